@@ -17,17 +17,30 @@ package cryptoio
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	log "github.com/golang/glog"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"lukechampine.com/uint128"
 	"github.com/pborman/uuid"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/standardencrypt"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/signingkey"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
 	"github.com/google/tink/go/aead"
 	"github.com/google/tink/go/core/registry"
@@ -46,6 +59,115 @@ const (
 	PublicKeysEnv = "AGGPUBLICKEYS"
 )
 
+// RetryParams contains the parameters for retrying the remote reads with exponential backoff.
+type RetryParams struct {
+	// Maximum number of attempts for each read, including the first one.
+	MaxAttempts int
+	// Backoff before the first retry, which is multiplied by Multiplier for each following retry and capped by MaxBackoff.
+	InitialBackoff, MaxBackoff time.Duration
+	Multiplier                 float64
+	// Deadline for each single attempt. No deadline is set if it is zero.
+	PerCallTimeout time.Duration
+}
+
+// DefaultRetryParams is used when reading keys and parameters from GCS or SecretManager.
+var DefaultRetryParams = &RetryParams{
+	MaxAttempts:    5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	PerCallTimeout: time.Minute,
+}
+
+// isRetryableError checks if an error returned by the remote storage is transient.
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Internal, codes.DeadlineExceeded:
+			return true
+		}
+	}
+	return false
+}
+
+// getBackoff calculates the jittered backoff before the retry after the given number of attempts.
+func getBackoff(params *RetryParams, attempt int) time.Duration {
+	backoff := float64(params.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		backoff *= params.Multiplier
+		if backoff > float64(params.MaxBackoff) {
+			backoff = float64(params.MaxBackoff)
+			break
+		}
+	}
+	// Jitter the backoff randomly within [backoff/2, backoff) so the workers do not retry at the same time.
+	half := int64(backoff) / 2
+	if half <= 0 {
+		return time.Duration(backoff)
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+// retryWithBackoff calls readFn until it succeeds, returns a non-retryable error, or the attempts are used up.
+func retryWithBackoff(ctx context.Context, params *RetryParams, desc string, readFn func(context.Context) error) error {
+	var err error
+	for attempt := 1; attempt <= params.MaxAttempts; attempt++ {
+		callCtx, cancel := ctx, context.CancelFunc(func() {})
+		if params.PerCallTimeout > 0 {
+			callCtx, cancel = context.WithTimeout(ctx, params.PerCallTimeout)
+		}
+		err = readFn(callCtx)
+		cancel()
+		if err == nil {
+			if attempt > 1 {
+				log.Infof("read %s succeeded after %d attempts", desc, attempt)
+			}
+			return nil
+		}
+		if !isRetryableError(err) || ctx.Err() != nil || attempt == params.MaxAttempts {
+			break
+		}
+
+		backoff := getBackoff(params, attempt)
+		log.Warningf("read %s failed (attempt %d/%d), retrying in %v: %v", desc, attempt, params.MaxAttempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+	return err
+}
+
+// readBytesWithRetry reads bytes from a local or remote file, retrying on transient errors.
+func readBytesWithRetry(ctx context.Context, filename string) ([]byte, error) {
+	var data []byte
+	err := retryWithBackoff(ctx, DefaultRetryParams, filename, func(ctx context.Context) error {
+		var err error
+		data, err = utils.ReadBytes(ctx, filename)
+		return err
+	})
+	return data, err
+}
+
+// readSecretWithRetry reads a secret from SecretManager, retrying on transient errors.
+func readSecretWithRetry(ctx context.Context, name string) ([]byte, error) {
+	var data []byte
+	err := retryWithBackoff(ctx, DefaultRetryParams, name, func(ctx context.Context) error {
+		var err error
+		data, err = utils.ReadSecret(ctx, name)
+		return err
+	})
+	return data, err
+}
+
 // SavePublicKeys saves the standard public keys and corresponding key IDs.
 //
 // Keys are saved as an environment variable when filePath is not empty; otherwise as a local or GCS file.
@@ -80,7 +202,7 @@ func ReadPublicKeys(ctx context.Context, filePath string) (*reporttypes.PublicKe
 			return nil, err
 		}
 	} else {
-		bKeys, err = utils.ReadBytes(ctx, filePath)
+		bKeys, err = readBytesWithRetry(ctx, filePath)
 		if err != nil {
 			return nil, err
 		}
@@ -90,6 +212,128 @@ func ReadPublicKeys(ctx context.Context, filePath string) (*reporttypes.PublicKe
 	return keys, err
 }
 
+// DefaultPublicKeyCacheTTL is the default time to keep the public keys in a PublicKeyCache.
+const DefaultPublicKeyCacheTTL = time.Hour
+
+// PublicKeyCache keeps the public keys read from files in the process, so the pipeline workers do not read the keys
+// for every bundle.
+//
+// The keys are read again after TTL, or when any of them expires. After half of that time, a read returns the cached
+// keys and refreshes them in the background, so the readers are not blocked by the refresh. Expired keys are not
+// returned.
+type PublicKeyCache struct {
+	TTL time.Duration
+
+	read func(ctx context.Context, uri string) (*reporttypes.PublicKeys, error)
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*publicKeyEntry
+}
+
+type publicKeyEntry struct {
+	keys       *reporttypes.PublicKeys
+	refreshAt  time.Time
+	expireAt   time.Time
+	refreshing bool
+}
+
+// NewPublicKeyCache creates a cache that keeps the keys for ttl.
+func NewPublicKeyCache(ttl time.Duration) *PublicKeyCache {
+	return &PublicKeyCache{
+		TTL:     ttl,
+		read:    ReadPublicKeys,
+		now:     time.Now,
+		entries: make(map[string]*publicKeyEntry),
+	}
+}
+
+var (
+	publicKeyCachesMu sync.Mutex
+	publicKeyCaches   = make(map[time.Duration]*PublicKeyCache)
+)
+
+// SharedPublicKeyCache returns the process-wide cache with the TTL, which is shared by the DoFns on a worker.
+func SharedPublicKeyCache(ttl time.Duration) *PublicKeyCache {
+	publicKeyCachesMu.Lock()
+	defer publicKeyCachesMu.Unlock()
+	c, ok := publicKeyCaches[ttl]
+	if !ok {
+		c = NewPublicKeyCache(ttl)
+		publicKeyCaches[ttl] = c
+	}
+	return c
+}
+
+// newPublicKeyEntry drops the expired keys, and sets the expiry of the entry no later than the first key expiry.
+func (c *PublicKeyCache) newPublicKeyEntry(uri string, keys *reporttypes.PublicKeys) (*publicKeyEntry, error) {
+	now := c.now()
+	entry := &publicKeyEntry{keys: &reporttypes.PublicKeys{}, expireAt: now.Add(c.TTL)}
+	for _, key := range keys.Keys {
+		if key.ExpireTime != nil {
+			if !now.Before(*key.ExpireTime) {
+				continue
+			}
+			if key.ExpireTime.Before(entry.expireAt) {
+				entry.expireAt = *key.ExpireTime
+			}
+		}
+		entry.keys.Keys = append(entry.keys.Keys, key)
+	}
+	if len(entry.keys.Keys) == 0 {
+		return nil, fmt.Errorf("no unexpired public key in %q", uri)
+	}
+	entry.refreshAt = now.Add(entry.expireAt.Sub(now) / 2)
+	return entry, nil
+}
+
+func (c *PublicKeyCache) refresh(uri string) {
+	keys, err := c.read(context.Background(), uri)
+	var entry *publicKeyEntry
+	if err == nil {
+		entry, err = c.newPublicKeyEntry(uri, keys)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		// The cached keys are used until they expire, and the refresh is tried again by the next read.
+		log.Warningf("failed to refresh public keys from %q: %v", uri, err)
+		if old, ok := c.entries[uri]; ok {
+			old.refreshing = false
+		}
+		return
+	}
+	c.entries[uri] = entry
+}
+
+// Get returns the unexpired public keys in the file.
+func (c *PublicKeyCache) Get(ctx context.Context, uri string) (*reporttypes.PublicKeys, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if entry, ok := c.entries[uri]; ok && now.Before(entry.expireAt) {
+		if !entry.refreshing && !now.Before(entry.refreshAt) {
+			entry.refreshing = true
+			go c.refresh(uri)
+		}
+		return entry.keys, nil
+	}
+
+	// The lock is held while reading, so concurrent readers of a missing entry wait for a single read.
+	keys, err := c.read(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := c.newPublicKeyEntry(uri, keys)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[uri] = entry
+	return entry.keys, nil
+}
+
 func getAEADForKMS(keyURI, credentialPath string) (tink.AEAD, error) {
 	var (
 		gcpclient registry.KMSClient
@@ -137,6 +381,58 @@ func KMSDecryptData(ctx context.Context, keyURI, credentialPath string, encrypte
 	return a.Decrypt(encryptedData, nil)
 }
 
+// KeyPurpose restricts what a private key of the helper can be used for. Each purpose has its own loader function,
+// which rejects the keys of the other purposes.
+type KeyPurpose string
+
+// Purposes of the private keys.
+const (
+	// Decrypting the reports, loaded with ReadStandardPrivateKey and ReadDecryptionKeyCollection. The decryption keys are
+	// stored as raw Tink keysets without a purpose, as the keys stored before the purposes were introduced.
+	PurposeReportDecryption KeyPurpose = "report_decryption"
+	// Signing the outputs of the helper, e.g. the result manifests, loaded with ReadSigningKey.
+	PurposeOutputSigning KeyPurpose = "output_signing"
+)
+
+// PurposeKey is the stored form of the private keys of the purposes other than report decryption. The purpose is
+// stored with the key material, under the same KMS encryption, so a key can not be loaded for another purpose by
+// listing it under that purpose.
+type PurposeKey struct {
+	Purpose KeyPurpose
+	// Key material in the encoding of the purpose, e.g. the base64-encoded Ed25519 seed for output signing.
+	Key string
+}
+
+// ErrWrongKeyPurpose is returned when a key is loaded for a purpose other than its own.
+var ErrWrongKeyPurpose = errors.New("key loaded for the wrong purpose")
+
+// KeyClaims records the purposes of the key material loaded by its owner, keyed by the SHA-256 hash of the material, so
+// the same key can not be loaded for two purposes even if it is stored under both. A caller loading keys of several
+// purposes shares one KeyClaims between the loaders with ReadStandardPrivateKeyParams.Claims. The zero value is ready to
+// use, and a nil KeyClaims records nothing.
+type KeyClaims struct {
+	mu       sync.Mutex
+	purposes map[[sha256.Size]byte]KeyPurpose
+}
+
+// claim records the purpose of the key material, and fails if it was loaded for another purpose before.
+func (c *KeyClaims) claim(key []byte, purpose KeyPurpose) error {
+	if c == nil {
+		return nil
+	}
+	hash := sha256.Sum256(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if loaded, ok := c.purposes[hash]; ok && loaded != purpose {
+		return fmt.Errorf("%w: key already loaded for %s, not %s", ErrWrongKeyPurpose, loaded, purpose)
+	}
+	if c.purposes == nil {
+		c.purposes = make(map[[sha256.Size]byte]KeyPurpose)
+	}
+	c.purposes[hash] = purpose
+	return nil
+}
+
 // ReadStandardPrivateKeyParams contains necessary parameters for function ReadStandardPrivateKey.
 type ReadStandardPrivateKeyParams struct {
 	// KMSKeyURI and KMSCredentialPath are required by Google Key Mangagement service.
@@ -147,26 +443,70 @@ type ReadStandardPrivateKeyParams struct {
 	SecretName string
 	// File path of the (encrypted) private key if it's not stored with SecretManager.
 	FilePath string
+	// After this time, the key is no longer tried for reports that can not be decrypted with the key of their key IDs.
+	// A zero value means the key does not expire.
+	ExpireTime time.Time
+	// Purposes of the keys loaded before by the same caller, which the key must not conflict with. Not recorded if nil.
+	Claims *KeyClaims `json:"-"`
 }
 
-// ReadStandardPrivateKey is called by the helper servers, which reads the standard private key.
-func ReadStandardPrivateKey(ctx context.Context, params *ReadStandardPrivateKeyParams) (*pb.StandardPrivateKey, error) {
+// readPrivateKey reads the key material if the stored key has the purpose. The stored keys that are not a PurposeKey
+// are report decryption keys.
+func readPrivateKey(ctx context.Context, params *ReadStandardPrivateKeyParams, purpose KeyPurpose) ([]byte, error) {
 	var (
 		data []byte
 		err  error
 	)
 	if params.SecretName != "" {
-		data, err = utils.ReadSecret(ctx, params.SecretName)
+		data, err = readSecretWithRetry(ctx, params.SecretName)
 	} else {
-		data, err = utils.ReadBytes(ctx, params.FilePath)
+		data, err = readBytesWithRetry(ctx, params.FilePath)
 	}
 	if err != nil {
 		return nil, err
 	}
 	if params.KMSKeyURI != "" {
-		data, err = KMSDecryptData(ctx, params.KMSKeyURI, params.KMSCredentialPath, data)
+		if data, err = KMSDecryptData(ctx, params.KMSKeyURI, params.KMSCredentialPath, data); err != nil {
+			return nil, err
+		}
+	}
+	stored := &PurposeKey{}
+	if err := json.Unmarshal(data, stored); err == nil && stored.Purpose != "" {
+		data = []byte(stored.Key)
+	} else {
+		stored.Purpose = PurposeReportDecryption
+	}
+	if stored.Purpose != purpose {
+		return nil, fmt.Errorf("%w: %s key loaded for %s", ErrWrongKeyPurpose, stored.Purpose, purpose)
+	}
+	if err := params.Claims.claim(data, purpose); err != nil {
+		return nil, err
 	}
-	return &pb.StandardPrivateKey{Key: data}, err
+	return data, nil
+}
+
+// ReadStandardPrivateKey is called by the helper servers, which reads the standard private key for decrypting reports.
+func ReadStandardPrivateKey(ctx context.Context, params *ReadStandardPrivateKeyParams) (*pb.StandardPrivateKey, error) {
+	data, err := readPrivateKey(ctx, params, PurposeReportDecryption)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.StandardPrivateKey{Key: data}, nil
+}
+
+// ReadSigningKey reads the Ed25519 key for signing the outputs, which is stored as a PurposeKey for output signing with
+// the base64-encoded seed.
+func ReadSigningKey(ctx context.Context, params *ReadStandardPrivateKeyParams) (ed25519.PrivateKey, error) {
+	data, err := readPrivateKey(ctx, params, PurposeOutputSigning)
+	if err != nil {
+		return nil, err
+	}
+	return signingkey.ParsePrivateKey(strings.TrimSpace(string(data)))
+}
+
+// EncodeSigningKey encodes the Ed25519 key for signing the outputs into the stored form read by ReadSigningKey.
+func EncodeSigningKey(key ed25519.PrivateKey) ([]byte, error) {
+	return json.Marshal(&PurposeKey{Purpose: PurposeOutputSigning, Key: base64.StdEncoding.EncodeToString(key.Seed())})
 }
 
 // SaveStandardPrivateKeyParams contains necessary parameters for function SaveStandardPrivateKey.
@@ -227,7 +567,7 @@ func SaveDPFParameters(ctx context.Context, filename string, params *pb.Incremen
 //
 // The file can be stored locally or in a GCS bucket (prefixed with 'gs://').
 func ReadPrefixes(ctx context.Context, filename string) ([][]uint128.Uint128, error) {
-	bPrefixes, err := utils.ReadBytes(ctx, filename)
+	bPrefixes, err := readBytesWithRetry(ctx, filename)
 	if err != nil {
 		return nil, err
 	}
@@ -242,7 +582,7 @@ func ReadPrefixes(ctx context.Context, filename string) ([][]uint128.Uint128, er
 //
 // The file can be stored locally or in a GCS bucket (prefixed with 'gs://').
 func ReadDPFParameters(ctx context.Context, filename string) (*pb.IncrementalDpfParameters, error) {
-	bParams, err := utils.ReadBytes(ctx, filename)
+	bParams, err := readBytesWithRetry(ctx, filename)
 	if err != nil {
 		return nil, err
 	}
@@ -264,7 +604,7 @@ func SavePrivateKeyParamsCollection(ctx context.Context, idKeys map[string]*Read
 
 // ReadPrivateKeyParamsCollection reads the information how the private keys can be read.
 func ReadPrivateKeyParamsCollection(ctx context.Context, filePath string) (map[string]*ReadStandardPrivateKeyParams, error) {
-	b, err := utils.ReadBytes(ctx, filePath)
+	b, err := readBytesWithRetry(ctx, filePath)
 	if err != nil {
 		return nil, err
 	}
@@ -275,8 +615,9 @@ func ReadPrivateKeyParamsCollection(ctx context.Context, filePath string) (map[s
 	return output, nil
 }
 
-// ReadPrivateKeyCollection reads the private storage information from a file, and then uses it to read the private keys.
-func ReadPrivateKeyCollection(ctx context.Context, filePath string) (map[string]*pb.StandardPrivateKey, error) {
+// ReadDecryptionKeyCollection reads the private storage information from a file, and then uses it to read the private
+// keys for decrypting reports. It fails if the collection has keys of other purposes.
+func ReadDecryptionKeyCollection(ctx context.Context, filePath string) (map[string]*pb.StandardPrivateKey, error) {
 	keyParams, err := ReadPrivateKeyParamsCollection(ctx, filePath)
 	if err != nil {
 		return nil, err
@@ -292,6 +633,18 @@ func ReadPrivateKeyCollection(ctx context.Context, filePath string) (map[string]
 	return keys, nil
 }
 
+// GetExpiredKeyIDs returns the sorted IDs of the keys that have expired at the given time.
+func GetExpiredKeyIDs(keyParams map[string]*ReadStandardPrivateKeyParams, now time.Time) []string {
+	var expired []string
+	for keyID, params := range keyParams {
+		if !params.ExpireTime.IsZero() && now.After(params.ExpireTime) {
+			expired = append(expired, keyID)
+		}
+	}
+	sort.Strings(expired)
+	return expired
+}
+
 // GenerateHybridKeyPairs generates encryption key pairs with specified valid time window.
 func GenerateHybridKeyPairs(ctx context.Context, keyCount int) (map[string]*pb.StandardPrivateKey, *reporttypes.PublicKeys, error) {
 	privKeys := make(map[string]*pb.StandardPrivateKey)
@@ -337,3 +690,41 @@ func DecryptOrUnmarshal(aggregatablePayload *pb.AggregatablePayload, privateKey
 	}
 	return payload, isEncrypted, nil
 }
+
+// DecryptWithFallback decrypts a report with the private key of its key ID, and then tries the fallback keys in order if
+// the key ID is missing, unknown or the decryption fails, since some producers omit or set wrong key IDs.
+//
+// The ID of the key that succeeded is returned so the key usage can be tracked. If no key works, the report is
+// unmarshalled as a non-encrypted payload like in DecryptOrUnmarshal(), and the returned key ID is empty.
+func DecryptWithFallback(aggregatablePayload *pb.AggregatablePayload, privateKeys map[string]*pb.StandardPrivateKey, fallbackKeyIDs []string) (*reporttypes.Payload, string, bool, error) {
+	candidates := []string{aggregatablePayload.KeyId}
+	for _, keyID := range fallbackKeyIDs {
+		if keyID != aggregatablePayload.KeyId {
+			candidates = append(candidates, keyID)
+		}
+	}
+
+	tried := 0
+	for _, keyID := range candidates {
+		privateKey, ok := privateKeys[keyID]
+		if !ok {
+			continue
+		}
+		tried++
+		b, err := standardencrypt.Decrypt(aggregatablePayload.Payload, []byte(aggregatablePayload.SharedInfo), privateKey)
+		if err != nil {
+			continue
+		}
+		payload := &reporttypes.Payload{}
+		if err := utils.UnmarshalCBOR(b, payload); err != nil {
+			return nil, keyID, true, err
+		}
+		return payload, keyID, true, nil
+	}
+
+	payload := &reporttypes.Payload{}
+	if err := utils.UnmarshalCBOR(aggregatablePayload.Payload.Data, payload); err != nil {
+		return nil, "", false, fmt.Errorf("failed to decrypt with %d keys and/or deserialize report: %s", tried, aggregatablePayload.String())
+	}
+	return payload, "", false, nil
+}
@@ -17,14 +17,21 @@ package cryptoio
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
 	"lukechampine.com/uint128"
@@ -172,6 +179,83 @@ func TestSaveReadPrivateKeyParamsCollection(t *testing.T) {
 	}
 }
 
+func TestReadKeysByPurpose(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "key_purposes")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	writeKey := func(name string, data []byte) *ReadStandardPrivateKeyParams {
+		filePath := path.Join(tmpDir, name)
+		if err := utils.WriteBytes(ctx, data, filePath, nil); err != nil {
+			t.Fatal(err)
+		}
+		return &ReadStandardPrivateKeyParams{FilePath: filePath}
+	}
+	want := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	encoded, err := EncodeSigningKey(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingParams := writeKey("signing_key", encoded)
+	decryptionParams := writeKey("decryption_key", []byte("decryption key"))
+
+	signingKey, err := ReadSigningKey(ctx, signingParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signingKey.Equal(want) {
+		t.Error("signing key mismatch")
+	}
+	if _, err := ReadStandardPrivateKey(ctx, decryptionParams); err != nil {
+		t.Fatalf("expect keys without purpose to be decryption keys, got %v", err)
+	}
+
+	// Each loader rejects the keys of the other purposes, which are stored with the key material.
+	if _, err := ReadSigningKey(ctx, decryptionParams); !errors.Is(err, ErrWrongKeyPurpose) {
+		t.Errorf("expect error %v for a decryption key loaded for signing, got %v", ErrWrongKeyPurpose, err)
+	}
+	if _, err := ReadStandardPrivateKey(ctx, signingParams); !errors.Is(err, ErrWrongKeyPurpose) {
+		t.Errorf("expect error %v for a signing key loaded for decryption, got %v", ErrWrongKeyPurpose, err)
+	}
+	unknownParams := writeKey("unknown_key", []byte(`{"Purpose":"unknown","Key":"a2V5"}`))
+	if _, err := ReadSigningKey(ctx, unknownParams); !errors.Is(err, ErrWrongKeyPurpose) {
+		t.Errorf("expect error %v for a key of unknown purpose loaded for signing, got %v", ErrWrongKeyPurpose, err)
+	}
+
+	// The same key material can not be loaded for another purpose by the same caller, even if it is stored under that
+	// purpose.
+	claims := &KeyClaims{}
+	decryptionParams.Claims = claims
+	if _, err := ReadStandardPrivateKey(ctx, decryptionParams); err != nil {
+		t.Fatal(err)
+	}
+	decryptionParams.Claims = nil
+	relabeled := writeKey("relabeled_key", []byte(`{"Purpose":"output_signing","Key":"decryption key"}`))
+	relabeled.Claims = claims
+	if _, err := ReadSigningKey(ctx, relabeled); !errors.Is(err, ErrWrongKeyPurpose) {
+		t.Errorf("expect error %v for a decryption key stored for signing, got %v", ErrWrongKeyPurpose, err)
+	}
+	// The claims are kept by their owner, so other callers are not affected.
+	relabeled.Claims = nil
+	if _, err := ReadSigningKey(ctx, relabeled); errors.Is(err, ErrWrongKeyPurpose) {
+		t.Errorf("expect the key loaded for signing without the claims of another caller, got %v", err)
+	}
+
+	collectionPath := path.Join(tmpDir, "key_params")
+	if err := SavePrivateKeyParamsCollection(ctx, map[string]*ReadStandardPrivateKeyParams{
+		"key_id_1": decryptionParams,
+		"key_id_2": signingParams,
+	}, collectionPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadDecryptionKeyCollection(ctx, collectionPath); !errors.Is(err, ErrWrongKeyPurpose) {
+		t.Errorf("expect error %v for a collection with a signing key, got %v", ErrWrongKeyPurpose, err)
+	}
+}
+
 func TestDecryptOrUnmarshal(t *testing.T) {
 	testDecryptOrUnmarshal(t, true /*encryptOutput*/)
 	testDecryptOrUnmarshal(t, false /*encryptOutput*/)
@@ -217,6 +301,76 @@ func testDecryptOrUnmarshal(t *testing.T, encryptOutput bool) {
 	}
 }
 
+func TestDecryptWithFallback(t *testing.T) {
+	ctx := context.Background()
+	privKeys, pubKeys, err := GenerateHybridKeyPairs(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &reporttypes.Payload{
+		Operation: "some operation",
+		DPFKey:    []byte("some key"),
+	}
+	data, err := utils.MarshalCBOR(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contextInfo := "some context"
+	keyID, pub, err := GetRandomPublicKey(pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := standardencrypt.Encrypt(data, []byte(contextInfo), pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var allKeyIDs []string
+	for id := range privKeys {
+		allKeyIDs = append(allKeyIDs, id)
+	}
+	sort.Strings(allKeyIDs)
+
+	for _, reportKeyID := range []string{keyID, "", "unknown-key"} {
+		got, gotKeyID, isEncrypted, err := DecryptWithFallback(&pb.AggregatablePayload{
+			Payload:    encrypted,
+			SharedInfo: contextInfo,
+			KeyId:      reportKeyID,
+		}, privKeys, allKeyIDs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isEncrypted || gotKeyID != keyID {
+			t.Errorf("expect report with key ID %q to be decrypted with key %q, got key %q and isEncrypted = %t", reportKeyID, keyID, gotKeyID, isEncrypted)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("decrypted payload mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	// Without the matching key in the fallback keys, the report can not be decrypted.
+	if _, _, _, err := DecryptWithFallback(&pb.AggregatablePayload{
+		Payload:    encrypted,
+		SharedInfo: contextInfo,
+	}, privKeys, nil /*fallbackKeyIDs*/); err == nil {
+		t.Error("expect error when no key can decrypt the report")
+	}
+}
+
+func TestGetExpiredKeyIDs(t *testing.T) {
+	now := time.Now()
+	keyParams := map[string]*ReadStandardPrivateKeyParams{
+		"no-expiry": {},
+		"expired-2": {ExpireTime: now.Add(-time.Hour)},
+		"expired-1": {ExpireTime: now.Add(-time.Minute)},
+		"active":    {ExpireTime: now.Add(time.Hour)},
+	}
+	want := []string{"expired-1", "expired-2"}
+	if diff := cmp.Diff(want, GetExpiredKeyIDs(keyParams, now)); diff != "" {
+		t.Errorf("expired key IDs mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func TestExtractPayloadsFromAggregatableReportOnepartyNoEncryption(t *testing.T) {
 	// The message generated by the test binary with contribution to a single bucket: <1234, 5>.
 	message := "{\"aggregation_service_payloads\":[{\"key_id\":\"id123\",\"payload\":\"omRkYXRhgaJldmFsdWVEAAAABWZidWNrZXRQAAAAAAAAAAAAAAAAAAAE0mlvcGVyYXRpb25paGlzdG9ncmFt\"}],\"shared_info\":\"{\\\"privacy_budget_key\\\":\\\"test_privacy_budget_key\\\",\\\"report_id\\\":\\\"c0eb0114-71ab-4811-9ae8-0c9eef442452\\\",\\\"reporting_origin\\\":\\\"https://example.com\\\",\\\"scheduled_report_time\\\":\\\"1648488303\\\",\\\"version\\\":\\\"\\\"}\"}"
@@ -379,3 +533,153 @@ func TestChromeEncryptionKeys(t *testing.T) {
 		t.Fatalf("want decrypted message %s, got %s", want, string(got))
 	}
 }
+
+func TestRetryWithBackoff(t *testing.T) {
+	params := &RetryParams{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     2 * time.Millisecond,
+		Multiplier:     2,
+		PerCallTimeout: time.Second,
+	}
+	transientErr := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	permanentErr := &googleapi.Error{Code: http.StatusForbidden}
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		desc         string
+		errs         []error
+		wantErr      error
+		wantAttempts int
+	}{
+		{"success", nil, nil, 1},
+		{"transient-then-success", []error{transientErr, transientErr}, nil, 3},
+		{"transient-exhausted", []error{transientErr, transientErr, transientErr}, transientErr, 3},
+		{"permanent", []error{permanentErr}, permanentErr, 1},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			attempts := 0
+			err := retryWithBackoff(ctx, params, tc.desc, func(ctx context.Context) error {
+				attempts++
+				if attempts <= len(tc.errs) {
+					return tc.errs[attempts-1]
+				}
+				return nil
+			})
+			if err != tc.wantErr {
+				t.Errorf("want error %v, got %v", tc.wantErr, err)
+			}
+			if attempts != tc.wantAttempts {
+				t.Errorf("want %d attempts, got %d", tc.wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestGetBackoff(t *testing.T) {
+	params := &RetryParams{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+	for _, tc := range []struct {
+		attempt  int
+		wantBase time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{10, time.Second},
+	} {
+		got := getBackoff(params, tc.attempt)
+		if got < tc.wantBase/2 || got >= tc.wantBase {
+			t.Errorf("want backoff in [%v, %v) for attempt %d, got %v", tc.wantBase/2, tc.wantBase, tc.attempt, got)
+		}
+	}
+}
+
+func TestPublicKeyCache(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		now   = time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+		reads int
+	)
+	expired, short := now.Add(-time.Minute), now.Add(30*time.Minute)
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+	getReads := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return reads
+	}
+
+	cache := NewPublicKeyCache(time.Hour)
+	cache.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	cache.read = func(ctx context.Context, uri string) (*reporttypes.PublicKeys, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		reads++
+		return &reporttypes.PublicKeys{Keys: []reporttypes.PublicKeyInfo{
+			{ID: "expired", Key: "key1", ExpireTime: &expired},
+			{ID: "short", Key: "key2", ExpireTime: &short},
+			{ID: "long", Key: "key3"},
+		}}, nil
+	}
+	keyIDs := func() []string {
+		keys, err := cache.Get(context.Background(), "keys")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, key := range keys.Keys {
+			ids = append(ids, key.ID)
+		}
+		return ids
+	}
+
+	// The entry expires with the key "short" after 30 minutes, and is refreshed in the background after 15 minutes.
+	if diff := cmp.Diff([]string{"short", "long"}, keyIDs()); diff != "" {
+		t.Errorf("key IDs mismatch (-want +got):\n%s", diff)
+	}
+	advance(10 * time.Minute)
+	keyIDs()
+	if got := getReads(); got != 1 {
+		t.Fatalf("expect cached keys before the refresh time, got %d reads", got)
+	}
+
+	advance(10 * time.Minute)
+	if diff := cmp.Diff([]string{"short", "long"}, keyIDs()); diff != "" {
+		t.Errorf("key IDs mismatch (-want +got):\n%s", diff)
+	}
+	for start := time.Now(); getReads() < 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("timeout waiting for the background refresh")
+		}
+	}
+
+	advance(11 * time.Minute)
+	if diff := cmp.Diff([]string{"long"}, keyIDs()); diff != "" {
+		t.Errorf("key IDs mismatch (-want +got):\n%s", diff)
+	}
+	if got := getReads(); got != 3 {
+		t.Errorf("expect the expired entry to be read again, got %d reads", got)
+	}
+}
+
+func TestPublicKeyCacheAllExpired(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	cache := NewPublicKeyCache(time.Hour)
+	cache.read = func(ctx context.Context, uri string) (*reporttypes.PublicKeys, error) {
+		return &reporttypes.PublicKeys{Keys: []reporttypes.PublicKeyInfo{{ID: "expired", Key: "key1", ExpireTime: &expired}}}, nil
+	}
+	if _, err := cache.Get(context.Background(), "keys"); err == nil {
+		t.Error("expect error when all the keys have expired")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 
+	"golang.org/x/exp/rand"
 	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/stat/distuv"
 )
@@ -33,3 +34,42 @@ func DistributedGeometricMechanismRand(epsilon float64, l1Sensitivity, numNoiseS
 	r, p := 1.0/float64(numNoiseShares), math.Exp(-epsilon/float64(l1Sensitivity))
 	return polyaRand(r, p) - polyaRand(r, p), nil
 }
+
+// GeometricMechanism is the name of the distributed two-sided geometric mechanism, which is also the default mechanism.
+const GeometricMechanism = "geometric"
+
+// DistributedGeometricMechanismRandVector draws n noise shares at once with DistributedGeometricMechanismRand().
+//
+// The parameters are checked and the distributions are created once for the whole batch, so the cost of generating
+// the noise for a vector does not scale with per-element function calls. If src is nil, the global random source is used;
+// a seeded source makes the noise reproducible, which should only be used for debugging.
+func DistributedGeometricMechanismRandVector(epsilon float64, l1Sensitivity, numNoiseShares uint64, n int, src rand.Source) ([]int64, error) {
+	roundingResult := float64(numNoiseShares) * (1.0 / float64(numNoiseShares))
+	if !floats.EqualWithinAbsOrRel(roundingResult, 1.0, 1e-6, 1e-6) {
+		return nil, fmt.Errorf("rounding error, expect numNoiseShares*(1/numNoiseShares) == 1, got %v", roundingResult)
+	}
+
+	r, p := 1.0/float64(numNoiseShares), math.Exp(-epsilon/float64(l1Sensitivity))
+	gamma := distuv.Gamma{Alpha: r, Beta: (1 - p) / p, Src: src}
+	poisson := distuv.Poisson{Src: src}
+	polya := func() int64 {
+		poisson.Lambda = gamma.Rand()
+		return int64(poisson.Rand())
+	}
+
+	noise := make([]int64, n)
+	for i := range noise {
+		noise[i] = polya() - polya()
+	}
+	return noise, nil
+}
+
+// NoiseVector draws n noise shares with the named mechanism. If src is nil, the global random source is used.
+func NoiseVector(mechanism string, epsilon float64, l1Sensitivity, numNoiseShares uint64, n int, src rand.Source) ([]int64, error) {
+	switch mechanism {
+	case "", GeometricMechanism:
+		return DistributedGeometricMechanismRandVector(epsilon, l1Sensitivity, numNoiseShares, n, src)
+	default:
+		return nil, fmt.Errorf("unsupported noise mechanism %q", mechanism)
+	}
+}
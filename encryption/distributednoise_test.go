@@ -4,6 +4,7 @@ import (
 	"math"
 	"testing"
 
+	"golang.org/x/exp/rand"
 	"gonum.org/v1/gonum/floats"
 	"github.com/grd/stat"
 )
@@ -55,3 +56,53 @@ func TestGeometricMechanismNoise(t *testing.T) {
 		}
 	}
 }
+
+func TestGeometricMechanismNoiseVector(t *testing.T) {
+	const (
+		numberOfSamples = 1e6
+		tolerance       = 1e-2
+		numNoiseShares  = 2
+		l1Sensitivity   = 2
+		epsilon         = 0.5
+	)
+
+	p := math.Exp(-epsilon / float64(l1Sensitivity))
+	wantMean, wantVariance := 0.0, 2*p/((1.0-p)*(1.0-p))
+	noisedSamples := make(stat.Float64Slice, numberOfSamples)
+	for j := 0; j < numNoiseShares; j++ {
+		noise, err := NoiseVector(GeometricMechanism, epsilon, l1Sensitivity, numNoiseShares, numberOfSamples, nil /*src*/)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range noise {
+			noisedSamples[i] += float64(noise[i])
+		}
+	}
+	gotMean, gotVariance := stat.Mean(noisedSamples), stat.Variance(noisedSamples)
+	if !floats.EqualWithinAbsOrRel(gotMean, wantMean, tolerance, tolerance) {
+		t.Errorf("Mean mismatch, want: %v, got: %v", wantMean, gotMean)
+	}
+	if !floats.EqualWithinAbsOrRel(gotVariance, wantVariance, tolerance, tolerance) {
+		t.Errorf("Variance mismatch, want: %v, got: %v", wantVariance, gotVariance)
+	}
+
+	if _, err := NoiseVector("unknown", epsilon, l1Sensitivity, numNoiseShares, 1, nil /*src*/); err == nil {
+		t.Error("expect error for unsupported noise mechanism")
+	}
+}
+
+func TestSeededNoiseVector(t *testing.T) {
+	noise1, err := NoiseVector(GeometricMechanism, 0.5, 1, 2, 100, rand.NewSource(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noise2, err := NoiseVector(GeometricMechanism, 0.5, 1, 2, 100, rand.NewSource(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range noise1 {
+		if noise1[i] != noise2[i] {
+			t.Fatalf("expect the same noise with the same seed, got %d and %d at index %d", noise1[i], noise2[i], i)
+		}
+	}
+}
@@ -726,6 +726,48 @@ func GetDefaultDPFParameters(keyBitSize int) ([]*dpfpb.DpfParameters, error) {
 	return allParams, nil
 }
 
+// GetDPFParametersWithGranularity generates the DPF parameters with a hierarchy at every granularity bits of the prefix length.
+//
+// The last hierarchy always covers the full keyBitSize. With granularity 1, the result is the same as GetDefaultDPFParameters().
+func GetDPFParametersWithGranularity(keyBitSize, granularity int) ([]*dpfpb.DpfParameters, error) {
+	if keyBitSize <= 0 {
+		return nil, fmt.Errorf("keyBitSize should be positive, got %d", keyBitSize)
+	}
+	if granularity <= 0 {
+		return nil, fmt.Errorf("granularity should be positive, got %d", granularity)
+	}
+	var allParams []*dpfpb.DpfParameters
+	for i := granularity; ; i += granularity {
+		if i > keyBitSize {
+			i = keyBitSize
+		}
+		allParams = append(allParams, &dpfpb.DpfParameters{
+			LogDomainSize: int32(i),
+			ValueType: &dpfpb.ValueType{
+				Type: &dpfpb.ValueType_Integer_{
+					Integer: &dpfpb.ValueType_Integer{
+						Bitsize: DefaultElementBitSize,
+					},
+				},
+			},
+		})
+		if i == keyBitSize {
+			break
+		}
+	}
+	return allParams, nil
+}
+
+// GetHierarchyLevel gets the hierarchy level in the DPF parameters for the given prefix length.
+func GetHierarchyLevel(params []*dpfpb.DpfParameters, prefixLength int32) (int32, error) {
+	for i, p := range params {
+		if p.GetLogDomainSize() == prefixLength {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("prefix length %d is not a hierarchy in the DPF parameters", prefixLength)
+}
+
 func getTupleDPFParametersFullHierarchy(keyBitSize int) ([]*dpfpb.DpfParameters, error) {
 	if keyBitSize <= 0 {
 		return nil, fmt.Errorf("keyBitSize should be positive, got %d", keyBitSize)
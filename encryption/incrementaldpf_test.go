@@ -445,6 +445,48 @@ func TestGetVectorLength(t *testing.T) {
 	}
 }
 
+func TestGetDPFParametersWithGranularity(t *testing.T) {
+	for _, tc := range []struct {
+		keyBitSize, granularity int
+		want                    []int32
+	}{
+		{keyBitSize: 4, granularity: 1, want: []int32{1, 2, 3, 4}},
+		{keyBitSize: 8, granularity: 4, want: []int32{4, 8}},
+		{keyBitSize: 10, granularity: 4, want: []int32{4, 8, 10}},
+		{keyBitSize: 3, granularity: 4, want: []int32{3}},
+	} {
+		params, err := GetDPFParametersWithGranularity(tc.keyBitSize, tc.granularity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int32
+		for i, p := range params {
+			got = append(got, p.GetLogDomainSize())
+			level, err := GetHierarchyLevel(params, p.GetLogDomainSize())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if level != int32(i) {
+				t.Errorf("expect level %d for prefix length %d, got %d", i, p.GetLogDomainSize(), level)
+			}
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("prefix lengths mismatch for key bit size %d and granularity %d (-want +got):\n%s", tc.keyBitSize, tc.granularity, diff)
+		}
+	}
+
+	params, err := GetDPFParametersWithGranularity(8, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetHierarchyLevel(params, 2); err == nil {
+		t.Error("expect error for prefix length not in the hierarchies")
+	}
+	if _, err := GetDPFParametersWithGranularity(8, 0); err == nil {
+		t.Error("expect error for non-positive granularity")
+	}
+}
+
 func TestReachUint64TupleDpfGenEvalFunctions(t *testing.T) {
 	os.Setenv("GODEBUG", "cgocheck=2")
 	params := CreateReachUint64TupleDpfParameters(17)
@@ -0,0 +1,138 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shamir splits secrets into shares with Shamir's secret sharing over GF(2^8), so that any threshold number of
+// shares recover the secret while fewer shares reveal nothing about it.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Share is one share of a secret. Each byte of the secret is shared with an independent polynomial, which is
+// evaluated at X.
+type Share struct {
+	X    byte
+	Data []byte
+}
+
+// gfMul multiplies two elements of GF(2^8) with the AES reduction polynomial x^8 + x^4 + x^3 + x + 1.
+func gfMul(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse of a nonzero element, which is a^254.
+func gfInv(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 254; i++ {
+		result = gfMul(result, a)
+	}
+	return result
+}
+
+// evaluate evaluates the polynomial with the coefficients in ascending order at x.
+func evaluate(coefficients []byte, x byte) byte {
+	var y byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coefficients[i]
+	}
+	return y
+}
+
+// Split splits the secret into n shares, any threshold of which recover the secret.
+func Split(secret []byte, n, threshold int) ([]*Share, error) {
+	if threshold < 2 || threshold > n {
+		return nil, fmt.Errorf("expect threshold in [2, %d], got %d", n, threshold)
+	}
+	if n > 255 {
+		return nil, fmt.Errorf("expect at most 255 shares, got %d", n)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+
+	shares := make([]*Share, n)
+	for i := range shares {
+		shares[i] = &Share{X: byte(i + 1), Data: make([]byte, len(secret))}
+	}
+	coefficients := make([]byte, threshold)
+	for j, b := range secret {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			share.Data[j] = evaluate(coefficients, share.X)
+		}
+	}
+	return shares, nil
+}
+
+// Combine recovers the secret from the shares with Lagrange interpolation at zero. The result is only correct if at
+// least the threshold number of shares of the same secret are given.
+func Combine(shares []*Share) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("expect at least 2 shares, got %d", len(shares))
+	}
+	length := len(shares[0].Data)
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if share.X == 0 {
+			return nil, errors.New("share with x-coordinate 0")
+		}
+		if seen[share.X] {
+			return nil, fmt.Errorf("duplicate share with x-coordinate %d", share.X)
+		}
+		seen[share.X] = true
+		if len(share.Data) != length {
+			return nil, fmt.Errorf("expect shares of %d bytes, got %d", length, len(share.Data))
+		}
+	}
+
+	// The Lagrange basis polynomials at zero, where subtraction in GF(2^8) is XOR.
+	basis := make([]byte, len(shares))
+	for i, si := range shares {
+		num, den := byte(1), byte(1)
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			num = gfMul(num, sj.X)
+			den = gfMul(den, si.X^sj.X)
+		}
+		basis[i] = gfMul(num, gfInv(den))
+	}
+
+	secret := make([]byte, length)
+	for k := range secret {
+		for i, share := range shares {
+			secret[k] ^= gfMul(share.Data[k], basis[i])
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGFInv(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := gfMul(byte(a), gfInv(byte(a))); got != 1 {
+			t.Fatalf("%d * inv(%d) = %d, want 1", a, a, got)
+		}
+	}
+}
+
+func TestSplitAndCombine(t *testing.T) {
+	secret := []byte("helper private key")
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("expect 5 shares, got %d", len(shares))
+	}
+
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var selected []*Share
+		for _, i := range subset {
+			selected = append(selected, shares[i])
+		}
+		got, err := Combine(selected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Errorf("combining shares %v got %q, want %q", subset, got, secret)
+		}
+	}
+
+	got, err := Combine(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Error("expect fewer shares than the threshold not to recover the secret")
+	}
+}
+
+func TestSplitAndCombineError(t *testing.T) {
+	if _, err := Split([]byte("secret"), 3, 4); err == nil {
+		t.Error("expect error for threshold larger than the share count")
+	}
+	if _, err := Split([]byte("secret"), 3, 1); err == nil {
+		t.Error("expect error for threshold smaller than 2")
+	}
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Combine([]*Share{shares[0], shares[0]}); err == nil {
+		t.Error("expect error for duplicate shares")
+	}
+}
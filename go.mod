@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	cloud.google.com/go v0.87.0
+	cloud.google.com/go/bigquery v1.32.0
   cloud.google.com/go/firestore v1.6.1
 	cloud.google.com/go/profiler v0.3.0
 	cloud.google.com/go/pubsub v1.13.0
@@ -23,6 +24,7 @@ require (
 	github.com/grd/stat v0.0.0-20130623202159-138af3fd5012
 	github.com/pborman/uuid v1.2.1
 	github.com/ugorji/go/codec v1.2.6
+	golang.org/x/exp v0.0.0-20200224162631-6cc2880d07d6
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	gonum.org/v1/gonum v0.8.2
 	google.golang.org/api v0.50.0
@@ -27,19 +27,37 @@
 // --max_num_workers=<number> (optional)
 // --worker_machine_type=<GCE instance type> (optional)
 // --job_name=<unique ongoing job name> (optional)
+//
+// Several independent batches, e.g. of helpers with many small origins, can be aggregated in one job to amortize the
+// startup cost with '--batches_uri', which points to a JSON list of dpfaggregator.BatchParams. Each batch gets its own
+// partial histogram and, if the ManifestURI is set, a manifest with the hashes of the histogram files, which is signed
+// with the key in '--result_signing_key_secret' like the manifests written by the helper servers. The flags for the
+// single batch input and outputs are ignored in this mode.
+//
+// Reports added to a batch after its first level, e.g. late reports, can be passed encrypted with '--late_report_uri'
+// while '--partial_report_uri' points to the saved evaluation context of the batch. Only the late reports are decrypted.
+//
+// On failure, the binary exits with the code of the failure class documented in package failurereport, and writes
+// the failure report to '--failure_report_uri' if set.
 package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"flag"
+	"fmt"
 	"math"
+	"time"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/log"
 	"github.com/apache/beam/sdks/go/pkg/beam/x/beamx"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/failurereport"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelineutils"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/strictprivacy"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
 
 	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
@@ -50,9 +68,14 @@ var (
 	expandParametersURI = flag.String("expand_parameters_uri", "", "Input URI of the expansion parameter file.")
 	partialHistogramURI = flag.String("partial_histogram_uri", "", "Output location of partial aggregation.")
 	decryptedReportURI  = flag.String("decrypted_report_uri", "", "Output location of the decrypted partial reports for hierarchical query so the helper won't need to do the decryption repeatedly.")
-	keyBitSize          = flag.Int("key_bit_size", 32, "Bit size of the data bucket keys. Support up to 128 bit.")
+	expansionStatsURI   = flag.String("expansion_stats_uri", "", "Output location of the expansion statistics for the current level. The statistics are not written if empty.")
+	batchesURI          = flag.String("batches_uri", "", "Input JSON list of independent batches aggregated in one job, each with its own input and outputs. If set, --partial_report_uri and the other single batch locations are ignored.")
+	keyBitSize          = flag.Int("key_bit_size", 32, "Bit size of the data bucket keys. Support up to 128 bit. Overridden by the batch metadata if --batch_metadata_uri is set.")
+	batchMetadataURI    = flag.String("batch_metadata_uri", "", "Metadata of the input batch with the key bit size of its reports, of type dpfaggregator.BatchMetadata. If --key_bit_size is also set, the two must agree.")
 	privateKeyParamsURI = flag.String("private_key_params_uri", "", "Input file that stores the parameters required to read the standard private keys.")
 
+	lateReportURI = flag.String("late_report_uri", "", "Input encrypted partial reports added to the batch after the evaluation context in --partial_report_uri was saved. Only these reports are decrypted at the levels after the first.")
+
 	directCombine = flag.Bool("direct_combine", false, "Use direct or segmented combine when aggregating the expanded vectors.")
 	segmentLength = flag.Uint64("segment_length", 32768, "Segment length to split the original vectors.")
 
@@ -61,64 +84,289 @@ var (
 	// https://github.com/WICG/conversion-measurement-api/blob/main/AGGREGATE.md#privacy-budgeting
 	l1Sensitivity = flag.Uint64("l1_sensitivity", uint64(math.Pow(2, 16)), "L1-sensitivity for the privacy budget.")
 
-	fileShards = flag.Int64("file_shards", 10, "The number of shards for the output file.")
+	noiseMechanism = flag.String("noise_mechanism", "geometric", "Mechanism for the noise added to the aggregation results when epsilon is positive.")
+	noiseSeed      = flag.Uint64("noise_seed", 0, "Seed for reproducible noise, only for debugging batches such as shadow runs. Zero means the noise is not seeded.")
+
+	fileShards       = flag.Int64("file_shards", 0, "The number of shards for the decrypted reports saved at the first level. If zero, it is picked from the input size with --target_shard_mb. The partial histograms of the levels are not sharded.")
+	targetShardMB    = flag.Int64("target_shard_mb", pipelineutils.DefaultTargetShardBytes>>20, "Target size in MB of the decrypted report shards when --file_shards is not set. The input size bounds the size of the decrypted reports.")
+	mmapLocalReports = flag.Bool("mmap_local_reports", false, "Read the local input reports through memory mappings, which is faster for very large files with the direct runner. Not supported for GCS inputs.")
+
+	elementsPerBundle         = flag.Int64("elements_per_bundle", 0, "Number of reports expanded in one bundle. If zero, it is tuned with --previous_expansion_stats_uri and --target_bundle_millis.")
+	previousExpansionStatsURI = flag.String("previous_expansion_stats_uri", "", "Expansion statistics of the previous level, used to estimate the expansion cost per report. Ignored if the file does not exist.")
+	targetBundleMillis        = flag.Int64("target_bundle_millis", 0, "Target time for expanding the reports in one bundle when tuning the bundle size.")
+	preemptMemoryMB           = flag.Int64("preempt_memory_mb", 0, "Resident memory in MB of a worker above which the bundles of reports are pre-empted and the rest of their reports re-split into smaller bundles, e.g. 80% of the worker memory. The reports are rebundled for the pre-emption if the bundle size is neither set nor tuned, and bundles are not pre-empted if zero.")
+
+	strictPrivacy = flag.Bool("strict_privacy", false, "Reject aggregations without noise or with seeded noise unless --debug_batch is set.")
+	debugBatch    = flag.Bool("debug_batch", false, "Whether the input is a debug batch, which is allowed to be aggregated without noise or with seeded noise in strict privacy mode.")
+
+	consistencyShareURI   = flag.String("consistency_share_uri", "", "Output location of the share sums of the sampled reports for the consistency check. Only allowed with --debug_batch.")
+	consistencySampleRate = flag.Float64("consistency_sample_rate", 0.01, "Fraction of the reports sampled for the consistency check.")
+	consistencySeed       = flag.Uint64("consistency_seed", 0, "Seed shared by the helpers to sample the same reports for the consistency check.")
+
+	dataQualitySummaryURI       = flag.String("data_quality_summary_uri", "", "Output summary of the report count of the helper at the first level, protected with a reserved fraction of the privacy budget of the level. The summary is not written if empty.")
+	dataQualityBudgetFraction   = flag.Float64("data_quality_budget_fraction", 0.05, "Fraction of the privacy budget of the first level reserved for the data quality summary, which must be in (0, 1) when --epsilon is positive.")
+	dataQualityCountSensitivity = flag.Uint64("data_quality_count_sensitivity", 1, "Maximum number of reports contributed by one user, which is the sensitivity of the report count in the data quality summary.")
+
+	traceURI        = flag.String("trace_uri", "", "Output location of the trace records of the sampled reports, for debugging missing reports. The reports are not traced if empty.")
+	traceReportURI  = flag.String("trace_report_uri", "", "Encrypted input reports sampled for the trace when --partial_report_uri contains the decrypted reports, which is required at the levels after the first. The input reports are sampled if empty.")
+	traceSampleRate = flag.Float64("trace_sample_rate", 0.001, "Fraction of the reports traced, which is at most 0.01.")
+	traceSeed       = flag.Uint64("trace_seed", 0, "Seed shared by the helpers and the levels of a query to trace the same reports.")
+
+	resultSigningKeySecret = flag.String("result_signing_key_secret", "", "Secret Manager version of the key used to sign the manifests of the batches in --batches_uri, stored as the JSON {\"Purpose\":\"output_signing\",\"Key\":\"<base64-encoded Ed25519 seed>\"}. The manifests are unsigned if empty.")
+
+	failureReportURI = flag.String("failure_report_uri", "", "Output location of the JSON failure report written when the binary fails.")
 )
 
+// readBatchKeyBitSize reads the key bit size from the batch metadata, which must agree with --key_bit_size if the flag
+// is set explicitly.
+func readBatchKeyBitSize(ctx context.Context, uri string) (int, error) {
+	metadata, err := dpfaggregator.ReadBatchMetadata(ctx, uri)
+	if err != nil {
+		return 0, err
+	}
+	var requested int32
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "key_bit_size" {
+			requested = int32(*keyBitSize)
+		}
+	})
+	keyBits, err := dpfaggregator.ResolveKeyBitSize(requested, metadata)
+	return int(keyBits), err
+}
+
 func main() {
 	flag.Parse()
 	beam.Init()
 
 	ctx := context.Background()
+	reporter := &failurereport.Reporter{Binary: "dpf_aggregate_partial_report_pipeline", URI: *failureReportURI}
+	if err := strictprivacy.Check(*strictPrivacy, &strictprivacy.Params{
+		Epsilon:   *epsilon,
+		NoiseSeed: *noiseSeed,
+		Debug:     *debugBatch,
+	}); err != nil {
+		reporter.Exit(ctx, failurereport.Wrap(failurereport.ClassPrivacyPolicy, failurereport.StageValidate, err))
+	}
+
 	expandParams, err := dpfaggregator.ReadExpandParameters(ctx, *expandParametersURI)
 	if err != nil {
-		log.Exit(ctx, err)
+		reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInvalidArgument, failurereport.StageValidate, *expandParametersURI, err))
 	}
 
-	inputGlob := pipelineutils.AddStrInPath(*partialReportURI, "*")
-	inputExist, err := utils.IsFileGlobExist(ctx, inputGlob)
-	if err != nil {
-		log.Exit(ctx, err)
-	} else if !inputExist {
-		log.Exitf(ctx, "input not found: %q", inputGlob)
+	batches := []*dpfaggregator.BatchParams{{
+		PartialReportURI:       *partialReportURI,
+		PartialHistogramURI:    *partialHistogramURI,
+		DecryptedReportURI:     *decryptedReportURI,
+		ExpansionStatisticsURI: *expansionStatsURI,
+		LateReportURI:          *lateReportURI,
+		MetadataURI:            *batchMetadataURI,
+	}}
+	if *batchesURI != "" {
+		if batches, err = dpfaggregator.ReadBatchParams(ctx, *batchesURI); err != nil {
+			reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInvalidArgument, failurereport.StageValidate, *batchesURI, err))
+		}
+	}
+	for _, batch := range batches {
+		if batch.MetadataURI != "" {
+			keyBits, err := readBatchKeyBitSize(ctx, batch.MetadataURI)
+			if err != nil {
+				reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInvalidArgument, failurereport.StageValidate, batch.MetadataURI, err))
+			}
+			batch.KeyBitSize = keyBits
+		}
+		inputGlob := pipelineutils.AddStrInPath(batch.PartialReportURI, "*")
+		for _, uri := range []string{batch.PartialReportURI, batch.LateReportURI} {
+			if uri == "" {
+				continue
+			}
+			glob := pipelineutils.AddStrInPath(uri, "*")
+			inputExist, err := utils.IsFileGlobExist(ctx, glob)
+			if err != nil {
+				reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInputNotFound, failurereport.StageReadInput, uri, err))
+			} else if !inputExist {
+				reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInputNotFound, failurereport.StageReadInput, uri, fmt.Errorf("input not found: %q", glob)))
+			}
+		}
+		if batch.Shards > 0 {
+			continue
+		}
+		if batch.Shards = *fileShards; batch.Shards <= 0 {
+			// The decrypted reports are smaller than the encrypted input, so the input size bounds the output size.
+			inputSize, err := pipelineutils.TotalFileSize(ctx, inputGlob)
+			if err != nil {
+				reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInputNotFound, failurereport.StageReadInput, batch.PartialReportURI, err))
+			}
+			batch.Shards = pipelineutils.ShardCount(inputSize, *targetShardMB<<20)
+		}
+		log.Infof(ctx, "Output data of batch %q written to %v file shards", batch.BatchID, batch.Shards)
 	}
 
-	var helperPrivKeys map[string]*pb.StandardPrivateKey
-	// Private keys are only needed when aggregating the partial reports for the first time.
-	// Otherwise partialReportURI should point to the decrypted reports.
-	if expandParams.PreviousLevel == -1 {
-		helperPrivKeys, err = cryptoio.ReadPrivateKeyCollection(ctx, *privateKeyParamsURI)
+	hasLateReports := false
+	for _, batch := range batches {
+		hasLateReports = hasLateReports || batch.LateReportURI != ""
+	}
+	var (
+		helperPrivKeys map[string]*pb.StandardPrivateKey
+		expiredKeyIDs  []string
+	)
+	// Private keys are only needed when aggregating the partial reports for the first time, or for decrypting the late
+	// or the traced reports. Otherwise partialReportURI should point to the decrypted reports.
+	if expandParams.PreviousLevel == -1 || hasLateReports || *traceURI != "" {
+		helperPrivKeys, err = cryptoio.ReadDecryptionKeyCollection(ctx, *privateKeyParamsURI)
+		if err != nil {
+			reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassKeyError, failurereport.StageReadKeys, *privateKeyParamsURI, err))
+		}
+		keyParams, err := cryptoio.ReadPrivateKeyParamsCollection(ctx, *privateKeyParamsURI)
 		if err != nil {
-			log.Exit(ctx, err)
+			reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassKeyError, failurereport.StageReadKeys, *privateKeyParamsURI, err))
 		}
-		if *decryptedReportURI == "" && !expandParams.DirectExpansion {
-			log.Exitf(ctx, "expect non-empty output decrypt report URI")
+		expiredKeyIDs = cryptoio.GetExpiredKeyIDs(keyParams, time.Now())
+	}
+	var signingKey ed25519.PrivateKey
+	if *resultSigningKeySecret != "" {
+		if signingKey, err = cryptoio.ReadSigningKey(ctx, &cryptoio.ReadStandardPrivateKeyParams{SecretName: *resultSigningKeySecret}); err != nil {
+			reporter.Exit(ctx, failurereport.Wrap(failurereport.ClassKeyError, failurereport.StageReadKeys, err))
+		}
+	}
+	if expandParams.PreviousLevel == -1 {
+		for _, batch := range batches {
+			if batch.DecryptedReportURI == "" && !expandParams.DirectExpansion {
+				reporter.Exitf(ctx, failurereport.ClassInvalidArgument, failurereport.StageValidate, "expect non-empty output decrypt report URI for batch %q", batch.BatchID)
+			}
 		}
 	}
 
-	log.Infof(ctx, "Output data written to %v file shards", *fileShards)
+	var consistencyCheck *dpfaggregator.ConsistencyCheckParams
+	if *consistencyShareURI != "" && expandParams.PreviousLevel == -1 {
+		if *batchesURI != "" {
+			reporter.Exitf(ctx, failurereport.ClassInvalidArgument, failurereport.StageValidate, "the consistency check is not supported with --batches_uri")
+		}
+		if !*debugBatch {
+			reporter.Exitf(ctx, failurereport.ClassPrivacyPolicy, failurereport.StageValidate, "the consistency check reveals report values and is only allowed with --debug_batch")
+		}
+		consistencyCheck = &dpfaggregator.ConsistencyCheckParams{
+			ShareURI:   *consistencyShareURI,
+			Seed:       *consistencySeed,
+			SampleRate: *consistencySampleRate,
+		}
+	}
+
+	var dataQuality *dpfaggregator.DataQualityParams
+	if *dataQualitySummaryURI != "" && expandParams.PreviousLevel == -1 {
+		if *batchesURI != "" {
+			reporter.Exitf(ctx, failurereport.ClassInvalidArgument, failurereport.StageValidate, "the data quality summary is not supported with --batches_uri")
+		}
+		dataQuality = &dpfaggregator.DataQualityParams{
+			SummaryURI:       *dataQualitySummaryURI,
+			BudgetFraction:   *dataQualityBudgetFraction,
+			CountSensitivity: *dataQualityCountSensitivity,
+		}
+		if err := dataQuality.Validate(*epsilon); err != nil {
+			reporter.Exit(ctx, failurereport.Wrap(failurereport.ClassPrivacyPolicy, failurereport.StageValidate, err))
+		}
+	}
 
+	var trace *dpfaggregator.TraceParams
+	if *traceURI != "" {
+		if *batchesURI != "" {
+			reporter.Exitf(ctx, failurereport.ClassInvalidArgument, failurereport.StageValidate, "report tracing is not supported with --batches_uri")
+		}
+		trace = &dpfaggregator.TraceParams{
+			TraceURI:           *traceURI,
+			EncryptedReportURI: *traceReportURI,
+			Seed:               *traceSeed,
+			SampleRate:         *traceSampleRate,
+		}
+	}
+
+	var previousStats *pb.ExpansionStatistics
+	if *elementsPerBundle == 0 && *previousExpansionStatsURI != "" && *targetBundleMillis > 0 {
+		exist, err := utils.IsFileGlobExist(ctx, *previousExpansionStatsURI)
+		if err != nil {
+			reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInputNotFound, failurereport.StageReadInput, *previousExpansionStatsURI, err))
+		}
+		if exist {
+			if previousStats, err = dpfaggregator.ReadExpansionStatistics(ctx, *previousExpansionStatsURI); err != nil {
+				reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInvalidArgument, failurereport.StageReadInput, *previousExpansionStatsURI, err))
+			}
+		} else {
+			log.Warnf(ctx, "expansion statistics %q not found, bundle size is not tuned", *previousExpansionStatsURI)
+		}
+	}
+
+	if *noiseSeed != 0 {
+		log.Warnf(ctx, "Noise is seeded with %d, which should only be used for debugging", *noiseSeed)
+	}
 	pipeline := beam.NewPipeline()
 	scope := pipeline.Root()
-	if err := dpfaggregator.AggregatePartialReport(
-		scope,
-		&dpfaggregator.AggregatePartialReportParams{
-			PartialReportURI:    *partialReportURI,
-			PartialHistogramURI: *partialHistogramURI,
-			DecryptedReportURI:  *decryptedReportURI,
-			HelperPrivateKeys:   helperPrivKeys,
-			ExpandParams:        expandParams,
-			KeyBitSize:          *keyBitSize,
-			CombineParams: &dpfaggregator.CombineParams{
-				DirectCombine: *directCombine,
-				SegmentLength: *segmentLength,
-				Epsilon:       *epsilon,
-				L1Sensitivity: *l1Sensitivity,
-			},
-			Shards: *fileShards,
-		}); err != nil {
-		log.Exit(ctx, err)
+	params := &dpfaggregator.AggregatePartialReportParams{
+		HelperPrivateKeys: helperPrivKeys,
+		ExpiredKeyIDs:     expiredKeyIDs,
+		ExpandParams:      expandParams,
+		KeyBitSize:        *keyBitSize,
+		CombineParams: &dpfaggregator.CombineParams{
+			DirectCombine:  *directCombine,
+			SegmentLength:  *segmentLength,
+			Epsilon:        *epsilon,
+			L1Sensitivity:  *l1Sensitivity,
+			NoiseMechanism: *noiseMechanism,
+			NoiseSeed:      *noiseSeed,
+		},
+		MmapLocalFiles:     *mmapLocalReports,
+		ElementsPerBundle:  *elementsPerBundle,
+		PreviousStatistics: previousStats,
+		TargetBundleMillis: *targetBundleMillis,
+		PreemptMemoryBytes: uint64(*preemptMemoryMB) << 20,
+		ConsistencyCheck:   consistencyCheck,
+		Trace:              trace,
+		DataQuality:        dataQuality,
+	}
+	if *batchesURI != "" {
+		err = dpfaggregator.AggregatePartialReportBatches(scope, params, batches)
+	} else {
+		params.PartialReportURI = *partialReportURI
+		params.PartialHistogramURI = *partialHistogramURI
+		params.DecryptedReportURI = *decryptedReportURI
+		params.ExpansionStatisticsURI = *expansionStatsURI
+		params.LateReportURI = *lateReportURI
+		params.Shards = batches[0].Shards
+		if batches[0].KeyBitSize > 0 {
+			params.KeyBitSize = batches[0].KeyBitSize
+		}
+		err = dpfaggregator.AggregatePartialReport(scope, params)
+	}
+	if err != nil {
+		reporter.Exit(ctx, failurereport.Wrap(failurereport.ClassInvalidArgument, failurereport.StageValidate, err))
 	}
 	if err := beamx.Run(ctx, pipeline); err != nil {
-		log.Exitf(ctx, "Failed to execute job: %s", err)
+		// The failing batch is unknown in the multi-batch mode, so only the single input is reported.
+		reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassPipelineFailed, failurereport.StageRunPipeline, *partialReportURI, fmt.Errorf("failed to execute job: %v", err)))
+	}
+
+	for _, batch := range batches {
+		if batch.ManifestURI == "" {
+			continue
+		}
+		files, err := resultmanifest.HashFiles(ctx, batch.PartialHistogramURI+"*")
+		if err != nil {
+			reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassOutputFailed, failurereport.StageWriteManifest, batch.PartialHistogramURI, err))
+		}
+		manifest := &resultmanifest.Manifest{
+			QueryID:      batch.BatchID,
+			ResultURI:    batch.PartialHistogramURI,
+			TotalEpsilon: *epsilon,
+			KeyBitSize:   int32(*keyBitSize),
+			Files:        files,
+		}
+		if batch.KeyBitSize > 0 {
+			manifest.KeyBitSize = int32(batch.KeyBitSize)
+		}
+		signed, err := resultmanifest.Sign(manifest, signingKey)
+		if err != nil {
+			reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassOutputFailed, failurereport.StageWriteManifest, batch.ManifestURI, err))
+		}
+		if err := resultmanifest.Write(ctx, signed, batch.ManifestURI); err != nil {
+			reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassOutputFailed, failurereport.StageWriteManifest, batch.ManifestURI, err))
+		}
 	}
 }
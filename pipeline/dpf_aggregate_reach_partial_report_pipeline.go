@@ -13,11 +13,15 @@
 // limitations under the License.
 
 // This binary aggregates the partial report for the Reach frequency.
+//
+// On failure, the binary exits with the code of the failure class documented in package failurereport, and writes
+// the failure report to '--failure_report_uri' if set.
 package main
 
 import (
 	"context"
 	"flag"
+	"fmt"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/log"
@@ -25,6 +29,7 @@ import (
 	"cloud.google.com/go/profiler"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/failurereport"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelineutils"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/reachaggregator"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
@@ -49,27 +54,30 @@ var (
 
 	profilerService        = flag.String("profiler_service", "", "Service name for profiling pipelines.")
 	profilerServiceVersion = flag.String("profiler_service_version", "", "Service version for profiling pipelines.")
+
+	failureReportURI = flag.String("failure_report_uri", "", "Output location of the JSON failure report written when the binary fails.")
 )
 
 func main() {
 	flag.Parse()
 
 	ctx := context.Background()
+	reporter := &failurereport.Reporter{Binary: "dpf_aggregate_reach_partial_report_pipeline", URI: *failureReportURI}
 	if *profilerService != "" {
 		if err := profiler.Start(
 			profiler.Config{
 				Service:        *profilerService,
 				ServiceVersion: *profilerServiceVersion,
 			}); err != nil {
-			log.Exit(ctx, err)
+			reporter.Exit(ctx, err)
 		}
 	}
 
 	beam.Init()
 
-	helperPrivKeys, err := cryptoio.ReadPrivateKeyCollection(ctx, *privateKeyParamsURI)
+	helperPrivKeys, err := cryptoio.ReadDecryptionKeyCollection(ctx, *privateKeyParamsURI)
 	if err != nil {
-		log.Exit(ctx, err)
+		reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassKeyError, failurereport.StageReadKeys, *privateKeyParamsURI, err))
 	}
 
 	log.Infof(ctx, "Output data written to %v file shards", *fileShards)
@@ -77,9 +85,9 @@ func main() {
 	inputGlob := pipelineutils.AddStrInPath(*partialReportURI, "*")
 	inputExist, err := utils.IsFileGlobExist(ctx, inputGlob)
 	if err != nil {
-		log.Exit(ctx, err)
+		reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInputNotFound, failurereport.StageReadInput, *partialReportURI, err))
 	} else if !inputExist {
-		log.Exitf(ctx, "input not found: %q", inputGlob)
+		reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInputNotFound, failurereport.StageReadInput, *partialReportURI, fmt.Errorf("input not found: %q", inputGlob)))
 	}
 
 	pipeline := beam.NewPipeline()
@@ -103,9 +111,9 @@ func main() {
 			},
 			Shards: *fileShards,
 		}); err != nil {
-		log.Exit(ctx, err)
+		reporter.Exit(ctx, failurereport.Wrap(failurereport.ClassInvalidArgument, failurereport.StageValidate, err))
 	}
 	if err := beamx.Run(ctx, pipeline); err != nil {
-		log.Exitf(ctx, "Failed to execute job: %s", err)
+		reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassPipelineFailed, failurereport.StageRunPipeline, *partialReportURI, fmt.Errorf("failed to execute job: %v", err)))
 	}
 }
@@ -25,6 +25,12 @@
 // (https://issues.apache.org/jira/browse/BEAM-11916), we need to split the vectors and then
 // combine the peices (segmentCombine()) as a workaround.
 //
+// If a privacy budget is given, noise is added to the combined vectors (or vector segments) in a
+// separate stage, with the noise for each vector drawn in one batch. The noise mechanism can be
+// changed with CombineParams.NoiseMechanism without touching the combiners. For debugging batches,
+// CombineParams.NoiseSeed makes the noise reproducible, so the outputs of different binary versions
+// can be compared on the same inputs.
+//
 // Finally, the SUM result is stored in a PartialAggregationDpf for each bucket ID. The
 // buket ID and it's corresponding PartialAggregationDpf in wire-format is written as a line in the
 // output file.
@@ -35,22 +41,38 @@ package dpfaggregator
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/io/textio"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/stats"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/top"
+	"golang.org/x/exp/rand"
 	"google.golang.org/protobuf/proto"
 	"lukechampine.com/uint128"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/distributednoise"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/incrementaldpf"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelineutils"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/canonicaljson"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/consistencycheck"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/mmapfile"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttrace"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
 
@@ -70,24 +92,52 @@ func init() {
 	beam.RegisterType(reflect.TypeOf((*pb.PartialReportDpf)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*pb.PartialAggregationDpf)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*pb.StandardCiphertext)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*pb.ExpansionStatistics)(nil)).Elem())
 
 	beam.RegisterType(reflect.TypeOf((*alignVectorFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*annotateHistogramFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*alignVectorSegmentFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*assignBundleKeyFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*addVectorNoiseFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*combineVectorFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*combineVectorSegmentFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*checkKeyBitSizeFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*consistencyShareFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*createEvalCtxFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*dataQualitySummaryFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*createExpansionStatisticsFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*expansionCounts)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*expandDpfKeyFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*decryptPartialReportFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*formatCompleteHistogramFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*formatExpansionStatisticsFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*formatPartialReportFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*formatHistogramFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*getBucketIDsFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*mergeHistogramFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*minValueFilterFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*parseBucketAnnotationFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*parseEncryptedPartialReportFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*parsePartialReportFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*parsePartialHistogramFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*preemptibleUngroupBundleFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*readMmapEncryptedPartialReportFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*readMmapPartialReportFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*sumExpansionCountsFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*traceReportFn)(nil)).Elem())
 
 	beam.RegisterType(reflect.TypeOf((*expandedVec)(nil)))
+	beam.RegisterType(reflect.TypeOf((*AnnotatedHistogram)(nil)).Elem())
+
+	beam.RegisterFunction(countCombineTimeFn)
+	beam.RegisterFunction(countDecryptedReportFn)
+	beam.RegisterFunction(countExpandTimeFn)
+	beam.RegisterFunction(countReportFn)
+	beam.RegisterFunction(flattenHistogramFn)
+	beam.RegisterFunction(formatAnnotatedHistogramFn)
+	beam.RegisterFunction(keyHistogramFn)
+	beam.RegisterFunction(lessCompleteHistogramFn)
+	beam.RegisterFunction(ungroupBundleFn)
 }
 
 // ExpandParameters contains required parameters for expanding the DPF keys.
@@ -96,6 +146,16 @@ type ExpandParameters struct {
 	Prefixes        []uint128.Uint128
 	PreviousLevel   int32
 	DirectExpansion bool
+	// Number of bits between two adjacent hierarchies in the DPF keys. Zero or one means there is a hierarchy at every prefix length.
+	HierarchyGranularity int32
+}
+
+// GetDPFParameters gets the DPF parameters for the key bit size and the hierarchy granularity in the expansion parameters.
+func GetDPFParameters(keyBitSize int, expandParams *ExpandParameters) ([]*dpfpb.DpfParameters, error) {
+	if expandParams.HierarchyGranularity <= 1 {
+		return incrementaldpf.GetDefaultDPFParameters(keyBitSize)
+	}
+	return incrementaldpf.GetDPFParametersWithGranularity(keyBitSize, int(expandParams.HierarchyGranularity))
 }
 
 // parseEncryptedPartialReportFn parses each line of the input partial report and gets a StandardCiphertext, which represents a encrypted PartialReportDpf.
@@ -126,38 +186,236 @@ func ReadEncryptedPartialReport(scope beam.Scope, partialReportFile string) beam
 	return beam.ParDo(scope, &parseEncryptedPartialReportFn{}, reshuffledLines)
 }
 
+// listLocalFiles lists the local files that match the input file name followed by a wildcard, as read by textio.
+func listLocalFiles(inputFile string) ([]string, error) {
+	if strings.HasPrefix(inputFile, "gs://") {
+		return nil, fmt.Errorf("expect local files for memory-mapped reading, got %q", inputFile)
+	}
+	glob := pipelineutils.AddStrInPath(inputFile, "*")
+	files, err := filepath.Glob(glob)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no file matches %q", glob)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readMmapEncryptedPartialReportFn reads the encrypted partial reports from a local file through a memory mapping,
+// parsing the lines without copying them into strings.
+type readMmapEncryptedPartialReportFn struct {
+	partialReportCounter beam.Counter
+}
+
+func (fn *readMmapEncryptedPartialReportFn) Setup() {
+	fn.partialReportCounter = beam.NewCounter("aggregation-prototype", "encrypted-partial-report-count")
+}
+
+func (fn *readMmapEncryptedPartialReportFn) ProcessElement(ctx context.Context, filename string, emit func(*pb.AggregatablePayload)) error {
+	f, err := mmapfile.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.ForEachLine(func(line []byte) error {
+		encrypted, err := reporttypes.DeserializeAggregatablePayloadBytes(line)
+		if err != nil {
+			return err
+		}
+		emit(encrypted)
+		fn.partialReportCounter.Inc(ctx, 1)
+		return nil
+	})
+}
+
+// ReadEncryptedPartialReportMmap reads the encrypted partial reports like ReadEncryptedPartialReport(), but from local
+// files through memory mappings, which is faster for very large files with the direct runner.
+func ReadEncryptedPartialReportMmap(scope beam.Scope, partialReportFile string) (beam.PCollection, error) {
+	scope = scope.Scope("ReadEncryptedPartialReportMmap")
+	files, err := listLocalFiles(partialReportFile)
+	if err != nil {
+		return beam.PCollection{}, err
+	}
+	encrypted := beam.ParDo(scope, &readMmapEncryptedPartialReportFn{}, beam.CreateList(scope, files))
+	return beam.Reshuffle(scope, encrypted), nil
+}
+
+// memorySampleInterval limits how often the memory is sampled while processing the elements.
+const memorySampleInterval = 100 * time.Millisecond
+
+// readMemoryBytes returns the resident set size of the worker process from /proc/self/statm, which includes the memory
+// allocated by the C++ DPF library and the Go heap not yet returned to the OS. Where /proc is not available, it falls
+// back to the memory obtained from the OS by the Go runtime. It can be replaced in tests.
+var readMemoryBytes = func() uint64 {
+	if b, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		// The second field is the number of resident pages.
+		if fields := strings.Fields(string(b)); len(fields) > 1 {
+			if pages, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.Sys
+}
+
+// memoryWatermark keeps the highest memory size sampled since it was reset. The memory is shared by all the bundles
+// running on a worker, so the watermark of a DoFn is the memory used by the worker while the DoFn runs.
+type memoryWatermark struct {
+	lastSample time.Time
+	last, peak uint64
+}
+
+// sample reads the memory size unless it was read within memorySampleInterval and force is false, and returns whether a
+// new sample was read.
+func (w *memoryWatermark) sample(force bool) bool {
+	now := time.Now()
+	if !force && now.Sub(w.lastSample) < memorySampleInterval {
+		return false
+	}
+	w.lastSample, w.last = now, readMemoryBytes()
+	if w.last > w.peak {
+		w.peak = w.last
+	}
+	return true
+}
+
+func (w *memoryWatermark) reset() {
+	w.lastSample, w.peak = time.Time{}, 0
+}
+
+// lifecycleMetrics records the time spent in the lifecycle methods of a heavy DoFn, the number of elements in its
+// bundles and the memory watermark of its bundles, as Beam distributions prefixed with the name of the DoFn.
+type lifecycleMetrics struct {
+	setupMicros   int64
+	setupReported bool
+	bundleStart   time.Time
+	bundleSize    int64
+	memory        memoryWatermark
+
+	setup, startBundle, processElement, bundleMicros, bundleSizes, memoryBytes beam.Distribution
+}
+
+// newLifecycleMetrics creates the metrics at the end of Setup, which started at setupStart. The setup time is reported
+// in the first bundle, as Setup does not have a context for updating the metrics.
+func newLifecycleMetrics(name string, setupStart time.Time) *lifecycleMetrics {
+	return &lifecycleMetrics{
+		setupMicros:    time.Since(setupStart).Microseconds(),
+		setup:          beam.NewDistribution("aggregation", name+"-setup-micros"),
+		startBundle:    beam.NewDistribution("aggregation", name+"-start-bundle-micros"),
+		processElement: beam.NewDistribution("aggregation", name+"-process-element-micros"),
+		bundleMicros:   beam.NewDistribution("aggregation", name+"-bundle-micros"),
+		bundleSizes:    beam.NewDistribution("aggregation", name+"-bundle-size"),
+		memoryBytes:    beam.NewDistribution("aggregation", name+"-memory-watermark-bytes"),
+	}
+}
+
+func (m *lifecycleMetrics) startBundleDone(ctx context.Context, start time.Time) {
+	if !m.setupReported {
+		m.setup.Update(ctx, m.setupMicros)
+		m.setupReported = true
+	}
+	m.bundleStart, m.bundleSize = start, 0
+	m.memory.reset()
+	m.memory.sample(true)
+	m.startBundle.Update(ctx, time.Since(start).Microseconds())
+}
+
+func (m *lifecycleMetrics) processElementDone(ctx context.Context, start time.Time) {
+	m.bundleSize++
+	m.memory.sample(false)
+	m.processElement.Update(ctx, time.Since(start).Microseconds())
+}
+
+func (m *lifecycleMetrics) finishBundle(ctx context.Context) {
+	m.memory.sample(true)
+	m.bundleMicros.Update(ctx, time.Since(m.bundleStart).Microseconds())
+	m.bundleSizes.Update(ctx, m.bundleSize)
+	m.memoryBytes.Update(ctx, int64(m.memory.peak))
+}
+
 // decryptPartialReportFn decrypts the StandardCiphertext and gets a PartialReportDpf with the private key from the helper server.
+//
+// If a report can not be decrypted with the key of its key ID, all the non-expired keys are tried before the report is
+// treated as non-encrypted. The counters record which key succeeded, to guide key retirement decisions.
 type decryptPartialReportFn struct {
 	StandardPrivateKeys map[string]*pb.StandardPrivateKey
+	ExpiredKeyIDs       []string
 
+	fallbackKeyIDs      []string
 	isEncryptedBundle   bool
 	nonencryptedCounter beam.Counter
+	fallbackCounter     beam.Counter
+	keyCounters         map[string]beam.Counter
+	metrics             *lifecycleMetrics
+}
+
+// getFallbackKeyIDs returns the sorted IDs of the unexpired keys, which are tried for reports with missing or wrong key
+// IDs.
+func getFallbackKeyIDs(standardPrivateKeys map[string]*pb.StandardPrivateKey, expiredKeyIDs []string) []string {
+	expired := make(map[string]bool)
+	for _, keyID := range expiredKeyIDs {
+		expired[keyID] = true
+	}
+	var keyIDs []string
+	for keyID := range standardPrivateKeys {
+		if !expired[keyID] {
+			keyIDs = append(keyIDs, keyID)
+		}
+	}
+	sort.Strings(keyIDs)
+	return keyIDs
 }
 
 func (fn *decryptPartialReportFn) Setup() {
-	fn.isEncryptedBundle = true
+	start := time.Now()
+	fn.fallbackKeyIDs = getFallbackKeyIDs(fn.StandardPrivateKeys, fn.ExpiredKeyIDs)
+
 	fn.nonencryptedCounter = beam.NewCounter("aggregation", "unpack-nonencrypted-count")
+	fn.fallbackCounter = beam.NewCounter("aggregation", "decrypt-fallback-key-count")
+	fn.keyCounters = make(map[string]beam.Counter)
+	for keyID := range fn.StandardPrivateKeys {
+		fn.keyCounters[keyID] = beam.NewCounter("aggregation", "decrypt-key-"+keyID)
+	}
+	fn.metrics = newLifecycleMetrics("decryptPartialReportFn", start)
 }
 
-func (fn *decryptPartialReportFn) ProcessElement(ctx context.Context, encrypted *pb.AggregatablePayload, emit func(*pb.PartialReportDpf)) error {
-	privateKey, ok := fn.StandardPrivateKeys[encrypted.KeyId]
-	if !ok && encrypted.KeyId != "" {
-		return fmt.Errorf("no private key found for keyID = %q", encrypted.KeyId)
-	}
+// StartBundle resets the state for each bundle, so a non-encrypted report only affects the reports in its own bundle.
+func (fn *decryptPartialReportFn) StartBundle(ctx context.Context, emit func(*pb.PartialReportDpf)) {
+	start := time.Now()
+	fn.isEncryptedBundle = true
+	fn.metrics.startBundleDone(ctx, start)
+}
+
+func (fn *decryptPartialReportFn) FinishBundle(ctx context.Context, emit func(*pb.PartialReportDpf)) {
+	fn.metrics.finishBundle(ctx)
+}
 
+func (fn *decryptPartialReportFn) ProcessElement(ctx context.Context, encrypted *pb.AggregatablePayload, emit func(*pb.PartialReportDpf)) error {
+	defer fn.metrics.processElementDone(ctx, time.Now())
 	payload := &reporttypes.Payload{}
 	if fn.isEncryptedBundle {
 		var (
 			isEncrypted bool
+			keyID       string
 			err         error
 		)
-		payload, isEncrypted, err = cryptoio.DecryptOrUnmarshal(encrypted, privateKey)
+		payload, keyID, isEncrypted, err = cryptoio.DecryptWithFallback(encrypted, fn.StandardPrivateKeys, fn.fallbackKeyIDs)
 		if err != nil {
 			return err
 		}
 		if !isEncrypted {
 			fn.nonencryptedCounter.Inc(ctx, 1)
 			fn.isEncryptedBundle = false
+		} else {
+			if keyID != encrypted.KeyId {
+				fn.fallbackCounter.Inc(ctx, 1)
+			}
+			fn.keyCounters[keyID].Inc(ctx, 1)
 		}
 	} else {
 		if err := utils.UnmarshalCBOR(encrypted.Payload.Data, payload); err != nil {
@@ -176,8 +434,229 @@ func (fn *decryptPartialReportFn) ProcessElement(ctx context.Context, encrypted
 
 // DecryptPartialReport decrypts every line in the input file with the helper private key, and gets the partial report.
 func DecryptPartialReport(s beam.Scope, encryptedReport beam.PCollection, standardPrivateKeys map[string]*pb.StandardPrivateKey) beam.PCollection {
+	return DecryptPartialReportWithExpiredKeys(s, encryptedReport, standardPrivateKeys, nil /*expiredKeyIDs*/)
+}
+
+// DecryptPartialReportWithExpiredKeys decrypts the partial reports like DecryptPartialReport(), except that the expired
+// keys are only used for reports with their key IDs.
+func DecryptPartialReportWithExpiredKeys(s beam.Scope, encryptedReport beam.PCollection, standardPrivateKeys map[string]*pb.StandardPrivateKey, expiredKeyIDs []string) beam.PCollection {
 	s = s.Scope("DecryptPartialReport")
-	return beam.ParDo(s, &decryptPartialReportFn{StandardPrivateKeys: standardPrivateKeys}, encryptedReport)
+	return beam.ParDo(s, &decryptPartialReportFn{StandardPrivateKeys: standardPrivateKeys, ExpiredKeyIDs: expiredKeyIDs}, encryptedReport)
+}
+
+// maxConsistencyCheckLogDomainSize limits the size of the first hierarchy level, which is fully expanded for each
+// sampled report in the consistency check.
+const maxConsistencyCheckLogDomainSize = 20
+
+// ConsistencyCheckParams contains the parameters for the consistency check of the secret shares on debug batches.
+type ConsistencyCheckParams struct {
+	// Output file of the share sums, one sampled report per line.
+	ShareURI string
+	// Seed shared by the helpers to sample the same reports.
+	Seed       uint64
+	SampleRate float64
+}
+
+// consistencyShareFn decrypts the sampled reports, and emits the sums of their shares at the first hierarchy level.
+type consistencyShareFn struct {
+	StandardPrivateKeys map[string]*pb.StandardPrivateKey
+	DpfParams           []*dpfpb.DpfParameters
+	Seed                uint64
+	SampleRate          float64
+
+	sampledCounter beam.Counter
+}
+
+func (fn *consistencyShareFn) Setup() {
+	fn.sampledCounter = beam.NewCounter("aggregation", "consistency-check-sampled-count")
+}
+
+func (fn *consistencyShareFn) ProcessElement(ctx context.Context, encrypted *pb.AggregatablePayload, emit func(string)) error {
+	reportID := reporttypes.GetReportID(encrypted.GetSharedInfo())
+	if !consistencycheck.Sampled(fn.Seed, reportID, fn.SampleRate) {
+		return nil
+	}
+	payload, _, _, err := cryptoio.DecryptWithFallback(encrypted, fn.StandardPrivateKeys, nil /*fallbackKeyIDs*/)
+	if err != nil {
+		return err
+	}
+	dpfKey := &dpfpb.DpfKey{}
+	if err := proto.Unmarshal(payload.DPFKey, dpfKey); err != nil {
+		return err
+	}
+	evalCtx, err := incrementaldpf.CreateEvaluationContext(fn.DpfParams, dpfKey)
+	if err != nil {
+		return err
+	}
+	vec, err := incrementaldpf.EvaluateUntil64(0 /*hierarchyLevel*/, nil /*prefixes*/, evalCtx)
+	if err != nil {
+		return err
+	}
+	fn.sampledCounter.Inc(ctx, 1)
+	emit(consistencycheck.FormatShare(reportID, consistencycheck.SumShare(vec)))
+	return nil
+}
+
+// WriteConsistencyShares samples the encrypted reports for the consistency check, and writes the sums of their shares.
+// It reveals the values of the sampled reports once combined with the partner's shares, so it is only for debug batches.
+func WriteConsistencyShares(scope beam.Scope, encrypted beam.PCollection, standardPrivateKeys map[string]*pb.StandardPrivateKey, dpfParams []*dpfpb.DpfParameters, params *ConsistencyCheckParams) error {
+	if len(dpfParams) == 0 {
+		return errors.New("expect nonempty DPF parameters")
+	}
+	if logDomainSize := dpfParams[0].GetLogDomainSize(); logDomainSize > maxConsistencyCheckLogDomainSize {
+		return fmt.Errorf("expect the first hierarchy level of at most %d bits for the consistency check, got %d", maxConsistencyCheckLogDomainSize, logDomainSize)
+	}
+	scope = scope.Scope("WriteConsistencyShares")
+	shares := beam.ParDo(scope, &consistencyShareFn{
+		StandardPrivateKeys: standardPrivateKeys,
+		DpfParams:           dpfParams,
+		Seed:                params.Seed,
+		SampleRate:          params.SampleRate,
+	}, encrypted)
+	textio.Write(scope, params.ShareURI, shares)
+	return nil
+}
+
+// TraceParams contains the parameters for tracing a sample of the reports through the pipeline.
+type TraceParams struct {
+	// Output file of the trace records, one record per line.
+	TraceURI string
+	// Encrypted input reports to sample when the pipeline reads the decrypted reports, which do not have the report IDs.
+	// The encrypted input of the pipeline is sampled if empty, so it is required at the levels after the first.
+	EncryptedReportURI string
+	// Seed shared by the helpers and the levels of a query to sample the same reports.
+	Seed       uint64
+	SampleRate float64
+}
+
+// traceReportFn decrypts and expands the sampled reports in the same way as the pipeline, and emits the trace records
+// of each stage.
+type traceReportFn struct {
+	StandardPrivateKeys map[string]*pb.StandardPrivateKey
+	ExpiredKeyIDs       []string
+	ExpandParams        *ExpandParameters
+	KeyBitSize          int
+	Seed                uint64
+	SampleRate          float64
+
+	fallbackKeyIDs  []string
+	cPrefixes       unsafe.Pointer
+	cPrefixesLength int64
+	dpfParams       []*dpfpb.DpfParameters
+	sampledCounter  beam.Counter
+}
+
+func (fn *traceReportFn) Setup() error {
+	fn.fallbackKeyIDs = getFallbackKeyIDs(fn.StandardPrivateKeys, fn.ExpiredKeyIDs)
+	fn.cPrefixes, fn.cPrefixesLength = incrementaldpf.CreateCUint128ArrayUnsafe(fn.ExpandParams.Prefixes)
+	if fn.ExpandParams.HierarchyGranularity > 1 {
+		var err error
+		if fn.dpfParams, err = GetDPFParameters(fn.KeyBitSize, fn.ExpandParams); err != nil {
+			return err
+		}
+	}
+	fn.sampledCounter = beam.NewCounter("aggregation", "trace-sampled-count")
+	return nil
+}
+
+func (fn *traceReportFn) Teardown() {
+	incrementaldpf.FreeUnsafePointer(fn.cPrefixes)
+}
+
+// trace returns the records of the report. Failures are recorded instead of returned, as the trace is only for
+// debugging and the pipeline fails on its own for the same report.
+func (fn *traceReportFn) trace(reportID string, encrypted *pb.AggregatablePayload) []*reporttrace.Record {
+	decrypt := &reporttrace.Record{ReportID: reportID, Stage: reporttrace.StageDecrypt}
+	payload, keyID, isEncrypted, err := cryptoio.DecryptWithFallback(encrypted, fn.StandardPrivateKeys, fn.fallbackKeyIDs)
+	if err != nil {
+		decrypt.Error = err.Error()
+		return []*reporttrace.Record{decrypt}
+	}
+	if isEncrypted {
+		decrypt.KeyID = keyID
+		decrypt.Fallback = keyID != encrypted.KeyId
+	}
+	dpfKey := &dpfpb.DpfKey{}
+	if err := proto.Unmarshal(payload.DPFKey, dpfKey); err != nil {
+		decrypt.Error = err.Error()
+		return []*reporttrace.Record{decrypt}
+	}
+
+	expand := &reporttrace.Record{ReportID: reportID, Stage: reporttrace.StageExpand, Level: fn.ExpandParams.Level}
+	evalCtx := &dpfpb.EvaluationContext{Key: dpfKey, PreviousHierarchyLevel: fn.ExpandParams.PreviousLevel}
+	vec, err := evaluateDpfKey(fn.ExpandParams, fn.KeyBitSize, fn.dpfParams, fn.cPrefixes, fn.cPrefixesLength, evalCtx)
+	if err != nil {
+		expand.Error = err.Error()
+	} else {
+		expand.Buckets = int64(len(vec))
+		expand.ShareSum = consistencycheck.SumShare(vec)
+	}
+	return []*reporttrace.Record{decrypt, expand}
+}
+
+func (fn *traceReportFn) ProcessElement(ctx context.Context, encrypted *pb.AggregatablePayload, emit func(string)) error {
+	reportID := reporttypes.GetReportID(encrypted.GetSharedInfo())
+	if !consistencycheck.Sampled(fn.Seed, reportID, fn.SampleRate) {
+		return nil
+	}
+	fn.sampledCounter.Inc(ctx, 1)
+	for _, record := range fn.trace(reportID, encrypted) {
+		line, err := reporttrace.Format(record)
+		if err != nil {
+			return err
+		}
+		emit(line)
+	}
+	return nil
+}
+
+// WriteReportTraces samples the encrypted reports by their IDs, and writes how each sampled report is decrypted and
+// expanded at the current level.
+func WriteReportTraces(scope beam.Scope, encrypted beam.PCollection, standardPrivateKeys map[string]*pb.StandardPrivateKey, expiredKeyIDs []string, expandParams *ExpandParameters, keyBitSize int, params *TraceParams) error {
+	if err := reporttrace.CheckSampleRate(params.SampleRate); err != nil {
+		return err
+	}
+	scope = scope.Scope("WriteReportTraces")
+	records := beam.ParDo(scope, &traceReportFn{
+		StandardPrivateKeys: standardPrivateKeys,
+		ExpiredKeyIDs:       expiredKeyIDs,
+		ExpandParams:        expandParams,
+		KeyBitSize:          keyBitSize,
+		Seed:                params.Seed,
+		SampleRate:          params.SampleRate,
+	}, encrypted)
+	textio.Write(scope, params.TraceURI, records)
+	return nil
+}
+
+// checkKeyBitSizeFn checks the DPF keys of the reports are generated with the parameters for the key bit size of the
+// batch, so a report from a client with a different key bit size fails the job with a clear error instead of failing
+// or corrupting the expansion.
+type checkKeyBitSizeFn struct {
+	DpfParams  []*dpfpb.DpfParameters
+	KeyBitSize int
+
+	checkedCounter beam.Counter
+}
+
+func (fn *checkKeyBitSizeFn) Setup() {
+	fn.checkedCounter = beam.NewCounter("aggregation", "checkKeyBitSizeFn-report-count")
+}
+
+func (fn *checkKeyBitSizeFn) ProcessElement(ctx context.Context, report *pb.PartialReportDpf, emit func(*pb.PartialReportDpf)) error {
+	// Creating the evaluation context validates the key against the parameters.
+	if _, err := incrementaldpf.CreateEvaluationContext(fn.DpfParams, report.GetSumKey()); err != nil {
+		return fmt.Errorf("report does not match the key bit size %d of the batch: %v", fn.KeyBitSize, err)
+	}
+	fn.checkedCounter.Inc(ctx, 1)
+	emit(report)
+	return nil
+}
+
+// CheckReportKeyBitSize fails the pipeline if any decrypted report does not match the key bit size of the batch.
+func CheckReportKeyBitSize(scope beam.Scope, decryptedReport beam.PCollection, dpfParams []*dpfpb.DpfParameters, keyBitSize int) beam.PCollection {
+	scope = scope.Scope("CheckReportKeyBitSize")
+	return beam.ParDo(scope, &checkKeyBitSizeFn{DpfParams: dpfParams, KeyBitSize: keyBitSize}, decryptedReport)
 }
 
 type createEvalCtxFn struct {
@@ -238,6 +717,50 @@ func (fn *parsePartialReportFn) ProcessElement(ctx context.Context, line string,
 	return nil
 }
 
+// readMmapPartialReportFn reads the decrypted partial reports from a local file through a memory mapping.
+type readMmapPartialReportFn struct {
+	partialReportCounter beam.Counter
+}
+
+func (fn *readMmapPartialReportFn) Setup() {
+	fn.partialReportCounter = beam.NewCounter("aggregation", "read-partial-report-count")
+}
+
+func (fn *readMmapPartialReportFn) ProcessElement(ctx context.Context, filename string, emit func(*pb.PartialReportDpf)) error {
+	f, err := mmapfile.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.ForEachLine(func(line []byte) error {
+		b := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+		n, err := base64.StdEncoding.Decode(b, line)
+		if err != nil {
+			return err
+		}
+		partialReport := &pb.PartialReportDpf{}
+		if err := proto.Unmarshal(b[:n], partialReport); err != nil {
+			return err
+		}
+		emit(partialReport)
+		fn.partialReportCounter.Inc(ctx, 1)
+		return nil
+	})
+}
+
+// ReadPartialReportMmap reads the decrypted partial reports like ReadPartialReport(), but from local files through
+// memory mappings.
+func ReadPartialReportMmap(scope beam.Scope, partialReportFile string) (beam.PCollection, error) {
+	scope = scope.Scope("ReadPartialReportMmap")
+	files, err := listLocalFiles(partialReportFile)
+	if err != nil {
+		return beam.PCollection{}, err
+	}
+	partialReport := beam.ParDo(scope, &readMmapPartialReportFn{}, beam.CreateList(scope, files))
+	return beam.Reshuffle(scope, partialReport), nil
+}
+
 // ReadPartialReport reads each line from a file, and parses it as a PartialReport.
 func ReadPartialReport(scope beam.Scope, partialReportFile string) beam.PCollection {
 	scope = scope.Scope("ReadPartialReport")
@@ -275,6 +798,10 @@ func writePartialReport(s beam.Scope, col beam.PCollection, outputName string, s
 
 type expandedVec struct {
 	SumVec []uint64
+	// Time in nanoseconds spent on combining the input vectors into this one.
+	CombineNanos int64
+	// Time in nanoseconds spent on expanding the DPF key into this vector.
+	ExpandNanos int64
 }
 
 // expandDpfKeyFn expands the DPF keys in a PartialReportDpf into a vector that represent the contribution to the SUM histogram.
@@ -285,11 +812,31 @@ type expandDpfKeyFn struct {
 	vecCounter      beam.Counter
 	cPrefixes       unsafe.Pointer
 	cPrefixesLength int64
+	// Only set when the DPF keys do not have a hierarchy at every prefix length.
+	dpfParams []*dpfpb.DpfParameters
+	metrics   *lifecycleMetrics
 }
 
-func (fn *expandDpfKeyFn) Setup() {
+func (fn *expandDpfKeyFn) Setup() error {
+	start := time.Now()
 	fn.vecCounter = beam.NewCounter("aggregation", "expandDpfFn-vec-count")
 	fn.cPrefixes, fn.cPrefixesLength = incrementaldpf.CreateCUint128ArrayUnsafe(fn.ExpandParams.Prefixes)
+	if fn.ExpandParams.HierarchyGranularity > 1 {
+		var err error
+		if fn.dpfParams, err = GetDPFParameters(fn.KeyBitSize, fn.ExpandParams); err != nil {
+			return err
+		}
+	}
+	fn.metrics = newLifecycleMetrics("expandDpfFn", start)
+	return nil
+}
+
+func (fn *expandDpfKeyFn) StartBundle(ctx context.Context, emitVec func(*expandedVec)) {
+	fn.metrics.startBundleDone(ctx, time.Now())
+}
+
+func (fn *expandDpfKeyFn) FinishBundle(ctx context.Context, emitVec func(*expandedVec)) {
+	fn.metrics.finishBundle(ctx)
 }
 
 func (fn *expandDpfKeyFn) Teardown() {
@@ -297,32 +844,41 @@ func (fn *expandDpfKeyFn) Teardown() {
 }
 
 func (fn *expandDpfKeyFn) ProcessElement(ctx context.Context, evalCtx *dpfpb.EvaluationContext, emitVec func(*expandedVec)) error {
+	start := time.Now()
+	defer fn.metrics.processElementDone(ctx, start)
 	if int32(fn.ExpandParams.Level) <= evalCtx.PreviousHierarchyLevel {
 		return fmt.Errorf("expect current level higher than the previous level %d, got %d", evalCtx.PreviousHierarchyLevel, fn.ExpandParams.Level)
 	}
 
-	var (
-		vecSum []uint64
-		err    error
-	)
-
-	// The DpfParameters are not needed here (either in the evaluation context or as a direct input), as they are known when the key bit size is given.
-	// That way, we can reduce the data copied from Go to C++.
-	if fn.ExpandParams.DirectExpansion {
-		vecSum, err = incrementaldpf.EvaluateAt64UnsafeDefault(fn.KeyBitSize, int(fn.ExpandParams.Level), fn.cPrefixes, fn.cPrefixesLength, evalCtx.Key)
-	} else {
-		vecSum, err = incrementaldpf.EvaluateUntil64UnsafeDefault(fn.KeyBitSize, int(fn.ExpandParams.Level), fn.cPrefixes, fn.cPrefixesLength, evalCtx)
-	}
+	vecSum, err := evaluateDpfKey(fn.ExpandParams, fn.KeyBitSize, fn.dpfParams, fn.cPrefixes, fn.cPrefixesLength, evalCtx)
 	if err != nil {
 		return err
 	}
 
-	emitVec(&expandedVec{SumVec: vecSum})
+	emitVec(&expandedVec{SumVec: vecSum, ExpandNanos: time.Since(start).Nanoseconds()})
 
 	fn.vecCounter.Inc(ctx, 1)
 	return nil
 }
 
+// evaluateDpfKey expands the DPF key in the evaluation context at the level of the expansion parameters. The
+// DpfParameters are only needed when the keys do not have a hierarchy at every prefix length.
+func evaluateDpfKey(expandParams *ExpandParameters, keyBitSize int, dpfParams []*dpfpb.DpfParameters, cPrefixes unsafe.Pointer, cPrefixesLength int64, evalCtx *dpfpb.EvaluationContext) ([]uint64, error) {
+	// For the default hierarchies, the DpfParameters are not needed here (either in the evaluation context or as a direct input), as they are known
+	// when the key bit size is given. That way, we can reduce the data copied from Go to C++.
+	switch {
+	case dpfParams != nil && expandParams.DirectExpansion:
+		return incrementaldpf.EvaluateAt64Unsafe(dpfParams, int(expandParams.Level), cPrefixes, cPrefixesLength, evalCtx.Key)
+	case dpfParams != nil:
+		evalCtx.Parameters = dpfParams
+		return incrementaldpf.EvaluateUntil64Unsafe(int(expandParams.Level), cPrefixes, cPrefixesLength, evalCtx)
+	case expandParams.DirectExpansion:
+		return incrementaldpf.EvaluateAt64UnsafeDefault(keyBitSize, int(expandParams.Level), cPrefixes, cPrefixesLength, evalCtx.Key)
+	default:
+		return incrementaldpf.EvaluateUntil64UnsafeDefault(keyBitSize, int(expandParams.Level), cPrefixes, cPrefixesLength, evalCtx)
+	}
+}
+
 // combineVectorFn combines the expandedVecs by adding the values for each index together for each
 // vector. The combination result is a single expandedVec.
 type combineVectorFn struct {
@@ -331,12 +887,15 @@ type combineVectorFn struct {
 	inputCounter  beam.Counter
 	createCounter beam.Counter
 	mergeCounter  beam.Counter
+	memory        memoryWatermark
+	memoryBytes   beam.Distribution
 }
 
 func (fn *combineVectorFn) Setup() {
 	fn.inputCounter = beam.NewCounter("aggregation", "combineVectorFn-input-count")
 	fn.createCounter = beam.NewCounter("aggregation", "combineVectorFn-create-count")
 	fn.mergeCounter = beam.NewCounter("aggregation", "combineVectorFn-merge-count")
+	fn.memoryBytes = beam.NewDistribution("aggregation", "combineVectorFn-memory-watermark-bytes")
 }
 
 func (fn *combineVectorFn) CreateAccumulator(ctx context.Context) *expandedVec {
@@ -346,19 +905,26 @@ func (fn *combineVectorFn) CreateAccumulator(ctx context.Context) *expandedVec {
 
 func (fn *combineVectorFn) AddInput(ctx context.Context, e *expandedVec, p *expandedVec) *expandedVec {
 	fn.inputCounter.Inc(ctx, 1)
+	if fn.memory.sample(false) {
+		fn.memoryBytes.Update(ctx, int64(fn.memory.last))
+	}
 
+	start := time.Now()
 	for i := uint64(0); i < fn.VectorLength; i++ {
 		e.SumVec[i] += p.SumVec[i]
 	}
+	e.CombineNanos += time.Since(start).Nanoseconds()
 	return e
 }
 
 func (fn *combineVectorFn) MergeAccumulators(ctx context.Context, a, b *expandedVec) *expandedVec {
 	fn.mergeCounter.Inc(ctx, 1)
 
+	start := time.Now()
 	for i := uint64(0); i < fn.VectorLength; i++ {
 		a.SumVec[i] += b.SumVec[i]
 	}
+	a.CombineNanos += b.CombineNanos + time.Since(start).Nanoseconds()
 	return a
 }
 
@@ -398,12 +964,15 @@ type combineVectorSegmentFn struct {
 	inputCounter  beam.Counter
 	createCounter beam.Counter
 	mergeCounter  beam.Counter
+	memory        memoryWatermark
+	memoryBytes   beam.Distribution
 }
 
 func (fn *combineVectorSegmentFn) Setup() {
 	fn.inputCounter = beam.NewCounter("aggregation", "combineVectorSegmentFn-input-count")
 	fn.createCounter = beam.NewCounter("aggregation", "combineVectorSegmentFn-create-count")
 	fn.mergeCounter = beam.NewCounter("aggregation", "combineVectorSegmentFn-merge-count")
+	fn.memoryBytes = beam.NewDistribution("aggregation", "combineVectorSegmentFn-memory-watermark-bytes")
 }
 
 func (fn *combineVectorSegmentFn) CreateAccumulator(ctx context.Context) *expandedVec {
@@ -413,19 +982,26 @@ func (fn *combineVectorSegmentFn) CreateAccumulator(ctx context.Context) *expand
 
 func (fn *combineVectorSegmentFn) AddInput(ctx context.Context, e *expandedVec, p *expandedVec) *expandedVec {
 	fn.inputCounter.Inc(ctx, 1)
+	if fn.memory.sample(false) {
+		fn.memoryBytes.Update(ctx, int64(fn.memory.last))
+	}
 
+	start := time.Now()
 	for i := uint64(0); i < fn.Length; i++ {
 		e.SumVec[i] += p.SumVec[i+fn.StartIndex]
 	}
+	e.CombineNanos += time.Since(start).Nanoseconds()
 	return e
 }
 
 func (fn *combineVectorSegmentFn) MergeAccumulators(ctx context.Context, a, b *expandedVec) *expandedVec {
 	fn.mergeCounter.Inc(ctx, 1)
 
+	start := time.Now()
 	for i := uint64(0); i < fn.Length; i++ {
 		a.SumVec[i] += b.SumVec[i]
 	}
+	a.CombineNanos += b.CombineNanos + time.Since(start).Nanoseconds()
 	return a
 }
 
@@ -459,17 +1035,21 @@ func (fn *alignVectorSegmentFn) ProcessElement(ctx context.Context, vec *expande
 	return nil
 }
 
-// directCombine aggregates the expanded vectors to a single vector, and then converts it to be a PCollection.
-func directCombine(scope beam.Scope, expanded, bucketIDs beam.PCollection, vectorLength uint64) beam.PCollection {
+// directCombine aggregates the expanded vectors to a single vector, adds noise to it, and then converts it to be a PCollection.
+//
+// The combined vector before adding noise is also returned for collecting the expansion statistics.
+func directCombine(scope beam.Scope, expanded, bucketIDs beam.PCollection, vectorLength uint64, params *CombineParams) (beam.PCollection, beam.PCollection) {
 	scope = scope.Scope("DirectCombine")
-	histogram := beam.Combine(scope, &combineVectorFn{VectorLength: vectorLength}, expanded)
-	return beam.ParDo(scope, &alignVectorFn{}, histogram, beam.SideInput{Input: bucketIDs})
+	combined := beam.Combine(scope, &combineVectorFn{VectorLength: vectorLength}, expanded)
+	histogram := addVectorNoise(scope, combined, params, 0 /*seedOffset*/)
+	return beam.ParDo(scope, &alignVectorFn{}, histogram, beam.SideInput{Input: bucketIDs}), combined
 }
 
 // There is an issue when combining large vectors (large domain size):  https://issues.apache.org/jira/browse/BEAM-11916
 // As a workaround, we split the vectors into pieces and combine the collection of the smaller vectors instead.
-func segmentCombine(scope beam.Scope, expanded, bucketIDs beam.PCollection, vectorLength, segmentLength uint64) beam.PCollection {
+func segmentCombine(scope beam.Scope, expanded, bucketIDs beam.PCollection, vectorLength uint64, params *CombineParams) (beam.PCollection, beam.PCollection) {
 	scope = scope.Scope("SegmentCombine")
+	segmentLength := params.SegmentLength
 	segmentCount := vectorLength / segmentLength
 	var segmentLengths []uint64
 	for i := uint64(0); i < segmentCount; i++ {
@@ -482,32 +1062,71 @@ func segmentCombine(scope beam.Scope, expanded, bucketIDs beam.PCollection, vect
 	}
 
 	results := make([]beam.PCollection, segmentCount)
+	combined := make([]beam.PCollection, segmentCount)
 	for i := range results {
-		pHistogram := beam.Combine(scope, &combineVectorSegmentFn{StartIndex: uint64(i) * segmentLength, Length: segmentLengths[i]}, expanded)
+		combined[i] = beam.Combine(scope, &combineVectorSegmentFn{StartIndex: uint64(i) * segmentLength, Length: segmentLengths[i]}, expanded)
+		pHistogram := addVectorNoise(scope, combined[i], params, uint64(i)*segmentLength)
 		results[i] = beam.ParDo(scope, &alignVectorSegmentFn{StartIndex: uint64(i) * segmentLength}, pHistogram, beam.SideInput{Input: bucketIDs})
 	}
-	return beam.Flatten(scope, results...)
+	return beam.Flatten(scope, results...), beam.Flatten(scope, combined...)
 }
 
-type addNoiseFn struct {
+// addVectorNoiseFn adds noise to each element of a combined vector, with the noise for the whole vector drawn in one batch.
+type addVectorNoiseFn struct {
+	Mechanism     string
 	Epsilon       float64
 	L1Sensitivity uint64
+	// Seed for the noise source; zero means the global random source is used.
+	Seed uint64
+
+	noiseCounter beam.Counter
+}
+
+func (fn *addVectorNoiseFn) Setup() {
+	fn.noiseCounter = beam.NewCounter("aggregation", "addVectorNoiseFn-noise-count")
 }
 
-func (fn *addNoiseFn) ProcessElement(ctx context.Context, id uint128.Uint128, pa *pb.PartialAggregationDpf, emit func(uint128.Uint128, *pb.PartialAggregationDpf)) error {
-	noise, err := distributednoise.DistributedGeometricMechanismRand(fn.Epsilon, fn.L1Sensitivity, numberOfHelpers)
+func (fn *addVectorNoiseFn) ProcessElement(ctx context.Context, vec *expandedVec, emit func(*expandedVec)) error {
+	var src rand.Source
+	if fn.Seed != 0 {
+		src = rand.NewSource(fn.Seed)
+	}
+	noise, err := distributednoise.NoiseVector(fn.Mechanism, fn.Epsilon, fn.L1Sensitivity, numberOfHelpers, len(vec.SumVec), src)
 	if err != nil {
 		return err
 	}
-	// Overflow of the noise is expected, and there's 50% probability that the noise is negative.
-	pa.PartialSum += uint64(noise)
-	emit(id, pa)
+	noised := make([]uint64, len(vec.SumVec))
+	for i := range vec.SumVec {
+		// Overflow of the noise is expected, and there's 50% probability that the noise is negative.
+		noised[i] = vec.SumVec[i] + uint64(noise[i])
+	}
+	emit(&expandedVec{SumVec: noised})
+
+	fn.noiseCounter.Inc(ctx, int64(len(noised)))
 	return nil
 }
 
-func addNoise(scope beam.Scope, rawResult beam.PCollection, epsilon float64, l1Sensitivity uint64) beam.PCollection {
-	scope = scope.Scope("AddNoise")
-	return beam.ParDo(scope, &addNoiseFn{Epsilon: epsilon, L1Sensitivity: l1Sensitivity}, rawResult)
+// addVectorNoise adds noise to the combined vectors or vector segments. The vectors are returned unchanged when the privacy budget is not positive.
+//
+// When the noise is seeded, seedOffset is added to the seed so the segments of a vector get different noise.
+func addVectorNoise(scope beam.Scope, combined beam.PCollection, params *CombineParams, seedOffset uint64) beam.PCollection {
+	if params.Epsilon <= 0 {
+		return combined
+	}
+	scope = scope.Scope("AddVectorNoise")
+	return beam.ParDo(scope, &addVectorNoiseFn{
+		Mechanism:     params.NoiseMechanism,
+		Epsilon:       params.Epsilon,
+		L1Sensitivity: params.L1Sensitivity,
+		Seed:          seedWithOffset(params.NoiseSeed, seedOffset),
+	}, combined)
+}
+
+func seedWithOffset(seed, offset uint64) uint64 {
+	if seed == 0 {
+		return 0
+	}
+	return seed + offset
 }
 
 // CombineParams contains parameters for combining the expanded vectors.
@@ -519,11 +1138,17 @@ type CombineParams struct {
 	// Privacy budget for adding noise to the aggregation.
 	Epsilon       float64
 	L1Sensitivity uint64
+	// The noise mechanism applied to the combined vectors; empty means distributednoise.GeometricMechanism.
+	NoiseMechanism string
+	// Seed for reproducible noise in debugging batches; zero means the noise is not seeded. Seeded noise must not be
+	// used for production queries.
+	NoiseSeed uint64
 }
 
 type getBucketIDsFn struct {
 	Level, PreviousLevel int32
 	KeyBitSize           int
+	HierarchyGranularity int32
 
 	dpfParams        []*dpfpb.DpfParameters
 	bucketIDsCounter beam.Counter
@@ -532,7 +1157,7 @@ type getBucketIDsFn struct {
 func (fn *getBucketIDsFn) Setup() error {
 	fn.bucketIDsCounter = beam.NewCounter("aggregation-prototype", "bucket-id-count")
 	var err error
-	fn.dpfParams, err = incrementaldpf.GetDefaultDPFParameters(fn.KeyBitSize)
+	fn.dpfParams, err = GetDPFParameters(fn.KeyBitSize, &ExpandParameters{HierarchyGranularity: fn.HierarchyGranularity})
 	return err
 }
 
@@ -548,92 +1173,730 @@ func (fn *getBucketIDsFn) ProcessElement(ctx context.Context, prefixes []uint128
 
 // ExpandAndCombineHistogram calculates histograms from the DPF keys and combines them.
 func ExpandAndCombineHistogram(scope beam.Scope, evaluationContext beam.PCollection, expandParams *ExpandParameters, dpfParams []*dpfpb.DpfParameters, combineParams *CombineParams, keyBitSize int) (beam.PCollection, error) {
-	prefixes := beam.Create(scope, expandParams.Prefixes)
-	var (
-		bucketIDs    beam.PCollection
-		vectorLength uint64
-		err          error
-	)
+	histogram, _, err := ExpandAndCombineHistogramWithStatistics(scope, evaluationContext, expandParams, dpfParams, combineParams, keyBitSize)
+	return histogram, err
+}
+
+// getVectorLength returns the length of the vector expanded from each DPF key.
+func getVectorLength(expandParams *ExpandParameters, dpfParams []*dpfpb.DpfParameters) (uint64, error) {
 	if expandParams.DirectExpansion {
-		bucketIDs = prefixes
-		vectorLength = uint64(len(expandParams.Prefixes))
-		if vectorLength == 0 {
-			return beam.PCollection{}, errors.New("expect nonempty bucket IDs for direct query")
-		}
-	} else {
-		bucketIDs = beam.ParDo(scope, &getBucketIDsFn{Level: expandParams.Level, PreviousLevel: expandParams.PreviousLevel, KeyBitSize: keyBitSize}, prefixes)
-		vectorLength, err = incrementaldpf.GetVectorLength(dpfParams, expandParams.Prefixes, expandParams.Level, expandParams.PreviousLevel)
-		if err != nil {
-			return beam.PCollection{}, err
+		if len(expandParams.Prefixes) == 0 {
+			return 0, errors.New("expect nonempty bucket IDs for direct query")
 		}
+		return uint64(len(expandParams.Prefixes)), nil
 	}
+	return incrementaldpf.GetVectorLength(dpfParams, expandParams.Prefixes, expandParams.Level, expandParams.PreviousLevel)
+}
 
-	expanded := beam.ParDo(scope, &expandDpfKeyFn{
-		ExpandParams: expandParams,
-		KeyBitSize:   keyBitSize,
-	}, evaluationContext)
+// maxElementsPerBundle caps the tuned bundle size, so a level with very cheap expansion is still split across workers.
+const maxElementsPerBundle = 100000
 
-	var rawResult beam.PCollection
-	if combineParams.DirectCombine {
-		rawResult = directCombine(scope, expanded, bucketIDs, vectorLength)
-	} else {
-		rawResult = segmentCombine(scope, expanded, bucketIDs, vectorLength, combineParams.SegmentLength)
+// TuneElementsPerBundle estimates the number of reports to expand in one bundle, so that a bundle takes about
+// targetBundleMillis. The cost of expanding one report is observed in the statistics of the previous level, and scaled
+// by the ratio between the vector lengths of the two levels, as the expansion time grows with the vector length.
+//
+// Zero is returned if the statistics do not contain enough information for an estimate.
+func TuneElementsPerBundle(previous *pb.ExpansionStatistics, vectorLength uint64, targetBundleMillis int64) int64 {
+	if previous.GetReportCount() == 0 || previous.GetExpandTimeMs() <= 0 || previous.GetVectorLength() == 0 || vectorLength == 0 || targetBundleMillis <= 0 {
+		return 0
 	}
-
-	if combineParams.Epsilon > 0 {
-		return addNoise(scope, rawResult, combineParams.Epsilon, combineParams.L1Sensitivity), nil
+	perReportMillis := float64(previous.GetExpandTimeMs()) / float64(previous.GetReportCount()) * float64(vectorLength) / float64(previous.GetVectorLength())
+	n := int64(float64(targetBundleMillis) / perReportMillis)
+	if n < 1 {
+		return 1
+	}
+	if n > maxElementsPerBundle {
+		return maxElementsPerBundle
 	}
-	return rawResult, nil
+	return n
 }
 
-// AggregatePartialReportParams contains necessary parameters for function AggregatePartialReport().
-type AggregatePartialReportParams struct {
-	// Input partial report file path, each line contains an encrypted PartialReportDpf.
-	PartialReportURI string
-	// Output partial aggregation file path, each line contains a bucket index and a wire-formatted PartialAggregationDpf.
-	PartialHistogramURI string
-	// Output the decrypted partial report to track the expansion state.
-	DecryptedReportURI string
-	// Number of shards when writing the output file.
-	Shards int64
-	// The private keys for the standard encryption from the helper server.
-	HelperPrivateKeys map[string]*pb.StandardPrivateKey
-	KeyBitSize        int
-	ExpandParams      *ExpandParameters
-	CombineParams     *CombineParams
+// assignBundleKeyFn keys the evaluation contexts with random keys, each of which is shared by at most
+// ElementsPerBundle consecutive elements.
+type assignBundleKeyFn struct {
+	ElementsPerBundle int64
+
+	key   int64
+	count int64
 }
 
-// AggregatePartialReport reads the partial report and calculates partial aggregation results from it.
-func AggregatePartialReport(scope beam.Scope, params *AggregatePartialReportParams) error {
-	dpfParams, err := incrementaldpf.GetDefaultDPFParameters(params.KeyBitSize)
-	if err != nil {
-		return err
+func (fn *assignBundleKeyFn) StartBundle(emit func(int64, *dpfpb.EvaluationContext)) {
+	fn.count = 0
+}
+
+func (fn *assignBundleKeyFn) ProcessElement(evalCtx *dpfpb.EvaluationContext, emit func(int64, *dpfpb.EvaluationContext)) {
+	if fn.count%fn.ElementsPerBundle == 0 {
+		fn.key = rand.Int63()
 	}
+	fn.count++
+	emit(fn.key, evalCtx)
+}
 
-	if err := CheckExpansionParameters(dpfParams, params.ExpandParams); err != nil {
-		return err
+func ungroupBundleFn(key int64, evalCtxIter func(**dpfpb.EvaluationContext) bool, emit func(*dpfpb.EvaluationContext)) {
+	var evalCtx *dpfpb.EvaluationContext
+	for evalCtxIter(&evalCtx) {
+		emit(evalCtx)
 	}
+}
 
-	scope = scope.Scope("AggregatePartialreportDpf")
+// RebundleEvaluationContext regroups the evaluation contexts in units of at most elementsPerBundle elements, so the
+// runner distributes the expansion in pieces of similar cost instead of leaving a few straggler bundles.
+func RebundleEvaluationContext(scope beam.Scope, evaluationContext beam.PCollection, elementsPerBundle int64) beam.PCollection {
+	scope = scope.Scope("RebundleEvaluationContext")
+	keyed := beam.ParDo(scope, &assignBundleKeyFn{ElementsPerBundle: elementsPerBundle}, evaluationContext)
+	return beam.ParDo(scope, ungroupBundleFn, beam.GroupByKey(scope, keyed))
+}
+
+// preemptedBundleSplits is the number of smaller bundles that the rest of a pre-empted bundle is split into.
+const preemptedBundleSplits = 4
+
+// maxPreemptionRounds is the number of times that the reports of a bundle can be pre-empted and re-split, each time into
+// bundles preemptedBundleSplits times smaller. The bundles of the last round are not pre-empted again.
+const maxPreemptionRounds = 3
+
+// DefaultPreemptibleElementsPerBundle is the bundle size of the pre-emptible bundles when the bundle size is neither
+// set nor tuned, e.g. at the first level of a hierarchical query.
+const DefaultPreemptibleElementsPerBundle = 10000
+
+// preemptibleUngroupBundleFn emits the evaluation contexts of a bundle like ungroupBundleFn, and pre-empts the bundle
+// when the memory of the worker approaches its limit while the contexts are expanded and added to the combiner
+// accumulators downstream. The Go heap is collected and returned to the OS first, and if the resident memory stays
+// above PreemptMemoryBytes, the rest of the contexts are keyed into bundles of at most ElementsPerSplit elements on the
+// second output. The pre-empted bundle then finishes and releases its accumulators, and the split bundles are expanded
+// after a shuffle.
+type preemptibleUngroupBundleFn struct {
+	PreemptMemoryBytes uint64
+	ElementsPerSplit   int64
+
+	memory           memoryWatermark
+	preemptedCounter beam.Counter
+	splitCounter     beam.Counter
+}
+
+func (fn *preemptibleUngroupBundleFn) Setup() {
+	fn.preemptedCounter = beam.NewCounter("aggregation", "preempted-bundle-count")
+	fn.splitCounter = beam.NewCounter("aggregation", "preempted-split-report-count")
+}
+
+func (fn *preemptibleUngroupBundleFn) ProcessElement(ctx context.Context, key int64, evalCtxIter func(**dpfpb.EvaluationContext) bool, emit func(*dpfpb.EvaluationContext), emitSplit func(int64, *dpfpb.EvaluationContext)) {
+	var (
+		evalCtx   *dpfpb.EvaluationContext
+		preempted bool
+		splitKey  int64
+		split     int64
+	)
+	for evalCtxIter(&evalCtx) {
+		if !preempted && fn.memory.sample(false) && fn.memory.last >= fn.PreemptMemoryBytes {
+			// The heap may be mostly garbage from the expanded vectors, which is cheaper to collect than to re-split.
+			debug.FreeOSMemory()
+			fn.memory.sample(true)
+			if preempted = fn.memory.last >= fn.PreemptMemoryBytes; preempted {
+				fn.preemptedCounter.Inc(ctx, 1)
+			}
+		}
+		if !preempted {
+			emit(evalCtx)
+			continue
+		}
+		if split%fn.ElementsPerSplit == 0 {
+			splitKey = rand.Int63()
+		}
+		split++
+		emitSplit(splitKey, evalCtx)
+	}
+	if split > 0 {
+		fn.splitCounter.Inc(ctx, split)
+	}
+}
+
+// RebundleEvaluationContextWithPreemption regroups the evaluation contexts like RebundleEvaluationContext, and
+// pre-empts the bundles that run when the resident memory of the worker exceeds preemptMemoryBytes, which should leave
+// some headroom below the worker memory, e.g. 80% of it. The rest of a pre-empted bundle is re-split into smaller
+// bundles, which can be pre-empted again for up to maxPreemptionRounds rounds, so a level with a larger vector length
+// than estimated slows down instead of failing with out-of-memory errors.
+//
+// The pre-emption covers the expansion and the combiner accumulators of the bundles, which run fused with them. The
+// accumulators merged after the shuffle of the combine are not pre-empted, and their size is bounded by the segment
+// length of the combine instead.
+func RebundleEvaluationContextWithPreemption(scope beam.Scope, evaluationContext beam.PCollection, elementsPerBundle int64, preemptMemoryBytes uint64) beam.PCollection {
+	scope = scope.Scope("RebundleEvaluationContext")
+	keyed := beam.ParDo(scope, &assignBundleKeyFn{ElementsPerBundle: elementsPerBundle}, evaluationContext)
+	var ungrouped []beam.PCollection
+	for round := 0; round < maxPreemptionRounds && elementsPerBundle > 1; round++ {
+		elementsPerBundle /= preemptedBundleSplits
+		if elementsPerBundle < 1 {
+			elementsPerBundle = 1
+		}
+		var emitted beam.PCollection
+		emitted, keyed = beam.ParDo2(scope, &preemptibleUngroupBundleFn{
+			PreemptMemoryBytes: preemptMemoryBytes,
+			ElementsPerSplit:   elementsPerBundle,
+		}, beam.GroupByKey(scope, keyed))
+		ungrouped = append(ungrouped, emitted)
+	}
+	ungrouped = append(ungrouped, beam.ParDo(scope, ungroupBundleFn, beam.GroupByKey(scope, keyed)))
+	return beam.Flatten(scope, ungrouped...)
+}
+
+// ExpandAndCombineHistogramWithStatistics calculates histograms like ExpandAndCombineHistogram(), and also returns a
+// PCollection with a single ExpansionStatistics for the expansion.
+func ExpandAndCombineHistogramWithStatistics(scope beam.Scope, evaluationContext beam.PCollection, expandParams *ExpandParameters, dpfParams []*dpfpb.DpfParameters, combineParams *CombineParams, keyBitSize int) (beam.PCollection, beam.PCollection, error) {
+	vectorLength, err := getVectorLength(expandParams, dpfParams)
+	if err != nil {
+		return beam.PCollection{}, beam.PCollection{}, err
+	}
+	prefixes := beam.Create(scope, expandParams.Prefixes)
+	var bucketIDs beam.PCollection
+	if expandParams.DirectExpansion {
+		bucketIDs = prefixes
+	} else {
+		bucketIDs = beam.ParDo(scope, &getBucketIDsFn{
+			Level:                expandParams.Level,
+			PreviousLevel:        expandParams.PreviousLevel,
+			KeyBitSize:           keyBitSize,
+			HierarchyGranularity: expandParams.HierarchyGranularity,
+		}, prefixes)
+	}
+
+	expanded := beam.ParDo(scope, &expandDpfKeyFn{
+		ExpandParams: expandParams,
+		KeyBitSize:   keyBitSize,
+	}, evaluationContext)
+
+	var histogram, combined beam.PCollection
+	if combineParams.DirectCombine {
+		histogram, combined = directCombine(scope, expanded, bucketIDs, vectorLength, combineParams)
+	} else {
+		histogram, combined = segmentCombine(scope, expanded, bucketIDs, vectorLength, combineParams)
+	}
+	statistics := collectExpansionStatistics(scope, evaluationContext, expanded, combined, expandParams, vectorLength)
+	return histogram, statistics, nil
+}
+
+// expansionCounts contains the counts collected from the pipeline for the expansion statistics.
+type expansionCounts struct {
+	ReportCount  uint64
+	CombineNanos int64
+	ExpandNanos  int64
+}
+
+func countReportFn(evalCtx *dpfpb.EvaluationContext) *expansionCounts {
+	return &expansionCounts{ReportCount: 1}
+}
+
+func countCombineTimeFn(vec *expandedVec) *expansionCounts {
+	return &expansionCounts{CombineNanos: vec.CombineNanos}
+}
+
+func countExpandTimeFn(vec *expandedVec) *expansionCounts {
+	return &expansionCounts{ExpandNanos: vec.ExpandNanos}
+}
+
+// sumExpansionCountsFn sums the expansionCounts, and emits zero counts for empty inputs.
+type sumExpansionCountsFn struct{}
+
+func (fn *sumExpansionCountsFn) CreateAccumulator() *expansionCounts {
+	return &expansionCounts{}
+}
+
+func (fn *sumExpansionCountsFn) AddInput(a, c *expansionCounts) *expansionCounts {
+	a.ReportCount += c.ReportCount
+	a.CombineNanos += c.CombineNanos
+	a.ExpandNanos += c.ExpandNanos
+	return a
+}
+
+func (fn *sumExpansionCountsFn) MergeAccumulators(a, b *expansionCounts) *expansionCounts {
+	return fn.AddInput(a, b)
+}
+
+// createExpansionStatisticsFn creates the ExpansionStatistics from the counts and the expansion parameters.
+type createExpansionStatisticsFn struct {
+	Level, PreviousLevel int32
+	PrefixCount          uint64
+	VectorLength         uint64
+}
+
+func (fn *createExpansionStatisticsFn) ProcessElement(counts *expansionCounts, emit func(*pb.ExpansionStatistics)) {
+	emit(&pb.ExpansionStatistics{
+		Level:         fn.Level,
+		PreviousLevel: fn.PreviousLevel,
+		PrefixCount:   fn.PrefixCount,
+		VectorLength:  fn.VectorLength,
+		ReportCount:   counts.ReportCount,
+		CombineTimeMs: time.Duration(counts.CombineNanos).Milliseconds(),
+		ExpandTimeMs:  time.Duration(counts.ExpandNanos).Milliseconds(),
+	})
+}
+
+func collectExpansionStatistics(scope beam.Scope, evaluationContext, expanded, combined beam.PCollection, expandParams *ExpandParameters, vectorLength uint64) beam.PCollection {
+	scope = scope.Scope("CollectExpansionStatistics")
+	counts := beam.Flatten(scope,
+		beam.ParDo(scope, countReportFn, evaluationContext),
+		beam.ParDo(scope, countExpandTimeFn, expanded),
+		beam.ParDo(scope, countCombineTimeFn, combined),
+	)
+	total := beam.Combine(scope, &sumExpansionCountsFn{}, counts)
+	return beam.ParDo(scope, &createExpansionStatisticsFn{
+		Level:         expandParams.Level,
+		PreviousLevel: expandParams.PreviousLevel,
+		PrefixCount:   uint64(len(expandParams.Prefixes)),
+		VectorLength:  vectorLength,
+	}, total)
+}
+
+// formatExpansionStatisticsFn converts the ExpansionStatistics into a wire-formatted and base64 encoded string.
+type formatExpansionStatisticsFn struct{}
+
+func (fn *formatExpansionStatisticsFn) ProcessElement(statistics *pb.ExpansionStatistics, emit func(string)) error {
+	b, err := proto.Marshal(statistics)
+	if err != nil {
+		return err
+	}
+	emit(base64.StdEncoding.EncodeToString(b))
+	return nil
+}
+
+func writeExpansionStatistics(s beam.Scope, statistics beam.PCollection, outputName string) {
+	s = s.Scope("WriteExpansionStatistics")
+	formatted := beam.ParDo(s, &formatExpansionStatisticsFn{}, statistics)
+	textio.Write(s, outputName, formatted)
+}
+
+// ReadExpansionStatistics reads the ExpansionStatistics written by the aggregation pipeline.
+func ReadExpansionStatistics(ctx context.Context, uri string) (*pb.ExpansionStatistics, error) {
+	lines, err := utils.ReadLines(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) != 1 {
+		return nil, fmt.Errorf("expect one line of expansion statistics in %s, got %d", uri, len(lines))
+	}
+	b, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil {
+		return nil, err
+	}
+	statistics := &pb.ExpansionStatistics{}
+	if err := proto.Unmarshal(b, statistics); err != nil {
+		return nil, err
+	}
+	return statistics, nil
+}
+
+// WriteExpansionStatistics writes the ExpansionStatistics in the same format as the aggregation pipeline.
+func WriteExpansionStatistics(ctx context.Context, statistics *pb.ExpansionStatistics, uri string) error {
+	b, err := proto.Marshal(statistics)
+	if err != nil {
+		return err
+	}
+	return utils.WriteLines(ctx, []string{base64.StdEncoding.EncodeToString(b)}, uri)
+}
+
+// DataQualityParams contains the parameters to summarize the reports of a helper at the first level of a query.
+type DataQualityParams struct {
+	// Output URI of the summary, which is written as a JSON line.
+	SummaryURI string
+	// Fraction of the privacy budget of the level reserved for the summary.
+	BudgetFraction float64
+	// Maximum number of reports contributed by one user, which is the sensitivity of the report count.
+	CountSensitivity uint64
+}
+
+// Validate checks the budget fraction for a level with the epsilon. A noised level needs a fraction in (0, 1), so the
+// report count is never released exactly next to a noised histogram.
+func (p *DataQualityParams) Validate(epsilon float64) error {
+	if epsilon > 0 && (p.BudgetFraction <= 0 || p.BudgetFraction >= 1) {
+		return fmt.Errorf("expect budget fraction of the data quality summary in (0, 1), got %v", p.BudgetFraction)
+	}
+	return nil
+}
+
+// DataQualitySummary contains the summary statistics of the reports of a helper, which help analysts judge the health
+// of the data. Unlike the one-party summary, it only has the report count: each helper holds secret shares of the
+// report values, so neither knows the value distribution or the nonzero buckets. Both helpers release a count of the
+// same reports with their own noise, so each of them spends half of the reserved budget.
+type DataQualitySummary struct {
+	ReportCount int64
+	Epsilon     float64
+}
+
+func countDecryptedReportFn(report *pb.PartialReportDpf) int {
+	return 1
+}
+
+// dataQualitySummaryFn formats the summary from the exact report count in the side input, which is read as an
+// iterable since the global sum emits nothing for an empty batch.
+type dataQualitySummaryFn struct {
+	Epsilon          float64
+	CountSensitivity uint64
+}
+
+func (fn *dataQualitySummaryFn) ProcessElement(_ []byte, countIter func(*int) bool, emit func(string)) error {
+	var count, n int
+	for countIter(&n) {
+		count += n
+	}
+	summary := &DataQualitySummary{ReportCount: int64(count), Epsilon: fn.Epsilon}
+	if fn.Epsilon > 0 {
+		// The count is not secret-shared, so each helper adds the full noise.
+		noise, err := distributednoise.DistributedGeometricMechanismRand(fn.Epsilon, fn.CountSensitivity, 1 /*numNoiseShares*/)
+		if err != nil {
+			return err
+		}
+		summary.ReportCount += noise
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	emit(string(b))
+	return nil
+}
+
+func writeDataQualitySummary(scope beam.Scope, decryptedReport beam.PCollection, params *DataQualityParams, epsilon float64) {
+	scope = scope.Scope("DataQualitySummary")
+	count := stats.Sum(scope, beam.ParDo(scope, countDecryptedReportFn, decryptedReport))
+	summary := beam.ParDo(scope, &dataQualitySummaryFn{Epsilon: epsilon, CountSensitivity: params.CountSensitivity}, beam.Impulse(scope), beam.SideInput{Input: count})
+	textio.Write(scope, params.SummaryURI, summary)
+}
+
+// AggregatePartialReportParams contains necessary parameters for function AggregatePartialReport().
+type AggregatePartialReportParams struct {
+	// Input partial report file path, each line contains an encrypted PartialReportDpf.
+	PartialReportURI string
+	// Input file path of encrypted reports added to the batch after its decrypted reports were saved, e.g. reports that
+	// arrived late. At the levels after the first, PartialReportURI points to the decrypted reports, and only these
+	// reports are decrypted and aggregated with them. At the first level, they are aggregated with the reports in
+	// PartialReportURI. Ignored if empty.
+	LateReportURI string
+	// Output partial aggregation file path, each line contains a bucket index and a wire-formatted PartialAggregationDpf.
+	PartialHistogramURI string
+	// Output the decrypted partial report to track the expansion state.
+	DecryptedReportURI string
+	// Output location of the expansion statistics. The statistics are not written if it is empty.
+	ExpansionStatisticsURI string
+	// Number of shards when writing the output file.
+	Shards int64
+	// The private keys for the standard encryption from the helper server.
+	HelperPrivateKeys map[string]*pb.StandardPrivateKey
+	// IDs of the expired private keys, which are not tried for reports with missing or wrong key IDs.
+	ExpiredKeyIDs []string
+	KeyBitSize    int
+	ExpandParams  *ExpandParameters
+	CombineParams *CombineParams
+	// Read the input reports from local files through memory mappings instead of textio, for very large inputs with the
+	// direct runner.
+	MmapLocalFiles bool
+	// Number of reports expanded in one bundle. If zero, it is tuned from PreviousStatistics and TargetBundleMillis, and
+	// the reports are not rebundled if neither is set.
+	ElementsPerBundle  int64
+	PreviousStatistics *pb.ExpansionStatistics
+	TargetBundleMillis int64
+	// Resident memory in bytes of a worker above which the bundles of reports are pre-empted and re-split. The reports
+	// are rebundled with DefaultPreemptibleElementsPerBundle if the bundle size is neither set nor tuned, and the bundles
+	// are not pre-empted if zero.
+	PreemptMemoryBytes uint64
+	// Sample the reports for the consistency check of the secret shares at the first level. It must only be set for
+	// debug batches.
+	ConsistencyCheck *ConsistencyCheckParams
+	// Trace a sample of the reports through the decryption and the expansion at the current level. The reports are not
+	// traced if nil.
+	Trace *TraceParams
+	// Summarize the reports at the first level with a fraction of the epsilon in CombineParams. The summary is not
+	// written if nil.
+	DataQuality *DataQualityParams
+}
+
+// readEncryptedReport reads the encrypted reports with textio, or through memory mappings if mmap is true.
+func readEncryptedReport(scope beam.Scope, uri string, mmap bool) (beam.PCollection, error) {
+	if mmap {
+		return ReadEncryptedPartialReportMmap(scope, uri)
+	}
+	return ReadEncryptedPartialReport(scope, uri), nil
+}
+
+// AggregatePartialReport reads the partial report and calculates partial aggregation results from it.
+//
+// The input can mix the decrypted reports saved at the first level of a hierarchical query and the encrypted reports
+// in LateReportURI, which are decrypted and normalized into the same evaluation contexts, so adding reports to a batch
+// does not require decrypting the whole batch again.
+func AggregatePartialReport(scope beam.Scope, params *AggregatePartialReportParams) error {
+	dpfParams, err := GetDPFParameters(params.KeyBitSize, params.ExpandParams)
+	if err != nil {
+		return err
+	}
+
+	if err := CheckExpansionParameters(dpfParams, params.ExpandParams); err != nil {
+		return err
+	}
+
+	combineParams := params.CombineParams
+	if params.DataQuality != nil {
+		if params.ExpandParams.PreviousLevel >= 0 {
+			return errors.New("expect the data quality summary only at the first level, where the reports are decrypted")
+		}
+		if err := params.DataQuality.Validate(combineParams.Epsilon); err != nil {
+			return err
+		}
+	}
+
+	scope = scope.Scope("AggregatePartialreportDpf")
 
 	isFinalLevel := params.ExpandParams.Level == int32(len(dpfParams)-1)
-	var decryptedReport beam.PCollection
+	var decryptedReport, encrypted, late beam.PCollection
+	if params.LateReportURI != "" {
+		if late, err = readEncryptedReport(scope.Scope("LateReport"), params.LateReportURI, params.MmapLocalFiles); err != nil {
+			return err
+		}
+	}
 	if params.ExpandParams.PreviousLevel < 0 {
-		encrypted := ReadEncryptedPartialReport(scope, params.PartialReportURI)
-		decryptedReport = DecryptPartialReport(scope, encrypted, params.HelperPrivateKeys)
+		if encrypted, err = readEncryptedReport(scope, params.PartialReportURI, params.MmapLocalFiles); err != nil {
+			return err
+		}
+		if late.IsValid() {
+			encrypted = beam.Flatten(scope, encrypted, late)
+		}
+		decryptedReport = DecryptPartialReportWithExpiredKeys(scope, encrypted, params.HelperPrivateKeys, params.ExpiredKeyIDs)
+		decryptedReport = CheckReportKeyBitSize(scope, decryptedReport, dpfParams, params.KeyBitSize)
+		if params.ConsistencyCheck != nil {
+			if err := WriteConsistencyShares(scope, encrypted, params.HelperPrivateKeys, dpfParams, params.ConsistencyCheck); err != nil {
+				return err
+			}
+		}
+		if params.DataQuality != nil {
+			summaryEpsilon := combineParams.Epsilon * params.DataQuality.BudgetFraction
+			remaining := *combineParams
+			remaining.Epsilon -= summaryEpsilon
+			combineParams = &remaining
+			writeDataQualitySummary(scope, decryptedReport, params.DataQuality, summaryEpsilon/numberOfHelpers)
+		}
 		if !isFinalLevel && !params.ExpandParams.DirectExpansion {
 			writePartialReport(scope, decryptedReport, params.DecryptedReportURI, params.Shards)
 		}
+	} else if params.MmapLocalFiles {
+		if decryptedReport, err = ReadPartialReportMmap(scope, params.PartialReportURI); err != nil {
+			return err
+		}
 	} else {
 		decryptedReport = ReadPartialReport(scope, params.PartialReportURI)
 	}
+	if params.ExpandParams.PreviousLevel >= 0 && late.IsValid() {
+		// Only the late reports are decrypted, and then aggregated like the decrypted reports of the batch.
+		lateScope := scope.Scope("LateReport")
+		decryptedLate := DecryptPartialReportWithExpiredKeys(lateScope, late, params.HelperPrivateKeys, params.ExpiredKeyIDs)
+		decryptedLate = CheckReportKeyBitSize(lateScope, decryptedLate, dpfParams, params.KeyBitSize)
+		decryptedReport = beam.Flatten(scope, decryptedReport, decryptedLate)
+	}
+	if params.Trace != nil {
+		if params.Trace.EncryptedReportURI != "" {
+			encrypted = ReadEncryptedPartialReport(scope, params.Trace.EncryptedReportURI)
+		} else if params.ExpandParams.PreviousLevel >= 0 {
+			return errors.New("expect the encrypted reports to trace at the levels after the first")
+		}
+		if err := WriteReportTraces(scope, encrypted, params.HelperPrivateKeys, params.ExpiredKeyIDs, params.ExpandParams, params.KeyBitSize, params.Trace); err != nil {
+			return err
+		}
+	}
 	evalCtx := CreateEvaluationContext(scope, decryptedReport, params.ExpandParams, params.KeyBitSize)
-	partialHistogram, err := ExpandAndCombineHistogram(scope, evalCtx, params.ExpandParams, dpfParams, params.CombineParams, params.KeyBitSize)
+	elementsPerBundle := params.ElementsPerBundle
+	if elementsPerBundle == 0 && params.PreviousStatistics != nil {
+		vectorLength, err := getVectorLength(params.ExpandParams, dpfParams)
+		if err != nil {
+			return err
+		}
+		elementsPerBundle = TuneElementsPerBundle(params.PreviousStatistics, vectorLength, params.TargetBundleMillis)
+	}
+	if params.PreemptMemoryBytes > 0 {
+		if elementsPerBundle == 0 {
+			elementsPerBundle = DefaultPreemptibleElementsPerBundle
+		}
+		evalCtx = RebundleEvaluationContextWithPreemption(scope, evalCtx, elementsPerBundle, params.PreemptMemoryBytes)
+	} else if elementsPerBundle > 0 {
+		evalCtx = RebundleEvaluationContext(scope, evalCtx, elementsPerBundle)
+	}
+	partialHistogram, statistics, err := ExpandAndCombineHistogramWithStatistics(scope, evalCtx, params.ExpandParams, dpfParams, combineParams, params.KeyBitSize)
 	if err != nil {
 		return err
 	}
 
 	writeHistogram(scope, partialHistogram, params.PartialHistogramURI)
+	if params.ExpansionStatisticsURI != "" {
+		writeExpansionStatistics(scope, statistics, params.ExpansionStatisticsURI)
+	}
+	return nil
+}
+
+// BatchParams contains the input and outputs of one batch when several independent batches are aggregated in one
+// pipeline.
+type BatchParams struct {
+	BatchID                string
+	PartialReportURI       string
+	PartialHistogramURI    string
+	DecryptedReportURI     string
+	ExpansionStatisticsURI string
+	// Encrypted reports added to the batch after its decrypted reports were saved. Ignored if empty.
+	LateReportURI string
+	// Output manifest with the hashes of the partial histogram files of the batch. It is not written if empty.
+	ManifestURI string
+	// Number of shards when writing the outputs of the batch. If zero, the value in the shared parameters is used.
+	Shards int64
+	// Metadata of the batch with the key bit size of its reports, which sets KeyBitSize if not empty.
+	MetadataURI string
+	// Bit size of the bucket IDs in the reports of the batch, so batches from clients with different key bit sizes can
+	// be aggregated in one job. If zero, the value in the shared parameters is used.
+	KeyBitSize int
+}
+
+// BatchMetadata describes the reports of a batch, and is written next to them by the client that batches the reports.
+// The helpers read the key bit size of a query from the metadata of its batch instead of a deployment-wide setting.
+type BatchMetadata struct {
+	// Bit size of the bucket IDs in all the reports of the batch.
+	KeyBitSize int32
+	// Whether the batch only contains reports for debugging, which can be aggregated without noise or with seeded noise.
+	// The helpers only trust the flag in metadata signed by a batcher they trust, see VerifyBatchMetadata, and only for
+	// the reports with BatchRoot.
+	DebugBatch bool `json:",omitempty"`
+	// Hex-encoded root of the batch integrity digest over the IDs of all the reports of the batch, which binds the
+	// signed metadata to the batch. Metadata signed for one batch can not flag another batch as a debug batch.
+	BatchRoot string `json:",omitempty"`
+	// Base64-encoded Ed25519 signature of the batcher over the canonical JSON of the metadata without the signature.
+	Signature string `json:",omitempty"`
+}
+
+// ErrUnsignedBatchMetadata is returned when the batch metadata is not signed by any trusted batcher.
+var ErrUnsignedBatchMetadata = errors.New("batch metadata not signed by a trusted batcher")
+
+func batchMetadataMessage(metadata *BatchMetadata) ([]byte, error) {
+	unsigned := *metadata
+	unsigned.Signature = ""
+	return canonicaljson.Marshal(&unsigned)
+}
+
+// SignBatchMetadata signs the batch metadata with the Ed25519 key of the batcher.
+func SignBatchMetadata(metadata *BatchMetadata, key ed25519.PrivateKey) error {
+	b, err := batchMetadataMessage(metadata)
+	if err != nil {
+		return err
+	}
+	metadata.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, b))
+	return nil
+}
+
+// VerifyBatchMetadata returns ErrUnsignedBatchMetadata unless the batch metadata is signed with one of the keys.
+func VerifyBatchMetadata(metadata *BatchMetadata, keys []ed25519.PublicKey) error {
+	if metadata.Signature == "" {
+		return ErrUnsignedBatchMetadata
+	}
+	sig, err := base64.StdEncoding.DecodeString(metadata.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsignedBatchMetadata, err)
+	}
+	b, err := batchMetadataMessage(metadata)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, b, sig) {
+			return nil
+		}
+	}
+	return ErrUnsignedBatchMetadata
+}
+
+// ReadBatchMetadata reads the BatchMetadata from a file and validates it.
+func ReadBatchMetadata(ctx context.Context, uri string) (*BatchMetadata, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	metadata := &BatchMetadata{}
+	if err := json.Unmarshal(b, metadata); err != nil {
+		return nil, err
+	}
+	if metadata.KeyBitSize <= 0 || metadata.KeyBitSize > 128 {
+		return nil, fmt.Errorf("expect key bit size in [1, 128] in batch metadata %q, got %d", uri, metadata.KeyBitSize)
+	}
+	return metadata, nil
+}
+
+// WriteBatchMetadata writes the BatchMetadata into a file.
+func WriteBatchMetadata(ctx context.Context, metadata *BatchMetadata, uri string) error {
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return utils.WriteBytes(ctx, b, uri, nil)
+}
+
+// ErrKeyBitSizeMismatch is returned when the requested key bit size differs from the one in the batch metadata.
+var ErrKeyBitSizeMismatch = errors.New("key bit size differs from the batch metadata")
+
+// ResolveKeyBitSize returns the key bit size in the batch metadata, and checks it agrees with the requested one if the
+// latter is not zero.
+func ResolveKeyBitSize(requested int32, metadata *BatchMetadata) (int32, error) {
+	if requested != 0 && requested != metadata.KeyBitSize {
+		return 0, fmt.Errorf("%w: requested %d, got %d", ErrKeyBitSizeMismatch, requested, metadata.KeyBitSize)
+	}
+	return metadata.KeyBitSize, nil
+}
+
+// ReadBatchParams reads the batches from a file with a JSON list of BatchParams, and checks the batch IDs are unique
+// and the required URIs are set.
+func ReadBatchParams(ctx context.Context, uri string) ([]*BatchParams, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	var batches []*BatchParams
+	if err := json.Unmarshal(b, &batches); err != nil {
+		return nil, err
+	}
+	if len(batches) == 0 {
+		return nil, fmt.Errorf("no batch found in %q", uri)
+	}
+	ids := make(map[string]bool)
+	for _, batch := range batches {
+		if batch.BatchID == "" {
+			return nil, fmt.Errorf("expect non-empty batch ID in %q", uri)
+		}
+		if ids[batch.BatchID] {
+			return nil, fmt.Errorf("duplicate batch ID %q in %q", batch.BatchID, uri)
+		}
+		ids[batch.BatchID] = true
+		if batch.PartialReportURI == "" || batch.PartialHistogramURI == "" {
+			return nil, fmt.Errorf("expect non-empty partial report and histogram URIs for batch %q", batch.BatchID)
+		}
+	}
+	return batches, nil
+}
+
+// AggregatePartialReportBatches aggregates several independent batches in one pipeline, so they share the startup
+// cost of the job. Each batch is expanded and combined separately with the shared parameters, and its outputs are
+// written to the locations in BatchParams.
+func AggregatePartialReportBatches(scope beam.Scope, params *AggregatePartialReportParams, batches []*BatchParams) error {
+	if params.ConsistencyCheck != nil {
+		return errors.New("consistency check is not supported when aggregating multiple batches")
+	}
+	if params.Trace != nil {
+		return errors.New("report tracing is not supported when aggregating multiple batches")
+	}
+	for _, batch := range batches {
+		batchParams := *params
+		batchParams.PartialReportURI = batch.PartialReportURI
+		batchParams.PartialHistogramURI = batch.PartialHistogramURI
+		batchParams.DecryptedReportURI = batch.DecryptedReportURI
+		batchParams.ExpansionStatisticsURI = batch.ExpansionStatisticsURI
+		batchParams.LateReportURI = batch.LateReportURI
+		if batch.Shards > 0 {
+			batchParams.Shards = batch.Shards
+		}
+		if batch.KeyBitSize > 0 {
+			batchParams.KeyBitSize = batch.KeyBitSize
+		}
+		if err := AggregatePartialReport(scope.Scope("Batch_"+batch.BatchID), &batchParams); err != nil {
+			return fmt.Errorf("batch %q: %v", batch.BatchID, err)
+		}
+	}
 	return nil
 }
 
@@ -775,14 +2038,254 @@ func writeCompleteHistogram(s beam.Scope, indexResult beam.PCollection, fileName
 	textio.Write(s, fileName, formatted)
 }
 
+// PostFilter is applied to the complete histogram after the merge, so analysts get the buckets they need without
+// post-processing. The filter is post-processing of the noised results, which does not consume privacy budget.
+//
+// The noise is added modulo 2^64, so a bucket whose noise exceeds its sum wraps around to a huge unsigned sum. The
+// filter compares the sums as two's complement signed integers, where such buckets are negative.
+type PostFilter struct {
+	// Buckets with sums below the floor are dropped if positive.
+	MinValue int64
+	// Only the TopK buckets with the largest sums are kept if positive. Ties are broken by the smaller bucket IDs.
+	TopK int
+}
+
+// ParsePostFilter parses a filter in the format "min_value=<floor>,top_k=<k>", where either part is optional. The
+// filter is nil if s is empty.
+func ParsePostFilter(s string) (*PostFilter, error) {
+	if s == "" {
+		return nil, nil
+	}
+	filter := &PostFilter{}
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("expect filter in format name=value, got %q", kv)
+		}
+		var err error
+		switch name, value := kv[:i], kv[i+1:]; name {
+		case "min_value":
+			filter.MinValue, err = strconv.ParseInt(value, 10, 64)
+			if err == nil && filter.MinValue <= 0 {
+				err = fmt.Errorf("expect positive min_value, got %d", filter.MinValue)
+			}
+		case "top_k":
+			filter.TopK, err = strconv.Atoi(value)
+			if err == nil && filter.TopK <= 0 {
+				err = fmt.Errorf("expect positive top_k, got %d", filter.TopK)
+			}
+		default:
+			err = fmt.Errorf("unknown post filter %q", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+// String formats the filter in the format of ParsePostFilter.
+func (f *PostFilter) String() string {
+	var parts []string
+	if f.MinValue > 0 {
+		parts = append(parts, fmt.Sprintf("min_value=%d", f.MinValue))
+	}
+	if f.TopK > 0 {
+		parts = append(parts, fmt.Sprintf("top_k=%d", f.TopK))
+	}
+	return strings.Join(parts, ",")
+}
+
+// signedSum returns the noised sum of the bucket as a signed integer.
+func signedSum(result CompleteHistogram) int64 {
+	return int64(result.Sum)
+}
+
+// lessCompleteHistogramFn orders the buckets by their signed sums, where buckets with smaller IDs are larger among ties.
+func lessCompleteHistogramFn(a, b CompleteHistogram) bool {
+	if a.Sum != b.Sum {
+		return signedSum(a) < signedSum(b)
+	}
+	return a.Bucket.Cmp(b.Bucket) > 0
+}
+
+// minValueFilterFn drops the buckets with signed sums below the floor.
+type minValueFilterFn struct {
+	MinValue     int64
+	countDropped beam.Counter
+}
+
+func (fn *minValueFilterFn) Setup() {
+	fn.countDropped = beam.NewCounter("aggregation", "minValueFilterFn_dropped_count")
+}
+
+func (fn *minValueFilterFn) ProcessElement(ctx context.Context, result CompleteHistogram, emit func(CompleteHistogram)) {
+	if signedSum(result) < fn.MinValue {
+		fn.countDropped.Inc(ctx, 1)
+		return
+	}
+	emit(result)
+}
+
+func flattenHistogramFn(results []CompleteHistogram, emit func(CompleteHistogram)) {
+	for _, result := range results {
+		emit(result)
+	}
+}
+
+// ApplyPostFilter filters the complete histogram.
+func ApplyPostFilter(s beam.Scope, completeHistogram beam.PCollection, filter *PostFilter) beam.PCollection {
+	s = s.Scope("ApplyPostFilter")
+	if filter.MinValue > 0 {
+		completeHistogram = beam.ParDo(s, &minValueFilterFn{MinValue: filter.MinValue}, completeHistogram)
+	}
+	if filter.TopK > 0 {
+		largest := top.Largest(s, completeHistogram, filter.TopK, lessCompleteHistogramFn)
+		completeHistogram = beam.ParDo(s, flattenHistogramFn, largest)
+	}
+	return completeHistogram
+}
+
+// FilterCompleteHistogram filters the complete histogram without using a Beam pipeline. The results are ordered by
+// decreasing signed sums if TopK is set.
+func FilterCompleteHistogram(results []CompleteHistogram, filter *PostFilter) []CompleteHistogram {
+	var filtered []CompleteHistogram
+	for _, result := range results {
+		if filter.MinValue == 0 || signedSum(result) >= filter.MinValue {
+			filtered = append(filtered, result)
+		}
+	}
+	if filter.TopK > 0 {
+		sort.Slice(filtered, func(i, j int) bool { return lessCompleteHistogramFn(filtered[j], filtered[i]) })
+		if len(filtered) > filter.TopK {
+			filtered = filtered[:filter.TopK]
+		}
+	}
+	return filtered
+}
+
 // MergePartialHistogram reads the partial aggregated histograms and merges them to get the complete histogram.
 func MergePartialHistogram(scope beam.Scope, partialHistFile1, partialHistFile2, completeHistFile string) {
+	MergePartialHistogramWithAnnotation(scope, partialHistFile1, partialHistFile2, "", nil, completeHistFile)
+}
+
+// MergePartialHistogramWithAnnotation merges the partial histograms, and joins the bucket IDs in the complete histogram against
+// the labels in the annotation file. No annotation is added if annotationFile is empty. The post filter is applied
+// before the annotation if not nil.
+func MergePartialHistogramWithAnnotation(scope beam.Scope, partialHistFile1, partialHistFile2, annotationFile string, filter *PostFilter, completeHistFile string) {
 	scope = scope.Scope("MergePartialHistogram")
 
 	partialHist1 := readPartialHistogram(scope, partialHistFile1)
 	partialHist2 := readPartialHistogram(scope, partialHistFile2)
 	completeHistogram := MergeHistogram(scope, partialHist1, partialHist2)
-	writeCompleteHistogram(scope, completeHistogram, completeHistFile)
+	if filter != nil {
+		completeHistogram = ApplyPostFilter(scope, completeHistogram, filter)
+	}
+	if annotationFile == "" {
+		writeCompleteHistogram(scope, completeHistogram, completeHistFile)
+		return
+	}
+	annotated := AnnotateHistogram(scope, completeHistogram, readBucketAnnotation(scope, annotationFile))
+	writeAnnotatedHistogram(scope, annotated, completeHistFile)
+}
+
+// AnnotatedHistogram represents the final aggregation result of a bucket with its human-readable labels.
+type AnnotatedHistogram struct {
+	Bucket uint128.Uint128
+	Sum    uint64
+	Labels []string
+}
+
+// parseBucketAnnotation parses a line of the annotation file, with the bucket ID in the first column and the labels in the others.
+func parseBucketAnnotation(line string) (uint128.Uint128, []string, error) {
+	cols := strings.Split(line, ",")
+	if len(cols) < 2 {
+		return uint128.Zero, nil, fmt.Errorf("expect at least 2 columns in line %q, got %d", line, len(cols))
+	}
+	bucket, err := utils.StringToUint128(strings.TrimSpace(cols[0]))
+	if err != nil {
+		return uint128.Zero, nil, err
+	}
+	return bucket, cols[1:], nil
+}
+
+type parseBucketAnnotationFn struct {
+	countAnnotation beam.Counter
+}
+
+func (fn *parseBucketAnnotationFn) Setup() {
+	fn.countAnnotation = beam.NewCounter("aggregation", "parseBucketAnnotationFn_annotation_count")
+}
+
+func (fn *parseBucketAnnotationFn) ProcessElement(ctx context.Context, line string, emit func(uint128.Uint128, []string)) error {
+	bucket, labels, err := parseBucketAnnotation(line)
+	if err != nil {
+		return err
+	}
+	fn.countAnnotation.Inc(ctx, 1)
+	emit(bucket, labels)
+	return nil
+}
+
+func readBucketAnnotation(s beam.Scope, annotationFile string) beam.PCollection {
+	s = s.Scope("ReadBucketAnnotation")
+	lines := textio.ReadSdf(s, annotationFile)
+	return beam.ParDo(s, &parseBucketAnnotationFn{}, lines)
+}
+
+func keyHistogramFn(result CompleteHistogram) (uint128.Uint128, uint64) {
+	return result.Bucket, result.Sum
+}
+
+// annotateHistogramFn joins the aggregation result of a bucket with its labels. Buckets without labels are passed through.
+type annotateHistogramFn struct {
+	countMatched   beam.Counter
+	countUnmatched beam.Counter
+}
+
+func (fn *annotateHistogramFn) Setup() {
+	fn.countMatched = beam.NewCounter("aggregation", "annotateHistogramFn_matched_count")
+	fn.countUnmatched = beam.NewCounter("aggregation", "annotateHistogramFn_unmatched_count")
+}
+
+func (fn *annotateHistogramFn) ProcessElement(ctx context.Context, bucket uint128.Uint128, sumIter func(*uint64) bool, labelsIter func(*[]string) bool, emit func(AnnotatedHistogram)) error {
+	var sum uint64
+	if !sumIter(&sum) {
+		// The annotated bucket does not appear in the result.
+		return nil
+	}
+	var labels []string
+	if labelsIter(&labels) {
+		var more []string
+		if labelsIter(&more) {
+			return fmt.Errorf("expect at most one annotation for bucket ID %s", bucket.String())
+		}
+		fn.countMatched.Inc(ctx, 1)
+	} else {
+		fn.countUnmatched.Inc(ctx, 1)
+	}
+	emit(AnnotatedHistogram{Bucket: bucket, Sum: sum, Labels: labels})
+	return nil
+}
+
+// AnnotateHistogram joins the complete histogram with the bucket annotations, which are pairs of <bucket ID, labels>.
+func AnnotateHistogram(s beam.Scope, completeHistogram, annotations beam.PCollection) beam.PCollection {
+	s = s.Scope("AnnotateHistogram")
+	keyed := beam.ParDo(s, keyHistogramFn, completeHistogram)
+	joined := beam.CoGroupByKey(s, keyed, annotations)
+	return beam.ParDo(s, &annotateHistogramFn{}, joined)
+}
+
+func formatAnnotatedHistogramFn(result AnnotatedHistogram) string {
+	cols := append([]string{result.Bucket.String(), strconv.FormatUint(result.Sum, 10)}, result.Labels...)
+	return strings.Join(cols, ",")
+}
+
+// writeAnnotatedHistogram writes the annotated histogram in lines of format: bucket ID, SUM, labels.
+func writeAnnotatedHistogram(s beam.Scope, annotated beam.PCollection, fileName string) {
+	s = s.Scope("WriteAnnotatedHistogram")
+	formatted := beam.ParDo(s, formatAnnotatedHistogramFn, annotated)
+	textio.Write(s, fileName, formatted)
 }
 
 // ReadPartialHistogram reads the partial aggregation result without using a Beam pipeline.
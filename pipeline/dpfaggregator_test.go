@@ -16,6 +16,9 @@ package dpfaggregator
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -37,6 +40,7 @@ import (
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/incrementaldpf"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/standardencrypt"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttrace"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
 
@@ -48,6 +52,8 @@ import (
 
 type standardEncryptFn struct {
 	PublicKeys *reporttypes.PublicKeys
+	// Some producers do not set the key IDs in the reports.
+	OmitKeyID bool
 }
 
 func (fn *standardEncryptFn) ProcessElement(report *pb.PartialReportDpf, emit func(*pb.AggregatablePayload)) error {
@@ -71,13 +77,21 @@ func (fn *standardEncryptFn) ProcessElement(report *pb.PartialReportDpf, emit fu
 	if err != nil {
 		return err
 	}
+	if fn.OmitKeyID {
+		keyID = ""
+	}
 	emit(&pb.AggregatablePayload{Payload: result, SharedInfo: contextInfo, KeyId: keyID})
 	return nil
 }
 
 func TestDecryptPartialReport(t *testing.T) {
+	testDecryptPartialReport(t, false /*omitKeyID*/)
+	testDecryptPartialReport(t, true /*omitKeyID*/)
+}
+
+func testDecryptPartialReport(t *testing.T, omitKeyID bool) {
 	ctx := context.Background()
-	privKeys, pubKeysInfo, err := cryptoio.GenerateHybridKeyPairs(ctx, 1)
+	privKeys, pubKeysInfo, err := cryptoio.GenerateHybridKeyPairs(ctx, 3)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -94,7 +108,7 @@ func TestDecryptPartialReport(t *testing.T) {
 	pipeline, scope := beam.NewPipelineWithRoot()
 
 	wantReports := beam.CreateList(scope, reports)
-	encryptedReports := beam.ParDo(scope, &standardEncryptFn{PublicKeys: pubKeysInfo}, wantReports)
+	encryptedReports := beam.ParDo(scope, &standardEncryptFn{PublicKeys: pubKeysInfo, OmitKeyID: omitKeyID}, wantReports)
 	getReports := DecryptPartialReport(scope, encryptedReports, privKeys)
 
 	passert.Equals(scope, getReports, wantReports)
@@ -104,6 +118,70 @@ func TestDecryptPartialReport(t *testing.T) {
 	}
 }
 
+func TestReadPartialReportMmap(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-mmap")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	encrypted := []*pb.AggregatablePayload{
+		{Payload: &pb.StandardCiphertext{Data: []byte("report1")}, SharedInfo: "context1", KeyId: "key1"},
+		{Payload: &pb.StandardCiphertext{Data: []byte("report2")}, SharedInfo: "context2", KeyId: "key2"},
+		{Payload: &pb.StandardCiphertext{Data: []byte("report3")}, SharedInfo: "context3", KeyId: "key1"},
+	}
+	decrypted := []*pb.PartialReportDpf{
+		{SumKey: &dpfpb.DpfKey{Seed: &dpfpb.Block{High: 2, Low: 1}}},
+		{SumKey: &dpfpb.DpfKey{Seed: &dpfpb.Block{High: 4, Low: 3}}},
+	}
+
+	// The reports are split into two shards, as written by the pipelines.
+	var encryptedLines, decryptedLines []string
+	for _, e := range encrypted {
+		line, err := reporttypes.SerializeAggregatablePayload(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encryptedLines = append(encryptedLines, line)
+	}
+	for _, d := range decrypted {
+		b, err := proto.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decryptedLines = append(decryptedLines, base64.StdEncoding.EncodeToString(b))
+	}
+	encryptedURI := path.Join(tmpDir, "encrypted")
+	decryptedURI := path.Join(tmpDir, "decrypted")
+	for i, shard := range [][]string{encryptedLines[:1], encryptedLines[1:]} {
+		if err := ioutil.WriteFile(fmt.Sprintf("%s-%d-2", encryptedURI, i+1), []byte(strings.Join(shard, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(decryptedURI+"-1-1", []byte(strings.Join(decryptedLines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pipeline, scope := beam.NewPipelineWithRoot()
+	gotEncrypted, err := ReadEncryptedPartialReportMmap(scope, encryptedURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotDecrypted, err := ReadPartialReportMmap(scope, decryptedURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passert.Equals(scope, gotEncrypted, beam.CreateList(scope, encrypted))
+	passert.Equals(scope, gotDecrypted, beam.CreateList(scope, decrypted))
+	if err := ptest.Run(pipeline); err != nil {
+		t.Fatalf("pipeline failed: %s", err)
+	}
+
+	if _, err := ReadPartialReportMmap(scope, "gs://bucket/reports"); err == nil {
+		t.Error("expect error for reading GCS files with memory mappings")
+	}
+}
+
 type idPartialAggregation struct {
 	ID                 uint128.Uint128
 	PartialAggregation *pb.PartialAggregationDpf
@@ -203,10 +281,10 @@ func TestDirectAndSegmentCombineVector(t *testing.T) {
 		} else {
 			intputBuckets = beam.CreateList(scope, [][]uint128.Uint128{{}})
 		}
-		getResultSegment := segmentCombine(scope, inputVec, intputBuckets, 1<<logN, 13)
+		getResultSegment, _ := segmentCombine(scope, inputVec, intputBuckets, 1<<logN, &CombineParams{SegmentLength: 13})
 		passert.Equals(scope, beam.ParDo(scope, convertIDPartialAggregationFn, getResultSegment), wantResult)
 
-		getResultDirect := directCombine(scope, inputVec, intputBuckets, 1<<logN)
+		getResultDirect, _ := directCombine(scope, inputVec, intputBuckets, 1<<logN, &CombineParams{DirectCombine: true})
 		passert.Equals(scope, beam.ParDo(scope, convertIDPartialAggregationFn, getResultDirect), wantResult)
 
 		if err := ptest.Run(pipeline); err != nil {
@@ -301,6 +379,183 @@ func TestAggregationAndMerge(t *testing.T) {
 	}
 }
 
+// expansionStatisticsWithoutTime drops the combine time, which is not deterministic.
+func expansionStatisticsWithoutTime(statistics *pb.ExpansionStatistics) string {
+	return fmt.Sprintf("level=%d previous=%d prefixes=%d length=%d reports=%d",
+		statistics.Level, statistics.PreviousLevel, statistics.PrefixCount, statistics.VectorLength, statistics.ReportCount)
+}
+
+func TestExpansionStatistics(t *testing.T) {
+	var reports []rawConversion
+	for i := uint64(0); i < 5; i++ {
+		reports = append(reports, rawConversion{Index: uint128.From64(i), Value: 1})
+	}
+
+	pipeline, scope := beam.NewPipelineWithRoot()
+	conversions := beam.CreateList(scope, reports)
+
+	ctxParams, err := incrementaldpf.GetDefaultDPFParameters(keyBitSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expandParams := &ExpandParameters{
+		Level:         7,
+		PreviousLevel: -1,
+	}
+
+	partialReport, _ := beam.ParDo2(scope, &splitConversionFn{KeyBitSize: keyBitSize}, conversions)
+	evalCtx := CreateEvaluationContext(scope, partialReport, expandParams, keyBitSize)
+	for _, combineParams := range []*CombineParams{{DirectCombine: true}, {SegmentLength: 100}} {
+		_, statistics, err := ExpandAndCombineHistogramWithStatistics(scope, evalCtx, expandParams, ctxParams, combineParams, keyBitSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		passert.Equals(scope, beam.ParDo(scope, expansionStatisticsWithoutTime, statistics), "level=7 previous=-1 prefixes=0 length=256 reports=5")
+	}
+
+	if err := ptest.Run(pipeline); err != nil {
+		t.Fatalf("pipeline failed: %s", err)
+	}
+}
+
+func TestTuneElementsPerBundle(t *testing.T) {
+	previous := &pb.ExpansionStatistics{VectorLength: 256, ReportCount: 1000, ExpandTimeMs: 2000}
+	for _, tc := range []struct {
+		desc               string
+		previous           *pb.ExpansionStatistics
+		vectorLength       uint64
+		targetBundleMillis int64
+		want               int64
+	}{
+		{"same vector length", previous, 256, 10000, 5000},
+		{"longer vector", previous, 1024, 10000, 1250},
+		{"expensive reports", previous, 1 << 20, 100, 1},
+		{"cheap reports", previous, 1, 10000, maxElementsPerBundle},
+		{"no expansion time", &pb.ExpansionStatistics{VectorLength: 256, ReportCount: 1000}, 256, 10000, 0},
+		{"no target", previous, 256, 0, 0},
+	} {
+		if got := TuneElementsPerBundle(tc.previous, tc.vectorLength, tc.targetBundleMillis); got != tc.want {
+			t.Errorf("%s: got %d elements per bundle, want %d", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestRebundleEvaluationContext(t *testing.T) {
+	var reports []rawConversion
+	for i := uint64(0); i < 10; i++ {
+		reports = append(reports, rawConversion{Index: uint128.From64(i), Value: 1})
+	}
+
+	pipeline, scope := beam.NewPipelineWithRoot()
+	conversions := beam.CreateList(scope, reports)
+	expandParams := &ExpandParameters{Level: 7, PreviousLevel: -1}
+	partialReport, _ := beam.ParDo2(scope, &splitConversionFn{KeyBitSize: keyBitSize}, conversions)
+	evalCtx := CreateEvaluationContext(scope, partialReport, expandParams, keyBitSize)
+	passert.Count(scope, RebundleEvaluationContext(scope, evalCtx, 3), "rebundled", 10)
+
+	if err := ptest.Run(pipeline); err != nil {
+		t.Fatalf("pipeline failed: %s", err)
+	}
+}
+
+func TestRebundleEvaluationContextWithPreemption(t *testing.T) {
+	defer func(read func() uint64) { readMemoryBytes = read }(readMemoryBytes)
+
+	for _, tc := range []struct {
+		desc       string
+		memorySize uint64
+	}{
+		{"below limit", 1 << 20},
+		{"above limit", 1 << 40},
+	} {
+		memorySize := tc.memorySize
+		readMemoryBytes = func() uint64 { return memorySize }
+
+		var reports []rawConversion
+		for i := uint64(0); i < 40; i++ {
+			reports = append(reports, rawConversion{Index: uint128.From64(i), Value: 1})
+		}
+		pipeline, scope := beam.NewPipelineWithRoot()
+		conversions := beam.CreateList(scope, reports)
+		expandParams := &ExpandParameters{Level: 7, PreviousLevel: -1}
+		partialReport, _ := beam.ParDo2(scope, &splitConversionFn{KeyBitSize: keyBitSize}, conversions)
+		evalCtx := CreateEvaluationContext(scope, partialReport, expandParams, keyBitSize)
+		// All the reports are kept whether the bundles are pre-empted or not, including the split bundles that are
+		// pre-empted again in the later rounds.
+		passert.Count(scope, RebundleEvaluationContextWithPreemption(scope, evalCtx, 32, 1<<30), "rebundled", 40)
+
+		if err := ptest.Run(pipeline); err != nil {
+			t.Fatalf("%s: pipeline failed: %s", tc.desc, err)
+		}
+	}
+}
+
+func TestReadMemoryBytes(t *testing.T) {
+	if got := readMemoryBytes(); got == 0 {
+		t.Error("expect nonzero resident memory of the test process")
+	}
+}
+
+func TestMemoryWatermark(t *testing.T) {
+	defer func(read func() uint64) { readMemoryBytes = read }(readMemoryBytes)
+	memorySize := uint64(100)
+	readMemoryBytes = func() uint64 { return memorySize }
+
+	w := &memoryWatermark{}
+	if !w.sample(false) {
+		t.Fatal("expect the first memory sample to be read")
+	}
+	memorySize = 300
+	if w.sample(false) {
+		t.Error("expect the memory sample within the sample interval to be skipped")
+	}
+	if !w.sample(true) || w.last != 300 {
+		t.Errorf("expect forced memory sample of 300 bytes, got %d", w.last)
+	}
+	memorySize = 200
+	w.sample(true)
+	if w.last != 200 || w.peak != 300 {
+		t.Errorf("expect last sample 200 and peak 300, got %d and %d", w.last, w.peak)
+	}
+	w.reset()
+	w.sample(false)
+	if w.peak != 200 {
+		t.Errorf("expect peak 200 after reset, got %d", w.peak)
+	}
+}
+
+func TestReadWriteExpansionStatistics(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-expansion-statistics")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	want := &pb.ExpansionStatistics{
+		Level:              2,
+		PreviousLevel:      1,
+		PrefixCount:        3,
+		VectorLength:       48,
+		ReportCount:        100,
+		CombineTimeMs:      12,
+		ExpandTimeMs:       34,
+		NonzeroBucketCount: 6,
+		NonzeroFraction:    0.125,
+	}
+	uri := path.Join(tmpDir, "stats")
+	if err := WriteExpansionStatistics(ctx, want, uri); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadExpansionStatistics(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Errorf("expansion statistics mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func TestHierarchicalAggregationAndMerge(t *testing.T) {
 	want := []CompleteHistogram{
 		{Bucket: uint128.From64(16), Sum: 10},
@@ -374,6 +629,109 @@ func TestHierarchicalAggregationAndMerge(t *testing.T) {
 	}
 }
 
+func TestAggregatePartialReportWithLateReports(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-late-reports")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	privKeys, pubKeysInfo, err := cryptoio.GenerateHybridKeyPairs(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dpfParams, err := incrementaldpf.GetDefaultDPFParameters(keyBitSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first 6 reports were decrypted at the first level, and the other 4 reports arrived later and are encrypted.
+	const reportCount, lateCount = 10, 4
+	valueSum := make([]uint64, keyBitSize)
+	for i := range valueSum {
+		valueSum[i] = 1
+	}
+	encryptFn := &standardEncryptFn{PublicKeys: pubKeysInfo}
+	var decryptedLines, lateLines [2][]string
+	for i := 0; i < reportCount; i++ {
+		key1, key2, err := incrementaldpf.GenerateKeys(dpfParams, uint128.From64(16), valueSum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, key := range []*dpfpb.DpfKey{key1, key2} {
+			report := &pb.PartialReportDpf{SumKey: key}
+			if i < reportCount-lateCount {
+				b, err := proto.Marshal(report)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decryptedLines[j] = append(decryptedLines[j], base64.StdEncoding.EncodeToString(b))
+				continue
+			}
+			var encrypted *pb.AggregatablePayload
+			if err := encryptFn.ProcessElement(report, func(e *pb.AggregatablePayload) { encrypted = e }); err != nil {
+				t.Fatal(err)
+			}
+			line, err := reporttypes.SerializeAggregatablePayload(encrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lateLines[j] = append(lateLines[j], line)
+		}
+	}
+
+	pipeline, scope := beam.NewPipelineWithRoot()
+	var histogramURIs [2]string
+	for j := range histogramURIs {
+		decryptedURI := path.Join(tmpDir, fmt.Sprintf("decrypted%d", j+1))
+		lateURI := path.Join(tmpDir, fmt.Sprintf("late%d", j+1))
+		histogramURIs[j] = path.Join(tmpDir, fmt.Sprintf("histogram%d", j+1))
+		if err := ioutil.WriteFile(decryptedURI+"-1-1", []byte(strings.Join(decryptedLines[j], "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(lateURI+"-1-1", []byte(strings.Join(lateLines[j], "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := AggregatePartialReport(scope.Scope(fmt.Sprintf("Helper%d", j+1)), &AggregatePartialReportParams{
+			PartialReportURI:    decryptedURI,
+			LateReportURI:       lateURI,
+			PartialHistogramURI: histogramURIs[j],
+			HelperPrivateKeys:   privKeys,
+			KeyBitSize:          keyBitSize,
+			ExpandParams: &ExpandParameters{
+				Prefixes:      []uint128.Uint128{uint128.From64(1)},
+				Level:         7,
+				PreviousLevel: 3,
+			},
+			CombineParams: &CombineParams{DirectCombine: true},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ptest.Run(pipeline); err != nil {
+		t.Fatalf("pipeline failed: %s", err)
+	}
+
+	partial1, err := ReadPartialHistogram(ctx, histogramURIs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial2, err := ReadPartialHistogram(ctx, histogramURIs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := MergePartialResult(partial1, partial2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := FilterCompleteHistogram(merged, &PostFilter{MinValue: 1})
+	want := []CompleteHistogram{{Bucket: uint128.From64(16), Sum: reportCount}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("histogram mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func TestDirectAggregationAndMerge(t *testing.T) {
 	want := []CompleteHistogram{
 		{Bucket: uint128.From64(16), Sum: 10},
@@ -586,6 +944,36 @@ func TestWriteReadCompleteHistogramWithPipeline(t *testing.T) {
 	}
 }
 
+func TestAnnotateHistogram(t *testing.T) {
+	histogram := []CompleteHistogram{
+		{Bucket: uint128.From64(1), Sum: 10},
+		{Bucket: uint128.From64(2), Sum: 20},
+	}
+	annotationLines := []string{
+		"1,campaign-a,creative-x",
+		// Annotations for buckets not in the result are dropped.
+		"3,campaign-b,creative-y",
+	}
+	want := []string{
+		"1,10,campaign-a,creative-x",
+		// Unmatched buckets are passed through.
+		"2,20",
+	}
+
+	pipeline, scope := beam.NewPipelineWithRoot()
+	annotations := beam.ParDo(scope, &parseBucketAnnotationFn{}, beam.CreateList(scope, annotationLines))
+	annotated := AnnotateHistogram(scope, beam.CreateList(scope, histogram), annotations)
+	passert.Equals(scope, beam.ParDo(scope, formatAnnotatedHistogramFn, annotated), beam.CreateList(scope, want))
+
+	if err := ptest.Run(pipeline); err != nil {
+		t.Fatalf("pipeline failed: %s", err)
+	}
+
+	if _, _, err := parseBucketAnnotation("1"); err == nil {
+		t.Error("expect error for annotation without labels")
+	}
+}
+
 func TestMergePartialHistogram(t *testing.T) {
 	partial1 := map[uint128.Uint128]*pb.PartialAggregationDpf{
 		uint128.From64(0): &pb.PartialAggregationDpf{PartialSum: 1},
@@ -668,3 +1056,325 @@ func TestReadWriteDPFparameters(t *testing.T) {
 		t.Errorf("Expand parameters read/write mismatch (-want +got):\n%s", diff)
 	}
 }
+
+func TestParsePostFilter(t *testing.T) {
+	got, err := ParsePostFilter("min_value=100,top_k=20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&PostFilter{MinValue: 100, TopK: 20}, got); diff != "" {
+		t.Errorf("post filter mismatch (-want +got):\n%s", diff)
+	}
+	if s := got.String(); s != "min_value=100,top_k=20" {
+		t.Errorf("got formatted filter %q", s)
+	}
+	if got, err := ParsePostFilter(""); err != nil || got != nil {
+		t.Errorf("expect nil filter for empty string, got %v, %v", got, err)
+	}
+	for _, s := range []string{"top_k=0", "min_value=-1", "max_value=1", "top_k"} {
+		if _, err := ParsePostFilter(s); err == nil {
+			t.Errorf("expect error for filter %q", s)
+		}
+	}
+}
+
+func TestFilterCompleteHistogram(t *testing.T) {
+	results := []CompleteHistogram{
+		{Bucket: uint128.From64(1), Sum: 5},
+		{Bucket: uint128.From64(2), Sum: 50},
+		{Bucket: uint128.From64(3), Sum: 20},
+		{Bucket: uint128.From64(4), Sum: 20},
+		{Bucket: uint128.From64(5), Sum: 10},
+		// The noise made the sum negative.
+		{Bucket: uint128.From64(6), Sum: 1<<64 - 3},
+	}
+	got := FilterCompleteHistogram(results, &PostFilter{MinValue: 10, TopK: 3})
+	want := []CompleteHistogram{
+		{Bucket: uint128.From64(2), Sum: 50},
+		{Bucket: uint128.From64(3), Sum: 20},
+		{Bucket: uint128.From64(4), Sum: 20},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("filtered results mismatch (-want +got):\n%s", diff)
+	}
+
+	got = FilterCompleteHistogram(results, &PostFilter{MinValue: 20})
+	want = []CompleteHistogram{
+		{Bucket: uint128.From64(2), Sum: 50},
+		{Bucket: uint128.From64(3), Sum: 20},
+		{Bucket: uint128.From64(4), Sum: 20},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("filtered results mismatch (-want +got):\n%s", diff)
+	}
+
+	// The negative sum ranks last.
+	got = FilterCompleteHistogram(results, &PostFilter{TopK: 6})
+	if last := got[len(got)-1]; last.Bucket != uint128.From64(6) {
+		t.Errorf("expect the negative sum last, got %+v", last)
+	}
+}
+
+func TestApplyPostFilter(t *testing.T) {
+	results := []CompleteHistogram{
+		{Bucket: uint128.From64(1), Sum: 5},
+		{Bucket: uint128.From64(2), Sum: 50},
+		{Bucket: uint128.From64(3), Sum: 20},
+		{Bucket: uint128.From64(4), Sum: 20},
+		{Bucket: uint128.From64(5), Sum: 1<<64 - 3},
+	}
+	filter := &PostFilter{MinValue: 10, TopK: 2}
+
+	pipeline, scope := beam.NewPipelineWithRoot()
+	got := ApplyPostFilter(scope, beam.CreateList(scope, results), filter)
+	passert.Equals(scope, got, beam.CreateList(scope, FilterCompleteHistogram(results, filter)))
+
+	if err := ptest.Run(pipeline); err != nil {
+		t.Fatalf("pipeline failed: %s", err)
+	}
+}
+
+func TestReadBatchParams(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-batch-params")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	uri := path.Join(tmpDir, "batches.json")
+	content := `[
+		{"BatchID":"origin1","PartialReportURI":"/in/origin1","PartialHistogramURI":"/out/origin1","ManifestURI":"/out/origin1_MANIFEST.json"},
+		{"BatchID":"origin2","PartialReportURI":"/in/origin2","PartialHistogramURI":"/out/origin2","Shards":2}
+	]`
+	if err := utils.WriteBytes(ctx, []byte(content), uri, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadBatchParams(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*BatchParams{
+		{BatchID: "origin1", PartialReportURI: "/in/origin1", PartialHistogramURI: "/out/origin1", ManifestURI: "/out/origin1_MANIFEST.json"},
+		{BatchID: "origin2", PartialReportURI: "/in/origin2", PartialHistogramURI: "/out/origin2", Shards: 2},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("batch params mismatch (-want +got):\n%s", diff)
+	}
+
+	for name, content := range map[string]string{
+		"empty list":        `[]`,
+		"missing batch ID":  `[{"PartialReportURI":"/in","PartialHistogramURI":"/out"}]`,
+		"duplicate ID":      `[{"BatchID":"a","PartialReportURI":"/in1","PartialHistogramURI":"/out1"},{"BatchID":"a","PartialReportURI":"/in2","PartialHistogramURI":"/out2"}]`,
+		"missing histogram": `[{"BatchID":"a","PartialReportURI":"/in"}]`,
+	} {
+		if err := utils.WriteBytes(ctx, []byte(content), uri, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadBatchParams(ctx, uri); err == nil {
+			t.Errorf("%s: expect error for batches %s", name, content)
+		}
+	}
+}
+
+func TestTraceReport(t *testing.T) {
+	ctx := context.Background()
+	privKeys, pubKeysInfo, err := cryptoio.GenerateHybridKeyPairs(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctxParams, err := incrementaldpf.GetDefaultDPFParameters(keyBitSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]uint64, keyBitSize)
+	for i := range values {
+		values[i] = 5
+	}
+	key1, key2, err := incrementaldpf.GenerateKeys(ctxParams, uint128.From64(16), values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encrypted []*pb.AggregatablePayload
+	for _, key := range []*dpfpb.DpfKey{key1, key2} {
+		if err := (&standardEncryptFn{PublicKeys: pubKeysInfo}).ProcessElement(&pb.PartialReportDpf{SumKey: key}, func(p *pb.AggregatablePayload) {
+			encrypted = append(encrypted, p)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name         string
+		expandParams *ExpandParameters
+		wantBuckets  int64
+		wantValue    uint64
+	}{
+		{
+			name:         "first level",
+			expandParams: &ExpandParameters{Level: 3, PreviousLevel: -1},
+			wantBuckets:  16,
+			wantValue:    5,
+		},
+		{
+			name:         "contributing prefix",
+			expandParams: &ExpandParameters{Prefixes: []uint128.Uint128{uint128.From64(1)}, Level: 7, PreviousLevel: 3},
+			wantBuckets:  16,
+			wantValue:    5,
+		},
+		{
+			name:         "pruned prefix",
+			expandParams: &ExpandParameters{Prefixes: []uint128.Uint128{uint128.From64(2)}, Level: 7, PreviousLevel: 3},
+			wantBuckets:  16,
+			wantValue:    0,
+		},
+	} {
+		fn := &traceReportFn{StandardPrivateKeys: privKeys, ExpandParams: tc.expandParams, KeyBitSize: keyBitSize}
+		if err := fn.Setup(); err != nil {
+			t.Fatal(err)
+		}
+		var traces [][]*reporttrace.Record
+		for _, e := range encrypted {
+			records := fn.trace("report1", e)
+			if len(records) != 2 || records[0].Error != "" || records[1].Error != "" {
+				t.Fatalf("%s: expect decryption and expansion records without errors, got %+v", tc.name, records)
+			}
+			if records[0].KeyID != e.KeyId || records[0].Fallback {
+				t.Errorf("%s: expect the report decrypted with key %q, got %+v", tc.name, e.KeyId, records[0])
+			}
+			traces = append(traces, records)
+		}
+		fn.Teardown()
+
+		want := []*reporttrace.Contribution{{ReportID: "report1", Level: tc.expandParams.Level, Buckets: tc.wantBuckets, Value: tc.wantValue}}
+		if diff := cmp.Diff(want, reporttrace.Combine(traces[0], traces[1])); diff != "" {
+			t.Errorf("%s: contributions mismatch (-want +got):\n%s", tc.name, diff)
+		}
+	}
+}
+
+func TestCheckReportKeyBitSize(t *testing.T) {
+	var reports []rawConversion
+	for i := uint64(0); i < 5; i++ {
+		reports = append(reports, rawConversion{Index: uint128.From64(i), Value: 1})
+	}
+
+	for _, tc := range []struct {
+		name       string
+		keyBitSize int
+		wantErr    bool
+	}{
+		{"same key bit size", keyBitSize, false},
+		{"different key bit size", 2 * keyBitSize, true},
+	} {
+		dpfParams, err := incrementaldpf.GetDefaultDPFParameters(tc.keyBitSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipeline, scope := beam.NewPipelineWithRoot()
+		conversions := beam.CreateList(scope, reports)
+		partialReport, _ := beam.ParDo2(scope, &splitConversionFn{KeyBitSize: keyBitSize}, conversions)
+		passert.Count(scope, CheckReportKeyBitSize(scope, partialReport, dpfParams, tc.keyBitSize), "checked", len(reports))
+
+		if err := ptest.Run(pipeline); (err != nil) != tc.wantErr {
+			t.Errorf("%s: expect error %t, got %v", tc.name, tc.wantErr, err)
+		}
+	}
+}
+
+func TestReadBatchMetadata(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-batch-metadata")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	uri := path.Join(tmpDir, "metadata.json")
+	want := &BatchMetadata{KeyBitSize: 16}
+	if err := WriteBatchMetadata(ctx, want, uri); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadBatchMetadata(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("batch metadata mismatch (-want +got):\n%s", diff)
+	}
+
+	if keyBitSize, err := ResolveKeyBitSize(0, got); err != nil || keyBitSize != 16 {
+		t.Errorf("expect key bit size 16 from the metadata, got %d, %v", keyBitSize, err)
+	}
+	if _, err := ResolveKeyBitSize(32, got); !errors.Is(err, ErrKeyBitSizeMismatch) {
+		t.Error("expect error for a requested key bit size different from the metadata")
+	}
+
+	if err := WriteBatchMetadata(ctx, &BatchMetadata{KeyBitSize: 129}, uri); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBatchMetadata(ctx, uri); err == nil {
+		t.Error("expect error for an invalid key bit size")
+	}
+}
+
+func TestSignBatchMetadata(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := &BatchMetadata{KeyBitSize: 16, DebugBatch: true, BatchRoot: "root1"}
+	if err := VerifyBatchMetadata(metadata, []ed25519.PublicKey{publicKey}); !errors.Is(err, ErrUnsignedBatchMetadata) {
+		t.Errorf("expect error %v for unsigned metadata, got %v", ErrUnsignedBatchMetadata, err)
+	}
+	if err := SignBatchMetadata(metadata, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBatchMetadata(metadata, []ed25519.PublicKey{otherKey, publicKey}); err != nil {
+		t.Errorf("expect the signature to verify, got %v", err)
+	}
+	if err := VerifyBatchMetadata(metadata, []ed25519.PublicKey{otherKey}); !errors.Is(err, ErrUnsignedBatchMetadata) {
+		t.Errorf("expect error %v for an untrusted batcher, got %v", ErrUnsignedBatchMetadata, err)
+	}
+	rebound := *metadata
+	rebound.BatchRoot = "root2"
+	if err := VerifyBatchMetadata(&rebound, []ed25519.PublicKey{publicKey}); !errors.Is(err, ErrUnsignedBatchMetadata) {
+		t.Errorf("expect error %v for metadata bound to another batch, got %v", ErrUnsignedBatchMetadata, err)
+	}
+	metadata.KeyBitSize = 32
+	if err := VerifyBatchMetadata(metadata, []ed25519.PublicKey{publicKey}); !errors.Is(err, ErrUnsignedBatchMetadata) {
+		t.Errorf("expect error %v for modified metadata, got %v", ErrUnsignedBatchMetadata, err)
+	}
+}
+
+func TestDataQualitySummary(t *testing.T) {
+	params := &DataQualityParams{BudgetFraction: 0}
+	if err := params.Validate(1); err == nil {
+		t.Error("expect error for a noised level without summary budget")
+	}
+	if err := params.Validate(0); err != nil {
+		t.Errorf("expect no error without noise, got %v", err)
+	}
+
+	counts := []int{3, 4}
+	countIter := func(n *int) bool {
+		if len(counts) == 0 {
+			return false
+		}
+		*n, counts = counts[0], counts[1:]
+		return true
+	}
+	var got []string
+	fn := &dataQualitySummaryFn{CountSensitivity: 1}
+	if err := fn.ProcessElement(nil, countIter, func(s string) { got = append(got, s) }); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{`{"ReportCount":7,"Epsilon":0}`}, got); diff != "" {
+		t.Errorf("data quality summary mismatch (-want +got):\n%s", diff)
+	}
+}
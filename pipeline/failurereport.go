@@ -0,0 +1,210 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package failurereport classifies the failures of the pipeline binaries, so the orchestrator can branch on the type
+// of a failure without parsing the logs.
+//
+// A failed binary exits with the code of the failure class, and writes a JSON Report to the location given by its flag
+// --failure_report_uri if set. The codes start at 10, so they do not collide with the codes of log.Exit (1) and of the
+// Go runtime, e.g. 2 for an unrecovered panic:
+//
+//	10 unknown           unclassified failures
+//	11 invalid_argument  invalid flags or parameter files; retrying does not help
+//	12 input_not_found   the input reports or files are missing; retry when the input is ready
+//	13 key_error         the private keys cannot be read or used
+//	14 privacy_policy    the aggregation violates the privacy policy, e.g. strict privacy mode
+//	15 pipeline_failed   the pipeline failed during execution; it may succeed when retried
+//	16 output_failed     the outputs or manifests cannot be written after the pipeline succeeded
+package failurereport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/log"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelineutils"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+// Class is the type of a failure.
+type Class string
+
+// Failure classes, whose exit codes are documented in the package comment.
+const (
+	ClassUnknown         Class = "unknown"
+	ClassInvalidArgument Class = "invalid_argument"
+	ClassInputNotFound   Class = "input_not_found"
+	ClassKeyError        Class = "key_error"
+	ClassPrivacyPolicy   Class = "privacy_policy"
+	ClassPipelineFailed  Class = "pipeline_failed"
+	ClassOutputFailed    Class = "output_failed"
+)
+
+var exitCodes = map[Class]int{
+	ClassUnknown:         10,
+	ClassInvalidArgument: 11,
+	ClassInputNotFound:   12,
+	ClassKeyError:        13,
+	ClassPrivacyPolicy:   14,
+	ClassPipelineFailed:  15,
+	ClassOutputFailed:    16,
+}
+
+// ExitCode returns the exit code of the failure class.
+func (c Class) ExitCode() int {
+	if code, ok := exitCodes[c]; ok {
+		return code
+	}
+	return exitCodes[ClassUnknown]
+}
+
+// ClassFromExitCode returns the failure class of the exit code, which is unknown for undocumented codes.
+func ClassFromExitCode(code int) Class {
+	for class, c := range exitCodes {
+		if c == code {
+			return class
+		}
+	}
+	return ClassUnknown
+}
+
+// Retriable returns whether retrying may help with a failure of the class. Invalid arguments and privacy policy
+// violations fail again with the same request.
+func (c Class) Retriable() bool {
+	return c != ClassInvalidArgument && c != ClassPrivacyPolicy
+}
+
+// Stages of the pipeline binaries where the failures happen.
+const (
+	StageValidate      = "validate"
+	StageReadInput     = "read_input"
+	StageReadKeys      = "read_keys"
+	StageRunPipeline   = "run_pipeline"
+	StageWriteManifest = "write_manifest"
+)
+
+// Error is a classified failure of a stage.
+type Error struct {
+	Class Class
+	Stage string
+	// URI of the offending input or output, if known.
+	URI string
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.URI != "" {
+		return fmt.Sprintf("%s failure in stage %s for %q: %v", e.Class, e.Stage, e.URI, e.Err)
+	}
+	return fmt.Sprintf("%s failure in stage %s: %v", e.Class, e.Stage, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap classifies the error. It returns nil if err is nil.
+func Wrap(class Class, stage string, err error) error {
+	return WrapURI(class, stage, "", err)
+}
+
+// WrapURI classifies the error with the URI of the offending file. It returns nil if err is nil.
+func WrapURI(class Class, stage, uri string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Class: class, Stage: stage, URI: uri, Err: err}
+}
+
+// Report is the machine-readable record of a failure.
+type Report struct {
+	Binary   string
+	Stage    string
+	Class    Class
+	ExitCode int
+	Error    string
+	URI      string `json:",omitempty"`
+	// Estimated number of records in the offending input, to size a retry or a bisection of the batch. Zero if unknown.
+	RecordEstimate int64 `json:",omitempty"`
+	Time           time.Time
+}
+
+// NewReport creates the report for the error. Errors that are not classified with Wrap have the unknown class.
+func NewReport(binary string, err error) *Report {
+	report := &Report{Binary: binary, Class: ClassUnknown, Error: err.Error(), Time: time.Now().UTC()}
+	var e *Error
+	if errors.As(err, &e) {
+		report.Stage, report.Class, report.URI = e.Stage, e.Class, e.URI
+	}
+	report.ExitCode = report.Class.ExitCode()
+	return report
+}
+
+// Write writes the report as JSON.
+func Write(ctx context.Context, report *Report, uri string) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteBytes(ctx, b, uri, nil)
+}
+
+// Read reads a report written by Write.
+func Read(ctx context.Context, uri string) (*Report, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{}
+	if err := json.Unmarshal(b, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Reporter writes the failure reports of a binary.
+type Reporter struct {
+	Binary string
+	// Location of the report. The report is only logged if it is empty.
+	URI string
+}
+
+// Exit writes the report for the error, and exits with the code of its class.
+func (r *Reporter) Exit(ctx context.Context, err error) {
+	report := NewReport(r.Binary, err)
+	// The input size is only estimated for pipeline failures, where it helps to decide how to retry.
+	if report.URI != "" && report.Class == ClassPipelineFailed {
+		if estimate, err := pipelineutils.EstimateLineCount(ctx, pipelineutils.AddStrInPath(report.URI, "*")); err != nil {
+			log.Warnf(ctx, "failed to estimate the records in %q: %v", report.URI, err)
+		} else {
+			report.RecordEstimate = estimate
+		}
+	}
+	log.Error(ctx, err)
+	if r.URI != "" {
+		if err := Write(ctx, report, r.URI); err != nil {
+			log.Errorf(ctx, "failed to write failure report to %q: %v", r.URI, err)
+		}
+	}
+	os.Exit(report.ExitCode)
+}
+
+// Exitf is Exit with the error formatted by fmt.Errorf and classified by Wrap.
+func (r *Reporter) Exitf(ctx context.Context, class Class, stage, format string, v ...interface{}) {
+	r.Exit(ctx, Wrap(class, stage, fmt.Errorf(format, v...)))
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failurereport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExitCode(t *testing.T) {
+	codes := make(map[int]Class)
+	for class := range exitCodes {
+		code := class.ExitCode()
+		if code == 0 {
+			t.Errorf("expect non-zero exit code for class %s", class)
+		}
+		if other, ok := codes[code]; ok {
+			t.Errorf("classes %s and %s have the same exit code %d", class, other, code)
+		}
+		codes[code] = class
+	}
+	if got, want := Class("other").ExitCode(), ClassUnknown.ExitCode(); got != want {
+		t.Errorf("expect exit code %d for an undefined class, got %d", want, got)
+	}
+	for code, class := range codes {
+		if got := ClassFromExitCode(code); got != class {
+			t.Errorf("expect class %s for exit code %d, got %s", class, code, got)
+		}
+	}
+	if got := ClassFromExitCode(137); got != ClassUnknown {
+		t.Errorf("expect unknown class for an undocumented exit code, got %s", got)
+	}
+}
+
+func TestNewReport(t *testing.T) {
+	errMissing := errors.New("file not found")
+	for _, tc := range []struct {
+		name string
+		err  error
+		want *Report
+	}{
+		{
+			name: "classified",
+			err:  WrapURI(ClassInputNotFound, StageReadInput, "/input/report", errMissing),
+			want: &Report{Binary: "binary", Stage: StageReadInput, Class: ClassInputNotFound, ExitCode: 12, URI: "/input/report",
+				Error: `input_not_found failure in stage read_input for "/input/report": file not found`},
+		},
+		{
+			name: "wrapped again",
+			err:  fmt.Errorf("batch a: %w", Wrap(ClassKeyError, StageReadKeys, errMissing)),
+			want: &Report{Binary: "binary", Stage: StageReadKeys, Class: ClassKeyError, ExitCode: 13,
+				Error: "batch a: key_error failure in stage read_keys: file not found"},
+		},
+		{
+			name: "unclassified",
+			err:  errMissing,
+			want: &Report{Binary: "binary", Class: ClassUnknown, ExitCode: 10, Error: "file not found"},
+		},
+	} {
+		got := NewReport("binary", tc.err)
+		if got.Time.IsZero() {
+			t.Errorf("%s: expect the failure time in the report", tc.name)
+		}
+		got.Time = time.Time{}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: report mismatch (-want +got):\n%s", tc.name, diff)
+		}
+	}
+	if !errors.Is(Wrap(ClassPipelineFailed, StageRunPipeline, errMissing), errMissing) {
+		t.Error("expect the classified error to wrap the original error")
+	}
+	if Wrap(ClassPipelineFailed, StageRunPipeline, nil) != nil {
+		t.Error("expect nil for wrapping a nil error")
+	}
+}
+
+func TestWriteReadReport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-failure-report")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	want := NewReport("binary", WrapURI(ClassPipelineFailed, StageRunPipeline, "/input/report", errors.New("worker lost")))
+	want.RecordEstimate = 1000
+	uri := path.Join(tmpDir, "failure.json")
+	if err := Write(ctx, want, uri); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("report mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -13,19 +13,25 @@
 // limitations under the License.
 
 // This binary decrypts the encrypted reports generated for the one-party service design and aggregates them.
+//
+// On failure, the binary exits with the code of the failure class documented in package failurereport, and writes
+// the failure report to '--failure_report_uri' if set.
 package main
 
 import (
 	"context"
 	"flag"
+	"fmt"
 	"math"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
-	"github.com/apache/beam/sdks/go/pkg/beam/log"
 	"github.com/apache/beam/sdks/go/pkg/beam/x/beamx"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/failurereport"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/onepartyaggregator"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelineutils"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/flagdeprecation"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/strictprivacy"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
 )
 
@@ -38,24 +44,58 @@ var (
 	// The default l1 sensitivity is consistent with:
 	// https://github.com/WICG/conversion-measurement-api/blob/main/AGGREGATE.md#privacy-budgeting
 	l1Sensitivity = flag.Uint64("l1_sensitivity", uint64(math.Pow(2, 16)), "L1-sensitivity for the privacy budget.")
+
+	dataQualitySummaryURI       = flag.String("data_quality_summary_uri", "", "Output summary of the report count, the nonzero bucket count and the value quantiles of the batch, protected with a reserved fraction of the privacy budget. The summary is not written if empty.")
+	dataQualityBudgetFraction   = flag.Float64("data_quality_budget_fraction", 0.05, "Fraction of the privacy budget reserved for the data quality summary, which must be in (0, 1) when --epsilon is positive.")
+	dataQualityCountSensitivity = flag.Uint64("data_quality_count_sensitivity", 1, "Maximum number of reports contributed by one user, which is the sensitivity of the counts in the data quality summary.")
+
+	strictFlags = flag.Bool("strict_flags", false, "Fail instead of warning when any flag to be retired is set.")
+
+	strictPrivacy = flag.Bool("strict_privacy", false, "Reject aggregations without noise unless --debug_batch is set.")
+	debugBatch    = flag.Bool("debug_batch", false, "Whether the input is a debug batch, which is allowed to be aggregated without noise in strict privacy mode.")
+
+	failureReportURI = flag.String("failure_report_uri", "", "Output location of the JSON failure report written when the binary fails.")
 )
 
+// retiredFlags maps the flags to be retired to their replacements. No flag of the binary is being retired yet.
+var retiredFlags = []flagdeprecation.Flag{}
+
 func main() {
 	flag.Parse()
 	beam.Init()
 
 	ctx := context.Background()
-	helperPrivKeys, err := cryptoio.ReadPrivateKeyCollection(ctx, *privateKeyParamsURI)
+	reporter := &failurereport.Reporter{Binary: "oneparty_aggregate_report_pipeline", URI: *failureReportURI}
+	if err := flagdeprecation.Migrate(flag.CommandLine, retiredFlags, *strictFlags); err != nil {
+		reporter.Exit(ctx, failurereport.Wrap(failurereport.ClassInvalidArgument, failurereport.StageValidate, err))
+	}
+	if err := strictprivacy.Check(*strictPrivacy, &strictprivacy.Params{Epsilon: *epsilon, Debug: *debugBatch}); err != nil {
+		reporter.Exit(ctx, failurereport.Wrap(failurereport.ClassPrivacyPolicy, failurereport.StageValidate, err))
+	}
+
+	helperPrivKeys, err := cryptoio.ReadDecryptionKeyCollection(ctx, *privateKeyParamsURI)
 	if err != nil {
-		log.Exit(ctx, err)
+		reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassKeyError, failurereport.StageReadKeys, *privateKeyParamsURI, err))
 	}
 
 	inputGlob := pipelineutils.AddStrInPath(*encryptedReportURI, "*")
 	inputExist, err := utils.IsFileGlobExist(ctx, inputGlob)
 	if err != nil {
-		log.Exit(ctx, err)
+		reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInputNotFound, failurereport.StageReadInput, *encryptedReportURI, err))
 	} else if !inputExist {
-		log.Exitf(ctx, "input not found: %q", inputGlob)
+		reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInputNotFound, failurereport.StageReadInput, *encryptedReportURI, fmt.Errorf("input not found: %q", inputGlob)))
+	}
+
+	var dataQuality *onepartyaggregator.DataQualityParams
+	if *dataQualitySummaryURI != "" {
+		dataQuality = &onepartyaggregator.DataQualityParams{
+			SummaryURI:       *dataQualitySummaryURI,
+			BudgetFraction:   *dataQualityBudgetFraction,
+			CountSensitivity: *dataQualityCountSensitivity,
+		}
+		if err := dataQuality.Validate(*epsilon); err != nil {
+			reporter.Exit(ctx, failurereport.Wrap(failurereport.ClassPrivacyPolicy, failurereport.StageValidate, err))
+		}
 	}
 
 	pipeline := beam.NewPipeline()
@@ -69,9 +109,10 @@ func main() {
 			HelperPrivateKeys:  helperPrivKeys,
 			Epsilon:            *epsilon,
 			L1Sensitivity:      *l1Sensitivity,
+			DataQuality:        dataQuality,
 		})
 
 	if err := beamx.Run(ctx, pipeline); err != nil {
-		log.Exitf(ctx, "Failed to execute job: %s", err)
+		reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassPipelineFailed, failurereport.StageRunPipeline, *encryptedReportURI, fmt.Errorf("failed to execute job: %v", err)))
 	}
 }
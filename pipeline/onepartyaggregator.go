@@ -17,8 +17,11 @@ package onepartyaggregator
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"math/bits"
 	"reflect"
 	"strconv"
 	"strings"
@@ -43,11 +46,14 @@ func init() {
 	beam.RegisterType(reflect.TypeOf((*pb.StandardCiphertext)(nil)).Elem())
 
 	beam.RegisterType(reflect.TypeOf((*addNoiseFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*dataQualitySummaryFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*decryptReportFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*filterBucketFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*formatHistogramFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*nonzeroBucketFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*parseEncryptedReportFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*parseTargetBucketFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*valueBinFn)(nil)).Elem())
 }
 
 // parseTargetBucketFn parses each line of the input and gets a uint128 bucket ID and a boolean value.
@@ -240,6 +246,180 @@ func addNoise(scope beam.Scope, rawResult beam.PCollection, epsilon float64, l1S
 	return beam.ParDo(scope, &addNoiseFn{Epsilon: epsilon, L1Sensitivity: l1Sensitivity}, rawResult)
 }
 
+// numValueBins is the number of bins for the report values. Bin 0 holds the zero values, and bin k > 0 holds the
+// values in [2^(k-1), 2^k).
+const numValueBins = 65
+
+// numDataQualityStatistics is the number of statistics in the data quality summary that share its privacy budget.
+const numDataQualityStatistics = 3
+
+// DataQualityQuantiles are the quantiles of the report values in the data quality summary.
+var DataQualityQuantiles = []float64{0.25, 0.5, 0.75, 0.9, 0.99}
+
+// DataQualityParams contains the parameters to summarize the distribution of the contributions in a batch.
+type DataQualityParams struct {
+	// Output URI of the summary, which is written as a JSON line.
+	SummaryURI string
+	// Fraction of the privacy budget of the query reserved for the summary, which is split equally over the statistics.
+	BudgetFraction float64
+	// Maximum number of reports contributed by one user, which is the sensitivity of the counts in the summary.
+	CountSensitivity uint64
+}
+
+// Validate checks the budget fraction for a query with the total epsilon. When the query is noised, the fraction must
+// be in (0, 1), so neither the summary nor the histogram is released without noise.
+func (p *DataQualityParams) Validate(epsilon float64) error {
+	if epsilon > 0 && (p.BudgetFraction <= 0 || p.BudgetFraction >= 1) {
+		return fmt.Errorf("expect budget fraction of the data quality summary in (0, 1), got %v", p.BudgetFraction)
+	}
+	return nil
+}
+
+// ValueQuantile is the upper bound of the report values at a quantile.
+type ValueQuantile struct {
+	Quantile   float64
+	UpperBound uint64
+}
+
+// DataQualitySummary contains the summary statistics of a batch, which help analysts judge the health of the data.
+type DataQualitySummary struct {
+	ReportCount         int64
+	NonzeroBucketCount  int64
+	ValueQuantiles      []ValueQuantile
+	EpsilonPerStatistic float64
+}
+
+func valueBin(value uint64) int {
+	return bits.Len64(value)
+}
+
+// binUpperBound returns the largest value in a bin.
+func binUpperBound(bin int) uint64 {
+	if bin == 0 {
+		return 0
+	}
+	return math.MaxUint64 >> (64 - bin)
+}
+
+// valueQuantiles estimates the quantiles from the counts of the value bins. Negative counts from the noise are
+// treated as zero.
+func valueQuantiles(binCounts []int64, quantiles []float64) []ValueQuantile {
+	var total int64
+	for _, c := range binCounts {
+		if c > 0 {
+			total += c
+		}
+	}
+	var result []ValueQuantile
+	for _, q := range quantiles {
+		var bin int
+		if total > 0 {
+			var cumulative int64
+			for bin = range binCounts {
+				if binCounts[bin] > 0 {
+					cumulative += binCounts[bin]
+				}
+				if float64(cumulative) >= q*float64(total) {
+					break
+				}
+			}
+		}
+		result = append(result, ValueQuantile{Quantile: q, UpperBound: binUpperBound(bin)})
+	}
+	return result
+}
+
+// NewDataQualitySummary creates the summary from the exact statistics, with noise from the geometric mechanism. No
+// noise is added if epsilon is zero, e.g. for experiments.
+func NewDataQualitySummary(binCounts []int64, nonzeroBucketCount int64, epsilon float64, countSensitivity uint64) (*DataQualitySummary, error) {
+	addNoise := func(v int64) (int64, error) {
+		if epsilon <= 0 {
+			return v, nil
+		}
+		noise, err := distributednoise.DistributedGeometricMechanismRand(epsilon, countSensitivity, numberOfHelpers)
+		if err != nil {
+			return 0, err
+		}
+		return v + noise, nil
+	}
+
+	summary := &DataQualitySummary{EpsilonPerStatistic: epsilon}
+	var reportCount int64
+	for _, c := range binCounts {
+		reportCount += c
+	}
+	var err error
+	if summary.ReportCount, err = addNoise(reportCount); err != nil {
+		return nil, err
+	}
+	if summary.NonzeroBucketCount, err = addNoise(nonzeroBucketCount); err != nil {
+		return nil, err
+	}
+	noisyBins := make([]int64, len(binCounts))
+	for i, c := range binCounts {
+		if noisyBins[i], err = addNoise(c); err != nil {
+			return nil, err
+		}
+	}
+	summary.ValueQuantiles = valueQuantiles(noisyBins, DataQualityQuantiles)
+	return summary, nil
+}
+
+// valueBinFn maps each report to the bin of its value.
+type valueBinFn struct{}
+
+func (fn *valueBinFn) ProcessElement(bucket uint128.Uint128, value uint64, emit func(int)) {
+	emit(valueBin(value))
+}
+
+// nonzeroBucketFn emits 1 for each bucket with a nonzero sum.
+type nonzeroBucketFn struct{}
+
+func (fn *nonzeroBucketFn) ProcessElement(bucket uint128.Uint128, value uint64, emit func(int)) {
+	if value != 0 {
+		emit(1)
+	}
+}
+
+// dataQualitySummaryFn formats the summary from the exact statistics in the side inputs. The global combines emit
+// nothing for empty inputs, so the statistics are read as iterables.
+type dataQualitySummaryFn struct {
+	Epsilon          float64
+	CountSensitivity uint64
+}
+
+func (fn *dataQualitySummaryFn) ProcessElement(_ []byte, binCountIter func(*int, *int) bool, nonzeroIter func(*int) bool, emit func(string)) error {
+	binCounts := make([]int64, numValueBins)
+	var bin, count int
+	for binCountIter(&bin, &count) {
+		binCounts[bin] = int64(count)
+	}
+	var nonzero, n int
+	for nonzeroIter(&n) {
+		nonzero += n
+	}
+
+	summary, err := NewDataQualitySummary(binCounts, int64(nonzero), fn.Epsilon, fn.CountSensitivity)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	emit(string(b))
+	return nil
+}
+
+func writeDataQualitySummary(scope beam.Scope, decrypted, summed beam.PCollection, params *DataQualityParams, epsilon float64) {
+	scope = scope.Scope("DataQualitySummary")
+	binCounts := stats.Count(scope, beam.ParDo(scope, &valueBinFn{}, decrypted))
+	nonzero := stats.Sum(scope, beam.ParDo(scope, &nonzeroBucketFn{}, summed))
+	summary := beam.ParDo(scope, &dataQualitySummaryFn{Epsilon: epsilon, CountSensitivity: params.CountSensitivity}, beam.Impulse(scope),
+		beam.SideInput{Input: binCounts}, beam.SideInput{Input: nonzero})
+	textio.Write(scope, params.SummaryURI, summary)
+}
+
 // AggregateReportParams contains necessary parameters for function AggregateReport().
 type AggregateReportParams struct {
 	// Input report file URI, each line contains an encrypted payload from the browser.
@@ -253,6 +433,8 @@ type AggregateReportParams struct {
 	// Privacy budget for adding noise to the aggregation.
 	Epsilon       float64
 	L1Sensitivity uint64
+	// Parameters of the data quality summary, which draws its budget from Epsilon. The summary is not written if nil.
+	DataQuality *DataQualityParams
 }
 
 // AggregateReport reads the encrypted reports, decrypts and aggregates them.
@@ -269,8 +451,15 @@ func AggregateReport(scope beam.Scope, params *AggregateReportParams) {
 	joined := beam.CoGroupByKey(scope, buckets, result)
 	filteredResult := beam.ParDo(scope, &filterBucketFn{}, joined)
 
-	if params.Epsilon > 0 {
-		filteredResult = addNoise(scope, filteredResult, params.Epsilon, params.L1Sensitivity)
+	epsilon := params.Epsilon
+	if params.DataQuality != nil {
+		summaryEpsilon := epsilon * params.DataQuality.BudgetFraction
+		epsilon -= summaryEpsilon
+		writeDataQualitySummary(scope, decrypted, result, params.DataQuality, summaryEpsilon/numDataQualityStatistics)
+	}
+
+	if epsilon > 0 {
+		filteredResult = addNoise(scope, filteredResult, epsilon, params.L1Sensitivity)
 	}
 
 	// TODO: Add noise before writing the result.
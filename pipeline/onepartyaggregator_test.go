@@ -16,11 +16,13 @@ package onepartyaggregator
 
 import (
 	"context"
+	"math"
 	"testing"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
 	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
 	"lukechampine.com/uint128"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/standardencrypt"
@@ -221,3 +223,66 @@ func TestFilterResults(t *testing.T) {
 		t.Fatalf("pipeline failed: %s", err)
 	}
 }
+
+func TestValueQuantiles(t *testing.T) {
+	binCounts := make([]int64, numValueBins)
+	// 10 zero values, 60 values in [1, 1], 20 values in [2, 3], 10 values in [2^15, 2^16).
+	binCounts[0], binCounts[1], binCounts[2], binCounts[16] = 10, 60, 20, 10
+	// Negative counts from the noise are ignored.
+	binCounts[64] = -5
+
+	got := valueQuantiles(binCounts, DataQualityQuantiles)
+	want := []ValueQuantile{
+		{Quantile: 0.25, UpperBound: 1},
+		{Quantile: 0.5, UpperBound: 1},
+		{Quantile: 0.75, UpperBound: 3},
+		{Quantile: 0.9, UpperBound: 3},
+		{Quantile: 0.99, UpperBound: 1<<16 - 1},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("value quantiles mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewDataQualitySummary(t *testing.T) {
+	binCounts := make([]int64, numValueBins)
+	binCounts[valueBin(0)], binCounts[valueBin(5)], binCounts[valueBin(math.MaxUint64)] = 1, 2, 1
+
+	got, err := NewDataQualitySummary(binCounts, 3, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &DataQualitySummary{
+		ReportCount:        4,
+		NonzeroBucketCount: 3,
+		ValueQuantiles: []ValueQuantile{
+			{Quantile: 0.25, UpperBound: 0},
+			{Quantile: 0.5, UpperBound: 7},
+			{Quantile: 0.75, UpperBound: 7},
+			{Quantile: 0.9, UpperBound: math.MaxUint64},
+			{Quantile: 0.99, UpperBound: math.MaxUint64},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("data quality summary mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidateDataQualityParams(t *testing.T) {
+	for _, tc := range []struct {
+		fraction, epsilon float64
+		wantErr           bool
+	}{
+		{0.05, 1, false},
+		{0, 1, true},
+		{1, 1, true},
+		{-0.1, 1, true},
+		// Without noise, e.g. for experiments, the fraction does not matter.
+		{0, 0, false},
+	} {
+		params := &DataQualityParams{BudgetFraction: tc.fraction}
+		if err := params.Validate(tc.epsilon); (err != nil) != tc.wantErr {
+			t.Errorf("fraction %v with epsilon %v: got error %v, want error %t", tc.fraction, tc.epsilon, err, tc.wantErr)
+		}
+	}
+}
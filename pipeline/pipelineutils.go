@@ -16,15 +16,29 @@
 package pipelineutils
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"path/filepath"
 	"reflect"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/io/filesystem"
 	"github.com/apache/beam/sdks/go/pkg/beam/io/textio"
 )
 
+// DefaultTargetShardBytes is the default size of the output shards when the shard count is picked automatically.
+const DefaultTargetShardBytes = 256 << 20
+
+// lineSampleBytes is the size of the sample read from the first file when estimating the number of lines.
+const lineSampleBytes = 1 << 20
+
+// maxShards caps the automatic shard count, as every shard adds a filter over the whole output to the pipeline.
+const maxShards = 256
+
 func init() {
 	beam.RegisterType(reflect.TypeOf((*addShardKeyFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*getShardFn)(nil)).Elem())
@@ -63,6 +77,109 @@ func WriteNShardedFiles(s beam.Scope, outputName string, n int64, lines beam.PCo
 	}
 }
 
+// ShardCount returns the number of shards for an output of about expectedBytes, so that each shard has about
+// targetShardBytes. There is at least one shard, and at most maxShards.
+func ShardCount(expectedBytes, targetShardBytes int64) int64 {
+	if targetShardBytes <= 0 || expectedBytes <= targetShardBytes {
+		return 1
+	}
+	n := (expectedBytes + targetShardBytes - 1) / targetShardBytes
+	if n > maxShards {
+		return maxShards
+	}
+	return n
+}
+
+// fileSizes returns the files matching the glob and their sizes.
+func fileSizes(ctx context.Context, fs filesystem.Interface, glob string) ([]string, []int64, error) {
+	files, err := fs.List(ctx, glob)
+	if err != nil {
+		return nil, nil, err
+	}
+	sizes := make([]int64, len(files))
+	for i, f := range files {
+		if sizes[i], err = fs.Size(ctx, f); err != nil {
+			return nil, nil, err
+		}
+	}
+	return files, sizes, nil
+}
+
+// TotalFileSize returns the total size of the files matching the glob, which is used to estimate the size of the
+// pipeline outputs.
+func TotalFileSize(ctx context.Context, glob string) (int64, error) {
+	fs, err := filesystem.New(ctx, glob)
+	if err != nil {
+		return 0, err
+	}
+	defer fs.Close()
+
+	_, sizes, err := fileSizes(ctx, fs, glob)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total, nil
+}
+
+// countLines counts the lines in the first limit bytes of the file, and returns the number of bytes read. A last line
+// without the newline is counted if the whole file is read.
+func countLines(ctx context.Context, fs filesystem.Interface, filename string, size, limit int64) (int64, int64, error) {
+	r, err := fs.OpenRead(ctx, filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, limit))
+	if err != nil {
+		return 0, 0, err
+	}
+	lines := int64(bytes.Count(b, []byte{'\n'}))
+	if n := int64(len(b)); n == size && n > 0 && b[n-1] != '\n' {
+		lines++
+	}
+	return int64(len(b)), lines, nil
+}
+
+// EstimateLineCount estimates the number of lines in the files matching the glob from their total size and the line
+// density of a sample from the beginning of the files. The count is exact if the sample covers all the input.
+func EstimateLineCount(ctx context.Context, glob string) (int64, error) {
+	fs, err := filesystem.New(ctx, glob)
+	if err != nil {
+		return 0, err
+	}
+	defer fs.Close()
+
+	files, sizes, err := fileSizes(ctx, fs, glob)
+	if err != nil {
+		return 0, err
+	}
+	var total, sampled, lines int64
+	for i, f := range files {
+		total += sizes[i]
+		if sampled >= lineSampleBytes {
+			continue
+		}
+		n, l, err := countLines(ctx, fs, f, sizes[i], lineSampleBytes-sampled)
+		if err != nil {
+			return 0, err
+		}
+		sampled += n
+		lines += l
+	}
+	if sampled == total {
+		return lines, nil
+	}
+	if lines == 0 {
+		// The first line is longer than the sample.
+		return 1, nil
+	}
+	return total * lines / sampled, nil
+}
+
 // AddStrInPath adds a string in the file name before the file extension.
 //
 // For example: addStringInPath("/foo/x.bar", "_baz") = "/foo/x_baz.bar"
@@ -15,6 +15,8 @@
 package pipelineutils
 
 import (
+	"bytes"
+	"context"
 	"io/ioutil"
 	"os"
 	"path"
@@ -98,3 +100,76 @@ func TestWriteNShardedFiles(t *testing.T) {
 		t.Fatalf("pipeline failed: %s", err)
 	}
 }
+
+func TestShardCount(t *testing.T) {
+	for _, tc := range []struct {
+		expectedBytes, targetShardBytes, want int64
+	}{
+		{0, DefaultTargetShardBytes, 1},
+		{DefaultTargetShardBytes, DefaultTargetShardBytes, 1},
+		{DefaultTargetShardBytes + 1, DefaultTargetShardBytes, 2},
+		{10 * DefaultTargetShardBytes, DefaultTargetShardBytes, 10},
+		{1 << 50, DefaultTargetShardBytes, maxShards},
+		{100, 0, 1},
+	} {
+		if got := ShardCount(tc.expectedBytes, tc.targetShardBytes); got != tc.want {
+			t.Errorf("ShardCount(%d, %d) = %d, want %d", tc.expectedBytes, tc.targetShardBytes, got, tc.want)
+		}
+	}
+}
+
+func TestTotalFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test-file-size")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, content := range []string{"12345", "123"} {
+		if err := ioutil.WriteFile(path.Join(dir, "input-"+strconv.Itoa(i)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := TotalFileSize(context.Background(), path.Join(dir, "input*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 8 {
+		t.Errorf("expect total size 8, got %d", got)
+	}
+}
+
+func TestEstimateLineCount(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "test-line-count")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	for i, content := range []string{"a\nb\nc", "d\ne\n"} {
+		if err := ioutil.WriteFile(path.Join(dir, "small-"+strconv.Itoa(i)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each line of the large file has 16 bytes, so the estimation from the sample is exact.
+	large := bytes.Repeat([]byte("123456789abcdef\n"), 2*lineSampleBytes/16)
+	if err := ioutil.WriteFile(path.Join(dir, "large"), large, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for glob, want := range map[string]int64{
+		"small-0": 3,
+		"small*":  5,
+		"large":   2 * lineSampleBytes / 16,
+		"missing": 0,
+	} {
+		got, err := EstimateLineCount(ctx, path.Join(dir, glob))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("expect %d lines for %q, got %d", want, glob, got)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package results reads the histogram files written by the DPF aggregation pipelines, so Go services can consume the
+// results without parsing the text format themselves.
+//
+// A partial histogram of a helper has lines of "bucket ID,base64-encoded PartialAggregationDpf", and a merged
+// histogram has lines of "bucket ID,SUM", followed by the labels in an annotated histogram. A result may be split into
+// shards matching a glob. The readers go through the shards in the order of their names, and only open a shard and
+// decode its records when the iteration reaches them:
+//
+//	r, err := results.OpenPartial(ctx, "/path/to/result*", nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer r.Close()
+//	for r.Next() {
+//		record := r.Record()
+//		...
+//	}
+//	return r.Err()
+package results
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/io/filesystem"
+	"google.golang.org/protobuf/proto"
+	"lukechampine.com/uint128"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+
+	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+
+	// The following packages are required to read files from GCS or local.
+	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/gcs"
+	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/local"
+)
+
+// maxLineBytes caps the length of a line, which is far above the records of the histograms.
+const maxLineBytes = 1 << 20
+
+// PartialRecord is the share of a helper for a bucket.
+type PartialRecord struct {
+	Bucket     uint128.Uint128
+	PartialSum uint64
+}
+
+// MergedRecord is the sum of a bucket in the merged histogram.
+type MergedRecord struct {
+	Bucket uint128.Uint128
+	Sum    uint64
+	// Labels of the bucket in an annotated histogram.
+	Labels []string
+}
+
+// PrefixFilter selects the buckets whose IDs start with a prefix.
+type PrefixFilter struct {
+	Prefix       uint128.Uint128
+	PrefixLength int32
+	// Bit size of the bucket IDs in the histogram.
+	KeyBitSize int32
+}
+
+// Validate checks the prefix fits in the bucket IDs.
+func (f *PrefixFilter) Validate() error {
+	if f.KeyBitSize <= 0 || f.KeyBitSize > 128 {
+		return fmt.Errorf("key bit size should be in [1, 128], got %d", f.KeyBitSize)
+	}
+	if f.PrefixLength < 0 || f.PrefixLength > f.KeyBitSize {
+		return fmt.Errorf("prefix length should be in [0, %d], got %d", f.KeyBitSize, f.PrefixLength)
+	}
+	if f.PrefixLength < 128 && f.Prefix.Rsh(uint(f.PrefixLength)) != uint128.Zero {
+		return fmt.Errorf("prefix %s is longer than %d bits", f.Prefix.String(), f.PrefixLength)
+	}
+	return nil
+}
+
+// Match returns whether the bucket is under the prefix. A nil filter matches all the buckets.
+func (f *PrefixFilter) Match(bucket uint128.Uint128) bool {
+	if f == nil {
+		return true
+	}
+	return bucket.Rsh(uint(f.KeyBitSize-f.PrefixLength)) == f.Prefix
+}
+
+// ParsePartialLine parses a line of a partial histogram.
+func ParsePartialLine(line string) (*PartialRecord, error) {
+	cols := strings.Split(line, ",")
+	if got, want := len(cols), 2; got != want {
+		return nil, fmt.Errorf("got %d number of columns in line %q, expected %d", got, line, want)
+	}
+	bucket, err := utils.StringToUint128(cols[0])
+	if err != nil {
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(cols[1])
+	if err != nil {
+		return nil, err
+	}
+	aggregation := &pb.PartialAggregationDpf{}
+	if err := proto.Unmarshal(b, aggregation); err != nil {
+		return nil, err
+	}
+	return &PartialRecord{Bucket: bucket, PartialSum: aggregation.GetPartialSum()}, nil
+}
+
+// ParseMergedLine parses a line of a merged histogram, with or without annotation.
+func ParseMergedLine(line string) (*MergedRecord, error) {
+	cols := strings.Split(line, ",")
+	if len(cols) < 2 {
+		return nil, fmt.Errorf("expect at least 2 columns in line %q, got %d", line, len(cols))
+	}
+	bucket, err := utils.StringToUint128(strings.TrimSpace(cols[0]))
+	if err != nil {
+		return nil, err
+	}
+	sum, err := strconv.ParseUint(strings.TrimSpace(cols[1]), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	record := &MergedRecord{Bucket: bucket, Sum: sum}
+	if len(cols) > 2 {
+		record.Labels = cols[2:]
+	}
+	return record, nil
+}
+
+// lineReader iterates over the nonempty lines of the files matching a glob, opening one file at a time.
+type lineReader struct {
+	ctx     context.Context
+	fs      filesystem.Interface
+	files   []string
+	next    int
+	file    io.ReadCloser
+	scanner *bufio.Scanner
+	// Name of the file with the current line.
+	current string
+	err     error
+}
+
+func newLineReader(ctx context.Context, glob string) (*lineReader, error) {
+	fs, err := filesystem.New(ctx, glob)
+	if err != nil {
+		return nil, err
+	}
+	files, err := fs.List(ctx, glob)
+	if err != nil {
+		fs.Close()
+		return nil, err
+	}
+	if len(files) == 0 {
+		fs.Close()
+		return nil, fmt.Errorf("no file matches %q", glob)
+	}
+	sort.Strings(files)
+	return &lineReader{ctx: ctx, fs: fs, files: files}, nil
+}
+
+// nextLine returns the next nonempty line, or false at the end of the files or on an error.
+func (r *lineReader) nextLine() (string, bool) {
+	for r.err == nil {
+		if r.scanner == nil {
+			if r.next >= len(r.files) {
+				return "", false
+			}
+			r.current = r.files[r.next]
+			r.next++
+			if r.file, r.err = r.fs.OpenRead(r.ctx, r.current); r.err != nil {
+				return "", false
+			}
+			r.scanner = bufio.NewScanner(r.file)
+			r.scanner.Buffer(nil, maxLineBytes)
+		}
+		if r.scanner.Scan() {
+			if line := r.scanner.Text(); line != "" {
+				return line, true
+			}
+			continue
+		}
+		r.err = r.scanner.Err()
+		if err := r.closeFile(); r.err == nil {
+			r.err = err
+		}
+	}
+	return "", false
+}
+
+func (r *lineReader) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file, r.scanner = nil, nil
+	return err
+}
+
+func (r *lineReader) close() error {
+	err := r.closeFile()
+	if fsErr := r.fs.Close(); err == nil {
+		err = fsErr
+	}
+	return err
+}
+
+// PartialReader iterates over the records of a partial histogram.
+type PartialReader struct {
+	lines  *lineReader
+	filter *PrefixFilter
+	record *PartialRecord
+	err    error
+}
+
+// OpenPartial opens the partial histogram in the files matching the glob. Only the buckets matching the filter are
+// returned if it is not nil.
+func OpenPartial(ctx context.Context, glob string, filter *PrefixFilter) (*PartialReader, error) {
+	if filter != nil {
+		if err := filter.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	lines, err := newLineReader(ctx, glob)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialReader{lines: lines, filter: filter}, nil
+}
+
+// Next advances to the next record, and returns false at the end of the histogram or on an error.
+func (r *PartialReader) Next() bool {
+	for r.err == nil {
+		line, ok := r.lines.nextLine()
+		if !ok {
+			r.err = r.lines.err
+			return false
+		}
+		record, err := ParsePartialLine(line)
+		if err != nil {
+			r.err = fmt.Errorf("invalid partial histogram %q: %v", r.lines.current, err)
+			return false
+		}
+		if r.filter.Match(record.Bucket) {
+			r.record = record
+			return true
+		}
+	}
+	return false
+}
+
+// Record returns the current record.
+func (r *PartialReader) Record() *PartialRecord { return r.record }
+
+// Err returns the error that stopped the iteration, if any.
+func (r *PartialReader) Err() error { return r.err }
+
+// Close closes the open shard.
+func (r *PartialReader) Close() error { return r.lines.close() }
+
+// MergedReader iterates over the records of a merged histogram.
+type MergedReader struct {
+	lines  *lineReader
+	filter *PrefixFilter
+	record *MergedRecord
+	err    error
+}
+
+// OpenMerged opens the merged histogram in the files matching the glob. Only the buckets matching the filter are
+// returned if it is not nil.
+func OpenMerged(ctx context.Context, glob string, filter *PrefixFilter) (*MergedReader, error) {
+	if filter != nil {
+		if err := filter.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	lines, err := newLineReader(ctx, glob)
+	if err != nil {
+		return nil, err
+	}
+	return &MergedReader{lines: lines, filter: filter}, nil
+}
+
+// Next advances to the next record, and returns false at the end of the histogram or on an error.
+func (r *MergedReader) Next() bool {
+	for r.err == nil {
+		line, ok := r.lines.nextLine()
+		if !ok {
+			r.err = r.lines.err
+			return false
+		}
+		record, err := ParseMergedLine(line)
+		if err != nil {
+			r.err = fmt.Errorf("invalid merged histogram %q: %v", r.lines.current, err)
+			return false
+		}
+		if r.filter.Match(record.Bucket) {
+			r.record = record
+			return true
+		}
+	}
+	return false
+}
+
+// Record returns the current record.
+func (r *MergedReader) Record() *MergedRecord { return r.record }
+
+// Err returns the error that stopped the iteration, if any.
+func (r *MergedReader) Err() error { return r.err }
+
+// Close closes the open shard.
+func (r *MergedReader) Close() error { return r.lines.close() }
+
+// ReadPartialSums reads the partial sums of the matching buckets into a map. A bucket appearing more than once is an
+// error.
+func ReadPartialSums(ctx context.Context, glob string, filter *PrefixFilter) (map[uint128.Uint128]uint64, error) {
+	r, err := OpenPartial(ctx, glob, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	sums := make(map[uint128.Uint128]uint64)
+	for r.Next() {
+		record := r.Record()
+		if _, ok := sums[record.Bucket]; ok {
+			return nil, fmt.Errorf("bucket %s appears more than once in %q", record.Bucket.String(), glob)
+		}
+		sums[record.Bucket] = record.PartialSum
+	}
+	return sums, r.Err()
+}
+
+// ReadMergedSums reads the sums of the matching buckets into a map. A bucket appearing more than once is an error.
+func ReadMergedSums(ctx context.Context, glob string, filter *PrefixFilter) (map[uint128.Uint128]uint64, error) {
+	r, err := OpenMerged(ctx, glob, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	sums := make(map[uint128.Uint128]uint64)
+	for r.Next() {
+		record := r.Record()
+		if _, ok := sums[record.Bucket]; ok {
+			return nil, fmt.Errorf("bucket %s appears more than once in %q", record.Bucket.String(), glob)
+		}
+		sums[record.Bucket] = record.Sum
+	}
+	return sums, r.Err()
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package results
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/proto"
+	"lukechampine.com/uint128"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+
+	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+)
+
+func partialLine(t *testing.T, bucket, sum uint64) string {
+	t.Helper()
+	b, err := proto.Marshal(&pb.PartialAggregationDpf{PartialSum: sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%d,%s", bucket, base64.StdEncoding.EncodeToString(b))
+}
+
+func writeShards(t *testing.T, dir string, shards map[string][]string) {
+	t.Helper()
+	ctx := context.Background()
+	for name, lines := range shards {
+		if err := utils.WriteBytes(ctx, []byte(strings.Join(lines, "\n")), path.Join(dir, name), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPrefixFilter(t *testing.T) {
+	filter := &PrefixFilter{Prefix: uint128.From64(2), PrefixLength: 2, KeyBitSize: 4}
+	if err := filter.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for bucket, want := range map[uint64]bool{0x7: false, 0x8: true, 0xb: true, 0xc: false} {
+		if got := filter.Match(uint128.From64(bucket)); got != want {
+			t.Errorf("expect match %v for bucket %x, got %v", want, bucket, got)
+		}
+	}
+
+	var nilFilter *PrefixFilter
+	if !nilFilter.Match(uint128.From64(0xc)) {
+		t.Error("expect a nil filter to match all buckets")
+	}
+
+	for _, invalid := range []*PrefixFilter{
+		{Prefix: uint128.From64(4), PrefixLength: 2, KeyBitSize: 4},
+		{PrefixLength: 5, KeyBitSize: 4},
+		{PrefixLength: 1, KeyBitSize: 0},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("expect error for invalid filter %+v", invalid)
+		}
+	}
+}
+
+func TestParseMergedLine(t *testing.T) {
+	record, err := ParseMergedLine("123,45,label1,label2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &MergedRecord{Bucket: uint128.From64(123), Sum: 45, Labels: []string{"label1", "label2"}}
+	if diff := cmp.Diff(want, record); diff != "" {
+		t.Errorf("merged record mismatch (-want +got):\n%s", diff)
+	}
+	if _, err := ParseMergedLine("123"); err == nil {
+		t.Error("expect error for a record without sum")
+	}
+}
+
+func TestReadPartialSums(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-results")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	writeShards(t, tmpDir, map[string][]string{
+		"partial-00000-of-00002": {partialLine(t, 1, 10), partialLine(t, 9, 90), ""},
+		"partial-00001-of-00002": {partialLine(t, 8, 80)},
+	})
+
+	ctx := context.Background()
+	glob := path.Join(tmpDir, "partial-*")
+	got, err := ReadPartialSums(ctx, glob, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint128.Uint128]uint64{uint128.From64(1): 10, uint128.From64(8): 80, uint128.From64(9): 90}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("partial sums mismatch (-want +got):\n%s", diff)
+	}
+
+	got, err = ReadPartialSums(ctx, glob, &PrefixFilter{Prefix: uint128.From64(1), PrefixLength: 1, KeyBitSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[uint128.Uint128]uint64{uint128.From64(8): 80, uint128.From64(9): 90}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("filtered partial sums mismatch (-want +got):\n%s", diff)
+	}
+
+	writeShards(t, tmpDir, map[string][]string{"partial-00002-of-00002": {partialLine(t, 1, 11)}})
+	if _, err := ReadPartialSums(ctx, glob, nil); err == nil {
+		t.Error("expect error for a bucket in more than one shard")
+	}
+
+	writeShards(t, tmpDir, map[string][]string{"partial-00002-of-00002": {"1,not-base64"}})
+	if _, err := ReadPartialSums(ctx, glob, nil); err == nil {
+		t.Error("expect error for an invalid partial aggregation")
+	}
+
+	if _, err := ReadPartialSums(ctx, path.Join(tmpDir, "missing-*"), nil); err == nil {
+		t.Error("expect error for a glob matching no file")
+	}
+}
+
+func TestMergedReader(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-results")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	writeShards(t, tmpDir, map[string][]string{
+		"merged-00001-of-00002": {"3,30,c"},
+		"merged-00000-of-00002": {"1,10,a", "2,20,b"},
+	})
+
+	r, err := OpenMerged(context.Background(), path.Join(tmpDir, "merged-*"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var got []*MergedRecord
+	for r.Next() {
+		got = append(got, r.Record())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// The shards are read in the order of their names.
+	want := []*MergedRecord{
+		{Bucket: uint128.From64(1), Sum: 10, Labels: []string{"a"}},
+		{Bucket: uint128.From64(2), Sum: 20, Labels: []string{"b"}},
+		{Bucket: uint128.From64(3), Sum: 30, Labels: []string{"c"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("merged records mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -17,18 +17,36 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/firestore"
 	log "github.com/golang/glog"
+	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
 	"github.com/google/privacy-sandbox-aggregation-service/service/aggregatorservice"
+	"github.com/google/privacy-sandbox-aggregation-service/service/authz"
+	"github.com/google/privacy-sandbox-aggregation-service/service/budgetledger"
+	"github.com/google/privacy-sandbox-aggregation-service/service/chaos"
+	"github.com/google/privacy-sandbox-aggregation-service/service/clienttoken"
+	"github.com/google/privacy-sandbox-aggregation-service/service/jobexport"
+	"github.com/google/privacy-sandbox-aggregation-service/service/jobmonitor"
+	"github.com/google/privacy-sandbox-aggregation-service/service/latencyslo"
 	"github.com/google/privacy-sandbox-aggregation-service/service/query"
+	"github.com/google/privacy-sandbox-aggregation-service/service/querytemplate"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultcache"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
+	"github.com/google/privacy-sandbox-aggregation-service/service/runtimeconfig"
 )
 
 var (
@@ -38,6 +56,23 @@ var (
 	dpfAggregatePartialReportBinary      = flag.String("dpf_aggregate_partial_report_binary", "/dpf_aggregate_partial_report_pipeline", "Binary for partial report aggregation with DPF protocol.")
 	dpfAggregateReachPartialReportBinary = flag.String("dpf_aggregate_reach_partial_report_binary", "/dpf_aggregate_reach_partial_report_pipeline", "Binary for partial report aggregation for Reach.")
 	workspaceURI                         = flag.String("workspace_uri", "", "The Private location to save the intermediate query states.")
+
+	shadowDpfAggregatePartialReportBinary = flag.String("shadow_dpf_aggregate_partial_report_binary", "", "Candidate binary for partial report aggregation with DPF protocol, which runs in shadow mode for debug batches requested with a noise seed.")
+	shadowDir                             = flag.String("shadow_dir", "", "Private directory for the outputs of the shadow pipelines and the reports of their differences from the production outputs.")
+
+	decryptedReportDir      = flag.String("decrypted_report_dir", "", "Private directory for the decrypted reports of hierarchical queries, which can be in a cheaper storage tier than the workspace. The workspace is used if empty.")
+	decryptedReportCacheDir = flag.String("decrypted_report_cache_dir", "", "Local directory to cache the verified decrypted reports when running pipelines with the direct runner. The cache is disabled if empty.")
+	mmapLocalReports        = flag.Bool("mmap_local_reports", false, "Read the local input reports through memory mappings in the DPF pipelines when running with the direct runner, for very large batches.")
+
+	consistencyCheckRate     = flag.Float64("consistency_check_rate", 0, "Fraction of the reports in debug batches whose secret shares are checked to recombine to valid values. Disabled if zero.")
+	consistencyCheckMaxValue = flag.Uint64("consistency_check_max_value", 1<<16, "Maximum value of a report in the consistency check.")
+	traceSampleRate          = flag.Float64("trace_sample_rate", 0, "Fraction of the reports traced through the DPF pipelines into the workspace, for debugging missing reports. At most 0.01, and disabled if zero.")
+
+	dataQualityBudgetFraction = flag.Float64("data_quality_budget_fraction", 0, "Fraction of the privacy budget reserved for a data quality summary written next to the final result, from the first level of the DPF queries. Must be below 1, and the summary is disabled if zero.")
+
+	targetBundleMillis = flag.Int64("target_bundle_millis", 0, "Target time for expanding the reports in one bundle at the deeper levels of hierarchical queries, tuned from the statistics of the previous level. Bundle sizes are not tuned if zero.")
+	preemptMemoryMB    = flag.Int64("preempt_memory_mb", 0, "Resident memory in MB of the pipeline workers above which the bundles of reports are pre-empted and re-split at every level of the DPF queries, e.g. 80% of the worker memory. Bundles are not pre-empted if zero.")
+
 	// The PubSub subscription should enable the retry policy with a exponential backoff delay.
 	// Recommended retry policy: min_retry_delay=60s, max_retry_delay=600s.
 	// The subscription should also have a dead-letter topic where messages will be forwarded after 10 failed delivery attemps.
@@ -45,6 +80,49 @@ var (
 	pubsubTopic        = flag.String("pubsub_topic", "", "PubSub topic to send aggregation requests to. The value may be a fully qualified topic URI.")
 	origin             = flag.String("origin", "", "Origin of the helper.")
 	sharedDir          = flag.String("shared_dir", "", "Shared directory for the intermediate results, where other helper can read them.")
+	readOnly           = flag.Bool("read_only", false, "Start the helper in read-only mode, where no new aggregation pipeline is launched. The mode can be changed with the admin endpoint /admin/readonly.")
+	readOnlyRetryDelay = flag.Duration("read_only_retry_delay", time.Minute, "How long a request that needs a new pipeline is held in read-only mode before it is nacked, unless the mode is disabled earlier. No other request is pulled meanwhile.")
+	resultCacheDir     = flag.String("result_cache_dir", "", "Private directory to cache the final results of completed queries. Caching is disabled if empty.")
+	budgetLedgerDir    = flag.String("budget_ledger_dir", "", "Private directory of the ledger with the privacy budget spent on each batch. The budget is not tracked if empty.")
+	batchBudget        = flag.Float64("batch_budget", 1, "Total epsilon of a batch in each budget period, when the budget is tracked.")
+	budgetPeriod       = flag.Duration("budget_period", 0, "Length of the periods after which the budget of the batches renews. The budget never renews if zero.")
+	strictPrivacy      = flag.Bool("strict_privacy", false, "Reject aggregations without noise or with seeded noise unless the signed batch metadata flags a debug batch. Reach queries are always noiseless, so they are only accepted on debug batches. Enable it only after the batchers sign the metadata of debug batches and their keys are set with --batch_signing_public_keys.")
+
+	batchSigningPublicKeys = flag.String("batch_signing_public_keys", "", "Base64-encoded Ed25519 public keys of the batchers trusted to flag debug batches in the signed batch metadata, separated by commas. No batch is treated as a debug batch if empty.")
+
+	budgetWindow = flag.String("budget_window", "", "Partition the budget by reporting origins and windows of scheduled report times, \"daily\", \"weekly\" or a duration, each with its own budget of --batch_budget. Every window with reports of a query is charged with its full epsilon. Replaces --budget_period if set.")
+
+	writeResultManifest    = flag.Bool("write_result_manifest", false, "Write a manifest with the hashes of the final result files next to them, for third-party auditors.")
+	resultSigningKeySecret = flag.String("result_signing_key_secret", "", "Secret Manager version of the key used to sign the result manifests, stored as the JSON {\"Purpose\":\"output_signing\",\"Key\":\"<base64-encoded Ed25519 seed>\"}. The manifests are unsigned if empty.")
+
+	queryTemplateURI               = flag.String("query_template_uri", "", "JSON file of the query templates managed through the endpoint /query_templates, where changes are saved. The endpoint is disabled if empty.")
+	queryTemplateMaxEpsilon        = flag.Float64("query_template_max_epsilon", 0, "Maximum total epsilon of the query templates added through /query_templates. The epsilon is not limited if zero.")
+	queryTemplateResultDirPrefixes = flag.String("query_template_result_dir_prefixes", "", "Prefixes allowed for the result directories of the query templates added through /query_templates, separated by commas. The directories are not restricted if empty.")
+	queryTemplateInputPrefixes     = flag.String("query_template_input_prefixes", "", "Prefixes allowed for the partial reports and the expansion configurations of the query templates added through /query_templates, separated by commas. The inputs are not restricted if empty.")
+
+	latencySLOObjectives = flag.String("latency_slo_objectives", "", "Latency objectives between the lifecycle steps of the queries in the format from:to=duration, separated by commas, e.g. batch_ready:merged=6h. The metrics are served on the endpoint /latency_slo.")
+	jobStoreProject      = flag.String("job_store_project", "", "GCP project of the Firestore job store, where the lifecycle steps of the queries are recorded. The steps are only kept in memory if empty.")
+
+	jobExportTable = flag.String("job_export_table", "", "BigQuery table in the format project.dataset.table, where the manifest, counters and lifecycle steps of each finished query are streamed for fleet-wide analytics. The table is created if it does not exist. Queries are not exported if empty.")
+
+	clientTokenRetention = flag.Duration("client_token_retention", 7*24*time.Hour, "How long the client tokens of the queries are kept in the job store, or in memory without job store, so retried submissions with the same token are not run again. The tokens never expire if zero.")
+	clientTokenLease     = flag.Duration("client_token_lease", 24*time.Hour, "How long the query of a client token is considered running on this helper without finishing, after which a retry can take it over, e.g. when the helper crashed. The default matches the maximum time a request message is held. The running queries are only taken over after they finish if zero.")
+
+	levelTimeout = flag.Duration("level_timeout", 0, "Maximum time a request waits for the results of the partner helper, after which the query is aborted. The requests wait indefinitely if zero.")
+
+	chaosFaultRates = flag.String("chaos_fault_rates", "", "For testing only: rates of the failures injected into the coordination with the partner helper in the format fault=rate, separated by commas, e.g. pipeline_timeout=0.1,drop_level_message=0.1,partial_upload=0.1. No failure is injected if empty.")
+	chaosSeed       = flag.Int64("chaos_seed", 0, "Seed of the injected failures.")
+
+	checkBatchIntegrity = flag.Bool("check_batch_integrity", false, "Compare the digest over the input reports with the partner helper before the first aggregation of a query, and abort the query if they differ.")
+
+	runtimeConfigURI          = flag.String("runtime_config_uri", "", "JSON file of the partner helper allowlist and the epsilon cap of the queries, which is reloaded when it changes. The current config is served on the endpoint /admin/runtime_config, where POST forces a reload. Queries are not checked if empty.")
+	runtimeConfigPollInterval = flag.Duration("runtime_config_poll_interval", time.Minute, "Interval to check the runtime config for changes.")
+
+	authzPolicyURI = flag.String("authz_policy_uri", "", "JSON file of the bindings from the caller identities to the roles viewer, submitter and admin, which are required by the HTTP APIs. The APIs that require a role reject all requests if empty.")
+	authzAudience  = flag.String("authz_audience", "", "Audience of the OIDC ID tokens of the callers. Only the client certificates identify the callers if empty.")
+	tlsCertFile    = flag.String("tls_cert_file", "", "Certificate file of the server, which serves TLS if set.")
+	tlsKeyFile     = flag.String("tls_key_file", "", "Private key file of the server certificate.")
+	clientCAFile   = flag.String("client_ca_file", "", "CA certificates to verify the client certificates of mutual TLS, which identify the callers to the authorization policy. Client certificates are not requested if empty.")
 
 	pipelineRunner            = flag.String("pipeline_runner", "direct", "Runner for the Beam pipeline: direct or dataflow.")
 	dataflowProject           = flag.String("dataflow_project", "", "GCP project of the Dataflow service.")
@@ -79,18 +157,89 @@ func main() {
 	log.Infof("Pipeline binary: %s\n", *dpfAggregatePartialReportBinary)
 	log.Infof("Shared directory: %s\n", *sharedDir)
 
+	if *dataQualityBudgetFraction < 0 || *dataQualityBudgetFraction >= 1 {
+		log.Exitf("expect --data_quality_budget_fraction in [0, 1), got %v", *dataQualityBudgetFraction)
+	}
+
 	sharedInfoHandler := &aggregatorservice.SharedInfoHandler{
 		SharedInfo: &query.HelperSharedInfo{
 			Origin:      *origin,
 			SharedDir:   *sharedDir,
 			PubSubTopic: *pubsubTopic,
+			// Read by the partner to check whether a level is done.
+			LevelDoneMarkers: true,
+			// Read by the partner to agree on serving a query from the result caches.
+			CacheDecisions: *resultCacheDir != "",
 		},
 	}
+	readOnlyMode := &aggregatorservice.ReadOnlyMode{}
+	readOnlyMode.Set(*readOnly)
+
+	authorizer, err := authz.NewAuthorizer(context.Background(), *authzPolicyURI, *authzAudience)
+	if err != nil {
+		log.Exit(err)
+	}
+	viewer := authz.MethodRoles{"": authz.RoleViewer}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", sharedInfoHandler)
+	mux.Handle("/healthz", &aggregatorservice.HealthHandler{Mode: readOnlyMode})
+	mux.Handle("/admin/readonly", authorizer.Require(authz.ViewerRoles, &aggregatorservice.ReadOnlyAdminHandler{Mode: readOnlyMode}))
+	mux.Handle("/epsilon_suggestion", authorizer.Require(viewer, &aggregatorservice.EpsilonSuggestionHandler{}))
+	if *queryTemplateURI != "" {
+		library, err := querytemplate.ReadLibrary(context.Background(), *queryTemplateURI)
+		if err != nil {
+			log.Exit(err)
+		}
+		policy := &querytemplate.Policy{
+			MaxEpsilon:        *queryTemplateMaxEpsilon,
+			ResultDirPrefixes: splitList(*queryTemplateResultDirPrefixes),
+			InputURIPrefixes:  splitList(*queryTemplateInputPrefixes),
+		}
+		mux.Handle("/query_templates", authorizer.Require(authz.MethodRoles{http.MethodGet: authz.RoleViewer, "": authz.RoleSubmitter}, &querytemplate.Handler{Library: library, Policy: policy}))
+	}
+	objectives, err := latencyslo.ParseObjectives(*latencySLOObjectives)
+	if err != nil {
+		log.Exit(err)
+	}
+	var lifecycleStore latencyslo.Store
+	var tokenStore clienttoken.Store = clienttoken.NewMemoryStore()
+	if *jobStoreProject != "" {
+		firestoreClient, err := firestore.NewClient(context.Background(), *jobStoreProject)
+		if err != nil {
+			log.Exit(err)
+		}
+		defer firestoreClient.Close()
+		lifecycleStore = &jobmonitor.LifecycleStore{Client: firestoreClient, Path: jobmonitor.ProdPath}
+		tokenStore = &jobmonitor.TokenStore{Client: firestoreClient, Path: jobmonitor.ClientTokenPath}
+	}
+	latencyTracker := latencyslo.NewTracker(objectives, lifecycleStore)
+	mux.Handle("/latency_slo", authorizer.Require(authz.MethodRoles{http.MethodGet: authz.RoleViewer, "": authz.RoleSubmitter}, &latencyslo.Handler{Tracker: latencyTracker}))
+	var runtimeConfig *runtimeconfig.Watcher
+	if *runtimeConfigURI != "" {
+		if runtimeConfig, err = runtimeconfig.NewWatcher(context.Background(), *runtimeConfigURI); err != nil {
+			log.Exit(err)
+		}
+		go runtimeConfig.Watch(context.Background(), *runtimeConfigPollInterval)
+		mux.Handle("/admin/runtime_config", authorizer.Require(authz.ViewerRoles, &runtimeconfig.Handler{Watcher: runtimeConfig}))
+	}
 	srv := http.Server{
 		Addr:      *address,
-		Handler:   sharedInfoHandler,
+		Handler:   mux,
 		TLSConfig: &tls.Config{},
 	}
+	if *clientCAFile != "" {
+		pem, err := ioutil.ReadFile(*clientCAFile)
+		if err != nil {
+			log.Exit(err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			log.Exitf("no CA certificate found in %q", *clientCAFile)
+		}
+		// Callers without certificates can still be identified by their tokens.
+		srv.TLSConfig.ClientCAs, srv.TLSConfig.ClientAuth = clientCAs, tls.VerifyClientCertIfGiven
+	}
 
 	ctx := context.Background()
 	queryHandler := aggregatorservice.QueryHandler{
@@ -99,6 +248,19 @@ func main() {
 			DpfAggregatePartialReportBinary:      *dpfAggregatePartialReportBinary,
 			DpfAggregateReachPartialReportBinary: *dpfAggregateReachPartialReportBinary,
 			WorkspaceURI:                         *workspaceURI,
+
+			ShadowDpfAggregatePartialReportBinary: *shadowDpfAggregatePartialReportBinary,
+			ShadowDir:                             *shadowDir,
+
+			DecryptedReportDir:        *decryptedReportDir,
+			DecryptedReportCacheDir:   *decryptedReportCacheDir,
+			MmapLocalReports:          *mmapLocalReports,
+			TargetBundleMillis:        *targetBundleMillis,
+			PreemptMemoryMB:           *preemptMemoryMB,
+			ConsistencyCheckRate:      *consistencyCheckRate,
+			ConsistencyCheckMaxValue:  *consistencyCheckMaxValue,
+			TraceSampleRate:           *traceSampleRate,
+			DataQualityBudgetFraction: *dataQualityBudgetFraction,
 		},
 		PipelineRunner: *pipelineRunner,
 		DataflowCfg: aggregatorservice.DataflowCfg{
@@ -115,6 +277,83 @@ func main() {
 		SharedDir:                 *sharedDir,
 		RequestPubSubTopic:        *pubsubTopic,
 		RequestPubsubSubscription: *pubsubSubscription,
+		ReadOnly:                  readOnlyMode,
+		ReadOnlyRetryDelay:        *readOnlyRetryDelay,
+		StrictPrivacy:             *strictPrivacy,
+		CheckBatchIntegrity:       *checkBatchIntegrity,
+		WriteResultManifest:       *writeResultManifest,
+		Latency:                   latencyTracker,
+		RuntimeConfig:             runtimeConfig,
+		ClientTokens:              &clienttoken.Registry{Store: tokenStore, Retention: *clientTokenRetention, Lease: *clientTokenLease},
+		LevelTimeout:              *levelTimeout,
+	}
+	// The key only lives as long as the server, which is enough for the shadow pipelines to add the same noise as the
+	// production ones.
+	queryHandler.NoiseSeedKey = make([]byte, 32)
+	if _, err := rand.Read(queryHandler.NoiseSeedKey); err != nil {
+		log.Exit(err)
+	}
+	for _, key := range strings.Split(*batchSigningPublicKeys, ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		publicKey, err := resultmanifest.ParsePublicKey(key)
+		if err != nil {
+			log.Exitf("invalid batch signing public key %q: %v", key, err)
+		}
+		queryHandler.BatchSigningKeys = append(queryHandler.BatchSigningKeys, publicKey)
+	}
+	if *resultSigningKeySecret != "" {
+		if queryHandler.ResultSigningKey, err = cryptoio.ReadSigningKey(ctx, &cryptoio.ReadStandardPrivateKeyParams{
+			SecretName: *resultSigningKeySecret,
+		}); err != nil {
+			log.Exit(err)
+		}
+	}
+	if *resultCacheDir != "" {
+		queryHandler.ResultCache = &resultcache.Cache{Dir: *resultCacheDir}
+	}
+	if *budgetLedgerDir != "" {
+		if *batchBudget <= 0 {
+			log.Exitf("expect positive batch budget, got %v", *batchBudget)
+		}
+		queryHandler.BudgetLedger = &budgetledger.Ledger{Dir: *budgetLedgerDir, Budget: *batchBudget, Period: *budgetPeriod}
+		if *budgetWindow != "" {
+			window, err := budgetledger.ParseWindow(*budgetWindow)
+			if err != nil {
+				log.Exit(err)
+			}
+			queryHandler.BudgetLedger.Window = window
+			mux.Handle("/budget_windows", authorizer.Require(viewer, &budgetledger.Handler{Ledger: queryHandler.BudgetLedger}))
+		}
+	}
+
+	if *chaosFaultRates != "" {
+		rates, err := chaos.ParseRates(*chaosFaultRates)
+		if err != nil {
+			log.Exit(err)
+		}
+		if queryHandler.Chaos, err = chaos.NewInjector(rates, *chaosSeed); err != nil {
+			log.Exit(err)
+		}
+		log.Warningf("injecting failures with rates %s", queryHandler.Chaos)
+	}
+
+	if *jobExportTable != "" {
+		project, dataset, table, err := jobexport.ParseTable(*jobExportTable)
+		if err != nil {
+			log.Exit(err)
+		}
+		bigqueryClient, err := bigquery.NewClient(ctx, project)
+		if err != nil {
+			log.Exit(err)
+		}
+		defer bigqueryClient.Close()
+		exportTable := bigqueryClient.Dataset(dataset).Table(table)
+		if err := jobexport.EnsureTable(ctx, exportTable); err != nil {
+			log.Exit(err)
+		}
+		queryHandler.JobExport = jobexport.NewExporter(exportTable.Inserter())
 	}
 
 	if err := queryHandler.Setup(ctx); err != nil {
@@ -129,7 +368,13 @@ func main() {
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if *tlsCertFile != "" {
+			err = srv.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
@@ -147,3 +392,14 @@ func main() {
 	log.Infof("%s signal caught", sig)
 	cancel()
 }
+
+// splitList returns the non-empty items of a list separated by commas.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
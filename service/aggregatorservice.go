@@ -18,22 +18,48 @@ package aggregatorservice
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/golang/glog"
 	"cloud.google.com/go/pubsub"
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/dataflow/v1b3"
+	"lukechampine.com/uint128"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/service/authz"
+	"github.com/google/privacy-sandbox-aggregation-service/service/batchintegrity"
+	"github.com/google/privacy-sandbox-aggregation-service/service/budgetadvisor"
+	"github.com/google/privacy-sandbox-aggregation-service/service/budgetledger"
+	"github.com/google/privacy-sandbox-aggregation-service/service/chaos"
+	"github.com/google/privacy-sandbox-aggregation-service/service/clienttoken"
+	"github.com/google/privacy-sandbox-aggregation-service/service/jobexport"
+	"github.com/google/privacy-sandbox-aggregation-service/service/latencyslo"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/failurereport"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/onepartyaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelineutils"
 	"github.com/google/privacy-sandbox-aggregation-service/service/query"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultcache"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
+	"github.com/google/privacy-sandbox-aggregation-service/service/runtimeconfig"
+	"github.com/google/privacy-sandbox-aggregation-service/service/shadowrun"
+	"github.com/google/privacy-sandbox-aggregation-service/service/tieredstorage"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/consistencycheck"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/strictprivacy"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
 )
 
@@ -56,6 +82,45 @@ type ServerCfg struct {
 	DpfAggregateReachPartialReportBinary string
 	OnepartyAggregateReportBinary        string
 	WorkspaceURI                         string
+
+	// A candidate DPF aggregation binary that runs in shadow mode for debug batches requested with nonzero
+	// DebugNoiseSeed. Its outputs and the reports of the differences from the production outputs are written in
+	// ShadowDir. Shadow mode is disabled if either field is empty.
+	ShadowDpfAggregatePartialReportBinary string
+	ShadowDir                             string
+
+	// Directory for the decrypted reports of the hierarchical queries, which can be in a cheaper storage tier than the
+	// workspace, e.g. a Nearline bucket. The workspace is used if empty.
+	DecryptedReportDir string
+	// Local directory where the decrypted reports are cached after they are verified, so they are fetched from
+	// DecryptedReportDir only once. It only works with the direct runner, and the cache is disabled if empty.
+	DecryptedReportCacheDir string
+	// Read the local input reports of the DPF pipelines through memory mappings, for very large batches on helpers
+	// that run the direct runner. Inputs in GCS are still read with textio.
+	MmapLocalReports bool
+	// Target time for expanding the reports in one bundle at the deeper levels of hierarchical queries. The bundle size
+	// is tuned from the expansion statistics of the previous level, and not tuned if zero.
+	TargetBundleMillis int64
+	// Resident memory in MB of the pipeline workers above which the bundles of reports are pre-empted and re-split, at
+	// every level of the hierarchical and direct DPF queries. The bundles are not pre-empted if zero.
+	PreemptMemoryMB int64
+	// Fraction of the reports in debug batches whose secret shares are checked to recombine to values of at most
+	// ConsistencyCheckMaxValue. The check is disabled if zero, and never runs on non-debug batches.
+	ConsistencyCheckRate     float64
+	ConsistencyCheckMaxValue uint64
+	// Fraction of the reports traced through the DPF pipelines into the workspace, for debugging missing reports. The
+	// reports are not traced if zero.
+	TraceSampleRate float64
+	// Fraction of the privacy budget reserved for a data quality summary of the batch, which is written next to the
+	// final result. The DPF queries reserve it from the first level. The summary is disabled if zero.
+	DataQualityBudgetFraction float64
+}
+
+func (c *ServerCfg) decryptedReportDir() string {
+	if c.DecryptedReportDir != "" {
+		return c.DecryptedReportDir
+	}
+	return c.WorkspaceURI
 }
 
 // SharedInfoHandler handles HTTP requests for the information shared with other helpers.
@@ -72,6 +137,126 @@ func (h *SharedInfoHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	}
 }
 
+// ReadOnlyMode is a service-level switch for incident response. When it is enabled, the helper does not launch new
+// aggregation pipelines, while the shared information, health status and query results can still be read.
+type ReadOnlyMode struct {
+	enabled int32
+}
+
+// Enabled returns whether the read-only mode is on.
+func (m *ReadOnlyMode) Enabled() bool {
+	return m != nil && atomic.LoadInt32(&m.enabled) == 1
+}
+
+// Set turns the read-only mode on or off.
+func (m *ReadOnlyMode) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&m.enabled, v)
+}
+
+// readOnlyPollInterval is how often WaitDisabled checks the mode.
+const readOnlyPollInterval = time.Second
+
+// WaitDisabled blocks until the read-only mode is off, the timeout elapses, or the context is done.
+func (m *ReadOnlyMode) WaitDisabled(ctx context.Context, timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(readOnlyPollInterval)
+	defer ticker.Stop()
+	for m.Enabled() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline.C:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReadOnlyStatus is the response of the admin and health endpoints.
+type ReadOnlyStatus struct {
+	Status   string `json:"status,omitempty"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ReadOnlyAdminHandler handles the admin requests for the read-only mode.
+//
+// GET returns the current mode; POST with form value "read_only=true" or "read_only=false" changes it. The handler is
+// served behind authz.Authorizer, and POST is only allowed to the callers authorized with the admin role.
+type ReadOnlyAdminHandler struct {
+	Mode *ReadOnlyMode
+}
+
+func (h *ReadOnlyAdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if caller := authz.CallerFromContext(req.Context()); caller == nil || caller.Role < authz.RoleAdmin {
+			http.Error(w, fmt.Sprintf("role %s required", authz.RoleAdmin), http.StatusForbidden)
+			return
+		}
+		enabled, err := strconv.ParseBool(req.FormValue("read_only"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid read_only value: %v", err), http.StatusBadRequest)
+			return
+		}
+		h.Mode.Set(enabled)
+		log.Warningf("read-only mode set to %t", enabled)
+	default:
+		http.Error(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, &ReadOnlyStatus{ReadOnly: h.Mode.Enabled()})
+}
+
+// HealthHandler reports the health of the helper, including whether it is in read-only mode.
+type HealthHandler struct {
+	Mode *ReadOnlyMode
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	status := &ReadOnlyStatus{Status: "ok", ReadOnly: h.Mode.Enabled()}
+	if status.ReadOnly {
+		status.Status = "read-only"
+	}
+	writeJSON(w, status)
+}
+
+// EpsilonSuggestionHandler suggests the minimum privacy budget for a desired relative error.
+//
+// The request body is a JSON-encoded budgetadvisor.SuggestionRequest, and the response is a budgetadvisor.Suggestion.
+type EpsilonSuggestionHandler struct{}
+
+func (h *EpsilonSuggestionHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	suggestionReq := &budgetadvisor.SuggestionRequest{}
+	if err := json.NewDecoder(req.Body).Decode(suggestionReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	suggestion, err := budgetadvisor.SuggestEpsilon(suggestionReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, suggestion)
+}
+
 // QueryHandler handles the request in the pubsub messages.
 type QueryHandler struct {
 	ServerCfg                 ServerCfg
@@ -82,6 +267,54 @@ type QueryHandler struct {
 	RequestPubSubTopic        string
 	RequestPubsubSubscription string
 
+	// The cache for the final results of the conversion queries. The cache is disabled if nil.
+	//
+	// A cached result is only served when the partner helper has a cached result for the query too, which the helpers
+	// agree on through the cache decisions in their shared directories.
+	ResultCache *resultcache.Cache
+	// Batch hashes of the result cache and the budget ledger, so a batch is not read again for every query on it.
+	batchHasher resultcache.BatchHasher
+	// When the read-only mode is enabled, requests that need new pipelines are held for ReadOnlyRetryDelay, or until the
+	// mode is disabled, and then nacked so they are handled later. As only one message is pulled at a time, holding it
+	// also stops pulling other requests, instead of redelivering them in a tight loop.
+	ReadOnly           *ReadOnlyMode
+	ReadOnlyRetryDelay time.Duration
+	// In strict privacy mode, aggregations without noise or with seeded noise are rejected unless the batch is a debug
+	// batch.
+	StrictPrivacy bool
+	// Public keys of the batchers trusted to flag debug batches in the signed batch metadata. The debug flag of a request
+	// is only honored if the metadata of its batch flags a debug batch with a valid signature, so no batch is a debug
+	// batch if empty.
+	BatchSigningKeys []ed25519.PublicKey
+	// Secret key of the helper, from which the noise seeds of the debug batches are derived. The seeds in the requests are
+	// never passed to the pipelines, so the requester can not reproduce the noise. The noise is never seeded if empty.
+	NoiseSeedKey []byte
+	// Whether to compare the digest over the input reports with the partner helper before the first aggregation
+	// of a query, so no budget is spent if the helpers received different reports.
+	CheckBatchIntegrity bool
+	// Whether to write a manifest of the final result files for auditors, which is signed if ResultSigningKey is set.
+	WriteResultManifest bool
+	ResultSigningKey    ed25519.PrivateKey
+	// Tracker of the lifecycle steps of the queries for the latency SLO metrics. Tracking is disabled if nil.
+	Latency *latencyslo.Tracker
+	// Runtime configuration with the allowlist of the partner helpers and the epsilon cap of the queries, which is
+	// reloaded while the helper runs. Queries are not checked if nil.
+	RuntimeConfig *runtimeconfig.Watcher
+	// Ledger of the privacy budget spent on each batch, which rejects or downgrades the queries exceeding the remaining
+	// budget. Queries without noise are rejected unless the batch is a debug batch. The budget is not tracked if nil.
+	BudgetLedger *budgetledger.Ledger
+	// Registry of the client tokens, which drops the retries of the queries submitted with the same token. Requests are
+	// not deduplicated if nil.
+	ClientTokens *clienttoken.Registry
+	// Maximum time a request waits for the results of the partner helper, after which the query is aborted. The requests
+	// wait indefinitely if zero.
+	LevelTimeout time.Duration
+	// Injector of failures in the coordination with the partner helper, for testing the recovery. No failure is injected
+	// if nil.
+	Chaos *chaos.Injector
+	// Exporter of the finished queries to BigQuery for fleet-wide analytics. Queries are not exported if nil.
+	JobExport *jobexport.Exporter
+
 	PubSubTopicClient, PubSubSubscriptionClient *pubsub.Client
 	GCSClient                                   *storage.Client
 	DataflowSvc                                 *dataflow.Service
@@ -148,7 +381,8 @@ func (h *QueryHandler) SetupPullRequests(ctx context.Context) error {
 	sub.ReceiveSettings.Synchronous = true
 	sub.ReceiveSettings.MaxOutstandingMessages = 1
 	sub.ReceiveSettings.MaxExtension = 24 * time.Hour // extending from 60min default to 1 day
-	return sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+	return sub.Receive(ctx, func(ctx context.Context, pubsubMsg *pubsub.Message) {
+		msg := &trackedMessage{Message: pubsubMsg}
 		request := &query.AggregateRequest{}
 		err := json.Unmarshal(msg.Data, request)
 		if err != nil {
@@ -157,6 +391,48 @@ func (h *QueryHandler) SetupPullRequests(ctx context.Context) error {
 			return
 		}
 
+		acquired, err := h.acquireClientToken(ctx, request)
+		switch {
+		case errors.Is(err, clienttoken.ErrTokenReused), errors.Is(err, clienttoken.ErrQueryIDMismatch):
+			log.Errorf("aborting query %q: %v", request.QueryID, err)
+			msg.Ack()
+			return
+		case errors.Is(err, clienttoken.ErrDone):
+			log.Infof("dropping query %q: %v", request.QueryID, err)
+			msg.Ack()
+			return
+		case err != nil:
+			// Including the queries running on another attempt, which are retried until they are done.
+			log.Error(err)
+			msg.Nack()
+			return
+		}
+		if acquired {
+			defer h.releaseClientToken(ctx, request, msg)
+		}
+
+		if err := h.resolveKeyBitSize(ctx, request); errors.Is(err, dpfaggregator.ErrKeyBitSizeMismatch) {
+			// The batch metadata does not change, so a request disagreeing with it is not retried.
+			log.Errorf("aborting query %q: %v", request.QueryID, err)
+			msg.Ack()
+			return
+		} else if err != nil {
+			// Failing to read the metadata may be transient.
+			log.Error(err)
+			msg.Nack()
+			return
+		}
+		if err := h.resolveDebugBatch(ctx, request); err != nil {
+			log.Error(err)
+			msg.Nack()
+			return
+		}
+		if err := resolvePostFilter(request); err != nil {
+			log.Errorf("aborting query %q: %v", request.QueryID, err)
+			msg.Ack()
+			return
+		}
+
 		jobDone := false
 		if h.PipelineRunner == "dataflow" {
 			// check if dataflow job with queryId-level-origin is already running / finished / failed
@@ -249,11 +525,94 @@ func (h *QueryHandler) SetupPullRequests(ctx context.Context) error {
 			}
 		}
 
+		if !jobDone {
+			if err := h.checkRuntimeConfig(request); err != nil {
+				// The request fails again with the same configuration, so it is not retried.
+				log.Errorf("aborting query %q: %v", request.QueryID, err)
+				h.exportJob(ctx, request, nil, err)
+				msg.Ack()
+				return
+			}
+		}
+
+		if err := h.checkStrictPrivacy(request); err != nil {
+			// The batch metadata does not change, so the request is rejected again if retried.
+			log.Errorf("aborting query %q: %v", request.QueryID, err)
+			h.exportJob(ctx, request, nil, err)
+			msg.Ack()
+			return
+		}
+
+		// The reports are compared with the partner helper before any budget is charged for them.
+		if !jobDone && request.QueryLevel == 0 && request.DecryptedReportQueryID == "" && request.AggregationType == query.ConversionType {
+			if err := h.verifyBatchIntegrity(ctx, request); err != nil && h.abortQuery(err, time.Since(msg.PublishTime)) {
+				log.Errorf("aborting query %q: %v", request.QueryID, err)
+				h.exportJob(ctx, request, nil, err)
+				msg.Ack()
+				return
+			} else if err != nil {
+				log.Error(err)
+				msg.Nack()
+				return
+			}
+		}
+
+		// The charge is looked up again when the job is done, so the next levels run with the downgraded epsilon. A cached
+		// result is only served after the query passes the privacy checks and is charged like a query that runs the pipelines.
+		if err := h.chargeBudget(ctx, request); errors.Is(err, budgetledger.ErrBudgetExceeded) || errors.Is(err, budgetledger.ErrMissingReportTimes) || errors.Is(err, ErrNoiselessQuery) {
+			// The budget does not grow back until the next period, and the batch metadata is not updated for a query, so
+			// the query is aborted instead of retried.
+			log.Errorf("aborting query %q: %v", request.QueryID, err)
+			h.exportJob(ctx, request, nil, err)
+			msg.Ack()
+			return
+		} else if err != nil {
+			log.Error(err)
+			msg.Nack()
+			return
+		}
+
+		if !jobDone && request.QueryLevel == 0 {
+			served, err := h.serveCachedResult(ctx, request)
+			if err != nil && h.abortQuery(err, time.Since(msg.PublishTime)) {
+				log.Errorf("aborting query %q: %v", request.QueryID, err)
+				h.exportJob(ctx, request, nil, err)
+				msg.Ack()
+				return
+			} else if err != nil {
+				// The helpers must agree on the cache decision before any of them runs the pipelines.
+				log.Error(err)
+				msg.Nack()
+				return
+			}
+			if served {
+				msg.Ack()
+				return
+			}
+		}
+
+		// Cached results can still be served in read-only mode, as no pipeline is launched for them.
+		if !jobDone && h.ReadOnly.Enabled() {
+			log.Warningf("read-only mode: not launching level %d of query %q", request.QueryLevel, request.QueryID)
+			h.ReadOnly.WaitDisabled(ctx, h.ReadOnlyRetryDelay)
+			msg.Nack()
+			return
+		}
+
+		// The level is changed when the next-level request of a hierarchical query is published.
+		level := request.QueryLevel
+		if !jobDone && level == 0 {
+			h.Latency.Record(ctx, request.QueryID, latencyslo.StepBatchReady, request.BatchReadyTime)
+			h.Latency.Record(ctx, request.QueryID, latencyslo.StepJobLaunched, time.Time{})
+		}
+
 		// no job with "queryId-level-helperId" name --> schedule --> if jobDone schedule next lvl
 		var aggErr error
 		if request.AggregationType == query.ConversionType {
 			if hierarchicalConfig, err := query.ReadHierarchicalConfigFile(ctx, request.ExpandConfigURI); err == nil {
 				aggErr = h.aggregatePartialReportHierarchical(ctx, request, hierarchicalConfig, jobDone)
+			} else if multiConfig, err := query.ReadMultiHierarchyConfigFile(ctx, request.ExpandConfigURI); err == nil {
+				aggErr = h.aggregatePartialReportMultiHierarchy(ctx, request, multiConfig)
 			} else if directConfig, err := query.ReadDirectConfigFile(ctx, request.ExpandConfigURI); err == nil {
 				if jobDone {
 					log.Infof("query %q complete", request.QueryID)
@@ -275,221 +634,1278 @@ func (h *QueryHandler) SetupPullRequests(ctx context.Context) error {
 			aggErr = fmt.Errorf("expect aggregation type 'reach' or 'conversion', got %q", request.AggregationType)
 		}
 
+		if aggErr != nil && h.abortQuery(aggErr, time.Since(msg.PublishTime)) {
+			log.Errorf("aborting query %q: %v", request.QueryID, aggErr)
+			h.exportJob(ctx, request, nil, aggErr)
+			msg.Ack()
+			return
+		}
 		if aggErr != nil {
 			log.Error(aggErr)
 			msg.Nack()
 			return
 		}
+		h.Latency.Record(ctx, request.QueryID, latencyslo.LevelDoneStep(level), time.Time{})
 		msg.Ack()
 	})
 }
 
-func getFinalPartialResultURI(resultDir, queryID, origin string) string {
-	return utils.JoinPath(resultDir, fmt.Sprintf("%s_%s", queryID, strings.ReplaceAll(origin, ".", "_")))
-}
+// ErrPartnerNotReady is returned when a request needs a result that the partner helper has not finished yet.
+var ErrPartnerNotReady = errors.New("result from the partner helper is not ready")
 
-func (h *QueryHandler) runPipeline(ctx context.Context, binary string, args []string, request *query.AggregateRequest) error {
-	if h.PipelineRunner == "dataflow" {
-		args = append(args,
-			"--project="+h.DataflowCfg.Project,
-			"--region="+h.DataflowCfg.Region,
-			"--temp_location="+h.DataflowCfg.TempLocation,
-			"--staging_location="+h.DataflowCfg.StagingLocation,
-			// set jobname to queryID-level-origin
-			"--job_name="+fmt.Sprintf("%s-%v-%s", request.QueryID, request.QueryLevel, h.Origin),
-			"--worker_binary="+h.ServerCfg.DpfAggregatePartialReportBinary,
-		)
-		// The zone of the worker pool. If not specified, Dataflow will pick one for the job.
-		if h.DataflowCfg.Zone != "" {
-			args = append(args,
-				"--zone="+h.DataflowCfg.Zone,
-			)
-		}
-		// The number of workers used at the beginning of a job. If not sepcified, one worker will be used.
-		if request.NumWorkers > 0 {
-			args = append(args,
-				"--num_workers="+fmt.Sprint(request.NumWorkers),
-			)
-		}
-		// The maximum number of workers allowed to be used during a job. If not specified, the maximum will be 1000 or depending on the quotas.
-		if h.DataflowCfg.MaxNumWorkers > 0 {
-			args = append(args,
-				"--max_num_workers="+strconv.Itoa(h.DataflowCfg.MaxNumWorkers),
-			)
-		}
-		// The worker type. If not specified, the worker type will be 'e2-standard-2'.
-		if h.DataflowCfg.WorkerMachineType != "" {
-			args = append(args,
-				"--worker_machine_type="+h.DataflowCfg.WorkerMachineType,
-			)
-		}
-		// The service account managing workers. If not specified, the Compute Engine default service account will be used.
-		if h.DataflowCfg.ServiceAccountEmail != "" {
-			args = append(args,
-				"--service_account_email="+h.DataflowCfg.ServiceAccountEmail,
-			)
-		}
+// abortQuery returns whether a failed request is aborted instead of retried, given how long it has waited since its
+// message was published.
+func (h *QueryHandler) abortQuery(err error, waited time.Duration) bool {
+	if errors.Is(err, batchintegrity.ErrRootMismatch) {
+		// Retrying does not help when the helpers have different reports.
+		return true
+	}
+	if errors.Is(err, strictprivacy.ErrNotDebugBatch) {
+		// The batch metadata does not change, so the request is rejected again if retried.
+		return true
 	}
+	var failure *failurereport.Error
+	if errors.As(err, &failure) && !failure.Class.Retriable() {
+		// The pipeline fails again with the same request.
+		return true
+	}
+	// After the timeout, the partner is assumed to have failed or aborted the query, which then stops on both helpers.
+	return errors.Is(err, ErrPartnerNotReady) && h.LevelTimeout > 0 && waited > h.LevelTimeout
+}
 
-	str := binary
-	for _, s := range args {
-		str = fmt.Sprintf("%s\n%s", str, s)
+// checkRuntimeConfig returns runtimeconfig.ErrNotAllowed if the current runtime configuration rejects the partner
+// helper or the total epsilon of the request.
+func (h *QueryHandler) checkRuntimeConfig(request *query.AggregateRequest) error {
+	if h.RuntimeConfig == nil {
+		return nil
 	}
-	log.Infof("Running command\n%s", str)
+	var partnerOrigin string
+	if request.PartnerSharedInfo != nil {
+		partnerOrigin = request.PartnerSharedInfo.Origin
+	}
+	return h.RuntimeConfig.Config().CheckQuery(partnerOrigin, request.TotalEpsilon)
+}
 
-	cmd := exec.CommandContext(ctx, binary, args...)
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		log.Errorf("err: %s, stderr: %s", err, stderr.String())
+// BudgetNotice tells the requester that a query runs with less privacy budget than requested.
+type BudgetNotice struct {
+	QueryID          string
+	Origin           string
+	RequestedEpsilon float64
+	Epsilon          float64
+	Time             time.Time
+}
+
+// resolveKeyBitSize sets the key bit size of the first request of a query from the metadata of its batch, so the
+// helper serves clients with different key bit sizes. The later requests of the query carry the resolved value.
+func (h *QueryHandler) resolveKeyBitSize(ctx context.Context, request *query.AggregateRequest) error {
+	if request.BatchMetadataURI == "" || request.QueryLevel > 0 || request.Hierarchy != "" || request.PrefixLength > 0 {
+		return nil
+	}
+	metadata, err := dpfaggregator.ReadBatchMetadata(ctx, request.BatchMetadataURI)
+	if err != nil {
 		return err
 	}
-	log.Infof("output of cmd: %s", out.String())
+	keyBitSize, err := dpfaggregator.ResolveKeyBitSize(request.KeyBitSize, metadata)
+	if err != nil {
+		return err
+	}
+	request.KeyBitSize = keyBitSize
 	return nil
 }
 
-func (h *QueryHandler) aggregatePartialReportHierarchical(ctx context.Context, request *query.AggregateRequest, config *query.HierarchicalConfig, jobDone bool) error {
-	finalLevel := int32(len(config.PrefixLengths)) - 1
-	if request.QueryLevel > finalLevel {
-		return fmt.Errorf("expect request level <= finalLevel %d, got %d", finalLevel, request.QueryLevel)
-	}
-	if !jobDone {
-		partialReportURI := request.PartialReportURI
-		outputDecryptedReportURI := ""
-		if request.QueryLevel > 0 {
-			// If it is not the first-level aggregation, check if the result from the partner helper is ready for the previous level.
-			exist, err := utils.IsGCSObjectExist(ctx, h.GCSClient,
-				query.GetRequestPartialResultURI(request.PartnerSharedInfo.SharedDir, request.QueryID, request.QueryLevel-1),
-			)
+// resolveDebugBatch replaces the debug flag of the request, which the requester sets, with the flag in the metadata of
+// its batch if the metadata is signed by a trusted batcher and its batch root matches the reports of the request. The
+// batch is not a debug batch otherwise, so the signed metadata of a debug batch can not be reused for other reports.
+func (h *QueryHandler) resolveDebugBatch(ctx context.Context, request *query.AggregateRequest) error {
+	debug := false
+	if (request.DebugBatch || request.DebugNoiseSeed != 0) && request.BatchMetadataURI != "" && len(h.BatchSigningKeys) > 0 {
+		metadata, err := dpfaggregator.ReadBatchMetadata(ctx, request.BatchMetadataURI)
+		if err != nil {
+			return err
+		}
+		if err := dpfaggregator.VerifyBatchMetadata(metadata, h.BatchSigningKeys); err != nil {
+			log.Warningf("query %q: %v", request.QueryID, err)
+		} else if metadata.DebugBatch {
+			digest, err := batchintegrity.DigestReports(ctx, reportGlobs(request)...)
 			if err != nil {
 				return err
 			}
-			if !exist {
-				// When the partial result from the partner helper is not ready, nack the message with an error.
-				return fmt.Errorf("result from %s for level %d of query %s is not ready", request.PartnerSharedInfo.Origin, request.QueryLevel-1, request.QueryID)
+			if root := digest.Root(); metadata.BatchRoot != root {
+				log.Warningf("query %q: signed batch metadata with root %q does not match the reports with root %q", request.QueryID, metadata.BatchRoot, root)
+			} else {
+				debug = true
 			}
-
-			// If it is not the first-level aggregation, the pipeline should read the decrypted reports instead of the original encrypted ones.
-			partialReportURI = query.GetRequestDecryptedReportURI(h.ServerCfg.WorkspaceURI, request.QueryID)
-		} else {
-			outputDecryptedReportURI = query.GetRequestDecryptedReportURI(h.ServerCfg.WorkspaceURI, request.QueryID)
-		}
-
-		expandParamsURI, err := query.GetRequestExpandParamsURI(ctx, config, request,
-			h.ServerCfg.WorkspaceURI,
-			h.SharedDir,
-			request.PartnerSharedInfo.SharedDir,
-		)
-		if err != nil {
-			return err
-		}
-
-		var outputResultURI string
-		// The final-level results are not supposed to be shared with the partner helpers.
-		if request.QueryLevel == finalLevel {
-			outputResultURI = getFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)
-		} else {
-			outputResultURI = query.GetRequestPartialResultURI(h.SharedDir, request.QueryID, request.QueryLevel)
-		}
-
-		args := []string{
-			"--partial_report_uri=" + partialReportURI,
-			"--expand_parameters_uri=" + expandParamsURI,
-			"--partial_histogram_uri=" + outputResultURI,
-			"--decrypted_report_uri=" + outputDecryptedReportURI,
-			"--epsilon=" + fmt.Sprintf("%f", request.TotalEpsilon*config.PrivacyBudgetPerPrefix[request.QueryLevel]),
-			"--private_key_params_uri=" + h.ServerCfg.PrivateKeyParamsURI,
-			"--key_bit_size=" + fmt.Sprint(request.KeyBitSize),
-			"--runner=" + h.PipelineRunner,
-		}
-
-		if err := h.runPipeline(ctx, h.ServerCfg.DpfAggregatePartialReportBinary, args, request); err != nil {
-			return err
 		}
 	}
-
-	if request.QueryLevel == finalLevel {
-		log.Infof("query %q complete", request.QueryID)
-		return nil
+	if request.DebugBatch && !debug {
+		log.Warningf("query %q is flagged as a debug batch, which is not confirmed by signed batch metadata", request.QueryID)
 	}
+	request.DebugBatch = debug
+	return nil
+}
 
-	// If the hierarchical query is not finished yet, publish the requests for the next-level aggregation.
-	request.QueryLevel++
-	_, topic, err := utils.ParsePubSubResourceName(h.RequestPubSubTopic)
+// resolvePostFilter checks the post filter of the request, and formats it in the canonical form, so the manifests of
+// both helpers record the same filter.
+func resolvePostFilter(request *query.AggregateRequest) error {
+	filter, err := dpfaggregator.ParsePostFilter(request.PostFilter)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid post filter: %w", err)
 	}
-	return utils.PublishRequest(ctx, h.PubSubTopicClient, topic, request)
+	if filter != nil {
+		request.PostFilter = filter.String()
+	}
+	return nil
 }
 
-func (h *QueryHandler) aggregatePartialReportReach(ctx context.Context, request *query.AggregateRequest) error {
-	outputResultURI := getFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)
-	outputValidityURI := utils.JoinPath(request.ResultDir, fmt.Sprintf("%s_%s_validity", request.QueryID, strings.ReplaceAll(h.Origin, ".", "_")))
-	args := []string{
-		"--partial_report_uri=" + request.PartialReportURI,
-		"--partial_histogram_uri=" + outputResultURI,
-		"--partial_validity_uri=" + outputValidityURI,
-		"--private_key_params_uri=" + h.ServerCfg.PrivateKeyParamsURI,
-		"--key_bit_size=" + fmt.Sprint(request.KeyBitSize),
-		"--runner=" + h.PipelineRunner,
+// checkStrictPrivacy rejects a query that would release results without proper noise in strict privacy mode, before
+// any budget is charged for it. The levels of the query are checked again before their pipelines run. Without strict
+// mode, the noise seed of a request is dropped unless the batch is a debug batch.
+func (h *QueryHandler) checkStrictPrivacy(request *query.AggregateRequest) error {
+	if err := strictprivacy.Check(h.StrictPrivacy, &strictprivacy.Params{
+		Epsilon:   request.TotalEpsilon,
+		NoiseSeed: request.DebugNoiseSeed,
+		Noiseless: request.AggregationType == query.ReachType,
+		Debug:     request.DebugBatch,
+	}); err != nil {
+		return fmt.Errorf("query %q rejected: %w", request.QueryID, err)
 	}
-
-	if err := h.runPipeline(ctx, h.ServerCfg.DpfAggregateReachPartialReportBinary, args, request); err != nil {
-		return err
+	if request.DebugNoiseSeed != 0 && !request.DebugBatch {
+		log.Warningf("query %q: ignoring the noise seed, which is only honored for debug batches", request.QueryID)
+		request.DebugNoiseSeed = 0
 	}
-
-	log.Infof("query %q complete", request.QueryID)
 	return nil
 }
 
-func (h *QueryHandler) aggregatePartialReportDirect(ctx context.Context, request *query.AggregateRequest, config *query.DirectConfig) error {
-	expandParamsURI := utils.JoinPath(h.ServerCfg.WorkspaceURI, fmt.Sprintf("%s_%s", request.QueryID, query.DefaultExpandParamsFile))
-	if err := dpfaggregator.SaveExpandParameters(ctx, &dpfaggregator.ExpandParameters{
-		Level:           request.KeyBitSize - 1,
-		Prefixes:        config.BucketIDs,
-		DirectExpansion: true,
-		PreviousLevel:   -1,
-	}, expandParamsURI); err != nil {
-		return err
+// noiseSeed derives the seed of the noise for the request level from the seed in the request and the secret key of the
+// helper. The seeds differ between the helpers and levels, and can not be derived by the requester, so the noise can
+// not be removed from the results. The production and the shadow pipelines of a level still add the same noise.
+func (h *QueryHandler) noiseSeed(request *query.AggregateRequest) uint64 {
+	if request.DebugNoiseSeed == 0 || !request.DebugBatch || len(h.NoiseSeedKey) == 0 {
+		return 0
 	}
+	mac := hmac.New(sha256.New, h.NoiseSeedKey)
+	fmt.Fprintf(mac, "%s\x00%s\x00%d\x00%d", h.Origin, request.QueryID, request.QueryLevel, request.DebugNoiseSeed)
+	if seed := binary.BigEndian.Uint64(mac.Sum(nil)); seed != 0 {
+		return seed
+	}
+	// Zero means the noise is not seeded.
+	return 1
+}
 
-	outputResultURI := getFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)
-	args := []string{
-		"--partial_report_uri=" + request.PartialReportURI,
+// trackedMessage records whether a request message was acked, which means the request is done or aborted, and is not
+// retried.
+type trackedMessage struct {
+	*pubsub.Message
+	acked bool
+}
+
+// Ack acknowledges the message.
+func (m *trackedMessage) Ack() {
+	m.acked = true
+	m.Message.Ack()
+}
+
+// acquireClientToken marks the query of the client token of the request as running, and returns whether it did, in
+// which case the token is released when the request is handled. Requests for queries already running or done with the
+// same token are rejected before any pipeline is launched.
+func (h *QueryHandler) acquireClientToken(ctx context.Context, request *query.AggregateRequest) (bool, error) {
+	// Only the first request of a query comes from the client.
+	if h.ClientTokens == nil || request.ClientToken == "" || request.QueryLevel > 0 || request.Hierarchy != "" || request.PrefixLength > 0 {
+		return false, nil
+	}
+	fingerprint, err := clienttoken.Fingerprint(request)
+	if err != nil {
+		return false, err
+	}
+	if err := h.ClientTokens.Acquire(ctx, request.ClientToken, request.QueryID, fingerprint, time.Now()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// releaseClientToken marks the query of the client token as done if the request message was acked, or as pending
+// otherwise, so the redelivered message runs it again.
+func (h *QueryHandler) releaseClientToken(ctx context.Context, request *query.AggregateRequest, msg *trackedMessage) {
+	if err := h.ClientTokens.Release(ctx, request.ClientToken, msg.acked); err != nil {
+		log.Errorf("failed to release the client token of query %q: %v", request.QueryID, err)
+	}
+}
+
+// ErrNoiselessQuery is returned in strict privacy mode when a query without noise is submitted for a batch that is not
+// a debug batch.
+var ErrNoiselessQuery = errors.New("queries without noise are only allowed for debug batches")
+
+// chargeBudget charges a query on the budget ledger, unless the helper has recorded a charge for it in its workspace,
+// which happens for the later levels of the query and the queries split from it. When the requester consents to a
+// partial epsilon, a query exceeding the remaining budget is downgraded to it, and a BudgetNotice is written to the
+// result directory.
+func (h *QueryHandler) chargeBudget(ctx context.Context, request *query.AggregateRequest) error {
+	if h.BudgetLedger == nil {
+		return nil
+	}
+	chargeURI := query.GetRequestChargeURI(h.ServerCfg.WorkspaceURI, request.QueryID)
+	exist, err := utils.IsFileGlobExist(ctx, chargeURI)
+	if err != nil {
+		return err
+	}
+	var charge *budgetledger.Charge
+	if exist {
+		if charge, err = readCharge(ctx, chargeURI); err != nil {
+			return err
+		}
+	} else {
+		if charge, err = h.newCharge(ctx, request); err != nil || charge == nil {
+			return err
+		}
+		if err := writeCharge(ctx, charge, chargeURI); err != nil {
+			return err
+		}
+	}
+	if !charge.Downgraded() {
+		return nil
+	}
+	request.TotalEpsilon, request.RequestedEpsilon = charge.Epsilon, charge.RequestedEpsilon
+	log.Warningf("query %q runs with epsilon %v instead of the requested %v, which exceeds the remaining budget", request.QueryID, charge.Epsilon, charge.RequestedEpsilon)
+
+	b, err := json.Marshal(&BudgetNotice{
+		QueryID:          request.QueryID,
+		Origin:           h.Origin,
+		RequestedEpsilon: charge.RequestedEpsilon,
+		Epsilon:          charge.Epsilon,
+		Time:             charge.Time,
+	})
+	if err != nil {
+		return err
+	}
+	return utils.WriteBytes(ctx, b, GetBudgetNoticeURI(request.ResultDir, request.QueryID, h.Origin), nil)
+}
+
+// newCharge charges the query on the budget ledger. Queries without noise, e.g. the reach queries, are not charged, in
+// which case no charge is returned. In strict privacy mode, they are only allowed for debug batches.
+func (h *QueryHandler) newCharge(ctx context.Context, request *query.AggregateRequest) (*budgetledger.Charge, error) {
+	if request.TotalEpsilon <= 0 {
+		if h.StrictPrivacy && !request.DebugBatch {
+			return nil, fmt.Errorf("query %q with epsilon %v: %w", request.QueryID, request.TotalEpsilon, ErrNoiselessQuery)
+		}
+		return nil, nil
+	}
+	if h.BudgetLedger.Window > 0 {
+		windows, err := h.readReportWindows(ctx, request.ReportURIs())
+		if err != nil {
+			return nil, err
+		}
+		return h.BudgetLedger.ChargeWindows(ctx, request.QueryID, request.TotalEpsilon, windows, request.AcceptPartialEpsilon, time.Now())
+	}
+	batchHash, err := h.batchHasher.Hash(ctx, request.ReportURIs()...)
+	if err != nil {
+		return nil, err
+	}
+	return h.BudgetLedger.Charge(ctx, batchHash, request.QueryID, request.TotalEpsilon, request.AcceptPartialEpsilon, time.Now())
+}
+
+// recordSplitCharge records that a query split from a charged query runs within the budget of the charged query.
+func (h *QueryHandler) recordSplitCharge(ctx context.Context, request, split *query.AggregateRequest) error {
+	if h.BudgetLedger == nil {
+		return nil
+	}
+	charge := &budgetledger.Charge{QueryID: request.QueryID, Epsilon: split.TotalEpsilon, Time: time.Now().UTC()}
+	return writeCharge(ctx, charge, query.GetRequestChargeURI(h.ServerCfg.WorkspaceURI, split.QueryID))
+}
+
+func readCharge(ctx context.Context, uri string) (*budgetledger.Charge, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	charge := &budgetledger.Charge{}
+	if err := json.Unmarshal(b, charge); err != nil {
+		return nil, err
+	}
+	return charge, nil
+}
+
+func writeCharge(ctx context.Context, charge *budgetledger.Charge, uri string) error {
+	b, err := json.Marshal(charge)
+	if err != nil {
+		return err
+	}
+	return utils.WriteBytes(ctx, b, uri, nil)
+}
+
+// readReportWindows reads the reporting origins and the windows of the scheduled times of the reports. Both are in the
+// shared info of the reports, which is bound to their encryption, so they can not be changed without failing the
+// decryption.
+func (h *QueryHandler) readReportWindows(ctx context.Context, reportURIs []string) ([]budgetledger.WindowKey, error) {
+	keys := make(map[budgetledger.WindowKey]bool)
+	for _, uri := range reportURIs {
+		if err := batchintegrity.ScanSharedInfo(ctx, pipelineutils.AddStrInPath(uri, "*"), func(sharedInfo string) error {
+			info := &reporttypes.SharedInfo{}
+			if err := json.Unmarshal([]byte(sharedInfo), info); err != nil {
+				return fmt.Errorf("%w: invalid shared info: %v", budgetledger.ErrMissingReportTimes, err)
+			}
+			seconds, err := strconv.ParseInt(info.ScheduledReportTime, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%w: report %q: %v", budgetledger.ErrMissingReportTimes, info.ReportID, err)
+			}
+			keys[budgetledger.WindowKey{Origin: info.ReportingOrigin, Start: h.BudgetLedger.WindowStart(time.Unix(seconds, 0))}] = true
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	var windows []budgetledger.WindowKey
+	for key := range keys {
+		windows = append(windows, key)
+	}
+	return windows, nil
+}
+
+// cacheDecision is the decision of a helper whether to serve a query from its result cache, which is shared with the
+// partner helper. QueryID is the ID of the earlier query whose result is cached, so the helpers only serve the results
+// of the same run, which have matching final prefixes and noise.
+type cacheDecision struct {
+	Hit     bool
+	QueryID string
+}
+
+// decideCache looks up the result cache for the request, and shares the decision in the shared directory. The decision
+// is kept for the retries of the request, so the partner helper never reads two different decisions. Failures of the
+// lookup are decided as a miss, as the cache is optional.
+func (h *QueryHandler) decideCache(ctx context.Context, request *query.AggregateRequest) (*cacheDecision, *resultcache.Entry, error) {
+	decisionURI := query.GetRequestCacheDecisionURI(h.SharedDir, request.QueryID)
+	decided, err := utils.IsFileGlobExist(ctx, decisionURI)
+	if err != nil {
+		return nil, nil, err
+	}
+	decision := &cacheDecision{}
+	if decided {
+		if decision, err = readCacheDecision(ctx, decisionURI); err != nil || !decision.Hit {
+			return decision, nil, err
+		}
+	}
+
+	var entry *resultcache.Entry
+	key, err := resultcache.GetKey(ctx, &h.batchHasher, request)
+	if err == nil {
+		entry, err = h.ResultCache.Lookup(ctx, key)
+	}
+	if err != nil {
+		log.Errorf("failed to look up result cache for query %q: %v", request.QueryID, err)
+	}
+	if decided {
+		if entry == nil || entry.QueryID != decision.QueryID {
+			// The partner may have served the cached result already, so the query can not run the pipelines instead.
+			return nil, nil, fmt.Errorf("cached result of query %q from query %q decided as a hit is not found", request.QueryID, decision.QueryID)
+		}
+		return decision, entry, nil
+	}
+
+	if entry != nil {
+		decision.Hit, decision.QueryID = true, entry.QueryID
+	}
+	b, err := json.Marshal(decision)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := utils.WriteBytes(ctx, b, decisionURI, nil); err != nil {
+		return nil, nil, err
+	}
+	return decision, entry, nil
+}
+
+func readCacheDecision(ctx context.Context, uri string) (*cacheDecision, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	decision := &cacheDecision{}
+	if err := json.Unmarshal(b, decision); err != nil {
+		return nil, err
+	}
+	return decision, nil
+}
+
+// serveCachedResult copies the cached final result to the result directory of the request if the query has been
+// completed before on both helpers, and both helpers cached the result of the same earlier query. Each helper shares its
+// decision before reading the one of the partner, so the helpers either both serve their cached results or both run the
+// pipelines. ErrPartnerNotReady is returned if the
+// decision of the partner is not ready, so the request is retried.
+func (h *QueryHandler) serveCachedResult(ctx context.Context, request *query.AggregateRequest) (bool, error) {
+	if h.ResultCache == nil || request.AggregationType != query.ConversionType {
+		return false, nil
+	}
+	if request.PartnerSharedInfo != nil && !request.PartnerSharedInfo.CacheDecisions {
+		return false, nil
+	}
+	decision, entry, err := h.decideCache(ctx, request)
+	if err != nil || !decision.Hit {
+		return false, err
+	}
+	if request.PartnerSharedInfo != nil {
+		partnerURI := query.GetRequestCacheDecisionURI(request.PartnerSharedInfo.SharedDir, request.QueryID)
+		exist, err := utils.IsFileGlobExist(ctx, partnerURI)
+		if err != nil {
+			return false, err
+		}
+		if !exist {
+			return false, fmt.Errorf("%w: cache decision from %s for query %s", ErrPartnerNotReady, request.PartnerSharedInfo.Origin, request.QueryID)
+		}
+		partner, err := readCacheDecision(ctx, partnerURI)
+		if err != nil {
+			return false, err
+		}
+		if !partner.Hit || partner.QueryID != entry.QueryID {
+			log.Infof("query %q: not serving the cached result of query %q, which %s does not have", request.QueryID, entry.QueryID, request.PartnerSharedInfo.Origin)
+			return false, nil
+		}
+	}
+	if err := resultcache.CopyResult(ctx, entry, GetFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)); err != nil {
+		return false, err
+	}
+	log.Infof("query %q complete with the cached result of query %q", request.QueryID, entry.QueryID)
+	h.writeResultManifest(ctx, request)
+	h.exportJob(ctx, request, nil, nil)
+	return true, nil
+}
+
+// cacheResult saves the final result of a completed query in the result cache. Failures are only logged.
+func (h *QueryHandler) cacheResult(ctx context.Context, request *query.AggregateRequest) {
+	if h.ResultCache == nil {
+		return
+	}
+	key, err := resultcache.GetKey(ctx, &h.batchHasher, request)
+	if err != nil {
+		log.Errorf("failed to get result cache key for query %q: %v", request.QueryID, err)
+		return
+	}
+	if _, err := h.ResultCache.Store(ctx, key, request.QueryID, GetFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)); err != nil {
+		log.Errorf("failed to cache result for query %q: %v", request.QueryID, err)
+	}
+}
+
+// GetFinalPartialResultURI returns the URI of the final partial result of a helper, which is written to the result
+// directory of the query.
+func GetFinalPartialResultURI(resultDir, queryID, origin string) string {
+	return utils.JoinPath(resultDir, fmt.Sprintf("%s_%s", queryID, strings.ReplaceAll(origin, ".", "_")))
+}
+
+// GetResultManifestURI returns the URI of the manifest for the final result files of a helper.
+func GetResultManifestURI(resultDir, queryID, origin string) string {
+	return GetFinalPartialResultURI(resultDir, queryID, origin) + "_MANIFEST.json"
+}
+
+// GetBudgetNoticeURI returns the URI of the notice for a query run with less privacy budget than requested.
+func GetBudgetNoticeURI(resultDir, queryID, origin string) string {
+	return GetFinalPartialResultURI(resultDir, queryID, origin) + "_BUDGET_NOTICE.json"
+}
+
+// GetDataQualitySummaryURI returns the URI of the data quality summary of the reports of a query.
+func GetDataQualitySummaryURI(resultDir, queryID, origin string) string {
+	return GetFinalPartialResultURI(resultDir, queryID, origin) + "_DATA_QUALITY.json"
+}
+
+// writeResultManifest writes the signed manifest of the final result files next to them. Failures are only logged, as
+// the results are complete without the manifest.
+func (h *QueryHandler) writeResultManifest(ctx context.Context, request *query.AggregateRequest) {
+	if !h.WriteResultManifest {
+		return
+	}
+	resultURI := GetFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)
+	files, err := resultmanifest.HashFiles(ctx, resultURI)
+	if err != nil {
+		log.Errorf("failed to hash result files of query %q: %v", request.QueryID, err)
+		return
+	}
+	signed, err := resultmanifest.Sign(&resultmanifest.Manifest{
+		QueryID:          request.QueryID,
+		Origin:           h.Origin,
+		ResultURI:        resultURI,
+		TotalEpsilon:     request.TotalEpsilon,
+		KeyBitSize:       request.KeyBitSize,
+		Files:            files,
+		PostFilter:       request.PostFilter,
+		RequestedEpsilon: request.RequestedEpsilon,
+	}, h.ResultSigningKey)
+	if err != nil {
+		log.Errorf("failed to sign result manifest of query %q: %v", request.QueryID, err)
+		return
+	}
+	if err := resultmanifest.Write(ctx, signed, GetResultManifestURI(request.ResultDir, request.QueryID, h.Origin)); err != nil {
+		log.Errorf("failed to write result manifest of query %q: %v", request.QueryID, err)
+	}
+}
+
+// exportLevel reads the counters of a level from its expansion statistics. The counters are left zero if the statistics
+// cannot be read.
+func exportLevel(ctx context.Context, level int32, epsilon float64, statsURI string) jobexport.Level {
+	exported := jobexport.Level{Level: int64(level), Epsilon: epsilon}
+	statistics, err := dpfaggregator.ReadExpansionStatistics(ctx, statsURI)
+	if err != nil {
+		log.Warningf("failed to read expansion statistics for level %d in %s: %v", level, statsURI, err)
+		return exported
+	}
+	exported.ReportCount = int64(statistics.ReportCount)
+	exported.PrefixCount = int64(statistics.PrefixCount)
+	exported.VectorLength = int64(statistics.VectorLength)
+	exported.NonzeroBucketCount = int64(statistics.NonzeroBucketCount)
+	exported.ExpandTimeMillis = statistics.ExpandTimeMs
+	exported.CombineTimeMillis = statistics.CombineTimeMs
+	return exported
+}
+
+// hierarchicalExportLevels returns the epsilon and the counters of each level of a hierarchical query.
+func (h *QueryHandler) hierarchicalExportLevels(ctx context.Context, request *query.AggregateRequest, config *query.HierarchicalConfig) []jobexport.Level {
+	finalLevel := int32(len(config.PrefixLengths)) - 1
+	var levels []jobexport.Level
+	for level := int32(0); level <= finalLevel; level++ {
+		resultURI := query.GetRequestPartialResultURI(h.SharedDir, request.QueryID, level)
+		if level == finalLevel {
+			resultURI = GetFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)
+		}
+		epsilon := request.TotalEpsilon * config.PrivacyBudgetPerPrefix[level]
+		levels = append(levels, exportLevel(ctx, level, epsilon, query.GetExpansionStatsURI(resultURI)))
+	}
+	return levels
+}
+
+// exportJob exports the record of a finished query, which is aborted if err is not nil. Failures are only logged, as
+// the export is only for analytics.
+func (h *QueryHandler) exportJob(ctx context.Context, request *query.AggregateRequest, levels []jobexport.Level, err error) {
+	if h.JobExport == nil {
+		return
+	}
+	row := &jobexport.Row{
+		QueryID:          request.QueryID,
+		Origin:           h.Origin,
+		AggregationType:  request.AggregationType,
+		Status:           jobexport.StatusComplete,
+		TotalEpsilon:     request.TotalEpsilon,
+		RequestedEpsilon: request.RequestedEpsilon,
+		KeyBitSize:       int64(request.KeyBitSize),
+		DebugBatch:       request.DebugBatch,
+		Levels:           levels,
+	}
+	if err != nil {
+		row.Status = jobexport.StatusAborted
+		row.Error = err.Error()
+		var failure *failurereport.Error
+		if errors.As(err, &failure) {
+			row.ErrorClass = string(failure.Class)
+		}
+	} else {
+		row.ResultURI = GetFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)
+		if h.WriteResultManifest {
+			if signed, readErr := resultmanifest.Read(ctx, GetResultManifestURI(request.ResultDir, request.QueryID, h.Origin)); readErr != nil {
+				log.Warningf("failed to read result manifest of query %q for export: %v", request.QueryID, readErr)
+			} else {
+				for name, hash := range signed.Manifest.Files {
+					row.ResultFiles = append(row.ResultFiles, jobexport.ResultFile{Name: name, SHA256: hash})
+				}
+				sort.Slice(row.ResultFiles, func(i, j int) bool { return row.ResultFiles[i].Name < row.ResultFiles[j].Name })
+				row.ManifestSigned = signed.Signature != ""
+			}
+		}
+	}
+	if h.Latency != nil {
+		for step, ts := range h.Latency.Query(ctx, request.QueryID).Steps {
+			row.Steps = append(row.Steps, jobexport.Step{Step: step, Time: ts})
+		}
+		sort.Slice(row.Steps, func(i, j int) bool {
+			if !row.Steps[i].Time.Equal(row.Steps[j].Time) {
+				return row.Steps[i].Time.Before(row.Steps[j].Time)
+			}
+			return row.Steps[i].Step < row.Steps[j].Step
+		})
+	}
+	if err := h.JobExport.Export(ctx, row); err != nil {
+		log.Errorf("failed to export query %q: %v", request.QueryID, err)
+	}
+}
+
+func (h *QueryHandler) runPipeline(ctx context.Context, binary string, args []string, request *query.AggregateRequest) error {
+	// set jobname to queryID-level-origin
+	jobName := fmt.Sprintf("%s-%v-%s", request.QueryID, request.QueryLevel, h.Origin)
+	reportURI := utils.JoinPath(h.ServerCfg.WorkspaceURI, jobName+"_failure.json")
+	args = append(args, "--failure_report_uri="+reportURI)
+	if err := h.runPipelineWithWorker(ctx, binary, h.ServerCfg.DpfAggregatePartialReportBinary, jobName, args, request); err != nil {
+		return classifyPipelineError(ctx, err, reportURI)
+	}
+	// An injected timeout keeps the outputs of the pipeline, as the job may finish after the helper gave up on it.
+	return h.Chaos.Fail(chaos.PipelineTimeout)
+}
+
+// classifyPipelineError classifies the failure of a pipeline binary by its exit code, with the stage and the offending
+// URI from the failure report if the binary wrote one.
+func classifyPipelineError(ctx context.Context, err error, reportURI string) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	class := failurereport.ClassFromExitCode(exitErr.ExitCode())
+	// A report left by an earlier attempt is ignored if it does not match the exit code.
+	if report, readErr := failurereport.Read(ctx, reportURI); readErr == nil && report.ExitCode == exitErr.ExitCode() {
+		return failurereport.WrapURI(report.Class, report.Stage, report.URI, errors.New(report.Error))
+	}
+	// Without a report, the exit code may come from something else than the binary, e.g. a wrapper script, so the query
+	// is not aborted on it.
+	if !class.Retriable() {
+		class = failurereport.ClassUnknown
+	}
+	return failurereport.Wrap(class, "", err)
+}
+
+func (h *QueryHandler) runPipelineWithWorker(ctx context.Context, binary, workerBinary, jobName string, args []string, request *query.AggregateRequest) error {
+	if h.PipelineRunner == "dataflow" {
+		args = append(args,
+			"--project="+h.DataflowCfg.Project,
+			"--region="+h.DataflowCfg.Region,
+			"--temp_location="+h.DataflowCfg.TempLocation,
+			"--staging_location="+h.DataflowCfg.StagingLocation,
+			"--job_name="+jobName,
+			"--worker_binary="+workerBinary,
+		)
+		// The zone of the worker pool. If not specified, Dataflow will pick one for the job.
+		if h.DataflowCfg.Zone != "" {
+			args = append(args,
+				"--zone="+h.DataflowCfg.Zone,
+			)
+		}
+		// The number of workers used at the beginning of a job. If not sepcified, one worker will be used.
+		if request.NumWorkers > 0 {
+			args = append(args,
+				"--num_workers="+fmt.Sprint(request.NumWorkers),
+			)
+		}
+		// The maximum number of workers allowed to be used during a job. If not specified, the maximum will be 1000 or depending on the quotas.
+		if h.DataflowCfg.MaxNumWorkers > 0 {
+			args = append(args,
+				"--max_num_workers="+strconv.Itoa(h.DataflowCfg.MaxNumWorkers),
+			)
+		}
+		// The worker type. If not specified, the worker type will be 'e2-standard-2'.
+		if h.DataflowCfg.WorkerMachineType != "" {
+			args = append(args,
+				"--worker_machine_type="+h.DataflowCfg.WorkerMachineType,
+			)
+		}
+		// The service account managing workers. If not specified, the Compute Engine default service account will be used.
+		if h.DataflowCfg.ServiceAccountEmail != "" {
+			args = append(args,
+				"--service_account_email="+h.DataflowCfg.ServiceAccountEmail,
+			)
+		}
+	}
+
+	str := binary
+	for _, s := range args {
+		str = fmt.Sprintf("%s\n%s", str, s)
+	}
+	log.Infof("Running command\n%s", str)
+
+	cmd := exec.CommandContext(ctx, binary, args...)
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		log.Errorf("err: %s, stderr: %s", err, stderr.String())
+		return err
+	}
+	log.Infof("output of cmd: %s", out.String())
+	return nil
+}
+
+// strictPrivacyArgs checks the aggregation in strict privacy mode, and returns the arguments that enable the same check
+// in the pipeline binary.
+func (h *QueryHandler) strictPrivacyArgs(request *query.AggregateRequest, params *strictprivacy.Params) ([]string, error) {
+	if !h.StrictPrivacy {
+		return nil, nil
+	}
+	params.Debug = request.DebugBatch
+	if err := strictprivacy.Check(h.StrictPrivacy, params); err != nil {
+		return nil, fmt.Errorf("query %q rejected: %w", request.QueryID, err)
+	}
+	return []string{"--strict_privacy", "--debug_batch=" + strconv.FormatBool(request.DebugBatch)}, nil
+}
+
+// consistencyCheckEnabled returns whether the secret shares of the sampled reports are checked. The check reveals the
+// values of the sampled reports to the helper running it, so it only runs on debug batches verified from signed batch
+// metadata whose batch root matches the reports, see resolveDebugBatch. The signed metadata of a debug batch can not
+// enable the check on other reports. The partner helper resolves the flag with its own trusted batchers, and only shares
+// its sums if it also confirms the debug batch.
+func (h *QueryHandler) consistencyCheckEnabled(request *query.AggregateRequest) bool {
+	return request.DebugBatch && h.ServerCfg.ConsistencyCheckRate > 0 && request.PartnerSharedInfo != nil
+}
+
+// runsConsistencyCheck returns whether the helper recombines the shares of the sampled reports. Only the helper with
+// the smaller origin runs the check, and it keeps its own shares and the recombined values in its private workspace.
+func (h *QueryHandler) runsConsistencyCheck(request *query.AggregateRequest) bool {
+	return h.Origin < request.PartnerSharedInfo.Origin
+}
+
+// consistencyCheckArgs returns the arguments for the pipeline binary to write the share sums of the sampled reports.
+func (h *QueryHandler) consistencyCheckArgs(request *query.AggregateRequest) []string {
+	if !h.consistencyCheckEnabled(request) {
+		return nil
+	}
+	shareDir := h.SharedDir
+	if h.runsConsistencyCheck(request) {
+		shareDir = h.ServerCfg.WorkspaceURI
+	}
+	return []string{
+		"--consistency_share_uri=" + query.GetRequestConsistencyShareURI(shareDir, request.QueryID),
+		"--consistency_sample_rate=" + fmt.Sprint(h.ServerCfg.ConsistencyCheckRate),
+		"--consistency_seed=" + fmt.Sprint(consistencycheck.QuerySeed(request.QueryID)),
+		"--debug_batch=true",
+	}
+}
+
+// traceArgs returns the arguments for the pipeline binary to trace a sample of the reports. The encrypted reports are
+// sampled separately when the pipeline reads the decrypted ones.
+func (h *QueryHandler) traceArgs(request *query.AggregateRequest, ownDecryption bool) []string {
+	if h.ServerCfg.TraceSampleRate <= 0 {
+		return nil
+	}
+	args := []string{
+		"--trace_uri=" + query.GetRequestTraceURI(h.ServerCfg.WorkspaceURI, request.QueryID, request.QueryLevel),
+		"--trace_sample_rate=" + fmt.Sprint(h.ServerCfg.TraceSampleRate),
+		"--trace_seed=" + fmt.Sprint(consistencycheck.QuerySeed(request.QueryID)),
+	}
+	if !ownDecryption {
+		args = append(args, "--trace_report_uri="+request.PartialReportURI)
+	}
+	return args
+}
+
+// checkConsistency combines the share sums from both helpers and reports the sampled reports with invalid values. It
+// runs after the first level on the helper running the check, or after the second level of a hierarchical query if
+// the shares of the partner were not ready before. The result is written to the private workspace. Failures are only
+// logged, as the check is for debugging the clients.
+func (h *QueryHandler) checkConsistency(ctx context.Context, request *query.AggregateRequest) {
+	if !h.consistencyCheckEnabled(request) || !h.runsConsistencyCheck(request) {
+		return
+	}
+	resultURI := query.GetRequestConsistencyResultURI(h.ServerCfg.WorkspaceURI, request.QueryID)
+	if done, err := utils.IsFileGlobExist(ctx, resultURI); err != nil || done {
+		return
+	}
+	partnerURI := query.GetRequestConsistencyShareURI(request.PartnerSharedInfo.SharedDir, request.QueryID)
+	exist, err := utils.IsFileGlobExist(ctx, partnerURI)
+	if err != nil {
+		log.Errorf("failed to find consistency shares of query %q from %s: %v", request.QueryID, request.PartnerSharedInfo.Origin, err)
+		return
+	}
+	if !exist {
+		log.Infof("consistency shares of query %q from %s are not ready", request.QueryID, request.PartnerSharedInfo.Origin)
+		return
+	}
+	own, err := consistencycheck.ReadShares(ctx, query.GetRequestConsistencyShareURI(h.ServerCfg.WorkspaceURI, request.QueryID))
+	if err != nil {
+		log.Errorf("failed to read consistency shares of query %q: %v", request.QueryID, err)
+		return
+	}
+	partner, err := consistencycheck.ReadShares(ctx, partnerURI)
+	if err != nil {
+		log.Errorf("failed to read consistency shares of query %q from %s: %v", request.QueryID, request.PartnerSharedInfo.Origin, err)
+		return
+	}
+	result := consistencycheck.Check(own, partner, h.ServerCfg.ConsistencyCheckMaxValue)
+	if b, err := json.Marshal(result); err != nil {
+		log.Errorf("failed to encode consistency check result of query %q: %v", request.QueryID, err)
+	} else if err := utils.WriteBytes(ctx, b, resultURI, nil); err != nil {
+		log.Errorf("failed to write consistency check result of query %q: %v", request.QueryID, err)
+	}
+	if result.OK() {
+		log.Infof("consistency check passed for %d sampled reports of query %q", result.Checked, request.QueryID)
+		return
+	}
+	log.Warningf("consistency check failed for query %q: %d of %d sampled reports out of range %v, %d reports sampled by one helper only %v",
+		request.QueryID, len(result.OutOfRange), result.Checked, result.OutOfRange, len(result.Missing), result.Missing)
+}
+
+func (h *QueryHandler) shadowEnabled(request *query.AggregateRequest) bool {
+	return h.noiseSeed(request) != 0 && h.ServerCfg.ShadowDpfAggregatePartialReportBinary != "" && h.ServerCfg.ShadowDir != ""
+}
+
+// runDpfPipeline runs the production DPF aggregation pipeline. For debug batches with a noise seed, the noise is seeded,
+// and the shadow binary is run with the same arguments afterwards.
+func (h *QueryHandler) runDpfPipeline(ctx context.Context, args []string, outputResultURI string, request *query.AggregateRequest) error {
+	if seed := h.noiseSeed(request); seed != 0 {
+		args = append(args, "--noise_seed="+fmt.Sprint(seed))
+	}
+	if h.ServerCfg.MmapLocalReports && h.PipelineRunner == "direct" {
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "--partial_report_uri=") && !strings.HasPrefix(arg, "--partial_report_uri=gs://") {
+				args = append(args, "--mmap_local_reports=true")
+				break
+			}
+		}
+	}
+	if err := h.runPipeline(ctx, h.ServerCfg.DpfAggregatePartialReportBinary, args, request); err != nil {
+		return err
+	}
+	if h.shadowEnabled(request) {
+		h.runShadowPipeline(ctx, args, outputResultURI, request)
+	}
+	return nil
+}
+
+// runShadowPipeline runs the shadow binary on the same inputs as the production pipeline, and compares the outputs.
+// The shadow run never fails the query; errors and disagreements are only logged and reported in the shadow directory.
+func (h *QueryHandler) runShadowPipeline(ctx context.Context, args []string, outputResultURI string, request *query.AggregateRequest) {
+	shadowArgs, shadowResultURI := shadowrun.ShadowArgs(args, h.ServerCfg.ShadowDir, request.QueryID, request.QueryLevel)
+	jobName := fmt.Sprintf("%s-%v-%s-shadow", request.QueryID, request.QueryLevel, h.Origin)
+	binary := h.ServerCfg.ShadowDpfAggregatePartialReportBinary
+	if err := h.runPipelineWithWorker(ctx, binary, binary, jobName, shadowArgs, request); err != nil {
+		log.Errorf("shadow pipeline failed for level %d of query %q: %v", request.QueryLevel, request.QueryID, err)
+		return
+	}
+	report, err := shadowrun.CompareOutputs(ctx, outputResultURI, shadowResultURI, h.ServerCfg.ShadowDir, request.QueryID, request.QueryLevel)
+	if err != nil {
+		log.Errorf("failed to compare shadow output for level %d of query %q: %v", request.QueryLevel, request.QueryID, err)
+		return
+	}
+	if !report.Agree {
+		log.Warningf("shadow output disagrees for level %d of query %q: %d mismatched, %d missing in shadow, %d missing in production",
+			request.QueryLevel, request.QueryID, len(report.MismatchedBuckets), len(report.MissingInShadow), len(report.MissingInProduction))
+		return
+	}
+	log.Infof("shadow output agrees for level %d of query %q", request.QueryLevel, request.QueryID)
+}
+
+func (h *QueryHandler) aggregatePartialReportHierarchical(ctx context.Context, request *query.AggregateRequest, config *query.HierarchicalConfig, jobDone bool) error {
+	finalLevel := int32(len(config.PrefixLengths)) - 1
+	if request.QueryLevel > finalLevel {
+		return fmt.Errorf("expect request level <= finalLevel %d, got %d", finalLevel, request.QueryLevel)
+	}
+	levelDone := false
+	if request.QueryLevel < finalLevel {
+		// A redelivered request skips the pipeline if the level was done before the next-level request was published.
+		var err error
+		if levelDone, err = isLevelDone(ctx, h.SharedDir, request.QueryID, request.QueryLevel); err != nil {
+			return err
+		}
+		if levelDone && !jobDone {
+			log.Infof("level %d of query %q is already done", request.QueryLevel, request.QueryID)
+			jobDone = true
+		}
+	}
+	if !jobDone {
+		partialReportURI := request.PartialReportURI
+		outputDecryptedReportURI := ""
+		if request.QueryLevel > 0 {
+			// If it is not the first-level aggregation, check if the result from the partner helper is ready for the previous level.
+			exist, err := isPartnerLevelDone(ctx, request.PartnerSharedInfo, request.QueryID, request.QueryLevel-1)
+			if err != nil {
+				return err
+			}
+			if !exist {
+				// When the partial result from the partner helper is not ready, nack the message with an error.
+				return fmt.Errorf("%w: %s for level %d of query %s", ErrPartnerNotReady, request.PartnerSharedInfo.Origin, request.QueryLevel-1, request.QueryID)
+			}
+			if request.QueryLevel == 1 && request.DecryptedReportQueryID == "" {
+				// The partner wrote its shares in the first level, which is done now.
+				h.checkConsistency(ctx, request)
+			}
+
+			// If it is not the first-level aggregation, the pipeline should read the decrypted reports instead of the original encrypted ones.
+			partialReportURI, err = h.fetchDecryptedReport(ctx, request)
+			if err != nil {
+				return err
+			}
+		} else if request.DecryptedReportQueryID != "" {
+			// The reports are decrypted by another hierarchy of the same batch.
+			exist, err := utils.IsFileGlobExist(ctx, query.GetRequestDecryptedReportManifestURI(h.ServerCfg.WorkspaceURI, request.DecryptedReportQueryID))
+			if err != nil {
+				return err
+			}
+			if !exist {
+				return fmt.Errorf("decrypted reports of query %s for hierarchy %q are not ready", request.DecryptedReportQueryID, request.Hierarchy)
+			}
+			partialReportURI, err = h.fetchDecryptedReport(ctx, request)
+			if err != nil {
+				return err
+			}
+		} else {
+			outputDecryptedReportURI = query.GetRequestDecryptedReportURI(h.ServerCfg.decryptedReportDir(), request.QueryID)
+		}
+
+		expandParamsURI, err := query.GetRequestExpandParamsURI(ctx, config, request,
+			h.ServerCfg.WorkspaceURI,
+			h.SharedDir,
+			request.PartnerSharedInfo.SharedDir,
+		)
+		if err != nil {
+			return err
+		}
+
+		var outputResultURI string
+		// The final-level results are not supposed to be shared with the partner helpers.
+		if request.QueryLevel == finalLevel {
+			outputResultURI = GetFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)
+		} else {
+			outputResultURI = query.GetRequestPartialResultURI(h.SharedDir, request.QueryID, request.QueryLevel)
+		}
+
+		epsilon := request.TotalEpsilon * config.PrivacyBudgetPerPrefix[request.QueryLevel]
+		strictArgs, err := h.strictPrivacyArgs(request, &strictprivacy.Params{Epsilon: epsilon, NoiseSeed: request.DebugNoiseSeed})
+		if err != nil {
+			return err
+		}
+		args := []string{
+			"--partial_report_uri=" + partialReportURI,
+			"--expand_parameters_uri=" + expandParamsURI,
+			"--partial_histogram_uri=" + outputResultURI,
+			"--decrypted_report_uri=" + outputDecryptedReportURI,
+			"--expansion_stats_uri=" + query.GetExpansionStatsURI(outputResultURI),
+			"--epsilon=" + fmt.Sprintf("%f", epsilon),
+			"--private_key_params_uri=" + h.ServerCfg.PrivateKeyParamsURI,
+			"--key_bit_size=" + fmt.Sprint(request.KeyBitSize),
+			"--runner=" + h.PipelineRunner,
+		}
+		args = append(args, strictArgs...)
+		ownDecryption := request.QueryLevel == 0 && request.DecryptedReportQueryID == ""
+		if ownDecryption {
+			// The late reports are saved with the decrypted reports, which the next levels and hierarchies read.
+			args = append(args, lateReportArgs(request)...)
+			args = append(args, h.consistencyCheckArgs(request)...)
+			args = append(args, h.dataQualityArgs(request)...)
+		}
+		args = append(args, h.traceArgs(request, ownDecryption)...)
+		if request.QueryLevel > 0 && h.ServerCfg.TargetBundleMillis > 0 {
+			args = append(args,
+				"--previous_expansion_stats_uri="+query.GetExpansionStatsURI(query.GetRequestPartialResultURI(h.SharedDir, request.QueryID, request.QueryLevel-1)),
+				"--target_bundle_millis="+fmt.Sprint(h.ServerCfg.TargetBundleMillis),
+			)
+		}
+		args = append(args, h.preemptionArgs()...)
+
+		if err := h.runDpfPipeline(ctx, args, outputResultURI, request); err != nil {
+			return err
+		}
+		if ownDecryption {
+			h.checkConsistency(ctx, request)
+		}
+		// The decrypted reports are kept for the next levels, and for the other hierarchies of the same batch.
+		if outputDecryptedReportURI != "" && (request.QueryLevel < finalLevel || request.Hierarchy != "") {
+			if _, err := tieredstorage.WriteManifest(ctx, outputDecryptedReportURI, pipelineutils.AddStrInPath(outputDecryptedReportURI, "*"),
+				query.GetRequestDecryptedReportManifestURI(h.ServerCfg.WorkspaceURI, request.QueryID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if request.QueryLevel == finalLevel {
+		log.Infof("query %q complete", request.QueryID)
+		h.writeResultManifest(ctx, request)
+		h.cacheResult(ctx, request)
+		h.exportJob(ctx, request, h.hierarchicalExportLevels(ctx, request, config), nil)
+		return nil
+	}
+
+	if !levelDone {
+		if err := h.markLevelDone(ctx, request); err != nil {
+			return err
+		}
+	}
+	// An injected drop fails the request after the level is done, as if the helper stopped before publishing the
+	// next-level request. The redelivered request publishes it without running the pipeline again.
+	if err := h.Chaos.Fail(chaos.DropLevelMessage); err != nil {
+		return err
+	}
+
+	// If the hierarchical query is not finished yet, publish the requests for the next-level aggregation.
+	request.QueryLevel++
+	_, topic, err := utils.ParsePubSubResourceName(h.RequestPubSubTopic)
+	if err != nil {
+		return err
+	}
+	return utils.PublishRequest(ctx, h.PubSubTopicClient, topic, request)
+}
+
+// isLevelDone checks if the marker of the completed partial result of a level exists in a shared directory.
+func isLevelDone(ctx context.Context, sharedDir, queryID string, level int32) (bool, error) {
+	return utils.IsFileGlobExist(ctx, query.GetRequestLevelDoneURI(sharedDir, queryID, level))
+}
+
+// isPartnerLevelDone checks if the partial result of a level from the partner helper is complete. The result of a
+// partner without level-done markers is complete when it exists.
+func isPartnerLevelDone(ctx context.Context, partner *query.HelperSharedInfo, queryID string, level int32) (bool, error) {
+	if !partner.LevelDoneMarkers {
+		return utils.IsFileGlobExist(ctx, query.GetRequestPartialResultURI(partner.SharedDir, queryID, level))
+	}
+	return isLevelDone(ctx, partner.SharedDir, queryID, level)
+}
+
+// markLevelDone writes the marker of the completed partial result of the request level, after which the partner helper
+// reads the result. A result left incomplete by a failed upload has no marker, so it is never merged.
+func (h *QueryHandler) markLevelDone(ctx context.Context, request *query.AggregateRequest) error {
+	if err := h.Chaos.Fail(chaos.PartialUpload); err != nil {
+		// Truncate the result as if the helper stopped halfway through the upload.
+		resultURI := query.GetRequestPartialResultURI(h.SharedDir, request.QueryID, request.QueryLevel)
+		if b, readErr := utils.ReadBytes(ctx, resultURI); readErr == nil {
+			if writeErr := utils.WriteBytes(ctx, b[:len(b)/2], resultURI, nil); writeErr != nil {
+				log.Errorf("failed to truncate the result of level %d of query %q: %v", request.QueryLevel, request.QueryID, writeErr)
+			}
+		}
+		return err
+	}
+	return utils.WriteBytes(ctx, []byte(time.Now().UTC().Format(time.RFC3339)), query.GetRequestLevelDoneURI(h.SharedDir, request.QueryID, request.QueryLevel), nil)
+}
+
+// reportGlobs returns the globs of the files of all the reports of the request, including the late reports.
+func reportGlobs(request *query.AggregateRequest) []string {
+	var globs []string
+	for _, uri := range request.ReportURIs() {
+		globs = append(globs, pipelineutils.AddStrInPath(uri, "*"))
+	}
+	return globs
+}
+
+// verifyBatchIntegrity shares the digest over the input reports with the partner helper, and compares it with the
+// digest from the partner. ErrPartnerNotReady is returned if the digest from the partner is not ready, so the request is
+// retried.
+func (h *QueryHandler) verifyBatchIntegrity(ctx context.Context, request *query.AggregateRequest) error {
+	if !h.CheckBatchIntegrity || request.PartnerSharedInfo == nil {
+		return nil
+	}
+	digest, err := batchintegrity.DigestReports(ctx, reportGlobs(request)...)
+	if err != nil {
+		return err
+	}
+	own := batchintegrity.NewBatchRoot(request.QueryID, digest)
+	if err := batchintegrity.WriteBatchRoot(ctx, own, query.GetRequestBatchRootURI(h.SharedDir, request.QueryID)); err != nil {
+		return err
+	}
+
+	partnerURI := query.GetRequestBatchRootURI(request.PartnerSharedInfo.SharedDir, request.QueryID)
+	exist, err := utils.IsFileGlobExist(ctx, partnerURI)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return fmt.Errorf("%w: batch root from %s for query %s", ErrPartnerNotReady, request.PartnerSharedInfo.Origin, request.QueryID)
+	}
+	partner, err := batchintegrity.ReadBatchRoot(ctx, partnerURI)
+	if err != nil {
+		return err
+	}
+	if err := batchintegrity.Compare(own, partner); err != nil {
+		return err
+	}
+	log.Infof("query %q: %d reports match the partner helper with root %s", request.QueryID, own.ReportCount, own.Root)
+	return nil
+}
+
+// aggregatePartialReportMultiHierarchy publishes the requests for aggregating each hierarchy of the batch.
+func (h *QueryHandler) aggregatePartialReportMultiHierarchy(ctx context.Context, request *query.AggregateRequest, config *query.MultiHierarchyConfig) error {
+	requests, err := query.SplitMultiHierarchyRequest(ctx, config, request, h.ServerCfg.WorkspaceURI)
+	if err != nil {
+		return err
+	}
+	_, topic, err := utils.ParsePubSubResourceName(h.RequestPubSubTopic)
+	if err != nil {
+		return err
+	}
+	for _, r := range requests {
+		log.Infof("query %q: publishing hierarchy %q as query %q with epsilon %v", request.QueryID, r.Hierarchy, r.QueryID, r.TotalEpsilon)
+		if err := h.recordSplitCharge(ctx, request, r); err != nil {
+			return err
+		}
+		if err := utils.PublishRequest(ctx, h.PubSubTopicClient, topic, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishPrefixLengthRequests publishes the requests for aggregating the prefixes of each length compiled from the
+// bucket ranges of a direct query.
+func (h *QueryHandler) publishPrefixLengthRequests(ctx context.Context, request *query.AggregateRequest, prefixes map[int32][]uint128.Uint128) error {
+	_, topic, err := utils.ParsePubSubResourceName(h.RequestPubSubTopic)
+	if err != nil {
+		return err
+	}
+	for _, r := range query.SplitPrefixLengthRequest(prefixes, request) {
+		log.Infof("query %q: publishing %d prefixes of length %d as query %q", request.QueryID, len(prefixes[r.PrefixLength]), r.PrefixLength, r.QueryID)
+		if err := h.recordSplitCharge(ctx, request, r); err != nil {
+			return err
+		}
+		if err := utils.PublishRequest(ctx, h.PubSubTopicClient, topic, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchDecryptedReport verifies the decrypted reports from the first level against their manifest, and returns the
+// location where the pipeline should read them.
+func (h *QueryHandler) fetchDecryptedReport(ctx context.Context, request *query.AggregateRequest) (string, error) {
+	queryID := request.QueryID
+	if request.DecryptedReportQueryID != "" {
+		queryID = request.DecryptedReportQueryID
+	}
+	manifestURI := query.GetRequestDecryptedReportManifestURI(h.ServerCfg.WorkspaceURI, queryID)
+	exist, err := utils.IsFileGlobExist(ctx, manifestURI)
+	if err != nil {
+		return "", err
+	}
+	if !exist {
+		// The reports were decrypted before the manifests were introduced.
+		return query.GetRequestDecryptedReportURI(h.ServerCfg.decryptedReportDir(), queryID), nil
+	}
+	cacheDir := ""
+	if h.PipelineRunner == "direct" {
+		cacheDir = h.ServerCfg.DecryptedReportCacheDir
+	}
+	return tieredstorage.Fetch(ctx, manifestURI, cacheDir)
+}
+
+// lateReportArgs returns the pipeline arguments for the late reports of the request.
+func lateReportArgs(request *query.AggregateRequest) []string {
+	if request.LateReportURI == "" {
+		return nil
+	}
+	return []string{"--late_report_uri=" + request.LateReportURI}
+}
+
+func (h *QueryHandler) aggregatePartialReportReach(ctx context.Context, request *query.AggregateRequest) error {
+	if request.LateReportURI != "" {
+		return fmt.Errorf("late reports are not supported for the %s aggregation", request.AggregationType)
+	}
+	outputResultURI := GetFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)
+	outputValidityURI := utils.JoinPath(request.ResultDir, fmt.Sprintf("%s_%s_validity", request.QueryID, strings.ReplaceAll(h.Origin, ".", "_")))
+	// The reach aggregation does not add noise.
+	if _, err := h.strictPrivacyArgs(request, &strictprivacy.Params{Noiseless: true}); err != nil {
+		return err
+	}
+	args := []string{
+		"--partial_report_uri=" + request.PartialReportURI,
+		"--partial_histogram_uri=" + outputResultURI,
+		"--partial_validity_uri=" + outputValidityURI,
+		"--private_key_params_uri=" + h.ServerCfg.PrivateKeyParamsURI,
+		"--key_bit_size=" + fmt.Sprint(request.KeyBitSize),
+		"--runner=" + h.PipelineRunner,
+	}
+
+	if err := h.runPipeline(ctx, h.ServerCfg.DpfAggregateReachPartialReportBinary, args, request); err != nil {
+		return err
+	}
+
+	log.Infof("query %q complete", request.QueryID)
+	h.exportJob(ctx, request, nil, nil)
+	return nil
+}
+
+// preemptionArgs returns the flags of the DPF pipelines for pre-empting the bundles of reports that exceed the memory
+// limit of the workers.
+// dataQualityArgs returns the flags for the pipeline that decrypts the reports of a query to summarize them next to the
+// final result, which are empty if the summary is disabled.
+func (h *QueryHandler) dataQualityArgs(request *query.AggregateRequest) []string {
+	if h.ServerCfg.DataQualityBudgetFraction <= 0 {
+		return nil
+	}
+	return []string{
+		"--data_quality_summary_uri=" + GetDataQualitySummaryURI(request.ResultDir, request.QueryID, h.Origin),
+		"--data_quality_budget_fraction=" + fmt.Sprint(h.ServerCfg.DataQualityBudgetFraction),
+	}
+}
+
+func (h *QueryHandler) preemptionArgs() []string {
+	if h.ServerCfg.PreemptMemoryMB <= 0 {
+		return nil
+	}
+	return []string{"--preempt_memory_mb=" + fmt.Sprint(h.ServerCfg.PreemptMemoryMB)}
+}
+
+func (h *QueryHandler) aggregatePartialReportDirect(ctx context.Context, request *query.AggregateRequest, config *query.DirectConfig) error {
+	prefixLength := request.PrefixLength
+	if prefixLength == 0 {
+		prefixes, err := query.GetDirectPrefixes(config, request.KeyBitSize)
+		if err != nil {
+			return err
+		}
+		// The expansion evaluates the DPF keys at one hierarchy level, so the prefixes of each length are aggregated by a
+		// separate query.
+		if len(prefixes) > 1 {
+			return h.publishPrefixLengthRequests(ctx, request, prefixes)
+		}
+		for l := range prefixes {
+			prefixLength = l
+		}
+	}
+
+	expandParamsURI := utils.JoinPath(h.ServerCfg.WorkspaceURI, fmt.Sprintf("%s_%s", request.QueryID, query.DefaultExpandParamsFile))
+	expandParams, err := query.GetDirectExpandParams(config, request.KeyBitSize, prefixLength)
+	if err != nil {
+		return err
+	}
+	if err := dpfaggregator.SaveExpandParameters(ctx, expandParams, expandParamsURI); err != nil {
+		return err
+	}
+
+	outputResultURI := GetFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)
+	strictArgs, err := h.strictPrivacyArgs(request, &strictprivacy.Params{Epsilon: request.TotalEpsilon, NoiseSeed: request.DebugNoiseSeed})
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"--partial_report_uri=" + request.PartialReportURI,
 		"--expand_parameters_uri=" + expandParamsURI,
 		"--partial_histogram_uri=" + outputResultURI,
+		"--expansion_stats_uri=" + query.GetExpansionStatsURI(outputResultURI),
 		"--epsilon=" + fmt.Sprintf("%f", request.TotalEpsilon),
 		"--private_key_params_uri=" + h.ServerCfg.PrivateKeyParamsURI,
 		"--key_bit_size=" + fmt.Sprint(request.KeyBitSize),
 		"--runner=" + h.PipelineRunner,
 	}
+	args = append(args, strictArgs...)
+	args = append(args, lateReportArgs(request)...)
+	args = append(args, h.consistencyCheckArgs(request)...)
+	args = append(args, h.traceArgs(request, true /*ownDecryption*/)...)
+	args = append(args, h.preemptionArgs()...)
+	if request.PrefixLength == 0 {
+		// The queries split by prefix lengths decrypt the same reports, so none of them summarizes the reports.
+		args = append(args, h.dataQualityArgs(request)...)
+	}
 
-	if err := h.runPipeline(ctx, h.ServerCfg.DpfAggregatePartialReportBinary, args, request); err != nil {
+	if err := h.runDpfPipeline(ctx, args, outputResultURI, request); err != nil {
 		return err
 	}
+	h.checkConsistency(ctx, request)
 
 	log.Infof("query %q complete", request.QueryID)
+	h.writeResultManifest(ctx, request)
+	h.cacheResult(ctx, request)
+	h.exportJob(ctx, request, []jobexport.Level{exportLevel(ctx, 0, request.TotalEpsilon, query.GetExpansionStatsURI(outputResultURI))}, nil)
 	return nil
 }
 
 func (h *QueryHandler) aggregateOnepartyReport(ctx context.Context, request *query.AggregateRequest) error {
-	outputResultURI := getFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)
+	outputResultURI := GetFinalPartialResultURI(request.ResultDir, request.QueryID, h.Origin)
+	strictArgs, err := h.strictPrivacyArgs(request, &strictprivacy.Params{Epsilon: request.TotalEpsilon})
+	if err != nil {
+		return err
+	}
 	args := []string{
 		"--encrypted_report_uri=" + request.PartialReportURI,
 		"--target_bucket_uri=" + request.ExpandConfigURI,
-		"--partial_histogram_uri=" + outputResultURI,
+		"--histogram_uri=" + outputResultURI,
 		"--private_key_params_uri=" + h.ServerCfg.PrivateKeyParamsURI,
 		"--epsilon=" + fmt.Sprintf("%f", request.TotalEpsilon),
 		"--runner=" + h.PipelineRunner,
 	}
+	args = append(args, strictArgs...)
+	args = append(args, h.dataQualityArgs(request)...)
 
 	if err := h.runPipeline(ctx, h.ServerCfg.OnepartyAggregateReportBinary, args, request); err != nil {
 		return err
 	}
 
 	log.Infof("query %q complete", request.QueryID)
+	h.writeResultManifest(ctx, request)
+	h.cacheResult(ctx, request)
+	h.exportJob(ctx, request, []jobexport.Level{{Epsilon: request.TotalEpsilon}}, nil)
 	return nil
 }
 
@@ -0,0 +1,1032 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregatorservice
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/failurereport"
+	"github.com/google/privacy-sandbox-aggregation-service/service/authz"
+	"github.com/google/privacy-sandbox-aggregation-service/service/batchintegrity"
+	"github.com/google/privacy-sandbox-aggregation-service/service/budgetadvisor"
+	"github.com/google/privacy-sandbox-aggregation-service/service/budgetledger"
+	"github.com/google/privacy-sandbox-aggregation-service/service/chaos"
+	"github.com/google/privacy-sandbox-aggregation-service/service/clienttoken"
+	"github.com/google/privacy-sandbox-aggregation-service/service/jobexport"
+	"github.com/google/privacy-sandbox-aggregation-service/service/latencyslo"
+	"github.com/google/privacy-sandbox-aggregation-service/service/query"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultcache"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
+	"github.com/google/privacy-sandbox-aggregation-service/service/runtimeconfig"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/consistencycheck"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/strictprivacy"
+
+	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+)
+
+func getStatus(t *testing.T, h http.Handler, req *http.Request) (int, *ReadOnlyStatus) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil
+	}
+	status := &ReadOnlyStatus{}
+	if err := json.Unmarshal(rec.Body.Bytes(), status); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, status
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	mode := &ReadOnlyMode{}
+	policy, err := authz.ParsePolicy([]byte(`{"Bindings": [
+    {"Role": "viewer", "Members": ["email:viewer@example.com"]},
+    {"Role": "admin", "Members": ["email:admin@example.com"]}
+  ]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer := &authz.Authorizer{
+		Policy: policy,
+		VerifyToken: func(_ context.Context, token string) (map[string]interface{}, error) {
+			return map[string]interface{}{"email": token}, nil
+		},
+	}
+	admin := authorizer.Require(authz.ViewerRoles, &ReadOnlyAdminHandler{Mode: mode})
+	health := &HealthHandler{Mode: mode}
+
+	_, got := getStatus(t, health, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if diff := cmp.Diff(&ReadOnlyStatus{Status: "ok"}, got); diff != "" {
+		t.Errorf("health status mismatch (-want +got):\n%s", diff)
+	}
+
+	form := url.Values{"read_only": {"true"}}
+	// Only the admins change the mode.
+	for _, caller := range []string{"", "viewer@example.com"} {
+		req := httptest.NewRequest(http.MethodPost, "/admin/readonly", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if caller != "" {
+			req.Header.Set("Authorization", "Bearer "+caller)
+		}
+		if code, _ := getStatus(t, admin, req); code == http.StatusOK {
+			t.Errorf("expect the read-only mode change rejected for caller %q", caller)
+		}
+		// The handler also rejects the changes when it is not served behind an authorizer.
+		req = httptest.NewRequest(http.MethodPost, "/admin/readonly", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if code, _ := getStatus(t, &ReadOnlyAdminHandler{Mode: mode}, req); code != http.StatusForbidden {
+			t.Errorf("expect status %d without an authorized caller, got %d", http.StatusForbidden, code)
+		}
+	}
+	if mode.Enabled() {
+		t.Fatal("expect read-only mode unchanged by unauthorized callers")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/readonly", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer admin@example.com")
+	_, got = getStatus(t, admin, req)
+	if diff := cmp.Diff(&ReadOnlyStatus{ReadOnly: true}, got); diff != "" {
+		t.Errorf("admin status mismatch (-want +got):\n%s", diff)
+	}
+	if !mode.Enabled() {
+		t.Error("expect read-only mode enabled")
+	}
+
+	_, got = getStatus(t, health, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if diff := cmp.Diff(&ReadOnlyStatus{Status: "read-only", ReadOnly: true}, got); diff != "" {
+		t.Errorf("health status mismatch (-want +got):\n%s", diff)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/readonly?read_only=invalid", nil)
+	req.Header.Set("Authorization", "Bearer admin@example.com")
+	if code, _ := getStatus(t, admin, req); code != http.StatusBadRequest {
+		t.Errorf("expect status %d for invalid value, got %d", http.StatusBadRequest, code)
+	}
+
+	var disabled *ReadOnlyMode
+	if disabled.Enabled() {
+		t.Error("expect nil read-only mode to be disabled")
+	}
+
+	// The held requests are released when the mode is disabled, before the timeout.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		mode.Set(false)
+	}()
+	start := time.Now()
+	mode.WaitDisabled(context.Background(), time.Hour)
+	if elapsed := time.Since(start); elapsed > time.Minute {
+		t.Errorf("expect WaitDisabled to return when the mode is disabled, returned after %v", elapsed)
+	}
+	mode.Set(true)
+	mode.WaitDisabled(context.Background(), 10*time.Millisecond)
+}
+
+func TestEpsilonSuggestionHandler(t *testing.T) {
+	body := `{"RelativeError": 0.1, "ReportCount": 1000, "L1Sensitivity": 1, "RemainingBudget": 1}`
+	rec := httptest.NewRecorder()
+	(&EpsilonSuggestionHandler{}).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/epsilon_suggestion", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expect status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	got := &budgetadvisor.Suggestion{}
+	if err := json.Unmarshal(rec.Body.Bytes(), got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Epsilon <= 0 || !got.WithinBudget {
+		t.Errorf("expect positive epsilon within budget, got %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	(&EpsilonSuggestionHandler{}).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/epsilon_suggestion", strings.NewReader(`{"RelativeError": 0.1}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expect status %d for invalid request, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestStrictPrivacyArgs(t *testing.T) {
+	request := &query.AggregateRequest{QueryID: "query1"}
+
+	h := &QueryHandler{}
+	if args, err := h.strictPrivacyArgs(request, &strictprivacy.Params{Epsilon: 0}); err != nil || args != nil {
+		t.Errorf("expect no check without strict mode, got args %v and error %v", args, err)
+	}
+
+	h.StrictPrivacy = true
+	if _, err := h.strictPrivacyArgs(request, &strictprivacy.Params{Epsilon: 0}); !errors.Is(err, strictprivacy.ErrNotDebugBatch) {
+		t.Errorf("expect noiseless aggregation to be rejected, got %v", err)
+	}
+	args, err := h.strictPrivacyArgs(request, &strictprivacy.Params{Epsilon: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"--strict_privacy", "--debug_batch=false"}, args); diff != "" {
+		t.Errorf("strict privacy args mismatch (-want +got):\n%s", diff)
+	}
+
+	request.DebugBatch = true
+	if _, err := h.strictPrivacyArgs(request, &strictprivacy.Params{Epsilon: 0, NoiseSeed: 1}); err != nil {
+		t.Errorf("expect debug batch to be allowed, got %v", err)
+	}
+}
+
+func TestResolveDebugBatch(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-debug-batch")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	debugReports, otherReports := path.Join(tmpDir, "debug"), path.Join(tmpDir, "other")
+	writeReports(t, debugReports, &reporttypes.SharedInfo{ReportID: "report1"}, &reporttypes.SharedInfo{ReportID: "report2"})
+	writeReports(t, otherReports, &reporttypes.SharedInfo{ReportID: "report3"})
+	digest, err := batchintegrity.DigestReports(ctx, debugReports+"*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedURI := path.Join(tmpDir, "signed.json")
+	metadata := &dpfaggregator.BatchMetadata{KeyBitSize: 16, DebugBatch: true, BatchRoot: digest.Root()}
+	if err := dpfaggregator.SignBatchMetadata(metadata, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := dpfaggregator.WriteBatchMetadata(ctx, metadata, signedURI); err != nil {
+		t.Fatal(err)
+	}
+	unsignedURI := path.Join(tmpDir, "unsigned.json")
+	if err := dpfaggregator.WriteBatchMetadata(ctx, &dpfaggregator.BatchMetadata{KeyBitSize: 16, DebugBatch: true}, unsignedURI); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &QueryHandler{BatchSigningKeys: []ed25519.PublicKey{publicKey}}
+	for _, tc := range []struct {
+		desc    string
+		handler *QueryHandler
+		reports string
+		late    string
+		uri     string
+		want    bool
+	}{
+		{"signed metadata", h, debugReports, "", signedURI, true},
+		{"unsigned metadata", h, debugReports, "", unsignedURI, false},
+		{"no batch metadata", h, debugReports, "", "", false},
+		{"no trusted batcher", &QueryHandler{}, debugReports, "", signedURI, false},
+		{"metadata of another batch", h, otherReports, "", signedURI, false},
+		{"reports added to the batch", h, debugReports, otherReports, signedURI, false},
+	} {
+		request := &query.AggregateRequest{QueryID: "query1", PartialReportURI: tc.reports, LateReportURI: tc.late, BatchMetadataURI: tc.uri, DebugBatch: true}
+		if err := tc.handler.resolveDebugBatch(ctx, request); err != nil {
+			t.Fatal(err)
+		}
+		if request.DebugBatch != tc.want {
+			t.Errorf("%s: expect debug batch %t, got %t", tc.desc, tc.want, request.DebugBatch)
+		}
+		// The consistency check, which recombines the shares of the sampled reports, only runs on confirmed debug batches.
+		request.PartnerSharedInfo = &query.HelperSharedInfo{Origin: "helper2"}
+		checker := &QueryHandler{Origin: "helper1", ServerCfg: ServerCfg{ConsistencyCheckRate: 1}}
+		if got := checker.consistencyCheckArgs(request) != nil; got != tc.want {
+			t.Errorf("%s: expect consistency check %t, got %t", tc.desc, tc.want, got)
+		}
+	}
+
+	request := &query.AggregateRequest{QueryID: "query1", TotalEpsilon: 0, PartialReportURI: debugReports, BatchMetadataURI: unsignedURI, DebugBatch: true}
+	if err := h.resolveDebugBatch(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	h.StrictPrivacy = true
+	if err := h.checkStrictPrivacy(request); !errors.Is(err, strictprivacy.ErrNotDebugBatch) {
+		t.Errorf("expect the query without noise to be rejected, got %v", err)
+	}
+	if !h.abortQuery(h.checkStrictPrivacy(request), 0) {
+		t.Error("expect the rejected query to be aborted")
+	}
+}
+
+func TestNoiseSeed(t *testing.T) {
+	request := &query.AggregateRequest{QueryID: "query1", DebugNoiseSeed: 42, DebugBatch: true}
+	h1 := &QueryHandler{Origin: "helper1", NoiseSeedKey: []byte("key1")}
+	h2 := &QueryHandler{Origin: "helper2", NoiseSeedKey: []byte("key2")}
+
+	seed := h1.noiseSeed(request)
+	if seed == 0 || seed == request.DebugNoiseSeed {
+		t.Errorf("expect a derived noise seed, got %d", seed)
+	}
+	if got := h1.noiseSeed(request); got != seed {
+		t.Errorf("expect the same seed for the same request, got %d and %d", seed, got)
+	}
+	if got := h2.noiseSeed(request); got == seed {
+		t.Errorf("expect different seeds for the helpers, got %d for both", got)
+	}
+	request.QueryLevel = 1
+	if got := h1.noiseSeed(request); got == seed {
+		t.Errorf("expect different seeds for the levels, got %d for both", got)
+	}
+	if got := (&QueryHandler{Origin: "helper1"}).noiseSeed(request); got != 0 {
+		t.Errorf("expect no seed without a secret key, got %d", got)
+	}
+	request.DebugBatch = false
+	if got := h1.noiseSeed(request); got != 0 {
+		t.Errorf("expect no seed for a batch that is not a debug batch, got %d", got)
+	}
+	if err := h1.checkStrictPrivacy(request); err != nil || request.DebugNoiseSeed != 0 {
+		t.Errorf("expect the noise seed to be dropped without strict mode, got seed %d and error %v", request.DebugNoiseSeed, err)
+	}
+}
+
+func TestConsistencyCheckArgs(t *testing.T) {
+	request := &query.AggregateRequest{QueryID: "query1", PartnerSharedInfo: &query.HelperSharedInfo{Origin: "helper2"}}
+	h := &QueryHandler{Origin: "helper1", SharedDir: "/shared", ServerCfg: ServerCfg{WorkspaceURI: "/workspace", ConsistencyCheckRate: 0.5}}
+	if args := h.consistencyCheckArgs(request); args != nil {
+		t.Errorf("expect no consistency check for non-debug batches, got %v", args)
+	}
+
+	// The helper running the check keeps its shares private.
+	request.DebugBatch = true
+	want := []string{
+		"--consistency_share_uri=/workspace/query1_CONSISTENCYSHARES",
+		"--consistency_sample_rate=0.5",
+		"--consistency_seed=" + fmt.Sprint(consistencycheck.QuerySeed("query1")),
+		"--debug_batch=true",
+	}
+	if diff := cmp.Diff(want, h.consistencyCheckArgs(request)); diff != "" {
+		t.Errorf("consistency check args mismatch (-want +got):\n%s", diff)
+	}
+
+	// The other helper shares its shares with the helper running the check.
+	h.Origin, request.PartnerSharedInfo.Origin = "helper2", "helper1"
+	want[0] = "--consistency_share_uri=/shared/query1_CONSISTENCYSHARES"
+	if diff := cmp.Diff(want, h.consistencyCheckArgs(request)); diff != "" {
+		t.Errorf("consistency check args mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestTraceArgs(t *testing.T) {
+	request := &query.AggregateRequest{QueryID: "query1", QueryLevel: 1, PartialReportURI: "/input/reports"}
+	h := &QueryHandler{ServerCfg: ServerCfg{WorkspaceURI: "/workspace"}}
+	if args := h.traceArgs(request, false /*ownDecryption*/); args != nil {
+		t.Errorf("expect no trace when disabled, got %v", args)
+	}
+
+	h.ServerCfg.TraceSampleRate = 0.001
+	want := []string{
+		"--trace_uri=/workspace/query1_TRACE_1",
+		"--trace_sample_rate=0.001",
+		"--trace_seed=" + fmt.Sprint(consistencycheck.QuerySeed("query1")),
+		"--trace_report_uri=/input/reports",
+	}
+	if diff := cmp.Diff(want, h.traceArgs(request, false /*ownDecryption*/)); diff != "" {
+		t.Errorf("trace args mismatch (-want +got):\n%s", diff)
+	}
+	// The pipeline samples its own input when it decrypts the reports.
+	if diff := cmp.Diff(want[:3], h.traceArgs(request, true /*ownDecryption*/)); diff != "" {
+		t.Errorf("trace args mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestClassifyPipelineError(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-pipeline-failure")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	reportURI := path.Join(tmpDir, "failure.json")
+	report := failurereport.NewReport("binary", failurereport.WrapURI(failurereport.ClassInputNotFound, failurereport.StageReadInput, "/input/report", errors.New("input not found")))
+	if err := failurereport.Write(ctx, report, reportURI); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		exitCode  int
+		wantClass failurereport.Class
+		wantURI   string
+	}{
+		// The details are read from the report written by the binary.
+		{exitCode: 12, wantClass: failurereport.ClassInputNotFound, wantURI: "/input/report"},
+		// The report does not match the exit code, so only the class is known.
+		{exitCode: 13, wantClass: failurereport.ClassKeyError},
+		// Non-retriable classes are only trusted from a report.
+		{exitCode: 11, wantClass: failurereport.ClassUnknown},
+		// Exit codes of log.Exit and panics are not classified.
+		{exitCode: 1, wantClass: failurereport.ClassUnknown},
+		{exitCode: 2, wantClass: failurereport.ClassUnknown},
+	} {
+		runErr := exec.Command("sh", "-c", fmt.Sprintf("exit %d", tc.exitCode)).Run()
+		var failure *failurereport.Error
+		if !errors.As(classifyPipelineError(ctx, runErr, reportURI), &failure) {
+			t.Fatalf("expect classified error for exit code %d", tc.exitCode)
+		}
+		if failure.Class != tc.wantClass || failure.URI != tc.wantURI {
+			t.Errorf("exit code %d: expect class %s and URI %q, got %s and %q", tc.exitCode, tc.wantClass, tc.wantURI, failure.Class, failure.URI)
+		}
+	}
+
+	other := errors.New("binary not found")
+	if got := classifyPipelineError(ctx, other, reportURI); got != other {
+		t.Errorf("expect the error unchanged when the binary does not exit, got %v", got)
+	}
+}
+
+func TestDataQualityArgs(t *testing.T) {
+	h := &QueryHandler{Origin: "helper1"}
+	request := &query.AggregateRequest{QueryID: "query1", ResultDir: "/results"}
+	if args := h.dataQualityArgs(request); args != nil {
+		t.Errorf("expect no flags with the summary disabled, got %v", args)
+	}
+	h.ServerCfg.DataQualityBudgetFraction = 0.0000001
+	want := []string{
+		"--data_quality_summary_uri=" + GetDataQualitySummaryURI("/results", "query1", "helper1"),
+		"--data_quality_budget_fraction=1e-07",
+	}
+	if diff := cmp.Diff(want, h.dataQualityArgs(request)); diff != "" {
+		t.Errorf("data quality flags mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestResolvePostFilter(t *testing.T) {
+	request := &query.AggregateRequest{PostFilter: "top_k=5,min_value=10"}
+	if err := resolvePostFilter(request); err != nil {
+		t.Fatal(err)
+	}
+	if want := "min_value=10,top_k=5"; request.PostFilter != want {
+		t.Errorf("expect post filter %q, got %q", want, request.PostFilter)
+	}
+	request.PostFilter = "min_value=-10"
+	if err := resolvePostFilter(request); err == nil {
+		t.Error("expect error for invalid post filter")
+	}
+}
+
+func TestCheckRuntimeConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-runtime-config")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	uri := path.Join(tmpDir, "config.json")
+	if err := ioutil.WriteFile(uri, []byte(`{"AllowedPartnerOrigins":["helper2"],"MaxQueryEpsilon":5}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := runtimeconfig.NewWatcher(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &QueryHandler{}
+	request := &query.AggregateRequest{QueryID: "query1", TotalEpsilon: 10, PartnerSharedInfo: &query.HelperSharedInfo{Origin: "helper3"}}
+	if err := h.checkRuntimeConfig(request); err != nil {
+		t.Errorf("expect no check without runtime config, got %v", err)
+	}
+
+	h.RuntimeConfig = watcher
+	if err := h.checkRuntimeConfig(request); !errors.Is(err, runtimeconfig.ErrNotAllowed) {
+		t.Errorf("expect ErrNotAllowed for a partner out of the allowlist, got %v", err)
+	}
+	request.PartnerSharedInfo.Origin = "helper2"
+	if err := h.checkRuntimeConfig(request); !errors.Is(err, runtimeconfig.ErrNotAllowed) {
+		t.Errorf("expect ErrNotAllowed for epsilon above the cap, got %v", err)
+	}
+	request.TotalEpsilon = 5
+	if err := h.checkRuntimeConfig(request); err != nil {
+		t.Errorf("expect the query to be allowed, got %v", err)
+	}
+}
+
+func TestChargeBudget(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-charge-budget")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	reportURI := path.Join(tmpDir, "reports")
+	if err := ioutil.WriteFile(reportURI, []byte("report line 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &QueryHandler{
+		Origin:       "helper1",
+		ServerCfg:    ServerCfg{WorkspaceURI: tmpDir},
+		BudgetLedger: &budgetledger.Ledger{Dir: tmpDir, Budget: 1},
+	}
+	newRequest := func(queryID string, epsilon float64, acceptPartial bool) *query.AggregateRequest {
+		return &query.AggregateRequest{
+			QueryID:              queryID,
+			PartialReportURI:     reportURI,
+			TotalEpsilon:         epsilon,
+			ResultDir:            tmpDir,
+			AcceptPartialEpsilon: acceptPartial,
+		}
+	}
+
+	if err := h.chargeBudget(ctx, newRequest("query1", 0.75, false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.chargeBudget(ctx, newRequest("query2", 0.5, false)); !errors.Is(err, budgetledger.ErrBudgetExceeded) {
+		t.Errorf("expect ErrBudgetExceeded without consent, got %v", err)
+	}
+
+	request := newRequest("query2", 0.5, true)
+	if err := h.chargeBudget(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	if request.TotalEpsilon != 0.25 || request.RequestedEpsilon != 0.5 {
+		t.Errorf("expect the request downgraded from 0.5 to 0.25, got %v from %v", request.TotalEpsilon, request.RequestedEpsilon)
+	}
+	b, err := ioutil.ReadFile(GetBudgetNoticeURI(tmpDir, "query2", "helper1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notice := &BudgetNotice{}
+	if err := json.Unmarshal(b, notice); err != nil {
+		t.Fatal(err)
+	}
+	if notice.QueryID != "query2" || notice.Epsilon != 0.25 || notice.RequestedEpsilon != 0.5 {
+		t.Errorf("unexpected budget notice %+v", notice)
+	}
+
+	// The next level of the downgraded query is not charged again.
+	request.QueryLevel = 1
+	if err := h.chargeBudget(ctx, request); err != nil {
+		t.Errorf("expect no charge for the next level, got %v", err)
+	}
+	if request.TotalEpsilon != 0.25 {
+		t.Errorf("expect the next level to run with the downgraded epsilon 0.25, got %v", request.TotalEpsilon)
+	}
+
+	// A query split from a charged query runs within its budget.
+	split := newRequest(query.GetHierarchyQueryID("query1", "h1"), 0.5, false)
+	if err := h.recordSplitCharge(ctx, newRequest("query1", 0.75, false), split); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.chargeBudget(ctx, split); err != nil || split.TotalEpsilon != 0.5 {
+		t.Errorf("expect no charge for the split query, got epsilon %v and error %v", split.TotalEpsilon, err)
+	}
+
+	// The level of a request does not decide whether the query has been charged.
+	request = newRequest("query3", 0.5, false)
+	request.QueryLevel = 1
+	if err := h.chargeBudget(ctx, request); !errors.Is(err, budgetledger.ErrBudgetExceeded) {
+		t.Errorf("expect ErrBudgetExceeded for a later level of an uncharged query, got %v", err)
+	}
+
+	// Queries without noise, e.g. the reach queries, are not charged, and only rejected in strict privacy mode.
+	request = newRequest("query4", 0, false)
+	request.AggregationType = query.ReachType
+	if err := h.chargeBudget(ctx, request); err != nil {
+		t.Errorf("expect no charge for a reach query, got %v", err)
+	}
+	h.StrictPrivacy = true
+	if err := h.chargeBudget(ctx, newRequest("query5", 0, false)); !errors.Is(err, ErrNoiselessQuery) {
+		t.Errorf("expect ErrNoiselessQuery without noise in strict privacy mode, got %v", err)
+	}
+	request = newRequest("query5", 0, false)
+	request.DebugBatch = true
+	if err := h.chargeBudget(ctx, request); err != nil {
+		t.Errorf("expect no charge without noise for a debug batch, got %v", err)
+	}
+}
+
+func TestAcquireClientToken(t *testing.T) {
+	ctx := context.Background()
+	h := &QueryHandler{ClientTokens: &clienttoken.Registry{Store: clienttoken.NewMemoryStore(), Retention: time.Hour}}
+	queryID := clienttoken.QueryID("token1")
+	newRequest := func(queryID string, epsilon float64) *query.AggregateRequest {
+		return &query.AggregateRequest{QueryID: queryID, PartialReportURI: "/reports", TotalEpsilon: epsilon, ClientToken: "token1"}
+	}
+
+	for _, tc := range []struct {
+		desc         string
+		request      *query.AggregateRequest
+		wantAcquired bool
+		wantErr      error
+	}{
+		{"first attempt", newRequest(queryID, 1), true, nil},
+		{"redelivery while the first attempt runs", newRequest(queryID, 1), false, clienttoken.ErrInProgress},
+		{"retry with a query ID not derived from the token", newRequest("query2", 1), false, clienttoken.ErrQueryIDMismatch},
+		{"token reused with a different epsilon", newRequest(queryID, 2), false, clienttoken.ErrTokenReused},
+		{"next level of the first attempt", &query.AggregateRequest{QueryID: queryID, QueryLevel: 1, ClientToken: "token1"}, false, nil},
+	} {
+		acquired, err := h.acquireClientToken(ctx, tc.request)
+		if !errors.Is(err, tc.wantErr) {
+			t.Fatalf("%s: expect error %v, got %v", tc.desc, tc.wantErr, err)
+		}
+		if acquired != tc.wantAcquired {
+			t.Errorf("%s: expect acquired %t, got %t", tc.desc, tc.wantAcquired, acquired)
+		}
+	}
+
+	// The retries are dropped once the query is done.
+	h.releaseClientToken(ctx, newRequest(queryID, 1), &trackedMessage{acked: true})
+	if _, err := h.acquireClientToken(ctx, newRequest(queryID, 1)); !errors.Is(err, clienttoken.ErrDone) {
+		t.Errorf("expect error %v after the query is done, got %v", clienttoken.ErrDone, err)
+	}
+}
+
+func TestServeCachedResult(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-serve-cached-result")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	for _, dir := range []string{"shared1", "shared2", "cache", "results"} {
+		if err := os.MkdirAll(path.Join(tmpDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{"reports": "report line 1\n", "config.json": `{"BucketIDs":[1]}`, "result": "1,abc"} {
+		if err := ioutil.WriteFile(path.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := &QueryHandler{
+		Origin:      "helper1",
+		SharedDir:   path.Join(tmpDir, "shared1"),
+		ResultCache: &resultcache.Cache{Dir: path.Join(tmpDir, "cache")},
+	}
+	partner := &query.HelperSharedInfo{Origin: "helper2", SharedDir: path.Join(tmpDir, "shared2"), CacheDecisions: true}
+	newRequest := func(queryID string) *query.AggregateRequest {
+		return &query.AggregateRequest{
+			AggregationType:   query.ConversionType,
+			QueryID:           queryID,
+			PartialReportURI:  path.Join(tmpDir, "reports"),
+			ExpandConfigURI:   path.Join(tmpDir, "config.json"),
+			TotalEpsilon:      1,
+			ResultDir:         path.Join(tmpDir, "results"),
+			PartnerSharedInfo: partner,
+		}
+	}
+	key, err := resultcache.GetKey(ctx, nil, newRequest("query0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ResultCache.Store(ctx, key, "query0", path.Join(tmpDir, "result")); err != nil {
+		t.Fatal(err)
+	}
+	writePartnerDecision := func(queryID string, hit bool, cachedQueryID string) {
+		b, err := json.Marshal(&cacheDecision{Hit: hit, QueryID: cachedQueryID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(query.GetRequestCacheDecisionURI(partner.SharedDir, queryID), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The hit is only served after the partner decides.
+	if _, err := h.serveCachedResult(ctx, newRequest("query1")); !errors.Is(err, ErrPartnerNotReady) {
+		t.Fatalf("expect error %v before the partner decides, got %v", ErrPartnerNotReady, err)
+	}
+	if decision, err := readCacheDecision(ctx, query.GetRequestCacheDecisionURI(h.SharedDir, "query1")); err != nil {
+		t.Fatal(err)
+	} else if !decision.Hit || decision.QueryID != "query0" {
+		t.Errorf("expect the hit of query0 shared with the partner, got %+v", decision)
+	}
+	writePartnerDecision("query1", false, "")
+	if served, err := h.serveCachedResult(ctx, newRequest("query1")); err != nil || served {
+		t.Errorf("expect the pipelines to run on a miss of the partner, got served %v and error %v", served, err)
+	}
+
+	// A partner hit on the result of another earlier query is treated as a miss.
+	writePartnerDecision("query4", true, "query5")
+	if served, err := h.serveCachedResult(ctx, newRequest("query4")); err != nil || served {
+		t.Errorf("expect the pipelines to run on a partner hit of another query, got served %v and error %v", served, err)
+	}
+
+	writePartnerDecision("query2", true, "query0")
+	if served, err := h.serveCachedResult(ctx, newRequest("query2")); err != nil || !served {
+		t.Fatalf("expect the cached result served on a hit of both helpers, got served %v and error %v", served, err)
+	}
+	if b, err := ioutil.ReadFile(GetFinalPartialResultURI(path.Join(tmpDir, "results"), "query2", h.Origin)); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "1,abc" {
+		t.Errorf("expect the cached result, got %q", b)
+	}
+
+	// Partners that do not share their decisions never get cached results.
+	oldPartner := *partner
+	oldPartner.CacheDecisions = false
+	request := newRequest("query3")
+	request.PartnerSharedInfo = &oldPartner
+	if served, err := h.serveCachedResult(ctx, request); err != nil || served {
+		t.Errorf("expect no cached result for a partner without decisions, got served %v and error %v", served, err)
+	}
+}
+
+func TestResolveKeyBitSize(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-resolve-key-bit-size")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	metadataURI := path.Join(tmpDir, "metadata.json")
+	if err := dpfaggregator.WriteBatchMetadata(ctx, &dpfaggregator.BatchMetadata{KeyBitSize: 16}, metadataURI); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &QueryHandler{}
+	request := &query.AggregateRequest{QueryID: "query1", BatchMetadataURI: metadataURI}
+	if err := h.resolveKeyBitSize(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	if request.KeyBitSize != 16 {
+		t.Errorf("expect key bit size 16 from the batch metadata, got %d", request.KeyBitSize)
+	}
+
+	request = &query.AggregateRequest{QueryID: "query2", KeyBitSize: 32, BatchMetadataURI: metadataURI}
+	if err := h.resolveKeyBitSize(ctx, request); !errors.Is(err, dpfaggregator.ErrKeyBitSizeMismatch) {
+		t.Errorf("expect error %v for a key bit size different from the batch metadata, got %v", dpfaggregator.ErrKeyBitSizeMismatch, err)
+	}
+	// The missing metadata is not a mismatch, and the request is retried.
+	request = &query.AggregateRequest{QueryID: "query3", BatchMetadataURI: path.Join(tmpDir, "missing.json")}
+	if err := h.resolveKeyBitSize(ctx, request); err == nil || errors.Is(err, dpfaggregator.ErrKeyBitSizeMismatch) {
+		t.Errorf("expect a read error for the missing metadata, got %v", err)
+	}
+
+	// The later levels carry the resolved key bit size.
+	request = &query.AggregateRequest{QueryID: "query1", QueryLevel: 1, KeyBitSize: 16, BatchMetadataURI: path.Join(tmpDir, "missing.json")}
+	if err := h.resolveKeyBitSize(ctx, request); err != nil {
+		t.Errorf("expect the metadata not read at the later levels, got %v", err)
+	}
+}
+
+// writeReports writes encrypted partial reports with the shared info into a file.
+func writeReports(t *testing.T, uri string, infos ...*reporttypes.SharedInfo) {
+	t.Helper()
+	var lines []string
+	for _, info := range infos {
+		b, err := json.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := reporttypes.SerializeAggregatablePayload(&pb.AggregatablePayload{Payload: &pb.StandardCiphertext{}, SharedInfo: string(b)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if err := ioutil.WriteFile(uri, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChargeBudgetWindows(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-charge-budget-windows")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	reportTime := time.Now().Add(-time.Hour)
+	scheduled := fmt.Sprint(reportTime.Unix())
+	batch1, batch2, invalid := path.Join(tmpDir, "batch1"), path.Join(tmpDir, "batch2"), path.Join(tmpDir, "invalid")
+	writeReports(t, batch1,
+		&reporttypes.SharedInfo{ReportID: "report1", ReportingOrigin: "https://a.example", ScheduledReportTime: scheduled},
+		&reporttypes.SharedInfo{ReportID: "report2", ReportingOrigin: "https://b.example", ScheduledReportTime: scheduled},
+	)
+	writeReports(t, batch2, &reporttypes.SharedInfo{ReportID: "report3", ReportingOrigin: "https://a.example", ScheduledReportTime: scheduled})
+	writeReports(t, invalid, &reporttypes.SharedInfo{ReportID: "report4", ReportingOrigin: "https://a.example"})
+	late := path.Join(tmpDir, "late")
+	writeReports(t, late, &reporttypes.SharedInfo{ReportID: "report5", ReportingOrigin: "https://c.example", ScheduledReportTime: scheduled})
+	ledgerDir := path.Join(tmpDir, "ledger")
+	if err := os.MkdirAll(ledgerDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := &QueryHandler{
+		ServerCfg:    ServerCfg{WorkspaceURI: tmpDir},
+		BudgetLedger: &budgetledger.Ledger{Dir: ledgerDir, Budget: 1, Window: budgetledger.Daily},
+	}
+
+	// The late reports are charged with the batch.
+	if err := h.chargeBudget(ctx, &query.AggregateRequest{QueryID: "query1", PartialReportURI: batch1, LateReportURI: late, TotalEpsilon: 0.75}); err != nil {
+		t.Fatal(err)
+	}
+	for _, origin := range []string{"https://a.example", "https://b.example", "https://c.example"} {
+		budgets, err := h.BudgetLedger.RemainingWindows(ctx, origin, reportTime, reportTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(budgets) != 1 || budgets[0].Remaining != 0.25 {
+			t.Errorf("expect 0.25 remaining in the window of the reports of %s, got %+v", origin, budgets)
+		}
+	}
+
+	// Another batch with reports of the same origin and window shares the budget.
+	if err := h.chargeBudget(ctx, &query.AggregateRequest{QueryID: "query2", PartialReportURI: batch2, TotalEpsilon: 0.5}); !errors.Is(err, budgetledger.ErrBudgetExceeded) {
+		t.Errorf("expect ErrBudgetExceeded for another batch in the same window, got %v", err)
+	}
+	if err := h.chargeBudget(ctx, &query.AggregateRequest{QueryID: "query3", PartialReportURI: invalid, TotalEpsilon: 0.1}); !errors.Is(err, budgetledger.ErrMissingReportTimes) {
+		t.Errorf("expect error %v without scheduled report times, got %v", budgetledger.ErrMissingReportTimes, err)
+	}
+}
+
+func TestAbortQuery(t *testing.T) {
+	h := &QueryHandler{LevelTimeout: time.Hour}
+	notReady := fmt.Errorf("%w: helper2 for level 0 of query query1", ErrPartnerNotReady)
+	for _, tc := range []struct {
+		desc   string
+		err    error
+		waited time.Duration
+		want   bool
+	}{
+		{"partner result within the level timeout", notReady, time.Minute, false},
+		{"partner result after the level timeout", notReady, 2 * time.Hour, true},
+		{"other errors after the level timeout", errors.New("pipeline failed"), 2 * time.Hour, false},
+		{"injected failures are retried", fmt.Errorf("%w: %s", chaos.ErrInjected, chaos.PartialUpload), 2 * time.Hour, false},
+		{"non-retriable pipeline failure", failurereport.Wrap(failurereport.ClassInvalidArgument, "", errors.New("bad report")), time.Minute, true},
+	} {
+		if got := h.abortQuery(tc.err, tc.waited); got != tc.want {
+			t.Errorf("%s: expect abort %v, got %v", tc.desc, tc.want, got)
+		}
+	}
+
+	h.LevelTimeout = 0
+	if h.abortQuery(notReady, 1000*time.Hour) {
+		t.Error("expect requests to wait for the partner indefinitely without level timeout")
+	}
+}
+
+// fakePipelineScript writes a pipeline binary that writes the partial result and the decrypted reports, and counts its
+// runs in a file.
+func fakePipelineScript(t *testing.T, dir string) (binary, countFile string) {
+	t.Helper()
+	binary, countFile = path.Join(dir, "fake_pipeline.sh"), path.Join(dir, "runs")
+	script := `#!/bin/sh
+for arg in "$@"; do
+  case "$arg" in
+    --partial_histogram_uri=*) echo "partial result of the level" > "${arg#*=}" ;;
+    --decrypted_report_uri=?*) echo "decrypted reports" > "${arg#*=}" ;;
+  esac
+done
+echo run >> ` + countFile + "\n"
+	if err := ioutil.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return binary, countFile
+}
+
+func TestHierarchicalLevelRecovery(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-level-recovery")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	binary, countFile := fakePipelineScript(t, tmpDir)
+	pipelineRuns := func() int {
+		b, err := ioutil.ReadFile(countFile)
+		if os.IsNotExist(err) {
+			return 0
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(b), "run")
+	}
+
+	ctx := context.Background()
+	sharedDir, partnerSharedDir, workspace := path.Join(tmpDir, "shared"), path.Join(tmpDir, "partner"), path.Join(tmpDir, "workspace")
+	for _, dir := range []string{sharedDir, partnerSharedDir, workspace} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := &query.HierarchicalConfig{
+		PrefixLengths:               []int32{2, 4},
+		PrivacyBudgetPerPrefix:      []float64{0.5, 0.5},
+		ExpansionThresholdPerPrefix: []uint64{1, 1},
+	}
+	newRequest := func() *query.AggregateRequest {
+		return &query.AggregateRequest{
+			AggregationType:   query.ConversionType,
+			PartialReportURI:  path.Join(tmpDir, "reports.txt"),
+			QueryID:           "query1",
+			TotalEpsilon:      1,
+			KeyBitSize:        8,
+			PartnerSharedInfo: &query.HelperSharedInfo{Origin: "helper2", SharedDir: partnerSharedDir},
+		}
+	}
+	newHandler := func(rates map[chaos.Fault]float64) *QueryHandler {
+		injector, err := chaos.NewInjector(rates, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &QueryHandler{
+			ServerCfg:      ServerCfg{DpfAggregatePartialReportBinary: binary, WorkspaceURI: workspace},
+			PipelineRunner: "direct",
+			Origin:         "helper1",
+			SharedDir:      sharedDir,
+			Chaos:          injector,
+		}
+	}
+	// The partner helper reads the results of the first level from the shared directory.
+	partnerRequest := newRequest()
+	partnerRequest.QueryLevel = 1
+	partnerRequest.PartnerSharedInfo = &query.HelperSharedInfo{Origin: "helper1", SharedDir: sharedDir, LevelDoneMarkers: true}
+	partner := newHandler(nil)
+	partner.SharedDir = partnerSharedDir
+
+	// The upload of the first-level result is interrupted.
+	if err := newHandler(map[chaos.Fault]float64{chaos.PartialUpload: 1}).aggregatePartialReportHierarchical(ctx, newRequest(), config, false); !errors.Is(err, chaos.ErrInjected) {
+		t.Fatalf("expect error %v for the interrupted upload, got %v", chaos.ErrInjected, err)
+	}
+	if err := partner.aggregatePartialReportHierarchical(ctx, partnerRequest, config, false); !errors.Is(err, ErrPartnerNotReady) {
+		t.Errorf("expect error %v for the incomplete result, got %v", ErrPartnerNotReady, err)
+	}
+
+	// The retry completes the level, and the helper stops before publishing the next-level request.
+	dropping := newHandler(map[chaos.Fault]float64{chaos.DropLevelMessage: 1})
+	if err := dropping.aggregatePartialReportHierarchical(ctx, newRequest(), config, false); !errors.Is(err, chaos.ErrInjected) {
+		t.Fatalf("expect error %v for the dropped message, got %v", chaos.ErrInjected, err)
+	}
+	if got, want := pipelineRuns(), 2; got != want {
+		t.Errorf("expect %d pipeline runs, got %d", want, got)
+	}
+	if done, err := isLevelDone(ctx, sharedDir, "query1", 0); err != nil {
+		t.Fatal(err)
+	} else if !done {
+		t.Error("expect the first level marked as done")
+	}
+	b, err := ioutil.ReadFile(query.GetRequestPartialResultURI(sharedDir, "query1", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "partial result of the level\n"; got != want {
+		t.Errorf("expect the complete result %q after the retry, got %q", want, got)
+	}
+	// A partner without level-done markers only checks that the result exists.
+	if done, err := isPartnerLevelDone(ctx, &query.HelperSharedInfo{SharedDir: sharedDir}, "query1", 0); err != nil {
+		t.Fatal(err)
+	} else if !done {
+		t.Error("expect the first level done for a partner without markers")
+	}
+
+	// The redelivered request does not run the pipeline again.
+	if err := dropping.aggregatePartialReportHierarchical(ctx, newRequest(), config, false); !errors.Is(err, chaos.ErrInjected) {
+		t.Fatalf("expect error %v for the dropped message, got %v", chaos.ErrInjected, err)
+	}
+	if got, want := pipelineRuns(), 2; got != want {
+		t.Errorf("expect %d pipeline runs after the redelivery, got %d", want, got)
+	}
+	if got := dropping.Chaos.Counts()[chaos.DropLevelMessage]; got != 2 {
+		t.Errorf("expect 2 dropped messages, got %d", got)
+	}
+}
+
+type fakeInserter struct {
+	rows []*jobexport.Row
+}
+
+func (f *fakeInserter) Put(ctx context.Context, src interface{}) error {
+	f.rows = append(f.rows, src.(*bigquery.StructSaver).Struct.(*jobexport.Row))
+	return nil
+}
+
+func TestExportJob(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-export-job")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	inserter := &fakeInserter{}
+	h := &QueryHandler{
+		Origin:              "helper1",
+		WriteResultManifest: true,
+		Latency:             latencyslo.NewTracker(nil, nil),
+		JobExport:           jobexport.NewExporter(inserter),
+	}
+	request := &query.AggregateRequest{
+		AggregationType: query.ConversionType,
+		QueryID:         "query1",
+		TotalEpsilon:    1,
+		KeyBitSize:      32,
+		ResultDir:       tmpDir,
+	}
+	launched, done := time.Unix(100, 0).UTC(), time.Unix(200, 0).UTC()
+	h.Latency.Record(ctx, request.QueryID, latencyslo.LevelDoneStep(0), done)
+	h.Latency.Record(ctx, request.QueryID, latencyslo.StepJobLaunched, launched)
+	manifest := &resultmanifest.Manifest{QueryID: request.QueryID, Origin: h.Origin, Files: map[string]string{"b": "hash2", "a": "hash1"}}
+	if err := resultmanifest.Write(ctx, &resultmanifest.SignedManifest{Manifest: manifest}, GetResultManifestURI(tmpDir, request.QueryID, h.Origin)); err != nil {
+		t.Fatal(err)
+	}
+
+	levels := []jobexport.Level{{Epsilon: 1, ReportCount: 10}}
+	h.exportJob(ctx, request, levels, nil)
+	h.exportJob(ctx, request, nil, failurereport.Wrap(failurereport.ClassPrivacyPolicy, failurereport.StageValidate, errors.New("epsilon too large")))
+
+	steps := []jobexport.Step{{Step: latencyslo.StepJobLaunched, Time: launched}, {Step: latencyslo.LevelDoneStep(0), Time: done}}
+	want := []*jobexport.Row{
+		{
+			QueryID:         "query1",
+			Origin:          "helper1",
+			AggregationType: query.ConversionType,
+			Status:          jobexport.StatusComplete,
+			TotalEpsilon:    1,
+			KeyBitSize:      32,
+			ResultURI:       GetFinalPartialResultURI(tmpDir, "query1", "helper1"),
+			ResultFiles:     []jobexport.ResultFile{{Name: "a", SHA256: "hash1"}, {Name: "b", SHA256: "hash2"}},
+			Levels:          levels,
+			Steps:           steps,
+		},
+		{
+			QueryID:         "query1",
+			Origin:          "helper1",
+			AggregationType: query.ConversionType,
+			Status:          jobexport.StatusAborted,
+			ErrorClass:      string(failurereport.ClassPrivacyPolicy),
+			Error:           "privacy_policy failure in stage validate: epsilon too large",
+			TotalEpsilon:    1,
+			KeyBitSize:      32,
+			Steps:           steps,
+		},
+	}
+	if diff := cmp.Diff(want, inserter.rows, cmpopts.IgnoreFields(jobexport.Row{}, "ExportTime")); diff != "" {
+		t.Errorf("exported rows mismatch (-want +got):\n%s", diff)
+	}
+}
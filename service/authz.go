@@ -0,0 +1,316 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package authz authorizes the requests to the HTTP APIs of the helper servers with roles.
+//
+// The caller is identified by the claims of its OIDC ID token, or by its client certificate when the server terminates
+// mutual TLS. A policy maps the identities to the roles viewer, submitter and admin, where each role includes the
+// permissions of the roles before it: viewers read the status of the jobs and the budgets, submitters also submit
+// queries and record their steps, and admins also change the budgets, the runtime configuration and the serving mode.
+// The handlers find the authorized caller in the context of the request, e.g. to only let the owner of a query template
+// or an admin change it.
+//
+// Without a policy, the APIs fail closed: only the requests that require no role are served.
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/golang/glog"
+	"google.golang.org/api/idtoken"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+// Role is the level of access to the APIs.
+type Role int
+
+// Roles in the increasing order of access.
+const (
+	RoleNone Role = iota
+	RoleViewer
+	RoleSubmitter
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{RoleNone: "none", RoleViewer: "viewer", RoleSubmitter: "submitter", RoleAdmin: "admin"}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole parses the role names "viewer", "submitter" and "admin".
+func ParseRole(s string) (Role, error) {
+	for role, name := range roleNames {
+		if role != RoleNone && name == s {
+			return role, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %q", s)
+}
+
+// Attributes of the identities from the client certificates. The attributes from the OIDC tokens are named after their
+// claims, e.g. "email", "hd" or "sub".
+const (
+	CertCommonName = "cert_cn"
+	CertURI        = "cert_uri"
+	CertDNSName    = "cert_dns"
+)
+
+// Identity contains the attributes of a caller, each with one or more values.
+type Identity struct {
+	Attributes map[string][]string
+}
+
+// String returns the first of the email, the subject or the certificate name of the identity, for the logs.
+func (i *Identity) String() string {
+	for _, name := range []string{"email", "sub", CertURI, CertCommonName} {
+		if values := i.Attributes[name]; len(values) > 0 {
+			return values[0]
+		}
+	}
+	return "unknown"
+}
+
+// Principal returns the first of the email, the subject or the certificate URI or name of the identity in the format of
+// the policy members, e.g. "email:analyst@example.com", which identifies the owner of a resource. It is empty if the
+// identity has none of them.
+func (i *Identity) Principal() string {
+	for _, name := range []string{"email", "sub", CertURI, CertCommonName} {
+		if values := i.Attributes[name]; len(values) > 0 {
+			return name + ":" + values[0]
+		}
+	}
+	return ""
+}
+
+// IdentityFromClaims creates the identity from the claims of an OIDC token. The string claims and the string items of
+// the list claims, like the groups, are kept.
+func IdentityFromClaims(claims map[string]interface{}) *Identity {
+	id := &Identity{Attributes: make(map[string][]string)}
+	for name, value := range claims {
+		switch v := value.(type) {
+		case string:
+			id.Attributes[name] = append(id.Attributes[name], v)
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					id.Attributes[name] = append(id.Attributes[name], s)
+				}
+			}
+		}
+	}
+	// Unverified emails can not identify the caller.
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		delete(id.Attributes, "email")
+	}
+	return id
+}
+
+// IdentityFromRequest creates the identity from the verified client certificate of a mutual TLS connection, or returns
+// nil if there is none.
+func IdentityFromRequest(req *http.Request) *Identity {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	id := &Identity{Attributes: make(map[string][]string)}
+	if cert.Subject.CommonName != "" {
+		id.Attributes[CertCommonName] = []string{cert.Subject.CommonName}
+	}
+	for _, uri := range cert.URIs {
+		id.Attributes[CertURI] = append(id.Attributes[CertURI], uri.String())
+	}
+	id.Attributes[CertDNSName] = append(id.Attributes[CertDNSName], cert.DNSNames...)
+	return id
+}
+
+// Binding grants a role to the members, in the format "attribute:value", e.g. "email:analyst@example.com",
+// "hd:example.com", "groups:analysts" or "cert_uri:spiffe://example.com/helper".
+type Binding struct {
+	Role    string
+	Members []string
+}
+
+// Policy maps the identities to their roles.
+type Policy struct {
+	Bindings []*Binding
+
+	members map[string]Role
+}
+
+// ParsePolicy parses the JSON-encoded policy and validates the roles and the members.
+func ParsePolicy(b []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	p.members = make(map[string]Role)
+	for _, binding := range p.Bindings {
+		role, err := ParseRole(binding.Role)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range binding.Members {
+			if kv := strings.SplitN(member, ":", 2); len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, fmt.Errorf("expect member in format attribute:value, got %q", member)
+			}
+			if role > p.members[member] {
+				p.members[member] = role
+			}
+		}
+	}
+	return p, nil
+}
+
+// ReadPolicy reads the JSON-encoded policy from a file.
+func ReadPolicy(ctx context.Context, uri string) (*Policy, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePolicy(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %q: %v", uri, err)
+	}
+	return p, nil
+}
+
+// Role returns the highest role granted to any attribute of the identity.
+func (p *Policy) Role(id *Identity) Role {
+	role := RoleNone
+	for name, values := range id.Attributes {
+		for _, value := range values {
+			if r := p.members[name+":"+value]; r > role {
+				role = r
+			}
+		}
+	}
+	return role
+}
+
+// MethodRoles contains the role required for each HTTP method of an API. The role of the empty method is required
+// for the methods not listed.
+type MethodRoles map[string]Role
+
+// ViewerRoles requires the viewer role to read and the admin role to change, e.g. for the admin APIs.
+var ViewerRoles = MethodRoles{http.MethodGet: RoleViewer, "": RoleAdmin}
+
+// Authorizer checks the roles of the callers of the APIs.
+type Authorizer struct {
+	Policy *Policy
+	// VerifyToken verifies an OIDC ID token and returns its claims, e.g. with idtoken.Validate for the Google-signed
+	// tokens. Only the client certificates identify the callers if nil.
+	VerifyToken func(ctx context.Context, token string) (map[string]interface{}, error)
+}
+
+// NewAuthorizer creates the authorizer with the policy in the file, which verifies the Google-signed OIDC ID tokens for
+// the audience if it is not empty. It returns nil without a policy, which fails closed in Require.
+func NewAuthorizer(ctx context.Context, policyURI, audience string) (*Authorizer, error) {
+	if policyURI == "" {
+		return nil, nil
+	}
+	policy, err := ReadPolicy(ctx, policyURI)
+	if err != nil {
+		return nil, err
+	}
+	a := &Authorizer{Policy: policy}
+	if audience != "" {
+		a.VerifyToken = func(ctx context.Context, token string) (map[string]interface{}, error) {
+			payload, err := idtoken.Validate(ctx, token, audience)
+			if err != nil {
+				return nil, err
+			}
+			return payload.Claims, nil
+		}
+	}
+	return a, nil
+}
+
+// ErrUnauthenticated is returned when a request has neither a client certificate nor a valid bearer token.
+var ErrUnauthenticated = errors.New("caller not authenticated")
+
+// Identify returns the identity of the caller from the client certificate, or from the bearer token if there is no
+// certificate.
+func (a *Authorizer) Identify(req *http.Request) (*Identity, error) {
+	if id := IdentityFromRequest(req); id != nil {
+		return id, nil
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || a.VerifyToken == nil {
+		return nil, ErrUnauthenticated
+	}
+	claims, err := a.VerifyToken(req.Context(), strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	return IdentityFromClaims(claims), nil
+}
+
+// Caller is the caller of a request authorized by Require.
+type Caller struct {
+	Identity *Identity
+	Role     Role
+}
+
+type callerKey struct{}
+
+// CallerFromContext returns the caller authorized by Require, or nil if the request did not require a role.
+func CallerFromContext(ctx context.Context) *Caller {
+	caller, _ := ctx.Value(callerKey{}).(*Caller)
+	return caller
+}
+
+// Require wraps the handler so it only serves the callers with the role required for the method of the request, and
+// adds the caller to the context of the request. A nil Authorizer has no policy, and only serves the requests that
+// require no role, so the APIs behind a role are never open.
+func (a *Authorizer) Require(roles MethodRoles, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		required, ok := roles[req.Method]
+		if !ok {
+			required = roles[""]
+		}
+		if a == nil {
+			if required > RoleNone {
+				http.Error(w, fmt.Sprintf("role %s required, but no authorization policy is configured", required), http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, req)
+			return
+		}
+		if required == RoleNone {
+			h.ServeHTTP(w, req)
+			return
+		}
+		id, err := a.Identify(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		role := a.Policy.Role(id)
+		if role < required {
+			log.Warningf("%s %s denied to %s with role %s, which requires %s", req.Method, req.URL.Path, id, role, required)
+			http.Error(w, fmt.Sprintf("role %s required", required), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), callerKey{}, &Caller{Identity: id, Role: role})))
+	})
+}
@@ -0,0 +1,206 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const testPolicy = `{
+  "Bindings": [
+    {"Role": "viewer", "Members": ["hd:example.com"]},
+    {"Role": "submitter", "Members": ["groups:analysts", "cert_uri:spiffe://partner.example/helper"]},
+    {"Role": "admin", "Members": ["email:admin@example.com"]}
+  ]
+}`
+
+func TestParseRole(t *testing.T) {
+	for _, want := range []Role{RoleViewer, RoleSubmitter, RoleAdmin} {
+		got, err := ParseRole(want.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("expect role %s, got %s", want, got)
+		}
+	}
+	for _, s := range []string{"", "none", "owner"} {
+		if _, err := ParseRole(s); err == nil {
+			t.Errorf("expect error for role %q", s)
+		}
+	}
+}
+
+func TestParsePolicyInvalid(t *testing.T) {
+	for _, policy := range []string{
+		`{"Bindings": [{"Role": "owner", "Members": ["email:a@example.com"]}]}`,
+		`{"Bindings": [{"Role": "viewer", "Members": ["a@example.com"]}]}`,
+		`{"Bindings": [{"Role": "viewer", "Members": ["email:"]}]}`,
+		`{"Bindings": [`,
+	} {
+		if _, err := ParsePolicy([]byte(policy)); err == nil {
+			t.Errorf("expect error for policy %s", policy)
+		}
+	}
+}
+
+func TestPolicyRole(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		claims map[string]interface{}
+		want   Role
+	}{
+		{claims: map[string]interface{}{"email": "someone@other.com"}, want: RoleNone},
+		{claims: map[string]interface{}{"email": "viewer@example.com", "hd": "example.com"}, want: RoleViewer},
+		{claims: map[string]interface{}{"hd": "example.com", "groups": []interface{}{"marketing", "analysts"}}, want: RoleSubmitter},
+		{claims: map[string]interface{}{"email": "admin@example.com", "hd": "example.com"}, want: RoleAdmin},
+		{claims: map[string]interface{}{"email": "admin@example.com", "email_verified": false}, want: RoleNone},
+	} {
+		if got := policy.Role(IdentityFromClaims(tc.claims)); got != tc.want {
+			t.Errorf("expect role %s for claims %v, got %s", tc.want, tc.claims, got)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := map[string]map[string]interface{}{
+		"viewer":    {"email": "viewer@example.com", "hd": "example.com"},
+		"submitter": {"email": "analyst@example.com", "groups": []interface{}{"analysts"}},
+		"admin":     {"email": "admin@example.com"},
+	}
+	authorizer := &Authorizer{
+		Policy: policy,
+		VerifyToken: func(_ context.Context, token string) (map[string]interface{}, error) {
+			if claims, ok := tokens[token]; ok {
+				return claims, nil
+			}
+			return nil, errors.New("invalid token")
+		},
+	}
+	handler := authorizer.Require(MethodRoles{http.MethodGet: RoleViewer, http.MethodPost: RoleSubmitter, "": RoleAdmin},
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	for _, tc := range []struct {
+		method, token string
+		want          int
+	}{
+		{method: http.MethodGet, want: http.StatusUnauthorized},
+		{method: http.MethodGet, token: "forged", want: http.StatusUnauthorized},
+		{method: http.MethodGet, token: "viewer", want: http.StatusOK},
+		{method: http.MethodPost, token: "viewer", want: http.StatusForbidden},
+		{method: http.MethodPost, token: "submitter", want: http.StatusOK},
+		{method: http.MethodDelete, token: "submitter", want: http.StatusForbidden},
+		{method: http.MethodDelete, token: "admin", want: http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, "/query_templates", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("expect status %d for %s with token %q, got %d", tc.want, tc.method, tc.token, w.Code)
+		}
+	}
+}
+
+func TestRequireClientCertificate(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := (&Authorizer{Policy: policy}).Require(MethodRoles{"": RoleSubmitter},
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	for _, tc := range []struct {
+		uri  string
+		want int
+	}{
+		{uri: "spiffe://partner.example/helper", want: http.StatusOK},
+		{uri: "spiffe://other.example/helper", want: http.StatusForbidden},
+	} {
+		u, err := url.Parse(tc.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/latency_slo", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+			{Subject: pkix.Name{CommonName: "helper"}, URIs: []*url.URL{u}},
+		}}}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("expect status %d for certificate %s, got %d", tc.want, tc.uri, w.Code)
+		}
+	}
+}
+
+func TestRequireNilAuthorizer(t *testing.T) {
+	var authorizer *Authorizer
+	handler := authorizer.Require(ViewerRoles, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	for method, want := range map[string]int{http.MethodGet: http.StatusForbidden, http.MethodPost: http.StatusForbidden} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/admin/readonly", nil))
+		if w.Code != want {
+			t.Errorf("expect status %d for %s without authorizer, got %d", want, method, w.Code)
+		}
+	}
+
+	// Only the requests that require no role are served.
+	open := authorizer.Require(MethodRoles{"": RoleNone}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	w := httptest.NewRecorder()
+	open.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expect status %d for a request that requires no role, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestCallerFromContext(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer := &Authorizer{
+		Policy: policy,
+		VerifyToken: func(_ context.Context, token string) (map[string]interface{}, error) {
+			return map[string]interface{}{"email": token, "groups": []interface{}{"analysts"}}, nil
+		},
+	}
+	var got *Caller
+	handler := authorizer.Require(MethodRoles{"": RoleSubmitter}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = CallerFromContext(req.Context())
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/query_templates", nil)
+	req.Header.Set("Authorization", "Bearer analyst@example.com")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got == nil || got.Role != RoleSubmitter || got.Identity.Principal() != "email:analyst@example.com" {
+		t.Errorf("expect submitter email:analyst@example.com in the context, got %+v", got)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package batchintegrity checks that the two helpers received the same reports for a batch before any privacy budget
+// is spent on it.
+//
+// Each helper computes a digest over the IDs of the reports in its input, and writes it into its shared directory. The
+// aggregation only starts when the digest from the partner helper is the same.
+//
+// The digest is the root of a Merkle tree over the report IDs, in the form of RFC 6962: each report ID is hashed into a
+// leaf, and each inner node hashes its two children, with distinct prefixes for the leaves and the inner nodes. The
+// leaves are sorted by their hashes, so the root does not depend on the order of the reports in the input files, and
+// unlike an additive hash, the tree allows proving that a report is in a batch with the sibling hashes on the path from
+// its leaf to the root. Only the 32-byte leaf hashes are kept in memory, not the reports or their IDs.
+package batchintegrity
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/io/filesystem"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+
+	// The following packages are required to read files from GCS or local.
+	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/gcs"
+	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/local"
+)
+
+// ErrRootMismatch is returned when the helpers received different reports for a batch. Retrying does not help, so the
+// query should be aborted.
+var ErrRootMismatch = errors.New("helpers received different reports")
+
+const (
+	// Name of the digest algorithm, which is exchanged with the root so helpers computing different digests do not take
+	// each other's roots for a mismatch.
+	algorithm = "merkle-sha256"
+	// Maximum length of a line in the input files.
+	maxLineBytes = 16 << 20
+)
+
+// BatchRoot is the digest of the reports in a batch, which is exchanged between the helpers.
+type BatchRoot struct {
+	QueryID     string
+	ReportCount int
+	Algorithm   string
+	// Hex-encoded Merkle root of the report IDs.
+	Root string
+}
+
+// Digest is the order-independent digest of a multiset of report IDs.
+type Digest struct {
+	leaves [][sha256.Size]byte
+}
+
+// Prefixes of the hashed leaves and inner nodes, so a leaf can not be taken for an inner node.
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// Add adds a report ID into the digest. A duplicated ID changes the digest.
+func (d *Digest) Add(id string) {
+	d.leaves = append(d.leaves, sha256.Sum256(append([]byte{leafPrefix}, id...)))
+}
+
+// Sum returns the Merkle root of the report IDs, with the leaves sorted by their hashes. The root of an empty batch is
+// the SHA-256 hash of the empty string.
+func (d *Digest) Sum() []byte {
+	sort.Slice(d.leaves, func(i, j int) bool { return bytes.Compare(d.leaves[i][:], d.leaves[j][:]) < 0 })
+	if len(d.leaves) == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	h := merkleRoot(d.leaves)
+	return h[:]
+}
+
+// merkleRoot returns the root of the tree over the leaves, which splits them at the largest power of two smaller than
+// their number.
+func merkleRoot(leaves [][sha256.Size]byte) [sha256.Size]byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+	left, right := merkleRoot(leaves[:k]), merkleRoot(leaves[k:])
+	b := make([]byte, 0, 1+2*sha256.Size)
+	b = append(append(append(b, nodePrefix), left[:]...), right[:]...)
+	return sha256.Sum256(b)
+}
+
+// Root returns the hex-encoded Merkle root of the digest.
+func (d *Digest) Root() string {
+	return hex.EncodeToString(d.Sum())
+}
+
+// Count returns the number of report IDs added into the digest.
+func (d *Digest) Count() int {
+	return len(d.leaves)
+}
+
+// DigestReports computes the digest over the IDs of the encrypted partial reports in the files matching the globs. The
+// files are read line by line.
+func DigestReports(ctx context.Context, globs ...string) (*Digest, error) {
+	digest := &Digest{}
+	for _, glob := range globs {
+		if err := ScanSharedInfo(ctx, glob, func(sharedInfo string) error {
+			digest.Add(reporttypes.GetReportID(sharedInfo))
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return digest, nil
+}
+
+// ScanSharedInfo calls the function with the shared info of each encrypted partial report in the files matching the
+// glob. The files are read line by line, so the reports are never held in memory at once.
+func ScanSharedInfo(ctx context.Context, glob string, fn func(sharedInfo string) error) error {
+	fs, err := filesystem.New(ctx, glob)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	files, err := fs.List(ctx, glob)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := scanFile(ctx, fs, f, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanFile(ctx context.Context, fs filesystem.Interface, f string, fn func(sharedInfo string) error) error {
+	r, err := fs.OpenRead(ctx, f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineBytes)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		payload, err := reporttypes.DeserializeAggregatablePayload(line)
+		if err != nil {
+			return fmt.Errorf("failed to parse report in %s: %v", f, err)
+		}
+		if err := fn(payload.GetSharedInfo()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// NewBatchRoot creates the root for the digest of the reports of a query.
+func NewBatchRoot(queryID string, digest *Digest) *BatchRoot {
+	return &BatchRoot{QueryID: queryID, ReportCount: digest.Count(), Algorithm: algorithm, Root: digest.Root()}
+}
+
+// WriteBatchRoot saves the root into a file.
+func WriteBatchRoot(ctx context.Context, root *BatchRoot, uri string) error {
+	b, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+	return utils.WriteBytes(ctx, b, uri, nil)
+}
+
+// ReadBatchRoot reads the root from a file.
+func ReadBatchRoot(ctx context.Context, uri string) (*BatchRoot, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	root := &BatchRoot{}
+	if err := json.Unmarshal(b, root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// Compare returns ErrRootMismatch if the roots of the two helpers are different.
+func Compare(own, partner *BatchRoot) error {
+	if own.QueryID != partner.QueryID {
+		return fmt.Errorf("expect root for query %q from partner, got %q", own.QueryID, partner.QueryID)
+	}
+	if own.Algorithm != partner.Algorithm {
+		return fmt.Errorf("expect root computed with %q from partner, got %q", own.Algorithm, partner.Algorithm)
+	}
+	if own.ReportCount != partner.ReportCount || own.Root != partner.Root {
+		return fmt.Errorf("%w for query %q: %d reports with root %s, partner has %d reports with root %s",
+			ErrRootMismatch, own.QueryID, own.ReportCount, own.Root, partner.ReportCount, partner.Root)
+	}
+	return nil
+}
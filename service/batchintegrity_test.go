@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package batchintegrity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func newDigest(ids ...string) *Digest {
+	d := &Digest{}
+	for _, id := range ids {
+		d.Add(id)
+	}
+	return d
+}
+
+func TestDigest(t *testing.T) {
+	sum := newDigest("report1", "report2", "report3").Sum()
+	if got := newDigest("report3", "report1", "report2").Sum(); !bytes.Equal(sum, got) {
+		t.Error("expect the same digest for the same reports in a different order")
+	}
+	if got := newDigest("report1", "report2").Sum(); bytes.Equal(sum, got) {
+		t.Error("expect a different digest for a subset of the reports")
+	}
+	if got := newDigest("report1", "report2", "report3", "report3").Sum(); bytes.Equal(sum, got) {
+		t.Error("expect a different digest for duplicated reports")
+	}
+	if got := len(newDigest().Sum()); got != 32 {
+		t.Errorf("expect a 32-byte digest for an empty batch, got %d bytes", got)
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	leaf := func(id string) []byte {
+		h := sha256.Sum256(append([]byte{0x00}, id...))
+		return h[:]
+	}
+	node := func(left, right []byte) []byte {
+		h := sha256.Sum256(append(append([]byte{0x01}, left...), right...))
+		return h[:]
+	}
+	if got, want := newDigest("a").Sum(), leaf("a"); !bytes.Equal(got, want) {
+		t.Errorf("expect the leaf hash as the root of one report, got %x, want %x", got, want)
+	}
+
+	// The leaves are sorted by their hashes, and split at the largest power of two smaller than their number.
+	leaves := [][]byte{leaf("a"), leaf("b"), leaf("c")}
+	for i := range leaves {
+		for j := i + 1; j < len(leaves); j++ {
+			if bytes.Compare(leaves[j], leaves[i]) < 0 {
+				leaves[i], leaves[j] = leaves[j], leaves[i]
+			}
+		}
+	}
+	want := node(node(leaves[0], leaves[1]), leaves[2])
+	if got := newDigest("c", "a", "b").Sum(); !bytes.Equal(got, want) {
+		t.Errorf("expect Merkle root %x, got %x", want, got)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	own := NewBatchRoot("query", newDigest("a", "b"))
+	if err := Compare(own, NewBatchRoot("query", newDigest("b", "a"))); err != nil {
+		t.Errorf("expect no error for the same reports, got %v", err)
+	}
+	if err := Compare(own, NewBatchRoot("query", newDigest("a", "c"))); !errors.Is(err, ErrRootMismatch) {
+		t.Errorf("expect ErrRootMismatch for different reports, got %v", err)
+	}
+	if err := Compare(own, NewBatchRoot("other", newDigest("a", "b"))); err == nil || errors.Is(err, ErrRootMismatch) {
+		t.Errorf("expect error for roots of different queries, got %v", err)
+	}
+	other := NewBatchRoot("query", newDigest("a", "c"))
+	other.Algorithm = "lthash16-1024"
+	if err := Compare(own, other); err == nil || errors.Is(err, ErrRootMismatch) {
+		t.Errorf("expect error for roots of different algorithms, got %v", err)
+	}
+}
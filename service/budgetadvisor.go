@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package budgetadvisor suggests the privacy budget for a query, so analysts can avoid spending more budget than needed.
+//
+// The aggregation results are noised with the two-sided geometric mechanism, whose standard deviation is
+// sqrt(2p)/(1-p) with p = exp(-epsilon/l1Sensitivity). Given the expected aggregate of a bucket, function SuggestEpsilon()
+// finds the minimum epsilon such that the noise standard deviation is within the desired relative error.
+package budgetadvisor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// SuggestionRequest contains the parameters for suggesting the privacy budget.
+type SuggestionRequest struct {
+	// Desired ratio between the noise standard deviation and the expected aggregate of a bucket.
+	RelativeError float64
+	// Number of reports in the batch that contribute to the bucket.
+	ReportCount uint64
+	// Average value contributed by each report. Zero means 1.
+	AverageValue  float64
+	L1Sensitivity uint64
+	// Share of the total budget spent on the aggregation of interest, e.g. the budget for a prefix length in the
+	// hierarchical query. Zero means 1.
+	BudgetFraction float64
+	// Remaining privacy budget of the batch.
+	RemainingBudget float64
+}
+
+// Suggestion contains the suggested privacy budget.
+type Suggestion struct {
+	// Minimum epsilon for the aggregation of interest.
+	Epsilon float64
+	// Minimum total epsilon for the query, considering the budget fraction.
+	TotalEpsilon float64
+	// Whether the total epsilon is within the remaining budget.
+	WithinBudget bool
+	// Noise standard deviation with the suggested epsilon.
+	NoiseStdDev float64
+}
+
+// NoiseStdDev calculates the standard deviation of the noise from the two-sided geometric mechanism.
+func NoiseStdDev(epsilon float64, l1Sensitivity uint64) float64 {
+	p := math.Exp(-epsilon / float64(l1Sensitivity))
+	return math.Sqrt(2*p) / (1 - p)
+}
+
+func validateRequest(req *SuggestionRequest) error {
+	if req.RelativeError <= 0 {
+		return fmt.Errorf("relative error should be positive, got %v", req.RelativeError)
+	}
+	if req.ReportCount == 0 {
+		return errors.New("expect nonzero report count")
+	}
+	if req.AverageValue < 0 {
+		return fmt.Errorf("average value should be non-negative, got %v", req.AverageValue)
+	}
+	if req.L1Sensitivity == 0 {
+		return errors.New("expect nonzero L1 sensitivity")
+	}
+	if req.BudgetFraction < 0 || req.BudgetFraction > 1 {
+		return fmt.Errorf("budget fraction should be in [0, 1], got %v", req.BudgetFraction)
+	}
+	if req.RemainingBudget < 0 {
+		return fmt.Errorf("remaining budget should be non-negative, got %v", req.RemainingBudget)
+	}
+	return nil
+}
+
+// SuggestEpsilon calculates the minimum epsilon for the desired relative error, and checks it against the remaining budget.
+func SuggestEpsilon(req *SuggestionRequest) (*Suggestion, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	averageValue := req.AverageValue
+	if averageValue == 0 {
+		averageValue = 1
+	}
+	budgetFraction := req.BudgetFraction
+	if budgetFraction == 0 {
+		budgetFraction = 1
+	}
+
+	// Solve sqrt(2p)/(1-p) = s for x = sqrt(p), i.e. s*x^2 + sqrt(2)*x - s = 0.
+	s := req.RelativeError * float64(req.ReportCount) * averageValue
+	x := (math.Sqrt(2+4*s*s) - math.Sqrt2) / (2 * s)
+	epsilon := -2 * float64(req.L1Sensitivity) * math.Log(x)
+	totalEpsilon := epsilon / budgetFraction
+	return &Suggestion{
+		Epsilon:      epsilon,
+		TotalEpsilon: totalEpsilon,
+		WithinBudget: totalEpsilon <= req.RemainingBudget,
+		NoiseStdDev:  NoiseStdDev(epsilon, req.L1Sensitivity),
+	}, nil
+}
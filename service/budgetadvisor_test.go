@@ -0,0 +1,80 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package budgetadvisor
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSuggestEpsilon(t *testing.T) {
+	for _, tc := range []struct {
+		desc         string
+		req          *SuggestionRequest
+		withinBudget bool
+	}{
+		{
+			desc: "within-budget",
+			req: &SuggestionRequest{
+				RelativeError:   0.1,
+				ReportCount:     1000,
+				L1Sensitivity:   1,
+				RemainingBudget: 1,
+			},
+			withinBudget: true,
+		},
+		{
+			desc: "over-budget-with-fraction",
+			req: &SuggestionRequest{
+				RelativeError:   0.01,
+				ReportCount:     100,
+				AverageValue:    2,
+				L1Sensitivity:   4,
+				BudgetFraction:  0.5,
+				RemainingBudget: 1,
+			},
+			withinBudget: false,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := SuggestEpsilon(tc.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			averageValue := tc.req.AverageValue
+			if averageValue == 0 {
+				averageValue = 1
+			}
+			wantStdDev := tc.req.RelativeError * float64(tc.req.ReportCount) * averageValue
+			if math.Abs(got.NoiseStdDev-wantStdDev) > 1e-6*wantStdDev {
+				t.Errorf("expect noise standard deviation %v, got %v", wantStdDev, got.NoiseStdDev)
+			}
+			// Any smaller epsilon gives a larger error.
+			if NoiseStdDev(got.Epsilon*0.99, tc.req.L1Sensitivity) <= wantStdDev {
+				t.Errorf("epsilon %v is not the minimum", got.Epsilon)
+			}
+			if tc.req.BudgetFraction > 0 && got.TotalEpsilon != got.Epsilon/tc.req.BudgetFraction {
+				t.Errorf("expect total epsilon %v, got %v", got.Epsilon/tc.req.BudgetFraction, got.TotalEpsilon)
+			}
+			if got.WithinBudget != tc.withinBudget {
+				t.Errorf("expect within budget %t, got %t with total epsilon %v", tc.withinBudget, got.WithinBudget, got.TotalEpsilon)
+			}
+		})
+	}
+
+	if _, err := SuggestEpsilon(&SuggestionRequest{RelativeError: 0.1, L1Sensitivity: 1}); err == nil {
+		t.Error("expect error for zero report count")
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package budgetledger tracks the privacy budget a helper has spent on each batch of reports.
+//
+// Each batch, identified by the hash of its report files, has a total budget per period. The queries on the batch are
+// charged with their total epsilon when they start, and a query that exceeds the remaining budget is rejected, unless
+// the requester consents to run it at the remaining epsilon instead. The charges are stored as one JSON account file per
+// batch and period in a directory, which can be local or in GCS.
+//
+// Alternatively, the budget is partitioned by the reporting origin and the age of the reports: each window of scheduled
+// report times, e.g. a day or a week, has its own budget for each origin, which is charged with the full epsilon by
+// every query on any report of the origin scheduled in the window, without proration for the queries spanning several
+// windows. The accounts do not depend on how the reports are batched, so a report can not be queried again with a fresh
+// budget by putting it in a new batch. New windows roll over with a fresh budget as time passes, while the budget of
+// the old windows is never renewed.
+package budgetledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+// ErrBudgetExceeded is wrapped by the errors for the queries rejected because of the remaining budget.
+var ErrBudgetExceeded = errors.New("privacy budget exceeded")
+
+// ErrMissingReportTimes is returned when the budget is partitioned by windows and the scheduled times of the reports are
+// unknown.
+var ErrMissingReportTimes = errors.New("scheduled report times unknown")
+
+// ErrTooManyWindows is wrapped by the errors for the budget requests of more than MaxWindows windows.
+var ErrTooManyWindows = errors.New("too many budget windows")
+
+// Charge is the budget spent by a query.
+type Charge struct {
+	QueryID string
+	Epsilon float64
+	// Epsilon requested by the query, when it was run at the remaining epsilon instead. Zero means the query was not
+	// downgraded.
+	RequestedEpsilon float64 `json:",omitempty"`
+	Time             time.Time
+}
+
+// Downgraded returns whether the query runs with less than the requested epsilon.
+func (c *Charge) Downgraded() bool {
+	return c.RequestedEpsilon > 0
+}
+
+// Account contains the charges on a batch in a period, or on the reports of an origin in a window.
+type Account struct {
+	BatchHash string `json:",omitempty"`
+	Origin    string `json:",omitempty"`
+	// Start of the period or the window, which is zero if the budget does not renew.
+	PeriodStart time.Time
+	Charges     []*Charge
+}
+
+// Spent returns the total epsilon charged on the account.
+func (a *Account) Spent() float64 {
+	var spent float64
+	for _, c := range a.Charges {
+		spent += c.Epsilon
+	}
+	return spent
+}
+
+func (a *Account) charge(queryID string) *Charge {
+	for _, c := range a.Charges {
+		if c.QueryID == queryID {
+			return c
+		}
+	}
+	return nil
+}
+
+// Ledger stores the accounts of the batches in a directory. Only one helper should write to the directory, as the
+// accounts are updated without locking the files.
+type Ledger struct {
+	Dir string
+	// Total epsilon of a batch in each period.
+	Budget float64
+	// Length of the periods, aligned to the Unix epoch, after which the budget renews. The budget never renews if zero.
+	Period time.Duration
+	// Length of the windows of scheduled report times, each with its own budget for each reporting origin, e.g. Daily or
+	// Weekly. The windows are aligned to Monday 1970-01-05 00:00 UTC, so the weekly windows start on Mondays. If
+	// positive, the queries are charged with ChargeWindows instead of Charge, and Period is ignored.
+	Window time.Duration
+
+	mu sync.Mutex
+}
+
+// periodStart returns the start of the period containing the time.
+func (l *Ledger) periodStart(now time.Time) time.Time {
+	if l.Period <= 0 {
+		return time.Time{}
+	}
+	return now.UTC().Truncate(l.Period)
+}
+
+func (l *Ledger) accountURI(batchHash string, periodStart time.Time) string {
+	if periodStart.IsZero() {
+		return utils.JoinPath(l.Dir, fmt.Sprintf("%s.json", batchHash))
+	}
+	return utils.JoinPath(l.Dir, fmt.Sprintf("%s_%d.json", batchHash, periodStart.Unix()))
+}
+
+// ReadAccount reads the account of the batch in the period containing the time. The account is empty if nothing has
+// been charged.
+func (l *Ledger) ReadAccount(ctx context.Context, batchHash string, now time.Time) (*Account, error) {
+	periodStart := l.periodStart(now)
+	return readAccount(ctx, l.accountURI(batchHash, periodStart), &Account{BatchHash: batchHash, PeriodStart: periodStart})
+}
+
+// readAccount reads the account from the file, which is the empty account if the file does not exist.
+func readAccount(ctx context.Context, uri string, empty *Account) (*Account, error) {
+	exist, err := utils.IsFileGlobExist(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return empty, nil
+	}
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	account := &Account{}
+	if err := json.Unmarshal(b, account); err != nil {
+		return nil, err
+	}
+	if account.BatchHash != empty.BatchHash || account.Origin != empty.Origin {
+		return nil, fmt.Errorf("budget account %s has mismatched batch hash %q or origin %q", uri, account.BatchHash, account.Origin)
+	}
+	return account, nil
+}
+
+// Remaining returns the epsilon left for the batch in the period containing the time.
+func (l *Ledger) Remaining(ctx context.Context, batchHash string, now time.Time) (float64, error) {
+	account, err := l.ReadAccount(ctx, batchHash, now)
+	if err != nil {
+		return 0, err
+	}
+	return l.remaining(account), nil
+}
+
+func (l *Ledger) remaining(account *Account) float64 {
+	if remaining := l.Budget - account.Spent(); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Charge charges the query with the epsilon on the batch, and returns the charge with the epsilon the query should run
+// with.
+//
+// If the epsilon exceeds the remaining budget, the query is charged with the remaining epsilon when allowPartial is
+// set, and rejected with ErrBudgetExceeded otherwise. A query is only charged once, so the redelivered requests of a
+// query get its existing charge.
+func (l *Ledger) Charge(ctx context.Context, batchHash, queryID string, epsilon float64, allowPartial bool, now time.Time) (*Charge, error) {
+	if epsilon <= 0 {
+		return nil, fmt.Errorf("expect positive epsilon to charge, got %v", epsilon)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	account, err := l.ReadAccount(ctx, batchHash, now)
+	if err != nil {
+		return nil, err
+	}
+	if c := account.charge(queryID); c != nil {
+		return c, nil
+	}
+
+	c := &Charge{QueryID: queryID, Epsilon: epsilon, Time: now.UTC()}
+	if remaining := l.remaining(account); epsilon > remaining {
+		if !allowPartial || remaining == 0 {
+			return nil, fmt.Errorf("%w: query %q requests epsilon %v with %v remaining for batch %s", ErrBudgetExceeded, queryID, epsilon, remaining, batchHash)
+		}
+		c.Epsilon, c.RequestedEpsilon = remaining, epsilon
+	}
+	account.Charges = append(account.Charges, c)
+
+	b, err := json.Marshal(account)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.WriteBytes(ctx, b, l.accountURI(batchHash, account.PeriodStart), nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Window lengths of the usual cadences.
+const (
+	Daily  = 24 * time.Hour
+	Weekly = 7 * Daily
+)
+
+// MaxWindows is the largest number of windows served by RemainingWindows, so a request for a long range of report times
+// doesn't read one account file for each of its windows.
+const MaxWindows = 366
+
+// windowAnchor is the Monday the windows are aligned to.
+var windowAnchor = time.Date(1970, 1, 5, 0, 0, 0, 0, time.UTC)
+
+// ParseWindow parses the window length, which is "daily", "weekly" or a duration like "12h".
+func ParseWindow(s string) (time.Duration, error) {
+	switch s {
+	case "daily":
+		return Daily, nil
+	case "weekly":
+		return Weekly, nil
+	}
+	window, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("expect window daily, weekly or a duration, got %q", s)
+	}
+	if window <= 0 {
+		return 0, fmt.Errorf("expect positive window, got %v", window)
+	}
+	return window, nil
+}
+
+// WindowKey identifies the account of the reports of an origin scheduled in a window.
+type WindowKey struct {
+	Origin string
+	// Start of the window.
+	Start time.Time
+}
+
+// WindowStart returns the start of the window containing the time.
+func (l *Ledger) WindowStart(t time.Time) time.Time {
+	d := t.Sub(windowAnchor)
+	start := d.Truncate(l.Window)
+	if start > d {
+		start -= l.Window
+	}
+	return windowAnchor.Add(start).UTC()
+}
+
+func (l *Ledger) windowAccountURI(key WindowKey) string {
+	return utils.JoinPath(l.Dir, fmt.Sprintf("window_%s_%d.json", url.QueryEscape(key.Origin), key.Start.Unix()))
+}
+
+func (l *Ledger) readWindowAccount(ctx context.Context, key WindowKey) (*Account, error) {
+	return readAccount(ctx, l.windowAccountURI(key), &Account{Origin: key.Origin, PeriodStart: key.Start})
+}
+
+// ChargeWindows charges the query with the epsilon on the windows of its reports, and returns the charge with the
+// epsilon the query should run with. Each window with at least one report of the query is charged with the full
+// epsilon, as every report contributes to the result with the full epsilon.
+//
+// A query whose reports straddle a window boundary is not prorated between the windows. A report has one scheduled
+// time, so it is in exactly one window, and charging each window with a share of the epsilon, e.g. by its share of the
+// reports, would account less than the epsilon every report of the window is exposed with.
+//
+// The query exceeds the budget if the epsilon exceeds the remaining budget of any window. It is then charged with the
+// largest epsilon all the windows can afford when allowPartial is set, and rejected with ErrBudgetExceeded otherwise. A
+// query is only charged once on each window, so the redelivered requests of a query get its existing charge, and
+// complete the charges that were not written.
+func (l *Ledger) ChargeWindows(ctx context.Context, queryID string, epsilon float64, windows []WindowKey, allowPartial bool, now time.Time) (*Charge, error) {
+	if l.Window <= 0 {
+		return nil, errors.New("budget windows are not enabled")
+	}
+	if epsilon <= 0 {
+		return nil, fmt.Errorf("expect positive epsilon to charge, got %v", epsilon)
+	}
+	if len(windows) == 0 {
+		return nil, ErrMissingReportTimes
+	}
+	keys := make(map[WindowKey]bool)
+	for _, w := range windows {
+		keys[WindowKey{Origin: w.Origin, Start: l.WindowStart(w.Start)}] = true
+	}
+	var sorted []WindowKey
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Origin != sorted[j].Origin {
+			return sorted[i].Origin < sorted[j].Origin
+		}
+		return sorted[i].Start.Before(sorted[j].Start)
+	})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	accounts := make(map[WindowKey]*Account)
+	var existing *Charge
+	affordable := math.Inf(1)
+	for _, key := range sorted {
+		account, err := l.readWindowAccount(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		accounts[key] = account
+		if c := account.charge(queryID); c != nil {
+			existing = c
+		}
+		if a := l.remaining(account); a < affordable {
+			affordable = a
+		}
+	}
+
+	c := &Charge{QueryID: queryID, Epsilon: epsilon, Time: now.UTC()}
+	if existing != nil {
+		c.Epsilon, c.RequestedEpsilon, c.Time = existing.Epsilon, existing.RequestedEpsilon, existing.Time
+	} else if epsilon > affordable {
+		if !allowPartial || affordable == 0 {
+			return nil, fmt.Errorf("%w: query %q requests epsilon %v with %v affordable on the windows of its reports", ErrBudgetExceeded, queryID, epsilon, affordable)
+		}
+		c.Epsilon, c.RequestedEpsilon = affordable, epsilon
+	}
+
+	for _, key := range sorted {
+		account := accounts[key]
+		if account.charge(queryID) != nil {
+			continue
+		}
+		windowCharge := *c
+		account.Charges = append(account.Charges, &windowCharge)
+		b, err := json.Marshal(account)
+		if err != nil {
+			return nil, err
+		}
+		if err := utils.WriteBytes(ctx, b, l.windowAccountURI(key), nil); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// WindowBudget is the budget of the reports of an origin in a window.
+type WindowBudget struct {
+	Start     time.Time
+	End       time.Time
+	Spent     float64
+	Remaining float64
+}
+
+// RemainingWindows returns the budget of the reports of the origin in each window overlapping [from, to], which must
+// overlap no more than MaxWindows windows.
+func (l *Ledger) RemainingWindows(ctx context.Context, origin string, from, to time.Time) ([]*WindowBudget, error) {
+	if l.Window <= 0 {
+		return nil, errors.New("budget windows are not enabled")
+	}
+	if to.Before(from) {
+		return nil, fmt.Errorf("expect end %v not before start %v", to, from)
+	}
+	first := l.WindowStart(from)
+	// The duration saturates for ranges beyond ~292 years, which still exceed the limit.
+	if to.Sub(first)/l.Window >= MaxWindows {
+		return nil, fmt.Errorf("%w: range [%v, %v] overlaps more than %d windows of %v", ErrTooManyWindows, from, to, MaxWindows, l.Window)
+	}
+	var budgets []*WindowBudget
+	for start := first; !start.After(to); start = start.Add(l.Window) {
+		account, err := l.readWindowAccount(ctx, WindowKey{Origin: origin, Start: start})
+		if err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, &WindowBudget{
+			Start:     start,
+			End:       start.Add(l.Window).UTC(),
+			Spent:     account.Spent(),
+			Remaining: l.remaining(account),
+		})
+	}
+	return budgets, nil
+}
+
+// Handler serves the remaining budget of the reports of an origin in each window.
+//
+// The request has the form values "origin" for the reporting origin, and "start" and "end" in RFC 3339 for the range of
+// report times, which is the current window if empty. The response is a JSON list of WindowBudget. A range overlapping
+// more than MaxWindows windows is rejected.
+type Handler struct {
+	Ledger *Ledger
+
+	now func() time.Time
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := req.Context()
+	origin := req.FormValue("origin")
+	if origin == "" {
+		http.Error(w, "origin is required", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now
+	if h.now != nil {
+		now = h.now
+	}
+	from, to := now(), now()
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"start", &from}, {"end", &to}} {
+		v := req.FormValue(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s: %v", p.name, err), http.StatusBadRequest)
+			return
+		}
+		*p.t = t
+	}
+
+	budgets, err := h.Ledger.RemainingWindows(ctx, origin, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(budgets); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
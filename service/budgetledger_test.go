@@ -0,0 +1,247 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package budgetledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCharge(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-budget-ledger")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	ledger := &Ledger{Dir: tmpDir, Budget: 1, Period: 24 * time.Hour}
+	now := time.Date(2021, 10, 4, 12, 0, 0, 0, time.UTC)
+
+	c, err := ledger.Charge(ctx, "batch1", "query1", 0.75, false /*allowPartial*/, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Epsilon != 0.75 || c.Downgraded() {
+		t.Errorf("expect full charge of 0.75, got %+v", c)
+	}
+
+	// A redelivered request gets the existing charge.
+	if c, err := ledger.Charge(ctx, "batch1", "query1", 0.75, false /*allowPartial*/, now); err != nil {
+		t.Fatal(err)
+	} else if c.Epsilon != 0.75 {
+		t.Errorf("expect the existing charge of 0.75, got %+v", c)
+	}
+
+	if _, err := ledger.Charge(ctx, "batch1", "query2", 0.5, false /*allowPartial*/, now); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expect ErrBudgetExceeded without consent, got %v", err)
+	}
+	c, err = ledger.Charge(ctx, "batch1", "query2", 0.5, true /*allowPartial*/, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Downgraded() || c.Epsilon != 0.25 || c.RequestedEpsilon != 0.5 {
+		t.Errorf("expect the query downgraded from 0.5 to 0.25, got %+v", c)
+	}
+
+	// Nothing is left to run the query with.
+	if _, err := ledger.Charge(ctx, "batch1", "query3", 0.5, true /*allowPartial*/, now); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expect ErrBudgetExceeded for the spent budget, got %v", err)
+	}
+
+	// Other batches and the next period have their own budget.
+	for _, tc := range []struct {
+		batchHash string
+		now       time.Time
+	}{
+		{"batch2", now},
+		{"batch1", now.Add(24 * time.Hour)},
+	} {
+		remaining, err := ledger.Remaining(ctx, tc.batchHash, tc.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remaining != 1 {
+			t.Errorf("expect full budget for batch %q at %v, got %v", tc.batchHash, tc.now, remaining)
+		}
+	}
+	if remaining, err := ledger.Remaining(ctx, "batch1", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if remaining != 0 {
+		t.Errorf("expect no budget left in the same period, got %v", remaining)
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	for s, want := range map[string]time.Duration{"daily": Daily, "weekly": Weekly, "12h": 12 * time.Hour} {
+		got, err := ParseWindow(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("expect window %v for %q, got %v", want, s, got)
+		}
+	}
+	for _, s := range []string{"monthly", "-1h", "0s"} {
+		if _, err := ParseWindow(s); err == nil {
+			t.Errorf("expect error for window %q", s)
+		}
+	}
+}
+
+func TestWindowStart(t *testing.T) {
+	ledger := &Ledger{Window: Weekly}
+	// 2021-10-07 is a Thursday, in the week starting on Monday 2021-10-04.
+	if got, want := ledger.WindowStart(time.Date(2021, 10, 7, 15, 0, 0, 0, time.UTC)), time.Date(2021, 10, 4, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("expect weekly window start %v, got %v", want, got)
+	}
+	ledger.Window = Daily
+	if got, want := ledger.WindowStart(time.Date(2021, 10, 7, 15, 0, 0, 0, time.UTC)), time.Date(2021, 10, 7, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("expect daily window start %v, got %v", want, got)
+	}
+}
+
+func TestChargeWindows(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-budget-windows")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	day := time.Date(2021, 10, 4, 0, 0, 0, 0, time.UTC)
+	now := day.Add(3 * Daily)
+	ledger := &Ledger{Dir: tmpDir, Budget: 1, Window: Daily}
+	// The reports of the first query are scheduled in both days.
+	bothDays := []WindowKey{{Origin: "origin1", Start: day.Add(18 * time.Hour)}, {Origin: "origin1", Start: day.Add(30 * time.Hour)}}
+	secondDay := []WindowKey{{Origin: "origin1", Start: day.Add(42 * time.Hour)}}
+
+	c, err := ledger.ChargeWindows(ctx, "query1", 0.5, bothDays, false /*allowPartial*/, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Epsilon != 0.5 || c.Downgraded() {
+		t.Errorf("expect full charge of 0.5, got %+v", c)
+	}
+	// A redelivered request gets the existing charge, and charges nothing more.
+	if _, err := ledger.ChargeWindows(ctx, "query1", 0.5, bothDays, false /*allowPartial*/, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every window with reports is charged with the full epsilon.
+	budgets, err := ledger.RemainingWindows(ctx, "origin1", day, day.Add(30*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remaining []float64
+	for _, b := range budgets {
+		remaining = append(remaining, b.Remaining)
+	}
+	if diff := cmp.Diff([]float64{0.5, 0.5}, remaining); diff != "" {
+		t.Errorf("remaining budget mismatch (-want +got):\n%s", diff)
+	}
+	// Other origins have their own budget.
+	if budgets, err := ledger.RemainingWindows(ctx, "origin2", day, day); err != nil {
+		t.Fatal(err)
+	} else if budgets[0].Remaining != 1 {
+		t.Errorf("expect full budget for another origin, got %+v", budgets[0])
+	}
+
+	// The range of windows is bounded.
+	if _, err := ledger.RemainingWindows(ctx, "origin1", day, day.Add(MaxWindows*Daily-time.Nanosecond)); err != nil {
+		t.Errorf("expect %d windows served, got error %v", MaxWindows, err)
+	}
+	if _, err := ledger.RemainingWindows(ctx, "origin1", day, day.Add(MaxWindows*Daily)); !errors.Is(err, ErrTooManyWindows) {
+		t.Errorf("expect ErrTooManyWindows for %d windows, got %v", MaxWindows+1, err)
+	}
+
+	if _, err := ledger.ChargeWindows(ctx, "query2", 1, secondDay, false /*allowPartial*/, now); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expect ErrBudgetExceeded without consent, got %v", err)
+	}
+	c, err = ledger.ChargeWindows(ctx, "query2", 1, secondDay, true /*allowPartial*/, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Epsilon != 0.5 || c.RequestedEpsilon != 1 {
+		t.Errorf("expect the query downgraded from 1 to 0.5, got %+v", c)
+	}
+
+	if _, err := ledger.ChargeWindows(ctx, "query3", 0.1, nil, false /*allowPartial*/, now); !errors.Is(err, ErrMissingReportTimes) {
+		t.Errorf("expect error %v without report times, got %v", ErrMissingReportTimes, err)
+	}
+}
+
+func TestWindowsHandler(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-budget-handler")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	day := time.Date(2021, 10, 4, 0, 0, 0, 0, time.UTC)
+	ledger := &Ledger{Dir: tmpDir, Budget: 1, Window: Daily}
+	if _, err := ledger.ChargeWindows(ctx, "query1", 0.25, []WindowKey{{Origin: "https://a.example", Start: day}}, false /*allowPartial*/, day); err != nil {
+		t.Fatal(err)
+	}
+	handler := &Handler{
+		Ledger: ledger,
+		now:    func() time.Time { return day.Add(time.Hour) },
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []*WindowBudget
+	}{
+		{"origin=https%3A%2F%2Fa.example", []*WindowBudget{{Start: day, End: day.Add(Daily), Spent: 0.25, Remaining: 0.75}}},
+		{"origin=https%3A%2F%2Fa.example&end=2021-10-05T00:00:00Z", []*WindowBudget{
+			{Start: day, End: day.Add(Daily), Spent: 0.25, Remaining: 0.75},
+			{Start: day.Add(Daily), End: day.Add(2 * Daily), Remaining: 1},
+		}},
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/budget_windows?"+tc.query, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expect status OK for %q, got %d: %s", tc.query, recorder.Code, recorder.Body)
+		}
+		var got []*WindowBudget
+		if err := json.NewDecoder(recorder.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("window budgets mismatch for %q (-want +got):\n%s", tc.query, diff)
+		}
+	}
+
+	for desc, query := range map[string]string{
+		"without origin":   "",
+		"too many windows": "?origin=https%3A%2F%2Fa.example&start=2001-01-01T00:00:00Z&end=2021-10-04T00:00:00Z",
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/budget_windows"+query, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("expect status BadRequest %s, got %d", desc, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chaos injects failures into the coordination between the two helpers.
+//
+// The hooks are placed where a helper can fail halfway through a level of a hierarchical query: when the pipeline
+// times out, when the helper stops before publishing the request of the next level, and when the upload of the
+// partial result for the partner is interrupted. An injected failure is returned as an error, so the request is
+// retried like after a real failure, and tests can check that the query still completes or is aborted on both helpers.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+)
+
+// Fault is a type of failure that can be injected.
+type Fault string
+
+// Faults in the coordination between the helpers.
+const (
+	// The helper gives up on a pipeline after it wrote its outputs, e.g. when the job finishes after the deadline.
+	PipelineTimeout Fault = "pipeline_timeout"
+	// The helper stops after a level is done and before the request for the next level is published.
+	DropLevelMessage Fault = "drop_level_message"
+	// The helper stops while uploading the partial result of a level, which is left incomplete in the shared directory.
+	PartialUpload Fault = "partial_upload"
+)
+
+var knownFaults = map[Fault]bool{PipelineTimeout: true, DropLevelMessage: true, PartialUpload: true}
+
+// ErrInjected is wrapped by the errors of the injected failures.
+var ErrInjected = errors.New("injected failure")
+
+// ParseRates parses the rates of the faults in the format "fault1=rate1,fault2=rate2", e.g.
+// "pipeline_timeout=0.1,partial_upload=0.05".
+func ParseRates(s string) (map[Fault]float64, error) {
+	rates := make(map[Fault]float64)
+	if s == "" {
+		return rates, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expect fault rate in format fault=rate, got %q", item)
+		}
+		rate, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate in %q: %v", item, err)
+		}
+		rates[Fault(kv[0])] = rate
+	}
+	return rates, nil
+}
+
+// Injector decides randomly whether to inject each fault, and counts the injected ones.
+type Injector struct {
+	mu     sync.Mutex
+	rates  map[Fault]float64
+	random *rand.Rand
+	counts map[Fault]int
+}
+
+// NewInjector creates an Injector with the rates of the faults in [0, 1]. The same seed injects the same sequence of
+// failures.
+func NewInjector(rates map[Fault]float64, seed int64) (*Injector, error) {
+	for fault, rate := range rates {
+		if !knownFaults[fault] {
+			return nil, fmt.Errorf("unknown fault %q", fault)
+		}
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("expect rate of fault %q in [0, 1], got %v", fault, rate)
+		}
+	}
+	return &Injector{rates: rates, random: rand.New(rand.NewSource(seed)), counts: make(map[Fault]int)}, nil
+}
+
+// Fail returns an error wrapping ErrInjected if the fault is injected. A nil Injector never injects faults.
+func (i *Injector) Fail(fault Fault) error {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	rate := i.rates[fault]
+	if rate == 0 || i.random.Float64() >= rate {
+		return nil
+	}
+	i.counts[fault]++
+	log.Warningf("injecting fault %q", fault)
+	return fmt.Errorf("%w: %s", ErrInjected, fault)
+}
+
+// Counts returns the number of the injected failures of each fault.
+func (i *Injector) Counts() map[Fault]int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	counts := make(map[Fault]int)
+	for fault, n := range i.counts {
+		counts[fault] = n
+	}
+	return counts
+}
+
+// String lists the rates of the faults, e.g. for logging the configuration of the helper.
+func (i *Injector) String() string {
+	var items []string
+	for fault, rate := range i.rates {
+		items = append(items, fmt.Sprintf("%s=%v", fault, rate))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaos
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRates(t *testing.T) {
+	got, err := ParseRates("pipeline_timeout=0.1,partial_upload=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[Fault]float64{PipelineTimeout: 0.1, PartialUpload: 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("rates mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, s := range []string{"pipeline_timeout", "pipeline_timeout=high"} {
+		if _, err := ParseRates(s); err == nil {
+			t.Errorf("expect error for rates %q", s)
+		}
+	}
+}
+
+func TestNewInjectorInvalidRates(t *testing.T) {
+	for _, rates := range []map[Fault]float64{
+		{"crash": 0.5},
+		{PipelineTimeout: 1.5},
+		{DropLevelMessage: -0.1},
+	} {
+		if _, err := NewInjector(rates, 0); err == nil {
+			t.Errorf("expect error for rates %v", rates)
+		}
+	}
+}
+
+func TestFail(t *testing.T) {
+	var disabled *Injector
+	if err := disabled.Fail(PartialUpload); err != nil {
+		t.Errorf("expect no failure from a nil injector, got %v", err)
+	}
+
+	injector, err := NewInjector(map[Fault]float64{PartialUpload: 1, PipelineTimeout: 0.5}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := injector.Fail(PartialUpload); !errors.Is(err, ErrInjected) {
+			t.Errorf("expect error %v for a fault with rate 1, got %v", ErrInjected, err)
+		}
+		if err := injector.Fail(DropLevelMessage); err != nil {
+			t.Errorf("expect no failure for a fault without rate, got %v", err)
+		}
+	}
+
+	// The same seed injects the same failures.
+	var first []bool
+	for i := 0; i < 20; i++ {
+		first = append(first, injector.Fail(PipelineTimeout) != nil)
+	}
+	replay, err := NewInjector(map[Fault]float64{PartialUpload: 1, PipelineTimeout: 0.5}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		replay.Fail(PartialUpload)
+	}
+	var second []bool
+	for i := 0; i < 20; i++ {
+		second = append(second, replay.Fail(PipelineTimeout) != nil)
+	}
+	if diff := cmp.Diff(first, second); diff != "" {
+		t.Errorf("injected failures mismatch for the same seed (-first +second):\n%s", diff)
+	}
+
+	counts := injector.Counts()
+	if counts[PartialUpload] != 3 || counts[DropLevelMessage] != 0 {
+		t.Errorf("expect 3 partial uploads and no dropped messages, got %v", counts)
+	}
+	if counts[PipelineTimeout] == 0 || counts[PipelineTimeout] == 20 {
+		t.Errorf("expect some of the 20 pipeline timeouts at rate 0.5, got %d", counts[PipelineTimeout])
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package clienttoken deduplicates the query requests retried by the clients.
+//
+// A client sets the same token on all the attempts to submit a query, and derives the query ID from the token with
+// QueryID, so the helpers agree on the query ID whichever attempt reaches them. Each helper records whether the query
+// of a token is running or done, and drops the attempts that arrive while the query runs or after it is done, before
+// any pipeline is launched or any budget is charged. The records are kept for a retention period, after which the
+// token can be used for a new query.
+package clienttoken
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/privacy-sandbox-aggregation-service/service/query"
+	"github.com/pborman/uuid"
+)
+
+var (
+	// ErrTokenReused is returned when a token is sent with a request different from the one it is bound to.
+	ErrTokenReused = errors.New("client token reused for a different request")
+	// ErrQueryIDMismatch is returned when the query ID of a request with a token is not derived from the token.
+	ErrQueryIDMismatch = errors.New("query ID not derived from the client token")
+	// ErrInProgress is returned when the query of a token is running, and the request is retried later.
+	ErrInProgress = errors.New("query of the client token in progress")
+	// ErrDone is returned when the query of a token is done, and the request is dropped.
+	ErrDone = errors.New("query of the client token done")
+)
+
+// States of the query of a token.
+const (
+	// StatePending is the state of a query whose last attempt failed and is retried.
+	StatePending = "pending"
+	// StateRunning is the state of a query handled by the helper until the lease expires.
+	StateRunning = "running"
+	// StateDone is the state of a query that finished or was aborted. Records written before the states were recorded
+	// have no state, and are also done.
+	StateDone = "done"
+)
+
+// Record binds a client token to its query, and records the state of the query.
+type Record struct {
+	QueryID string `firestore:"query_id"`
+	// Fingerprint of the parameters of the request, which must be the same in the retries.
+	Fingerprint string    `firestore:"fingerprint"`
+	Created     time.Time `firestore:"created"`
+	State       string    `firestore:"state"`
+	// Time after which a running query is considered abandoned, e.g. when the helper crashed, so another attempt can
+	// take it over. A zero time never expires.
+	LeaseExpiry time.Time `firestore:"lease_expiry"`
+}
+
+func (r *Record) done() bool {
+	return r.State == "" || r.State == StateDone
+}
+
+func (r *Record) running(now time.Time) bool {
+	return r.State == StateRunning && (r.LeaseExpiry.IsZero() || now.Before(r.LeaseExpiry))
+}
+
+// Store keeps the records of the tokens, e.g. in the job store.
+type Store interface {
+	// Update reads the record of the key, which is nil if it does not exist, and writes the record returned by f if it
+	// is not nil. The read and the write are atomic, so concurrent requests with the same token bind it only once.
+	Update(ctx context.Context, key string, f func(*Record) (*Record, error)) error
+}
+
+// MemoryStore keeps the records in memory, which are lost when the helper restarts.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]*Record
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]*Record)}
+}
+
+// Update implements Store.
+func (s *MemoryStore) Update(ctx context.Context, key string, f func(*Record) (*Record, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, err := f(s.records[key])
+	if err != nil || record == nil {
+		return err
+	}
+	s.records[key] = record
+	return nil
+}
+
+// Fingerprint hashes the parameters of the request that a retry must not change. The batch ready time is excluded, as
+// clients may set it again in each attempt, and so is the query ID, which is derived from the token.
+func Fingerprint(request *query.AggregateRequest) (string, error) {
+	b, err := json.Marshal(struct {
+		AggregationType      string
+		PartialReportURI     string
+		LateReportURI        string
+		ExpandConfigURI      string
+		TotalEpsilon         float64
+		KeyBitSize           int32
+		BatchMetadataURI     string
+		ResultDir            string
+		DebugBatch           bool
+		AcceptPartialEpsilon bool
+	}{
+		AggregationType:      request.AggregationType,
+		PartialReportURI:     request.PartialReportURI,
+		LateReportURI:        request.LateReportURI,
+		ExpandConfigURI:      request.ExpandConfigURI,
+		TotalEpsilon:         request.TotalEpsilon,
+		KeyBitSize:           request.KeyBitSize,
+		BatchMetadataURI:     request.BatchMetadataURI,
+		ResultDir:            request.ResultDir,
+		DebugBatch:           request.DebugBatch,
+		AcceptPartialEpsilon: request.AcceptPartialEpsilon,
+	})
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// Key returns the key of a token in the store. Tokens are hashed, as they are chosen by the clients and may not be
+// valid document IDs.
+func Key(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// QueryID returns the query ID derived from a token, which the requests with the token must use.
+func QueryID(token string) string {
+	return uuid.NewSHA1(uuid.NameSpace_URL, []byte(token)).String()
+}
+
+// Registry binds the client tokens to the queries.
+type Registry struct {
+	Store Store
+	// How long a token stays bound to its query. The bindings never expire if zero.
+	Retention time.Duration
+	// How long a query stays running without being released, after which another attempt can take it over. The
+	// running queries are only taken over after they are released if zero.
+	Lease time.Duration
+}
+
+// Acquire marks the query of the token as running, so the caller handles the request, and must Release the token
+// when done. It returns ErrDone if the query is done, and ErrInProgress if the query is running with a live lease,
+// in which case the request is not handled. A token without a record, or with an expired one, is bound to the query.
+func (r *Registry) Acquire(ctx context.Context, token, queryID, fingerprint string, now time.Time) error {
+	if want := QueryID(token); queryID != want {
+		return fmt.Errorf("%w: got %q, want %q", ErrQueryIDMismatch, queryID, want)
+	}
+	return r.Store.Update(ctx, Key(token), func(existing *Record) (*Record, error) {
+		record := &Record{QueryID: queryID, Fingerprint: fingerprint, Created: now.UTC()}
+		if existing != nil && (existing.running(now) || r.Retention <= 0 || now.Sub(existing.Created) < r.Retention) {
+			if existing.Fingerprint != fingerprint {
+				return nil, fmt.Errorf("%w: token is bound to query %q", ErrTokenReused, existing.QueryID)
+			}
+			if existing.done() {
+				return nil, fmt.Errorf("%w: query %q", ErrDone, existing.QueryID)
+			}
+			if existing.running(now) {
+				return nil, fmt.Errorf("%w: query %q", ErrInProgress, existing.QueryID)
+			}
+			record.Created = existing.Created
+		}
+		record.State = StateRunning
+		if r.Lease > 0 {
+			record.LeaseExpiry = now.Add(r.Lease).UTC()
+		}
+		return record, nil
+	})
+}
+
+// Release marks the query of the token as done, or as pending if the request failed and is retried.
+func (r *Registry) Release(ctx context.Context, token string, done bool) error {
+	return r.Store.Update(ctx, Key(token), func(existing *Record) (*Record, error) {
+		if existing == nil {
+			return nil, nil
+		}
+		record := *existing
+		record.State = StatePending
+		if done {
+			record.State = StateDone
+		}
+		record.LeaseExpiry = time.Time{}
+		return &record, nil
+	})
+}
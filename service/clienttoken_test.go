@@ -0,0 +1,100 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clienttoken
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/privacy-sandbox-aggregation-service/service/query"
+)
+
+func TestFingerprint(t *testing.T) {
+	request := &query.AggregateRequest{
+		AggregationType:  query.ConversionType,
+		PartialReportURI: "/reports/batch1",
+		ExpandConfigURI:  "/configs/config.json",
+		QueryID:          "query1",
+		TotalEpsilon:     1,
+		KeyBitSize:       32,
+		ResultDir:        "/results",
+		BatchReadyTime:   time.Unix(100, 0),
+	}
+	want, err := Fingerprint(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retry := *request
+	retry.QueryID, retry.BatchReadyTime = "query2", time.Unix(200, 0)
+	if got, err := Fingerprint(&retry); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("expect the same fingerprint for a retry with a new query ID, got %q and %q", got, want)
+	}
+
+	changed := *request
+	changed.TotalEpsilon = 2
+	if got, err := Fingerprint(&changed); err != nil {
+		t.Fatal(err)
+	} else if got == want {
+		t.Error("expect a different fingerprint for a different epsilon")
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	registry := &Registry{Store: NewMemoryStore(), Retention: time.Hour, Lease: 10 * time.Minute}
+	start := time.Unix(1000, 0)
+	query1, query2 := QueryID("token1"), QueryID("token2")
+
+	for _, tc := range []struct {
+		desc, token, queryID, fingerprint string
+		now                               time.Time
+		want                              error
+	}{
+		{"first request acquires the token", "token1", query1, "fp1", start, nil},
+		{"retry while the query runs", "token1", query1, "fp1", start.Add(time.Minute), ErrInProgress},
+		{"query ID not derived from the token", "token1", "query1", "fp1", start.Add(time.Minute), ErrQueryIDMismatch},
+		{"token reused with other parameters", "token1", query1, "fp2", start.Add(time.Minute), ErrTokenReused},
+		{"another token", "token2", query2, "fp1", start.Add(time.Minute), nil},
+		{"expired lease is taken over", "token1", query1, "fp1", start.Add(11 * time.Minute), nil},
+	} {
+		if err := registry.Acquire(ctx, tc.token, tc.queryID, tc.fingerprint, tc.now); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expect error %v, got %v", tc.desc, tc.want, err)
+		}
+	}
+
+	// A failed attempt is retried, and a done query is dropped.
+	if err := registry.Release(ctx, "token1", false /*done*/); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Acquire(ctx, "token1", query1, "fp1", start.Add(12*time.Minute)); err != nil {
+		t.Errorf("expect the failed query retried, got %v", err)
+	}
+	if err := registry.Release(ctx, "token1", true /*done*/); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Acquire(ctx, "token1", query1, "fp1", start.Add(13*time.Minute)); !errors.Is(err, ErrDone) {
+		t.Errorf("expect error %v for a done query, got %v", ErrDone, err)
+	}
+
+	// The token can be used again after the retention period.
+	if err := registry.Acquire(ctx, "token1", query1, "fp2", start.Add(2*time.Hour)); err != nil {
+		t.Errorf("expect the expired token bound again, got %v", err)
+	}
+}
@@ -13,12 +13,18 @@
 // limitations under the License.
 
 // This binary hosts the collector service.
+//
+// With '--loadtest', the binary also posts synthetic reports to the collector at '--loadtest_qps' for
+// '--loadtest_duration', logs the latency and the error rate of the responses, and exits. The load is sent to
+// '--loadtest_url' if set, or otherwise to the collector started by the binary itself, which then writes its batches
+// under the 'loadtest' prefix of '--batch_dir', so the synthetic reports are never aggregated with the real ones.
 package main
 
 import (
 	"context"
 	"crypto/tls"
 	"flag"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -27,13 +33,38 @@ import (
 	"time"
 
 	log "github.com/golang/glog"
+	"github.com/google/privacy-sandbox-aggregation-service/service/authz"
 	"github.com/google/privacy-sandbox-aggregation-service/service/collectorservice"
+	"github.com/google/privacy-sandbox-aggregation-service/service/loadtest"
+	"github.com/google/privacy-sandbox-aggregation-service/service/runtimeconfig"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
 )
 
+// loadTestBatchPrefix is the prefix in the batch directory for the batches of the synthetic reports.
+const loadTestBatchPrefix = "loadtest"
+
 var (
-	address   = flag.String("address", "", "Address of the server.")
-	batchDir  = flag.String("batch_dir", "", "Directory that stores report batches.")
-	batchSize = flag.Int("batch_size", 1000000, "Number of reports to be included in each batch file.")
+	address    = flag.String("address", "", "Address of the server.")
+	batchDir   = flag.String("batch_dir", "", "Directory that stores report batches.")
+	batchSize  = flag.Int("batch_size", 1000000, "Number of reports to be included in each batch file.")
+	keyPinsURI = flag.String("key_pins_uri", "", "JSON file mapping reporting origins to the key IDs pinned for them. Reports referencing other key IDs are rejected for these origins. Pins registered through /admin/keypins on --admin_address are saved to the same file. Pinning is disabled if empty.")
+
+	adminAddress   = flag.String("admin_address", "", "Address of the admin server with the endpoints /admin/keypins and /admin/runtime_config, which is separate from the public report endpoint. The admin endpoints are not served if empty.")
+	authzPolicyURI = flag.String("authz_policy_uri", "", "JSON file of the bindings from the caller identities to the roles viewer and admin, which are required by the admin endpoints. The admin endpoints reject all requests if empty.")
+	authzAudience  = flag.String("authz_audience", "", "Audience of the OIDC ID tokens of the callers of the admin endpoints.")
+
+	runtimeConfigURI          = flag.String("runtime_config_uri", "", "JSON file of the reporting origin allowlist and the report quotas, which is reloaded when it changes. The current config is served on the endpoint /admin/runtime_config on --admin_address, where POST forces a reload. Reports are not checked if empty.")
+	runtimeConfigPollInterval = flag.Duration("runtime_config_poll_interval", time.Minute, "Interval to check the runtime config for changes.")
+
+	loadTest                = flag.Bool("loadtest", false, "Post synthetic reports to the collector, log the measured latency and error rate, and exit.")
+	loadTestURL             = flag.String("loadtest_url", "", "Report endpoint of the collector under load test, which must not batch reports for production queries. If empty, the load is sent to the collector started by this binary, which writes its batches under the prefix 'loadtest' of --batch_dir.")
+	loadTestQPS             = flag.Float64("loadtest_qps", 100, "Reports sent per second in the load test.")
+	loadTestDuration        = flag.Duration("loadtest_duration", time.Minute, "Duration of the load test.")
+	loadTestConcurrency     = flag.Int("loadtest_concurrency", 100, "Maximum number of requests in flight in the load test.")
+	loadTestPayloadCount    = flag.Int("loadtest_payload_count", 2, "Number of payloads in each synthetic report, 2 for the MPC protocol and 1 for the one-party protocol.")
+	loadTestPayloadSize     = flag.Int("loadtest_payload_size", loadtest.DefaultPayloadSize, "Size in bytes of each synthetic payload.")
+	loadTestReportingOrigin = flag.String("loadtest_reporting_origin", "", "Reporting origin of the synthetic reports.")
+	loadTestKeyID           = flag.String("loadtest_key_id", "", "Key ID of the synthetic payloads.")
 
 	version string // set by linker -X
 	build   string // set by linker -X
@@ -52,14 +83,50 @@ func main() {
 	log.Info("- Debugging enabled - \n")
 	log.Infof("Running collector server version: %v, build: %v\n", version, buildDate)
 	log.Infof("Listening to %v", *address)
-	log.Infof("Batch size %v, Batch Dir: %v", *batchSize, *batchDir)
+	dir := *batchDir
+	if *loadTest && *loadTestURL == "" {
+		// The synthetic reports are kept apart from the batches of the real reports.
+		dir = utils.JoinPath(dir, loadTestBatchPrefix)
+	}
+	log.Infof("Batch size %v, Batch Dir: %v", *batchSize, dir)
 
-	handler := collectorservice.NewHandler(context.Background(), *batchSize, *batchDir)
+	authorizer, err := authz.NewAuthorizer(context.Background(), *authzPolicyURI, *authzAudience)
+	if err != nil {
+		log.Exit(err)
+	}
+
+	handler := collectorservice.NewHandler(context.Background(), *batchSize, dir)
+	mux := http.NewServeMux()
+	mux.Handle("/", handler.Handler())
+	// The admin endpoints are never served on the public address, where the browsers send the reports.
+	adminMux := http.NewServeMux()
+	if *keyPinsURI != "" {
+		pins, err := collectorservice.ReadKeyPins(context.Background(), *keyPinsURI)
+		if err != nil {
+			log.Exit(err)
+		}
+		handler.KeyPins = pins
+		adminMux.Handle("/admin/keypins", authorizer.Require(authz.ViewerRoles, &collectorservice.KeyPinsAdminHandler{Pins: pins}))
+	}
+	if *runtimeConfigURI != "" {
+		watcher, err := runtimeconfig.NewWatcher(context.Background(), *runtimeConfigURI)
+		if err != nil {
+			log.Exit(err)
+		}
+		go watcher.Watch(context.Background(), *runtimeConfigPollInterval)
+		handler.RuntimeConfig = watcher
+		adminMux.Handle("/admin/runtime_config", authorizer.Require(authz.ViewerRoles, &runtimeconfig.Handler{Watcher: watcher}))
+	}
 	srv := &http.Server{
 		Addr:      *address,
-		Handler:   handler.Handler(),
+		Handler:   mux,
 		TLSConfig: &tls.Config{},
 	}
+	var adminSrv *http.Server
+	if *adminAddress != "" {
+		log.Infof("Serving the admin endpoints on %v", *adminAddress)
+		adminSrv = &http.Server{Addr: *adminAddress, Handler: adminMux}
+	}
 
 	// Create channel to listen for signals.
 	signalChan := make(chan os.Signal, 1)
@@ -73,10 +140,21 @@ func main() {
 			log.Fatal(err)
 		}
 	}()
+	if adminSrv != nil {
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-	// Receive output from signalChan.
-	sig := <-signalChan
-	log.Infof("%s signal caught", sig)
+	if *loadTest {
+		runLoadTest(signalChan)
+	} else {
+		// Receive output from signalChan.
+		sig := <-signalChan
+		log.Infof("%s signal caught", sig)
+	}
 
 	// Timeout if waiting for connections to return idle.
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -86,9 +164,51 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Infof("server shutdown failed: %+v", err)
 	}
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(ctx); err != nil {
+			log.Infof("admin server shutdown failed: %+v", err)
+		}
+	}
 
 	// Flush all remaining reports
 	handler.Shutdown()
 
 	log.Infof("server exited")
 }
+
+// runLoadTest sends the load until the end of the load test or a signal, and logs the result.
+func runLoadTest(signalChan <-chan os.Signal) {
+	url := *loadTestURL
+	if url == "" {
+		_, port, err := net.SplitHostPort(*address)
+		if err != nil {
+			log.Exit(err)
+		}
+		url = "http://localhost:" + port + collectorservice.ReportPath
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if sig, ok := <-signalChan; ok {
+			log.Infof("%s signal caught, stopping the load test", sig)
+			cancel()
+		}
+	}()
+
+	log.Infof("Load testing %v at %v QPS for %v", url, *loadTestQPS, *loadTestDuration)
+	result, err := loadtest.Run(ctx, &http.Client{Timeout: 30 * time.Second}, &loadtest.Config{
+		URL:             url,
+		QPS:             *loadTestQPS,
+		Duration:        *loadTestDuration,
+		Concurrency:     *loadTestConcurrency,
+		PayloadCount:    *loadTestPayloadCount,
+		PayloadSize:     *loadTestPayloadSize,
+		ReportingOrigin: *loadTestReportingOrigin,
+		KeyID:           *loadTestKeyID,
+		Seed:            time.Now().UnixNano(),
+	})
+	if err != nil && err != context.Canceled {
+		log.Exit(err)
+	}
+	log.Infof("Load test result: %v", result)
+}
@@ -20,13 +20,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/golang/glog"
 	"golang.org/x/sync/errgroup"
+	"github.com/google/privacy-sandbox-aggregation-service/service/runtimeconfig"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
 )
@@ -37,7 +41,7 @@ const (
 	reportsChannelBufferFactor = 0.2
 
 	// Supported URL paths.
-	reportPath      = "/.well-known/attribution-reporting/report-aggregate-attribution"
+	ReportPath      = "/.well-known/attribution-reporting/report-aggregate-attribution"
 	debugReportPath = "/.well-known/attribution-reporting/debug/report-aggregate-attribution"
 )
 
@@ -48,6 +52,216 @@ const (
 // written into two files, which will be the input of the aggregation service for the corresponding helpers.
 type CollectorHandler struct {
 	bufferedReportWriter bufferedReportWriter
+
+	// Key IDs pinned for the reporting origins. Reports are not checked if nil.
+	KeyPins *KeyPins
+	// Runtime configuration with the allowlist and the quotas of the reporting origins, which is reloaded while the
+	// collector runs. Reports are not checked if nil.
+	RuntimeConfig *runtimeconfig.Watcher
+
+	quota reportQuota
+}
+
+// ErrUnpinnedKeyID is returned when a report references a key ID that is not registered for its reporting origin.
+var ErrUnpinnedKeyID = errors.New("key ID not pinned for the reporting origin")
+
+var (
+	// ErrOriginNotAllowed is returned when the reporting origin is not in the allowlist of the runtime configuration.
+	ErrOriginNotAllowed = errors.New("reporting origin not allowed")
+	// ErrQuotaExceeded is returned when the reporting origin has sent more reports than its quota in the current minute.
+	ErrQuotaExceeded = errors.New("report quota exceeded for the reporting origin")
+)
+
+// reportingOrigin returns the reporting origin in the shared info of the report.
+func reportingOrigin(report *reporttypes.AggregatableReport) (string, bool) {
+	info := &reporttypes.SharedInfo{}
+	if err := json.Unmarshal([]byte(report.SharedInfo), info); err != nil {
+		return "", false
+	}
+	return info.ReportingOrigin, true
+}
+
+// reportQuota counts the reports accepted from each reporting origin in the current minute.
+type reportQuota struct {
+	mu     sync.Mutex
+	window time.Time
+	counts map[string]int64
+}
+
+// allow counts the report if the origin has not reached the limit in the minute of now. Zero limit means unlimited.
+func (q *reportQuota) allow(origin string, limit int64, now time.Time) bool {
+	if limit <= 0 {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if window := now.Truncate(time.Minute); !window.Equal(q.window) {
+		q.window = window
+		q.counts = make(map[string]int64)
+	}
+	if q.counts[origin] >= limit {
+		return false
+	}
+	q.counts[origin]++
+	return true
+}
+
+// checkRuntimeConfig returns ErrOriginNotAllowed or ErrQuotaExceeded if the report is rejected by the current runtime
+// configuration.
+func (h *CollectorHandler) checkRuntimeConfig(report *reporttypes.AggregatableReport, now time.Time) error {
+	if h.RuntimeConfig == nil {
+		return nil
+	}
+	config := h.RuntimeConfig.Config()
+	// Reports without a parsable origin only pass an empty allowlist.
+	origin, _ := reportingOrigin(report)
+	if !config.ReportingOriginAllowed(origin) {
+		return fmt.Errorf("%w: %q", ErrOriginNotAllowed, origin)
+	}
+	if !h.quota.allow(origin, config.ReportsPerMinute(origin), now) {
+		return fmt.Errorf("%w: %q", ErrQuotaExceeded, origin)
+	}
+	return nil
+}
+
+// KeyPins holds the helper public key IDs that each reporting origin registered for its clients. Reports from an
+// origin with pinned key IDs are rejected if any of their payloads references another key ID, which catches
+// misconfigured test traffic before it pollutes the batches. Origins without pins are not checked.
+type KeyPins struct {
+	// File where the pins are saved when they change. The pins are only kept in memory if empty.
+	URI string
+
+	mu   sync.RWMutex
+	pins map[string]map[string]bool
+}
+
+// NewKeyPins creates the pins from a map of reporting origins to key IDs.
+func NewKeyPins(pins map[string][]string) *KeyPins {
+	p := &KeyPins{pins: make(map[string]map[string]bool)}
+	for origin, keyIDs := range pins {
+		p.set(origin, keyIDs)
+	}
+	return p
+}
+
+// ReadKeyPins reads the pins from a JSON file of reporting origins mapped to key IDs, and saves later changes back
+// to the same file.
+func ReadKeyPins(ctx context.Context, uri string) (*KeyPins, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	pins := make(map[string][]string)
+	if err := json.Unmarshal(b, &pins); err != nil {
+		return nil, fmt.Errorf("failed to parse key pins in %q: %v", uri, err)
+	}
+	p := NewKeyPins(pins)
+	p.URI = uri
+	return p, nil
+}
+
+func (p *KeyPins) set(origin string, keyIDs []string) {
+	if len(keyIDs) == 0 {
+		delete(p.pins, origin)
+		return
+	}
+	ids := make(map[string]bool)
+	for _, id := range keyIDs {
+		ids[id] = true
+	}
+	p.pins[origin] = ids
+}
+
+// Register replaces the pinned key IDs of an origin. An empty list removes the pins, so reports from the origin are
+// no longer checked.
+func (p *KeyPins) Register(ctx context.Context, origin string, keyIDs []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.set(origin, keyIDs)
+	if p.URI == "" {
+		return nil
+	}
+	b, err := json.Marshal(p.snapshot())
+	if err != nil {
+		return err
+	}
+	return utils.WriteBytes(ctx, b, p.URI, nil)
+}
+
+func (p *KeyPins) snapshot() map[string][]string {
+	pins := make(map[string][]string)
+	for origin, ids := range p.pins {
+		for id := range ids {
+			pins[origin] = append(pins[origin], id)
+		}
+		sort.Strings(pins[origin])
+	}
+	return pins
+}
+
+// Pins returns the pinned key IDs of all origins.
+func (p *KeyPins) Pins() map[string][]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.snapshot()
+}
+
+// Check returns ErrUnpinnedKeyID if a payload of the report references a key ID that is not pinned for its origin.
+func (p *KeyPins) Check(report *reporttypes.AggregatableReport) error {
+	origin, ok := reportingOrigin(report)
+	if !ok {
+		// Reports without a parsable origin can not be matched with any pins.
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ids, ok := p.pins[origin]
+	if !ok {
+		return nil
+	}
+	for _, payload := range report.AggregationServicePayloads {
+		if !ids[payload.KeyID] {
+			return fmt.Errorf("%w: %q for origin %q", ErrUnpinnedKeyID, payload.KeyID, origin)
+		}
+	}
+	return nil
+}
+
+// KeyPinsAdminHandler handles the admin requests for the key pins.
+//
+// GET returns the pins of all origins; POST with form values "origin" and "key_ids" (comma-separated, empty to remove
+// the pins) registers the key IDs of an origin.
+type KeyPinsAdminHandler struct {
+	Pins *KeyPins
+}
+
+func (h *KeyPinsAdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		origin := req.FormValue("origin")
+		if origin == "" {
+			http.Error(w, "origin is required", http.StatusBadRequest)
+			return
+		}
+		var keyIDs []string
+		if v := req.FormValue("key_ids"); v != "" {
+			keyIDs = strings.Split(v, ",")
+		}
+		if err := h.Pins.Register(req.Context(), origin, keyIDs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+		log.Infof("key IDs %v pinned for origin %q", keyIDs, origin)
+	default:
+		http.Error(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.Pins.Pins()); err != nil {
+		log.Error(err)
+	}
 }
 
 // NewHandler creates a new CollectorHandler with initialized values
@@ -77,7 +291,7 @@ func (h *CollectorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if req.URL.Path != reportPath && req.URL.Path != debugReportPath {
+	if req.URL.Path != ReportPath && req.URL.Path != debugReportPath {
 		errMsg := "Unsupported path"
 		http.Error(w, errMsg, http.StatusNotFound)
 		log.Error(errMsg)
@@ -99,6 +313,24 @@ func (h *CollectorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		log.Error(err)
 	}
 
+	if h.KeyPins != nil {
+		if err := h.KeyPins.Check(report); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Error(err)
+			return
+		}
+	}
+
+	if err := h.checkRuntimeConfig(report, time.Now()); err != nil {
+		status := http.StatusForbidden
+		if errors.Is(err, ErrQuotaExceeded) {
+			status = http.StatusTooManyRequests
+		}
+		http.Error(w, err.Error(), status)
+		log.Error(err)
+		return
+	}
+
 	h.bufferedReportWriter.reportsCh <- report
 }
 
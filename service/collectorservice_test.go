@@ -18,16 +18,23 @@ import (
 	"bufio"
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
+	"github.com/google/privacy-sandbox-aggregation-service/service/runtimeconfig"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
 
 	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
@@ -137,3 +144,117 @@ func readPartialReport(line string) (*pb.AggregatablePayload, error) {
 
 	return partialReport, nil
 }
+
+func TestKeyPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "key-pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	uri := path.Join(dir, "pins.json")
+	if err := ioutil.WriteFile(uri, []byte(`{"https://pinned.example":["key1","key2"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pins, err := ReadKeyPins(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newReport := func(origin string, keyIDs ...string) *reporttypes.AggregatableReport {
+		report := &reporttypes.AggregatableReport{SharedInfo: fmt.Sprintf(`{"reporting_origin":%q}`, origin)}
+		for _, id := range keyIDs {
+			report.AggregationServicePayloads = append(report.AggregationServicePayloads, &reporttypes.AggregationServicePayload{KeyID: id})
+		}
+		return report
+	}
+	if err := pins.Check(newReport("https://pinned.example", "key1", "key2")); err != nil {
+		t.Errorf("expect pinned key IDs to pass, got %v", err)
+	}
+	if err := pins.Check(newReport("https://pinned.example", "key1", "key3")); !errors.Is(err, ErrUnpinnedKeyID) {
+		t.Errorf("expect ErrUnpinnedKeyID for an unpinned key ID, got %v", err)
+	}
+	if err := pins.Check(newReport("https://other.example", "key3")); err != nil {
+		t.Errorf("expect origins without pins to pass, got %v", err)
+	}
+
+	if err := pins.Register(ctx, "https://other.example", []string{"key4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pins.Register(ctx, "https://pinned.example", nil); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ReadKeyPins(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string][]string{"https://other.example": {"key4"}}, saved.Pins()); diff != "" {
+		t.Errorf("saved key pins mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckRuntimeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runtime-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	uri := path.Join(dir, "config.json")
+	if err := ioutil.WriteFile(uri, []byte(`{"AllowedReportingOrigins":["https://a.example","https://b.example"],"DefaultReportsPerMinute":2,"OriginReportsPerMinute":{"https://b.example":0}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := runtimeconfig.NewWatcher(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &CollectorHandler{RuntimeConfig: watcher}
+
+	newReport := func(origin string) *reporttypes.AggregatableReport {
+		return &reporttypes.AggregatableReport{SharedInfo: fmt.Sprintf(`{"reporting_origin":%q}`, origin)}
+	}
+	now := time.Date(2021, 1, 1, 0, 0, 10, 0, time.UTC)
+	if err := h.checkRuntimeConfig(newReport("https://other.example"), now); !errors.Is(err, ErrOriginNotAllowed) {
+		t.Errorf("expect ErrOriginNotAllowed for an origin out of the allowlist, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := h.checkRuntimeConfig(newReport("https://a.example"), now); err != nil {
+			t.Errorf("expect report %d within the quota to pass, got %v", i, err)
+		}
+	}
+	if err := h.checkRuntimeConfig(newReport("https://a.example"), now); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expect ErrQuotaExceeded for the report above the quota, got %v", err)
+	}
+	if err := h.checkRuntimeConfig(newReport("https://a.example"), now.Add(time.Minute)); err != nil {
+		t.Errorf("expect the quota to reset in the next minute, got %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := h.checkRuntimeConfig(newReport("https://b.example"), now); err != nil {
+			t.Errorf("expect no quota for the origin with zero quota, got %v", err)
+		}
+	}
+}
+
+func TestKeyPinsAdminHandler(t *testing.T) {
+	h := &KeyPinsAdminHandler{Pins: NewKeyPins(nil)}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/keypins?origin=https://a.example&key_ids=k2,k1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expect status %d, got %d", http.StatusOK, rec.Code)
+	}
+	got := make(map[string][]string)
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string][]string{"https://a.example": {"k1", "k2"}}, got); diff != "" {
+		t.Errorf("key pins mismatch (-want +got):\n%s", diff)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/keypins?key_ids=k1", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expect status %d without origin, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
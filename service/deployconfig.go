@@ -0,0 +1,309 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package deployconfig renders the deployment specs of an aggregator helper from the AggregationConfig proto.
+//
+// The flags of the aggregator server, the Kubernetes manifests, the Dataflow environment and the list of IAM bindings
+// are all generated from the same config, so the runtime flags and the deployed config do not drift apart.
+package deployconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	pb "github.com/google/privacy-sandbox-aggregation-service/service/aggregation_config_go_proto"
+)
+
+const (
+	defaultPort     = 8080
+	defaultReplicas = 1
+	appLabel        = "aggregator-worker"
+)
+
+// Binding is an IAM role granted to a member.
+type Binding struct {
+	Role   string `json:"role"`
+	Member string `json:"member"`
+}
+
+// Deployment holds the specs rendered from an AggregationConfig.
+type Deployment struct {
+	// Flags of the aggregator server.
+	Flags []string
+	// Kubernetes manifests in the JSON format accepted by kubectl.
+	KubernetesManifests []byte
+	// Dataflow runtime environment for the aggregation pipelines, nil unless the Dataflow runner is used.
+	DataflowEnvironment map[string]interface{}
+	// IAM bindings required by the helper.
+	IAMBindings []Binding
+}
+
+// Validate checks the fields required for a deployment.
+func Validate(cfg *pb.AggregationConfig) error {
+	if cfg.GetOrigin() == "" {
+		return errors.New("origin is required")
+	}
+	if cfg.GetImage() == "" {
+		return errors.New("image is required")
+	}
+	if cfg.GetServiceAccountEmail() == "" {
+		return errors.New("service_account_email is required")
+	}
+	if cfg.GetKubernetesNamespace() == "" {
+		return errors.New("kubernetes_namespace is required")
+	}
+	switch cfg.GetPipelineRunner() {
+	case "", "direct":
+	case "dataflow":
+		if cfg.GetDataflow().GetProject() == "" || cfg.GetDataflow().GetRegion() == "" {
+			return errors.New("dataflow project and region are required for the dataflow runner")
+		}
+	default:
+		return fmt.Errorf("unexpected pipeline runner %q", cfg.GetPipelineRunner())
+	}
+	if period := cfg.GetBudgetPeriod(); period != "" {
+		if _, err := time.ParseDuration(period); err != nil {
+			return fmt.Errorf("invalid budget_period %q: %v", period, err)
+		}
+	}
+	return nil
+}
+
+func port(cfg *pb.AggregationConfig) int32 {
+	if cfg.GetPort() > 0 {
+		return cfg.GetPort()
+	}
+	return defaultPort
+}
+
+func replicas(cfg *pb.AggregationConfig) int32 {
+	if cfg.GetReplicas() > 0 {
+		return cfg.GetReplicas()
+	}
+	return defaultReplicas
+}
+
+func resourceName(cfg *pb.AggregationConfig) string {
+	return "aggregator-" + cfg.GetOrigin()
+}
+
+func kubernetesServiceAccountName(cfg *pb.AggregationConfig) string {
+	if cfg.GetProject() == "" && cfg.GetEnvironment() == "" {
+		return resourceName(cfg) + "-k8s-svc-acc"
+	}
+	return fmt.Sprintf("%s-%s-%s-k8s-svc-acc", cfg.GetProject(), cfg.GetEnvironment(), cfg.GetOrigin())
+}
+
+// ServerFlags returns the flags of the aggregator server. Flags with empty values are omitted, so the server uses its
+// defaults for them.
+func ServerFlags(cfg *pb.AggregationConfig) []string {
+	var flags []string
+	add := func(name, value string) {
+		if value != "" {
+			flags = append(flags, fmt.Sprintf("--%s=%s", name, value))
+		}
+	}
+	addBool := func(name string, value bool) {
+		if value {
+			add(name, "true")
+		}
+	}
+
+	add("address", fmt.Sprintf(":%d", port(cfg)))
+	add("pubsub_topic", cfg.GetPubsubTopic())
+	add("pubsub_subscription", cfg.GetPubsubSubscription())
+	add("origin", cfg.GetOrigin())
+	add("private_key_params_uri", cfg.GetPrivateKeyParamsUri())
+	add("workspace_uri", cfg.GetWorkspaceUri())
+	add("shared_dir", cfg.GetSharedDir())
+	add("result_cache_dir", cfg.GetResultCacheDir())
+	add("decrypted_report_dir", cfg.GetDecryptedReportDir())
+	add("shadow_dpf_aggregate_partial_report_binary", cfg.GetShadowDpfAggregatePartialReportBinary())
+	add("shadow_dir", cfg.GetShadowDir())
+	add("runtime_config_uri", cfg.GetRuntimeConfigUri())
+	add("budget_ledger_dir", cfg.GetBudgetLedgerDir())
+	if cfg.GetBatchBudget() > 0 {
+		add("batch_budget", strconv.FormatFloat(cfg.GetBatchBudget(), 'g', -1, 64))
+	}
+	add("budget_period", cfg.GetBudgetPeriod())
+	addBool("strict_privacy", cfg.GetStrictPrivacy())
+	addBool("read_only", cfg.GetReadOnly())
+	addBool("check_batch_integrity", cfg.GetCheckBatchIntegrity())
+
+	add("pipeline_runner", cfg.GetPipelineRunner())
+	if cfg.GetPipelineRunner() == "dataflow" {
+		df := cfg.GetDataflow()
+		add("dataflow_project", df.GetProject())
+		add("dataflow_region", df.GetRegion())
+		add("dataflow_zone", df.GetZone())
+		add("dataflow_temp_location", df.GetTempLocation())
+		add("dataflow_staging_location", df.GetStagingLocation())
+		if df.GetMaxNumWorkers() > 0 {
+			add("dataflow_max_num_workers", strconv.Itoa(int(df.GetMaxNumWorkers())))
+		}
+		add("dataflow_worker_machine_type", df.GetWorkerMachineType())
+		add("dataflow_service_account", cfg.GetServiceAccountEmail())
+	}
+	return append(flags, "-logtostderr=true")
+}
+
+// DataflowEnvironment returns the runtime environment of the Dataflow templates for the aggregation pipelines, with
+// the field names of the Dataflow API, or nil if the pipelines are not run with Dataflow.
+func DataflowEnvironment(cfg *pb.AggregationConfig) map[string]interface{} {
+	if cfg.GetPipelineRunner() != "dataflow" {
+		return nil
+	}
+	df := cfg.GetDataflow()
+	env := map[string]interface{}{
+		"serviceAccountEmail": cfg.GetServiceAccountEmail(),
+	}
+	for k, v := range map[string]string{
+		"tempLocation":    df.GetTempLocation(),
+		"stagingLocation": df.GetStagingLocation(),
+		"region":          df.GetRegion(),
+		"zone":            df.GetZone(),
+		"machineType":     df.GetWorkerMachineType(),
+	} {
+		if v != "" {
+			env[k] = v
+		}
+	}
+	if df.GetMaxNumWorkers() > 0 {
+		env["maxWorkers"] = df.GetMaxNumWorkers()
+	}
+	return env
+}
+
+// IAMBindings returns the roles the helper needs: the Kubernetes service account impersonates the GCP service account
+// through workload identity, which then pulls the requests, manages the pipelines and reads and writes the buckets.
+func IAMBindings(cfg *pb.AggregationConfig) []Binding {
+	member := "serviceAccount:" + cfg.GetServiceAccountEmail()
+	var bindings []Binding
+	if cfg.GetProject() != "" {
+		bindings = append(bindings, Binding{
+			Role:   "roles/iam.workloadIdentityUser",
+			Member: fmt.Sprintf("serviceAccount:%s.svc.id.goog[%s/%s]", cfg.GetProject(), cfg.GetKubernetesNamespace(), kubernetesServiceAccountName(cfg)),
+		})
+	}
+	bindings = append(bindings,
+		Binding{Role: "roles/pubsub.subscriber", Member: member},
+		Binding{Role: "roles/pubsub.publisher", Member: member},
+		Binding{Role: "roles/storage.objectAdmin", Member: member},
+		Binding{Role: "roles/secretmanager.secretAccessor", Member: member},
+	)
+	if cfg.GetPipelineRunner() == "dataflow" {
+		bindings = append(bindings,
+			Binding{Role: "roles/dataflow.admin", Member: member},
+			Binding{Role: "roles/dataflow.worker", Member: member},
+			Binding{Role: "roles/iam.serviceAccountUser", Member: member},
+		)
+	}
+	return bindings
+}
+
+// kubernetesObjects returns the service account, service and deployment of the helper.
+func kubernetesObjects(cfg *pb.AggregationConfig) []map[string]interface{} {
+	name := resourceName(cfg)
+	namespace := cfg.GetKubernetesNamespace()
+	labels := map[string]string{"app": appLabel, "origin": cfg.GetOrigin()}
+	saName := kubernetesServiceAccountName(cfg)
+
+	serviceAccount := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ServiceAccount",
+		"metadata": map[string]interface{}{
+			"name":      saName,
+			"namespace": namespace,
+			"annotations": map[string]string{
+				"environment":                    cfg.GetEnvironment(),
+				"iam.gke.io/gcp-service-account": cfg.GetServiceAccountEmail(),
+			},
+		},
+		"automountServiceAccountToken": false,
+	}
+
+	service := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"name": name, "namespace": namespace},
+		"spec": map[string]interface{}{
+			"type":     "LoadBalancer",
+			"selector": labels,
+			"ports": []map[string]interface{}{
+				{"name": "manifest-endpoint", "port": port(cfg), "protocol": "TCP"},
+			},
+		},
+	}
+
+	deployment := map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": name, "namespace": namespace},
+		"spec": map[string]interface{}{
+			"replicas": replicas(cfg),
+			"selector": map[string]interface{}{"matchLabels": labels},
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": labels},
+				"spec": map[string]interface{}{
+					"serviceAccountName":           saName,
+					"automountServiceAccountToken": true,
+					"containers": []map[string]interface{}{
+						{
+							"name":  "aggregator-server",
+							"image": cfg.GetImage(),
+							"args":  ServerFlags(cfg),
+							"ports": []map[string]interface{}{
+								{"containerPort": port(cfg), "protocol": "TCP"},
+							},
+							"resources": map[string]interface{}{
+								"requests": map[string]string{"memory": "50Mi", "cpu": "0.1"},
+								"limits":   map[string]string{"memory": "2000Mi", "cpu": "1.5"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	return []map[string]interface{}{serviceAccount, service, deployment}
+}
+
+// KubernetesManifests returns the Kubernetes objects of the helper as a JSON list, which can be applied with kubectl.
+func KubernetesManifests(cfg *pb.AggregationConfig) ([]byte, error) {
+	return json.MarshalIndent(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"items":      kubernetesObjects(cfg),
+	}, "", "  ")
+}
+
+// Render validates the config and generates all the deployment specs.
+func Render(cfg *pb.AggregationConfig) (*Deployment, error) {
+	if err := Validate(cfg); err != nil {
+		return nil, err
+	}
+	manifests, err := KubernetesManifests(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Deployment{
+		Flags:               ServerFlags(cfg),
+		KubernetesManifests: manifests,
+		DataflowEnvironment: DataflowEnvironment(cfg),
+		IAMBindings:         IAMBindings(cfg),
+	}, nil
+}
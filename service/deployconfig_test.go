@@ -0,0 +1,149 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deployconfig
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	pb "github.com/google/privacy-sandbox-aggregation-service/service/aggregation_config_go_proto"
+)
+
+func testConfig() *pb.AggregationConfig {
+	return &pb.AggregationConfig{
+		Project:             "project",
+		Environment:         "dev",
+		Origin:              "aggregator1",
+		KubernetesNamespace: "default",
+		ServiceAccountEmail: "agg@project.iam.gserviceaccount.com",
+		Image:               "gcr.io/project/aggregator_server:v1",
+		PubsubTopic:         "projects/project/topics/requests",
+		PubsubSubscription:  "projects/project/subscriptions/requests",
+		WorkspaceUri:        "gs://workspace",
+		SharedDir:           "gs://shared",
+		StrictPrivacy:       true,
+		PipelineRunner:      "dataflow",
+		Dataflow: &pb.DataflowConfig{
+			Project:       "project",
+			Region:        "us-central1",
+			TempLocation:  "gs://temp",
+			MaxNumWorkers: 10,
+		},
+	}
+}
+
+func TestServerFlags(t *testing.T) {
+	want := []string{
+		"--address=:8080",
+		"--pubsub_topic=projects/project/topics/requests",
+		"--pubsub_subscription=projects/project/subscriptions/requests",
+		"--origin=aggregator1",
+		"--workspace_uri=gs://workspace",
+		"--shared_dir=gs://shared",
+		"--strict_privacy=true",
+		"--pipeline_runner=dataflow",
+		"--dataflow_project=project",
+		"--dataflow_region=us-central1",
+		"--dataflow_temp_location=gs://temp",
+		"--dataflow_max_num_workers=10",
+		"--dataflow_service_account=agg@project.iam.gserviceaccount.com",
+		"-logtostderr=true",
+	}
+	if diff := cmp.Diff(want, ServerFlags(testConfig())); diff != "" {
+		t.Errorf("server flags mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestKubernetesManifestsUseServerFlags(t *testing.T) {
+	cfg := testConfig()
+	deployment, err := Render(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list struct {
+		Items []struct {
+			Kind string
+			Spec struct {
+				Template struct {
+					Spec struct {
+						ServiceAccountName string
+						Containers         []struct {
+							Image string
+							Args  []string
+						}
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(deployment.KubernetesManifests, &list); err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	for _, item := range list.Items {
+		kinds = append(kinds, item.Kind)
+		if item.Kind != "Deployment" {
+			continue
+		}
+		if got, want := item.Spec.Template.Spec.ServiceAccountName, "project-dev-aggregator1-k8s-svc-acc"; got != want {
+			t.Errorf("expect service account %q, got %q", want, got)
+		}
+		container := item.Spec.Template.Spec.Containers[0]
+		if container.Image != cfg.GetImage() {
+			t.Errorf("expect image %q, got %q", cfg.GetImage(), container.Image)
+		}
+		if diff := cmp.Diff(deployment.Flags, container.Args); diff != "" {
+			t.Errorf("container args drift from the server flags (-want +got):\n%s", diff)
+		}
+	}
+	if diff := cmp.Diff([]string{"ServiceAccount", "Service", "Deployment"}, kinds); diff != "" {
+		t.Errorf("manifest kinds mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestIAMBindings(t *testing.T) {
+	cfg := testConfig()
+	cfg.PipelineRunner = "direct"
+	member := "serviceAccount:agg@project.iam.gserviceaccount.com"
+	want := []Binding{
+		{Role: "roles/iam.workloadIdentityUser", Member: "serviceAccount:project.svc.id.goog[default/project-dev-aggregator1-k8s-svc-acc]"},
+		{Role: "roles/pubsub.subscriber", Member: member},
+		{Role: "roles/pubsub.publisher", Member: member},
+		{Role: "roles/storage.objectAdmin", Member: member},
+		{Role: "roles/secretmanager.secretAccessor", Member: member},
+	}
+	if diff := cmp.Diff(want, IAMBindings(cfg)); diff != "" {
+		t.Errorf("IAM bindings mismatch (-want +got):\n%s", diff)
+	}
+	if got := DataflowEnvironment(cfg); got != nil {
+		t.Errorf("expect no Dataflow environment for the direct runner, got %v", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := testConfig()
+	cfg.Dataflow = nil
+	if err := Validate(cfg); err == nil {
+		t.Error("expect error for the dataflow runner without Dataflow config")
+	}
+	cfg.PipelineRunner = "spark"
+	if err := Validate(cfg); err == nil {
+		t.Error("expect error for unknown pipeline runner")
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jobexport streams a record of each finished query into BigQuery for fleet-wide analytics.
+//
+// Each helper inserts one row per query when it completes or aborts the query, with the result manifest, the counters
+// of each aggregation level, the epsilon spent on each level and the lifecycle steps. The rows of all the helpers go
+// into a table with the fixed Schema, partitioned by the export time, so dashboards can follow the error rates, noise
+// levels and costs per origin over time.
+package jobexport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+// Statuses of the exported queries.
+const (
+	StatusComplete = "complete"
+	StatusAborted  = "aborted"
+)
+
+// Level contains the epsilon and the counters of the aggregation of one level of a query.
+type Level struct {
+	Level   int64   `bigquery:"level"`
+	Epsilon float64 `bigquery:"epsilon"`
+	// Counters from the expansion statistics of the level, which are zero if the pipeline did not write them.
+	ReportCount        int64 `bigquery:"report_count"`
+	PrefixCount        int64 `bigquery:"prefix_count"`
+	VectorLength       int64 `bigquery:"vector_length"`
+	NonzeroBucketCount int64 `bigquery:"nonzero_bucket_count"`
+	ExpandTimeMillis   int64 `bigquery:"expand_time_ms"`
+	CombineTimeMillis  int64 `bigquery:"combine_time_ms"`
+}
+
+// ResultFile is a final result file in the manifest of a query.
+type ResultFile struct {
+	Name   string `bigquery:"name"`
+	SHA256 string `bigquery:"sha256"`
+}
+
+// Step is a lifecycle step of a query.
+type Step struct {
+	Step string    `bigquery:"step"`
+	Time time.Time `bigquery:"time"`
+}
+
+// Row is the record of a finished query on one helper.
+type Row struct {
+	QueryID         string `bigquery:"query_id"`
+	Origin          string `bigquery:"origin"`
+	AggregationType string `bigquery:"aggregation_type"`
+	Status          string `bigquery:"status"`
+	// Class of the failure of an aborted query, in the failure classes of the pipelines if it failed in a pipeline.
+	ErrorClass       string       `bigquery:"error_class"`
+	Error            string       `bigquery:"error"`
+	TotalEpsilon     float64      `bigquery:"total_epsilon"`
+	RequestedEpsilon float64      `bigquery:"requested_epsilon"`
+	KeyBitSize       int64        `bigquery:"key_bit_size"`
+	DebugBatch       bool         `bigquery:"debug_batch"`
+	ResultURI        string       `bigquery:"result_uri"`
+	ResultFiles      []ResultFile `bigquery:"result_files"`
+	ManifestSigned   bool         `bigquery:"manifest_signed"`
+	Levels           []Level      `bigquery:"levels"`
+	Steps            []Step       `bigquery:"steps"`
+	ExportTime       time.Time    `bigquery:"export_time"`
+}
+
+// Schema is the schema of the exported table. Columns are only ever added to it, so the queries of the dashboards keep
+// working across helper versions.
+var Schema = bigquery.Schema{
+	{Name: "query_id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "origin", Type: bigquery.StringFieldType, Required: true},
+	{Name: "aggregation_type", Type: bigquery.StringFieldType},
+	{Name: "status", Type: bigquery.StringFieldType, Required: true},
+	{Name: "error_class", Type: bigquery.StringFieldType},
+	{Name: "error", Type: bigquery.StringFieldType},
+	{Name: "total_epsilon", Type: bigquery.FloatFieldType},
+	{Name: "requested_epsilon", Type: bigquery.FloatFieldType},
+	{Name: "key_bit_size", Type: bigquery.IntegerFieldType},
+	{Name: "debug_batch", Type: bigquery.BooleanFieldType},
+	{Name: "result_uri", Type: bigquery.StringFieldType},
+	{Name: "result_files", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+		{Name: "name", Type: bigquery.StringFieldType},
+		{Name: "sha256", Type: bigquery.StringFieldType},
+	}},
+	{Name: "manifest_signed", Type: bigquery.BooleanFieldType},
+	{Name: "levels", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+		{Name: "level", Type: bigquery.IntegerFieldType},
+		{Name: "epsilon", Type: bigquery.FloatFieldType},
+		{Name: "report_count", Type: bigquery.IntegerFieldType},
+		{Name: "prefix_count", Type: bigquery.IntegerFieldType},
+		{Name: "vector_length", Type: bigquery.IntegerFieldType},
+		{Name: "nonzero_bucket_count", Type: bigquery.IntegerFieldType},
+		{Name: "expand_time_ms", Type: bigquery.IntegerFieldType},
+		{Name: "combine_time_ms", Type: bigquery.IntegerFieldType},
+	}},
+	{Name: "steps", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+		{Name: "step", Type: bigquery.StringFieldType},
+		{Name: "time", Type: bigquery.TimestampFieldType},
+	}},
+	{Name: "export_time", Type: bigquery.TimestampFieldType, Required: true},
+}
+
+// CheckSchema returns an error if a column of Schema is missing in the existing schema, or has a different type.
+// Columns added to the table by others are allowed.
+func CheckSchema(existing, want bigquery.Schema) error {
+	fields := make(map[string]*bigquery.FieldSchema)
+	for _, f := range existing {
+		fields[f.Name] = f
+	}
+	for _, w := range want {
+		f, ok := fields[w.Name]
+		if !ok {
+			return fmt.Errorf("missing column %q", w.Name)
+		}
+		if f.Type != w.Type || f.Repeated != w.Repeated {
+			return fmt.Errorf("expect column %q of type %s (repeated %v), got %s (repeated %v)", w.Name, w.Type, w.Repeated, f.Type, f.Repeated)
+		}
+		if w.Type == bigquery.RecordFieldType {
+			if err := CheckSchema(f.Schema, w.Schema); err != nil {
+				return fmt.Errorf("in column %q: %v", w.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// EnsureTable creates the table with Schema if it does not exist, or checks that the existing table has the columns
+// of Schema.
+func EnsureTable(ctx context.Context, table *bigquery.Table) error {
+	metadata, err := table.Metadata(ctx)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return table.Create(ctx, &bigquery.TableMetadata{
+			Schema:           Schema,
+			TimePartitioning: &bigquery.TimePartitioning{Field: "export_time"},
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if err := CheckSchema(metadata.Schema, Schema); err != nil {
+		return fmt.Errorf("table %s.%s does not match the export schema: %v", table.DatasetID, table.TableID, err)
+	}
+	return nil
+}
+
+// ParseTable parses the table in the format "project.dataset.table".
+func ParseTable(s string) (project, dataset, table string, err error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("expect table in format project.dataset.table, got %q", s)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// Inserter streams rows into a table, e.g. a *bigquery.Inserter.
+type Inserter interface {
+	Put(ctx context.Context, src interface{}) error
+}
+
+// InsertID identifies the row of a query on a helper, so BigQuery drops the duplicates when the export is retried.
+func InsertID(row *Row) string {
+	return fmt.Sprintf("%s/%s/%s", row.Origin, row.QueryID, row.Status)
+}
+
+// Exporter exports the rows of the finished queries.
+type Exporter struct {
+	Inserter Inserter
+	now      func() time.Time
+}
+
+// NewExporter creates an Exporter that streams the rows with the inserter.
+func NewExporter(inserter Inserter) *Exporter {
+	return &Exporter{Inserter: inserter, now: time.Now}
+}
+
+// Export streams the row into the table, with the current time as the export time.
+func (e *Exporter) Export(ctx context.Context, row *Row) error {
+	row.ExportTime = e.now().UTC()
+	return e.Inserter.Put(ctx, &bigquery.StructSaver{Schema: Schema, InsertID: InsertID(row), Struct: row})
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobexport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSchemaMatchesRow(t *testing.T) {
+	inferred, err := bigquery.InferSchema(Row{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchema(inferred, Schema); err != nil {
+		t.Errorf("Row does not have the columns of Schema: %v", err)
+	}
+	if err := CheckSchema(Schema, inferred); err != nil {
+		t.Errorf("Schema does not have the fields of Row: %v", err)
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	want := bigquery.Schema{
+		{Name: "query_id", Type: bigquery.StringFieldType},
+		{Name: "steps", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+			{Name: "time", Type: bigquery.TimestampFieldType},
+		}},
+	}
+	for _, tc := range []struct {
+		desc     string
+		existing bigquery.Schema
+		wantErr  bool
+	}{
+		{
+			desc:     "extra column",
+			existing: append(bigquery.Schema{{Name: "note", Type: bigquery.StringFieldType}}, want...),
+		},
+		{
+			desc:     "missing column",
+			existing: want[1:],
+			wantErr:  true,
+		},
+		{
+			desc: "different type",
+			existing: bigquery.Schema{
+				{Name: "query_id", Type: bigquery.IntegerFieldType},
+				want[1],
+			},
+			wantErr: true,
+		},
+		{
+			desc: "different nested type",
+			existing: bigquery.Schema{
+				want[0],
+				{Name: "steps", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+					{Name: "time", Type: bigquery.StringFieldType},
+				}},
+			},
+			wantErr: true,
+		},
+	} {
+		if err := CheckSchema(tc.existing, want); (err != nil) != tc.wantErr {
+			t.Errorf("%s: expect error %v, got %v", tc.desc, tc.wantErr, err)
+		}
+	}
+}
+
+type fakeInserter struct {
+	puts []interface{}
+}
+
+func (f *fakeInserter) Put(ctx context.Context, src interface{}) error {
+	f.puts = append(f.puts, src)
+	return nil
+}
+
+func TestExport(t *testing.T) {
+	inserter := &fakeInserter{}
+	exporter := NewExporter(inserter)
+	exportTime := time.Unix(1000, 0).UTC()
+	exporter.now = func() time.Time { return exportTime }
+
+	row := &Row{
+		QueryID:      "query1",
+		Origin:       "helper1",
+		Status:       StatusComplete,
+		TotalEpsilon: 1,
+		Levels:       []Level{{Level: 0, Epsilon: 0.5, ReportCount: 100}, {Level: 1, Epsilon: 0.5, ReportCount: 100}},
+	}
+	if err := exporter.Export(context.Background(), row); err != nil {
+		t.Fatal(err)
+	}
+	if len(inserter.puts) != 1 {
+		t.Fatalf("expect 1 insert, got %d", len(inserter.puts))
+	}
+	saver, ok := inserter.puts[0].(*bigquery.StructSaver)
+	if !ok {
+		t.Fatalf("expect *bigquery.StructSaver, got %T", inserter.puts[0])
+	}
+	if got, want := saver.InsertID, "helper1/query1/complete"; got != want {
+		t.Errorf("expect insert ID %q, got %q", want, got)
+	}
+	if diff := cmp.Diff(row, saver.Struct); diff != "" {
+		t.Errorf("exported row mismatch (-want +got):\n%s", diff)
+	}
+	if !row.ExportTime.Equal(exportTime) {
+		t.Errorf("expect export time %v, got %v", exportTime, row.ExportTime)
+	}
+}
+
+func TestParseTable(t *testing.T) {
+	project, dataset, table, err := ParseTable("project1.dataset1.table1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if project != "project1" || dataset != "dataset1" || table != "table1" {
+		t.Errorf("expect project1, dataset1 and table1, got %q, %q and %q", project, dataset, table)
+	}
+	for _, s := range []string{"dataset1.table1", "project1..table1", "project1.dataset1.table1.column1"} {
+		if _, _, _, err := ParseTable(s); err == nil {
+			t.Errorf("expect error for table %q", s)
+		}
+	}
+}
@@ -7,12 +7,16 @@ import (
 	"time"
 
 	"cloud.google.com/go/firestore"
+	"github.com/google/privacy-sandbox-aggregation-service/service/clienttoken"
 )
 
 // Paths should be used when writing to Firestore.
 const (
 	ProdPath = "jobs"
 	TestPath = "jobs-test"
+
+	// Collection of the client tokens, keyed by clienttoken.Key.
+	ClientTokenPath = "client-tokens"
 )
 
 // PipelineJob represent a Beam pipeline job on an aggregator for a certain level of a aggregation job.
@@ -38,6 +42,8 @@ type AggregationJob struct {
 	Created time.Time `firestore:"created,omitempty"`
 	// Number of levels required by the job.
 	Levels int `firestore:"levels,omitempty"`
+	// Times of the lifecycle steps of the job, keyed by the step names in package latencyslo.
+	Lifecycle map[string]time.Time `firestore:"lifecycle,omitempty"`
 }
 
 // WriteJobs writes a list of jobs to Firestore. The input jobs are keyed by the query IDs.
@@ -64,3 +70,62 @@ func WriteJobs(ctx context.Context, client *firestore.Client, path string, jobs
 	}
 	return nil
 }
+
+// LifecycleStore records the lifecycle steps of the jobs in Firestore for latency tracking.
+type LifecycleStore struct {
+	Client *firestore.Client
+	Path   string
+}
+
+// RecordStep records the time of a step of the job, keeping the other fields of the job.
+func (s *LifecycleStore) RecordStep(ctx context.Context, queryID, step string, t time.Time) error {
+	_, err := s.Client.Collection(s.Path).Doc(queryID).Set(ctx, map[string]interface{}{
+		"lifecycle": map[string]interface{}{step: t},
+	}, firestore.MergeAll)
+	return err
+}
+
+// ReadSteps reads the recorded steps of the job. No step is returned if the job does not exist.
+func (s *LifecycleStore) ReadSteps(ctx context.Context, queryID string) (map[string]time.Time, error) {
+	doc, err := s.Client.Collection(s.Path).Doc(queryID).Get(ctx)
+	if doc != nil && !doc.Exists() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := &AggregationJob{}
+	if err := doc.DataTo(job); err != nil {
+		return nil, err
+	}
+	return job.Lifecycle, nil
+}
+
+// TokenStore records the client tokens of the queries in Firestore.
+type TokenStore struct {
+	Client *firestore.Client
+	Path   string
+}
+
+// Update implements clienttoken.Store in a transaction.
+func (s *TokenStore) Update(ctx context.Context, key string, f func(*clienttoken.Record) (*clienttoken.Record, error)) error {
+	ref := s.Client.Collection(s.Path).Doc(key)
+	return s.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var existing *clienttoken.Record
+		doc, err := tx.Get(ref)
+		if doc == nil || doc.Exists() {
+			if err != nil {
+				return err
+			}
+			existing = &clienttoken.Record{}
+			if err := doc.DataTo(existing); err != nil {
+				return err
+			}
+		}
+		record, err := f(existing)
+		if err != nil || record == nil {
+			return err
+		}
+		return tx.Set(ref, record)
+	})
+}
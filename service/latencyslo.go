@@ -0,0 +1,410 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package latencyslo tracks the end-to-end latency of the queries against turnaround-time objectives.
+//
+// The helper records the time of each lifecycle step of a query, e.g. when the batch is ready, when the first pipeline
+// is launched, when each level is done and when the querier merges the results. An objective bounds the time between
+// two of the steps, and the tracker reports the latencies of each query and the aggregate attainment of the objectives.
+package latencyslo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// Lifecycle steps of a query.
+const (
+	StepBatchReady  = "batch_ready"
+	StepJobLaunched = "job_launched"
+	StepMerged      = "merged"
+)
+
+// DefaultMaxQueries is the default number of queries whose timelines are kept in memory.
+const DefaultMaxQueries = 10000
+
+// ErrUnknownQuery is returned when a step is reported for a query that the helper has not recorded.
+var ErrUnknownQuery = errors.New("query not tracked by the helper")
+
+// LevelDoneStep returns the step when the aggregation of the level is done on the helper.
+func LevelDoneStep(level int32) string {
+	return fmt.Sprintf("level_%d_done", level)
+}
+
+// Objective is the target latency between two lifecycle steps.
+type Objective struct {
+	From, To string
+	Target   time.Duration
+}
+
+// Name identifies the objective in the metrics.
+func (o *Objective) Name() string {
+	return o.From + ":" + o.To
+}
+
+// ParseObjectives parses the objectives in the format "from1:to1=duration1,from2:to2=duration2", e.g.
+// "batch_ready:merged=6h,job_launched:level_0_done=30m".
+func ParseObjectives(s string) ([]*Objective, error) {
+	var objectives []*Objective
+	if s == "" {
+		return objectives, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		steps := strings.SplitN(kv[0], ":", 2)
+		if len(kv) != 2 || len(steps) != 2 || steps[0] == "" || steps[1] == "" {
+			return nil, fmt.Errorf("expect objective in format from:to=duration, got %q", item)
+		}
+		target, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid target latency in objective %q: %v", item, err)
+		}
+		if target <= 0 {
+			return nil, fmt.Errorf("expect positive target latency in objective %q", item)
+		}
+		objectives = append(objectives, &Objective{From: steps[0], To: steps[1], Target: target})
+	}
+	return objectives, nil
+}
+
+// Store persists the lifecycle steps of the queries, e.g. in the job store, so the timelines survive restarts of the
+// helper.
+type Store interface {
+	RecordStep(ctx context.Context, queryID, step string, t time.Time) error
+	ReadSteps(ctx context.Context, queryID string) (map[string]time.Time, error)
+}
+
+// Tracker records the lifecycle steps of the queries and computes the latency metrics.
+type Tracker struct {
+	Objectives []*Objective
+	// The steps are only kept in memory if Store is nil.
+	Store Store
+	// Number of queries kept in memory, beyond which the earliest tracked queries are evicted, and are only kept in the
+	// store. The summary only covers the queries in memory. The memory is not bounded if zero.
+	MaxQueries int
+
+	now       func() time.Time
+	mu        sync.Mutex
+	timelines map[string]map[string]time.Time
+	// IDs of the queries in memory in the order they are tracked.
+	order []string
+}
+
+// NewTracker creates a tracker for the objectives.
+func NewTracker(objectives []*Objective, store Store) *Tracker {
+	return &Tracker{
+		Objectives: objectives,
+		Store:      store,
+		MaxQueries: DefaultMaxQueries,
+		now:        time.Now,
+		timelines:  make(map[string]map[string]time.Time),
+	}
+}
+
+// readTimeline returns the steps of the query in memory, or otherwise in the store, without tracking the query in
+// memory.
+func (t *Tracker) readTimeline(ctx context.Context, queryID string) map[string]time.Time {
+	if steps, ok := t.timelines[queryID]; ok {
+		return steps
+	}
+	steps := make(map[string]time.Time)
+	if t.Store != nil {
+		stored, err := t.Store.ReadSteps(ctx, queryID)
+		if err != nil {
+			log.Warningf("failed to read the lifecycle steps of query %q: %v", queryID, err)
+		}
+		for step, ts := range stored {
+			steps[step] = ts
+		}
+	}
+	return steps
+}
+
+// timeline returns the steps of the query, which are loaded from the store when the query is first tracked in memory.
+func (t *Tracker) timeline(ctx context.Context, queryID string) map[string]time.Time {
+	if steps, ok := t.timelines[queryID]; ok {
+		return steps
+	}
+	steps := t.readTimeline(ctx, queryID)
+	t.timelines[queryID] = steps
+	t.order = append(t.order, queryID)
+	for t.MaxQueries > 0 && len(t.order) > t.MaxQueries {
+		delete(t.timelines, t.order[0])
+		t.order = t.order[1:]
+	}
+	return steps
+}
+
+// Record records the step of the query at the time, or at the current time if the time is zero. Only the first
+// record of a step is kept, so retried requests do not move the steps.
+func (t *Tracker) Record(ctx context.Context, queryID, step string, ts time.Time) {
+	if t == nil {
+		return
+	}
+	if ts.IsZero() {
+		ts = t.now()
+	}
+	ts = ts.UTC()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record(ctx, queryID, step, ts)
+}
+
+// RecordReported records a step reported from outside the helper, e.g. by the querier, at the time, or at the current
+// time if the time is zero. ErrUnknownQuery is returned if the helper has not recorded any step of the query, so the
+// reports can not add queries.
+func (t *Tracker) RecordReported(ctx context.Context, queryID, step string, ts time.Time) error {
+	if ts.IsZero() {
+		ts = t.now()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.readTimeline(ctx, queryID)) == 0 {
+		return fmt.Errorf("%w: %q", ErrUnknownQuery, queryID)
+	}
+	t.record(ctx, queryID, step, ts.UTC())
+	return nil
+}
+
+func (t *Tracker) record(ctx context.Context, queryID, step string, ts time.Time) {
+	steps := t.timeline(ctx, queryID)
+	if _, ok := steps[step]; ok {
+		return
+	}
+	steps[step] = ts
+	if t.Store != nil {
+		// Tracking the latency is optional, so the query continues without persisting the step.
+		if err := t.Store.RecordStep(ctx, queryID, step, ts); err != nil {
+			log.Warningf("failed to persist step %q of query %q: %v", step, queryID, err)
+		}
+	}
+}
+
+// ObjectiveLatency is the latency of a query for an objective. Latency is the elapsed time so far if the query has
+// not reached the end step.
+type ObjectiveLatency struct {
+	Objective string
+	Target    time.Duration
+	Latency   time.Duration
+	Completed bool
+	// Whether the latency is beyond the target, which can be known before the query completes.
+	Breached bool
+}
+
+// QueryLatency contains the lifecycle steps and the latencies of a query.
+type QueryLatency struct {
+	QueryID   string
+	Steps     map[string]time.Time
+	Latencies []*ObjectiveLatency
+}
+
+func (t *Tracker) objectiveLatency(o *Objective, steps map[string]time.Time, now time.Time) (*ObjectiveLatency, bool) {
+	from, ok := steps[o.From]
+	if !ok {
+		return nil, false
+	}
+	l := &ObjectiveLatency{Objective: o.Name(), Target: o.Target}
+	if to, ok := steps[o.To]; ok {
+		l.Latency, l.Completed = to.Sub(from), true
+	} else {
+		l.Latency = now.Sub(from)
+	}
+	l.Breached = l.Latency > o.Target
+	return l, true
+}
+
+// Query returns the latencies of a query. Objectives whose start step has not been reached are omitted.
+func (t *Tracker) Query(ctx context.Context, queryID string) *QueryLatency {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	steps := t.readTimeline(ctx, queryID)
+	result := &QueryLatency{QueryID: queryID, Steps: make(map[string]time.Time)}
+	for step, ts := range steps {
+		result.Steps[step] = ts
+	}
+	for _, o := range t.Objectives {
+		if l, ok := t.objectiveLatency(o, steps, now); ok {
+			result.Latencies = append(result.Latencies, l)
+		}
+	}
+	return result
+}
+
+// ObjectiveSummary aggregates the latencies of the queries tracked in memory for an objective.
+type ObjectiveSummary struct {
+	Objective string
+	Target    time.Duration
+	// Number of queries that reached the end step, and how many of them were within the target.
+	Completed  int
+	WithinSLO  int
+	Attainment float64
+	P50        time.Duration
+	P90        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+	// IDs of the queries that have not reached the end step but are already beyond the target.
+	InProgressBreaching []string `json:",omitempty"`
+}
+
+// percentile returns the nearest-rank percentile of the sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Summary returns the aggregate metrics for each objective.
+func (t *Tracker) Summary() []*ObjectiveSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+
+	queryIDs := make([]string, 0, len(t.timelines))
+	for queryID := range t.timelines {
+		queryIDs = append(queryIDs, queryID)
+	}
+	sort.Strings(queryIDs)
+
+	var summaries []*ObjectiveSummary
+	for _, o := range t.Objectives {
+		s := &ObjectiveSummary{Objective: o.Name(), Target: o.Target}
+		var latencies []time.Duration
+		for _, queryID := range queryIDs {
+			l, ok := t.objectiveLatency(o, t.timelines[queryID], now)
+			if !ok {
+				continue
+			}
+			if !l.Completed {
+				if l.Breached {
+					s.InProgressBreaching = append(s.InProgressBreaching, queryID)
+				}
+				continue
+			}
+			latencies = append(latencies, l.Latency)
+			if !l.Breached {
+				s.WithinSLO++
+			}
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		s.Completed = len(latencies)
+		if s.Completed > 0 {
+			s.Attainment = float64(s.WithinSLO) / float64(s.Completed)
+			s.P50 = percentile(latencies, 0.5)
+			s.P90 = percentile(latencies, 0.9)
+			s.P99 = percentile(latencies, 0.99)
+			s.Max = latencies[len(latencies)-1]
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
+
+// StepRecord is the request body for recording a step that happens outside the helper, e.g. when the querier merges
+// the results.
+type StepRecord struct {
+	QueryID string
+	Step    string
+	// The current time is used if zero.
+	Time time.Time
+}
+
+// Handler exposes the latency metrics.
+//
+// GET returns the summary of all objectives, or the latencies of the query given by the form value "query_id"; POST
+// with a JSON StepRecord in the body records a step that happens outside the helper, which is only StepMerged, for a
+// query tracked by the helper. The handler is served behind authz.Authorizer, which authenticates the callers.
+type Handler struct {
+	Tracker *Tracker
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		if queryID := req.FormValue("query_id"); queryID != "" {
+			writeJSON(w, h.Tracker.Query(req.Context(), queryID))
+			return
+		}
+		writeJSON(w, h.Tracker.Summary())
+	case http.MethodPost:
+		record := &StepRecord{}
+		if err := json.NewDecoder(req.Body).Decode(record); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if record.QueryID == "" || record.Step == "" {
+			http.Error(w, "query ID and step are required", http.StatusBadRequest)
+			return
+		}
+		if record.Step != StepMerged {
+			http.Error(w, fmt.Sprintf("only step %s can be reported, got %s", StepMerged, record.Step), http.StatusBadRequest)
+			return
+		}
+		if err := h.Tracker.RecordReported(req.Context(), record.QueryID, record.Step, record.Time); errors.Is(err, ErrUnknownQuery) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ReportStep records a step of the query on the helper at the URL of the handler.
+func ReportStep(client *http.Client, handlerURL, token string, record *StepRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, handlerURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error reporting step %s of query %q to %s: %s", record.Step, record.QueryID, handlerURL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package latencyslo
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var start = time.Date(2021, 10, 4, 0, 0, 0, 0, time.UTC)
+
+type memoryStore struct {
+	steps map[string]map[string]time.Time
+}
+
+func (s *memoryStore) RecordStep(ctx context.Context, queryID, step string, t time.Time) error {
+	if s.steps[queryID] == nil {
+		s.steps[queryID] = make(map[string]time.Time)
+	}
+	s.steps[queryID][step] = t
+	return nil
+}
+
+func (s *memoryStore) ReadSteps(ctx context.Context, queryID string) (map[string]time.Time, error) {
+	return s.steps[queryID], nil
+}
+
+func TestParseObjectives(t *testing.T) {
+	got, err := ParseObjectives("batch_ready:merged=6h,job_launched:level_0_done=30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Objective{
+		{From: StepBatchReady, To: StepMerged, Target: 6 * time.Hour},
+		{From: StepJobLaunched, To: LevelDoneStep(0), Target: 30 * time.Minute},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("objectives mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, s := range []string{"batch_ready=6h", "batch_ready:merged", "batch_ready:merged=6", "batch_ready:merged=-1h", ":merged=1h"} {
+		if _, err := ParseObjectives(s); err == nil {
+			t.Errorf("expect error for objectives %q", s)
+		}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	ctx := context.Background()
+	objective := &Objective{From: StepBatchReady, To: StepMerged, Target: 2 * time.Hour}
+	tracker := NewTracker([]*Objective{objective}, nil)
+	now := start
+	tracker.now = func() time.Time { return now }
+
+	// Three completed queries taking 1h, 1.5h and 3h, and a running one for 2.5h.
+	for i, latency := range []time.Duration{time.Hour, 90 * time.Minute, 3 * time.Hour} {
+		queryID := string(rune('a' + i))
+		tracker.Record(ctx, queryID, StepBatchReady, start)
+		tracker.Record(ctx, queryID, StepMerged, start.Add(latency))
+	}
+	tracker.Record(ctx, "running", StepBatchReady, time.Time{})
+	// Steps recorded again by retried requests are ignored.
+	tracker.Record(ctx, "a", StepMerged, start.Add(10*time.Hour))
+	now = start.Add(150 * time.Minute)
+
+	want := []*ObjectiveSummary{{
+		Objective:           "batch_ready:merged",
+		Target:              2 * time.Hour,
+		Completed:           3,
+		WithinSLO:           2,
+		Attainment:          2.0 / 3,
+		P50:                 90 * time.Minute,
+		P90:                 3 * time.Hour,
+		P99:                 3 * time.Hour,
+		Max:                 3 * time.Hour,
+		InProgressBreaching: []string{"running"},
+	}}
+	if diff := cmp.Diff(want, tracker.Summary()); diff != "" {
+		t.Errorf("summary mismatch (-want +got):\n%s", diff)
+	}
+
+	wantQuery := &QueryLatency{
+		QueryID:   "running",
+		Steps:     map[string]time.Time{StepBatchReady: start},
+		Latencies: []*ObjectiveLatency{{Objective: "batch_ready:merged", Target: 2 * time.Hour, Latency: 150 * time.Minute, Breached: true}},
+	}
+	if diff := cmp.Diff(wantQuery, tracker.Query(ctx, "running")); diff != "" {
+		t.Errorf("query latency mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestTrackerStore(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{steps: make(map[string]map[string]time.Time)}
+	NewTracker(nil, store).Record(ctx, "query", StepBatchReady, start)
+
+	// A new tracker, e.g. after the helper restarts, continues the timeline from the store.
+	tracker := NewTracker(nil, store)
+	tracker.Record(ctx, "query", StepBatchReady, start.Add(time.Hour))
+	tracker.Record(ctx, "query", LevelDoneStep(0), start.Add(time.Hour))
+
+	want := map[string]time.Time{StepBatchReady: start, LevelDoneStep(0): start.Add(time.Hour)}
+	if diff := cmp.Diff(want, store.steps["query"]); diff != "" {
+		t.Errorf("stored steps mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestTrackerBounded(t *testing.T) {
+	ctx := context.Background()
+	tracker := NewTracker(nil, nil)
+	tracker.MaxQueries = 2
+
+	// Reading the latencies of unknown queries does not track them.
+	tracker.Query(ctx, "unknown")
+	if len(tracker.timelines) != 0 {
+		t.Errorf("expect no query tracked after reading, got %d", len(tracker.timelines))
+	}
+
+	for _, queryID := range []string{"query1", "query2", "query3"} {
+		tracker.Record(ctx, queryID, StepBatchReady, start)
+	}
+	if _, ok := tracker.timelines["query1"]; ok || len(tracker.timelines) != 2 {
+		t.Errorf("expect the earliest query evicted, got %d queries", len(tracker.timelines))
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tracker := NewTracker([]*Objective{{From: StepBatchReady, To: StepMerged, Target: time.Hour}}, nil)
+	server := httptest.NewServer(&Handler{Tracker: tracker})
+	defer server.Close()
+	client := server.Client()
+
+	tracker.Record(context.Background(), "query", StepBatchReady, start)
+	if err := ReportStep(client, server.URL, "", &StepRecord{QueryID: "query", Step: StepMerged, Time: start.Add(30 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	for desc, record := range map[string]*StepRecord{
+		"record without query ID":     {Step: StepMerged},
+		"step recorded by the helper": {QueryID: "query", Step: StepJobLaunched},
+		"query unknown to the helper": {QueryID: "unknown", Step: StepMerged},
+	} {
+		if err := ReportStep(client, server.URL, "", record); err == nil {
+			t.Errorf("expect error for %s", desc)
+		}
+	}
+
+	resp, err := client.Get(server.URL + "?query_id=query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got := &QueryLatency{}
+	if err := json.NewDecoder(resp.Body).Decode(got); err != nil {
+		t.Fatal(err)
+	}
+	want := &QueryLatency{
+		QueryID:   "query",
+		Steps:     map[string]time.Time{StepBatchReady: start, StepMerged: start.Add(30 * time.Minute)},
+		Latencies: []*ObjectiveLatency{{Objective: "batch_ready:merged", Target: time.Hour, Latency: 30 * time.Minute, Completed: true}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("query latency mismatch (-want +got):\n%s", diff)
+	}
+
+	resp, err = client.Post(server.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expect status BadRequest for an empty body, got %s", resp.Status)
+	}
+}
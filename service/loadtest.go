@@ -0,0 +1,270 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loadtest generates load on the collector service for capacity planning.
+//
+// The client posts synthetic reports at a fixed rate, with random payloads of the size of the encrypted reports sent by
+// the browsers, and measures the latency and the errors of the responses. The payloads are not valid ciphertexts, so
+// the batches written by the collector during a load test must not be aggregated.
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
+)
+
+// DefaultPayloadSize is about the size in bytes of an encrypted DPF payload with 32-bit bucket keys.
+const DefaultPayloadSize = 1024
+
+// Config contains the parameters of a load test.
+type Config struct {
+	// URL of the report endpoint of the collector.
+	URL string
+	// Reports sent per second.
+	QPS float64
+	// Duration of the load test.
+	Duration time.Duration
+	// Maximum number of requests in flight. A report is skipped instead of delaying the next ones if all the requests
+	// are in flight, so the QPS is kept when the collector slows down.
+	Concurrency int
+	// Number of payloads in each report, 2 for the MPC protocol and 1 for the one-party protocol.
+	PayloadCount int
+	// Size in bytes of each payload before the base64 encoding.
+	PayloadSize int
+	// Reporting origin in the shared info of the reports, which is checked against the runtime config of the collector.
+	ReportingOrigin string
+	// Key ID of the payloads, which must be pinned for the reporting origin if the collector checks the key pins.
+	KeyID string
+	// Bearer token sent with the requests if not empty.
+	Token string
+	// Seed of the random payloads.
+	Seed int64
+}
+
+// Validate checks the parameters of the load test.
+func (c *Config) Validate() error {
+	if c.URL == "" {
+		return errors.New("expect non-empty URL")
+	}
+	if c.QPS <= 0 {
+		return fmt.Errorf("expect positive QPS, got %v", c.QPS)
+	}
+	if c.Duration <= 0 {
+		return fmt.Errorf("expect positive duration, got %v", c.Duration)
+	}
+	if c.Concurrency <= 0 {
+		return fmt.Errorf("expect positive concurrency, got %d", c.Concurrency)
+	}
+	if c.PayloadCount != 1 && c.PayloadCount != 2 {
+		return fmt.Errorf("expect 1 or 2 payloads, got %d", c.PayloadCount)
+	}
+	if c.PayloadSize <= 0 {
+		return fmt.Errorf("expect positive payload size, got %d", c.PayloadSize)
+	}
+	return nil
+}
+
+// NewReport creates a synthetic report with random payloads and a unique report ID.
+func NewReport(c *Config, random *rand.Rand) (*reporttypes.AggregatableReport, error) {
+	sharedInfo, err := json.Marshal(&reporttypes.SharedInfo{
+		ScheduledReportTime: fmt.Sprint(time.Now().Unix()),
+		Version:             "0.1",
+		ReportID:            uuid.New(),
+		ReportingOrigin:     c.ReportingOrigin,
+	})
+	if err != nil {
+		return nil, err
+	}
+	report := &reporttypes.AggregatableReport{SharedInfo: string(sharedInfo)}
+	for i := 0; i < c.PayloadCount; i++ {
+		payload := make([]byte, c.PayloadSize)
+		random.Read(payload)
+		report.AggregationServicePayloads = append(report.AggregationServicePayloads, &reporttypes.AggregationServicePayload{
+			Payload: base64.StdEncoding.EncodeToString(payload),
+			KeyID:   c.KeyID,
+		})
+	}
+	return report, nil
+}
+
+// Result contains the measurements of a load test.
+type Result struct {
+	Duration time.Duration
+	// Number of reports sent, including the failed ones.
+	Sent int64
+	// Number of reports skipped because all the requests were in flight.
+	Skipped int64
+	// Number of failed reports by HTTP status, or by "transport" for requests without response.
+	Errors map[string]int64
+	// Latencies of the requests with a response, sorted in ascending order.
+	Latencies []time.Duration
+}
+
+// ErrorCount returns the number of failed reports.
+func (r *Result) ErrorCount() int64 {
+	var n int64
+	for _, count := range r.Errors {
+		n += count
+	}
+	return n
+}
+
+// ErrorRate returns the fraction of the sent reports that failed.
+func (r *Result) ErrorRate() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.ErrorCount()) / float64(r.Sent)
+}
+
+// QPS returns the rate of the sent reports.
+func (r *Result) QPS() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Sent) / r.Duration.Seconds()
+}
+
+// Percentile returns the latency at the percentile p in [0, 100], or zero if there is no latency.
+func (r *Result) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(p / 100 * float64(len(r.Latencies)-1))
+	return r.Latencies[i]
+}
+
+// String summarizes the result for the logs.
+func (r *Result) String() string {
+	var errs []string
+	for status, count := range r.Errors {
+		errs = append(errs, fmt.Sprintf("%s=%d", status, count))
+	}
+	sort.Strings(errs)
+	return fmt.Sprintf("sent %d reports in %v (%.1f QPS), skipped %d, error rate %.4f [%s], latency p50 %v p90 %v p99 %v max %v",
+		r.Sent, r.Duration.Round(time.Millisecond), r.QPS(), r.Skipped, r.ErrorRate(), strings.Join(errs, ","),
+		r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Percentile(100))
+}
+
+// Run sends the reports to the collector at the configured rate until the duration has passed or the context is done,
+// and waits for the requests in flight.
+func Run(ctx context.Context, client *http.Client, c *Config) (*Result, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	random := rand.New(rand.NewSource(c.Seed))
+	result := &Result{Errors: make(map[string]int64)}
+	var mu sync.Mutex
+	record := func(latency time.Duration, status string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if latency > 0 {
+			result.Latencies = append(result.Latencies, latency)
+		}
+		if status != "" {
+			result.Errors[status]++
+		}
+	}
+
+	requests := make(chan []byte)
+	var wg sync.WaitGroup
+	for i := 0; i < c.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for body := range requests {
+				record(send(ctx, client, c, body))
+			}
+		}()
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / c.QPS))
+	defer ticker.Stop()
+	deadline := time.NewTimer(c.Duration)
+	defer deadline.Stop()
+	var err error
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		case <-deadline.C:
+			break loop
+		case <-ticker.C:
+		}
+		report, reportErr := NewReport(c, random)
+		if reportErr != nil {
+			err = reportErr
+			break loop
+		}
+		body, marshalErr := json.Marshal(report)
+		if marshalErr != nil {
+			err = marshalErr
+			break loop
+		}
+		select {
+		case requests <- body:
+			result.Sent++
+		default:
+			result.Skipped++
+		}
+	}
+	close(requests)
+	wg.Wait()
+	result.Duration = time.Since(start)
+	sort.Slice(result.Latencies, func(i, j int) bool { return result.Latencies[i] < result.Latencies[j] })
+	return result, err
+}
+
+// send posts a report, and returns the latency if there is a response, and the error status if the report failed.
+func send(ctx context.Context, client *http.Client, c *Config, body []byte) (time.Duration, string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "transport"
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "transport"
+	}
+	// The body is drained so the connection is reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(start)
+	if resp.StatusCode != http.StatusOK {
+		return latency, fmt.Sprint(resp.StatusCode)
+	}
+	return latency, ""
+}
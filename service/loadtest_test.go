@@ -0,0 +1,130 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadtest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
+)
+
+func TestNewReport(t *testing.T) {
+	config := &Config{PayloadCount: 2, PayloadSize: 100, ReportingOrigin: "https://origin.example", KeyID: "key1"}
+	random := rand.New(rand.NewSource(0))
+	report, err := NewReport(config, random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := report.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.AggregationServicePayloads) != 2 {
+		t.Fatalf("expect 2 payloads, got %d", len(report.AggregationServicePayloads))
+	}
+	for _, payload := range report.AggregationServicePayloads {
+		b, err := base64.StdEncoding.DecodeString(payload.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != 100 || payload.KeyID != "key1" {
+			t.Errorf("expect payload of 100 bytes with key ID key1, got %d bytes with key ID %q", len(b), payload.KeyID)
+		}
+	}
+	info := &reporttypes.SharedInfo{}
+	if err := json.Unmarshal([]byte(report.SharedInfo), info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ReportingOrigin != "https://origin.example" {
+		t.Errorf("expect reporting origin https://origin.example, got %q", info.ReportingOrigin)
+	}
+
+	another, err := NewReport(config, random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reporttypes.GetReportID(report.SharedInfo) == reporttypes.GetReportID(another.SharedInfo) {
+		t.Error("expect different report IDs")
+	}
+}
+
+func TestRun(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		report := &reporttypes.AggregatableReport{}
+		if err := json.NewDecoder(req.Body).Decode(report); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received++
+		n := received
+		mu.Unlock()
+		// Every other report is rejected.
+		if n%2 == 0 {
+			http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	result, err := Run(context.Background(), server.Client(), &Config{
+		URL:          server.URL,
+		QPS:          200,
+		Duration:     200 * time.Millisecond,
+		Concurrency:  4,
+		PayloadCount: 2,
+		PayloadSize:  DefaultPayloadSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent == 0 {
+		t.Fatal("expect reports sent")
+	}
+	if int(result.Sent) != received {
+		t.Errorf("expect %d reports received, got %d", result.Sent, received)
+	}
+	if got, want := result.Errors["429"], result.Sent/2; got != want {
+		t.Errorf("expect %d reports rejected, got %d: %v", want, got, result)
+	}
+	if int64(len(result.Latencies)) != result.Sent {
+		t.Errorf("expect %d latencies, got %d", result.Sent, len(result.Latencies))
+	}
+	if result.Percentile(50) > result.Percentile(100) {
+		t.Errorf("expect median latency below the maximum: %v", result)
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	for _, config := range []*Config{
+		{QPS: 1, Duration: time.Second, Concurrency: 1, PayloadCount: 2, PayloadSize: 1},
+		{URL: "http://collector", Duration: time.Second, Concurrency: 1, PayloadCount: 2, PayloadSize: 1},
+		{URL: "http://collector", QPS: 1, Duration: time.Second, Concurrency: 1, PayloadCount: 3, PayloadSize: 1},
+	} {
+		if _, err := Run(context.Background(), http.DefaultClient, config); err == nil {
+			t.Errorf("expect error for config %+v", config)
+		}
+	}
+}
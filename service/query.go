@@ -20,9 +20,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"gonum.org/v1/gonum/floats"
 	"lukechampine.com/uint128"
+	"github.com/google/privacy-sandbox-aggregation-service/encryption/incrementaldpf"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
 )
@@ -41,11 +44,47 @@ type HierarchicalConfig struct {
 	PrefixLengths               []int32
 	PrivacyBudgetPerPrefix      []float64
 	ExpansionThresholdPerPrefix []uint64
+	// Number of bits between two adjacent hierarchies in the DPF keys, which must match the granularity used when generating the reports.
+	// Zero or one means the keys have a hierarchy at every prefix length.
+	HierarchyGranularity int32
 }
 
 // DirectConfig contains the parameters for the direct query model.
 type DirectConfig struct {
 	BucketIDs []uint128.Uint128
+	// Inclusive ranges of bucket IDs. If set, the ranges and the bucket IDs are compiled into the minimal set of DPF
+	// prefixes covering them, and the result has the sum of each prefix instead of each bucket.
+	BucketRanges []BucketRange
+	// Number of bits between two adjacent hierarchies in the DPF keys, as in HierarchicalConfig.
+	HierarchyGranularity int32
+}
+
+// BucketRange is an inclusive range of bucket IDs, e.g. [0x00A00000, 0x00AFFFFF].
+type BucketRange struct {
+	Start, End uint128.Uint128
+}
+
+// Prefix is a DPF prefix, which covers the bucket IDs whose first Length bits equal Value.
+type Prefix struct {
+	Value  uint128.Uint128
+	Length int32
+}
+
+// NamedHierarchy is one of the hierarchies in a MultiHierarchyConfig.
+type NamedHierarchy struct {
+	Name string
+	// Fraction of the total privacy budget of the query spent on this hierarchy.
+	BudgetShare float64
+	Config      HierarchicalConfig
+}
+
+// MultiHierarchyConfig requests the same batch aggregated under several hierarchies, e.g. rollups with different
+// prefix lengths, with the privacy budget split between them.
+//
+// All the hierarchies expand the same DPF keys, so each of them is a schedule of prefix lengths over the bit order of
+// the bucket IDs. The reports are only decrypted once, by the first hierarchy, and the others read its decrypted reports.
+type MultiHierarchyConfig struct {
+	Hierarchies []NamedHierarchy
 }
 
 // HierarchicalResult records the aggregation result at certain prefix length.
@@ -121,11 +160,31 @@ func ReadDirectConfigFile(ctx context.Context, filename string) (*DirectConfig,
 	return config, validateDirectConfig(config)
 }
 
+// ReadMultiHierarchyConfigFile reads the MultiHierarchyConfig from a file and validate it.
+func ReadMultiHierarchyConfigFile(ctx context.Context, filename string) (*MultiHierarchyConfig, error) {
+	bc, err := utils.ReadBytes(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	config := &MultiHierarchyConfig{}
+	if err := json.Unmarshal(bc, config); err != nil {
+		return nil, err
+	}
+	return config, validateMultiHierarchyConfig(config)
+}
+
 // Default basic file names.
 const (
 	DefaultExpandParamsFile    = "EXPANDPARAMS"
 	DefaultPartialResultFile   = "PARTIALRESULT"
 	DefaultDecryptedReportFile = "DECRYPTEDREPORT"
+	DefaultExpansionStatsFile  = "EXPANSIONSTATS"
+	DefaultBatchRootFile       = "BATCHROOT"
+	DefaultConsistencyFile     = "CONSISTENCYSHARES"
+	DefaultTraceFile           = "TRACE"
+	DefaultLevelDoneFile       = "LEVELDONE"
+	DefaultChargeFile          = "CHARGE"
+	DefaultCacheDecisionFile   = "CACHEDECISION"
 )
 
 // HelperSharedInfo stores information that is shared by other helpers.
@@ -134,6 +193,12 @@ type HelperSharedInfo struct {
 	// The shared directory where the other helpers will read the intermediate results.
 	SharedDir   string
 	PubSubTopic string
+	// Whether the helper marks the levels done in the shared directory with GetRequestLevelDoneURI. The partial results
+	// of helpers that do not, e.g. older versions, are complete when they exist.
+	LevelDoneMarkers bool
+	// Whether the helper shares its result cache decisions in the shared directory with GetRequestCacheDecisionURI.
+	// The cached results are never served for queries with partners that do not.
+	CacheDecisions bool
 }
 
 // AggregateRequest contains infomation that are necessary for the query.
@@ -141,16 +206,66 @@ type AggregateRequest struct {
 	// The type of aggregation, should be "conversion" or "reach".
 	AggregationType  string
 	PartialReportURI string
-	ExpandConfigURI  string
-	QueryID          string
-	QueryLevel       int32
-	TotalEpsilon     float64
-	KeyBitSize       int32
+	// Encrypted reports added to the batch after it was formed, e.g. reports that arrived late, which are only
+	// supported for the conversion aggregation. They belong to the batch as much as the partial reports: the helpers
+	// compare them in the batch integrity check, charge the budget for them, and decrypt them at the first level with
+	// the partial reports. Ignored if empty.
+	LateReportURI   string
+	ExpandConfigURI string
+	QueryID         string
+	QueryLevel      int32
+	TotalEpsilon    float64
+	// Bit size of the bucket IDs. It is read from the batch metadata if BatchMetadataURI is set, and must agree with it
+	// if not zero.
+	KeyBitSize int32
+	// Metadata of the batch of the helper with the key bit size of the reports, of type dpfaggregator.BatchMetadata.
+	BatchMetadataURI string
 
 	PartnerSharedInfo *HelperSharedInfo
 	ResultDir         string
 	// Dataflow Job Hints
 	NumWorkers int32
+	// Seed for reproducible noise in debug batches, e.g. for comparing the results with a shadow pipeline. Zero means
+	// the noise is not seeded, which is required for production queries. The helpers derive their own secret seeds from
+	// it, and ignore it for the batches that are not debug batches.
+	DebugNoiseSeed uint64
+	// Whether the input is a debug batch, which can be aggregated without noise or with seeded noise when the helpers
+	// run in strict privacy mode. The helpers only honor it if the batch metadata, signed by a trusted batcher, also
+	// flags a debug batch.
+	DebugBatch bool
+	// Name of the hierarchy when the query is one of the hierarchies requested by a MultiHierarchyConfig.
+	Hierarchy string
+	// ID of the query whose decrypted reports are read instead of decrypting the partial reports again, so the
+	// hierarchies of a MultiHierarchyConfig share one decryption pass. Empty means the query decrypts its own reports.
+	DecryptedReportQueryID string
+	// Length of the prefixes aggregated by the request, when the bucket ranges of a DirectConfig compile into prefixes
+	// of several lengths. Zero means the request aggregates all the prefixes.
+	PrefixLength int32
+	// Time when the batch of the query was ready for aggregation, which starts the end-to-end latency of the query. The
+	// time when the helper receives the request is used if zero.
+	BatchReadyTime time.Time
+	// Whether the requester consents to run the query at the remaining privacy budget of the batch when the total
+	// epsilon exceeds it. Otherwise such a query is aborted.
+	AcceptPartialEpsilon bool
+	// Total epsilon requested for the query, which is set by the helper when it runs the query at the remaining budget.
+	// Zero means the query runs with the requested epsilon.
+	RequestedEpsilon float64
+	// Token set by the client on all the attempts to submit the query, so a retry with another query ID is not run
+	// again. Requests without a token are not deduplicated.
+	ClientToken string
+	// Filter applied to the complete histogram when the partial results are merged, in the format of
+	// dpfaggregator.ParsePostFilter. The helpers record it in their result manifests, where the merger reads it. No
+	// filter is applied if empty.
+	PostFilter string
+}
+
+// ReportURIs returns the inputs of the encrypted reports of the request, which are the partial reports and the late
+// reports if set.
+func (r *AggregateRequest) ReportURIs() []string {
+	if r.LateReportURI == "" {
+		return []string{r.PartialReportURI}
+	}
+	return []string{r.PartialReportURI, r.LateReportURI}
 }
 
 // GetRequestPartialResultURI returns the URI of the expected result file for a request.
@@ -158,11 +273,99 @@ func GetRequestPartialResultURI(sharedDir, queryID string, level int32) string {
 	return utils.JoinPath(sharedDir, fmt.Sprintf("%s_%s_%d", queryID, DefaultPartialResultFile, level))
 }
 
+// GetRequestLevelDoneURI returns the URI of the marker written after the partial result of a level is complete. The
+// partner helper only reads the result after the marker exists.
+func GetRequestLevelDoneURI(sharedDir, queryID string, level int32) string {
+	return utils.JoinPath(sharedDir, fmt.Sprintf("%s_%s_%d", queryID, DefaultLevelDoneFile, level))
+}
+
+// GetExpansionStatsURI returns the URI of the expansion statistics, which are written next to the partial result.
+func GetExpansionStatsURI(partialResultURI string) string {
+	return fmt.Sprintf("%s_%s", partialResultURI, DefaultExpansionStatsFile)
+}
+
+// GetRequestBatchRootURI returns the URI of the digest over the reports of a query, which is read by the partner helper.
+func GetRequestBatchRootURI(sharedDir, queryID string) string {
+	return utils.JoinPath(sharedDir, fmt.Sprintf("%s_%s", queryID, DefaultBatchRootFile))
+}
+
+// GetRequestCacheDecisionURI returns the URI of the decision of a helper whether to serve a query from its result cache,
+// which is read by the partner helper.
+func GetRequestCacheDecisionURI(sharedDir, queryID string) string {
+	return utils.JoinPath(sharedDir, fmt.Sprintf("%s_%s", queryID, DefaultCacheDecisionFile))
+}
+
+// GetRequestChargeURI returns the URI of the budget charge of a query, which is kept in the private workspace. The
+// charge of a query split from another one refers to the charged query.
+func GetRequestChargeURI(workDir, queryID string) string {
+	return utils.JoinPath(workDir, fmt.Sprintf("%s_%s", queryID, DefaultChargeFile))
+}
+
+// GetRequestConsistencyShareURI returns the URI of the share sums for the consistency check of a debug batch. Only the
+// helper that does not run the check writes them to its shared directory, where the partner helper reads them.
+func GetRequestConsistencyShareURI(dir, queryID string) string {
+	return utils.JoinPath(dir, fmt.Sprintf("%s_%s", queryID, DefaultConsistencyFile))
+}
+
+// GetRequestConsistencyResultURI returns the URI of the result of the consistency check, which is kept in the private
+// workspace of the helper running the check.
+func GetRequestConsistencyResultURI(workDir, queryID string) string {
+	return utils.JoinPath(workDir, fmt.Sprintf("%s_%s_RESULT", queryID, DefaultConsistencyFile))
+}
+
+// GetRequestTraceURI returns the URI of the trace records of the sampled reports at a level, which are kept in the
+// private workspace.
+func GetRequestTraceURI(workDir, queryID string, level int32) string {
+	return utils.JoinPath(workDir, fmt.Sprintf("%s_%s_%d", queryID, DefaultTraceFile, level))
+}
+
 // GetRequestDecryptedReportURI returns the URI of the decrypted report file.
 func GetRequestDecryptedReportURI(workDir, queryID string) string {
 	return utils.JoinPath(workDir, fmt.Sprintf("%s_%s", queryID, DefaultDecryptedReportFile))
 }
 
+// GetRequestDecryptedReportManifestURI returns the URI of the manifest for the decrypted report files.
+func GetRequestDecryptedReportManifestURI(workDir, queryID string) string {
+	return utils.JoinPath(workDir, fmt.Sprintf("%s_%s_MANIFEST", queryID, DefaultDecryptedReportFile))
+}
+
+// GetHierarchyQueryID returns the ID of the query for one of the hierarchies in a MultiHierarchyConfig.
+func GetHierarchyQueryID(queryID, hierarchy string) string {
+	return fmt.Sprintf("%s_%s", queryID, hierarchy)
+}
+
+// GetHierarchyConfigURI returns the URI of the HierarchicalConfig file for one of the hierarchies in a MultiHierarchyConfig.
+func GetHierarchyConfigURI(workDir, queryID, hierarchy string) string {
+	return utils.JoinPath(workDir, fmt.Sprintf("%s_HIERARCHYCONFIG", GetHierarchyQueryID(queryID, hierarchy)))
+}
+
+// SplitMultiHierarchyRequest saves the config of each hierarchy into the work directory, and returns the requests for
+// aggregating the hierarchies, with the privacy budget of the query split between them.
+//
+// The first hierarchy decrypts the reports, and the others read its decrypted reports.
+func SplitMultiHierarchyRequest(ctx context.Context, config *MultiHierarchyConfig, request *AggregateRequest, workDir string) ([]*AggregateRequest, error) {
+	var requests []*AggregateRequest
+	firstQueryID := GetHierarchyQueryID(request.QueryID, config.Hierarchies[0].Name)
+	for i, hierarchy := range config.Hierarchies {
+		configURI := GetHierarchyConfigURI(workDir, request.QueryID, hierarchy.Name)
+		if err := WriteHierarchicalConfigFile(ctx, &hierarchy.Config, configURI); err != nil {
+			return nil, err
+		}
+
+		r := *request
+		r.QueryID = GetHierarchyQueryID(request.QueryID, hierarchy.Name)
+		r.QueryLevel = 0
+		r.ExpandConfigURI = configURI
+		r.TotalEpsilon = request.TotalEpsilon * hierarchy.BudgetShare
+		r.Hierarchy = hierarchy.Name
+		if i > 0 {
+			r.DecryptedReportQueryID = firstQueryID
+		}
+		requests = append(requests, &r)
+	}
+	return requests, nil
+}
+
 // GetRequestExpandParamsURI calculates the expand parameters, saves it into a file and returns the URI.
 func GetRequestExpandParamsURI(ctx context.Context, config *HierarchicalConfig, request *AggregateRequest, workDir, sharedDir, partnerSharedDir string) (string, error) {
 	finalLevel := int32(len(config.PrefixLengths)) - 1
@@ -189,9 +392,13 @@ func GetRequestExpandParamsURI(ctx context.Context, config *HierarchicalConfig,
 		if err != nil {
 			return "", err
 		}
+		statsURI := GetExpansionStatsURI(GetRequestPartialResultURI(sharedDir, request.QueryID, request.QueryLevel-1))
+		if err := updateExpansionStatistics(ctx, statsURI, results); err != nil {
+			return "", err
+		}
 	}
 
-	expandParams, err := getCurrentLevelParams(request.QueryLevel, results, config)
+	expandParams, err := getCurrentLevelParams(request.QueryLevel, results, config, request.KeyBitSize)
 	if err != nil {
 		return "", err
 	}
@@ -204,6 +411,29 @@ func GetRequestExpandParamsURI(ctx context.Context, config *HierarchicalConfig,
 	return expandParamsURI, nil
 }
 
+// updateExpansionStatistics adds the nonzero bucket count and fraction of the merged results to the expansion statistics
+// of the previous level, if the statistics exist.
+func updateExpansionStatistics(ctx context.Context, statsURI string, results []dpfaggregator.CompleteHistogram) error {
+	exist, err := utils.IsFileGlobExist(ctx, statsURI)
+	if err != nil || !exist {
+		return err
+	}
+	statistics, err := dpfaggregator.ReadExpansionStatistics(ctx, statsURI)
+	if err != nil {
+		return err
+	}
+	statistics.NonzeroBucketCount = 0
+	for _, result := range results {
+		if result.Sum != 0 {
+			statistics.NonzeroBucketCount++
+		}
+	}
+	if len(results) > 0 {
+		statistics.NonzeroFraction = float64(statistics.NonzeroBucketCount) / float64(len(results))
+	}
+	return dpfaggregator.WriteExpansionStatistics(ctx, statistics, statsURI)
+}
+
 func validateHierarchicalConfig(config *HierarchicalConfig) error {
 	if len(config.PrefixLengths) == 0 {
 		return errors.New("expect nonempty PrefixLengths")
@@ -236,12 +466,72 @@ func validateHierarchicalConfig(config *HierarchicalConfig) error {
 		}
 		cur = l
 	}
+	if config.HierarchyGranularity < 0 {
+		return fmt.Errorf("hierarchy granularity should be non-negative, got %d", config.HierarchyGranularity)
+	}
 	return nil
 }
 
+func validateMultiHierarchyConfig(config *MultiHierarchyConfig) error {
+	if len(config.Hierarchies) == 0 {
+		return errors.New("expect nonempty Hierarchies")
+	}
+	names := make(map[string]bool)
+	var totalShare float64
+	for i, hierarchy := range config.Hierarchies {
+		if hierarchy.Name == "" {
+			return fmt.Errorf("expect nonempty name for hierarchy %d", i)
+		}
+		if names[hierarchy.Name] {
+			return fmt.Errorf("duplicate hierarchy name %q", hierarchy.Name)
+		}
+		names[hierarchy.Name] = true
+
+		if hierarchy.BudgetShare <= 0 || hierarchy.BudgetShare > 1.0 {
+			return fmt.Errorf("budget share of hierarchy %q should be in (0, 1], got %v", hierarchy.Name, hierarchy.BudgetShare)
+		}
+		totalShare += hierarchy.BudgetShare
+
+		if err := validateHierarchicalConfig(&hierarchy.Config); err != nil {
+			return fmt.Errorf("invalid config for hierarchy %q: %v", hierarchy.Name, err)
+		}
+		// The hierarchies read the same decrypted DPF keys, which only have the hierarchies of one granularity.
+		if got, want := hierarchy.Config.HierarchyGranularity, config.Hierarchies[0].Config.HierarchyGranularity; got != want {
+			return fmt.Errorf("expect the same hierarchy granularity %d for all hierarchies, got %d for %q", want, got, hierarchy.Name)
+		}
+	}
+	if !floats.EqualWithinAbsOrRel(totalShare, 1.0, 1e-6, 1e-6) {
+		return fmt.Errorf("total budget share should add up to 1, got %v", totalShare)
+	}
+	return nil
+}
+
+// getHierarchyLevel gets the DPF hierarchy level for the prefix length.
+//
+// With granularity g > 1, the DPF keys have hierarchies at prefix lengths g, 2g, ... and keyBitSize, so the prefix length must be one of them.
+// Otherwise the keys have a hierarchy at every prefix length, as with incrementaldpf.GetDefaultDPFParameters().
+func getHierarchyLevel(prefixLength, granularity, keyBitSize int32) (int32, error) {
+	if granularity <= 1 {
+		return prefixLength - 1, nil
+	}
+	params, err := incrementaldpf.GetDPFParametersWithGranularity(int(keyBitSize), int(granularity))
+	if err != nil {
+		return 0, err
+	}
+	return incrementaldpf.GetHierarchyLevel(params, prefixLength)
+}
+
 func validateDirectConfig(config *DirectConfig) error {
-	if len(config.BucketIDs) == 0 {
-		return errors.New("expect nonempty bucket IDs")
+	if len(config.BucketIDs) == 0 && len(config.BucketRanges) == 0 {
+		return errors.New("expect nonempty bucket IDs or bucket ranges")
+	}
+	for _, r := range config.BucketRanges {
+		if r.Start.Cmp(r.End) > 0 {
+			return fmt.Errorf("expect bucket range start %s <= end %s", r.Start, r.End)
+		}
+	}
+	if config.HierarchyGranularity < 0 {
+		return fmt.Errorf("hierarchy granularity should be non-negative, got %d", config.HierarchyGranularity)
 	}
 	return nil
 }
@@ -256,23 +546,184 @@ func getNextNonemptyPrefixes(result []dpfaggregator.CompleteHistogram, threshold
 	return prefixes
 }
 
-func getCurrentLevelParams(queryLevel int32, previousResults []dpfaggregator.CompleteHistogram, config *HierarchicalConfig) (*dpfaggregator.ExpandParameters, error) {
+func getCurrentLevelParams(queryLevel int32, previousResults []dpfaggregator.CompleteHistogram, config *HierarchicalConfig, keyBitSize int32) (*dpfaggregator.ExpandParameters, error) {
+	// The DPF levels correspond to the query prefix lengths.
+	level, err := getHierarchyLevel(config.PrefixLengths[queryLevel], config.HierarchyGranularity, keyBitSize)
+	if err != nil {
+		return nil, err
+	}
 	expandParams := &dpfaggregator.ExpandParameters{
-		// The DPF levels correspond to the query prefix lengths.
-		Level:           config.PrefixLengths[queryLevel] - 1,
-		DirectExpansion: false,
+		Level:                level,
+		DirectExpansion:      false,
+		HierarchyGranularity: config.HierarchyGranularity,
 	}
 	if previousResults == nil {
 		expandParams.PreviousLevel = -1
 		return expandParams, nil
 	}
 
-	expandParams.PreviousLevel = config.PrefixLengths[queryLevel-1] - 1
+	expandParams.PreviousLevel, err = getHierarchyLevel(config.PrefixLengths[queryLevel-1], config.HierarchyGranularity, keyBitSize)
+	if err != nil {
+		return nil, err
+	}
 	expandParams.Prefixes = getNextNonemptyPrefixes(previousResults, config.ExpansionThresholdPerPrefix[queryLevel-1])
 
 	return expandParams, nil
 }
 
+// hierarchyPrefixLengths returns the prefix lengths where the DPF keys have hierarchies, in ascending order.
+func hierarchyPrefixLengths(granularity, keyBitSize int32) []int32 {
+	step := granularity
+	if step <= 1 {
+		step = 1
+	}
+	var lengths []int32
+	for l := step; l < keyBitSize; l += step {
+		lengths = append(lengths, l)
+	}
+	return append(lengths, keyBitSize)
+}
+
+// mergeBucketRanges sorts the ranges and merges the overlapping and adjacent ones.
+func mergeBucketRanges(ranges []BucketRange) []BucketRange {
+	sorted := make([]BucketRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.Cmp(sorted[j].Start) < 0 })
+
+	var merged []BucketRange
+	for _, r := range sorted {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.End.Equals(uint128.Max) || r.Start.Cmp(last.End.Add64(1)) <= 0 {
+				if r.End.Cmp(last.End) > 0 {
+					last.End = r.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// CompileBucketRanges compiles the bucket ranges into the minimal set of disjoint DPF prefixes that covers exactly the
+// bucket IDs in the ranges. The prefix lengths are restricted to the hierarchies of the DPF keys with the granularity.
+func CompileBucketRanges(ranges []BucketRange, keyBitSize, granularity int32) ([]Prefix, error) {
+	if keyBitSize <= 0 || keyBitSize > 128 {
+		return nil, fmt.Errorf("expect key bit size in [1, 128], got %d", keyBitSize)
+	}
+	domainEnd := uint128.Max.Rsh(uint(128 - keyBitSize))
+	for _, r := range ranges {
+		if r.Start.Cmp(r.End) > 0 {
+			return nil, fmt.Errorf("expect bucket range start %s <= end %s", r.Start, r.End)
+		}
+		if r.End.Cmp(domainEnd) > 0 {
+			return nil, fmt.Errorf("bucket range end %s exceeds the %d-bit domain", r.End, keyBitSize)
+		}
+	}
+
+	lengths := hierarchyPrefixLengths(granularity, keyBitSize)
+	var prefixes []Prefix
+	for _, r := range mergeBucketRanges(ranges) {
+		start := r.Start
+		for {
+			// Take the largest aligned block at a hierarchy that starts at the current bucket and stays in the range. The
+			// blocks of the full key bit size are single buckets, so there is always one.
+			var end uint128.Uint128
+			for _, l := range lengths {
+				shift := uint(keyBitSize - l)
+				mask := uint128.Zero
+				if shift > 0 {
+					mask = uint128.Max.Rsh(128 - shift)
+				}
+				if !start.And(mask).IsZero() {
+					continue
+				}
+				if end = start.Or(mask); end.Cmp(r.End) > 0 {
+					continue
+				}
+				prefixes = append(prefixes, Prefix{Value: start.Rsh(shift), Length: l})
+				break
+			}
+			if end.Cmp(r.End) >= 0 {
+				break
+			}
+			start = end.Add64(1)
+		}
+	}
+	return prefixes, nil
+}
+
+// GetDirectPrefixes returns the prefixes aggregated by the direct query, keyed by the prefix lengths. Without bucket
+// ranges, the bucket IDs are aggregated as they are.
+func GetDirectPrefixes(config *DirectConfig, keyBitSize int32) (map[int32][]uint128.Uint128, error) {
+	if len(config.BucketRanges) == 0 {
+		return map[int32][]uint128.Uint128{keyBitSize: config.BucketIDs}, nil
+	}
+	ranges := append([]BucketRange(nil), config.BucketRanges...)
+	for _, id := range config.BucketIDs {
+		ranges = append(ranges, BucketRange{Start: id, End: id})
+	}
+	compiled, err := CompileBucketRanges(ranges, keyBitSize, config.HierarchyGranularity)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make(map[int32][]uint128.Uint128)
+	for _, p := range compiled {
+		prefixes[p.Length] = append(prefixes[p.Length], p.Value)
+	}
+	return prefixes, nil
+}
+
+// GetPrefixLengthQueryID returns the ID of the query for the prefixes of one length in a DirectConfig.
+func GetPrefixLengthQueryID(queryID string, prefixLength int32) string {
+	return fmt.Sprintf("%s_prefix%d", queryID, prefixLength)
+}
+
+// SplitPrefixLengthRequest returns the requests for aggregating the prefixes of each length, ordered by the lengths.
+//
+// The prefixes are disjoint, so each report contributes to at most one of them, and every request takes the total
+// privacy budget of the query.
+func SplitPrefixLengthRequest(prefixes map[int32][]uint128.Uint128, request *AggregateRequest) []*AggregateRequest {
+	lengths := make([]int32, 0, len(prefixes))
+	for l := range prefixes {
+		lengths = append(lengths, l)
+	}
+	sort.Slice(lengths, func(i, j int) bool { return lengths[i] < lengths[j] })
+
+	var requests []*AggregateRequest
+	for _, l := range lengths {
+		r := *request
+		r.QueryID = GetPrefixLengthQueryID(request.QueryID, l)
+		r.PrefixLength = l
+		requests = append(requests, &r)
+	}
+	return requests
+}
+
+// GetDirectExpandParams gets the parameters for expanding the DPF keys directly at the prefixes of the length in the
+// config.
+func GetDirectExpandParams(config *DirectConfig, keyBitSize, prefixLength int32) (*dpfaggregator.ExpandParameters, error) {
+	prefixes, err := GetDirectPrefixes(config, keyBitSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(prefixes[prefixLength]) == 0 {
+		return nil, fmt.Errorf("no prefix of length %d in the direct query", prefixLength)
+	}
+	level, err := getHierarchyLevel(prefixLength, config.HierarchyGranularity, keyBitSize)
+	if err != nil {
+		return nil, err
+	}
+	return &dpfaggregator.ExpandParameters{
+		Level:                level,
+		Prefixes:             prefixes[prefixLength],
+		DirectExpansion:      true,
+		PreviousLevel:        -1,
+		HierarchyGranularity: config.HierarchyGranularity,
+	}, nil
+}
+
 func getRequestExpandParamsURI(workDir string, request *AggregateRequest) string {
 	return utils.JoinPath(workDir, fmt.Sprintf("%s_%s_%d", request.QueryID, DefaultExpandParamsFile, request.QueryLevel))
 }
@@ -3,6 +3,7 @@ package query
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -193,3 +194,248 @@ func TestGetRequestExpandParams(t *testing.T) {
 		request.QueryLevel++
 	}
 }
+
+func TestGetCurrentLevelParamsWithGranularity(t *testing.T) {
+	config := &HierarchicalConfig{
+		PrefixLengths:               []int32{4, 8, 10},
+		PrivacyBudgetPerPrefix:      []float64{0.2, 0.3, 0.5},
+		ExpansionThresholdPerPrefix: []uint64{2, 2, 2},
+		HierarchyGranularity:        4,
+	}
+	previousResults := []dpfaggregator.CompleteHistogram{
+		{Bucket: uint128.From64(1), Sum: 1},
+		{Bucket: uint128.From64(3), Sum: 3},
+	}
+	got, err := getCurrentLevelParams(2, previousResults, config, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &dpfaggregator.ExpandParameters{
+		Level:                2,
+		PreviousLevel:        1,
+		Prefixes:             []uint128.Uint128{uint128.From64(3)},
+		HierarchyGranularity: 4,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("expand params mismatch (-want +got):\n%s", diff)
+	}
+
+	config.PrefixLengths = []int32{2, 8, 10}
+	if _, err := getCurrentLevelParams(0, nil, config, 10); err == nil {
+		t.Error("expect error for prefix length not aligned with the hierarchy granularity")
+	}
+}
+
+func TestSplitMultiHierarchyRequest(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-multi-hierarchy")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	daily := HierarchicalConfig{
+		PrefixLengths:               []int32{8, 16},
+		PrivacyBudgetPerPrefix:      []float64{0.5, 0.5},
+		ExpansionThresholdPerPrefix: []uint64{5, 0},
+	}
+	weekly := HierarchicalConfig{
+		PrefixLengths:               []int32{16},
+		PrivacyBudgetPerPrefix:      []float64{1},
+		ExpansionThresholdPerPrefix: []uint64{0},
+	}
+	config := &MultiHierarchyConfig{Hierarchies: []NamedHierarchy{
+		{Name: "daily", BudgetShare: 0.75, Config: daily},
+		{Name: "weekly", BudgetShare: 0.25, Config: weekly},
+	}}
+	ctx := context.Background()
+	configFile := path.Join(tmpDir, "config_file")
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.WriteBytes(ctx, b, configFile, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadMultiHierarchyConfigFile(ctx, configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(config, got); diff != "" {
+		t.Errorf("multi-hierarchy config mismatch (-want +got):\n%s", diff)
+	}
+	// A multi-hierarchy config is not a valid single hierarchical config.
+	if _, err := ReadHierarchicalConfigFile(ctx, configFile); err == nil {
+		t.Error("expect error reading multi-hierarchy config as HierarchicalConfig")
+	}
+
+	request := &AggregateRequest{QueryID: "query", TotalEpsilon: 4, ExpandConfigURI: configFile}
+	requests, err := SplitMultiHierarchyRequest(ctx, config, request, tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*AggregateRequest{
+		{QueryID: "query_daily", TotalEpsilon: 3, Hierarchy: "daily", ExpandConfigURI: GetHierarchyConfigURI(tmpDir, "query", "daily")},
+		{QueryID: "query_weekly", TotalEpsilon: 1, Hierarchy: "weekly", ExpandConfigURI: GetHierarchyConfigURI(tmpDir, "query", "weekly"), DecryptedReportQueryID: "query_daily"},
+	}
+	if diff := cmp.Diff(want, requests); diff != "" {
+		t.Errorf("hierarchy requests mismatch (-want +got):\n%s", diff)
+	}
+	gotWeekly, err := ReadHierarchicalConfigFile(ctx, requests[1].ExpandConfigURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&weekly, gotWeekly); diff != "" {
+		t.Errorf("hierarchy config mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidateMultiHierarchyConfig(t *testing.T) {
+	hierarchy := HierarchicalConfig{
+		PrefixLengths:               []int32{8},
+		PrivacyBudgetPerPrefix:      []float64{1},
+		ExpansionThresholdPerPrefix: []uint64{0},
+	}
+	coarse := hierarchy
+	coarse.HierarchyGranularity = 8
+	for _, tc := range []struct {
+		desc   string
+		config *MultiHierarchyConfig
+	}{
+		{"empty", &MultiHierarchyConfig{}},
+		{"duplicate names", &MultiHierarchyConfig{Hierarchies: []NamedHierarchy{
+			{Name: "a", BudgetShare: 0.5, Config: hierarchy},
+			{Name: "a", BudgetShare: 0.5, Config: hierarchy},
+		}}},
+		{"shares not adding up to 1", &MultiHierarchyConfig{Hierarchies: []NamedHierarchy{
+			{Name: "a", BudgetShare: 0.5, Config: hierarchy},
+			{Name: "b", BudgetShare: 0.6, Config: hierarchy},
+		}}},
+		{"different granularities", &MultiHierarchyConfig{Hierarchies: []NamedHierarchy{
+			{Name: "a", BudgetShare: 0.5, Config: hierarchy},
+			{Name: "b", BudgetShare: 0.5, Config: coarse},
+		}}},
+	} {
+		if err := validateMultiHierarchyConfig(tc.config); err == nil {
+			t.Errorf("%s: expect error for config %+v", tc.desc, tc.config)
+		}
+	}
+}
+
+func TestCompileBucketRanges(t *testing.T) {
+	for _, tc := range []struct {
+		desc        string
+		ranges      []BucketRange
+		keyBitSize  int32
+		granularity int32
+		want        []Prefix
+	}{
+		{
+			desc:       "aligned range",
+			ranges:     []BucketRange{{Start: uint128.From64(0x00A00000), End: uint128.From64(0x00AFFFFF)}},
+			keyBitSize: 32,
+			want:       []Prefix{{Value: uint128.From64(0x00A), Length: 12}},
+		},
+		{
+			desc:       "unaligned range",
+			ranges:     []BucketRange{{Start: uint128.From64(3), End: uint128.From64(12)}},
+			keyBitSize: 8,
+			want: []Prefix{
+				{Value: uint128.From64(3), Length: 8},
+				{Value: uint128.From64(1), Length: 6},
+				{Value: uint128.From64(2), Length: 6},
+				{Value: uint128.From64(12), Length: 8},
+			},
+		},
+		{
+			desc:        "prefix lengths at hierarchies",
+			ranges:      []BucketRange{{Start: uint128.From64(0x0E), End: uint128.From64(0x3F)}},
+			keyBitSize:  8,
+			granularity: 4,
+			want: []Prefix{
+				{Value: uint128.From64(0x0E), Length: 8},
+				{Value: uint128.From64(0x0F), Length: 8},
+				{Value: uint128.From64(1), Length: 4},
+				{Value: uint128.From64(2), Length: 4},
+				{Value: uint128.From64(3), Length: 4},
+			},
+		},
+		{
+			desc: "overlapping and adjacent ranges",
+			ranges: []BucketRange{
+				{Start: uint128.From64(4), End: uint128.From64(7)},
+				{Start: uint128.From64(0), End: uint128.From64(3)},
+				{Start: uint128.From64(2), End: uint128.From64(5)},
+			},
+			keyBitSize: 8,
+			want:       []Prefix{{Value: uint128.From64(0), Length: 5}},
+		},
+		{
+			desc:       "whole domain",
+			ranges:     []BucketRange{{Start: uint128.From64(0), End: uint128.From64(255)}},
+			keyBitSize: 8,
+			want:       []Prefix{{Value: uint128.From64(0), Length: 1}, {Value: uint128.From64(1), Length: 1}},
+		},
+		{
+			desc:       "end of 128-bit domain",
+			ranges:     []BucketRange{{Start: uint128.Max.Sub64(1), End: uint128.Max}},
+			keyBitSize: 128,
+			want:       []Prefix{{Value: uint128.Max.Rsh(1), Length: 127}},
+		},
+	} {
+		got, err := CompileBucketRanges(tc.ranges, tc.keyBitSize, tc.granularity)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: prefixes mismatch (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+
+	if _, err := CompileBucketRanges([]BucketRange{{Start: uint128.From64(5), End: uint128.From64(4)}}, 8, 1); err == nil {
+		t.Error("expect error for range with start after end")
+	}
+	if _, err := CompileBucketRanges([]BucketRange{{Start: uint128.From64(0), End: uint128.From64(256)}}, 8, 1); err == nil {
+		t.Error("expect error for range beyond the key domain")
+	}
+}
+
+func TestGetDirectPrefixes(t *testing.T) {
+	config := &DirectConfig{
+		BucketIDs:    []uint128.Uint128{uint128.From64(20)},
+		BucketRanges: []BucketRange{{Start: uint128.From64(3), End: uint128.From64(12)}},
+	}
+	got, err := GetDirectPrefixes(config, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int32][]uint128.Uint128{
+		6: {uint128.From64(1), uint128.From64(2)},
+		8: {uint128.From64(3), uint128.From64(12), uint128.From64(20)},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("prefixes mismatch (-want +got):\n%s", diff)
+	}
+
+	requests := SplitPrefixLengthRequest(got, &AggregateRequest{QueryID: "query", TotalEpsilon: 4})
+	wantRequests := []*AggregateRequest{
+		{QueryID: "query_prefix6", TotalEpsilon: 4, PrefixLength: 6},
+		{QueryID: "query_prefix8", TotalEpsilon: 4, PrefixLength: 8},
+	}
+	if diff := cmp.Diff(wantRequests, requests); diff != "" {
+		t.Errorf("prefix length requests mismatch (-want +got):\n%s", diff)
+	}
+
+	params, err := GetDirectExpandParams(config, 8, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantParams := &dpfaggregator.ExpandParameters{
+		Level:           5,
+		Prefixes:        []uint128.Uint128{uint128.From64(1), uint128.From64(2)},
+		DirectExpansion: true,
+		PreviousLevel:   -1,
+	}
+	if diff := cmp.Diff(wantParams, params); diff != "" {
+		t.Errorf("expand params mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,470 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package queryarchive bundles the complete record of a query into a portable tar archive, which can be handed to
+// auditors or support.
+//
+// The archive contains the query specification, its parameters, the expansion configuration, and for each result the
+// result manifest with the result files it lists. Raw or partial reports are never archived. The first entry is an
+// archive manifest with the SHA-256 hashes of all other entries, so the archive is verified when it is imported. The
+// archive manifest signed by a trusted helper key covers all the entries. Without it, only the results signed by a
+// trusted helper key in their result manifests are imported:
+//
+//	MANIFEST.json
+//	query/spec.json
+//	query/params.json
+//	query/expansion_config
+//	results/0/RESULT_MANIFEST.json
+//	results/0/<result files>
+//	results/1/...
+package queryarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/canonicaljson"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+// Version of the archive format.
+const Version = 1
+
+// Names of the entries in the archive.
+const (
+	ManifestEntry       = "MANIFEST.json"
+	SpecEntry           = "query/spec.json"
+	ParamsEntry         = "query/params.json"
+	ExpandConfigEntry   = "query/expansion_config"
+	resultDir           = "results"
+	resultManifestEntry = "RESULT_MANIFEST.json"
+)
+
+var (
+	// ErrCorrupted is returned when the entries of an archive do not match its manifest.
+	ErrCorrupted = errors.New("corrupted query archive")
+	// ErrUntrusted is returned when the results of an archive are not signed by a trusted key.
+	ErrUntrusted = errors.New("query archive not signed by a trusted key")
+)
+
+// Manifest lists the entries of an archive with their SHA-256 hashes.
+type Manifest struct {
+	Version int
+	QueryID string
+	Created time.Time
+	// SHA-256 hashes of the entries keyed by the entry names, except the manifest itself.
+	Entries map[string]string
+	// Names of the result manifest entries. The result files listed by each manifest are in the same directory.
+	ResultManifests []string `json:",omitempty"`
+	// Base64-encoded Ed25519 signature of the manifest without the signature, if the archive is signed on export.
+	Signature string `json:",omitempty"`
+}
+
+// signedBytes returns the bytes covered by the signature of the manifest.
+func (m *Manifest) signedBytes() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = ""
+	return canonicaljson.Marshal(&unsigned)
+}
+
+// verify checks the signature of the manifest with the keys, and returns ErrUntrusted if no key verifies it.
+func (m *Manifest) verify(keys []ed25519.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil || m.Signature == "" {
+		return ErrUntrusted
+	}
+	b, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, b, sig) {
+			return nil
+		}
+	}
+	return ErrUntrusted
+}
+
+// ExportParams contains the records of a query to be archived.
+type ExportParams struct {
+	QueryID string
+	// Specification of the query, e.g. the aggregation request or the query template, which is archived as JSON.
+	Spec interface{}
+	// Runtime parameters of the query, e.g. the parameters of the query template.
+	Params map[string]string
+	// Expansion configuration of the query. It is not archived if empty.
+	ExpandConfigURI string
+	// Manifests of the results, whose result files are archived with them.
+	ResultManifestURIs []string
+	// Result files archived with unsigned manifests created on export, for queries whose helpers do not write result
+	// manifests. Each item is a URI or glob of the result files. The archive must be signed with SigningKey to import
+	// them.
+	ResultURIs []string
+	// Key of the helper to sign the archive manifest with. The archive is not signed if nil.
+	SigningKey ed25519.PrivateKey
+}
+
+func hash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+type archiveWriter struct {
+	manifest *Manifest
+	names    []string
+	data     map[string][]byte
+}
+
+func (w *archiveWriter) add(name string, b []byte) error {
+	if _, ok := w.data[name]; ok {
+		return fmt.Errorf("duplicate archive entry %q", name)
+	}
+	w.names = append(w.names, name)
+	w.data[name] = b
+	w.manifest.Entries[name] = hash(b)
+	return nil
+}
+
+// addResult adds the result manifest and the result files it lists, after checking the files against the manifest.
+func (w *archiveWriter) addResult(ctx context.Context, index int, signed *resultmanifest.SignedManifest) error {
+	if signed.Manifest == nil {
+		return errors.New("empty result manifest")
+	}
+	dir := path.Join(resultDir, fmt.Sprint(index))
+	b, err := canonicaljson.Marshal(signed)
+	if err != nil {
+		return err
+	}
+	manifestName := path.Join(dir, resultManifestEntry)
+	if err := w.add(manifestName, b); err != nil {
+		return err
+	}
+	w.manifest.ResultManifests = append(w.manifest.ResultManifests, manifestName)
+
+	files := make([]string, 0, len(signed.Manifest.Files))
+	for name := range signed.Manifest.Files {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		if name != path.Base(name) || name == resultManifestEntry {
+			return fmt.Errorf("invalid result file name %q", name)
+		}
+		b, err := utils.ReadBytes(ctx, utils.JoinPath(utils.DirPath(signed.Manifest.ResultURI), name))
+		if err != nil {
+			return err
+		}
+		if got, want := hash(b), signed.Manifest.Files[name]; got != want {
+			return fmt.Errorf("hash mismatch for result file %q: manifest has %s, file has %s", name, want, got)
+		}
+		if err := w.add(path.Join(dir, name), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Export writes the archive of the query to the URI, and returns its manifest.
+func Export(ctx context.Context, params *ExportParams, archiveURI string) (*Manifest, error) {
+	w := &archiveWriter{
+		manifest: &Manifest{Version: Version, QueryID: params.QueryID, Created: time.Now().UTC(), Entries: make(map[string]string)},
+		data:     make(map[string][]byte),
+	}
+
+	spec, err := json.MarshalIndent(params.Spec, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := w.add(SpecEntry, spec); err != nil {
+		return nil, err
+	}
+	queryParams := params.Params
+	if queryParams == nil {
+		queryParams = make(map[string]string)
+	}
+	b, err := json.MarshalIndent(queryParams, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := w.add(ParamsEntry, b); err != nil {
+		return nil, err
+	}
+	if params.ExpandConfigURI != "" {
+		b, err := utils.ReadBytes(ctx, params.ExpandConfigURI)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.add(ExpandConfigEntry, b); err != nil {
+			return nil, err
+		}
+	}
+
+	var results []*resultmanifest.SignedManifest
+	for _, uri := range params.ResultManifestURIs {
+		signed, err := resultmanifest.Read(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, signed)
+	}
+	for _, uri := range params.ResultURIs {
+		files, err := resultmanifest.HashFiles(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, &resultmanifest.SignedManifest{
+			Manifest: &resultmanifest.Manifest{QueryID: params.QueryID, ResultURI: uri, Files: files},
+		})
+	}
+	for i, signed := range results {
+		if err := w.addResult(ctx, i, signed); err != nil {
+			return nil, err
+		}
+	}
+
+	if params.SigningKey != nil {
+		b, err := w.manifest.signedBytes()
+		if err != nil {
+			return nil, err
+		}
+		w.manifest.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(params.SigningKey, b))
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	manifestBytes, err := canonicaljson.Marshal(w.manifest)
+	if err != nil {
+		return nil, err
+	}
+	// The manifest is written first, so it can be read before the entries it describes.
+	entries := append([]string{ManifestEntry}, w.names...)
+	w.data[ManifestEntry] = manifestBytes
+	for _, name := range entries {
+		b := w.data[name]
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(b)),
+			ModTime: w.manifest.Created,
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := utils.WriteBytes(ctx, buf.Bytes(), archiveURI, nil); err != nil {
+		return nil, err
+	}
+	return w.manifest, nil
+}
+
+// validEntryName checks that the entry stays in the output directory when extracted.
+func validEntryName(name string) bool {
+	return name != "" && !path.IsAbs(name) && path.Clean(name) == name && name != ".." && !strings.HasPrefix(name, "../")
+}
+
+// Read reads the archive and verifies its entries against the manifest. It returns the manifest and the entries keyed
+// by their names.
+func Read(ctx context.Context, archiveURI string) (*Manifest, map[string][]byte, error) {
+	b, err := utils.ReadBytes(ctx, archiveURI)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(bytes.NewReader(b))
+	var manifest *Manifest
+	entries := make(map[string][]byte)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, nil, fmt.Errorf("%w: entry %q is not a regular file", ErrCorrupted, header.Name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if manifest == nil {
+			if header.Name != ManifestEntry {
+				return nil, nil, fmt.Errorf("%w: expect the first entry %s, got %q", ErrCorrupted, ManifestEntry, header.Name)
+			}
+			manifest = &Manifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+			}
+			if manifest.Version != Version {
+				return nil, nil, fmt.Errorf("unsupported archive version %d, expect %d", manifest.Version, Version)
+			}
+			continue
+		}
+
+		want, ok := manifest.Entries[header.Name]
+		if !ok || !validEntryName(header.Name) {
+			return nil, nil, fmt.Errorf("%w: unexpected entry %q", ErrCorrupted, header.Name)
+		}
+		if _, ok := entries[header.Name]; ok {
+			return nil, nil, fmt.Errorf("%w: duplicate entry %q", ErrCorrupted, header.Name)
+		}
+		if got := hash(data); got != want {
+			return nil, nil, fmt.Errorf("%w: hash mismatch for entry %q: manifest has %s, entry has %s", ErrCorrupted, header.Name, want, got)
+		}
+		entries[header.Name] = data
+	}
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("%w: empty archive", ErrCorrupted)
+	}
+	for name := range manifest.Entries {
+		if _, ok := entries[name]; !ok {
+			return nil, nil, fmt.Errorf("%w: missing entry %q", ErrCorrupted, name)
+		}
+	}
+	return manifest, entries, nil
+}
+
+// Import verifies the archive and extracts the entries into the directory. The result files are checked against their
+// result manifests before any entry is written, so a failed import leaves nothing extracted.
+//
+// All the entries are extracted if the archive manifest is signed by one of the public keys of the helpers. Otherwise,
+// only the results whose manifests are signed by one of the keys are extracted, and the query specification, its
+// parameters and the archive manifest are not, as nothing authenticates them. An unsigned archive without results is
+// rejected. The returned manifest only lists the extracted entries.
+func Import(ctx context.Context, archiveURI, outputDir string, keys []ed25519.PublicKey) (*Manifest, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("expect the public keys of the helpers to verify the archive")
+	}
+	manifest, entries, err := Read(ctx, archiveURI)
+	if err != nil {
+		return nil, err
+	}
+	archiveSigned := manifest.verify(keys) == nil
+	if !archiveSigned && len(manifest.ResultManifests) == 0 {
+		return nil, fmt.Errorf("%w: unsigned archive without signed result manifests", ErrUntrusted)
+	}
+
+	extracted := make(map[string][]byte)
+	if archiveSigned {
+		for name, b := range entries {
+			extracted[name] = b
+		}
+	}
+	for _, name := range manifest.ResultManifests {
+		b, ok := entries[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: missing result manifest %q", ErrCorrupted, name)
+		}
+		signed := &resultmanifest.SignedManifest{}
+		if err := json.Unmarshal(b, signed); err != nil {
+			return nil, fmt.Errorf("%w: invalid result manifest %q: %v", ErrCorrupted, name, err)
+		}
+		if signed.Manifest == nil {
+			return nil, fmt.Errorf("%w: empty result manifest %q", ErrCorrupted, name)
+		}
+		if !archiveSigned && !verifyResult(signed, keys) {
+			return nil, fmt.Errorf("%w: result manifest %q", ErrUntrusted, name)
+		}
+		extracted[name] = b
+		if err := addResultFiles(signed.Manifest, path.Dir(name), entries, extracted); err != nil {
+			return nil, err
+		}
+	}
+
+	imported := *manifest
+	if !archiveSigned {
+		imported.Entries = make(map[string]string)
+		for name := range extracted {
+			imported.Entries[name] = manifest.Entries[name]
+		}
+		imported.Signature = ""
+	}
+	names := make([]string, 0, len(extracted)+1)
+	for name := range extracted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if archiveSigned {
+		manifestBytes, err := canonicaljson.Marshal(manifest)
+		if err != nil {
+			return nil, err
+		}
+		extracted[ManifestEntry] = manifestBytes
+		names = append(names, ManifestEntry)
+	}
+	for _, name := range names {
+		uri := utils.JoinPath(outputDir, name)
+		if !strings.HasPrefix(uri, "gs://") {
+			if err := os.MkdirAll(path.Dir(uri), 0755); err != nil {
+				return nil, err
+			}
+		}
+		if err := utils.WriteBytes(ctx, extracted[name], uri, nil); err != nil {
+			return nil, err
+		}
+	}
+	return &imported, nil
+}
+
+// addResultFiles checks the result files in the directory of the archive against the result manifest, and adds them to
+// the extracted entries.
+func addResultFiles(m *resultmanifest.Manifest, dir string, entries, extracted map[string][]byte) error {
+	for name, want := range m.Files {
+		if name != path.Base(name) || name == resultManifestEntry {
+			return fmt.Errorf("%w: invalid result file name %q", ErrCorrupted, name)
+		}
+		entry := path.Join(dir, name)
+		b, ok := entries[entry]
+		if !ok {
+			return fmt.Errorf("%w: missing result file %q", ErrCorrupted, entry)
+		}
+		if got := hash(b); got != want {
+			return fmt.Errorf("%w: hash mismatch for result file %q: manifest has %s, file has %s", ErrCorrupted, entry, want, got)
+		}
+		extracted[entry] = b
+	}
+	return nil
+}
+
+// verifyResult returns whether the result manifest is signed by one of the keys.
+func verifyResult(signed *resultmanifest.SignedManifest, keys []ed25519.PublicKey) bool {
+	for _, key := range keys {
+		if resultmanifest.VerifySignature(signed, key) == nil {
+			return true
+		}
+	}
+	return false
+}
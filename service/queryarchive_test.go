@@ -0,0 +1,260 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queryarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/canonicaljson"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+type querySpec struct {
+	QueryID      string
+	TotalEpsilon float64
+}
+
+// writeResults writes the result files with a manifest signed with the key, or unsigned if the key is nil.
+func writeResults(ctx context.Context, t *testing.T, dir string, key ed25519.PrivateKey) string {
+	t.Helper()
+	for name, content := range map[string]string{"result-1-of-2": "1,10\n2,20\n", "result-2-of-2": "3,30\n"} {
+		if err := utils.WriteBytes(ctx, []byte(content), path.Join(dir, name), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	glob := path.Join(dir, "result*")
+	files, err := resultmanifest.HashFiles(ctx, glob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestURI := path.Join(dir, "manifest.json")
+	signed, err := resultmanifest.Sign(&resultmanifest.Manifest{QueryID: "query", ResultURI: glob, Files: files}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resultmanifest.Write(ctx, signed, manifestURI); err != nil {
+		t.Fatal(err)
+	}
+	return manifestURI
+}
+
+func TestExportImport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-query-archive")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	resultDir1, resultDir2 := path.Join(tmpDir, "helper1"), path.Join(tmpDir, "helper2")
+	for _, dir := range []string{resultDir1, resultDir2} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestURI := writeResults(ctx, t, resultDir1, privateKey)
+	writeResults(ctx, t, resultDir2, nil)
+	configURI := path.Join(tmpDir, "config.json")
+	if err := utils.WriteBytes(ctx, []byte(`{"PrefixLengths":[8,16]}`), configURI, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	archiveURI := path.Join(tmpDir, "query.tar")
+	exported, err := Export(ctx, &ExportParams{
+		QueryID:            "query",
+		Spec:               &querySpec{QueryID: "query", TotalEpsilon: 5},
+		Params:             map[string]string{"origin": "example.com"},
+		ExpandConfigURI:    configURI,
+		ResultManifestURIs: []string{manifestURI},
+		ResultURIs:         []string{path.Join(resultDir2, "result*")},
+		SigningKey:         privateKey,
+	}, archiveURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(exported.Entries), 9; got != want {
+		t.Errorf("expect %d archive entries, got %d", want, got)
+	}
+
+	outputDir := path.Join(tmpDir, "imported")
+	if _, err := Import(ctx, archiveURI, outputDir, nil); err == nil {
+		t.Error("expect error when importing without helper keys")
+	}
+	if _, err := Import(ctx, archiveURI, outputDir, []ed25519.PublicKey{otherKey}); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("expect error %v for an archive signed by another key, got %v", ErrUntrusted, err)
+	}
+	imported, err := Import(ctx, archiveURI, outputDir, []ed25519.PublicKey{otherKey, publicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(exported, imported); diff != "" {
+		t.Errorf("imported manifest mismatch (-want +got):\n%s", diff)
+	}
+	got, err := utils.ReadBytes(ctx, path.Join(outputDir, "results/1/result-2-of-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "3,30\n"; string(got) != want {
+		t.Errorf("expect imported result %q, got %q", want, got)
+	}
+
+	// Without the archive signature, each result manifest must be signed, and only the results are imported.
+	for _, tc := range []struct {
+		desc   string
+		params *ExportParams
+		want   error
+	}{
+		{"signed result manifests", &ExportParams{QueryID: "query", Spec: &querySpec{QueryID: "query"}, ResultManifestURIs: []string{manifestURI}}, nil},
+		{"results without manifests", &ExportParams{QueryID: "query", ResultURIs: []string{path.Join(resultDir2, "result*")}}, ErrUntrusted},
+		{"no results", &ExportParams{QueryID: "query", Spec: &querySpec{QueryID: "query"}}, ErrUntrusted},
+	} {
+		unsignedURI := path.Join(tmpDir, "unsigned.tar")
+		if _, err := Export(ctx, tc.params, unsignedURI); err != nil {
+			t.Fatal(err)
+		}
+		unsignedDir := path.Join(tmpDir, "unsigned", tc.desc)
+		imported, err := Import(ctx, unsignedURI, unsignedDir, []ed25519.PublicKey{publicKey})
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: expect error %v, got %v", tc.desc, tc.want, err)
+		}
+		if err != nil {
+			continue
+		}
+		if _, ok := imported.Entries[SpecEntry]; ok {
+			t.Errorf("%s: expect the unsigned query spec not imported", tc.desc)
+		}
+		if _, err := os.Stat(path.Join(unsignedDir, SpecEntry)); !os.IsNotExist(err) {
+			t.Errorf("%s: expect the unsigned query spec not extracted, got %v", tc.desc, err)
+		}
+		if _, err := os.Stat(path.Join(unsignedDir, "results/0/result-1-of-2")); err != nil {
+			t.Errorf("%s: expect the signed result extracted, got %v", tc.desc, err)
+		}
+	}
+}
+
+func TestImportMismatchedResult(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-query-archive-mismatched")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := resultmanifest.Sign(&resultmanifest.Manifest{QueryID: "query", Files: map[string]string{"result": hash([]byte("1,10\n"))}}, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultManifest, err := canonicaljson.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultManifestName, resultName := "results/0/"+resultManifestEntry, "results/0/result"
+	entries := map[string]string{SpecEntry: "{}", resultManifestName: string(resultManifest), resultName: "1,99\n"}
+	manifest := &Manifest{Version: Version, QueryID: "query", Entries: make(map[string]string), ResultManifests: []string{resultManifestName}}
+	for name, content := range entries {
+		manifest.Entries[name] = hash([]byte(content))
+	}
+	b, err := manifest.signedBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, b))
+	manifestBytes, err := canonicaljson.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	uri := path.Join(tmpDir, "archive.tar")
+	archive := writeTar(t, [][2]string{{ManifestEntry, string(manifestBytes)}, {SpecEntry, entries[SpecEntry]}, {resultManifestName, entries[resultManifestName]}, {resultName, entries[resultName]}})
+	if err := utils.WriteBytes(ctx, archive, uri, nil); err != nil {
+		t.Fatal(err)
+	}
+	outputDir := path.Join(tmpDir, "imported")
+	if _, err := Import(ctx, uri, outputDir, []ed25519.PublicKey{publicKey}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("expect ErrCorrupted for a result file not matching its manifest, got %v", err)
+	}
+	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+		t.Errorf("expect nothing extracted from the failed import, got %v", err)
+	}
+}
+
+func writeTar(t *testing.T, entries [][2]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e[0], Mode: 0644, Size: int64(len(e[1]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadCorrupted(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-query-archive-corrupted")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	specHash := hash([]byte("{}"))
+	manifest := `{"Version":1,"QueryID":"query","Entries":{"query/spec.json":"` + specHash + `"}}`
+	traversal := `{"Version":1,"QueryID":"query","Entries":{"../spec.json":"` + specHash + `"}}`
+	for name, entries := range map[string][][2]string{
+		"modified entry":     {{ManifestEntry, manifest}, {SpecEntry, "{\"a\":1}"}},
+		"missing entry":      {{ManifestEntry, manifest}},
+		"unlisted entry":     {{ManifestEntry, manifest}, {SpecEntry, "{}"}, {ParamsEntry, "{}"}},
+		"manifest not first": {{SpecEntry, "{}"}, {ManifestEntry, manifest}},
+		"path traversal":     {{ManifestEntry, traversal}, {"../spec.json", "{}"}},
+	} {
+		uri := path.Join(tmpDir, "archive.tar")
+		if err := utils.WriteBytes(ctx, writeTar(t, entries), uri, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := Read(ctx, uri); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: expect ErrCorrupted, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package querytemplate stores the definitions of recurring queries, which are invoked with runtime parameters.
+//
+// A template fixes the hierarchy shape, the privacy budget and the output location of a query. Its string fields may
+// reference parameters as ${name}, which are substituted when the template is instantiated, e.g. with the date range
+// and the reporting origin of the batch to aggregate. The parameter values can not contain path separators, so the
+// instances stay in the directories fixed by the template, which the helper checks against its Policy.
+package querytemplate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/service/authz"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+// Parameters with special meanings, which are validated when the template is instantiated.
+const (
+	StartDateParam = "start_date"
+	EndDateParam   = "end_date"
+	OriginParam    = "origin"
+
+	dateLayout = "2006-01-02"
+)
+
+var (
+	// ErrNotFound is returned when a template does not exist in the library.
+	ErrNotFound = errors.New("query template not found")
+	// ErrPolicyViolation is returned when a template is not allowed by the policy of the helper.
+	ErrPolicyViolation = errors.New("query template violates the helper policy")
+)
+
+// Template defines a recurring query.
+type Template struct {
+	Name        string
+	Description string `json:",omitempty"`
+	// Parameters accepted by the template, mapped to their default values. Parameters with empty defaults are required.
+	Params map[string]string `json:",omitempty"`
+
+	// The type of aggregation, should be "conversion" or "reach".
+	AggregationType string
+	// Input partial reports for each helper. The second one is empty for the one-party design.
+	PartialReportURI1 string
+	PartialReportURI2 string `json:",omitempty"`
+	// Expansion configuration, which defines the hierarchy shape of the query.
+	ExpandConfigURI string
+	// Total privacy budget of the query.
+	TotalEpsilon float64
+	KeyBitSize   int32
+	// The directory where the final results are saved.
+	ResultDir  string
+	NumWorkers int32 `json:",omitempty"`
+	// Filter applied to the complete histogram when the results are merged, in the format of
+	// dpfaggregator.ParsePostFilter.
+	PostFilter string `json:",omitempty"`
+	// Principal of the caller who added the template, who can change or delete it along with the admins. It is set by
+	// the Handler, and empty for the templates added without authorization.
+	Owner string `json:",omitempty"`
+}
+
+// Validate checks that the template only references declared parameters, and its post filter is valid.
+func (t *Template) Validate() error {
+	if t.Name == "" {
+		return errors.New("template name is required")
+	}
+	if t.TotalEpsilon < 0 {
+		return fmt.Errorf("expect non-negative epsilon, got %v", t.TotalEpsilon)
+	}
+	if _, err := dpfaggregator.ParsePostFilter(t.PostFilter); err != nil {
+		return fmt.Errorf("template %q has invalid post filter: %v", t.Name, err)
+	}
+	var undeclared []string
+	for _, s := range t.patterns() {
+		os.Expand(*s, func(name string) string {
+			if _, ok := t.Params[name]; !ok {
+				undeclared = append(undeclared, name)
+			}
+			return ""
+		})
+	}
+	if len(undeclared) > 0 {
+		sort.Strings(undeclared)
+		return fmt.Errorf("template %q references undeclared parameters %v", t.Name, undeclared)
+	}
+	return nil
+}
+
+// patterns returns the fields where the parameters are substituted.
+func (t *Template) patterns() []*string {
+	return []*string{&t.PartialReportURI1, &t.PartialReportURI2, &t.ExpandConfigURI, &t.ResultDir}
+}
+
+// Policy restricts the templates that can be added to a helper.
+type Policy struct {
+	// Maximum total epsilon of a template. The epsilon is not limited if zero.
+	MaxEpsilon float64
+	// Prefixes allowed for the result directories, which are not restricted if empty.
+	ResultDirPrefixes []string
+	// Prefixes allowed for the partial reports and the expansion configurations, which are not restricted if empty.
+	InputURIPrefixes []string
+}
+
+// fixedPrefix returns the part of a pattern before the first parameter, which does not change when the template is
+// instantiated.
+func fixedPrefix(pattern string) string {
+	if i := strings.Index(pattern, "$"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+func hasAllowedPrefix(pattern string, prefixes []string) bool {
+	if len(prefixes) == 0 || pattern == "" {
+		return true
+	}
+	fixed := fixedPrefix(pattern)
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(fixed, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns ErrPolicyViolation if the template exceeds the epsilon cap, or the fixed parts of its result directory
+// or input URIs are outside the allowed prefixes. A nil policy allows all templates.
+func (p *Policy) Check(t *Template) error {
+	if p == nil {
+		return nil
+	}
+	if p.MaxEpsilon > 0 && t.TotalEpsilon > p.MaxEpsilon {
+		return fmt.Errorf("%w: epsilon %v exceeds the maximum %v", ErrPolicyViolation, t.TotalEpsilon, p.MaxEpsilon)
+	}
+	if !hasAllowedPrefix(t.ResultDir, p.ResultDirPrefixes) {
+		return fmt.Errorf("%w: result directory %q not under %v", ErrPolicyViolation, t.ResultDir, p.ResultDirPrefixes)
+	}
+	for _, uri := range []string{t.PartialReportURI1, t.PartialReportURI2, t.ExpandConfigURI} {
+		if !hasAllowedPrefix(uri, p.InputURIPrefixes) {
+			return fmt.Errorf("%w: input %q not under %v", ErrPolicyViolation, uri, p.InputURIPrefixes)
+		}
+	}
+	return nil
+}
+
+func validateParams(params map[string]string) error {
+	dates := make(map[string]time.Time)
+	for _, name := range []string{StartDateParam, EndDateParam} {
+		v, ok := params[name]
+		if !ok {
+			continue
+		}
+		d, err := time.Parse(dateLayout, v)
+		if err != nil {
+			return fmt.Errorf("expect parameter %s in format YYYY-MM-DD, got %q", name, v)
+		}
+		dates[name] = d
+	}
+	start, hasStart := dates[StartDateParam]
+	end, hasEnd := dates[EndDateParam]
+	if hasStart && hasEnd && end.Before(start) {
+		return fmt.Errorf("%s %s is before %s %s", EndDateParam, params[EndDateParam], StartDateParam, params[StartDateParam])
+	}
+	for name, v := range params {
+		// The values can not move the instances out of the directories of the template.
+		if strings.ContainsAny(v, "/\\$") || strings.Contains(v, "..") {
+			return fmt.Errorf("invalid value %q of parameter %s", v, name)
+		}
+	}
+	return nil
+}
+
+// Instantiate returns a copy of the template with the parameters substituted. Parameters not given in params take
+// the default values of the template.
+func (t *Template) Instantiate(params map[string]string) (*Template, error) {
+	values := make(map[string]string)
+	for name, v := range t.Params {
+		values[name] = v
+	}
+	for name, v := range params {
+		if _, ok := t.Params[name]; !ok {
+			return nil, fmt.Errorf("unknown parameter %q for template %q", name, t.Name)
+		}
+		values[name] = v
+	}
+	var missing []string
+	for name, v := range values {
+		if v == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("missing parameters %v for template %q", missing, t.Name)
+	}
+	if err := validateParams(values); err != nil {
+		return nil, err
+	}
+
+	instance := *t
+	instance.Params = values
+	for _, s := range instance.patterns() {
+		*s = os.Expand(*s, func(name string) string { return values[name] })
+	}
+	return &instance, nil
+}
+
+// ParseParams parses the parameters in the format "name1=value1,name2=value2".
+func ParseParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	if s == "" {
+		return params, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("expect parameter in format name=value, got %q", kv)
+		}
+		params[kv[:i]] = kv[i+1:]
+	}
+	return params, nil
+}
+
+// Library holds the query templates keyed by their names.
+type Library struct {
+	// File where the templates are saved when they change. The templates are only kept in memory if empty.
+	URI string
+
+	mu        sync.RWMutex
+	templates map[string]*Template
+}
+
+// NewLibrary creates an empty library.
+func NewLibrary() *Library {
+	return &Library{templates: make(map[string]*Template)}
+}
+
+// ReadLibrary reads the templates from a JSON file with a list of templates, and saves later changes back to the same
+// file. An empty library is created if the file does not exist.
+func ReadLibrary(ctx context.Context, uri string) (*Library, error) {
+	l := NewLibrary()
+	l.URI = uri
+	exist, err := utils.IsFileGlobExist(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return l, nil
+	}
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	var templates []*Template
+	if err := json.Unmarshal(b, &templates); err != nil {
+		return nil, fmt.Errorf("failed to parse query templates in %q: %v", uri, err)
+	}
+	for _, t := range templates {
+		if err := t.Validate(); err != nil {
+			return nil, err
+		}
+		l.templates[t.Name] = t
+	}
+	return l, nil
+}
+
+func (l *Library) save(ctx context.Context) error {
+	if l.URI == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(l.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteBytes(ctx, b, l.URI, nil)
+}
+
+// Put adds a template, or replaces the template with the same name.
+func (l *Library) Put(ctx context.Context, t *Template) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.templates[t.Name] = t
+	return l.save(ctx)
+}
+
+// Delete removes a template.
+func (l *Library) Delete(ctx context.Context, name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.templates[name]; !ok {
+		return fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	delete(l.templates, name)
+	return l.save(ctx)
+}
+
+// Get returns the template with the name.
+func (l *Library) Get(name string) (*Template, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	t, ok := l.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	return t, nil
+}
+
+func (l *Library) list() []*Template {
+	templates := make([]*Template, 0, len(l.templates))
+	for _, t := range l.templates {
+		templates = append(templates, t)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates
+}
+
+// List returns all the templates ordered by names.
+func (l *Library) List() []*Template {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.list()
+}
+
+// Handler manages the templates in a library.
+//
+// GET returns all the templates, or only the one named by the form value "name"; POST with a JSON template in the
+// body adds or replaces the template; DELETE removes the template named by the form value "name". A template can only
+// be replaced or deleted by its owner or an admin, when the caller is authorized with authz.Authorizer. The added
+// templates must be allowed by the Policy.
+type Handler struct {
+	Library *Library
+	Policy  *Policy
+}
+
+// mayChange returns whether the caller can replace or delete the template. Requests without an authorized caller are
+// not checked, as the authorizer rejects them without a policy.
+func mayChange(caller *authz.Caller, t *Template) bool {
+	if caller == nil || caller.Role >= authz.RoleAdmin {
+		return true
+	}
+	return t.Owner != "" && t.Owner == caller.Identity.Principal()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		name := req.FormValue("name")
+		if name == "" {
+			writeJSON(w, h.Library.List())
+			return
+		}
+		t, err := h.Library.Get(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, t)
+	case http.MethodPost:
+		t := &Template{}
+		if err := json.NewDecoder(req.Body).Decode(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := t.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.Policy.Check(t); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		caller := authz.CallerFromContext(req.Context())
+		t.Owner = ""
+		if caller != nil {
+			t.Owner = caller.Identity.Principal()
+		}
+		if existing, err := h.Library.Get(t.Name); err == nil {
+			if !mayChange(caller, existing) {
+				http.Error(w, fmt.Sprintf("query template %q is owned by %q", t.Name, existing.Owner), http.StatusForbidden)
+				return
+			}
+			t.Owner = existing.Owner
+		}
+		if err := h.Library.Put(req.Context(), t); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+		log.Infof("query template %q saved", t.Name)
+		writeJSON(w, t)
+	case http.MethodDelete:
+		name := req.FormValue("name")
+		if existing, err := h.Library.Get(name); err == nil && !mayChange(authz.CallerFromContext(req.Context()), existing) {
+			http.Error(w, fmt.Sprintf("query template %q is owned by %q", name, existing.Owner), http.StatusForbidden)
+			return
+		}
+		if err := h.Library.Delete(req.Context(), name); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+		log.Infof("query template %q deleted", name)
+	default:
+		http.Error(w, "only GET, POST and DELETE are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ReadTemplate reads a template from the handler of a helper at the URL.
+func ReadTemplate(client *http.Client, handlerURL, token, name string) (*Template, error) {
+	req, err := http.NewRequest("GET", handlerURL+"?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error reading query template %q from %s: %s %s", name, handlerURL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	t := &Template{}
+	if err := json.Unmarshal(body, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,286 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package querytemplate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/privacy-sandbox-aggregation-service/service/authz"
+)
+
+func weeklyTemplate() *Template {
+	return &Template{
+		Name:              "weekly",
+		Params:            map[string]string{StartDateParam: "", EndDateParam: "", OriginParam: "", "hierarchy": "default"},
+		AggregationType:   "conversion",
+		PartialReportURI1: "gs://helper1/${origin}/${start_date}_${end_date}/reports*",
+		PartialReportURI2: "gs://helper2/${origin}/${start_date}_${end_date}/reports*",
+		ExpandConfigURI:   "gs://configs/${hierarchy}.json",
+		TotalEpsilon:      5,
+		KeyBitSize:        32,
+		ResultDir:         "gs://results/${origin}/$start_date",
+	}
+}
+
+func TestInstantiate(t *testing.T) {
+	tmpl := weeklyTemplate()
+	got, err := tmpl.Instantiate(map[string]string{StartDateParam: "2021-10-04", EndDateParam: "2021-10-10", OriginParam: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Template{
+		Name:              "weekly",
+		Params:            map[string]string{StartDateParam: "2021-10-04", EndDateParam: "2021-10-10", OriginParam: "example.com", "hierarchy": "default"},
+		AggregationType:   "conversion",
+		PartialReportURI1: "gs://helper1/example.com/2021-10-04_2021-10-10/reports*",
+		PartialReportURI2: "gs://helper2/example.com/2021-10-04_2021-10-10/reports*",
+		ExpandConfigURI:   "gs://configs/default.json",
+		TotalEpsilon:      5,
+		KeyBitSize:        32,
+		ResultDir:         "gs://results/example.com/2021-10-04",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("instantiated template mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(weeklyTemplate(), tmpl); diff != "" {
+		t.Errorf("template should not be modified (-want +got):\n%s", diff)
+	}
+}
+
+func TestInstantiateError(t *testing.T) {
+	for _, params := range []map[string]string{
+		{StartDateParam: "2021-10-04", EndDateParam: "2021-10-10"},
+		{StartDateParam: "2021-10-04", EndDateParam: "2021-10-10", OriginParam: "example.com", "unknown": "x"},
+		{StartDateParam: "2021-10-11", EndDateParam: "2021-10-10", OriginParam: "example.com"},
+		{StartDateParam: "10/04/2021", EndDateParam: "2021-10-10", OriginParam: "example.com"},
+		{StartDateParam: "2021-10-04", EndDateParam: "2021-10-10", OriginParam: "../example.com"},
+		{StartDateParam: "2021-10-04", EndDateParam: "2021-10-10", OriginParam: "example.com", "hierarchy": "../../other/config"},
+		{StartDateParam: "2021-10-04", EndDateParam: "2021-10-10", OriginParam: "example.com", "hierarchy": ".."},
+	} {
+		if _, err := weeklyTemplate().Instantiate(params); err == nil {
+			t.Errorf("expect error when instantiating with %v", params)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tmpl := weeklyTemplate()
+	tmpl.ResultDir = "gs://results/${date}"
+	if err := tmpl.Validate(); err == nil {
+		t.Error("expect error for undeclared parameter")
+	}
+
+	tmpl = weeklyTemplate()
+	tmpl.PostFilter = "top_k=0"
+	if err := tmpl.Validate(); err == nil {
+		t.Error("expect error for invalid post filter")
+	}
+	tmpl.PostFilter = "min_value=10,top_k=5"
+	if err := tmpl.Validate(); err != nil {
+		t.Errorf("expect valid post filter, got %v", err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy := &Policy{MaxEpsilon: 10, ResultDirPrefixes: []string{"gs://results/"}, InputURIPrefixes: []string{"gs://helper", "gs://configs/"}}
+	if err := policy.Check(weeklyTemplate()); err != nil {
+		t.Errorf("expect the template allowed, got %v", err)
+	}
+	var nilPolicy *Policy
+	if err := nilPolicy.Check(weeklyTemplate()); err != nil {
+		t.Errorf("expect all templates allowed without policy, got %v", err)
+	}
+
+	for desc, change := range map[string]func(*Template){
+		"epsilon above the cap":            func(t *Template) { t.TotalEpsilon = 11 },
+		"result directory outside":         func(t *Template) { t.ResultDir = "gs://other/${origin}" },
+		"result directory from parameters": func(t *Template) { t.ResultDir = "${origin}/results" },
+		"input outside":                    func(t *Template) { t.PartialReportURI2 = "gs://other/reports*" },
+		"expansion config outside":         func(t *Template) { t.ExpandConfigURI = "gs://other/${hierarchy}.json" },
+	} {
+		tmpl := weeklyTemplate()
+		change(tmpl)
+		if err := policy.Check(tmpl); !errors.Is(err, ErrPolicyViolation) {
+			t.Errorf("%s: expect error %v, got %v", desc, ErrPolicyViolation, err)
+		}
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	got, err := ParseParams("origin=example.com,start_date=2021-10-04,empty=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{OriginParam: "example.com", StartDateParam: "2021-10-04", "empty": ""}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("params mismatch (-want +got):\n%s", diff)
+	}
+	if _, err := ParseParams("origin"); err == nil {
+		t.Error("expect error for parameter without value")
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-query-template")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	uri := path.Join(tmpDir, "templates.json")
+	library, err := ReadLibrary(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := library.Put(ctx, weeklyTemplate()); err != nil {
+		t.Fatal(err)
+	}
+	if err := library.Put(ctx, &Template{Name: "daily", ResultDir: "gs://results/daily"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := library.Delete(ctx, "daily"); err != nil {
+		t.Fatal(err)
+	}
+	if err := library.Delete(ctx, "daily"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expect ErrNotFound when deleting a template twice, got %v", err)
+	}
+
+	reread, err := ReadLibrary(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]*Template{weeklyTemplate()}, reread.List()); diff != "" {
+		t.Errorf("saved templates mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	server := httptest.NewServer(&Handler{Library: NewLibrary(), Policy: &Policy{MaxEpsilon: 10}})
+	defer server.Close()
+	client := server.Client()
+
+	b, err := json.Marshal(weeklyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Post(server.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect status OK when adding a template, got %s", resp.Status)
+	}
+
+	resp, err = client.Post(server.URL, "application/json", bytes.NewReader([]byte(`{"Name":"bad","ResultDir":"${date}"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expect status BadRequest for an invalid template, got %s", resp.Status)
+	}
+
+	resp, err = client.Post(server.URL, "application/json", bytes.NewReader([]byte(`{"Name":"greedy","TotalEpsilon":100}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expect status Forbidden for a template violating the policy, got %s", resp.Status)
+	}
+
+	got, err := ReadTemplate(client, server.URL, "", "weekly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(weeklyTemplate(), got); diff != "" {
+		t.Errorf("read template mismatch (-want +got):\n%s", diff)
+	}
+	if _, err := ReadTemplate(client, server.URL, "", "monthly"); err == nil {
+		t.Error("expect error when reading a nonexistent template")
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"?name=weekly", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expect status OK when deleting a template, got %s", resp.Status)
+	}
+}
+
+func TestHandlerOwnership(t *testing.T) {
+	policy, err := authz.ParsePolicy([]byte(`{"Bindings": [
+    {"Role": "submitter", "Members": ["email:alice@example.com", "email:bob@example.com"]},
+    {"Role": "admin", "Members": ["email:admin@example.com"]}
+  ]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer := &authz.Authorizer{
+		Policy: policy,
+		VerifyToken: func(_ context.Context, token string) (map[string]interface{}, error) {
+			return map[string]interface{}{"email": token}, nil
+		},
+	}
+	library := NewLibrary()
+	handler := authorizer.Require(authz.MethodRoles{"": authz.RoleSubmitter}, &Handler{Library: library})
+
+	b, err := json.Marshal(weeklyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc, method, caller string
+		want                 int
+	}{
+		{"add by the owner", http.MethodPost, "alice@example.com", http.StatusOK},
+		{"replace by another submitter", http.MethodPost, "bob@example.com", http.StatusForbidden},
+		{"delete by another submitter", http.MethodDelete, "bob@example.com", http.StatusForbidden},
+		{"replace by an admin", http.MethodPost, "admin@example.com", http.StatusOK},
+		{"replace by the owner", http.MethodPost, "alice@example.com", http.StatusOK},
+		{"delete by the owner", http.MethodDelete, "alice@example.com", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, "/query_templates?name=weekly", bytes.NewReader(b))
+		req.Header.Set("Authorization", "Bearer "+tc.caller)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: expect status %d, got %d: %s", tc.desc, tc.want, w.Code, w.Body)
+		}
+		if tc.desc == "replace by an admin" {
+			if got, err := library.Get("weekly"); err != nil || got.Owner != "email:alice@example.com" {
+				t.Errorf("expect the owner kept when an admin replaces the template, got %+v, %v", got, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package resultcache caches the final query results of a helper, so a bit-identical re-submission of a completed query
+// can return the stored result without running the pipelines again.
+//
+// The cache key consists of the hash of the input report batch and the hash of the query specification. The query ID,
+// result directory and other settings that do not change the result are not part of the key. The batch hashes are
+// kept by a BatchHasher, so the reports of a batch are only read once for all the queries on it.
+package resultcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/io/filesystem"
+	"github.com/google/privacy-sandbox-aggregation-service/service/query"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+
+	// The following packages are required to read files from GCS or local.
+	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/gcs"
+	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/local"
+)
+
+// Key identifies a query result by its input batch and query specification.
+type Key struct {
+	BatchHash string
+	SpecHash  string
+}
+
+// Entry records where the result of a completed query is stored.
+type Entry struct {
+	Key       Key
+	QueryID   string
+	ResultURI string
+	CreatedAt time.Time
+}
+
+// querySpec contains the fields of an aggregation request that determine the result.
+type querySpec struct {
+	AggregationType string
+	ExpandConfig    []byte
+	TotalEpsilon    float64
+	KeyBitSize      int32
+}
+
+// HashBatch calculates the SHA-256 hash of the files matching the globs, in the order of the globs and then of the file
+// names.
+func HashBatch(ctx context.Context, globs ...string) (string, error) {
+	h := sha256.New()
+	for _, glob := range globs {
+		files, err := listBatchFiles(ctx, glob)
+		if err != nil {
+			return "", err
+		}
+		if err := hashFiles(ctx, glob, files, h); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// batchFile is a file of a report batch, with the version that tells whether the file changed since it was hashed.
+type batchFile struct {
+	Name    string
+	Version string
+}
+
+// listBatchFiles lists the files matching the glob with their versions, sorted by name.
+func listBatchFiles(ctx context.Context, glob string) ([]batchFile, error) {
+	fs, err := filesystem.New(ctx, glob)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	names, err := fs.List(ctx, glob)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no file matches %q", glob)
+	}
+	sort.Strings(names)
+	files := make([]batchFile, len(names))
+	for i, name := range names {
+		version, err := utils.FileVersion(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = batchFile{Name: name, Version: version}
+	}
+	return files, nil
+}
+
+func hashFiles(ctx context.Context, glob string, files []batchFile, w io.Writer) error {
+	fs, err := filesystem.New(ctx, glob)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	for _, f := range files {
+		if err := hashFile(ctx, fs, f.Name, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxBatchHashes bounds the hashes kept by a BatchHasher, which forgets all of them when the bound is reached.
+const maxBatchHashes = 10000
+
+// BatchHasher calculates the batch hashes like HashBatch, and keeps them in memory for the later requests on the same
+// batch. A batch is hashed again when its files are added, removed or rewritten, which is told by the GCS generation or
+// the modification time and size of each file (see utils.FileVersion). The zero value is ready to use, and a nil BatchHasher hashes every batch with HashBatch.
+type BatchHasher struct {
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+// Hash returns the hash of the files matching the globs, which is read from memory if the same files were hashed before.
+func (b *BatchHasher) Hash(ctx context.Context, globs ...string) (string, error) {
+	if b == nil {
+		return HashBatch(ctx, globs...)
+	}
+	listing := make([][]batchFile, len(globs))
+	for i, glob := range globs {
+		var err error
+		if listing[i], err = listBatchFiles(ctx, glob); err != nil {
+			return "", err
+		}
+	}
+	bListing, err := json.Marshal(listing)
+	if err != nil {
+		return "", err
+	}
+	listingHash := sha256.Sum256(bListing)
+	id := hex.EncodeToString(listingHash[:])
+
+	b.mu.Lock()
+	hash, ok := b.hashes[id]
+	b.mu.Unlock()
+	if ok {
+		return hash, nil
+	}
+
+	h := sha256.New()
+	for i, glob := range globs {
+		if err := hashFiles(ctx, glob, listing[i], h); err != nil {
+			return "", err
+		}
+	}
+	hash = hex.EncodeToString(h.Sum(nil))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.hashes == nil || len(b.hashes) >= maxBatchHashes {
+		b.hashes = make(map[string]string)
+	}
+	b.hashes[id] = hash
+	return hash, nil
+}
+
+func hashFile(ctx context.Context, fs filesystem.Interface, filename string, w io.Writer) error {
+	r, err := fs.OpenRead(ctx, filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// HashQuerySpec calculates the SHA-256 hash of the query specification in the request, including the content of the expansion configuration.
+func HashQuerySpec(ctx context.Context, request *query.AggregateRequest) (string, error) {
+	config, err := utils.ReadBytes(ctx, request.ExpandConfigURI)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(&querySpec{
+		AggregationType: request.AggregationType,
+		ExpandConfig:    config,
+		TotalEpsilon:    request.TotalEpsilon,
+		KeyBitSize:      request.KeyBitSize,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// GetKey calculates the cache key for the request, with the batch hash from the hasher.
+func GetKey(ctx context.Context, batches *BatchHasher, request *query.AggregateRequest) (Key, error) {
+	batchHash, err := batches.Hash(ctx, request.ReportURIs()...)
+	if err != nil {
+		return Key{}, err
+	}
+	specHash, err := HashQuerySpec(ctx, request)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{BatchHash: batchHash, SpecHash: specHash}, nil
+}
+
+// Cache stores the entries as JSON files in a directory, which can be local or in GCS.
+type Cache struct {
+	Dir string
+}
+
+func (c *Cache) entryURI(key Key) string {
+	return utils.JoinPath(c.Dir, fmt.Sprintf("%s_%s.json", key.BatchHash, key.SpecHash))
+}
+
+// Lookup finds the entry for the key. The result is nil if the key is not cached.
+func (c *Cache) Lookup(ctx context.Context, key Key) (*Entry, error) {
+	uri := c.entryURI(key)
+	exist, err := utils.IsFileGlobExist(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, nil
+	}
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{}
+	if err := json.Unmarshal(b, entry); err != nil {
+		return nil, err
+	}
+	if entry.Key != key {
+		return nil, fmt.Errorf("cache entry %s has mismatched key %+v", uri, entry.Key)
+	}
+	return entry, nil
+}
+
+// Store copies the result into the cache directory and saves the entry for the key, overwriting any existing entry.
+func (c *Cache) Store(ctx context.Context, key Key, queryID, resultURI string) (*Entry, error) {
+	if strings.TrimSpace(resultURI) == "" {
+		return nil, errors.New("expect nonempty result URI for the cache entry")
+	}
+	entry := &Entry{
+		Key:       key,
+		QueryID:   queryID,
+		ResultURI: utils.JoinPath(c.Dir, fmt.Sprintf("%s_%s_result", key.BatchHash, key.SpecHash)),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := copyFile(ctx, resultURI, entry.ResultURI); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.WriteBytes(ctx, b, c.entryURI(key), nil); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// CopyResult copies the cached result to the destination.
+func CopyResult(ctx context.Context, entry *Entry, destURI string) error {
+	return copyFile(ctx, entry.ResultURI, destURI)
+}
+
+func copyFile(ctx context.Context, srcURI, destURI string) error {
+	b, err := utils.ReadBytes(ctx, srcURI)
+	if err != nil {
+		return err
+	}
+	return utils.WriteBytes(ctx, b, destURI, nil)
+}
@@ -0,0 +1,172 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resultcache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/google/privacy-sandbox-aggregation-service/service/query"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+func TestResultCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-result-cache")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	for _, f := range []struct{ name, content string }{
+		{"report-1", "report line 1"},
+		{"report-2", "report line 2"},
+		{"config.json", `{"BucketIDs":[1,2]}`},
+		{"result", "1,abc"},
+	} {
+		if err := utils.WriteBytes(ctx, []byte(f.content), path.Join(tmpDir, f.name), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request := &query.AggregateRequest{
+		AggregationType:  query.ConversionType,
+		PartialReportURI: path.Join(tmpDir, "report-*"),
+		ExpandConfigURI:  path.Join(tmpDir, "config.json"),
+		QueryID:          "query1",
+		TotalEpsilon:     1,
+		KeyBitSize:       32,
+	}
+	batches := &BatchHasher{}
+	key, err := GetKey(ctx, batches, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-submission with a different query ID and result directory has the same key.
+	resubmitted := *request
+	resubmitted.QueryID = "query2"
+	resubmitted.ResultDir = "/other/dir"
+	if got, err := GetKey(ctx, batches, &resubmitted); err != nil {
+		t.Fatal(err)
+	} else if got != key {
+		t.Errorf("expect the same key for a re-submitted query, got %+v and %+v", key, got)
+	}
+
+	// Changing the privacy budget changes the key.
+	changed := *request
+	changed.TotalEpsilon = 2
+	if got, err := GetKey(ctx, batches, &changed); err != nil {
+		t.Fatal(err)
+	} else if got.SpecHash == key.SpecHash || got.BatchHash != key.BatchHash {
+		t.Errorf("expect only the spec hash to change, got %+v and %+v", key, got)
+	}
+
+	cache := &Cache{Dir: path.Join(tmpDir, "cache")}
+	if err := os.MkdirAll(cache.Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := cache.Lookup(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != nil {
+		t.Fatalf("expect cache miss, got %+v", entry)
+	}
+
+	if _, err := cache.Store(ctx, key, request.QueryID, path.Join(tmpDir, "result")); err != nil {
+		t.Fatal(err)
+	}
+	entry, err = cache.Lookup(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.QueryID != request.QueryID {
+		t.Fatalf("expect cache hit for query %q, got %+v", request.QueryID, entry)
+	}
+
+	destURI := path.Join(tmpDir, "copied_result")
+	if err := CopyResult(ctx, entry, destURI); err != nil {
+		t.Fatal(err)
+	}
+	got, err := utils.ReadBytes(ctx, destURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1,abc"; string(got) != want {
+		t.Errorf("expect copied result %q, got %q", want, got)
+	}
+}
+
+func TestBatchHasher(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-batch-hasher")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	writeReport := func(name, content string) {
+		if err := utils.WriteBytes(ctx, []byte(content), path.Join(tmpDir, name), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeReport("report-1", "report line 1")
+	writeReport("late-1", "late line 1")
+	globs := []string{path.Join(tmpDir, "report-*"), path.Join(tmpDir, "late-*")}
+
+	want, err := HashBatch(ctx, globs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := &BatchHasher{}
+	if got, err := batches.Hash(ctx, globs...); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("expect hash %s, got %s", want, got)
+	}
+
+	// Rewriting a report with the same size changes the hash.
+	writeReport("report-1", "report line 2")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path.Join(tmpDir, "report-1"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	want, err = HashBatch(ctx, globs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := batches.Hash(ctx, globs...); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("expect hash %s after rewriting a report, got %s", want, got)
+	}
+
+	// Adding reports to the batch changes the hash.
+	writeReport("late-2", "late line 2")
+	want, err = HashBatch(ctx, globs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := batches.Hash(ctx, globs...); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("expect hash %s after adding reports, got %s", want, got)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package resultmanifest describes the final result files of a query, so third-party auditors can check that the
+// results they received are the ones released by the helper.
+//
+// The manifest is serialized in the canonical JSON form, and signed with an Ed25519 key of the helper. The signature is
+// over the canonical bytes of the Manifest object, so an auditor can verify it after decoding and canonicalizing the
+// object again in any language.
+package resultmanifest
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/io/filesystem"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/canonicaljson"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/signingkey"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+
+	// The following packages are required to read files from GCS or local.
+	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/gcs"
+	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/local"
+)
+
+// ErrInvalidSignature is returned when the signature does not match the manifest.
+var ErrInvalidSignature = errors.New("invalid manifest signature")
+
+// Manifest records the result files of a query and their SHA-256 hashes.
+type Manifest struct {
+	QueryID string
+	Origin  string
+	// URI or glob of the result files.
+	ResultURI    string
+	TotalEpsilon float64
+	KeyBitSize   int32
+	// SHA-256 hashes of the result files keyed by the file names.
+	Files map[string]string
+	// Filter applied to the complete histogram after the merge, in the format of dpfaggregator.ParsePostFilter. The
+	// helpers record the filter of the query, which the merger applies and records again.
+	PostFilter string `json:",omitempty"`
+	// Total epsilon requested for the query, when the helper ran it at the remaining privacy budget of the batch.
+	RequestedEpsilon float64 `json:",omitempty"`
+}
+
+// SignedManifest is the manifest with the base64-encoded Ed25519 signature over its canonical serialization.
+type SignedManifest struct {
+	Manifest  *Manifest
+	Signature string `json:",omitempty"`
+}
+
+func hashFile(ctx context.Context, uri string) (string, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// HashFiles hashes the files matching the glob, keyed by the file names.
+func HashFiles(ctx context.Context, glob string) (map[string]string, error) {
+	fs, err := filesystem.New(ctx, glob)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	files, err := fs.List(ctx, glob)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no file matches %q", glob)
+	}
+	sort.Strings(files)
+	hashes := make(map[string]string)
+	for _, f := range files {
+		if hashes[path.Base(f)], err = hashFile(ctx, f); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// Marshal returns the canonical serialization of the manifest, which is the message that is signed.
+func Marshal(m *Manifest) ([]byte, error) {
+	return canonicaljson.Marshal(m)
+}
+
+// Sign signs the manifest with the private key. The manifest is left unsigned if the key is nil.
+func Sign(m *Manifest, key ed25519.PrivateKey) (*SignedManifest, error) {
+	signed := &SignedManifest{Manifest: m}
+	if key == nil {
+		return signed, nil
+	}
+	b, err := Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	signed.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, b))
+	return signed, nil
+}
+
+// VerifySignature checks the signature of the manifest with the public key of the helper.
+func VerifySignature(signed *SignedManifest, key ed25519.PublicKey) error {
+	if signed.Manifest == nil {
+		return errors.New("empty manifest")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	b, err := Marshal(signed.Manifest)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, b, sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// VerifyFiles checks the hashes of the result files in the directory against the manifest. The directory of
+// ResultURI is used if dir is empty.
+func VerifyFiles(ctx context.Context, m *Manifest, dir string) error {
+	if dir == "" {
+		dir = utils.DirPath(m.ResultURI)
+	}
+	names := make([]string, 0, len(m.Files))
+	for name := range m.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		got, err := hashFile(ctx, utils.JoinPath(dir, name))
+		if err != nil {
+			return err
+		}
+		if got != m.Files[name] {
+			return fmt.Errorf("hash mismatch for result file %q: manifest has %s, file has %s", name, m.Files[name], got)
+		}
+	}
+	return nil
+}
+
+// Write serializes the signed manifest in the canonical form and saves it.
+func Write(ctx context.Context, signed *SignedManifest, uri string) error {
+	b, err := canonicaljson.Marshal(signed)
+	if err != nil {
+		return err
+	}
+	return utils.WriteBytes(ctx, b, uri, nil)
+}
+
+// Read reads a signed manifest.
+func Read(ctx context.Context, uri string) (*SignedManifest, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	signed := &SignedManifest{}
+	if err := json.Unmarshal(b, signed); err != nil {
+		return nil, err
+	}
+	return signed, nil
+}
+
+// ParsePrivateKey parses a base64-encoded Ed25519 seed for signing the manifests.
+func ParsePrivateKey(encoded string) (ed25519.PrivateKey, error) {
+	return signingkey.ParsePrivateKey(encoded)
+}
+
+// ParsePublicKey parses a base64-encoded Ed25519 public key for verifying the manifests.
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	return signingkey.ParsePublicKey(encoded)
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resultmanifest
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	privateKey, err := ParsePrivateKey(base64.StdEncoding.EncodeToString(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ParsePublicKey(base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := &Manifest{
+		QueryID:      "query1",
+		Origin:       "aggregator.example.com",
+		ResultURI:    "gs://bucket/query1_aggregator_example_com",
+		TotalEpsilon: 0.1,
+		KeyBitSize:   32,
+		Files:        map[string]string{"b": "2", "a": "1"},
+	}
+	signed, err := Sign(manifest, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySignature(signed, publicKey); err != nil {
+		t.Fatalf("expect valid signature, got %v", err)
+	}
+
+	manifest.TotalEpsilon = 0.2
+	if err := VerifySignature(signed, publicKey); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expect ErrInvalidSignature for a modified manifest, got %v", err)
+	}
+}
+
+func TestWriteReadAndVerifyFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-result-manifest")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	resultURI := path.Join(tmpDir, "query1_origin")
+	for i, content := range []string{"1,10\n", "2,20\n"} {
+		if err := utils.WriteBytes(ctx, []byte(content), resultURI+"-"+string(rune('1'+i))+"-2", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := HashFiles(ctx, resultURI+"*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	signed, err := Sign(&Manifest{QueryID: "query1", Origin: "origin", ResultURI: resultURI, TotalEpsilon: 1e-7, Files: files}, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestURI := path.Join(tmpDir, "manifest.json")
+	if err := Write(ctx, signed, manifestURI); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(ctx, manifestURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(signed, got); diff != "" {
+		t.Errorf("signed manifest mismatch (-want +got):\n%s", diff)
+	}
+	if err := VerifySignature(got, privateKey.Public().(ed25519.PublicKey)); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyFiles(ctx, got.Manifest, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := utils.WriteBytes(ctx, []byte("1,11\n"), resultURI+"-1-2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyFiles(ctx, got.Manifest, ""); err == nil {
+		t.Fatal("expect error for a modified result file")
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package resultverifier lets a third party, e.g. the adtech that requested a query, validate the merged result of a
+// query independently of the helpers.
+//
+// The verification takes the signed result manifests of the two helpers, the merged result, and the public
+// configuration of the query, and runs the following checks:
+//   - signatures: each manifest is signed by the key of its helper;
+//   - files: the final partial results match the hashes in the manifests;
+//   - parameters: the manifests agree with each other and with the public configuration;
+//   - record counts: the partial results have the same buckets, and the merged result has one record per bucket, or
+//     fewer if a post filter is configured;
+//   - share combination: for a random sample of the buckets, the shares of the two helpers add up to the merged sum,
+//     and the buckets missing from the merged result are the ones dropped by the post filter.
+package resultverifier
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"lukechampine.com/uint128"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/results"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+// Names of the checks in the report.
+const (
+	CheckSignatures       = "signatures"
+	CheckFiles            = "files"
+	CheckParameters       = "parameters"
+	CheckRecordCounts     = "record_counts"
+	CheckShareCombination = "share_combination"
+)
+
+// PublicConfig is the public configuration of a query, which the requester knows without trusting the helpers.
+type PublicConfig struct {
+	QueryID string
+	// Total epsilon requested for the query.
+	TotalEpsilon float64
+	KeyBitSize   int32
+	// Origins of the two helpers in any order. The origins are not checked if empty.
+	Origins []string `json:",omitempty"`
+	// Filter applied to the complete histogram after the merge, in the format of dpfaggregator.ParsePostFilter.
+	PostFilter string `json:",omitempty"`
+}
+
+// ReadPublicConfig reads the public configuration from a JSON file.
+func ReadPublicConfig(ctx context.Context, uri string) (*PublicConfig, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	config := &PublicConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("invalid public configuration in %q: %v", uri, err)
+	}
+	return config, nil
+}
+
+// Check is the outcome of one verification step.
+type Check struct {
+	Name   string
+	Passed bool
+	Detail string `json:",omitempty"`
+}
+
+// Report is the outcome of a verification.
+type Report struct {
+	QueryID        string
+	Passed         bool
+	Checks         []*Check
+	SampledBuckets int
+}
+
+func (r *Report) add(name string, err error) {
+	check := &Check{Name: name, Passed: err == nil}
+	if err != nil {
+		check.Detail = err.Error()
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// Params contains the inputs of a verification.
+type Params struct {
+	Config *PublicConfig
+	// Signed result manifests of the two helpers, and the public keys of the helpers in the same order.
+	ManifestURIs [2]string
+	PublicKeys   [2]ed25519.PublicKey
+	// Merged result in the format of the merge pipeline: bucket ID, SUM and the optional labels.
+	MergedResultURI string
+	// Number of buckets sampled for checking the share combination. All buckets are checked if not positive.
+	SampleSize int
+	Seed       int64
+}
+
+// Verify runs all the checks. An error is returned only if the inputs cannot be read; failed checks are recorded in the
+// report.
+func Verify(ctx context.Context, params *Params) (*Report, error) {
+	report := &Report{QueryID: params.Config.QueryID}
+	var manifests [2]*resultmanifest.Manifest
+	var sigErrs []string
+	for i, uri := range params.ManifestURIs {
+		signed, err := resultmanifest.Read(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+		if signed.Manifest == nil {
+			return nil, fmt.Errorf("empty result manifest in %q", uri)
+		}
+		manifests[i] = signed.Manifest
+		if err := resultmanifest.VerifySignature(signed, params.PublicKeys[i]); err != nil {
+			sigErrs = append(sigErrs, fmt.Sprintf("helper %d: %v", i+1, err))
+		}
+	}
+	report.add(CheckSignatures, joinErrors(sigErrs))
+
+	var fileErrs []string
+	for i, m := range manifests {
+		if err := resultmanifest.VerifyFiles(ctx, m, ""); err != nil {
+			fileErrs = append(fileErrs, fmt.Sprintf("helper %d: %v", i+1, err))
+		}
+	}
+	report.add(CheckFiles, joinErrors(fileErrs))
+
+	report.add(CheckParameters, CheckManifestParameters(params.Config, manifests[0], manifests[1]))
+
+	filter, err := dpfaggregator.ParsePostFilter(params.Config.PostFilter)
+	if err != nil {
+		return nil, err
+	}
+	partial1, err := readPartialSums(ctx, manifests[0])
+	if err != nil {
+		return nil, err
+	}
+	partial2, err := readPartialSums(ctx, manifests[1])
+	if err != nil {
+		return nil, err
+	}
+	merged, err := results.ReadMergedSums(ctx, params.MergedResultURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	report.add(CheckRecordCounts, ReconcileRecordCounts(partial1, partial2, merged, filter))
+
+	sampled, mismatches := CheckShares(partial1, partial2, merged, filter, params.SampleSize, params.Seed)
+	report.SampledBuckets = sampled
+	report.add(CheckShareCombination, joinErrors(mismatches))
+
+	report.Passed = true
+	for _, c := range report.Checks {
+		report.Passed = report.Passed && c.Passed
+	}
+	return report, nil
+}
+
+func joinErrors(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// CheckManifestParameters checks the manifests of the two helpers agree with each other and with the public
+// configuration. A query that a helper ran at the remaining privacy budget is checked against the epsilon it requested.
+func CheckManifestParameters(config *PublicConfig, m1, m2 *resultmanifest.Manifest) error {
+	var errs []string
+	for i, m := range []*resultmanifest.Manifest{m1, m2} {
+		if m.QueryID != config.QueryID {
+			errs = append(errs, fmt.Sprintf("helper %d: query ID %q, want %q", i+1, m.QueryID, config.QueryID))
+		}
+		requested := m.TotalEpsilon
+		if m.RequestedEpsilon > 0 {
+			requested = m.RequestedEpsilon
+		}
+		if requested != config.TotalEpsilon {
+			errs = append(errs, fmt.Sprintf("helper %d: epsilon %v, want %v", i+1, requested, config.TotalEpsilon))
+		}
+		if m.KeyBitSize != config.KeyBitSize {
+			errs = append(errs, fmt.Sprintf("helper %d: key bit size %d, want %d", i+1, m.KeyBitSize, config.KeyBitSize))
+		}
+		if m.PostFilter != "" && m.PostFilter != config.PostFilter {
+			errs = append(errs, fmt.Sprintf("helper %d: post filter %q, want %q", i+1, m.PostFilter, config.PostFilter))
+		}
+	}
+	if m1.TotalEpsilon != m2.TotalEpsilon {
+		errs = append(errs, fmt.Sprintf("helpers ran with different epsilons %v and %v", m1.TotalEpsilon, m2.TotalEpsilon))
+	}
+	if m1.Origin == m2.Origin {
+		errs = append(errs, fmt.Sprintf("both manifests are from origin %q", m1.Origin))
+	}
+	if len(config.Origins) > 0 {
+		want := append([]string(nil), config.Origins...)
+		got := []string{m1.Origin, m2.Origin}
+		sort.Strings(want)
+		sort.Strings(got)
+		if strings.Join(want, ",") != strings.Join(got, ",") {
+			errs = append(errs, fmt.Sprintf("manifests are from origins %v, want %v", got, want))
+		}
+	}
+	return joinErrors(errs)
+}
+
+// readPartialSums reads the partial sums from the result files listed in the manifest.
+func readPartialSums(ctx context.Context, m *resultmanifest.Manifest) (map[uint128.Uint128]uint64, error) {
+	sums := make(map[uint128.Uint128]uint64)
+	dir := utils.DirPath(m.ResultURI)
+	for name := range m.Files {
+		shard, err := results.ReadPartialSums(ctx, utils.JoinPath(dir, name), nil)
+		if err != nil {
+			return nil, err
+		}
+		for bucket, sum := range shard {
+			if _, ok := sums[bucket]; ok {
+				return nil, fmt.Errorf("bucket %s appears more than once in the result of %q", bucket.String(), m.Origin)
+			}
+			sums[bucket] = sum
+		}
+	}
+	return sums, nil
+}
+
+// ReconcileRecordCounts checks the partial results have the same buckets, and every merged record has a bucket from
+// them. Without a post filter, the merged result must have all the buckets. With a floor, the merged records must not
+// have signed sums below it, as noise added modulo 2^64 makes the small sums negative.
+func ReconcileRecordCounts(partial1, partial2, merged map[uint128.Uint128]uint64, filter *dpfaggregator.PostFilter) error {
+	var errs []string
+	if len(partial1) != len(partial2) {
+		errs = append(errs, fmt.Sprintf("partial results have %d and %d records", len(partial1), len(partial2)))
+	}
+	var onlyIn1 int
+	for bucket := range partial1 {
+		if _, ok := partial2[bucket]; !ok {
+			onlyIn1++
+		}
+	}
+	if onlyIn1 > 0 {
+		errs = append(errs, fmt.Sprintf("%d buckets of helper 1 are missing from helper 2", onlyIn1))
+	}
+	var unknown int
+	for bucket := range merged {
+		_, ok1 := partial1[bucket]
+		_, ok2 := partial2[bucket]
+		if !ok1 || !ok2 {
+			unknown++
+		}
+	}
+	if unknown > 0 {
+		errs = append(errs, fmt.Sprintf("%d merged records have buckets missing from the partial results", unknown))
+	}
+	if filter != nil && filter.MinValue > 0 {
+		var below int
+		for _, sum := range merged {
+			if int64(sum) < filter.MinValue {
+				below++
+			}
+		}
+		if below > 0 {
+			errs = append(errs, fmt.Sprintf("%d merged records have sums below the floor %d", below, filter.MinValue))
+		}
+	}
+	if filter == nil && len(merged) != len(partial1) {
+		errs = append(errs, fmt.Sprintf("merged result has %d records, want %d", len(merged), len(partial1)))
+	}
+	if filter != nil && filter.TopK > 0 && len(merged) > filter.TopK {
+		errs = append(errs, fmt.Sprintf("merged result has %d records, more than the top %d", len(merged), filter.TopK))
+	}
+	return joinErrors(errs)
+}
+
+// CheckShares checks the share combination for a sample of the buckets in the partial results, which are chosen with
+// the seed. It returns the number of sampled buckets and the mismatches.
+func CheckShares(partial1, partial2, merged map[uint128.Uint128]uint64, filter *dpfaggregator.PostFilter, sampleSize int, seed int64) (int, []string) {
+	buckets := make([]uint128.Uint128, 0, len(partial1))
+	for bucket := range partial1 {
+		if _, ok := partial2[bucket]; ok {
+			buckets = append(buckets, bucket)
+		}
+	}
+	// Sorting makes the sample depend only on the seed.
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Cmp(buckets[j]) < 0 })
+	if sampleSize > 0 && sampleSize < len(buckets) {
+		rand.New(rand.NewSource(seed)).Shuffle(len(buckets), func(i, j int) { buckets[i], buckets[j] = buckets[j], buckets[i] })
+		buckets = buckets[:sampleSize]
+	}
+
+	var mismatches []string
+	for _, bucket := range buckets {
+		// The shares are additive modulo 2^64.
+		sum := partial1[bucket] + partial2[bucket]
+		got, ok := merged[bucket]
+		if ok {
+			if got != sum {
+				mismatches = append(mismatches, fmt.Sprintf("bucket %s: merged sum %d, shares add up to %d", bucket.String(), got, sum))
+			}
+			continue
+		}
+		// The post filter compares the sums as signed integers.
+		filtered := filter != nil && ((filter.MinValue > 0 && int64(sum) < filter.MinValue) || (filter.TopK > 0 && len(merged) >= filter.TopK))
+		if !filtered {
+			mismatches = append(mismatches, fmt.Sprintf("bucket %s: missing from the merged result with sum %d", bucket.String(), sum))
+		}
+	}
+	return len(buckets), mismatches
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resultverifier
+
+import (
+	"testing"
+
+	"lukechampine.com/uint128"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
+)
+
+func TestCheckManifestParameters(t *testing.T) {
+	config := &PublicConfig{QueryID: "query1", TotalEpsilon: 1, KeyBitSize: 32, Origins: []string{"helper2", "helper1"}}
+	newManifests := func() (*resultmanifest.Manifest, *resultmanifest.Manifest) {
+		return &resultmanifest.Manifest{QueryID: "query1", Origin: "helper1", TotalEpsilon: 1, KeyBitSize: 32},
+			&resultmanifest.Manifest{QueryID: "query1", Origin: "helper2", TotalEpsilon: 1, KeyBitSize: 32}
+	}
+
+	m1, m2 := newManifests()
+	if err := CheckManifestParameters(config, m1, m2); err != nil {
+		t.Errorf("expect consistent parameters, got %v", err)
+	}
+
+	// Both helpers ran the query at the remaining budget.
+	m1.TotalEpsilon, m1.RequestedEpsilon = 0.5, 1
+	m2.TotalEpsilon, m2.RequestedEpsilon = 0.5, 1
+	if err := CheckManifestParameters(config, m1, m2); err != nil {
+		t.Errorf("expect consistent parameters for a downgraded query, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		desc   string
+		change func(m1, m2 *resultmanifest.Manifest)
+	}{
+		{"different query ID", func(m1, m2 *resultmanifest.Manifest) { m2.QueryID = "query2" }},
+		{"different epsilon", func(m1, m2 *resultmanifest.Manifest) { m1.TotalEpsilon = 2 }},
+		{"one helper downgraded", func(m1, m2 *resultmanifest.Manifest) { m1.TotalEpsilon, m1.RequestedEpsilon = 0.5, 1 }},
+		{"different key bit size", func(m1, m2 *resultmanifest.Manifest) { m2.KeyBitSize = 64 }},
+		{"same origin", func(m1, m2 *resultmanifest.Manifest) { m2.Origin = "helper1" }},
+		{"unexpected origin", func(m1, m2 *resultmanifest.Manifest) { m2.Origin = "helper3" }},
+		{"unexpected post filter", func(m1, m2 *resultmanifest.Manifest) { m1.PostFilter = "top_k=10" }},
+	} {
+		m1, m2 := newManifests()
+		tc.change(m1, m2)
+		if err := CheckManifestParameters(config, m1, m2); err == nil {
+			t.Errorf("%s: expect error for inconsistent parameters", tc.desc)
+		}
+	}
+}
+
+// splitShares splits the sums into random-looking shares of the two helpers.
+func splitShares(sums map[uint64]uint64) (map[uint128.Uint128]uint64, map[uint128.Uint128]uint64, map[uint128.Uint128]uint64) {
+	partial1, partial2, merged := make(map[uint128.Uint128]uint64), make(map[uint128.Uint128]uint64), make(map[uint128.Uint128]uint64)
+	for b, sum := range sums {
+		bucket := uint128.From64(b)
+		share := b*0x9e3779b97f4a7c15 + 7
+		partial1[bucket], partial2[bucket], merged[bucket] = share, sum-share, sum
+	}
+	return partial1, partial2, merged
+}
+
+func TestReconcileRecordCounts(t *testing.T) {
+	partial1, partial2, merged := splitShares(map[uint64]uint64{1: 10, 2: 20, 3: 30})
+	if err := ReconcileRecordCounts(partial1, partial2, merged, nil); err != nil {
+		t.Errorf("expect reconciled record counts, got %v", err)
+	}
+
+	delete(merged, uint128.From64(1))
+	if err := ReconcileRecordCounts(partial1, partial2, merged, nil); err == nil {
+		t.Error("expect error for a missing record without post filter")
+	}
+	if err := ReconcileRecordCounts(partial1, partial2, merged, &dpfaggregator.PostFilter{MinValue: 15}); err != nil {
+		t.Errorf("expect reconciled record counts with post filter, got %v", err)
+	}
+	if err := ReconcileRecordCounts(partial1, partial2, merged, &dpfaggregator.PostFilter{TopK: 1}); err == nil {
+		t.Error("expect error for more records than the top k")
+	}
+
+	merged[uint128.From64(4)] = 40
+	if err := ReconcileRecordCounts(partial1, partial2, merged, &dpfaggregator.PostFilter{MinValue: 15}); err == nil {
+		t.Error("expect error for a merged record with an unknown bucket")
+	}
+
+	delete(partial2, uint128.From64(3))
+	if err := ReconcileRecordCounts(partial1, partial2, merged, &dpfaggregator.PostFilter{MinValue: 15}); err == nil {
+		t.Error("expect error for a bucket missing from helper 2")
+	}
+
+	// A sum made negative by the noise is below any floor.
+	partial1, partial2, merged = splitShares(map[uint64]uint64{1: 20, 2: 1<<64 - 5})
+	if err := ReconcileRecordCounts(partial1, partial2, merged, &dpfaggregator.PostFilter{MinValue: 15}); err == nil {
+		t.Error("expect error for a merged record with a negative sum")
+	}
+	delete(merged, uint128.From64(2))
+	if err := ReconcileRecordCounts(partial1, partial2, merged, &dpfaggregator.PostFilter{MinValue: 15}); err != nil {
+		t.Errorf("expect reconciled record counts without the negative sum, got %v", err)
+	}
+}
+
+func TestCheckShares(t *testing.T) {
+	sums := make(map[uint64]uint64)
+	for i := uint64(0); i < 100; i++ {
+		sums[i] = i * 3
+	}
+	partial1, partial2, merged := splitShares(sums)
+
+	if sampled, mismatches := CheckShares(partial1, partial2, merged, nil, 0 /*sampleSize*/, 1 /*seed*/); sampled != 100 || len(mismatches) != 0 {
+		t.Errorf("expect 100 buckets checked without mismatches, got %d with %v", sampled, mismatches)
+	}
+
+	merged[uint128.From64(42)]++
+	if _, mismatches := CheckShares(partial1, partial2, merged, nil, 0 /*sampleSize*/, 1 /*seed*/); len(mismatches) != 1 {
+		t.Errorf("expect one mismatch, got %v", mismatches)
+	}
+	merged[uint128.From64(42)]--
+
+	// The sample is the same for the same seed.
+	merged[uint128.From64(42)]++
+	_, mismatches1 := CheckShares(partial1, partial2, merged, nil, 50 /*sampleSize*/, 7 /*seed*/)
+	_, mismatches2 := CheckShares(partial1, partial2, merged, nil, 50 /*sampleSize*/, 7 /*seed*/)
+	if len(mismatches1) != len(mismatches2) {
+		t.Errorf("expect the same sample for the same seed, got %v and %v", mismatches1, mismatches2)
+	}
+	merged[uint128.From64(42)]--
+
+	// Buckets below the floor are dropped by the post filter.
+	filter := &dpfaggregator.PostFilter{MinValue: 30}
+	for i := uint64(0); i < 10; i++ {
+		delete(merged, uint128.From64(i))
+	}
+	if _, mismatches := CheckShares(partial1, partial2, merged, filter, 0 /*sampleSize*/, 1 /*seed*/); len(mismatches) != 0 {
+		t.Errorf("expect no mismatch for the filtered buckets, got %v", mismatches)
+	}
+	delete(merged, uint128.From64(50))
+	if _, mismatches := CheckShares(partial1, partial2, merged, filter, 0 /*sampleSize*/, 1 /*seed*/); len(mismatches) != 1 {
+		t.Errorf("expect one mismatch for a bucket above the floor, got %v", mismatches)
+	}
+
+	// A sum made negative by the noise is dropped by the floor.
+	partial1, partial2, merged = splitShares(map[uint64]uint64{1: 40, 2: 1<<64 - 5})
+	delete(merged, uint128.From64(2))
+	if _, mismatches := CheckShares(partial1, partial2, merged, filter, 0 /*sampleSize*/, 1 /*seed*/); len(mismatches) != 0 {
+		t.Errorf("expect no mismatch for the negative sum, got %v", mismatches)
+	}
+}
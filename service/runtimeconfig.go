@@ -0,0 +1,231 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package runtimeconfig holds the part of the configuration that the collector and the helper reload while running,
+// so routine changes of the origin allowlists, quotas and budget caps do not require a redeployment.
+//
+// The configuration is a JSON file on GCS or the local disk. A Watcher polls the version of the file, i.e. the GCS
+// object generation or the local modification time, and swaps in the new configuration as a whole once it is parsed
+// and validated. An invalid file is logged and ignored, so the previous configuration stays in effect.
+package runtimeconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+// ErrNotAllowed is returned when a query is rejected by the runtime configuration.
+var ErrNotAllowed = errors.New("not allowed by the runtime config")
+
+// Config contains the settings that can change without restarting the services.
+type Config struct {
+	// Reporting origins whose reports are accepted by the collector. All origins are accepted if empty.
+	AllowedReportingOrigins []string `json:",omitempty"`
+	// Origins of the partner helpers that the helper runs queries with. All partners are allowed if empty.
+	AllowedPartnerOrigins []string `json:",omitempty"`
+	// Maximum number of reports the collector accepts from one reporting origin per minute. Unlimited if zero.
+	DefaultReportsPerMinute int64 `json:",omitempty"`
+	// Quotas of specific reporting origins, which override the default.
+	OriginReportsPerMinute map[string]int64 `json:",omitempty"`
+	// Maximum total epsilon of a query run by the helper. Queries are not capped if zero.
+	MaxQueryEpsilon float64 `json:",omitempty"`
+}
+
+// Validate checks the quotas and caps are not negative.
+func (c *Config) Validate() error {
+	if c.DefaultReportsPerMinute < 0 {
+		return fmt.Errorf("expect non-negative DefaultReportsPerMinute, got %d", c.DefaultReportsPerMinute)
+	}
+	for origin, quota := range c.OriginReportsPerMinute {
+		if quota < 0 {
+			return fmt.Errorf("expect non-negative reports per minute for origin %q, got %d", origin, quota)
+		}
+	}
+	if c.MaxQueryEpsilon < 0 {
+		return fmt.Errorf("expect non-negative MaxQueryEpsilon, got %v", c.MaxQueryEpsilon)
+	}
+	return nil
+}
+
+func allowed(list []string, origin string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, o := range list {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// ReportingOriginAllowed returns whether the collector accepts reports from the origin.
+func (c *Config) ReportingOriginAllowed(origin string) bool {
+	return allowed(c.AllowedReportingOrigins, origin)
+}
+
+// PartnerOriginAllowed returns whether the helper runs queries with the partner helper.
+func (c *Config) PartnerOriginAllowed(origin string) bool {
+	return allowed(c.AllowedPartnerOrigins, origin)
+}
+
+// ReportsPerMinute returns the quota of the reporting origin, which is zero if unlimited.
+func (c *Config) ReportsPerMinute(origin string) int64 {
+	if quota, ok := c.OriginReportsPerMinute[origin]; ok {
+		return quota
+	}
+	return c.DefaultReportsPerMinute
+}
+
+// CheckQuery returns ErrNotAllowed if the helper must not run a query with the partner helper and the total epsilon.
+func (c *Config) CheckQuery(partnerOrigin string, totalEpsilon float64) error {
+	if !c.PartnerOriginAllowed(partnerOrigin) {
+		return fmt.Errorf("%w: partner origin %q", ErrNotAllowed, partnerOrigin)
+	}
+	if c.MaxQueryEpsilon > 0 && totalEpsilon > c.MaxQueryEpsilon {
+		return fmt.Errorf("%w: total epsilon %v above the cap %v", ErrNotAllowed, totalEpsilon, c.MaxQueryEpsilon)
+	}
+	return nil
+}
+
+// Parse parses and validates the configuration.
+func Parse(b []byte) (*Config, error) {
+	config := &Config{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Snapshot is a loaded version of the configuration.
+type Snapshot struct {
+	Config   *Config
+	Version  string
+	LoadedAt time.Time
+}
+
+// Watcher keeps the latest valid configuration from a file.
+type Watcher struct {
+	URI string
+
+	mu       sync.RWMutex
+	snapshot *Snapshot
+}
+
+// NewWatcher creates a watcher with the configuration loaded from the file. Unlike later reloads, an invalid file is
+// an error, so the services do not start with an unintended configuration.
+func NewWatcher(ctx context.Context, uri string) (*Watcher, error) {
+	w := &Watcher{URI: uri}
+	if _, err := w.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Snapshot returns the current configuration with its version.
+func (w *Watcher) Snapshot() *Snapshot {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.snapshot
+}
+
+// Config returns the current configuration, which must not be modified. Callers should get it once per request so
+// all the checks of the request see the same version. An empty configuration, which allows everything, is returned
+// for a nil watcher.
+func (w *Watcher) Config() *Config {
+	if w == nil {
+		return &Config{}
+	}
+	return w.Snapshot().Config
+}
+
+// Reload loads the configuration if the file has changed since the last load, and returns whether it is reloaded.
+// The current configuration is kept if the file is invalid.
+func (w *Watcher) Reload(ctx context.Context) (bool, error) {
+	version, err := utils.FileVersion(ctx, w.URI)
+	if err != nil {
+		return false, err
+	}
+	if current := w.Snapshot(); current != nil && current.Version == version {
+		return false, nil
+	}
+	b, err := utils.ReadBytes(ctx, w.URI)
+	if err != nil {
+		return false, err
+	}
+	config, err := Parse(b)
+	if err != nil {
+		return false, fmt.Errorf("invalid runtime config %q of version %s: %v", w.URI, version, err)
+	}
+
+	w.mu.Lock()
+	w.snapshot = &Snapshot{Config: config, Version: version, LoadedAt: time.Now().UTC()}
+	w.mu.Unlock()
+	log.Infof("loaded runtime config %q of version %s", w.URI, version)
+	return true, nil
+}
+
+// Watch reloads the configuration at the interval until the context is done.
+func (w *Watcher) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := w.Reload(ctx); err != nil {
+				log.Errorf("keeping the current runtime config: %v", err)
+			}
+		}
+	}
+}
+
+// Handler exposes the current configuration.
+//
+// GET returns the current Snapshot; POST reloads the file immediately, e.g. right after a change is pushed, and
+// returns the resulting Snapshot.
+type Handler struct {
+	Watcher *Watcher
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if _, err := h.Watcher.Reload(req.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Error(err)
+			return
+		}
+	default:
+		http.Error(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.Watcher.Snapshot()); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtimeconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+func TestConfig(t *testing.T) {
+	config, err := Parse([]byte(`{
+		"AllowedReportingOrigins": ["https://a.example"],
+		"DefaultReportsPerMinute": 100,
+		"OriginReportsPerMinute": {"https://a.example": 1000},
+		"MaxQueryEpsilon": 10
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.ReportingOriginAllowed("https://a.example") || config.ReportingOriginAllowed("https://b.example") {
+		t.Errorf("expect only https://a.example to be allowed, got %v", config.AllowedReportingOrigins)
+	}
+	if got := config.ReportsPerMinute("https://a.example"); got != 1000 {
+		t.Errorf("expect quota 1000 for the overridden origin, got %d", got)
+	}
+	if got := config.ReportsPerMinute("https://b.example"); got != 100 {
+		t.Errorf("expect the default quota 100, got %d", got)
+	}
+	// No partner allowlist means all partners are allowed.
+	if err := config.CheckQuery("https://helper.example", 10); err != nil {
+		t.Errorf("expect query within the cap to be allowed, got %v", err)
+	}
+	if err := config.CheckQuery("https://helper.example", 10.5); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("expect ErrNotAllowed for query above the cap, got %v", err)
+	}
+
+	config.AllowedPartnerOrigins = []string{"https://helper.example"}
+	if err := config.CheckQuery("https://other.example", 1); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("expect ErrNotAllowed for a partner out of the allowlist, got %v", err)
+	}
+
+	for _, s := range []string{
+		`{"DefaultReportsPerMinute": -1}`,
+		`{"OriginReportsPerMinute": {"https://a.example": -1}}`,
+		`{"MaxQueryEpsilon": -1}`,
+		`{"MaxQueryEpsilon": "1"}`,
+	} {
+		if _, err := Parse([]byte(s)); err == nil {
+			t.Errorf("expect error for config %s", s)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-runtime-config")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	uri := path.Join(tmpDir, "config.json")
+	write := func(content string) {
+		t.Helper()
+		if err := utils.WriteBytes(ctx, []byte(content), uri, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"MaxQueryEpsilon": 1}`)
+	watcher, err := NewWatcher(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := watcher.Config()
+	if reloaded, err := watcher.Reload(ctx); err != nil || reloaded {
+		t.Errorf("expect no reload for an unchanged file, got %v, %v", reloaded, err)
+	}
+
+	write(`{"MaxQueryEpsilon": 2.5}`)
+	if reloaded, err := watcher.Reload(ctx); err != nil || !reloaded {
+		t.Fatalf("expect reload for a changed file, got %v, %v", reloaded, err)
+	}
+	if diff := cmp.Diff(&Config{MaxQueryEpsilon: 2.5}, watcher.Config()); diff != "" {
+		t.Errorf("config mismatch (-want +got):\n%s", diff)
+	}
+	// Callers holding the old configuration are not affected by the reload.
+	if old.MaxQueryEpsilon != 1 {
+		t.Errorf("expect the old config unchanged, got %+v", old)
+	}
+
+	write(`{"MaxQueryEpsilon": -1000}`)
+	if _, err := watcher.Reload(ctx); err == nil {
+		t.Error("expect error for an invalid config")
+	}
+	if got := watcher.Config().MaxQueryEpsilon; got != 2.5 {
+		t.Errorf("expect the last valid config to stay in effect, got MaxQueryEpsilon %v", got)
+	}
+
+	if _, err := NewWatcher(ctx, uri); err == nil {
+		t.Error("expect error for starting with an invalid config")
+	}
+	var nilWatcher *Watcher
+	if diff := cmp.Diff(&Config{}, nilWatcher.Config()); diff != "" {
+		t.Errorf("expect empty config for a nil watcher (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-runtime-config-handler")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	uri := path.Join(tmpDir, "config.json")
+	if err := utils.WriteBytes(ctx, []byte(`{"MaxQueryEpsilon": 1}`), uri, nil); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := NewWatcher(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(&Handler{Watcher: watcher})
+	defer server.Close()
+
+	if err := utils.WriteBytes(ctx, []byte(`{"MaxQueryEpsilon": 3}`), uri, nil); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.Client().Post(server.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect status OK, got %s", resp.Status)
+	}
+	got := &Snapshot{}
+	if err := json.NewDecoder(resp.Body).Decode(got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(watcher.Snapshot(), got); diff != "" {
+		t.Errorf("snapshot mismatch (-want +got):\n%s", diff)
+	}
+	if got.Config.MaxQueryEpsilon != 3 {
+		t.Errorf("expect the reloaded config, got %+v", got.Config)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shadowrun supports running a candidate pipeline binary in shadow mode alongside the production binary.
+//
+// The shadow pipeline reads the same inputs as the production pipeline, with the same noise seed for debugging batches,
+// and writes its outputs into a separate directory. Function CompareHistograms() diffs the outputs of the two runs, and
+// the report is saved next to the shadow outputs, so rollouts of the candidate binary can be gated on agreement.
+package shadowrun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"lukechampine.com/uint128"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+
+	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+)
+
+// Flags of the production pipeline whose values are output locations, which are redirected to the shadow directory.
+var outputFlags = []string{"--partial_histogram_uri=", "--decrypted_report_uri=", "--expansion_stats_uri="}
+
+// Report records the difference between the outputs of the production and shadow runs.
+type Report struct {
+	QueryID       string
+	Level         int32
+	ProductionURI string
+	ShadowURI     string
+	// Whether the shadow output is identical to the production output.
+	Agree bool
+	// Buckets with different values in the two outputs.
+	MismatchedBuckets []uint128.Uint128
+	// Buckets that only exist in one of the outputs.
+	MissingInShadow, MissingInProduction []uint128.Uint128
+}
+
+// GetShadowOutputURI returns the shadow location for a production output.
+func GetShadowOutputURI(shadowDir, queryID string, level int32, flag string) string {
+	name := strings.Trim(strings.TrimSuffix(strings.TrimPrefix(flag, "--"), "="), "_")
+	return utils.JoinPath(shadowDir, fmt.Sprintf("%s_%d_%s", queryID, level, name))
+}
+
+// GetReportURI returns the location of the shadow report for a query level.
+func GetReportURI(shadowDir, queryID string, level int32) string {
+	return utils.JoinPath(shadowDir, fmt.Sprintf("%s_%d_shadow_report.json", queryID, level))
+}
+
+// ShadowArgs copies the production pipeline arguments, redirecting the nonempty output locations into the shadow
+// directory. It returns the shadow arguments and the shadow location of the partial histogram.
+func ShadowArgs(args []string, shadowDir, queryID string, level int32) ([]string, string) {
+	var (
+		shadowArgs   []string
+		histogramURI string
+	)
+	for _, arg := range args {
+		for _, flag := range outputFlags {
+			if strings.HasPrefix(arg, flag) && arg != flag {
+				uri := GetShadowOutputURI(shadowDir, queryID, level, flag)
+				if flag == outputFlags[0] {
+					histogramURI = uri
+				}
+				arg = flag + uri
+				break
+			}
+		}
+		shadowArgs = append(shadowArgs, arg)
+	}
+	return shadowArgs, histogramURI
+}
+
+// CompareHistograms diffs the partial histograms from the production and shadow runs.
+func CompareHistograms(production, shadow map[uint128.Uint128]*pb.PartialAggregationDpf) *Report {
+	report := &Report{}
+	for id, p := range production {
+		s, ok := shadow[id]
+		if !ok {
+			report.MissingInShadow = append(report.MissingInShadow, id)
+			continue
+		}
+		if p.GetPartialSum() != s.GetPartialSum() {
+			report.MismatchedBuckets = append(report.MismatchedBuckets, id)
+		}
+	}
+	for id := range shadow {
+		if _, ok := production[id]; !ok {
+			report.MissingInProduction = append(report.MissingInProduction, id)
+		}
+	}
+	for _, ids := range [][]uint128.Uint128{report.MismatchedBuckets, report.MissingInShadow, report.MissingInProduction} {
+		sort.Slice(ids, func(i, j int) bool { return ids[i].Cmp(ids[j]) < 0 })
+	}
+	report.Agree = len(report.MismatchedBuckets) == 0 && len(report.MissingInShadow) == 0 && len(report.MissingInProduction) == 0
+	return report
+}
+
+// CompareOutputs reads the partial histograms from the production and shadow runs, diffs them, and saves the report in the shadow directory.
+func CompareOutputs(ctx context.Context, productionURI, shadowURI, shadowDir, queryID string, level int32) (*Report, error) {
+	production, err := dpfaggregator.ReadPartialHistogram(ctx, productionURI)
+	if err != nil {
+		return nil, err
+	}
+	shadow, err := dpfaggregator.ReadPartialHistogram(ctx, shadowURI)
+	if err != nil {
+		return nil, err
+	}
+	report := CompareHistograms(production, shadow)
+	report.QueryID, report.Level = queryID, level
+	report.ProductionURI, report.ShadowURI = productionURI, shadowURI
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.WriteBytes(ctx, b, GetReportURI(shadowDir, queryID, level), nil); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowrun
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"lukechampine.com/uint128"
+
+	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+)
+
+func TestShadowArgs(t *testing.T) {
+	args := []string{
+		"--partial_report_uri=/input/reports",
+		"--partial_histogram_uri=/result/query1_origin",
+		"--decrypted_report_uri=",
+		"--epsilon=1.000000",
+	}
+	got, histogramURI := ShadowArgs(args, "/shadow", "query1", 2)
+	want := []string{
+		"--partial_report_uri=/input/reports",
+		"--partial_histogram_uri=/shadow/query1_2_partial_histogram_uri",
+		"--decrypted_report_uri=",
+		"--epsilon=1.000000",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("shadow args mismatch (-want +got):\n%s", diff)
+	}
+	if want := "/shadow/query1_2_partial_histogram_uri"; histogramURI != want {
+		t.Errorf("expect shadow histogram URI %q, got %q", want, histogramURI)
+	}
+	if args[1] != "--partial_histogram_uri=/result/query1_origin" {
+		t.Errorf("production args should not be changed, got %q", args[1])
+	}
+}
+
+func TestCompareHistograms(t *testing.T) {
+	production := map[uint128.Uint128]*pb.PartialAggregationDpf{
+		uint128.From64(1): {PartialSum: 10},
+		uint128.From64(2): {PartialSum: 20},
+		uint128.From64(3): {PartialSum: 30},
+	}
+
+	same := map[uint128.Uint128]*pb.PartialAggregationDpf{
+		uint128.From64(1): {PartialSum: 10},
+		uint128.From64(2): {PartialSum: 20},
+		uint128.From64(3): {PartialSum: 30},
+	}
+	if report := CompareHistograms(production, same); !report.Agree {
+		t.Errorf("expect agreement, got %+v", report)
+	}
+
+	different := map[uint128.Uint128]*pb.PartialAggregationDpf{
+		uint128.From64(1): {PartialSum: 10},
+		uint128.From64(2): {PartialSum: 21},
+		uint128.From64(4): {PartialSum: 40},
+	}
+	want := &Report{
+		MismatchedBuckets:   []uint128.Uint128{uint128.From64(2)},
+		MissingInShadow:     []uint128.Uint128{uint128.From64(3)},
+		MissingInProduction: []uint128.Uint128{uint128.From64(4)},
+	}
+	if diff := cmp.Diff(want, CompareHistograms(production, different)); diff != "" {
+		t.Errorf("shadow report mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tieredstorage keeps the intermediate state of the hierarchical queries, e.g. the decrypted reports, in a
+// storage tier different from the workspace, such as a Nearline bucket.
+//
+// Function WriteManifest() records the SHA-256 hash of each file written by the pipeline. At the next level, function
+// Fetch() verifies the files against the manifest before they are read again, and optionally keeps a verified copy in a
+// local cache directory, so the files are only fetched from the cold storage once for all the levels of a query. The
+// files are streamed while they are hashed and copied, so they are never held in memory.
+package tieredstorage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/io/filesystem"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+
+	// The following packages are required to read files from GCS or local.
+	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/gcs"
+	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/local"
+)
+
+// fetchedMarkerPrefix prefixes the name of the marker written in the cache directory after all the files of a manifest
+// are copied and verified. The marker does not share the prefix of the cached files, which the pipelines read with a
+// wildcard.
+const fetchedMarkerPrefix = "FETCHED_"
+
+// Manifest records the files written with the same base URI and their hashes.
+type Manifest struct {
+	// The pipelines read the files with BaseURI followed by a wildcard.
+	BaseURI string
+	// SHA-256 hashes of the files keyed by the file names.
+	Files map[string]string
+}
+
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func listFiles(ctx context.Context, glob string) ([]string, error) {
+	fs, err := filesystem.New(ctx, glob)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	files, err := fs.List(ctx, glob)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// copyFile streams the file into w, and returns the SHA-256 hash of its content.
+func copyFile(ctx context.Context, uri string, w io.Writer) (string, error) {
+	fs, err := filesystem.New(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	defer fs.Close()
+
+	r, err := fs.OpenRead(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteManifest hashes the files matching the glob, and saves the manifest for the base URI.
+func WriteManifest(ctx context.Context, baseURI, glob, manifestURI string) (*Manifest, error) {
+	files, err := listFiles(ctx, glob)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no file matches %q", glob)
+	}
+
+	manifest := &Manifest{BaseURI: baseURI, Files: make(map[string]string)}
+	for _, f := range files {
+		if manifest.Files[path.Base(f)], err = copyFile(ctx, f, io.Discard); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.WriteBytes(ctx, b, manifestURI, nil); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ReadManifest reads the manifest from a file.
+func ReadManifest(ctx context.Context, manifestURI string) (*Manifest, error) {
+	b, err := utils.ReadBytes(ctx, manifestURI)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// verifyFile streams a file into w, and checks its hash.
+func verifyFile(ctx context.Context, uri, wantHash string, w io.Writer) error {
+	got, err := copyFile(ctx, uri, w)
+	if err != nil {
+		return err
+	}
+	if got != wantHash {
+		return fmt.Errorf("integrity check failed for %s: expect SHA-256 %s, got %s", uri, wantHash, got)
+	}
+	return nil
+}
+
+// fetchFile streams a file from the cold storage into the cache, and checks its hash.
+func fetchFile(ctx context.Context, remoteURI, cachedURI, wantHash string) error {
+	fs, err := filesystem.New(ctx, cachedURI)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	w, err := fs.OpenWrite(ctx, cachedURI)
+	if err != nil {
+		return err
+	}
+	if err := verifyFile(ctx, remoteURI, wantHash, w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Fetch verifies the files in the manifest, and returns the base URI where the pipelines should read them.
+//
+// If cacheDir is empty, the files are verified where they are stored and the original base URI is returned. Otherwise,
+// the files are copied into cacheDir and verified, and the base URI in the cache is returned. A marker with the hash of
+// the manifest is written after all the files are verified, so the later levels of the query read the cached copy
+// without fetching the files again. The files are fetched again if the marker is missing, e.g. after an interrupted
+// fetch, or if the manifest changed.
+func Fetch(ctx context.Context, manifestURI, cacheDir string) (string, error) {
+	bManifest, err := utils.ReadBytes(ctx, manifestURI)
+	if err != nil {
+		return "", err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(bManifest, manifest); err != nil {
+		return "", err
+	}
+	remoteDir := utils.DirPath(manifest.BaseURI)
+	if cacheDir == "" {
+		for name, hash := range manifest.Files {
+			if err := verifyFile(ctx, utils.JoinPath(remoteDir, name), hash, io.Discard); err != nil {
+				return "", err
+			}
+		}
+		return manifest.BaseURI, nil
+	}
+
+	cachedBaseURI := utils.JoinPath(cacheDir, path.Base(manifest.BaseURI))
+	markerURI := utils.JoinPath(cacheDir, fetchedMarkerPrefix+path.Base(manifest.BaseURI))
+	manifestHash := hashBytes(bManifest)
+	exist, err := utils.IsFileGlobExist(ctx, markerURI)
+	if err != nil {
+		return "", err
+	}
+	if exist {
+		marker, err := utils.ReadBytes(ctx, markerURI)
+		if err != nil {
+			return "", err
+		}
+		if string(marker) == manifestHash {
+			return cachedBaseURI, nil
+		}
+	}
+
+	for name, hash := range manifest.Files {
+		if err := fetchFile(ctx, utils.JoinPath(remoteDir, name), utils.JoinPath(cacheDir, name), hash); err != nil {
+			return "", err
+		}
+	}
+	if err := utils.WriteBytes(ctx, []byte(manifestHash), markerURI, nil); err != nil {
+		return "", err
+	}
+	return cachedBaseURI, nil
+}
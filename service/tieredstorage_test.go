@@ -0,0 +1,117 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredstorage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+func TestManifestAndFetch(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-tiered-storage")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+	coldDir := path.Join(tmpDir, "cold")
+	cacheDir := path.Join(tmpDir, "cache")
+	for _, dir := range []string{coldDir, cacheDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	baseURI := path.Join(coldDir, "query1_DECRYPTEDREPORT")
+	for i, content := range []string{"report 1\nreport 2\n", "report 3\n"} {
+		if err := utils.WriteBytes(ctx, []byte(content), baseURI+"-"+string(rune('1'+i))+"-2", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifestURI := path.Join(tmpDir, "manifest.json")
+	manifest, err := WriteManifest(ctx, baseURI, baseURI+"*", manifestURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(manifest.Files), 2; got != want {
+		t.Fatalf("expect %d files in the manifest, got %d", want, got)
+	}
+
+	got, err := Fetch(ctx, manifestURI, "" /*cacheDir*/)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != baseURI {
+		t.Errorf("expect base URI %q without cache, got %q", baseURI, got)
+	}
+
+	got, err = Fetch(ctx, manifestURI, cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := path.Join(cacheDir, "query1_DECRYPTEDREPORT"); got != want {
+		t.Errorf("expect cached base URI %q, got %q", want, got)
+	}
+	cached, err := utils.ReadBytes(ctx, got+"-2-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "report 3\n"; string(cached) != want {
+		t.Errorf("expect cached content %q, got %q", want, cached)
+	}
+
+	// The later levels of the query read the cached copy without fetching the files again.
+	if err := utils.WriteBytes(ctx, []byte("corrupted"), baseURI+"-2-2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Fetch(ctx, manifestURI, cacheDir); err != nil {
+		t.Fatal(err)
+	} else if want := path.Join(cacheDir, "query1_DECRYPTEDREPORT"); got != want {
+		t.Errorf("expect cached base URI %q, got %q", want, got)
+	}
+	if err := utils.WriteBytes(ctx, []byte("report 3\n"), baseURI+"-2-2", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cached copy without the marker of a complete fetch is fetched again from the cold storage.
+	if err := os.Remove(path.Join(cacheDir, fetchedMarkerPrefix+"query1_DECRYPTEDREPORT")); err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.WriteBytes(ctx, []byte("corrupted"), got+"-2-2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Fetch(ctx, manifestURI, cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err = utils.ReadBytes(ctx, got+"-2-2"); err != nil {
+		t.Fatal(err)
+	} else if want := "report 3\n"; string(cached) != want {
+		t.Errorf("expect repaired cached content %q, got %q", want, cached)
+	}
+
+	// Corruption in the cold storage fails the integrity check.
+	if err := utils.WriteBytes(ctx, []byte("corrupted"), baseURI+"-1-2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Fetch(ctx, manifestURI, "" /*cacheDir*/); err == nil {
+		t.Error("expect integrity check failure for corrupted file")
+	}
+}
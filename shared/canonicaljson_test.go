@@ -0,0 +1,71 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package canonicaljson
+
+import (
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	for _, tc := range []struct {
+		input, want string
+	}{
+		{`{ "b": 1, "a": [true, null, "x"] }`, `{"a":[true,null,"x"],"b":1}`},
+		{`{"\u20ac":1,"\r":2,"1":3,"\ud83d\ude00":4,"\u00f6":5}`, "{\"\\r\":2,\"1\":3,\"\u00f6\":5,\"\u20ac\":1,\"\U0001F600\":4}"},
+		{`"<a & b>\u2028\u001f"`, "\"<a & b>\u2028\\u001f\""},
+		{`18446744073709551615`, `18446744073709551615`},
+		{`-0`, `0`},
+		{`[1.0, 0.1, 1e-7, 1e21, 1e20, 123.456e2, -0.0000015, 5E-324]`, `[1,0.1,1e-7,1e+21,100000000000000000000,12345.6,-0.0000015,5e-324]`},
+	} {
+		got, err := Canonicalize([]byte(tc.input))
+		if err != nil {
+			t.Fatalf("Canonicalize(%s): %v", tc.input, err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("Canonicalize(%s) = %s, want %s", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestCanonicalizeIdempotent(t *testing.T) {
+	type manifest struct {
+		QueryID string
+		Epsilon float64
+		Files   map[string]string
+	}
+	b, err := Marshal(&manifest{QueryID: "q<1>", Epsilon: 0.3, Files: map[string]string{"b": "2", "a": "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"Epsilon":0.3,"Files":{"a":"1","b":"2"},"QueryID":"q<1>"}`
+	if string(b) != want {
+		t.Fatalf("got %s, want %s", b, want)
+	}
+	again, err := Canonicalize(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != want {
+		t.Errorf("canonicalizing twice got %s, want %s", again, want)
+	}
+}
+
+func TestCanonicalizeError(t *testing.T) {
+	for _, input := range []string{`{"a":1} {}`, `{"a":`, `1e400`} {
+		if _, err := Canonicalize([]byte(input)); err == nil {
+			t.Errorf("expect error for %s", input)
+		}
+	}
+}
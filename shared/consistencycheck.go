@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package consistencycheck verifies that the secret shares generated by the clients recombine to valid values, to
+// surface client-side bugs in debug batches.
+//
+// Both helpers sample the same subset of reports with a shared seed. For each sampled report, a helper sums its share
+// of the expanded vector at the first hierarchy level. As the shares are additive, the two sums add up to the value
+// of the report, which is then checked against the allowed range. The check reveals the values of the sampled reports
+// to the helper that recombines the sums, so it must only run on debug batches, and only one of the helpers shares its
+// sums with the other.
+package consistencycheck
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+// Result is the outcome of a check.
+type Result struct {
+	Checked int
+	// Reports whose recombined value is out of the allowed range.
+	OutOfRange []string
+	// Sampled reports that only one of the helpers has.
+	Missing []string
+}
+
+// OK returns whether all the sampled reports passed the check.
+func (r *Result) OK() bool {
+	return len(r.OutOfRange) == 0 && len(r.Missing) == 0
+}
+
+// Sampled decides whether a report is in the sample, in the same way on both helpers.
+func Sampled(seed uint64, reportID string, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	if rate >= 1 {
+		return true
+	}
+	b := make([]byte, 8, 8+len(reportID))
+	binary.BigEndian.PutUint64(b, seed)
+	h := sha256.Sum256(append(b, reportID...))
+	return float64(binary.BigEndian.Uint64(h[:8])) < rate*math.MaxUint64
+}
+
+// SumShare sums the share of an expanded vector. The sum wraps around as the shares are additive modulo 2^64.
+func SumShare(vec []uint64) uint64 {
+	var sum uint64
+	for _, v := range vec {
+		sum += v
+	}
+	return sum
+}
+
+// FormatShare formats the share sum of a report as a line of the share file.
+func FormatShare(reportID string, sum uint64) string {
+	return fmt.Sprintf("%s,%d", reportID, sum)
+}
+
+// ParseShare parses a line of the share file. The report ID may contain commas, so the sum is after the last one.
+func ParseShare(line string) (string, uint64, error) {
+	i := strings.LastIndex(line, ",")
+	if i < 0 {
+		return "", 0, fmt.Errorf("expect report ID and share sum, got %q", line)
+	}
+	sum, err := strconv.ParseUint(line[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return line[:i], sum, nil
+}
+
+// ReadShares reads the share sums keyed by the report IDs.
+func ReadShares(ctx context.Context, uri string) (map[string]uint64, error) {
+	lines, err := utils.ReadLines(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	shares := make(map[string]uint64)
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		id, sum, err := ParseShare(line)
+		if err != nil {
+			return nil, err
+		}
+		shares[id] = sum
+	}
+	return shares, nil
+}
+
+// Check recombines the share sums from the two helpers, and checks that each value is at most maxValue.
+func Check(own, partner map[string]uint64, maxValue uint64) *Result {
+	result := &Result{}
+	for id, sum := range own {
+		partnerSum, ok := partner[id]
+		if !ok {
+			result.Missing = append(result.Missing, id)
+			continue
+		}
+		result.Checked++
+		if sum+partnerSum > maxValue {
+			result.OutOfRange = append(result.OutOfRange, id)
+		}
+	}
+	for id := range partner {
+		if _, ok := own[id]; !ok {
+			result.Missing = append(result.Missing, id)
+		}
+	}
+	sort.Strings(result.OutOfRange)
+	sort.Strings(result.Missing)
+	return result
+}
+
+// QuerySeed derives the sampling seed from the query ID, which is the same on both helpers.
+func QuerySeed(queryID string) uint64 {
+	h := sha256.Sum256([]byte(queryID))
+	return binary.BigEndian.Uint64(h[:8])
+}
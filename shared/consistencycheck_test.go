@@ -0,0 +1,76 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consistencycheck
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSampled(t *testing.T) {
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("report%d", i)
+		got := Sampled(42, id, 0.1)
+		if got != Sampled(42, id, 0.1) {
+			t.Fatalf("sampling is not deterministic for %q", id)
+		}
+		if got {
+			sampled++
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Errorf("expect about 1000 reports sampled at rate 0.1, got %d", sampled)
+	}
+	if Sampled(42, "report", 0) || !Sampled(42, "report", 1) {
+		t.Error("expect no report sampled at rate 0 and all at rate 1")
+	}
+}
+
+func TestParseShare(t *testing.T) {
+	id, sum, err := ParseShare(FormatShare(`{"report_id":"a,b"}`, math.MaxUint64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != `{"report_id":"a,b"}` || sum != math.MaxUint64 {
+		t.Errorf("got report %q with sum %d", id, sum)
+	}
+	if _, _, err := ParseShare("no-sum"); err == nil {
+		t.Error("expect error for a line without share sum")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	// The shares of 5 are 2^64-3 and 8, which wrap around.
+	own := map[string]uint64{"ok": math.MaxUint64 - 2, "too-large": 100, "own-only": 1}
+	partner := map[string]uint64{"ok": 8, "too-large": 1000, "partner-only": 1}
+	got := Check(own, partner, 1000)
+	want := &Result{Checked: 2, OutOfRange: []string{"too-large"}, Missing: []string{"own-only", "partner-only"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("check result mismatch (-want +got):\n%s", diff)
+	}
+	if got.OK() {
+		t.Error("expect the check to fail")
+	}
+}
+
+func TestSumShare(t *testing.T) {
+	if got := SumShare([]uint64{math.MaxUint64, 2, 0}); got != 1 {
+		t.Errorf("expect the shares to sum modulo 2^64 to 1, got %d", got)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flagdeprecation contains functions for retiring the command line flags of the binaries.
+//
+// A binary lists its flags to be retired together with their replacements. After the flags are parsed,
+// function Migrate() warns about each retired flag set on the command line with the equivalent new
+// configuration, and copies the value to the replacement flag so the old command lines keep working.
+// In strict mode, setting any retired flag is an error.
+package flagdeprecation
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+// Flag describes a flag to be retired and the configuration replacing it.
+type Flag struct {
+	// Name of the retired flag.
+	Name string
+	// Name of the flag or configuration field replacing the retired flag.
+	Replacement string
+	// Snippet returns the equivalent new configuration for a value of the retired flag.
+	// If nil, the snippet is "--<Replacement>=<value>".
+	Snippet func(value string) string
+}
+
+// Warning contains the migration information for a retired flag set on the command line.
+type Warning struct {
+	Flag        string `json:"flag"`
+	Value       string `json:"value"`
+	Replacement string `json:"replacement"`
+	Snippet     string `json:"snippet"`
+}
+
+// String formats the warning as a JSON object so it can be parsed by log processors.
+func (w Warning) String() string {
+	b, err := json.Marshal(w)
+	if err != nil {
+		return fmt.Sprintf("flag %s=%s, replacement %s: %s", w.Flag, w.Value, w.Replacement, w.Snippet)
+	}
+	return string(b)
+}
+
+func (f Flag) snippet(value string) string {
+	if f.Snippet != nil {
+		return f.Snippet(value)
+	}
+	return fmt.Sprintf("--%s=%s", f.Replacement, value)
+}
+
+// Check gets the warnings for the retired flags that are explicitly set in the flag set.
+func Check(fs *flag.FlagSet, flags []Flag) []Warning {
+	retired := make(map[string]Flag)
+	for _, f := range flags {
+		retired[f.Name] = f
+	}
+
+	var warnings []Warning
+	fs.Visit(func(fl *flag.Flag) {
+		f, ok := retired[fl.Name]
+		if !ok {
+			return
+		}
+		value := fl.Value.String()
+		warnings = append(warnings, Warning{
+			Flag:        f.Name,
+			Value:       value,
+			Replacement: f.Replacement,
+			Snippet:     f.snippet(value),
+		})
+	})
+	sort.Slice(warnings, func(i, j int) bool { return warnings[i].Flag < warnings[j].Flag })
+	return warnings
+}
+
+// Migrate logs the warnings for the retired flags set on the command line, and copies their values to the replacement flags.
+//
+// A value is only copied when the replacement is a flag in the same flag set and it is not set explicitly.
+// In strict mode, an error is returned if any retired flag is set.
+func Migrate(fs *flag.FlagSet, flags []Flag, strict bool) error {
+	warnings := Check(fs, flags)
+	if len(warnings) == 0 {
+		return nil
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		explicit[fl.Name] = true
+	})
+
+	var names []string
+	for _, w := range warnings {
+		log.Warningf("flag to be retired: %s", w)
+		names = append(names, w.Flag)
+		if strict || fs.Lookup(w.Replacement) == nil {
+			continue
+		}
+		if explicit[w.Replacement] {
+			log.Warningf("both --%s and --%s are set, ignoring --%s", w.Flag, w.Replacement, w.Flag)
+			continue
+		}
+		if err := fs.Set(w.Replacement, w.Value); err != nil {
+			return fmt.Errorf("failed to migrate --%s to --%s: %v", w.Flag, w.Replacement, err)
+		}
+	}
+	if strict {
+		return fmt.Errorf("retired flags are not allowed in strict mode: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
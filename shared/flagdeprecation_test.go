@@ -0,0 +1,82 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagdeprecation
+
+import (
+	"flag"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var testFlags = []Flag{
+	{Name: "old_uri", Replacement: "new_uri"},
+	{Name: "old_budget", Replacement: "PrivacyBudget", Snippet: func(value string) string {
+		return fmt.Sprintf(`{"PrivacyBudget": %s}`, value)
+	}},
+}
+
+func newTestFlagSet() (*flag.FlagSet, *string, *string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	oldURI := fs.String("old_uri", "", "")
+	newURI := fs.String("new_uri", "", "")
+	fs.Float64("old_budget", 0, "")
+	return fs, oldURI, newURI
+}
+
+func TestCheck(t *testing.T) {
+	fs, _, _ := newTestFlagSet()
+	if err := fs.Parse([]string{"--old_uri=foo", "--old_budget=0.5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Warning{
+		{Flag: "old_budget", Value: "0.5", Replacement: "PrivacyBudget", Snippet: `{"PrivacyBudget": 0.5}`},
+		{Flag: "old_uri", Value: "foo", Replacement: "new_uri", Snippet: "--new_uri=foo"},
+	}
+	if diff := cmp.Diff(want, Check(fs, testFlags)); diff != "" {
+		t.Errorf("warnings mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	for _, tc := range []struct {
+		desc       string
+		args       []string
+		strict     bool
+		wantNewURI string
+		wantErr    bool
+	}{
+		{"no-retired-flags", []string{"--new_uri=bar"}, false, "bar", false},
+		{"copy-to-replacement", []string{"--old_uri=foo"}, false, "foo", false},
+		{"replacement-set", []string{"--old_uri=foo", "--new_uri=bar"}, false, "bar", false},
+		{"strict", []string{"--old_uri=foo"}, true, "", true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			fs, _, newURI := newTestFlagSet()
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			err := Migrate(fs, testFlags, tc.strict)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("want error %t, got %v", tc.wantErr, err)
+			}
+			if *newURI != tc.wantNewURI {
+				t.Errorf("want --new_uri=%q, got %q", tc.wantNewURI, *newURI)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mmapfile reads large local files through read-only memory mappings.
+//
+// The records are iterated without copying: the slices passed to the callback point into the mapping, and they are
+// only valid until the file is closed.
+package mmapfile
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// File is a read-only memory-mapped file.
+type File struct {
+	data []byte
+}
+
+// Open maps the whole file into memory.
+func Open(filename string) (*File, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		// Empty files can not be mapped.
+		return &File{}, nil
+	}
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("file %s is too large to map: %d bytes", filename, size)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map file %s: %v", filename, err)
+	}
+	return &File{data: data}, nil
+}
+
+// Len returns the size of the file.
+func (f *File) Len() int {
+	return len(f.data)
+}
+
+// Close unmaps the file. The slices from the file must not be used afterwards.
+func (f *File) Close() error {
+	if f.data == nil {
+		return nil
+	}
+	data := f.data
+	f.data = nil
+	return syscall.Munmap(data)
+}
+
+// ForEachLine calls fn for each nonempty line in the file, without the line terminator "\n" or "\r\n". The iteration
+// stops at the first error returned by fn.
+func (f *File) ForEachLine(fn func(line []byte) error) error {
+	data := f.data
+	for len(data) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			line, data = data, nil
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) == 0 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mmapfile
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func readLines(t *testing.T, content string) []string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "reports")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if got, want := f.Len(), len(content); got != want {
+		t.Errorf("expect file length %d, got %d", want, got)
+	}
+	var lines []string
+	if err := f.ForEachLine(func(line []byte) error {
+		lines = append(lines, string(line))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestForEachLine(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		want    []string
+	}{
+		{"", nil},
+		{"a\nbb\nccc\n", []string{"a", "bb", "ccc"}},
+		{"a\r\n\nbb", []string{"a", "bb"}},
+	} {
+		if diff := cmp.Diff(tc.want, readLines(t, tc.content)); diff != "" {
+			t.Errorf("lines mismatch for %q (-want +got):\n%s", tc.content, diff)
+		}
+	}
+}
+
+func TestForEachLineStopsAtError(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "reports")
+	if err := ioutil.WriteFile(filename, []byte("a\nb\nc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	errStop := errors.New("stop")
+	count := 0
+	err = f.ForEachLine(func(line []byte) error {
+		count++
+		if string(line) == "b" {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) || count != 2 {
+		t.Errorf("expect iteration to stop at the second line with the error, got count %d and error %v", count, err)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reporttrace records how a small sample of reports is handled by the aggregation pipelines, to diagnose
+// reports missing from the results without logging every report.
+//
+// The reports are sampled by a stable hash of their IDs with a seed derived from the query ID, so both helpers and all
+// the levels of a hierarchical query trace the same reports. For each sampled report, a pipeline writes one Record per
+// stage to the private trace file of the helper: which key decrypted the report, and at each level the number of
+// buckets it was expanded into and the sum of its shares over them. The share sums of one helper reveal nothing, but
+// the sums from the two helpers add up to the value that the report contributed within the queried prefixes, so a zero
+// value shows that the report was pruned or fell outside the buckets at that level. Combining the traces therefore
+// reveals the values of the sampled reports, and is only done for investigations.
+package reporttrace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+// MaxSampleRate caps the fraction of traced reports, so a trace stays a small sample of the batch.
+const MaxSampleRate = 0.01
+
+// Stages of the pipelines recorded in the traces.
+const (
+	StageDecrypt = "decrypt"
+	StageExpand  = "expand"
+)
+
+// Record is the handling of a sampled report in one stage.
+type Record struct {
+	ReportID string
+	Stage    string
+	// ID of the key that decrypted the report, which is empty for unencrypted reports.
+	KeyID string `json:",omitempty"`
+	// Whether the report was decrypted with a fallback key instead of the key with its key ID.
+	Fallback bool `json:",omitempty"`
+	// Error of the stage, after which the report is not traced any further.
+	Error string `json:",omitempty"`
+	// Hierarchy level of the expansion.
+	Level int32 `json:",omitempty"`
+	// Number of buckets the report is expanded into, and the sum of the helper's shares over them.
+	Buckets  int64  `json:",omitempty"`
+	ShareSum uint64 `json:",omitempty"`
+}
+
+// CheckSampleRate checks the fraction of traced reports is in (0, MaxSampleRate].
+func CheckSampleRate(rate float64) error {
+	if rate <= 0 || rate > MaxSampleRate {
+		return fmt.Errorf("expect trace sample rate in (0, %v], got %v", MaxSampleRate, rate)
+	}
+	return nil
+}
+
+// Format formats the record as a line of the trace file.
+func Format(record *Record) (string, error) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Parse parses a line of the trace file.
+func Parse(line string) (*Record, error) {
+	record := &Record{}
+	if err := json.Unmarshal([]byte(line), record); err != nil {
+		return nil, fmt.Errorf("invalid trace record %q: %v", line, err)
+	}
+	return record, nil
+}
+
+// ReadRecords reads the records from a trace file.
+func ReadRecords(ctx context.Context, uri string) ([]*Record, error) {
+	lines, err := utils.ReadLines(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		record, err := Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Contribution is the value a sampled report contributed at a level, recombined from the traces of both helpers.
+type Contribution struct {
+	ReportID string
+	Level    int32
+	Buckets  int64
+	// Sum of the report's values in the expanded buckets. The shares are additive modulo 2^64.
+	Value uint64
+	// Whether only one of the helpers traced the report at the level, in which case Value is a single share and
+	// meaningless.
+	Missing bool
+}
+
+type contributionKey struct {
+	reportID string
+	level    int32
+}
+
+// Combine recombines the expansion records of the two helpers, sorted by report ID and level.
+func Combine(own, partner []*Record) []*Contribution {
+	contributions := make(map[contributionKey]*Contribution)
+	seen := make(map[contributionKey]int)
+	for i, records := range [][]*Record{own, partner} {
+		for _, r := range records {
+			if r.Stage != StageExpand || r.Error != "" {
+				continue
+			}
+			key := contributionKey{reportID: r.ReportID, level: r.Level}
+			c, ok := contributions[key]
+			if !ok {
+				c = &Contribution{ReportID: r.ReportID, Level: r.Level, Buckets: r.Buckets}
+				contributions[key] = c
+			}
+			c.Value += r.ShareSum
+			seen[key] |= 1 << i
+		}
+	}
+
+	result := make([]*Contribution, 0, len(contributions))
+	for key, c := range contributions {
+		c.Missing = seen[key] != 3
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ReportID != result[j].ReportID {
+			return result[i].ReportID < result[j].ReportID
+		}
+		return result[i].Level < result[j].Level
+	})
+	return result
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reporttrace
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadRecords(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("/tmp", "test-report-trace")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	want := []*Record{
+		{ReportID: "report1", Stage: StageDecrypt, KeyID: "key1", Fallback: true},
+		{ReportID: "report1", Stage: StageExpand, Level: 2, Buckets: 8, ShareSum: 1 << 63},
+		{ReportID: "report2", Stage: StageDecrypt, Error: "failed to decrypt"},
+	}
+	var lines []string
+	for _, r := range want {
+		line, err := Format(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	uri := path.Join(tmpDir, "trace")
+	if err := ioutil.WriteFile(uri, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadRecords(context.Background(), uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("records mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := Parse("report1,decrypt"); err == nil {
+		t.Error("expect error for an invalid record")
+	}
+}
+
+func TestCombine(t *testing.T) {
+	own := []*Record{
+		{ReportID: "report2", Stage: StageExpand, Level: 0, Buckets: 2, ShareSum: 10},
+		{ReportID: "report1", Stage: StageDecrypt, KeyID: "key1"},
+		{ReportID: "report1", Stage: StageExpand, Level: 1, Buckets: 4, ShareSum: 1<<64 - 3},
+		{ReportID: "report1", Stage: StageExpand, Level: 0, Buckets: 2, ShareSum: 7},
+		{ReportID: "report3", Stage: StageExpand, Level: 0, Buckets: 2, ShareSum: 1},
+	}
+	partner := []*Record{
+		{ReportID: "report1", Stage: StageExpand, Level: 0, Buckets: 2, ShareSum: 1<<64 - 2},
+		{ReportID: "report1", Stage: StageExpand, Level: 1, Buckets: 4, ShareSum: 3},
+		{ReportID: "report2", Stage: StageExpand, Level: 0, Buckets: 2, ShareSum: 1<<64 - 10},
+		{ReportID: "report3", Stage: StageDecrypt, Error: "failed to decrypt"},
+	}
+	want := []*Contribution{
+		{ReportID: "report1", Level: 0, Buckets: 2, Value: 5},
+		// The report was pruned before level 1.
+		{ReportID: "report1", Level: 1, Buckets: 4, Value: 0},
+		{ReportID: "report2", Level: 0, Buckets: 2, Value: 0},
+		{ReportID: "report3", Level: 0, Buckets: 2, Value: 1, Missing: true},
+	}
+	if diff := cmp.Diff(want, Combine(own, partner)); diff != "" {
+		t.Errorf("contributions mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckSampleRate(t *testing.T) {
+	if err := CheckSampleRate(MaxSampleRate); err != nil {
+		t.Errorf("expect the max sample rate to be valid, got %v", err)
+	}
+	for _, rate := range []float64{0, -0.1, MaxSampleRate * 2} {
+		if err := CheckSampleRate(rate); err == nil {
+			t.Errorf("expect error for sample rate %v", rate)
+		}
+	}
+}
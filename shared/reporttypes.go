@@ -18,8 +18,10 @@ package reporttypes
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
@@ -39,6 +41,8 @@ type PublicKeyInfo struct {
 	ID string `json:"id"`
 	// Base64 encoded public key bytes.
 	Key string `json:"key"`
+	// Time after which the key should no longer be used for encryption. The key does not expire if nil.
+	ExpireTime *time.Time `json:"expire_time,omitempty"`
 }
 
 // PublicKeys contains a set of public keys and their IDs.
@@ -84,6 +88,16 @@ type SharedInfo struct {
 	DebugMode              bool   `json:"debug_mode"`
 }
 
+// GetReportID gets the report ID from the shared info of a payload. Both helpers receive the same shared info for a
+// report, so the shared info itself identifies the report if it has no ID.
+func GetReportID(sharedInfo string) string {
+	info := &SharedInfo{}
+	if err := json.Unmarshal([]byte(sharedInfo), info); err == nil && info.ReportID != "" {
+		return info.ReportID
+	}
+	return sharedInfo
+}
+
 // Contribution contains a single histogram contribution.
 type Contribution struct {
 	Bucket []byte `json:"bucket"`
@@ -204,3 +218,19 @@ func DeserializeAggregatablePayload(line string) (*pb.AggregatablePayload, error
 	}
 	return payload, nil
 }
+
+// DeserializeAggregatablePayloadBytes deserializes the AggregatablePayload from a line in bytes, e.g. a slice of a
+// memory-mapped file, without converting it into a string first.
+func DeserializeAggregatablePayloadBytes(line []byte) (*pb.AggregatablePayload, error) {
+	bsc := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(bsc, line)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &pb.AggregatablePayload{}
+	if err := proto.Unmarshal(bsc[:n], payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -44,4 +44,21 @@ func TestSerializeAggregatablePayload(t *testing.T) {
 	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
 		t.Errorf("deserialized report mismatch (-want +got):\n%s", diff)
 	}
+
+	gotFromBytes, err := DeserializeAggregatablePayloadBytes([]byte(serialized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, gotFromBytes, protocmp.Transform()); diff != "" {
+		t.Errorf("report deserialized from bytes mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestGetReportID(t *testing.T) {
+	if got, want := GetReportID(`{"report_id":"abc","version":"0.1"}`), "abc"; got != want {
+		t.Errorf("expect report ID %q, got %q", want, got)
+	}
+	if got, want := GetReportID("context"), "context"; got != want {
+		t.Errorf("expect the shared info %q as the ID, got %q", want, got)
+	}
 }
@@ -0,0 +1,53 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signingkey
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	seed := bytes.Repeat([]byte{1}, ed25519.SeedSize)
+	privateKey, err := ParsePrivateKey(base64.StdEncoding.EncodeToString(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privateKey.Equal(ed25519.NewKeyFromSeed(seed)) {
+		t.Error("private key mismatch")
+	}
+	want := privateKey.Public().(ed25519.PublicKey)
+	publicKey, err := ParsePublicKey(base64.StdEncoding.EncodeToString(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !publicKey.Equal(want) {
+		t.Error("public key mismatch")
+	}
+
+	for desc, encoded := range map[string]string{
+		"invalid base64": "not base64!",
+		"wrong size":     base64.StdEncoding.EncodeToString([]byte("short")),
+	} {
+		if _, err := ParsePrivateKey(encoded); err == nil {
+			t.Errorf("%s: expect error for the private key", desc)
+		}
+		if _, err := ParsePublicKey(encoded); err == nil {
+			t.Errorf("%s: expect error for the public key", desc)
+		}
+	}
+}
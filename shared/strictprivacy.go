@@ -0,0 +1,57 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package strictprivacy prevents accidental releases of aggregation results without proper noise.
+//
+// The aggregation pipelines skip the noise when epsilon is not positive, and the noise becomes reproducible when it is
+// seeded. Both are useful for debugging, but must not happen for production batches. In strict mode, function Check()
+// rejects such aggregations unless the batch is explicitly flagged as a debug batch.
+package strictprivacy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Params contains the privacy settings of an aggregation to be checked.
+type Params struct {
+	// Privacy budget of the aggregation; zero or negative means no noise is added.
+	Epsilon float64
+	// Seed of the noise; zero means the noise is not seeded.
+	NoiseSeed uint64
+	// Whether the aggregation never adds noise, e.g. the reach aggregation.
+	Noiseless bool
+	// Whether the batch is flagged as a debug batch.
+	Debug bool
+}
+
+// ErrNotDebugBatch is wrapped by the errors for the aggregations rejected in strict mode.
+var ErrNotDebugBatch = errors.New("only allowed for debug batches in strict privacy mode")
+
+// Check returns an error if strict mode is enabled and the aggregation would release results without proper noise for
+// a batch that is not flagged as debug.
+func Check(strict bool, params *Params) error {
+	if !strict || params.Debug {
+		return nil
+	}
+	switch {
+	case params.Noiseless:
+		return fmt.Errorf("aggregation without noise is %w", ErrNotDebugBatch)
+	case params.Epsilon <= 0:
+		return fmt.Errorf("epsilon %v means no noise, which is %w", params.Epsilon, ErrNotDebugBatch)
+	case params.NoiseSeed != 0:
+		return fmt.Errorf("seeded noise is %w", ErrNotDebugBatch)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package strictprivacy
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		strict  bool
+		params  Params
+		wantErr bool
+	}{
+		{"non-strict noiseless", false, Params{Epsilon: 0}, false},
+		{"strict with noise", true, Params{Epsilon: 1}, false},
+		{"strict zero epsilon", true, Params{Epsilon: 0}, true},
+		{"strict negative epsilon", true, Params{Epsilon: -1}, true},
+		{"strict seeded noise", true, Params{Epsilon: 1, NoiseSeed: 7}, true},
+		{"strict noiseless aggregation", true, Params{Epsilon: 1, Noiseless: true}, true},
+		{"strict zero epsilon debug batch", true, Params{Epsilon: 0, Debug: true}, false},
+		{"strict seeded noise debug batch", true, Params{Epsilon: 1, NoiseSeed: 7, Debug: true}, false},
+	} {
+		err := Check(tc.strict, &tc.params)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%s: expect error %t, got %v", tc.desc, tc.wantErr, err)
+		}
+		if err != nil && !errors.Is(err, ErrNotDebugBatch) {
+			t.Errorf("%s: expect error wrapping ErrNotDebugBatch, got %v", tc.desc, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package subcommand contains functions for the command line tools that group several operations as subcommands.
+//
+// A subcommand either runs in the same process, or executes one of the single-purpose binaries, which are found in
+// the binary directory. The arguments of all the subcommands can be loaded from flag files with "--flagfile=<uri>",
+// where each line of the file is one flag, and lines starting with "#" are comments.
+package subcommand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/golang/glog"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+const flagFilePrefix = "--flagfile="
+
+// ErrUnknownCommand is returned when the subcommand is not registered.
+var ErrUnknownCommand = errors.New("unknown subcommand")
+
+// Command is a subcommand of a command line tool.
+type Command struct {
+	Name        string
+	Description string
+	// Binary executed for the subcommand with the expanded arguments. Ignored if Run is set.
+	Binary string
+	// Run executes the subcommand in the same process.
+	Run func(ctx context.Context, args []string) error
+}
+
+// ExpandFlagFiles replaces each "--flagfile=<uri>" in the arguments with the flags in the file. Flags set directly on
+// the command line after the flag file override the values in the file, as the last value of a flag wins.
+func ExpandFlagFiles(ctx context.Context, args []string) ([]string, error) {
+	var expanded []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, flagFilePrefix) {
+			expanded = append(expanded, arg)
+			continue
+		}
+		lines, err := utils.ReadLines(ctx, strings.TrimPrefix(arg, flagFilePrefix))
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if strings.HasPrefix(line, flagFilePrefix) {
+				return nil, fmt.Errorf("nested flag file is not supported: %q", line)
+			}
+			expanded = append(expanded, line)
+		}
+	}
+	return expanded, nil
+}
+
+// FindBinary returns the path of a binary in the binary directory, or in $PATH if binaryDir is empty.
+func FindBinary(binaryDir, name string) (string, error) {
+	if binaryDir == "" {
+		return exec.LookPath(name)
+	}
+	p := filepath.Join(binaryDir, name)
+	if _, err := os.Stat(p); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// ExecutableDir returns the directory of the running binary, where the single-purpose binaries are installed next to
+// it in the container images.
+func ExecutableDir() string {
+	p, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	return filepath.Dir(p)
+}
+
+// Usage writes the list of subcommands.
+func Usage(w io.Writer, tool string, commands []*Command) {
+	fmt.Fprintf(w, "Usage: %s <subcommand> [--flagfile=<uri>] [flags...]\n\nSubcommands:\n", tool)
+	sorted := append([]*Command(nil), commands...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range sorted {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.Name, c.Description)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun \"%s <subcommand> --help\" for the flags of a subcommand.\n", tool)
+}
+
+func find(commands []*Command, name string) *Command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Dispatch runs the subcommand named by the first argument with the rest of the arguments. When the binary of the
+// subcommand fails, the returned *exec.ExitError carries its exit code, which is passed on with ExitCode.
+func Dispatch(ctx context.Context, commands []*Command, binaryDir string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: none given", ErrUnknownCommand)
+	}
+	c := find(commands, args[0])
+	if c == nil {
+		return fmt.Errorf("%w: %q", ErrUnknownCommand, args[0])
+	}
+	expanded, err := ExpandFlagFiles(ctx, args[1:])
+	if err != nil {
+		return err
+	}
+	if c.Run != nil {
+		return c.Run(ctx, expanded)
+	}
+
+	binary, err := FindBinary(binaryDir, c.Binary)
+	if err != nil {
+		return fmt.Errorf("binary for subcommand %q not found: %v", c.Name, err)
+	}
+	log.Infof("running %s %s", binary, strings.Join(expanded, " "))
+	cmd := exec.CommandContext(ctx, binary, expanded...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// ExitCode returns the exit code of the binary that failed a subcommand, so the tool exits with the failure class of the
+// pipeline binaries, or 1 for the other errors.
+func ExitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+	return 1
+}
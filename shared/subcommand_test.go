@@ -0,0 +1,96 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subcommand
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExpandFlagFiles(t *testing.T) {
+	dir := t.TempDir()
+	flagFile := filepath.Join(dir, "common.flags")
+	content := "# shared settings\n--origin=helper1\n\n  --epsilon=1  \n"
+	if err := ioutil.WriteFile(flagFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ExpandFlagFiles(context.Background(), []string{"--flagfile=" + flagFile, "--epsilon=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"--origin=helper1", "--epsilon=1", "--epsilon=2"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("expanded args mismatch (-want +got):\n%s", diff)
+	}
+
+	nested := filepath.Join(dir, "nested.flags")
+	if err := ioutil.WriteFile(nested, []byte("--flagfile="+flagFile+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExpandFlagFiles(context.Background(), []string{"--flagfile=" + nested}); err == nil {
+		t.Error("expect error for nested flag files")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	var gotArgs []string
+	commands := []*Command{
+		{Name: "inspect", Description: "Print a file.", Run: func(ctx context.Context, args []string) error {
+			gotArgs = args
+			return nil
+		}},
+		{Name: "merge", Description: "Merge partial histograms.", Binary: "nonexistent_binary"},
+	}
+	ctx := context.Background()
+
+	if err := Dispatch(ctx, commands, "", []string{"inspect", "--uri=/tmp/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"--uri=/tmp/a"}, gotArgs); diff != "" {
+		t.Errorf("subcommand args mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := Dispatch(ctx, commands, "", []string{"unknown"}); !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("expect ErrUnknownCommand, got %v", err)
+	}
+	if err := Dispatch(ctx, commands, t.TempDir(), []string{"merge"}); err == nil {
+		t.Error("expect error for missing binary")
+	} else if code := ExitCode(err); code != 1 {
+		t.Errorf("expect exit code 1 for missing binary, got %d", code)
+	}
+
+	// The exit code of a failed binary is passed on.
+	binaryDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(binaryDir, "nonexistent_binary"), []byte("#!/bin/sh\nexit 12\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if code := ExitCode(Dispatch(ctx, commands, binaryDir, []string{"merge"})); code != 12 {
+		t.Errorf("expect exit code 12 of the binary, got %d", code)
+	}
+
+	var usage bytes.Buffer
+	Usage(&usage, "aggsvc", commands)
+	if !strings.Contains(usage.String(), "inspect") || !strings.Contains(usage.String(), "Merge partial histograms.") {
+		t.Errorf("usage does not list the subcommands:\n%s", usage.String())
+	}
+}
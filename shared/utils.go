@@ -255,6 +255,16 @@ func JoinPath(directory, filename string) string {
 	return path.Join(directory, filename)
 }
 
+// DirPath returns the directory of a file, or "." if the path has no directory. Function path.Dir does not work for GCS
+// files, as it cleans "gs://foo/bar" into "gs:/foo".
+func DirPath(filename string) string {
+	i := strings.LastIndex(filename, "/")
+	if i < 0 {
+		return "."
+	}
+	return filename[:i]
+}
+
 // SaveSecret saves the input payload with Google Cloud Secret Manager.
 func SaveSecret(ctx context.Context, payload []byte, projectID, secretID string) (string, error) {
 	client, err := secretmanager.NewClient(ctx)
@@ -468,3 +478,29 @@ func IsFileGlobExist(ctx context.Context, glob string) (bool, error) {
 	}
 	return len(files) > 0, nil
 }
+
+// FileVersion returns a string that changes whenever the content of a local or GCS file changes: the generation of a
+// GCS object, or the modification time and size of a local file.
+func FileVersion(ctx context.Context, filename string) (string, error) {
+	if strings.HasPrefix(filename, "gs://") {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer client.Close()
+		bucket, object, err := ParseGCSPath(filename)
+		if err != nil {
+			return "", err
+		}
+		attrs, err := client.Bucket(bucket).Object(object).Attrs(ctx)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprint(attrs.Generation), nil
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), nil
+}
@@ -111,6 +111,21 @@ func TestJoinPath(t *testing.T) {
 	}
 }
 
+func TestDirPath(t *testing.T) {
+	for _, tc := range []struct {
+		filename, want string
+	}{
+		{"gs://foo/bar/baz", "gs://foo/bar"},
+		{"gs://foo/bar", "gs://foo"},
+		{"/foo/bar", "/foo"},
+		{"bar", "."},
+	} {
+		if got := DirPath(tc.filename); got != tc.want {
+			t.Errorf("expect directory %s of %s, got %s", tc.want, tc.filename, got)
+		}
+	}
+}
+
 func TestStringToUint128(t *testing.T) {
 	want := "147573952589676412928" // 2^67
 	n, err := StringToUint128(want)
@@ -242,3 +257,39 @@ func TestIntegerToByteString(t *testing.T) {
 		t.Errorf("uint32 conversion failed: want %d, got %d", want32, got32)
 	}
 }
+
+func TestFileVersion(t *testing.T) {
+	fileDir, err := ioutil.TempDir("/tmp", "test-file-version")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(fileDir)
+
+	ctx := context.Background()
+	filename := path.Join(fileDir, "config.json")
+	if err := WriteBytes(ctx, []byte("{}"), filename, nil); err != nil {
+		t.Fatal(err)
+	}
+	v1, err := FileVersion(ctx, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := FileVersion(ctx, filename); err != nil {
+		t.Fatal(err)
+	} else if v != v1 {
+		t.Errorf("expect the same version %q for an unchanged file, got %q", v1, v)
+	}
+
+	if err := WriteBytes(ctx, []byte(`{"a":1}`), filename, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := FileVersion(ctx, filename); err != nil {
+		t.Fatal(err)
+	} else if v == v1 {
+		t.Errorf("expect a new version after the file changed, got %q", v)
+	}
+
+	if _, err := FileVersion(ctx, path.Join(fileDir, "missing.json")); err == nil {
+		t.Error("expect error for a missing file")
+	}
+}
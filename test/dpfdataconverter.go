@@ -24,6 +24,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/io/textio"
@@ -104,8 +105,13 @@ func (fn *parseRawConversionFn) ProcessElement(ctx context.Context, line string,
 
 type encryptSecretSharesFn struct {
 	PublicKeys1, PublicKeys2 *reporttypes.PublicKeys
-	KeyBitSize               int
-	EncryptOutput            bool
+	// If set, the public keys are read on the workers through a process-wide cache, instead of being fixed when the
+	// pipeline is constructed.
+	PublicKeysURI1, PublicKeysURI2 string
+	PublicKeyCacheTTL              time.Duration
+	KeyBitSize                     int
+	HierarchyGranularity           int
+	EncryptOutput                  bool
 
 	countReport beam.Counter
 }
@@ -149,6 +155,23 @@ func (fn *encryptSecretSharesFn) Setup(ctx context.Context) {
 	fn.countReport = beam.NewCounter("aggregation", "encryptSecretSharesFn_report_count")
 }
 
+// StartBundle gets the current public keys from the cache, so keys rotated during a long job are picked up without
+// reading the key files for every bundle.
+func (fn *encryptSecretSharesFn) StartBundle(ctx context.Context, emit1 func(*pb.AggregatablePayload), emit2 func(*pb.AggregatablePayload)) error {
+	var err error
+	if fn.PublicKeysURI1 != "" {
+		if fn.PublicKeys1, err = cryptoio.SharedPublicKeyCache(fn.PublicKeyCacheTTL).Get(ctx, fn.PublicKeysURI1); err != nil {
+			return err
+		}
+	}
+	if fn.PublicKeysURI2 != "" {
+		if fn.PublicKeys2, err = cryptoio.SharedPublicKeyCache(fn.PublicKeyCacheTTL).Get(ctx, fn.PublicKeysURI2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // putValueForHierarchies determines which value to use when the keys are expanded for different hierarchies.
 //
 // For now, the values are the same for all the levels.
@@ -161,8 +184,18 @@ func putValueForHierarchies(params []*dpfpb.DpfParameters, value uint64) []uint6
 }
 
 // GenerateDPFKeys generates DPF keys for the input report.
-func GenerateDPFKeys(report pipelinetypes.RawReport, keyBitSize int) (*dpfpb.DpfKey, *dpfpb.DpfKey, error) {
-	allParams, err := incrementaldpf.GetDefaultDPFParameters(keyBitSize)
+//
+// The keys have a hierarchy at every hierarchyGranularity bits of the prefix length; zero or one means every prefix length.
+func GenerateDPFKeys(report pipelinetypes.RawReport, keyBitSize, hierarchyGranularity int) (*dpfpb.DpfKey, *dpfpb.DpfKey, error) {
+	var (
+		allParams []*dpfpb.DpfParameters
+		err       error
+	)
+	if hierarchyGranularity <= 1 {
+		allParams, err = incrementaldpf.GetDefaultDPFParameters(keyBitSize)
+	} else {
+		allParams, err = incrementaldpf.GetDPFParametersWithGranularity(keyBitSize, hierarchyGranularity)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -193,7 +226,7 @@ func EncryptPartialReports(key1, key2 *dpfpb.DpfKey, publicKeys1, publicKeys2 *r
 func (fn *encryptSecretSharesFn) ProcessElement(ctx context.Context, c pipelinetypes.RawReport, emit1 func(*pb.AggregatablePayload), emit2 func(*pb.AggregatablePayload)) error {
 	fn.countReport.Inc(ctx, 1)
 
-	key1, key2, err := GenerateDPFKeys(c, fn.KeyBitSize)
+	key1, key2, err := GenerateDPFKeys(c, fn.KeyBitSize, fn.HierarchyGranularity)
 	if err != nil {
 		return err
 	}
@@ -230,10 +263,14 @@ func splitRawConversion(s beam.Scope, reports beam.PCollection, params *Generate
 
 	return beam.ParDo2(s,
 		&encryptSecretSharesFn{
-			PublicKeys1:   params.PublicKeys1,
-			PublicKeys2:   params.PublicKeys2,
-			KeyBitSize:    params.KeyBitSize,
-			EncryptOutput: params.EncryptOutput,
+			PublicKeys1:          params.PublicKeys1,
+			PublicKeys2:          params.PublicKeys2,
+			PublicKeysURI1:       params.PublicKeysURI1,
+			PublicKeysURI2:       params.PublicKeysURI2,
+			PublicKeyCacheTTL:    params.PublicKeyCacheTTL,
+			KeyBitSize:           params.KeyBitSize,
+			HierarchyGranularity: params.HierarchyGranularity,
+			EncryptOutput:        params.EncryptOutput,
 		}, reports)
 }
 
@@ -241,8 +278,14 @@ func splitRawConversion(s beam.Scope, reports beam.PCollection, params *Generate
 type GeneratePartialReportParams struct {
 	ConversionURI, PartialReportURI1, PartialReportURI2 string
 	PublicKeys1, PublicKeys2                            *reporttypes.PublicKeys
-	KeyBitSize                                          int
-	Shards                                              int64
+	// Files of the public keys, which are read by the workers through a cache with PublicKeyCacheTTL instead of using
+	// PublicKeys1 and PublicKeys2 if set.
+	PublicKeysURI1, PublicKeysURI2 string
+	PublicKeyCacheTTL              time.Duration
+	KeyBitSize                     int
+	// Number of bits between two adjacent hierarchies in the DPF keys. Zero or one means every prefix length.
+	HierarchyGranularity int
+	Shards               int64
 
 	// EncryptOutput should only be used for integration test before HPKE is ready in Go Tink.
 	EncryptOutput bool
@@ -416,6 +459,7 @@ func ReadRawConversions(ctx context.Context, conversionFile string, keyBitSize i
 type GenerateBrowserReportParams struct {
 	RawReport                pipelinetypes.RawReport
 	KeyBitSize               int
+	HierarchyGranularity     int
 	PublicKeys1, PublicKeys2 *reporttypes.PublicKeys
 	SharedInfo               string
 	EncryptOutput            bool
@@ -423,7 +467,7 @@ type GenerateBrowserReportParams struct {
 
 // GenerateBrowserReport creates an aggregation report from the browser.
 func GenerateBrowserReport(params *GenerateBrowserReportParams) (*reporttypes.AggregatableReport, error) {
-	key1, key2, err := GenerateDPFKeys(params.RawReport, params.KeyBitSize)
+	key1, key2, err := GenerateDPFKeys(params.RawReport, params.KeyBitSize, params.HierarchyGranularity)
 	if err != nil {
 		return nil, err
 	}
@@ -33,6 +33,7 @@ import (
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelinetypes"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+	"github.com/google/privacy-sandbox-aggregation-service/test/pipelinetestutil"
 
 	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/local"
 
@@ -138,17 +139,17 @@ func createConversionsDpf(logN, logElementSizeSum, totalCount uint64) (*dpfTestD
 }
 
 func TestAggregationPipelineDPF(t *testing.T) {
-	testAggregationPipelineDPF(t, true /*withEncryption*/)
-	testAggregationPipelineDPF(t, false /*withEncryption*/)
+	testAggregationPipelineDPF(t, true /*withEncryption*/, 1 /*hierarchyGranularity*/)
+	testAggregationPipelineDPF(t, false /*withEncryption*/, 1 /*hierarchyGranularity*/)
 }
 
-func testAggregationPipelineDPF(t testing.TB, withEncryption bool) {
-	ctx := context.Background()
-	privKeys1, pubKeysInfo1, err := cryptoio.GenerateHybridKeyPairs(ctx, 10)
-	if err != nil {
-		t.Fatal(err)
-	}
-	privKeys2, pubKeysInfo2, err := cryptoio.GenerateHybridKeyPairs(ctx, 10)
+func TestAggregationPipelineDPFWithGranularity(t *testing.T) {
+	// The prefix lengths in the test data are multiples of 4.
+	testAggregationPipelineDPF(t, false /*withEncryption*/, 4 /*hierarchyGranularity*/)
+}
+
+func testAggregationPipelineDPF(t testing.TB, withEncryption bool, hierarchyGranularity int32) {
+	helpers, err := pipelinetestutil.NewFakeHelpers(context.Background(), 10, "" /*sharedDir*/)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -159,10 +160,6 @@ func testAggregationPipelineDPF(t testing.TB, withEncryption bool) {
 		t.Fatal(err)
 	}
 
-	ctxParams, err := incrementaldpf.GetDefaultDPFParameters(keyBitSize)
-	if err != nil {
-		t.Fatal(err)
-	}
 	combineParams := &dpfaggregator.CombineParams{
 		DirectCombine: true,
 	}
@@ -171,40 +168,32 @@ func testAggregationPipelineDPF(t testing.TB, withEncryption bool) {
 	conversions := beam.CreateList(scope, testData.Conversions)
 
 	ePr1, ePr2 := splitRawConversion(scope, conversions, &GeneratePartialReportParams{
-		PublicKeys1:   pubKeysInfo1,
-		PublicKeys2:   pubKeysInfo2,
-		KeyBitSize:    keyBitSize,
-		EncryptOutput: withEncryption,
+		PublicKeys1:          helpers.Keys1.PublicKeys,
+		PublicKeys2:          helpers.Keys2.PublicKeys,
+		KeyBitSize:           keyBitSize,
+		HierarchyGranularity: int(hierarchyGranularity),
+		EncryptOutput:        withEncryption,
 	})
 
-	pr1 := dpfaggregator.DecryptPartialReport(scope, ePr1, privKeys1)
-	pr2 := dpfaggregator.DecryptPartialReport(scope, ePr2, privKeys2)
+	pr1, pr2 := helpers.DecryptPartialReports(scope, ePr1, ePr2)
 
 	previousLevel := int32(-1)
 	for i := range testData.Prefixes {
-		want := beam.CreateList(scope, testData.WantResults[i])
-
+		level := testData.SumParams.Params[i].LogDomainSize/hierarchyGranularity - 1
 		expandParams := &dpfaggregator.ExpandParameters{
-			Prefixes:        testData.Prefixes[i],
-			Level:           testData.SumParams.Params[i].LogDomainSize - 1,
-			PreviousLevel:   previousLevel,
-			DirectExpansion: false,
-		}
-		ctx1 := dpfaggregator.CreateEvaluationContext(scope, pr1, expandParams, keyBitSize)
-		ctx2 := dpfaggregator.CreateEvaluationContext(scope, pr2, expandParams, keyBitSize)
-
-		ph1, err := dpfaggregator.ExpandAndCombineHistogram(scope, ctx1, expandParams, ctxParams, combineParams, keyBitSize)
-		if err != nil {
-			t.Fatal(err)
+			Prefixes:             testData.Prefixes[i],
+			Level:                level,
+			PreviousLevel:        previousLevel,
+			DirectExpansion:      false,
+			HierarchyGranularity: hierarchyGranularity,
 		}
-		ph2, err := dpfaggregator.ExpandAndCombineHistogram(scope, ctx2, expandParams, ctxParams, combineParams, keyBitSize)
+		got, err := pipelinetestutil.ExpandAndMerge(scope, pr1, pr2, expandParams, combineParams, keyBitSize)
 		if err != nil {
 			t.Fatal(err)
 		}
-		got := dpfaggregator.MergeHistogram(scope, ph1, ph2)
-		passert.Equals(scope, got, want)
+		pipelinetestutil.VerifyHistogram(scope, got, testData.WantResults[i])
 
-		previousLevel = testData.SumParams.Params[i].LogDomainSize - 1
+		previousLevel = level
 	}
 
 	if err := ptest.Run(pipeline); err != nil {
@@ -214,7 +203,7 @@ func testAggregationPipelineDPF(t testing.TB, withEncryption bool) {
 
 func BenchmarkPipeline(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		testAggregationPipelineDPF(b, true /*withEncryption*/)
+		testAggregationPipelineDPF(b, true /*withEncryption*/, 1 /*hierarchyGranularity*/)
 	}
 }
 
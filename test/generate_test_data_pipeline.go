@@ -45,12 +45,19 @@ package main
 import (
 	"context"
 	"flag"
+	"strings"
+	"time"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/log"
 	"github.com/apache/beam/sdks/go/pkg/beam/x/beamx"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelineutils"
+	"github.com/google/privacy-sandbox-aggregation-service/service/batchintegrity"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
 	"github.com/google/privacy-sandbox-aggregation-service/test/dpfdataconverter"
 	"github.com/google/privacy-sandbox-aggregation-service/test/onepartydataconverter"
 )
@@ -64,6 +71,16 @@ var (
 	publicKeysURI2 = flag.String("public_keys_uri2", "", "Input file containing the public keys from helper 2.")
 	keyBitSize     = flag.Int("key_bit_size", 32, "Bit size of the conversion keys.")
 
+	batchMetadataURI1 = flag.String("batch_metadata_uri1", "", "Output metadata of the reports for helper 1 with the key bit size, which is not written if empty.")
+	batchMetadataURI2 = flag.String("batch_metadata_uri2", "", "Output metadata of the reports for helper 2 with the key bit size, which is not written if empty.")
+
+	debugBatch         = flag.Bool("debug_batch", false, "Flag the batch as a debug batch in the metadata. The helpers only trust the flag if the metadata is signed with --batch_signing_key_uri.")
+	batchSigningKeyURI = flag.String("batch_signing_key_uri", "", "File of the base64-encoded Ed25519 seed that signs the batch metadata. The metadata is unsigned if empty.")
+
+	publicKeyCacheTTL = flag.Duration("public_key_cache_ttl", 0, "If positive, the workers read the public keys through a cache with this TTL and pick up rotated keys during the job; otherwise the keys are read once at launch.")
+
+	hierarchyGranularity = flag.Int("hierarchy_granularity", 1, "Number of bits between two adjacent hierarchies in the DPF keys. The prefix lengths in the expansion config should be multiples of it.")
+
 	encryptOutput = flag.Bool("encrypt_output", true, "Generate reports with encryption. This should only be false for integration test before HPKE is ready in Go Tink.")
 
 	fileShards = flag.Int64("file_shards", 1, "The number of shards for the output file.")
@@ -79,6 +96,12 @@ func main() {
 		helperPubKeys1, helperPubKeys2 *reporttypes.PublicKeys
 		err                            error
 	)
+	// The keys are read at launch anyway, so a missing or malformed key file fails fast.
+	var cachedKeysURI1, cachedKeysURI2 string
+	var cacheTTL time.Duration
+	if *publicKeyCacheTTL > 0 {
+		cachedKeysURI1, cachedKeysURI2, cacheTTL = *publicKeysURI1, *publicKeysURI2, *publicKeyCacheTTL
+	}
 	helperPubKeys1, err = cryptoio.ReadPublicKeys(ctx, *publicKeysURI1)
 	if err != nil {
 		log.Exit(ctx, err)
@@ -97,14 +120,18 @@ func main() {
 	if *publicKeysURI2 != "" {
 		log.Infof(ctx, "encrypting the reports for MPC protocol")
 		dpfdataconverter.GeneratePartialReport(scope, &dpfdataconverter.GeneratePartialReportParams{
-			ConversionURI:     *conversionURI,
-			PartialReportURI1: *encryptedReportURI1,
-			PartialReportURI2: *encryptedReportURI2,
-			KeyBitSize:        *keyBitSize,
-			PublicKeys1:       helperPubKeys1,
-			PublicKeys2:       helperPubKeys2,
-			Shards:            *fileShards,
-			EncryptOutput:     *encryptOutput,
+			ConversionURI:        *conversionURI,
+			PartialReportURI1:    *encryptedReportURI1,
+			PartialReportURI2:    *encryptedReportURI2,
+			KeyBitSize:           *keyBitSize,
+			HierarchyGranularity: *hierarchyGranularity,
+			PublicKeys1:          helperPubKeys1,
+			PublicKeys2:          helperPubKeys2,
+			PublicKeysURI1:       cachedKeysURI1,
+			PublicKeysURI2:       cachedKeysURI2,
+			PublicKeyCacheTTL:    cacheTTL,
+			Shards:               *fileShards,
+			EncryptOutput:        *encryptOutput,
 		})
 	} else {
 		log.Infof(ctx, "encrypting the reports for one-party protocol")
@@ -112,6 +139,8 @@ func main() {
 			RawReportURI:       *conversionURI,
 			EncryptedReportURI: *encryptedReportURI1,
 			PublicKeys:         helperPubKeys1,
+			PublicKeysURI:      cachedKeysURI1,
+			PublicKeyCacheTTL:  cacheTTL,
 			Shards:             *fileShards,
 			EncryptOutput:      *encryptOutput,
 		})
@@ -121,4 +150,38 @@ func main() {
 	if err := beamx.Run(ctx, pipeline); err != nil {
 		log.Exitf(ctx, "Failed to execute job: %s", err)
 	}
+
+	// The one-party reports have no DPF keys, so the key bit size only describes the MPC reports.
+	if *publicKeysURI2 != "" {
+		metadata := &dpfaggregator.BatchMetadata{KeyBitSize: int32(*keyBitSize), DebugBatch: *debugBatch}
+		if *debugBatch {
+			// The reports of both helpers have the same IDs, so they have the same root.
+			digest, err := batchintegrity.DigestReports(ctx, pipelineutils.AddStrInPath(*encryptedReportURI1, "*"))
+			if err != nil {
+				log.Exit(ctx, err)
+			}
+			metadata.BatchRoot = digest.Root()
+		}
+		if *batchSigningKeyURI != "" {
+			encoded, err := utils.ReadBytes(ctx, *batchSigningKeyURI)
+			if err != nil {
+				log.Exit(ctx, err)
+			}
+			key, err := resultmanifest.ParsePrivateKey(strings.TrimSpace(string(encoded)))
+			if err != nil {
+				log.Exit(ctx, err)
+			}
+			if err := dpfaggregator.SignBatchMetadata(metadata, key); err != nil {
+				log.Exit(ctx, err)
+			}
+		}
+		for _, uri := range []string{*batchMetadataURI1, *batchMetadataURI2} {
+			if uri == "" {
+				continue
+			}
+			if err := dpfaggregator.WriteBatchMetadata(ctx, metadata, uri); err != nil {
+				log.Exit(ctx, err)
+			}
+		}
+	}
 }
@@ -22,6 +22,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/io/textio"
@@ -118,8 +119,12 @@ func (fn *parseRawReportFn) ProcessElement(ctx context.Context, line string, emi
 }
 
 type encryptReportFn struct {
-	PublicKeys    *reporttypes.PublicKeys
-	EncryptOutput bool
+	PublicKeys *reporttypes.PublicKeys
+	// If set, the public keys are read on the workers through a process-wide cache, instead of being fixed when the
+	// pipeline is constructed.
+	PublicKeysURI     string
+	PublicKeyCacheTTL time.Duration
+	EncryptOutput     bool
 
 	countReport beam.Counter
 }
@@ -128,6 +133,16 @@ func (fn *encryptReportFn) Setup(ctx context.Context) {
 	fn.countReport = beam.NewCounter("aggregation", "encryptReportFn_report_count")
 }
 
+// StartBundle gets the current public keys from the cache, so keys rotated during a long job are picked up.
+func (fn *encryptReportFn) StartBundle(ctx context.Context, emit func(*pb.AggregatablePayload)) error {
+	if fn.PublicKeysURI == "" {
+		return nil
+	}
+	var err error
+	fn.PublicKeys, err = cryptoio.SharedPublicKeyCache(fn.PublicKeyCacheTTL).Get(ctx, fn.PublicKeysURI)
+	return err
+}
+
 func (fn *encryptReportFn) ProcessElement(ctx context.Context, c *pipelinetypes.RawReport, emit func(*pb.AggregatablePayload)) error {
 	fn.countReport.Inc(ctx, 1)
 
@@ -161,7 +176,11 @@ type GenerateEncryptedReportParams struct {
 	RawReportURI       string
 	EncryptedReportURI string
 	PublicKeys         *reporttypes.PublicKeys
-	Shards             int64
+	// File of the public keys, which is read by the workers through a cache with PublicKeyCacheTTL instead of using
+	// PublicKeys if set.
+	PublicKeysURI     string
+	PublicKeyCacheTTL time.Duration
+	Shards            int64
 
 	// EncryptOutput should only be used for integration test before HPKE is ready in Go Tink.
 	EncryptOutput bool
@@ -177,7 +196,11 @@ func GenerateEncryptedReport(scope beam.Scope, params *GenerateEncryptedReportPa
 	rawReports := beam.ParDo(scope, &parseRawReportFn{}, lines)
 	resharded := beam.Reshuffle(scope, rawReports)
 
-	encrypted := beam.ParDo(scope, &encryptReportFn{PublicKeys: params.PublicKeys}, resharded)
+	encrypted := beam.ParDo(scope, &encryptReportFn{
+		PublicKeys:        params.PublicKeys,
+		PublicKeysURI:     params.PublicKeysURI,
+		PublicKeyCacheTTL: params.PublicKeyCacheTTL,
+	}, resharded)
 
 	writeEncryptedReport(scope, encrypted, params.EncryptedReportURI, params.Shards)
 }
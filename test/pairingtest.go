@@ -0,0 +1,220 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pairingtest certifies that two independently deployed helpers aggregate correctly together, before a new
+// helper pairing receives production traffic.
+//
+// The test batch is a tiny fixed set of conversions, encrypted with the public keys of both helpers. It is aggregated
+// by a two-level hierarchical query through the normal coordination flow, where the helpers exchange the intermediate
+// results through their shared directories. The query runs without noise, so the merged final results must match the
+// expected histogram byte for byte.
+package pairingtest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"lukechampine.com/uint128"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelinetypes"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/results"
+	"github.com/google/privacy-sandbox-aggregation-service/service/query"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+	"github.com/google/privacy-sandbox-aggregation-service/test/dpfdataconverter"
+)
+
+// KeyBitSize is the bit size of the bucket IDs in the test batch.
+const KeyBitSize = 16
+
+// QueryIDPrefix marks the queries of the pairing tests, so they can be told apart from production queries.
+const QueryIDPrefix = "pairing-test-"
+
+// Conversions is the fixed test batch. Some buckets have several reports, so a report dropped or counted twice by
+// either helper changes the result, and one value is large enough to overflow if a share is truncated.
+var Conversions = []pipelinetypes.RawReport{
+	{Bucket: uint128.From64(0x1234), Value: 5},
+	{Bucket: uint128.From64(0x1234), Value: 7},
+	{Bucket: uint128.From64(0x12ff), Value: 1},
+	{Bucket: uint128.From64(0xab00), Value: 1 << 20},
+	{Bucket: uint128.From64(0xab01), Value: 3},
+}
+
+// Config returns the hierarchical query of the test. Only the 8-bit prefixes with conversions are expanded to the
+// full bucket IDs.
+func Config() *query.HierarchicalConfig {
+	return &query.HierarchicalConfig{
+		PrefixLengths:               []int32{8, 16},
+		PrivacyBudgetPerPrefix:      []float64{0.5, 0.5},
+		ExpansionThresholdPerPrefix: []uint64{1, 0},
+		HierarchyGranularity:        1,
+	}
+}
+
+// ExpectedHistogram returns the complete histogram of the test query in ascending order of the bucket IDs: every
+// bucket under the expanded prefixes, including the ones without conversions.
+func ExpectedHistogram() []dpfaggregator.CompleteHistogram {
+	sums := make(map[uint128.Uint128]uint64)
+	prefixes := make(map[uint64]bool)
+	for _, c := range Conversions {
+		sums[c.Bucket] += c.Value
+		prefixes[c.Bucket.Lo>>8] = true
+	}
+	var result []dpfaggregator.CompleteHistogram
+	for prefix := range prefixes {
+		for i := uint64(0); i < 1<<8; i++ {
+			bucket := uint128.From64(prefix<<8 | i)
+			result = append(result, dpfaggregator.CompleteHistogram{Bucket: bucket, Sum: sums[bucket]})
+		}
+	}
+	sortHistogram(result)
+	return result
+}
+
+func sortHistogram(histogram []dpfaggregator.CompleteHistogram) {
+	sort.Slice(histogram, func(i, j int) bool { return histogram[i].Bucket.Cmp(histogram[j].Bucket) < 0 })
+}
+
+// FormatHistogram formats the histogram in the canonical form that is compared byte for byte: one "bucket,sum" line
+// per bucket in ascending order of the bucket IDs.
+func FormatHistogram(histogram []dpfaggregator.CompleteHistogram) []byte {
+	sorted := append([]dpfaggregator.CompleteHistogram(nil), histogram...)
+	sortHistogram(sorted)
+	var b strings.Builder
+	for _, h := range sorted {
+		fmt.Fprintf(&b, "%s,%d\n", h.Bucket.String(), h.Sum)
+	}
+	return []byte(b.String())
+}
+
+// WriteReports generates the encrypted partial reports of the test batch for the two helpers. The reports have
+// stable IDs, so the batch integrity check of the helpers also runs on the test batch.
+func WriteReports(ctx context.Context, publicKeys1, publicKeys2 *reporttypes.PublicKeys, reportURI1, reportURI2 string) error {
+	var lines1, lines2 []string
+	for i, c := range Conversions {
+		key1, key2, err := dpfdataconverter.GenerateDPFKeys(c, KeyBitSize, int(Config().HierarchyGranularity))
+		if err != nil {
+			return err
+		}
+		sharedInfo := fmt.Sprintf(`{"report_id":"%sreport-%d"}`, QueryIDPrefix, i)
+		encrypted1, encrypted2, err := dpfdataconverter.EncryptPartialReports(key1, key2, publicKeys1, publicKeys2, sharedInfo, true /*encryptOutput*/)
+		if err != nil {
+			return err
+		}
+		line1, err := reporttypes.SerializeAggregatablePayload(encrypted1)
+		if err != nil {
+			return err
+		}
+		line2, err := reporttypes.SerializeAggregatablePayload(encrypted2)
+		if err != nil {
+			return err
+		}
+		lines1, lines2 = append(lines1, line1), append(lines2, line2)
+	}
+	if err := utils.WriteLines(ctx, lines1, reportURI1); err != nil {
+		return err
+	}
+	return utils.WriteLines(ctx, lines2, reportURI2)
+}
+
+// Result is the outcome of a pairing test.
+type Result struct {
+	QueryID string
+	Origin1 string
+	Origin2 string
+	Passed  bool
+	// SHA-256 digests of the canonical expected and merged histograms.
+	ExpectedSHA256 string
+	GotSHA256      string
+	// Differences from the expected histogram, one per bucket.
+	Mismatches []string `json:",omitempty"`
+	Time       time.Time
+}
+
+// MergeResults merges the final partial results of the two helpers into the complete histogram. Buckets missing from
+// either helper are returned as mismatches instead of being merged.
+func MergeResults(partial1, partial2 map[uint128.Uint128]uint64) ([]dpfaggregator.CompleteHistogram, []string) {
+	var (
+		merged     []dpfaggregator.CompleteHistogram
+		mismatches []string
+	)
+	for bucket, sum1 := range partial1 {
+		sum2, ok := partial2[bucket]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("bucket %s: missing from helper 2", bucket.String()))
+			continue
+		}
+		// The shares are additive modulo 2^64.
+		merged = append(merged, dpfaggregator.CompleteHistogram{Bucket: bucket, Sum: sum1 + sum2})
+	}
+	for bucket := range partial2 {
+		if _, ok := partial1[bucket]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("bucket %s: missing from helper 1", bucket.String()))
+		}
+	}
+	sortHistogram(merged)
+	sort.Strings(mismatches)
+	return merged, mismatches
+}
+
+// Compare compares the merged histogram with the expected one, and fills the digests, the mismatches and the outcome
+// of the result.
+func Compare(result *Result, merged []dpfaggregator.CompleteHistogram, mismatches []string) {
+	want, got := FormatHistogram(ExpectedHistogram()), FormatHistogram(merged)
+	wantDigest, gotDigest := sha256.Sum256(want), sha256.Sum256(got)
+	result.ExpectedSHA256 = hex.EncodeToString(wantDigest[:])
+	result.GotSHA256 = hex.EncodeToString(gotDigest[:])
+
+	gotSums := make(map[uint128.Uint128]uint64)
+	for _, h := range merged {
+		gotSums[h.Bucket] = h.Sum
+	}
+	wantBuckets := make(map[uint128.Uint128]bool)
+	for _, h := range ExpectedHistogram() {
+		wantBuckets[h.Bucket] = true
+		if got, ok := gotSums[h.Bucket]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("bucket %s: want %d, got none", h.Bucket.String(), h.Sum))
+		} else if got != h.Sum {
+			mismatches = append(mismatches, fmt.Sprintf("bucket %s: want %d, got %d", h.Bucket.String(), h.Sum, got))
+		}
+	}
+	for _, h := range merged {
+		if !wantBuckets[h.Bucket] {
+			mismatches = append(mismatches, fmt.Sprintf("bucket %s: unexpected with %d", h.Bucket.String(), h.Sum))
+		}
+	}
+	result.Mismatches = mismatches
+	result.Passed = result.ExpectedSHA256 == result.GotSHA256 && len(mismatches) == 0
+}
+
+// Verify reads the final partial results of the two helpers, and checks the merged histogram against the expected one.
+func Verify(ctx context.Context, result *Result, resultURI1, resultURI2 string) error {
+	partial1, err := results.ReadPartialSums(ctx, resultURI1, nil)
+	if err != nil {
+		return err
+	}
+	partial2, err := results.ReadPartialSums(ctx, resultURI2, nil)
+	if err != nil {
+		return err
+	}
+	merged, mismatches := MergeResults(partial1, partial2)
+	Compare(result, merged, mismatches)
+	result.Time = time.Now().UTC()
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pairingtest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"lukechampine.com/uint128"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+)
+
+func TestExpectedHistogram(t *testing.T) {
+	histogram := ExpectedHistogram()
+	// The conversions fall under the prefixes 0x12 and 0xab.
+	if got, want := len(histogram), 2*256; got != want {
+		t.Fatalf("expect %d buckets, got %d", want, got)
+	}
+	got := make(map[uint128.Uint128]uint64)
+	for _, h := range histogram {
+		if h.Sum != 0 {
+			got[h.Bucket] = h.Sum
+		}
+	}
+	want := map[uint128.Uint128]uint64{
+		uint128.From64(0x1234): 12,
+		uint128.From64(0x12ff): 1,
+		uint128.From64(0xab00): 1 << 20,
+		uint128.From64(0xab01): 3,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("nonzero buckets mismatch (-want +got):\n%s", diff)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(FormatHistogram(histogram)), "\n"), "\n")
+	if lines[0] != "4608,0" || lines[len(lines)-1] != "44031,0" {
+		t.Errorf("expect the canonical histogram from bucket 4608 to 44031, got %q to %q", lines[0], lines[len(lines)-1])
+	}
+}
+
+// splitShares splits the expected histogram into two partial results, with the given changes applied to the second.
+func splitShares(change func(map[uint128.Uint128]uint64)) (map[uint128.Uint128]uint64, map[uint128.Uint128]uint64) {
+	partial1, partial2 := make(map[uint128.Uint128]uint64), make(map[uint128.Uint128]uint64)
+	for i, h := range ExpectedHistogram() {
+		share := uint64(i)*0x9e3779b97f4a7c15 + 1
+		partial1[h.Bucket] = share
+		partial2[h.Bucket] = h.Sum - share
+	}
+	change(partial2)
+	return partial1, partial2
+}
+
+func TestCompare(t *testing.T) {
+	for _, tc := range []struct {
+		desc           string
+		change         func(map[uint128.Uint128]uint64)
+		wantMismatches []string
+	}{
+		{
+			desc:   "matching results",
+			change: func(map[uint128.Uint128]uint64) {},
+		},
+		{
+			desc:           "wrong sum",
+			change:         func(p map[uint128.Uint128]uint64) { p[uint128.From64(0x1234)]-- },
+			wantMismatches: []string{"bucket 4660: want 12, got 11"},
+		},
+		{
+			desc:   "missing bucket",
+			change: func(p map[uint128.Uint128]uint64) { delete(p, uint128.From64(0xab01)) },
+			wantMismatches: []string{
+				"bucket 43777: missing from helper 2",
+				"bucket 43777: want 3, got none",
+			},
+		},
+		{
+			desc: "unexpected bucket",
+			change: func(p map[uint128.Uint128]uint64) {
+				p[uint128.From64(0x0001)] = 1
+			},
+			wantMismatches: []string{
+				"bucket 1: missing from helper 1",
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			partial1, partial2 := splitShares(tc.change)
+			merged, mismatches := MergeResults(partial1, partial2)
+			result := &Result{}
+			Compare(result, merged, mismatches)
+
+			if diff := cmp.Diff(tc.wantMismatches, result.Mismatches); diff != "" {
+				t.Errorf("mismatches (-want +got):\n%s", diff)
+			}
+			wantPassed := len(tc.wantMismatches) == 0
+			if result.Passed != wantPassed {
+				t.Errorf("expect passed %t, got %t", wantPassed, result.Passed)
+			}
+			if wantPassed && result.ExpectedSHA256 != result.GotSHA256 {
+				t.Errorf("expect same digests, got %q and %q", result.ExpectedSHA256, result.GotSHA256)
+			}
+		})
+	}
+}
+
+func TestCompareUnexpectedBucket(t *testing.T) {
+	merged := append(ExpectedHistogram(), dpfaggregator.CompleteHistogram{Bucket: uint128.From64(0xff00), Sum: 2})
+	result := &Result{}
+	Compare(result, merged, nil)
+	if diff := cmp.Diff([]string{"bucket 65280: unexpected with 2"}, result.Mismatches); diff != "" {
+		t.Errorf("mismatches (-want +got):\n%s", diff)
+	}
+	if result.Passed {
+		t.Error("expect the test to fail with an unexpected bucket")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pipelinetestutil contains utilities for testing the aggregation pipelines with two fake helpers.
+//
+// The integrators can use FakeHelpers to generate the helper keys, run the DPF aggregation for both helpers
+// in the same Beam pipeline, and verify the merged histograms, without setting up real helper servers.
+package pipelinetestutil
+
+import (
+	"context"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/service/query"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
+
+	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+)
+
+// HelperKeys contains the encryption keys of a fake helper.
+type HelperKeys struct {
+	PrivateKeys map[string]*pb.StandardPrivateKey
+	PublicKeys  *reporttypes.PublicKeys
+}
+
+// FakeHelpers represents a pair of helpers running in the same test pipeline.
+type FakeHelpers struct {
+	Keys1, Keys2 *HelperKeys
+	// Information shared by the helpers, as served by the aggregator servers.
+	SharedInfo1, SharedInfo2 *query.HelperSharedInfo
+}
+
+// PrepareKeys generates keyCount hybrid key pairs for a fake helper.
+func PrepareKeys(ctx context.Context, keyCount int) (*HelperKeys, error) {
+	privKeys, pubKeys, err := cryptoio.GenerateHybridKeyPairs(ctx, keyCount)
+	if err != nil {
+		return nil, err
+	}
+	return &HelperKeys{PrivateKeys: privKeys, PublicKeys: pubKeys}, nil
+}
+
+// CreateServerInfo creates the information that a fake helper shares with its partner.
+func CreateServerInfo(origin, sharedDir, pubsubTopic string) *query.HelperSharedInfo {
+	return &query.HelperSharedInfo{
+		Origin:      origin,
+		SharedDir:   sharedDir,
+		PubSubTopic: pubsubTopic,
+	}
+}
+
+// NewFakeHelpers creates two fake helpers with their own keys, sharing intermediate results under sharedDir.
+func NewFakeHelpers(ctx context.Context, keyCount int, sharedDir string) (*FakeHelpers, error) {
+	keys1, err := PrepareKeys(ctx, keyCount)
+	if err != nil {
+		return nil, err
+	}
+	keys2, err := PrepareKeys(ctx, keyCount)
+	if err != nil {
+		return nil, err
+	}
+	return &FakeHelpers{
+		Keys1:       keys1,
+		Keys2:       keys2,
+		SharedInfo1: CreateServerInfo("helper1", sharedDir, "projects/test/topics/helper1"),
+		SharedInfo2: CreateServerInfo("helper2", sharedDir, "projects/test/topics/helper2"),
+	}, nil
+}
+
+// DecryptPartialReports decrypts the partial reports for both helpers with their own private keys.
+func (h *FakeHelpers) DecryptPartialReports(scope beam.Scope, encrypted1, encrypted2 beam.PCollection) (beam.PCollection, beam.PCollection) {
+	return dpfaggregator.DecryptPartialReport(scope, encrypted1, h.Keys1.PrivateKeys), dpfaggregator.DecryptPartialReport(scope, encrypted2, h.Keys2.PrivateKeys)
+}
+
+// ExpandAndMerge expands the decrypted partial reports from both helpers for one hierarchy, and merges the partial histograms.
+func ExpandAndMerge(scope beam.Scope, decrypted1, decrypted2 beam.PCollection, expandParams *dpfaggregator.ExpandParameters, combineParams *dpfaggregator.CombineParams, keyBitSize int) (beam.PCollection, error) {
+	dpfParams, err := dpfaggregator.GetDPFParameters(keyBitSize, expandParams)
+	if err != nil {
+		return beam.PCollection{}, err
+	}
+
+	ctx1 := dpfaggregator.CreateEvaluationContext(scope, decrypted1, expandParams, keyBitSize)
+	ctx2 := dpfaggregator.CreateEvaluationContext(scope, decrypted2, expandParams, keyBitSize)
+	ph1, err := dpfaggregator.ExpandAndCombineHistogram(scope, ctx1, expandParams, dpfParams, combineParams, keyBitSize)
+	if err != nil {
+		return beam.PCollection{}, err
+	}
+	ph2, err := dpfaggregator.ExpandAndCombineHistogram(scope, ctx2, expandParams, dpfParams, combineParams, keyBitSize)
+	if err != nil {
+		return beam.PCollection{}, err
+	}
+	return dpfaggregator.MergeHistogram(scope, ph1, ph2), nil
+}
+
+// VerifyHistogram adds an assertion to the pipeline that the merged histogram equals the expected one.
+func VerifyHistogram(scope beam.Scope, got beam.PCollection, want []dpfaggregator.CompleteHistogram) {
+	passert.Equals(scope, got, beam.CreateList(scope, want))
+}
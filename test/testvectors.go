@@ -0,0 +1,452 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testvectors generates and checks the canonical test vectors of the DPF protocol, so implementations of the
+// helper in other languages can validate their byte-level compatibility with this one.
+//
+// A vector file contains the fixed private keys of the two helpers and the levels of a hierarchical query. For each
+// report, it contains the encrypted partial reports sent to the two helpers in the format of the input files, the DPF
+// keys expected after decrypting them, and the vectors expected from expanding the keys at each level before noise is
+// added. The sum of the vectors of the two helpers is the contribution of the report to each bucket.
+package testvectors
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"lukechampine.com/uint128"
+	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
+	"github.com/google/privacy-sandbox-aggregation-service/encryption/incrementaldpf"
+	"github.com/google/privacy-sandbox-aggregation-service/encryption/standardencrypt"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelinetypes"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+	"github.com/google/privacy-sandbox-aggregation-service/test/dpfdataconverter"
+
+	dpfpb "github.com/google/distributed_point_functions/dpf/distributed_point_function_go_proto"
+	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+)
+
+// Version of the format of the vector files, which changes when the files are not compatible with older checkers.
+const Version = "1"
+
+// helperCount is the number of helpers in the DPF protocol.
+const helperCount = 2
+
+// File contains the canonical test vectors.
+type File struct {
+	Version string
+	// Bit size of the bucket IDs. The DPF keys have a hierarchy at every prefix length.
+	KeyBitSize int
+	// Keys of the two helpers, which the reports are encrypted with.
+	HelperKeys [helperCount]*HelperKey
+	// Levels of the hierarchical query that the DPF keys are expanded at, in order.
+	Levels  []*Level
+	Vectors []*Vector
+}
+
+// HelperKey is the hybrid encryption key pair of a helper.
+type HelperKey struct {
+	KeyID string
+	// Base64-encoded wire-format StandardPrivateKey and StandardPublicKey.
+	PrivateKey string
+	PublicKey  string
+}
+
+// Level is one step of the hierarchical query.
+type Level struct {
+	Level, PreviousLevel int32
+	// Decimal prefixes of the buckets kept from the previous level, which are empty at the first level.
+	Prefixes []string
+	// Decimal bucket IDs of the entries of the expanded vectors. They are empty at the first level, where the bucket ID
+	// is the index of the entry.
+	BucketIDs []string
+}
+
+// Vector contains the inputs and the expected outputs of the helpers for one report.
+type Vector struct {
+	Name string
+	// Decimal bucket ID and value of the report.
+	Bucket string
+	Value  uint64
+	// Shared info authenticated by the encryption of the reports.
+	SharedInfo string
+	// Encrypted partial reports of the two helpers, serialized like the lines of the input files.
+	EncryptedReports [helperCount]string
+	// Base64-encoded wire-format DpfKey of each helper, expected after decrypting its partial report.
+	DPFKeys [helperCount]string
+	// Vectors expected from expanding the DPF keys of each helper at each level, before noise is added.
+	Expanded [][helperCount][]uint64
+}
+
+// Report is a report for which a test vector is generated.
+type Report struct {
+	Name   string
+	Report pipelinetypes.RawReport
+}
+
+// Generate creates the test vectors for the reports, expanding the DPF keys at the given levels. The reports are
+// encrypted with the given helper keys, so regenerated vectors keep the keys of the published ones, and new keys are
+// generated for the helpers without one. The DPF keys and the encryption take their randomness from the DPF library
+// and Tink, which cannot be seeded, so the encrypted reports and the DPF keys differ in every generation.
+//
+// The prefixes at each level after the first are the buckets of all the reports, so every report has a nonzero entry
+// in the expanded vectors.
+func Generate(keyBitSize int, levels []int32, reports []*Report, sharedInfo string, helperKeys [helperCount]*HelperKey) (*File, error) {
+	if len(levels) == 0 {
+		return nil, errors.New("expect at least one level")
+	}
+	params, err := incrementaldpf.GetDefaultDPFParameters(keyBitSize)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{Version: Version, KeyBitSize: keyBitSize, HelperKeys: helperKeys}
+
+	var publicKeys [helperCount]*reporttypes.PublicKeys
+	for i := range f.HelperKeys {
+		if f.HelperKeys[i] == nil {
+			if f.HelperKeys[i], err = generateHelperKey(fmt.Sprintf("helper%d", i+1)); err != nil {
+				return nil, err
+			}
+		}
+		b, err := base64.StdEncoding.DecodeString(f.HelperKeys[i].PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		publicKey := &pb.StandardPublicKey{}
+		if err := proto.Unmarshal(b, publicKey); err != nil {
+			return nil, err
+		}
+		publicKeys[i] = &reporttypes.PublicKeys{Keys: []reporttypes.PublicKeyInfo{{ID: f.HelperKeys[i].KeyID, Key: base64.StdEncoding.EncodeToString(publicKey.Key)}}}
+	}
+
+	previousLevel := int32(-1)
+	for _, level := range levels {
+		l := &Level{Level: level, PreviousLevel: previousLevel}
+		if previousLevel >= 0 {
+			seen := make(map[uint128.Uint128]bool)
+			var prefixes []uint128.Uint128
+			for _, report := range reports {
+				prefix := bucketPrefix(report.Report.Bucket, keyBitSize, params[previousLevel])
+				if !seen[prefix] {
+					seen[prefix] = true
+					prefixes = append(prefixes, prefix)
+				}
+			}
+			l.Prefixes = formatUint128s(prefixes)
+			bucketIDs, err := incrementaldpf.CalculateBucketID(params, prefixes, level, previousLevel)
+			if err != nil {
+				return nil, err
+			}
+			l.BucketIDs = formatUint128s(bucketIDs)
+		}
+		f.Levels = append(f.Levels, l)
+		previousLevel = level
+	}
+
+	privateKeys, err := f.privateKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, report := range reports {
+		key1, key2, err := dpfdataconverter.GenerateDPFKeys(report.Report, keyBitSize, 1 /*hierarchyGranularity*/)
+		if err != nil {
+			return nil, err
+		}
+		encrypted1, encrypted2, err := dpfdataconverter.EncryptPartialReports(key1, key2, publicKeys[0], publicKeys[1], sharedInfo, true /*encryptOutput*/)
+		if err != nil {
+			return nil, err
+		}
+		v := &Vector{Name: report.Name, Bucket: report.Report.Bucket.String(), Value: report.Report.Value, SharedInfo: sharedInfo}
+		for i, encrypted := range []*pb.AggregatablePayload{encrypted1, encrypted2} {
+			if v.EncryptedReports[i], err = reporttypes.SerializeAggregatablePayload(encrypted); err != nil {
+				return nil, err
+			}
+			// The expected DPF keys are the bytes in the encrypted payloads, so the checkers can compare them exactly.
+			dpfKey, err := decryptDPFKey(v.EncryptedReports[i], v.SharedInfo, privateKeys[i])
+			if err != nil {
+				return nil, err
+			}
+			v.DPFKeys[i] = base64.StdEncoding.EncodeToString(dpfKey)
+		}
+		if v.Expanded, err = expand(params, f.Levels, v.DPFKeys); err != nil {
+			return nil, err
+		}
+		f.Vectors = append(f.Vectors, v)
+	}
+	return f, nil
+}
+
+// generateHelperKey generates a new key pair for a helper.
+func generateHelperKey(keyID string) (*HelperKey, error) {
+	privateKey, publicKey, err := standardencrypt.GenerateStandardKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	bPrivateKey, err := proto.Marshal(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	bPublicKey, err := proto.Marshal(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &HelperKey{
+		KeyID:      keyID,
+		PrivateKey: base64.StdEncoding.EncodeToString(bPrivateKey),
+		PublicKey:  base64.StdEncoding.EncodeToString(bPublicKey),
+	}, nil
+}
+
+// Check validates this implementation against the test vectors: the encrypted reports are decrypted into the expected
+// DPF keys, the keys are expanded into the expected vectors, and the vectors of the two helpers sum to the value of the
+// report in its bucket and to zero elsewhere.
+func Check(f *File) error {
+	if f.Version != Version {
+		return fmt.Errorf("expect vector file version %s, got %q", Version, f.Version)
+	}
+	params, err := incrementaldpf.GetDefaultDPFParameters(f.KeyBitSize)
+	if err != nil {
+		return err
+	}
+	privateKeys, err := f.privateKeys()
+	if err != nil {
+		return err
+	}
+	for _, l := range f.Levels {
+		if l.PreviousLevel < 0 {
+			continue
+		}
+		prefixes, err := parseUint128s(l.Prefixes)
+		if err != nil {
+			return err
+		}
+		bucketIDs, err := incrementaldpf.CalculateBucketID(params, prefixes, l.Level, l.PreviousLevel)
+		if err != nil {
+			return err
+		}
+		if got := formatUint128s(bucketIDs); !equalStrings(got, l.BucketIDs) {
+			return fmt.Errorf("level %d: expect bucket IDs %v, got %v", l.Level, l.BucketIDs, got)
+		}
+	}
+
+	for _, v := range f.Vectors {
+		for i := range v.EncryptedReports {
+			dpfKey, err := decryptDPFKey(v.EncryptedReports[i], v.SharedInfo, privateKeys[i])
+			if err != nil {
+				return fmt.Errorf("vector %q, helper %d: %v", v.Name, i+1, err)
+			}
+			want, err := base64.StdEncoding.DecodeString(v.DPFKeys[i])
+			if err != nil {
+				return fmt.Errorf("vector %q, helper %d: %v", v.Name, i+1, err)
+			}
+			if !bytes.Equal(dpfKey, want) {
+				return fmt.Errorf("vector %q, helper %d: decrypted DPF key differs from the expected one", v.Name, i+1)
+			}
+		}
+		expanded, err := expand(params, f.Levels, v.DPFKeys)
+		if err != nil {
+			return fmt.Errorf("vector %q: %v", v.Name, err)
+		}
+		if len(v.Expanded) != len(f.Levels) {
+			return fmt.Errorf("vector %q: expect expanded vectors for %d levels, got %d", v.Name, len(f.Levels), len(v.Expanded))
+		}
+		bucket, err := utils.StringToUint128(v.Bucket)
+		if err != nil {
+			return fmt.Errorf("vector %q: %v", v.Name, err)
+		}
+		for j, l := range f.Levels {
+			for i := range expanded[j] {
+				if !equalUint64s(expanded[j][i], v.Expanded[j][i]) {
+					return fmt.Errorf("vector %q, level %d, helper %d: expanded vector differs from the expected one", v.Name, l.Level, i+1)
+				}
+			}
+			if err := checkSum(v.Expanded[j], l, bucketPrefix(bucket, f.KeyBitSize, params[l.Level]), v.Value); err != nil {
+				return fmt.Errorf("vector %q, level %d: %v", v.Name, l.Level, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkSum checks that the vectors of the two helpers sum to value at the entry of the bucket and to zero elsewhere.
+func checkSum(vectors [helperCount][]uint64, l *Level, bucket uint128.Uint128, value uint64) error {
+	if len(vectors[0]) != len(vectors[1]) {
+		return fmt.Errorf("expect vectors of the same length, got %d and %d", len(vectors[0]), len(vectors[1]))
+	}
+	if l.PreviousLevel >= 0 && len(l.BucketIDs) != len(vectors[0]) {
+		return fmt.Errorf("expect %d bucket IDs for the vector entries, got %d", len(vectors[0]), len(l.BucketIDs))
+	}
+	for k := range vectors[0] {
+		id := uint128.From64(uint64(k))
+		if l.PreviousLevel >= 0 {
+			var err error
+			if id, err = utils.StringToUint128(l.BucketIDs[k]); err != nil {
+				return err
+			}
+		}
+		want := uint64(0)
+		if id == bucket {
+			want = value
+		}
+		if got := vectors[0][k] + vectors[1][k]; got != want {
+			return fmt.Errorf("expect sum %d in bucket %s, got %d", want, id, got)
+		}
+	}
+	return nil
+}
+
+// ReadFile reads the test vectors from a JSON file.
+func ReadFile(ctx context.Context, uri string) (*File, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteFile writes the test vectors into a JSON file.
+func WriteFile(ctx context.Context, f *File, uri string) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteBytes(ctx, b, uri, nil)
+}
+
+func (f *File) privateKeys() ([helperCount]*pb.StandardPrivateKey, error) {
+	var keys [helperCount]*pb.StandardPrivateKey
+	for i, helperKey := range f.HelperKeys {
+		if helperKey == nil {
+			return keys, fmt.Errorf("missing key of helper %d", i+1)
+		}
+		b, err := base64.StdEncoding.DecodeString(helperKey.PrivateKey)
+		if err != nil {
+			return keys, err
+		}
+		keys[i] = &pb.StandardPrivateKey{}
+		if err := proto.Unmarshal(b, keys[i]); err != nil {
+			return keys, err
+		}
+	}
+	return keys, nil
+}
+
+// decryptDPFKey decrypts a serialized partial report with the shared info and returns the bytes of its DPF key.
+// Unencrypted reports are rejected, as they do not test the encryption.
+func decryptDPFKey(line, sharedInfo string, privateKey *pb.StandardPrivateKey) ([]byte, error) {
+	encrypted, err := reporttypes.DeserializeAggregatablePayload(line)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted.SharedInfo != sharedInfo {
+		return nil, fmt.Errorf("expect shared info %q, got %q", sharedInfo, encrypted.SharedInfo)
+	}
+	payload, isEncrypted, err := cryptoio.DecryptOrUnmarshal(encrypted, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if !isEncrypted {
+		return nil, errors.New("expect an encrypted report")
+	}
+	return payload.DPFKey, nil
+}
+
+// expand expands the DPF keys of the two helpers at the levels, continuing from the evaluation context of the previous
+// level like the helpers do.
+func expand(params []*dpfpb.DpfParameters, levels []*Level, dpfKeys [helperCount]string) ([][helperCount][]uint64, error) {
+	expanded := make([][helperCount][]uint64, len(levels))
+	for i, encoded := range dpfKeys {
+		b, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		key := &dpfpb.DpfKey{}
+		if err := proto.Unmarshal(b, key); err != nil {
+			return nil, err
+		}
+		evalCtx, err := incrementaldpf.CreateEvaluationContext(params, key)
+		if err != nil {
+			return nil, err
+		}
+		for j, l := range levels {
+			prefixes, err := parseUint128s(l.Prefixes)
+			if err != nil {
+				return nil, err
+			}
+			if expanded[j][i], err = incrementaldpf.EvaluateUntil64(int(l.Level), prefixes, evalCtx); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// bucketPrefix returns the prefix of the bucket with the bit size of the DPF parameters.
+func bucketPrefix(bucket uint128.Uint128, keyBitSize int, params *dpfpb.DpfParameters) uint128.Uint128 {
+	return bucket.Rsh(uint(keyBitSize - int(params.GetLogDomainSize())))
+}
+
+func formatUint128s(values []uint128.Uint128) []string {
+	var s []string
+	for _, v := range values {
+		s = append(s, v.String())
+	}
+	return s
+}
+
+func parseUint128s(s []string) ([]uint128.Uint128, error) {
+	var values []uint128.Uint128
+	for _, str := range s {
+		v, err := utils.StringToUint128(str)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalUint64s(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testvectors
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"lukechampine.com/uint128"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelinetypes"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+
+	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+)
+
+func generateTestVectors(t *testing.T) *File {
+	t.Helper()
+	f, err := Generate(8, []int32{3, 7}, []*Report{
+		{Name: "low", Report: pipelinetypes.RawReport{Bucket: uint128.From64(3), Value: 5}},
+		{Name: "high", Report: pipelinetypes.RawReport{Bucket: uint128.From64(250), Value: 1<<64 - 1}},
+	}, `{"report_id":"test"}`, [helperCount]*HelperKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestGenerateAndCheck(t *testing.T) {
+	f := generateTestVectors(t)
+	if err := Check(f); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir, err := ioutil.TempDir("/tmp", "test-vectors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	uri := path.Join(tmpDir, "vectors.json")
+	if err := WriteFile(context.Background(), f, uri); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFile(context.Background(), uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(got); err != nil {
+		t.Fatalf("expect the written vectors to pass the check, got %v", err)
+	}
+}
+
+func TestGenerateKeepsHelperKeys(t *testing.T) {
+	published := generateTestVectors(t)
+	f, err := Generate(8, []int32{7}, []*Report{
+		{Name: "low", Report: pipelinetypes.RawReport{Bucket: uint128.From64(3), Value: 5}},
+	}, `{"report_id":"test"}`, published.HelperKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(published.HelperKeys, f.HelperKeys); diff != "" {
+		t.Errorf("helper keys mismatch (-want +got):\n%s", diff)
+	}
+	if err := Check(f); err != nil {
+		t.Fatalf("expect the vectors encrypted with the published keys to pass the check, got %v", err)
+	}
+}
+
+func TestCheckDetectsDifferences(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		modify func(f *File)
+	}{
+		{"expanded vector", func(f *File) { f.Vectors[0].Expanded[1][0][0]++ }},
+		{"both expanded vectors", func(f *File) {
+			f.Vectors[0].Expanded[0][0][0]++
+			f.Vectors[0].Expanded[0][1][0]--
+		}},
+		{"DPF key", func(f *File) { f.Vectors[1].DPFKeys[1] = f.Vectors[0].DPFKeys[1] }},
+		{"encrypted report", func(f *File) { f.Vectors[0].EncryptedReports[0] = f.Vectors[1].EncryptedReports[0] }},
+		{"helper key", func(f *File) { f.HelperKeys[0], f.HelperKeys[1] = f.HelperKeys[1], f.HelperKeys[0] }},
+		{"bucket IDs", func(f *File) { f.Levels[1].BucketIDs[0] = "1" }},
+		{"shared info", func(f *File) { f.Vectors[0].SharedInfo = `{"report_id":"other"}` }},
+		{"value", func(f *File) { f.Vectors[0].Value++ }},
+		{"version", func(f *File) { f.Version = "0" }},
+	} {
+		f := generateTestVectors(t)
+		tc.modify(f)
+		if err := Check(f); err == nil {
+			t.Errorf("%s: expect the check to fail", tc.desc)
+		}
+	}
+}
+
+func TestCheckRejectsUnencryptedReports(t *testing.T) {
+	f := generateTestVectors(t)
+	dpfKey, err := base64.StdEncoding.DecodeString(f.Vectors[0].DPFKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bPayload, err := utils.MarshalCBOR(reporttypes.Payload{Operation: "hierarchical-histogram", DPFKey: dpfKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unencrypted, err := reporttypes.SerializeAggregatablePayload(&pb.AggregatablePayload{
+		Payload:    &pb.StandardCiphertext{Data: bPayload},
+		SharedInfo: f.Vectors[0].SharedInfo,
+		KeyId:      f.HelperKeys[0].KeyID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Vectors[0].EncryptedReports[0] = unencrypted
+	if err := Check(f); err == nil {
+		t.Error("expect the check to fail for an unencrypted report")
+	}
+}
+
+func TestCanonicalVectors(t *testing.T) {
+	uri, err := utils.RunfilesPath("test/testdata/canonical_vectors.json", false /*isBinary*/)
+	if err != nil {
+		t.Fatalf("canonical vectors not found, generate them with tools:generate_test_vectors: %v", err)
+	}
+	f, err := ReadFile(context.Background(), uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(f); err != nil {
+		t.Fatalf("this implementation is not compatible with the canonical vectors: %v", err)
+	}
+}
@@ -19,7 +19,9 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/golang/glog"
@@ -27,7 +29,9 @@ import (
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/pborman/uuid"
 	"github.com/google/privacy-sandbox-aggregation-service/service/aggregatorservice"
+	"github.com/google/privacy-sandbox-aggregation-service/service/clienttoken"
 	"github.com/google/privacy-sandbox-aggregation-service/service/query"
+	"github.com/google/privacy-sandbox-aggregation-service/service/querytemplate"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
 )
 
@@ -36,20 +40,70 @@ var (
 	helperAddress2     = flag.String("helper_address2", "", "Address of helper 2, required for MPC protocal.")
 	partialReportURI1  = flag.String("partial_report_uri1", "", "Input partial report for helper 1.")
 	partialReportURI2  = flag.String("partial_report_uri2", "", "Input partial report for helper 2, required for MPC protocal.")
-	expansionConfigURI = flag.String("expansion_config_uri", "", "URI for the expansion configurations with type query.HierarchicalConfig, query.DirectConfig or a single column of bucket IDs for the one-party design.")
+	lateReportURI1     = flag.String("late_report_uri1", "", "Encrypted reports added to the batch of helper 1 after it was formed, e.g. reports that arrived late. The helpers check they agree on them like on the partial reports.")
+	lateReportURI2     = flag.String("late_report_uri2", "", "Encrypted reports added to the batch of helper 2 after it was formed.")
+	expansionConfigURI = flag.String("expansion_config_uri", "", "URI for the expansion configurations with type query.HierarchicalConfig, query.MultiHierarchyConfig, query.DirectConfig or a single column of bucket IDs for the one-party design.")
 	epsilon            = flag.Float64("epsilon", 0.0, "Total privacy budget for the hierarchical query. For experiments, no noise will be added when epsilon is zero.")
 	keyBitSize         = flag.Int("key_bit_size", 32, "Bit size of the data bucket keys. Support up to 128 bit.")
 	resultDir          = flag.String("result_dir", "", "The directory where the final results will be saved. Helpers should only have writing permissions to this directory.")
 	aggType            = flag.String("agg_type", "conversion", "Aggregation type, should be 'conversion' or 'reach'.")
+	postFilter         = flag.String("post_filter", "", "Optional filter applied to the complete aggregation when the partial results are merged, in the format min_value=<floor>,top_k=<k>. The helpers record it in their result manifests, where the merger reads it.")
+
+	batchMetadataURI1 = flag.String("batch_metadata_uri1", "", "Metadata of the partial reports of helper 1 with their key bit size, of type dpfaggregator.BatchMetadata. The helper reads the key bit size from it instead of --key_bit_size.")
+	batchMetadataURI2 = flag.String("batch_metadata_uri2", "", "Metadata of the partial reports of helper 2, as --batch_metadata_uri1.")
+
+	clientToken = flag.String("client_token", "", "Token identifying the query across retries of this tool, e.g. after a network failure. The query ID is derived from the token, and the helpers drop retries of a query submitted with the same token and parameters.")
+
+	acceptPartialEpsilon = flag.Bool("accept_partial_epsilon", false, "Run the query at the remaining privacy budget of the batch if the epsilon exceeds it, instead of failing. The helpers write a budget notice next to the results of a downgraded query.")
+
+	queryTemplate       = flag.String("query_template", "", "Name of a query template stored on helper 1. The template defines the partial reports, expansion configuration, epsilon, key bit size, result directory and post filter, which override the flags above.")
+	queryTemplateParams = flag.String("query_template_params", "", "Parameters of the query template in the format name1=value1,name2=value2, e.g. origin=example.com,start_date=2021-10-04,end_date=2021-10-10.")
 
 	impersonatedSvcAccount = flag.String("impersonated_svc_account", "", "Service account to impersonate, skipped if empty")
 
 	numWorkers = flag.Int("num_workers", 1, "Initial number of workers for Dataflow job")
 
+	batchReadyTime = flag.String("batch_ready_time", "", "Time in RFC 3339 format when the input batch was ready, which starts the end-to-end latency of the query. The current time is used if empty.")
+
 	version string // set by linker -X
 	build   string // set by linker -X
 )
 
+// applyQueryTemplate reads the query template from helper 1, and overrides the query flags with the instantiated
+// template.
+func applyQueryTemplate(client *http.Client, impersonatedSvcAccount string) error {
+	token, err := utils.GetAuthorizationToken(context.Background(), *helperAddress1, impersonatedSvcAccount)
+	if err != nil {
+		log.Infof("Couldn't get Auth Bearer IdToken: %s", err)
+	}
+	tmpl, err := querytemplate.ReadTemplate(client, strings.TrimSuffix(*helperAddress1, "/")+"/query_templates", token, *queryTemplate)
+	if err != nil {
+		return err
+	}
+	params, err := querytemplate.ParseParams(*queryTemplateParams)
+	if err != nil {
+		return err
+	}
+	instance, err := tmpl.Instantiate(params)
+	if err != nil {
+		return err
+	}
+	log.Infof("Query template %q instantiated with parameters %v", instance.Name, instance.Params)
+
+	*aggType = instance.AggregationType
+	*partialReportURI1 = instance.PartialReportURI1
+	*partialReportURI2 = instance.PartialReportURI2
+	*expansionConfigURI = instance.ExpandConfigURI
+	*epsilon = instance.TotalEpsilon
+	*keyBitSize = int(instance.KeyBitSize)
+	*resultDir = instance.ResultDir
+	*postFilter = instance.PostFilter
+	if instance.NumWorkers > 0 {
+		*numWorkers = int(instance.NumWorkers)
+	}
+	return nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -63,13 +117,12 @@ func main() {
 	log.Info("- Debugging enabled - \n")
 	log.Infof("Running querier simulator version: %v, build: %v\n", version, buildDate)
 
-	if *aggType == "" {
-		log.Exit("aggregation type empty")
-	}
-
 	ctx := context.Background()
 	client := retryablehttp.NewClient().StandardClient()
 	queryID := uuid.New()
+	if *clientToken != "" {
+		queryID = clienttoken.QueryID(*clientToken)
+	}
 
 	var (
 		token1, token2               string
@@ -81,6 +134,21 @@ func main() {
 		inputExist                   bool
 	)
 
+	if *queryTemplate != "" {
+		if err := applyQueryTemplate(client, *impersonatedSvcAccount); err != nil {
+			log.Exit(err)
+		}
+	}
+	if *aggType == "" {
+		log.Exit("aggregation type empty")
+	}
+	readyTime := time.Now().UTC()
+	if *batchReadyTime != "" {
+		if readyTime, err = time.Parse(time.RFC3339, *batchReadyTime); err != nil {
+			log.Exitf("invalid batch ready time: %v", err)
+		}
+	}
+
 	inputExist, err = utils.IsFileGlobExist(ctx, *partialReportURI1)
 	if err != nil {
 		log.Exit(err)
@@ -134,17 +202,33 @@ func main() {
 		defer pubsubClient2.Close()
 	}
 
+	// The helpers read the key bit size from the batch metadata if it is set.
+	keyBitSize1, keyBitSize2 := int32(*keyBitSize), int32(*keyBitSize)
+	if *batchMetadataURI1 != "" {
+		keyBitSize1 = 0
+	}
+	if *batchMetadataURI2 != "" {
+		keyBitSize2 = 0
+	}
+
 	// Request aggregation on helper1.
 	if err := utils.PublishRequest(ctx, pubsubClient1, topic1, &query.AggregateRequest{
 		AggregationType:   *aggType,
 		PartialReportURI:  *partialReportURI1,
+		LateReportURI:     *lateReportURI1,
 		ExpandConfigURI:   *expansionConfigURI,
 		TotalEpsilon:      *epsilon,
 		QueryID:           queryID,
 		PartnerSharedInfo: sharedInfo2,
 		ResultDir:         *resultDir,
-		KeyBitSize:        int32(*keyBitSize),
+		KeyBitSize:        keyBitSize1,
+		BatchMetadataURI:  *batchMetadataURI1,
 		NumWorkers:        int32(*numWorkers),
+		BatchReadyTime:    readyTime,
+
+		AcceptPartialEpsilon: *acceptPartialEpsilon,
+		ClientToken:          *clientToken,
+		PostFilter:           *postFilter,
 	}); err != nil {
 		log.Exit(err)
 	}
@@ -154,13 +238,20 @@ func main() {
 		if err := utils.PublishRequest(ctx, pubsubClient2, topic2, &query.AggregateRequest{
 			AggregationType:   *aggType,
 			PartialReportURI:  *partialReportURI2,
+			LateReportURI:     *lateReportURI2,
 			ExpandConfigURI:   *expansionConfigURI,
 			TotalEpsilon:      *epsilon,
 			QueryID:           queryID,
 			PartnerSharedInfo: sharedInfo1,
 			ResultDir:         *resultDir,
-			KeyBitSize:        int32(*keyBitSize),
+			KeyBitSize:        keyBitSize2,
+			BatchMetadataURI:  *batchMetadataURI2,
 			NumWorkers:        int32(*numWorkers),
+			BatchReadyTime:    readyTime,
+
+			AcceptPartialEpsilon: *acceptPartialEpsilon,
+			ClientToken:          *clientToken,
+			PostFilter:           *postFilter,
 		}); err != nil {
 			log.Exit(err)
 		}
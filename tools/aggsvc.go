@@ -0,0 +1,171 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary is the single entrypoint for the operator workflows of the aggregation service.
+//
+// Usage:
+// /path/to/aggsvc [--binary_dir=/path/to/binaries] <subcommand> [--flagfile=/path/to/common.flags] [flags...]
+//
+// Subcommands implemented by the single-purpose binaries are executed with the expanded flags, so the binaries need
+// to be installed in the binary directory, which by default is the directory of aggsvc.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	log "github.com/golang/glog"
+	"google.golang.org/protobuf/encoding/protojson"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/service/deployconfig"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttrace"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/subcommand"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+	"lukechampine.com/uint128"
+
+	cfgpb "github.com/google/privacy-sandbox-aggregation-service/service/aggregation_config_go_proto"
+)
+
+var binaryDir = flag.String("binary_dir", "", "Directory of the single-purpose binaries run by the subcommands. The directory of aggsvc is used if empty.")
+
+var commands = []*subcommand.Command{
+	{Name: "generate-keys", Description: "Create pairs of private and public keys for hybrid encryption.", Binary: "create_hybrid_key_pair"},
+	{Name: "key-ceremony", Description: "Generate key pairs on an air-gapped machine with the private keys split into operator shares, or recover the keys from the shares.", Binary: "key_ceremony"},
+	{Name: "simulate", Description: "Create encrypted reports from raw conversions and send them to a collector.", Binary: "browser_simulator"},
+	{Name: "aggregate-dpf", Description: "Decrypt and aggregate the partial reports with the DPF protocol.", Binary: "dpf_aggregate_partial_report_pipeline"},
+	{Name: "aggregate-conversion", Description: "Decrypt and aggregate the reports for the one-party design.", Binary: "oneparty_aggregate_report_pipeline"},
+	{Name: "merge", Description: "Merge the partial histograms from two helpers.", Binary: "dpf_merge_partial_aggregation_pipeline"},
+	{Name: "pairing-test", Description: "Certify a pairing of two helpers by aggregating a fixed test batch through both and checking the exact results.", Binary: "helper_pairing"},
+	{Name: "archive", Description: "Export the specification and results of a query into a portable archive, or verify and import an archive.", Binary: "query_archive"},
+	{Name: "verify-result", Description: "Verify the signed manifests, parameters, record counts and sampled share combinations of a merged result.", Binary: "verify_result"},
+	{Name: "validate", Description: "Validate an aggregation config.", Run: validate},
+	{Name: "inspect", Description: "Print a partial histogram or the expansion statistics of a level.", Run: inspect},
+	{Name: "trace", Description: "Recombine the report traces from two helpers into the values the sampled reports contributed at each level.", Run: combineTraces},
+}
+
+func validate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configFile := fs.String("config_file", "", "Input file of the AggregationConfig proto in the JSON format.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	b, err := utils.ReadBytes(ctx, *configFile)
+	if err != nil {
+		return err
+	}
+	cfg := &cfgpb.AggregationConfig{}
+	if err := protojson.Unmarshal(b, cfg); err != nil {
+		return err
+	}
+	if err := deployconfig.Validate(cfg); err != nil {
+		return err
+	}
+	fmt.Printf("%s: OK\n", *configFile)
+	return nil
+}
+
+func inspect(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	partialHistogramURI := fs.String("partial_histogram_uri", "", "Partial histogram to print, one bucket per line.")
+	expansionStatsURI := fs.String("expansion_stats_uri", "", "Expansion statistics to print.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	switch {
+	case *partialHistogramURI != "":
+		histogram, err := dpfaggregator.ReadPartialHistogram(ctx, *partialHistogramURI)
+		if err != nil {
+			return err
+		}
+		var ids []uint128.Uint128
+		for id := range histogram {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i].Cmp(ids[j]) < 0 })
+		for _, id := range ids {
+			fmt.Printf("%s,%d\n", id.String(), histogram[id].GetPartialSum())
+		}
+		return nil
+	case *expansionStatsURI != "":
+		stats, err := dpfaggregator.ReadExpansionStatistics(ctx, *expansionStatsURI)
+		if err != nil {
+			return err
+		}
+		b, err := protojson.MarshalOptions{Multiline: true}.Marshal(stats)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	default:
+		return errors.New("either --partial_histogram_uri or --expansion_stats_uri should be set")
+	}
+}
+
+func combineTraces(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("trace", flag.ContinueOnError)
+	traceURI1 := fs.String("trace_uri1", "", "Trace records of the sampled reports from helper 1.")
+	traceURI2 := fs.String("trace_uri2", "", "Trace records of the sampled reports from helper 2.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *traceURI1 == "" || *traceURI2 == "" {
+		return errors.New("both --trace_uri1 and --trace_uri2 should be set")
+	}
+
+	var traces [][]*reporttrace.Record
+	for _, uri := range []string{*traceURI1, *traceURI2} {
+		records, err := reporttrace.ReadRecords(ctx, uri)
+		if err != nil {
+			return err
+		}
+		// Decryption is traced by each helper alone, so only the unusual cases are reported.
+		for _, r := range records {
+			if r.Stage == reporttrace.StageDecrypt && (r.Error != "" || r.Fallback) {
+				log.Warningf("%s: report %q decrypted with key %q, fallback %v, error %q", uri, r.ReportID, r.KeyID, r.Fallback, r.Error)
+			}
+		}
+		traces = append(traces, records)
+	}
+	for _, c := range reporttrace.Combine(traces[0], traces[1]) {
+		fmt.Printf("%s,%d,%d,%d,%v\n", c.ReportID, c.Level, c.Buckets, c.Value, c.Missing)
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		subcommand.Usage(flag.CommandLine.Output(), "aggsvc", commands)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	dir := *binaryDir
+	if dir == "" {
+		dir = subcommand.ExecutableDir()
+	}
+	if err := subcommand.Dispatch(context.Background(), commands, dir, flag.Args()); err != nil {
+		if errors.Is(err, subcommand.ErrUnknownCommand) {
+			flag.Usage()
+		}
+		log.Error(err)
+		os.Exit(subcommand.ExitCode(err))
+	}
+}
@@ -45,6 +45,7 @@ var (
 	helperPublicKeysURI1 = flag.String("helper_public_keys_uri1", "", "A file that contains the public encryption key from helper1.")
 	helperPublicKeysURI2 = flag.String("helper_public_keys_uri2", "", "A file that contains the public encryption key from helper2. Ignore to use the one-party protocol.")
 	keyBitSize           = flag.Int("key_bit_size", 32, "Bit size of the conversion keys.")
+	hierarchyGranularity = flag.Int("hierarchy_granularity", 1, "Number of bits between two adjacent hierarchies in the DPF keys. The prefix lengths in the expansion config should be multiples of it.")
 	conversionURI        = flag.String("conversion_uri", "", "Input raw conversion data.")
 	conversionRaw        = flag.String("conversion_raw", "2684354560,20", "Raw conversion.")
 	sendCount            = flag.Int("send_count", 1, "How many times to send each conversion.")
@@ -137,12 +138,13 @@ func main() {
 			)
 			if isMPC {
 				report, err = dpfdataconverter.GenerateBrowserReport(&dpfdataconverter.GenerateBrowserReportParams{
-					RawReport:     c,
-					KeyBitSize:    *keyBitSize,
-					PublicKeys1:   helperPubKeys1,
-					PublicKeys2:   helperPubKeys2,
-					SharedInfo:    string(sharedInfo),
-					EncryptOutput: *encryptOutput,
+					RawReport:            c,
+					KeyBitSize:           *keyBitSize,
+					HierarchyGranularity: *hierarchyGranularity,
+					PublicKeys1:          helperPubKeys1,
+					PublicKeys2:          helperPubKeys2,
+					SharedInfo:           string(sharedInfo),
+					EncryptOutput:        *encryptOutput,
 				})
 			} else {
 				report, err = onepartydataconverter.GenerateBrowserReport(&onepartydataconverter.GenerateBrowserReportParams{
@@ -18,6 +18,7 @@ package main
 import (
 	"context"
 	"flag"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
@@ -32,6 +33,7 @@ var (
 	keyCount           = flag.Int("key_count", 10, "Count of key pairs to generate.")
 	maxAge             = flag.Int("max_age", 604800, "The maximum age in seconds for the cache control. The default is 7 days.")
 	versionID          = flag.String("version_id", "", "Version of the key pairs.")
+	keyLifetime        = flag.Duration("key_lifetime", 0, "Lifetime of the private keys, after which they are not tried for reports with missing or wrong key IDs. Zero means the keys do not expire.")
 	publicKeyInfoFile  = flag.String("public_key_info_file", "", "Output file that contains the public keys and related info.")
 	privateKeyInfoFile = flag.String("private_key_info_file", "", "Output file that includes information about how to get the private keys.")
 )
@@ -49,6 +51,15 @@ func main() {
 		log.Warning("non-encrypted private key should be stored only for testing")
 	}
 
+	var expireTime time.Time
+	if *keyLifetime > 0 {
+		expireTime = time.Now().Add(*keyLifetime).UTC()
+		// Publish the expiry with the public keys, so the report generators stop using them in time.
+		for i := range pubInfo.Keys {
+			pubInfo.Keys[i].ExpireTime = &expireTime
+		}
+	}
+
 	privInfo := make(map[string]*cryptoio.ReadStandardPrivateKeyParams)
 	for keyID, key := range privKeys {
 		privKeyFile := utils.JoinPath(*privateKeyDir, keyID)
@@ -67,6 +78,8 @@ func main() {
 			KMSCredentialPath: *kmsCredentialFile,
 			SecretName:        secretName,
 			FilePath:          privKeyFile,
+			ExpireTime:        expireTime,
+			Purpose:           cryptoio.PurposeReportDecryption,
 		}
 	}
 
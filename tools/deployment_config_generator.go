@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary renders the deployment specs of an aggregator helper from the aggregation config.
+//
+// The input is an AggregationConfig proto in the JSON format. The outputs are the Kubernetes manifests, the flags of
+// the aggregator server, the Dataflow runtime environment and the list of IAM bindings, written into the output
+// directory.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"strings"
+
+	log "github.com/golang/glog"
+	"google.golang.org/protobuf/encoding/protojson"
+	"github.com/google/privacy-sandbox-aggregation-service/service/deployconfig"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+
+	pb "github.com/google/privacy-sandbox-aggregation-service/service/aggregation_config_go_proto"
+)
+
+var (
+	configFile = flag.String("config_file", "", "Input file of the AggregationConfig proto in the JSON format.")
+	outputDir  = flag.String("output_dir", "", "Output directory for the generated deployment specs.")
+)
+
+const (
+	kubernetesManifestsFile = "kubernetes_manifests.json"
+	serverFlagsFile         = "aggregator_server.flags"
+	dataflowEnvironmentFile = "dataflow_environment.json"
+	iamBindingsFile         = "iam_bindings.json"
+)
+
+func writeJSON(ctx context.Context, v interface{}, filename string) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteBytes(ctx, b, filename, nil)
+}
+
+func main() {
+	flag.Parse()
+
+	ctx := context.Background()
+	b, err := utils.ReadBytes(ctx, *configFile)
+	if err != nil {
+		log.Exit(err)
+	}
+	cfg := &pb.AggregationConfig{}
+	if err := protojson.Unmarshal(b, cfg); err != nil {
+		log.Exit(err)
+	}
+
+	deployment, err := deployconfig.Render(cfg)
+	if err != nil {
+		log.Exit(err)
+	}
+
+	if err := utils.WriteBytes(ctx, deployment.KubernetesManifests, utils.JoinPath(*outputDir, kubernetesManifestsFile), nil); err != nil {
+		log.Exit(err)
+	}
+	if err := utils.WriteBytes(ctx, []byte(strings.Join(deployment.Flags, "\n")+"\n"), utils.JoinPath(*outputDir, serverFlagsFile), nil); err != nil {
+		log.Exit(err)
+	}
+	if deployment.DataflowEnvironment != nil {
+		if err := writeJSON(ctx, deployment.DataflowEnvironment, utils.JoinPath(*outputDir, dataflowEnvironmentFile)); err != nil {
+			log.Exit(err)
+		}
+	}
+	if err := writeJSON(ctx, deployment.IAMBindings, utils.JoinPath(*outputDir, iamBindingsFile)); err != nil {
+		log.Exit(err)
+	}
+	log.Infof("deployment specs for origin %q written to %s", cfg.GetOrigin(), *outputDir)
+}
@@ -20,6 +20,12 @@
 // --partial_histogram_file1=/path/to/partial_histogram_file1.txt \
 // --partial_histogram_file2=/path/to/partial_histogram_file2.txt \
 // --complete_hisgogram_file=/path/to/complete_histogram_file.txt \
+// --bucket_annotation_uri=/path/to/bucket_annotation_file.txt \
+// --partial_manifest_uri1=/path/to/partial_histogram_manifest1.json \
+// --partial_manifest_uri2=/path/to/partial_histogram_manifest2.json \
+// --manifest_uri=/path/to/complete_histogram_manifest.json \
+// --query_id=<query ID> \
+// --latency_slo_urls=https://<helper1>/latency_slo,https://<helper2>/latency_slo \
 // --runner=direct
 //
 // 2. Dataflow on cloud
@@ -32,17 +38,28 @@
 // --temp_location=gs://<dataflow temp dir> \
 // --staging_location=gs://<dataflow temp dir> \
 // --worker_binary=/path/to/dpf_merge_partial_aggregation_pipeline
+//
+// On failure, the binary exits with the code of the failure class documented in package failurereport, and writes
+// the failure report to '--failure_report_uri' if set.
 
 package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/log"
 	"github.com/apache/beam/sdks/go/pkg/beam/x/beamx"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/failurereport"
+	"github.com/google/privacy-sandbox-aggregation-service/service/latencyslo"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
 	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
 )
 
@@ -50,8 +67,52 @@ var (
 	partialHistogramURI1 = flag.String("partial_histogram_uri1", "", "Input partial histogram from helper 1.")
 	partialHistogramURI2 = flag.String("partial_histogram_uri2", "", "Input partial histogram from helper 2.")
 	completeHistogramURI = flag.String("complete_histogram_uri", "", "Output complete aggregation.")
+	bucketAnnotationURI  = flag.String("bucket_annotation_uri", "", "Optional input file that maps bucket IDs to labels, with lines of format: bucket ID, label1, label2, ... The labels are appended to the matched buckets in the output.")
+	partialManifestURI1  = flag.String("partial_manifest_uri1", "", "Optional result manifest of the partial histogram from helper 1, which records the post filter of the query.")
+	partialManifestURI2  = flag.String("partial_manifest_uri2", "", "Optional result manifest of the partial histogram from helper 2, required with --partial_manifest_uri1.")
+	postFilter           = flag.String("post_filter", "", "Optional filter applied to the complete aggregation, in the format min_value=<floor>,top_k=<k>. Buckets with sums below the floor are dropped, and only the k buckets with the largest sums are kept. The filter of the query is read from the partial manifests if set, and must agree with this flag if both are set.")
+	manifestURI          = flag.String("manifest_uri", "", "Optional output manifest with the hashes of the complete aggregation files and the applied post filter.")
+
+	queryID         = flag.String("query_id", "", "ID of the query whose results are merged, which is recorded in the output manifest and required for reporting the latency.")
+	latencySLOURLs  = flag.String("latency_slo_urls", "", "Optional comma-separated latency SLO endpoints of the helpers, e.g. https://<helper>/latency_slo, where the merge step of the query is recorded.")
+	impersonatedSvc = flag.String("impersonated_svc_account", "", "Service account to impersonate when reporting the latency, skipped if empty.")
+
+	failureReportURI = flag.String("failure_report_uri", "", "Output location of the JSON failure report written when the binary fails.")
 )
 
+// resolvePostFilter returns the post filter of the query recorded in the manifests of the partial histograms, which
+// must agree with each other and with --post_filter if set. The filter of the flag is used without the manifests.
+func resolvePostFilter(ctx context.Context) (*dpfaggregator.PostFilter, error) {
+	filter, err := resolvePostFilter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if *partialManifestURI1 == "" && *partialManifestURI2 == "" {
+		return filter, nil
+	}
+	if *partialManifestURI1 == "" || *partialManifestURI2 == "" {
+		return nil, errors.New("expect manifests of both partial histograms")
+	}
+	var recorded []string
+	for _, uri := range []string{*partialManifestURI1, *partialManifestURI2} {
+		signed, err := resultmanifest.Read(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+		if signed.Manifest == nil {
+			return nil, fmt.Errorf("empty manifest %q", uri)
+		}
+		recorded = append(recorded, signed.Manifest.PostFilter)
+	}
+	if recorded[0] != recorded[1] {
+		return nil, fmt.Errorf("helpers recorded different post filters %q and %q", recorded[0], recorded[1])
+	}
+	if filter != nil && filter.String() != recorded[0] {
+		return nil, fmt.Errorf("post filter %q disagrees with %q of the query", filter.String(), recorded[0])
+	}
+	return dpfaggregator.ParsePostFilter(recorded[0])
+}
+
 func main() {
 	flag.Parse()
 
@@ -61,22 +122,52 @@ func main() {
 	scope := pipeline.Root()
 
 	ctx := context.Background()
+	reporter := &failurereport.Reporter{Binary: "dpf_merge_partial_aggregation_pipeline", URI: *failureReportURI}
 
-	inputExist, err := utils.IsFileGlobExist(ctx, *partialHistogramURI1)
-	if err != nil {
-		log.Exit(ctx, err)
-	} else if !inputExist {
-		log.Exitf(ctx, "input not found: %q", *partialHistogramURI1)
+	for _, uri := range []string{*partialHistogramURI1, *partialHistogramURI2} {
+		inputExist, err := utils.IsFileGlobExist(ctx, uri)
+		if err != nil {
+			reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInputNotFound, failurereport.StageReadInput, uri, err))
+		} else if !inputExist {
+			reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassInputNotFound, failurereport.StageReadInput, uri, fmt.Errorf("input not found: %q", uri)))
+		}
 	}
-	inputExist, err = utils.IsFileGlobExist(ctx, *partialHistogramURI2)
+
+	filter, err := dpfaggregator.ParsePostFilter(*postFilter)
 	if err != nil {
-		log.Exit(ctx, err)
-	} else if !inputExist {
-		log.Exitf(ctx, "input not found: %q", *partialHistogramURI2)
+		reporter.Exit(ctx, failurereport.Wrap(failurereport.ClassInvalidArgument, failurereport.StageValidate, err))
 	}
 
-	dpfaggregator.MergePartialHistogram(scope, *partialHistogramURI1, *partialHistogramURI2, *completeHistogramURI)
+	dpfaggregator.MergePartialHistogramWithAnnotation(scope, *partialHistogramURI1, *partialHistogramURI2, *bucketAnnotationURI, filter, *completeHistogramURI)
 	if err := beamx.Run(ctx, pipeline); err != nil {
-		log.Exitf(ctx, "Failed to execute job: %s", err)
+		reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassPipelineFailed, failurereport.StageRunPipeline, *partialHistogramURI1, fmt.Errorf("failed to execute job: %v", err)))
+	}
+
+	if *manifestURI != "" {
+		files, err := resultmanifest.HashFiles(ctx, *completeHistogramURI+"*")
+		if err != nil {
+			reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassOutputFailed, failurereport.StageWriteManifest, *completeHistogramURI, err))
+		}
+		manifest := &resultmanifest.Manifest{QueryID: *queryID, ResultURI: *completeHistogramURI, Files: files}
+		if filter != nil {
+			manifest.PostFilter = filter.String()
+		}
+		if err := resultmanifest.Write(ctx, &resultmanifest.SignedManifest{Manifest: manifest}, *manifestURI); err != nil {
+			reporter.Exit(ctx, failurereport.WrapURI(failurereport.ClassOutputFailed, failurereport.StageWriteManifest, *manifestURI, err))
+		}
+	}
+
+	if *latencySLOURLs != "" && *queryID != "" {
+		record := &latencyslo.StepRecord{QueryID: *queryID, Step: latencyslo.StepMerged, Time: time.Now().UTC()}
+		for _, url := range strings.Split(*latencySLOURLs, ",") {
+			token, err := utils.GetAuthorizationToken(ctx, url, *impersonatedSvc)
+			if err != nil {
+				log.Infof(ctx, "Couldn't get Auth Bearer IdToken: %s", err)
+			}
+			// The results are already merged, so failing to report the latency is not fatal.
+			if err := latencyslo.ReportStep(http.DefaultClient, url, token, record); err != nil {
+				log.Warn(ctx, err)
+			}
+		}
 	}
 }
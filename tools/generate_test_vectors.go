@@ -0,0 +1,105 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary generates the canonical test vectors of the DPF protocol, which are checked in as
+// test/testdata/canonical_vectors.json for other implementations of the helpers to validate against.
+//
+// The reports cover the edges of the bucket domain, buckets that share prefixes and values that overflow when the
+// secret shares are summed. The vectors are only regenerated when the protocol changes. Passing the published file as
+// '--helper_keys_uri' keeps the helper keys fixed across generations, but the DPF keys and the encryption are random,
+// so the encrypted reports and the expected DPF keys change every time.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"strconv"
+	"strings"
+
+	log "github.com/golang/glog"
+	"lukechampine.com/uint128"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelinetypes"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/reporttypes"
+	"github.com/google/privacy-sandbox-aggregation-service/test/testvectors"
+)
+
+var (
+	outputURI     = flag.String("output_uri", "", "Output JSON file of the test vectors.")
+	keyBitSize    = flag.Int("key_bit_size", 16, "Bit size of the bucket IDs.")
+	levels        = flag.String("levels", "3,9,15", "Levels of the hierarchical query that the DPF keys are expanded at, separated by commas.")
+	helperKeysURI = flag.String("helper_keys_uri", "", "Vector file whose helper keys encrypt the reports, usually the published test/testdata/canonical_vectors.json. New helper keys are generated if empty.")
+)
+
+func parseLevels(s string) ([]int32, error) {
+	var parsed []int32
+	for _, level := range strings.Split(s, ",") {
+		l, err := strconv.ParseInt(strings.TrimSpace(level), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, int32(l))
+	}
+	return parsed, nil
+}
+
+func main() {
+	flag.Parse()
+	if *outputURI == "" {
+		log.Exit("expect non-empty --output_uri")
+	}
+	parsedLevels, err := parseLevels(*levels)
+	if err != nil {
+		log.Exit(err)
+	}
+
+	maxBucket := uint128.From64(1).Lsh(uint(*keyBitSize)).Sub64(1)
+	reports := []*testvectors.Report{
+		{Name: "first bucket", Report: pipelinetypes.RawReport{Bucket: uint128.Zero, Value: 1}},
+		{Name: "last bucket", Report: pipelinetypes.RawReport{Bucket: maxBucket, Value: 1}},
+		{Name: "shared prefix low", Report: pipelinetypes.RawReport{Bucket: maxBucket.Rsh(1).Sub64(1), Value: 7}},
+		{Name: "shared prefix high", Report: pipelinetypes.RawReport{Bucket: maxBucket.Rsh(1), Value: 9}},
+		{Name: "large value", Report: pipelinetypes.RawReport{Bucket: maxBucket.Rsh(2), Value: 1<<64 - 1}},
+	}
+	sharedInfo, err := json.Marshal(&reporttypes.SharedInfo{
+		ScheduledReportTime: "1630000000",
+		PrivacyBudgetKey:    "test-vectors",
+		Version:             "0.1",
+		ReportID:            "00000000-0000-4000-8000-000000000000",
+		ReportingOrigin:     "https://reporter.example",
+	})
+	if err != nil {
+		log.Exit(err)
+	}
+
+	var helperKeys [2]*testvectors.HelperKey
+	if *helperKeysURI != "" {
+		published, err := testvectors.ReadFile(context.Background(), *helperKeysURI)
+		if err != nil {
+			log.Exit(err)
+		}
+		helperKeys = published.HelperKeys
+	}
+	vectors, err := testvectors.Generate(*keyBitSize, parsedLevels, reports, string(sharedInfo), helperKeys)
+	if err != nil {
+		log.Exit(err)
+	}
+	// The vectors are checked before they are written, so a broken build does not publish them.
+	if err := testvectors.Check(vectors); err != nil {
+		log.Exit(err)
+	}
+	if err := testvectors.WriteFile(context.Background(), vectors, *outputURI); err != nil {
+		log.Exit(err)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary certifies a pairing of two independently deployed helpers before it receives production traffic.
+//
+// It encrypts the fixed test batch of the pairingtest package with the public keys of the helpers, requests a
+// hierarchical query without noise on both helpers through the same shared info and PubSub flow as the
+// aggregation_query_tool, waits for the final partial results in the result directory, and checks that the merged
+// results match the expected histogram byte for byte. The outcome is written as a JSON report, and the binary exits
+// with a nonzero code if the pairing fails.
+//
+// The helpers must be able to read the test inputs and write to the result directory. The test batch is flagged as a
+// debug batch in batch metadata signed with --batch_signing_key_uri, whose public key the helpers must trust.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"cloud.google.com/go/pubsub"
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/pborman/uuid"
+	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/pipelineutils"
+	"github.com/google/privacy-sandbox-aggregation-service/service/aggregatorservice"
+	"github.com/google/privacy-sandbox-aggregation-service/service/batchintegrity"
+	"github.com/google/privacy-sandbox-aggregation-service/service/query"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+	"github.com/google/privacy-sandbox-aggregation-service/test/pairingtest"
+)
+
+var (
+	helperAddress1       = flag.String("helper_address1", "", "Address of helper 1.")
+	helperAddress2       = flag.String("helper_address2", "", "Address of helper 2.")
+	helperPublicKeysURI1 = flag.String("helper_public_keys_uri1", "", "A file that contains the public encryption keys from helper 1.")
+	helperPublicKeysURI2 = flag.String("helper_public_keys_uri2", "", "A file that contains the public encryption keys from helper 2.")
+	partialReportURI1    = flag.String("partial_report_uri1", "", "Output of the test partial reports for helper 1, which must be readable by helper 1.")
+	partialReportURI2    = flag.String("partial_report_uri2", "", "Output of the test partial reports for helper 2, which must be readable by helper 2.")
+	expansionConfigURI   = flag.String("expansion_config_uri", "", "Output of the hierarchical query configuration of the test, which must be readable by both helpers.")
+	batchMetadataURI1    = flag.String("batch_metadata_uri1", "", "Output of the signed metadata of the test batch for helper 1, which must be readable by helper 1.")
+	batchMetadataURI2    = flag.String("batch_metadata_uri2", "", "Output of the signed metadata of the test batch for helper 2, which must be readable by helper 2.")
+	batchSigningKeyURI   = flag.String("batch_signing_key_uri", "", "File of the base64-encoded Ed25519 seed of a batcher trusted by both helpers, which signs the batch metadata.")
+	resultDir            = flag.String("result_dir", "", "The directory where the helpers write the final partial results of the test.")
+	reportURI            = flag.String("report_uri", "", "Output of the JSON report of the test. The report is only logged if empty.")
+
+	impersonatedSvcAccount = flag.String("impersonated_svc_account", "", "Service account to impersonate, skipped if empty")
+
+	timeout      = flag.Duration("timeout", time.Hour, "Time to wait for the final partial results of both helpers.")
+	pollInterval = flag.Duration("poll_interval", 30*time.Second, "Interval of checking for the final partial results.")
+
+	version string // set by linker -X
+	build   string // set by linker -X
+)
+
+// helper is the coordination endpoint of a helper under test.
+type helper struct {
+	sharedInfo   *query.HelperSharedInfo
+	pubsubClient *pubsub.Client
+	topic        string
+}
+
+func connectHelper(ctx context.Context, client *http.Client, address string) (*helper, error) {
+	token, err := utils.GetAuthorizationToken(ctx, address, *impersonatedSvcAccount)
+	if err != nil {
+		log.Infof("Couldn't get Auth Bearer IdToken: %s", err)
+	}
+	sharedInfo, err := aggregatorservice.ReadHelperSharedInfo(client, address, token)
+	if err != nil {
+		return nil, err
+	}
+	project, topic, err := utils.ParsePubSubResourceName(sharedInfo.PubSubTopic)
+	if err != nil {
+		return nil, err
+	}
+	pubsubClient, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	return &helper{sharedInfo: sharedInfo, pubsubClient: pubsubClient, topic: topic}, nil
+}
+
+func (h *helper) request(ctx context.Context, queryID, partialReportURI, batchMetadataURI string, partner *helper) error {
+	return utils.PublishRequest(ctx, h.pubsubClient, h.topic, &query.AggregateRequest{
+		AggregationType:   "conversion",
+		PartialReportURI:  partialReportURI,
+		ExpandConfigURI:   *expansionConfigURI,
+		TotalEpsilon:      0,
+		QueryID:           queryID,
+		PartnerSharedInfo: partner.sharedInfo,
+		ResultDir:         *resultDir,
+		KeyBitSize:        pairingtest.KeyBitSize,
+		NumWorkers:        1,
+		BatchMetadataURI:  batchMetadataURI,
+		DebugBatch:        true,
+		BatchReadyTime:    time.Now().UTC(),
+	})
+}
+
+// writeDebugBatchMetadata writes the metadata of the test batch, which is signed so the helpers trust its debug flag for
+// the reports in reportURI.
+func writeDebugBatchMetadata(ctx context.Context, reportURI string, uris ...string) error {
+	digest, err := batchintegrity.DigestReports(ctx, pipelineutils.AddStrInPath(reportURI, "*"))
+	if err != nil {
+		return err
+	}
+	encoded, err := utils.ReadBytes(ctx, *batchSigningKeyURI)
+	if err != nil {
+		return err
+	}
+	key, err := resultmanifest.ParsePrivateKey(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return err
+	}
+	metadata := &dpfaggregator.BatchMetadata{KeyBitSize: pairingtest.KeyBitSize, DebugBatch: true, BatchRoot: digest.Root()}
+	if err := dpfaggregator.SignBatchMetadata(metadata, key); err != nil {
+		return err
+	}
+	for _, uri := range uris {
+		if err := dpfaggregator.WriteBatchMetadata(ctx, metadata, uri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForResults waits until the final partial results of both helpers exist.
+func waitForResults(ctx context.Context, resultURIs ...string) error {
+	deadline := time.Now().Add(*timeout)
+	for _, uri := range resultURIs {
+		for {
+			exist, err := utils.IsFileGlobExist(ctx, uri)
+			if err != nil {
+				return err
+			}
+			if exist {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out after %v waiting for result %q", *timeout, uri)
+			}
+			time.Sleep(*pollInterval)
+		}
+	}
+	return nil
+}
+
+func runPairingTest(ctx context.Context, result *pairingtest.Result) error {
+	publicKeys1, err := cryptoio.ReadPublicKeys(ctx, *helperPublicKeysURI1)
+	if err != nil {
+		return err
+	}
+	publicKeys2, err := cryptoio.ReadPublicKeys(ctx, *helperPublicKeysURI2)
+	if err != nil {
+		return err
+	}
+	if err := pairingtest.WriteReports(ctx, publicKeys1, publicKeys2, *partialReportURI1, *partialReportURI2); err != nil {
+		return err
+	}
+	if err := query.WriteHierarchicalConfigFile(ctx, pairingtest.Config(), *expansionConfigURI); err != nil {
+		return err
+	}
+	if err := writeDebugBatchMetadata(ctx, *partialReportURI1, *batchMetadataURI1, *batchMetadataURI2); err != nil {
+		return err
+	}
+
+	client := retryablehttp.NewClient().StandardClient()
+	helper1, err := connectHelper(ctx, client, *helperAddress1)
+	if err != nil {
+		return err
+	}
+	defer helper1.pubsubClient.Close()
+	helper2, err := connectHelper(ctx, client, *helperAddress2)
+	if err != nil {
+		return err
+	}
+	defer helper2.pubsubClient.Close()
+	result.Origin1, result.Origin2 = helper1.sharedInfo.Origin, helper2.sharedInfo.Origin
+
+	if err := helper1.request(ctx, result.QueryID, *partialReportURI1, *batchMetadataURI1, helper2); err != nil {
+		return err
+	}
+	if err := helper2.request(ctx, result.QueryID, *partialReportURI2, *batchMetadataURI2, helper1); err != nil {
+		return err
+	}
+	log.Infof("pairing test requested with query ID %q", result.QueryID)
+
+	resultURI1 := aggregatorservice.GetFinalPartialResultURI(*resultDir, result.QueryID, result.Origin1)
+	resultURI2 := aggregatorservice.GetFinalPartialResultURI(*resultDir, result.QueryID, result.Origin2)
+	if err := waitForResults(ctx, resultURI1, resultURI2); err != nil {
+		return err
+	}
+	return pairingtest.Verify(ctx, result, resultURI1, resultURI2)
+}
+
+func main() {
+	flag.Parse()
+	log.Infof("Running helper pairing test version: %v, build: %v\n", version, build)
+
+	for name, value := range map[string]string{
+		"helper_address1":         *helperAddress1,
+		"helper_address2":         *helperAddress2,
+		"helper_public_keys_uri1": *helperPublicKeysURI1,
+		"helper_public_keys_uri2": *helperPublicKeysURI2,
+		"partial_report_uri1":     *partialReportURI1,
+		"partial_report_uri2":     *partialReportURI2,
+		"expansion_config_uri":    *expansionConfigURI,
+		"batch_metadata_uri1":     *batchMetadataURI1,
+		"batch_metadata_uri2":     *batchMetadataURI2,
+		"batch_signing_key_uri":   *batchSigningKeyURI,
+		"result_dir":              *resultDir,
+	} {
+		if value == "" {
+			log.Exitf("--%s is required", name)
+		}
+	}
+
+	ctx := context.Background()
+	result := &pairingtest.Result{QueryID: pairingtest.QueryIDPrefix + uuid.New()}
+	if err := runPairingTest(ctx, result); err != nil {
+		log.Exitf("pairing test %q failed to run: %v", result.QueryID, err)
+	}
+
+	b, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Exit(err)
+	}
+	if *reportURI != "" {
+		if err := utils.WriteBytes(ctx, b, *reportURI, nil); err != nil {
+			log.Exit(err)
+		}
+	}
+	fmt.Println(string(b))
+	if !result.Passed {
+		log.Errorf("helpers %q and %q failed the pairing test with %d mismatches", result.Origin1, result.Origin2, len(result.Mismatches))
+		log.Flush()
+		os.Exit(1)
+	}
+	log.Infof("helpers %q and %q passed the pairing test", result.Origin1, result.Origin2)
+}
@@ -0,0 +1,269 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary runs the key ceremony for the helper key pairs with split knowledge.
+//
+// On an air-gapped machine, the binary generates the key pairs, splits each private key into Shamir shares for the
+// operators, and writes the public keys for publication with the fingerprints of all keys:
+// /path/to/key_ceremony --output_dir=/path/to/ceremony --operator_count=5 --threshold=3
+//
+// Later, a threshold number of operators bring their shares to recover the private keys, which are checked against
+// the fingerprints and saved in the same way as create_hybrid_key_pair:
+// /path/to/key_ceremony --combine_share_files=/path/to/share1,/path/to/share2,/path/to/share3 --private_key_info_file=...
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/google/privacy-sandbox-aggregation-service/encryption/cryptoio"
+	"github.com/google/privacy-sandbox-aggregation-service/encryption/shamir"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+
+	pb "github.com/google/privacy-sandbox-aggregation-service/encryption/crypto_go_proto"
+)
+
+var (
+	keyCount      = flag.Int("key_count", 10, "Count of key pairs to generate.")
+	operatorCount = flag.Int("operator_count", 3, "Number of operators who each receive one share of every private key.")
+	threshold     = flag.Int("threshold", 2, "Number of operator shares required to recover the private keys.")
+	outputDir     = flag.String("output_dir", "", "Output directory on the air-gapped machine for the operator shares, the public keys and the fingerprints.")
+	maxAge        = flag.Int("max_age", 604800, "The maximum age in seconds for the cache control of the public keys. The default is 7 days.")
+
+	combineShareFiles  = flag.String("combine_share_files", "", "Comma-separated operator share files to recover the private keys from. The key pairs are generated if empty.")
+	kmsKeyURI          = flag.String("kms_key_uri", "", "Key URI of the GCP KMS service for the recovered private keys.")
+	kmsCredentialFile  = flag.String("kms_credential_file", "", "Path of the JSON file that stores the credential information for the KMS service.")
+	secretProjectID    = flag.String("secret_project_id", "", "ID of the GCP project that provides the SecretManager service.")
+	privateKeyDir      = flag.String("private_key_dir", "", "Output directory for the recovered private keys.")
+	keyLifetime        = flag.Duration("key_lifetime", 0, "Lifetime of the recovered private keys, after which they are not tried for reports with missing or wrong key IDs. Zero means the keys do not expire.")
+	privateKeyInfoFile = flag.String("private_key_info_file", "", "Output file that includes information about how to get the recovered private keys.")
+)
+
+const (
+	publicKeysFile   = "public_keys.json"
+	fingerprintsFile = "fingerprints.txt"
+)
+
+// keyShare is the share of a private key held by an operator.
+type keyShare struct {
+	X     byte
+	Share string
+	// Fingerprints of the private and public keys, to verify the recovered keys and match them with the published ones.
+	PrivateKeyFingerprint string
+	PublicKeyFingerprint  string
+}
+
+// operatorShares contains the shares of all the private keys held by an operator.
+type operatorShares struct {
+	Operator  int
+	Threshold int
+	Keys      map[string]*keyShare
+}
+
+// fingerprint formats the SHA-256 hash of the key in groups of four hex digits, so the operators can compare them
+// by reading aloud.
+func fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	h := hex.EncodeToString(sum[:])
+	var groups []string
+	for i := 0; i < len(h); i += 4 {
+		groups = append(groups, h[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+func operatorShareFile(dir string, operator int) string {
+	return utils.JoinPath(dir, fmt.Sprintf("operator_%d_shares.json", operator))
+}
+
+func generate(ctx context.Context) error {
+	if *outputDir == "" {
+		return errors.New("--output_dir is required")
+	}
+	privKeys, pubInfo, err := cryptoio.GenerateHybridKeyPairs(ctx, *keyCount)
+	if err != nil {
+		return err
+	}
+
+	operators := make([]*operatorShares, *operatorCount)
+	for i := range operators {
+		operators[i] = &operatorShares{Operator: i + 1, Threshold: *threshold, Keys: make(map[string]*keyShare)}
+	}
+	var lines []string
+	for _, pub := range pubInfo.Keys {
+		pubKey, err := base64.StdEncoding.DecodeString(pub.Key)
+		if err != nil {
+			return err
+		}
+		privKey := privKeys[pub.ID].Key
+		shares, err := shamir.Split(privKey, *operatorCount, *threshold)
+		if err != nil {
+			return err
+		}
+		privFingerprint, pubFingerprint := fingerprint(privKey), fingerprint(pubKey)
+		for i, share := range shares {
+			operators[i].Keys[pub.ID] = &keyShare{
+				X:                     share.X,
+				Share:                 base64.StdEncoding.EncodeToString(share.Data),
+				PrivateKeyFingerprint: privFingerprint,
+				PublicKeyFingerprint:  pubFingerprint,
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%s\tpublic: %s\tprivate: %s", pub.ID, pubFingerprint, privFingerprint))
+	}
+	sort.Strings(lines)
+
+	for _, operator := range operators {
+		b, err := json.MarshalIndent(operator, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := utils.WriteBytes(ctx, b, operatorShareFile(*outputDir, operator.Operator), nil); err != nil {
+			return err
+		}
+	}
+	if err := cryptoio.SavePublicKeys(ctx, pubInfo, utils.JoinPath(*outputDir, publicKeysFile), *maxAge); err != nil {
+		return err
+	}
+	fingerprints := strings.Join(lines, "\n") + "\n"
+	if err := utils.WriteBytes(ctx, []byte(fingerprints), utils.JoinPath(*outputDir, fingerprintsFile), nil); err != nil {
+		return err
+	}
+
+	fmt.Printf("Generated %d key pairs with %d operator shares, %d of which recover the private keys.\n", len(pubInfo.Keys), *operatorCount, *threshold)
+	fmt.Print(fingerprints)
+	return nil
+}
+
+func readOperatorShares(ctx context.Context, uri string) (*operatorShares, error) {
+	b, err := utils.ReadBytes(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	shares := &operatorShares{}
+	if err := json.Unmarshal(b, shares); err != nil {
+		return nil, fmt.Errorf("failed to parse operator shares in %q: %v", uri, err)
+	}
+	return shares, nil
+}
+
+// recoverKeys recovers the private keys from the operator shares, and checks them against the fingerprints.
+func recoverKeys(operators []*operatorShares) (map[string]*pb.StandardPrivateKey, error) {
+	if len(operators) == 0 {
+		return nil, errors.New("no operator shares")
+	}
+	if got, want := len(operators), operators[0].Threshold; got < want {
+		return nil, fmt.Errorf("got shares from %d operators, need %d", got, want)
+	}
+
+	keys := make(map[string]*pb.StandardPrivateKey)
+	for keyID, first := range operators[0].Keys {
+		var shares []*shamir.Share
+		for _, operator := range operators {
+			ks, ok := operator.Keys[keyID]
+			if !ok {
+				return nil, fmt.Errorf("operator %d has no share for key %q", operator.Operator, keyID)
+			}
+			if ks.PrivateKeyFingerprint != first.PrivateKeyFingerprint {
+				return nil, fmt.Errorf("operators disagree on the fingerprint of key %q", keyID)
+			}
+			data, err := base64.StdEncoding.DecodeString(ks.Share)
+			if err != nil {
+				return nil, err
+			}
+			shares = append(shares, &shamir.Share{X: ks.X, Data: data})
+		}
+		key, err := shamir.Combine(shares)
+		if err != nil {
+			return nil, fmt.Errorf("failed to recover key %q: %v", keyID, err)
+		}
+		if got := fingerprint(key); got != first.PrivateKeyFingerprint {
+			return nil, fmt.Errorf("recovered key %q has fingerprint %s, want %s", keyID, got, first.PrivateKeyFingerprint)
+		}
+		keys[keyID] = &pb.StandardPrivateKey{Key: key}
+	}
+	return keys, nil
+}
+
+func combine(ctx context.Context) error {
+	var operators []*operatorShares
+	for _, uri := range strings.Split(*combineShareFiles, ",") {
+		shares, err := readOperatorShares(ctx, uri)
+		if err != nil {
+			return err
+		}
+		operators = append(operators, shares)
+	}
+	privKeys, err := recoverKeys(operators)
+	if err != nil {
+		return err
+	}
+
+	if *kmsKeyURI == "" {
+		log.Warning("non-encrypted private key should be stored only for testing")
+	}
+	var expireTime time.Time
+	if *keyLifetime > 0 {
+		expireTime = time.Now().Add(*keyLifetime).UTC()
+	}
+
+	privInfo := make(map[string]*cryptoio.ReadStandardPrivateKeyParams)
+	for keyID, key := range privKeys {
+		privKeyFile := utils.JoinPath(*privateKeyDir, keyID)
+		secretName, err := cryptoio.SaveStandardPrivateKey(ctx, &cryptoio.SaveStandardPrivateKeyParams{
+			KMSKeyURI:         *kmsKeyURI,
+			KMSCredentialPath: *kmsCredentialFile,
+			SecretProjectID:   *secretProjectID,
+			SecretID:          keyID,
+			FilePath:          privKeyFile,
+		}, key)
+		if err != nil {
+			return err
+		}
+		privInfo[keyID] = &cryptoio.ReadStandardPrivateKeyParams{
+			KMSKeyURI:         *kmsKeyURI,
+			KMSCredentialPath: *kmsCredentialFile,
+			SecretName:        secretName,
+			FilePath:          privKeyFile,
+			ExpireTime:        expireTime,
+		}
+		fmt.Printf("%s\tprivate: %s\n", keyID, fingerprint(key.Key))
+	}
+	return cryptoio.SavePrivateKeyParamsCollection(ctx, privInfo, *privateKeyInfoFile)
+}
+
+func main() {
+	flag.Parse()
+
+	ctx := context.Background()
+	run := generate
+	if *combineShareFiles != "" {
+		run = combine
+	}
+	if err := run(ctx); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
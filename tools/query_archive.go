@@ -0,0 +1,161 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary exports the complete record of a query into a portable archive, or imports and verifies an archive.
+//
+// To export the specification, parameters, manifests and results of a query, without any reports:
+// /path/to/query_archive --archive_uri=/path/to/query.tar \
+// --query_id=<query ID> \
+// --query_spec_file=/path/to/request_or_template.json \
+// --query_params=origin=example.com,start_date=2021-10-04 \
+// --expansion_config_uri=/path/to/expansion_config.json \
+// --result_manifest_uris=gs://<result bucket>/<query ID>_MANIFEST.json \
+// --signing_key_uri=/path/to/signing_key
+//
+// To verify an archive against the public keys of the helpers and extract it for review:
+// /path/to/query_archive --archive_uri=/path/to/query.tar --import_dir=/path/to/review \
+// --helper_public_keys=<base64 key of helper 1>,<base64 key of helper 2>
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/google/privacy-sandbox-aggregation-service/service/queryarchive"
+	"github.com/google/privacy-sandbox-aggregation-service/service/querytemplate"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+var (
+	archiveURI = flag.String("archive_uri", "", "The archive to export the query to, or to import.")
+	importDir  = flag.String("import_dir", "", "Directory where an imported archive is extracted after verification. The query is exported if empty.")
+
+	queryID            = flag.String("query_id", "", "ID of the exported query.")
+	querySpecFile      = flag.String("query_spec_file", "", "JSON file with the specification of the exported query, e.g. the aggregation request or the query template.")
+	queryParams        = flag.String("query_params", "", "Runtime parameters of the exported query in the format name1=value1,name2=value2.")
+	expansionConfigURI = flag.String("expansion_config_uri", "", "Expansion configuration of the exported query.")
+	resultManifestURIs = flag.String("result_manifest_uris", "", "Comma-separated result manifests of the exported query. The result files listed by the manifests are archived with them.")
+	resultURIs         = flag.String("result_uris", "", "Comma-separated URIs or globs of result files without manifests, which are archived with unsigned manifests. They can only be imported if the archive is signed with --signing_key_uri.")
+	signingKeyURI      = flag.String("signing_key_uri", "", "File with the base64-encoded Ed25519 seed of the helper, which signs the exported archive. The archive is not signed if empty.")
+
+	helperPublicKeys = flag.String("helper_public_keys", "", "Comma-separated base64-encoded Ed25519 public keys of the helpers, one of which must sign the imported archive or each of its result manifests.")
+)
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func export(ctx context.Context) error {
+	if *queryID == "" || *querySpecFile == "" {
+		return errors.New("--query_id and --query_spec_file are required for export")
+	}
+	if *resultManifestURIs == "" && *resultURIs == "" {
+		return errors.New("either --result_manifest_uris or --result_uris should be set")
+	}
+	b, err := utils.ReadBytes(ctx, *querySpecFile)
+	if err != nil {
+		return err
+	}
+	var spec json.RawMessage
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return fmt.Errorf("failed to parse query specification in %q: %v", *querySpecFile, err)
+	}
+	params, err := querytemplate.ParseParams(*queryParams)
+	if err != nil {
+		return err
+	}
+
+	var signingKey ed25519.PrivateKey
+	if *signingKeyURI != "" {
+		b, err := utils.ReadBytes(ctx, *signingKeyURI)
+		if err != nil {
+			return err
+		}
+		if signingKey, err = resultmanifest.ParsePrivateKey(strings.TrimSpace(string(b))); err != nil {
+			return err
+		}
+	}
+
+	manifest, err := queryarchive.Export(ctx, &queryarchive.ExportParams{
+		QueryID:            *queryID,
+		Spec:               spec,
+		Params:             params,
+		ExpandConfigURI:    *expansionConfigURI,
+		ResultManifestURIs: splitList(*resultManifestURIs),
+		ResultURIs:         splitList(*resultURIs),
+		SigningKey:         signingKey,
+	}, *archiveURI)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Exported query %q with %d entries to %s\n", manifest.QueryID, len(manifest.Entries), *archiveURI)
+	return nil
+}
+
+func importArchive(ctx context.Context) error {
+	var keys []ed25519.PublicKey
+	for _, encoded := range splitList(*helperPublicKeys) {
+		key, err := resultmanifest.ParsePublicKey(strings.TrimSpace(encoded))
+		if err != nil {
+			return fmt.Errorf("invalid helper public key %q: %v", encoded, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return errors.New("--helper_public_keys is required for import")
+	}
+	manifest, err := queryarchive.Import(ctx, *archiveURI, *importDir, keys)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(manifest.Entries))
+	for name := range manifest.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("Verified archive of query %q created at %s:\n", manifest.QueryID, manifest.Created)
+	for _, name := range names {
+		fmt.Printf("%s\t%s\n", manifest.Entries[name], name)
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	if *archiveURI == "" {
+		log.Exit("--archive_uri is required")
+	}
+	ctx := context.Background()
+	run := export
+	if *importDir != "" {
+		run = importArchive
+	}
+	if err := run(ctx); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This binary lets a third party verify the merged result of a query independently of the helpers.
+//
+// /path/to/verify_result \
+// --public_config_uri=/path/to/public_config.json \
+// --manifest_uri1=gs://<result bucket>/<query ID>_<origin1>_MANIFEST.json \
+// --manifest_uri2=gs://<result bucket>/<query ID>_<origin2>_MANIFEST.json \
+// --public_key1=<base64 Ed25519 key of helper 1> \
+// --public_key2=<base64 Ed25519 key of helper 2> \
+// --merged_result_uri=/path/to/merged_result
+//
+// The public configuration is a JSON-encoded resultverifier.PublicConfig. The report of the checks is printed, and the
+// binary exits with a nonzero code if any check fails.
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultmanifest"
+	"github.com/google/privacy-sandbox-aggregation-service/service/resultverifier"
+	"github.com/google/privacy-sandbox-aggregation-service/shared/utils"
+)
+
+var (
+	publicConfigURI = flag.String("public_config_uri", "", "JSON file of the public configuration of the query, with type resultverifier.PublicConfig.")
+	manifestURI1    = flag.String("manifest_uri1", "", "Signed result manifest of helper 1.")
+	manifestURI2    = flag.String("manifest_uri2", "", "Signed result manifest of helper 2.")
+	publicKey1      = flag.String("public_key1", "", "Base64-encoded Ed25519 public key that helper 1 signs the result manifests with.")
+	publicKey2      = flag.String("public_key2", "", "Base64-encoded Ed25519 public key that helper 2 signs the result manifests with.")
+	mergedResultURI = flag.String("merged_result_uri", "", "Merged result of the query, as written by the merge pipeline.")
+
+	sampleSize = flag.Int("sample_size", 1000, "Number of buckets sampled for checking the share combination. All buckets are checked if not positive.")
+	seed       = flag.Int64("seed", 0, "Seed for sampling the buckets, for reproducing a verification. A random seed is used if zero.")
+	reportURI  = flag.String("report_uri", "", "Output of the JSON report of the checks. The report is only printed if empty.")
+)
+
+func verify(ctx context.Context) (*resultverifier.Report, error) {
+	config, err := resultverifier.ReadPublicConfig(ctx, *publicConfigURI)
+	if err != nil {
+		return nil, err
+	}
+	var keys [2]ed25519.PublicKey
+	for i, encoded := range []string{*publicKey1, *publicKey2} {
+		if keys[i], err = resultmanifest.ParsePublicKey(encoded); err != nil {
+			return nil, fmt.Errorf("invalid public key of helper %d: %v", i+1, err)
+		}
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Infof("sampling %d buckets with seed %d", *sampleSize, *seed)
+	return resultverifier.Verify(ctx, &resultverifier.Params{
+		Config:          config,
+		ManifestURIs:    [2]string{*manifestURI1, *manifestURI2},
+		PublicKeys:      keys,
+		MergedResultURI: *mergedResultURI,
+		SampleSize:      *sampleSize,
+		Seed:            *seed,
+	})
+}
+
+func main() {
+	flag.Parse()
+	if *publicConfigURI == "" || *manifestURI1 == "" || *manifestURI2 == "" || *mergedResultURI == "" {
+		log.Exit("--public_config_uri, --manifest_uri1, --manifest_uri2 and --merged_result_uri are required")
+	}
+
+	ctx := context.Background()
+	report, err := verify(ctx)
+	if err != nil {
+		log.Exit(err)
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Exit(err)
+	}
+	if *reportURI != "" {
+		if err := utils.WriteBytes(ctx, b, *reportURI, nil); err != nil {
+			log.Exit(err)
+		}
+	}
+	fmt.Println(string(b))
+	if !report.Passed {
+		log.Errorf("result of query %q failed the verification", report.QueryID)
+		log.Flush()
+		os.Exit(1)
+	}
+}